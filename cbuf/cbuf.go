@@ -0,0 +1,392 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+/*
+
+Package cbuf implements a time series circular buffer: a fixed number of rows,
+each covering a fixed number of seconds, of float64 columns. Adding data for a
+time past the newest row advances the buffer, discarding the oldest rows. It
+is the Go counterpart of the sandbox `circular_buffer` Lua module, and reads
+and writes the same "cbuf" text format, so Go filters can produce data for the
+dashboard graphs and consume the output of sandbox filters.
+
+*/
+package cbuf
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// How a column's values are combined when rows are merged for display.
+const (
+	AGGREGATION_SUM  = "sum"
+	AGGREGATION_MIN  = "min"
+	AGGREGATION_MAX  = "max"
+	AGGREGATION_AVG  = "avg"
+	AGGREGATION_NONE = "none"
+)
+
+// Matches the characters that aren't allowed in column names and units.
+var invalidHeaderChars = regexp.MustCompile(`\W`)
+
+// Returned by Parse when the data isn't in the cbuf text format.
+var ErrInvalidFormat = errors.New("invalid cbuf format")
+
+// Describes a column of a CircularBuffer.
+type ColumnInfo struct {
+	Name        string `json:"name"`
+	Unit        string `json:"unit"`
+	Aggregation string `json:"aggregation"`
+}
+
+// Header of the cbuf text format.
+type header struct {
+	Time          int64        `json:"time"`
+	Rows          int          `json:"rows"`
+	Columns       int          `json:"columns"`
+	SecondsPerRow int64        `json:"seconds_per_row"`
+	ColumnInfo    []ColumnInfo `json:"column_info"`
+}
+
+// Time series circular buffer. Cells that haven't been set are NaN. A
+// CircularBuffer isn't safe for concurrent use.
+type CircularBuffer struct {
+	rows          int
+	columns       int
+	secondsPerRow int64
+	// Start time of the newest row, in seconds.
+	currentTime int64
+	// Index of the newest row.
+	currentRow int
+	headers    []ColumnInfo
+	values     []float64
+}
+
+// Creates a CircularBuffer of rows x columns cells, each row covering
+// secondsPerRow seconds.
+func New(rows, columns int, secondsPerRow int64) (*CircularBuffer, error) {
+	if rows < 2 {
+		return nil, errors.New("rows must be at least 2")
+	}
+	if columns < 1 {
+		return nil, errors.New("columns must be at least 1")
+	}
+	if secondsPerRow < 1 {
+		return nil, errors.New("seconds per row must be at least 1")
+	}
+	cb := &CircularBuffer{
+		rows:          rows,
+		columns:       columns,
+		secondsPerRow: secondsPerRow,
+		currentTime:   secondsPerRow * int64(rows-1),
+		currentRow:    rows - 1,
+		headers:       make([]ColumnInfo, columns),
+		values:        make([]float64, rows*columns),
+	}
+	for i := range cb.headers {
+		cb.headers[i] = ColumnInfo{
+			Name:        fmt.Sprintf("Column_%d", i+1),
+			Unit:        "count",
+			Aggregation: AGGREGATION_SUM,
+		}
+	}
+	for i := range cb.values {
+		cb.values[i] = math.NaN()
+	}
+	return cb, nil
+}
+
+func (cb *CircularBuffer) Rows() int {
+	return cb.rows
+}
+
+func (cb *CircularBuffer) Columns() int {
+	return cb.columns
+}
+
+func (cb *CircularBuffer) SecondsPerRow() int64 {
+	return cb.secondsPerRow
+}
+
+// Returns the start time of the newest row, in nanoseconds.
+func (cb *CircularBuffer) CurrentTime() int64 {
+	return cb.currentTime * 1e9
+}
+
+// Returns the descriptions of the columns.
+func (cb *CircularBuffer) Headers() []ColumnInfo {
+	headers := make([]ColumnInfo, len(cb.headers))
+	copy(headers, cb.headers)
+	return headers
+}
+
+// Sets the name, unit, and aggregation method of a column. Characters other
+// than letters, digits, and underscores in the name and unit are replaced w/
+// underscores.
+func (cb *CircularBuffer) SetHeader(column int, name, unit, aggregation string) error {
+	if err := cb.checkColumn(column); err != nil {
+		return err
+	}
+	switch aggregation {
+	case AGGREGATION_SUM, AGGREGATION_MIN, AGGREGATION_MAX, AGGREGATION_AVG,
+		AGGREGATION_NONE:
+	default:
+		return fmt.Errorf("invalid aggregation: %s", aggregation)
+	}
+	cb.headers[column] = ColumnInfo{
+		Name:        invalidHeaderChars.ReplaceAllString(name, "_"),
+		Unit:        invalidHeaderChars.ReplaceAllString(unit, "_"),
+		Aggregation: aggregation,
+	}
+	return nil
+}
+
+func (cb *CircularBuffer) checkColumn(column int) error {
+	if column < 0 || column >= cb.columns {
+		return fmt.Errorf("column out of range: %d", column)
+	}
+	return nil
+}
+
+// Returns the index of the row containing the time, in nanoseconds, advancing
+// the buffer if the time is past the newest row. Returns false if the time is
+// older than the oldest row.
+func (cb *CircularBuffer) row(ns int64, advance bool) (int, bool) {
+	t := ns / 1e9
+	t -= t % cb.secondsPerRow
+	delta := (t - cb.currentTime) / cb.secondsPerRow
+	if delta > 0 {
+		if !advance {
+			return 0, false
+		}
+		if delta >= int64(cb.rows) {
+			for i := range cb.values {
+				cb.values[i] = math.NaN()
+			}
+		} else {
+			for i := int64(0); i < delta; i++ {
+				cb.currentRow = (cb.currentRow + 1) % cb.rows
+				start := cb.currentRow * cb.columns
+				for j := start; j < start+cb.columns; j++ {
+					cb.values[j] = math.NaN()
+				}
+			}
+		}
+		cb.currentTime = t
+		return cb.currentRow, true
+	}
+	if -delta >= int64(cb.rows) {
+		return 0, false
+	}
+	return int((int64(cb.currentRow) + delta + int64(cb.rows)) % int64(cb.rows)), true
+}
+
+// Adds the value to a cell, returning the cell's new value. The time is in
+// nanoseconds. Returns false if the time is older than the oldest row.
+func (cb *CircularBuffer) Add(ns int64, column int, value float64) (float64, bool) {
+	if cb.checkColumn(column) != nil {
+		return 0, false
+	}
+	row, ok := cb.row(ns, true)
+	if !ok {
+		return 0, false
+	}
+	i := row*cb.columns + column
+	if math.IsNaN(cb.values[i]) {
+		cb.values[i] = value
+	} else {
+		cb.values[i] += value
+	}
+	return cb.values[i], true
+}
+
+// Overwrites a cell's value. The time is in nanoseconds. Returns false if the
+// time is older than the oldest row.
+func (cb *CircularBuffer) Set(ns int64, column int, value float64) bool {
+	if cb.checkColumn(column) != nil {
+		return false
+	}
+	row, ok := cb.row(ns, true)
+	if !ok {
+		return false
+	}
+	cb.values[row*cb.columns+column] = value
+	return true
+}
+
+// Returns a cell's value, NaN if it hasn't been set. The time is in
+// nanoseconds. Returns false if the time is outside of the buffer.
+func (cb *CircularBuffer) Get(ns int64, column int) (float64, bool) {
+	if cb.checkColumn(column) != nil {
+		return 0, false
+	}
+	row, ok := cb.row(ns, false)
+	if !ok {
+		return 0, false
+	}
+	return cb.values[row*cb.columns+column], true
+}
+
+// Computes the "sum", "avg", "sd" (standard deviation), "min", or "max" of a
+// column's values between the start and end times, in nanoseconds,
+// inclusive. Cells that haven't been set are ignored; NaN is returned if
+// there are none.
+func (cb *CircularBuffer) Compute(function string, column int, start, end int64) (
+	float64, error) {
+
+	if err := cb.checkColumn(column); err != nil {
+		return 0, err
+	}
+	if end < start {
+		return 0, errors.New("end time is before start time")
+	}
+	startRow, ok := cb.row(start, false)
+	if !ok {
+		return 0, errors.New("start time is outside of the buffer")
+	}
+	endRow, ok := cb.row(end, false)
+	if !ok {
+		return 0, errors.New("end time is outside of the buffer")
+	}
+
+	var values []float64
+	for row := startRow; ; row = (row + 1) % cb.rows {
+		if v := cb.values[row*cb.columns+column]; !math.IsNaN(v) {
+			values = append(values, v)
+		}
+		if row == endRow {
+			break
+		}
+	}
+	if len(values) == 0 {
+		return math.NaN(), nil
+	}
+
+	var result float64
+	switch function {
+	case "sum", "avg", "sd":
+		for _, v := range values {
+			result += v
+		}
+		if function == "sum" {
+			break
+		}
+		result /= float64(len(values))
+		if function == "sd" {
+			mean := result
+			result = 0
+			for _, v := range values {
+				result += (v - mean) * (v - mean)
+			}
+			result = math.Sqrt(result / float64(len(values)))
+		}
+	case "min":
+		result = values[0]
+		for _, v := range values[1:] {
+			result = math.Min(result, v)
+		}
+	case "max":
+		result = values[0]
+		for _, v := range values[1:] {
+			result = math.Max(result, v)
+		}
+	default:
+		return 0, fmt.Errorf("unknown function: %s", function)
+	}
+	return result, nil
+}
+
+// Returns the buffer in the cbuf text format: a JSON header line followed by
+// a line of tab separated column values per row, oldest first.
+func (cb *CircularBuffer) Format() []byte {
+	buf := new(bytes.Buffer)
+	h := header{
+		Time:          cb.currentTime - cb.secondsPerRow*int64(cb.rows-1),
+		Rows:          cb.rows,
+		Columns:       cb.columns,
+		SecondsPerRow: cb.secondsPerRow,
+		ColumnInfo:    cb.headers,
+	}
+	headerJson, _ := json.Marshal(h)
+	buf.Write(headerJson)
+	buf.WriteByte('\n')
+	for i := 1; i <= cb.rows; i++ {
+		row := (cb.currentRow + i) % cb.rows
+		for j := 0; j < cb.columns; j++ {
+			if j > 0 {
+				buf.WriteByte('\t')
+			}
+			v := cb.values[row*cb.columns+j]
+			if math.IsNaN(v) {
+				buf.WriteString("nan")
+			} else {
+				buf.WriteString(strconv.FormatFloat(v, 'g', -1, 64))
+			}
+		}
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes()
+}
+
+// Creates a CircularBuffer from data in the cbuf text format, such as the
+// output of a sandbox filter's circular buffer.
+func Parse(data []byte) (*CircularBuffer, error) {
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	if !scanner.Scan() {
+		return nil, ErrInvalidFormat
+	}
+	var h header
+	if err := json.Unmarshal(scanner.Bytes(), &h); err != nil {
+		return nil, ErrInvalidFormat
+	}
+	cb, err := New(h.Rows, h.Columns, h.SecondsPerRow)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", ErrInvalidFormat, err)
+	}
+	if len(h.ColumnInfo) == h.Columns {
+		copy(cb.headers, h.ColumnInfo)
+	}
+	cb.currentTime = h.Time + h.SecondsPerRow*int64(h.Rows-1)
+
+	for row := 0; row < h.Rows; row++ {
+		if !scanner.Scan() {
+			return nil, fmt.Errorf("%s: expected %d rows, got %d", ErrInvalidFormat,
+				h.Rows, row)
+		}
+		cols := strings.Split(scanner.Text(), "\t")
+		if len(cols) != h.Columns {
+			return nil, fmt.Errorf("%s: row %d has %d columns", ErrInvalidFormat,
+				row+1, len(cols))
+		}
+		for j, col := range cols {
+			if col == "nan" {
+				continue
+			}
+			v, err := strconv.ParseFloat(col, 64)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s", ErrInvalidFormat, err)
+			}
+			cb.values[row*cb.columns+j] = v
+		}
+	}
+	return cb, nil
+}
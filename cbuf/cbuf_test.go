@@ -0,0 +1,118 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package cbuf
+
+import (
+	"math"
+	"testing"
+)
+
+func TestAddAndAdvance(t *testing.T) {
+	cb, err := New(3, 2, 1)
+	if err != nil {
+		t.Fatalf("New failed: %s", err)
+	}
+	if v, ok := cb.Add(0, 0, 1); !ok || v != 1 {
+		t.Errorf("add to oldest row: got %v, %t", v, ok)
+	}
+	if v, ok := cb.Add(2e9, 0, 3); !ok || v != 3 {
+		t.Errorf("add to newest row: got %v, %t", v, ok)
+	}
+	if v, _ := cb.Add(2e9, 0, 3); v != 6 {
+		t.Errorf("expected a sum of 6, got %v", v)
+	}
+
+	// Advancing by one row drops the oldest row.
+	if !cb.Set(3e9, 1, 7) {
+		t.Fatalf("set failed")
+	}
+	if cb.CurrentTime() != 3e9 {
+		t.Errorf("expected current time 3e9, got %d", cb.CurrentTime())
+	}
+	if _, ok := cb.Get(0, 0); ok {
+		t.Errorf("expected the dropped row to be out of range")
+	}
+	if v, ok := cb.Get(3e9, 0); !ok || !math.IsNaN(v) {
+		t.Errorf("expected a new row to be NaN, got %v", v)
+	}
+	if _, ok := cb.Get(4e9, 0); ok {
+		t.Errorf("Get mustn't advance the buffer")
+	}
+	if _, ok := cb.Add(0, 2, 1); ok {
+		t.Errorf("expected an invalid column to fail")
+	}
+}
+
+func TestCompute(t *testing.T) {
+	cb, _ := New(4, 1, 1)
+	for i, v := range []float64{2, 4, 4} {
+		cb.Set(int64(i)*1e9, 0, v)
+	}
+	expected := map[string]float64{
+		"sum": 10,
+		"min": 2,
+		"max": 4,
+		"sd":  math.Sqrt(8.0 / 9.0),
+	}
+	for function, want := range expected {
+		got, err := cb.Compute(function, 0, 0, 3e9)
+		if err != nil {
+			t.Errorf("%s failed: %s", function, err)
+		} else if math.Abs(got-want) > 1e-9 {
+			t.Errorf("%s: expected %v, got %v", function, want, got)
+		}
+	}
+	if avg, _ := cb.Compute("avg", 0, 1e9, 2e9); avg != 4 {
+		t.Errorf("expected an avg of 4, got %v", avg)
+	}
+	if _, err := cb.Compute("median", 0, 0, 3e9); err == nil {
+		t.Errorf("expected an unknown function to fail")
+	}
+	if v, _ := cb.Compute("sum", 0, 3e9, 3e9); !math.IsNaN(v) {
+		t.Errorf("expected NaN for rows w/o data, got %v", v)
+	}
+}
+
+func TestFormatAndParse(t *testing.T) {
+	cb, _ := New(2, 2, 60)
+	cb.SetHeader(0, "Requests", "count", AGGREGATION_SUM)
+	cb.SetHeader(1, "Response Time", "ms", AGGREGATION_AVG)
+	cb.Set(60e9, 0, 5)
+	cb.Set(60e9, 1, 1.5)
+
+	expected := `{"time":0,"rows":2,"columns":2,"seconds_per_row":60,"column_info":` +
+		`[{"name":"Requests","unit":"count","aggregation":"sum"},` +
+		`{"name":"Response_Time","unit":"ms","aggregation":"avg"}]}` + "\n" +
+		"nan\tnan\n5\t1.5\n"
+	formatted := cb.Format()
+	if string(formatted) != expected {
+		t.Fatalf("expected:\n%s\ngot:\n%s", expected, formatted)
+	}
+
+	parsed, err := Parse(formatted)
+	if err != nil {
+		t.Fatalf("Parse failed: %s", err)
+	}
+	if string(parsed.Format()) != expected {
+		t.Errorf("round trip changed the data:\n%s", parsed.Format())
+	}
+	if v, _ := parsed.Get(60e9, 1); v != 1.5 {
+		t.Errorf("expected 1.5, got %v", v)
+	}
+
+	if _, err = Parse([]byte("{}\n")); err == nil {
+		t.Errorf("expected an invalid header to fail")
+	}
+}
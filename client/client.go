@@ -17,6 +17,18 @@
 
 Client package to talk to heka from Go.
 
+A Client encodes messages w/ a StreamEncoder, which adds the Heka stream
+framing and, optionally, a message signature, and hands the result to a
+Sender. NetworkSender writes to a single TCP, UDP, or Unix socket connection,
+ReconnectingSender redials whenever a write fails, and AsyncSender queues
+messages so sending never blocks the application:
+
+	sender := client.NewAsyncSender(
+		client.NewReconnectingSender("tcp", "127.0.0.1:5565"), 1000)
+	c := client.NewClient(sender, client.NewProtobufEncoder(nil))
+	defer sender.Close()
+	err := c.SendMessage(msg)
+
 */
 package client
 
@@ -23,6 +23,7 @@ import (
 	"fmt"
 	"github.com/mozilla-services/heka/message"
 	"hash"
+	"hash/crc32"
 )
 
 type Encoder interface {
@@ -36,10 +37,26 @@ type StreamEncoder interface {
 
 type ProtobufEncoder struct {
 	Signer *message.MessageSigningConfig
+	// Version of the stream framing used by EncodeMessageStream, 1 or 2.
+	// Defaults to 1.
+	FramingVersion int
+	// Whether the stream framing includes a checksum of the message.
+	Checksum bool
+}
+
+// Options for the Heka stream framing added by CreateFramedRecord.
+type FramingOptions struct {
+	// Signs the message if not nil.
+	Signer *message.MessageSigningConfig
+	// Framing version, 1 or 2. Defaults to 1.
+	Version int
+	// If true, the header includes a CRC-32 checksum of the message, which
+	// receivers verify before decoding it.
+	Checksum bool
 }
 
 func NewProtobufEncoder(signer *message.MessageSigningConfig) *ProtobufEncoder {
-	return &ProtobufEncoder{signer}
+	return &ProtobufEncoder{Signer: signer}
 }
 
 func (p *ProtobufEncoder) EncodeMessage(msg *message.Message) ([]byte, error) {
@@ -53,7 +70,11 @@ func (p *ProtobufEncoder) EncodeMessageStream(msg *message.Message,
 	// TODO if we compute the size of the header first this can be marshaled
 	// directly to outBytes.
 	if err == nil {
-		err = CreateHekaStream(msgBytes, outBytes, p.Signer)
+		err = CreateFramedRecord(msgBytes, outBytes, FramingOptions{
+			Signer:   p.Signer,
+			Version:  p.FramingVersion,
+			Checksum: p.Checksum,
+		})
 	}
 	return
 }
@@ -61,29 +82,36 @@ func (p *ProtobufEncoder) EncodeMessageStream(msg *message.Message,
 func CreateHekaStream(msgBytes []byte, outBytes *[]byte,
 	msc *message.MessageSigningConfig) error {
 
-	msgSize := uint32(len(msgBytes))
-	if msgSize > message.MAX_MESSAGE_SIZE {
-		return fmt.Errorf("Message too big, requires %d (MAX_MESSAGE_SIZE = %d)",
-			len(msgBytes), message.MAX_MESSAGE_SIZE)
-	}
+	return CreateFramedRecord(msgBytes, outBytes, FramingOptions{Signer: msc})
+}
 
-	h := &message.Header{}
-	h.SetMessageLength(msgSize)
-	if msc != nil {
-		h.SetHmacSigner(msc.Name)
-		h.SetHmacKeyVersion(msc.Version)
-		var hm hash.Hash
-		switch msc.Hash {
-		case "sha1":
-			hm = hmac.New(sha1.New, []byte(msc.Key))
-			h.SetHmacHashFunction(message.Header_SHA1)
-		default:
-			hm = hmac.New(md5.New, []byte(msc.Key))
-		}
+// Like CreateHekaStream, but uses version 2 of the stream framing, which
+// allows much larger headers and protects them w/ a checksum.
+func CreateHekaStreamV2(msgBytes []byte, outBytes *[]byte,
+	msc *message.MessageSigningConfig) error {
 
-		hm.Write(msgBytes)
-		h.SetHmac(hm.Sum(nil))
+	return CreateFramedRecord(msgBytes, outBytes, FramingOptions{Signer: msc,
+		Version: 2})
+}
+
+// Writes the message, w/ the Heka stream framing described by the options
+// prepended, to outBytes.
+func CreateFramedRecord(msgBytes []byte, outBytes *[]byte, opts FramingOptions) error {
+	h, err := newHeader(msgBytes, opts.Signer)
+	if err != nil {
+		return err
+	}
+	if opts.Checksum {
+		h.SetMessageCrc32(crc32.ChecksumIEEE(msgBytes))
 	}
+	if opts.Version == 2 {
+		if *outBytes, err = message.AppendFramingV2((*outBytes)[:0], h); err != nil {
+			return err
+		}
+		*outBytes = append(*outBytes, msgBytes...)
+		return nil
+	}
+
 	headerSize := proto.Size(h)
 	if headerSize > message.MAX_HEADER_SIZE {
 		return fmt.Errorf("Message header too big, requires %d (MAX_HEADER_SIZE = %d)",
@@ -109,3 +137,34 @@ func CreateHekaStream(msgBytes []byte, outBytes *[]byte,
 	copy((*outBytes)[message.HEADER_FRAMING_SIZE+headerSize:], msgBytes)
 	return nil
 }
+
+// Creates the stream framing header for the message, signing it if a
+// signing config is provided.
+func newHeader(msgBytes []byte, msc *message.MessageSigningConfig) (
+	*message.Header, error) {
+
+	msgSize := uint32(len(msgBytes))
+	if msgSize > message.MAX_MESSAGE_SIZE {
+		return nil, fmt.Errorf("Message too big, requires %d (MAX_MESSAGE_SIZE = %d)",
+			len(msgBytes), message.MAX_MESSAGE_SIZE)
+	}
+
+	h := &message.Header{}
+	h.SetMessageLength(msgSize)
+	if msc != nil {
+		h.SetHmacSigner(msc.Name)
+		h.SetHmacKeyVersion(msc.Version)
+		var hm hash.Hash
+		switch msc.Hash {
+		case "sha1":
+			hm = hmac.New(sha1.New, []byte(msc.Key))
+			h.SetHmacHashFunction(message.Header_SHA1)
+		default:
+			hm = hmac.New(md5.New, []byte(msc.Key))
+		}
+
+		hm.Write(msgBytes)
+		h.SetHmac(hm.Sum(nil))
+	}
+	return h, nil
+}
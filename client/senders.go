@@ -17,14 +17,21 @@ package client
 
 import (
 	"crypto/tls"
+	"errors"
 	"net"
+	"sync"
+	"time"
 )
 
+// Sends framed, and optionally signed, message data produced by a
+// StreamEncoder to Heka.
 type Sender interface {
 	SendMessage(outBytes []byte) (err error)
 	Close()
 }
 
+// Sender writing to a single network connection. Any protocol supported by
+// `net.Dial` can be used, e.g. "tcp", "udp", or "unix".
 type NetworkSender struct {
 	connection net.Conn
 }
@@ -55,3 +62,138 @@ func (self *NetworkSender) SendMessage(outBytes []byte) (err error) {
 func (self *NetworkSender) Close() {
 	self.connection.Close()
 }
+
+// Returned by an AsyncSender when its queue has no room for another message.
+var ErrQueueFull = errors.New("send queue is full")
+
+// Sender that connects on demand and reconnects if a write fails, so a Heka
+// restart doesn't require the application to recreate its client.
+type ReconnectingSender struct {
+	// Number of times a failed send is retried over a new connection before
+	// the error is returned. -1 means retry forever.
+	MaxRetries int
+	// Delay before the first retry, doubled after each failed attempt up to
+	// MaxDelay.
+	Delay    time.Duration
+	MaxDelay time.Duration
+
+	dial func() (net.Conn, error)
+	conn net.Conn
+	lock sync.Mutex
+}
+
+// Creates a ReconnectingSender using the provided `net.Dial` protocol. No
+// connection is made until the first message is sent.
+func NewReconnectingSender(proto, addr string) *ReconnectingSender {
+	return newReconnectingSender(func() (net.Conn, error) {
+		return net.Dial(proto, addr)
+	})
+}
+
+// Creates a ReconnectingSender that connects using TLS.
+func NewReconnectingTlsSender(proto, addr string, config *tls.Config) *ReconnectingSender {
+	return newReconnectingSender(func() (net.Conn, error) {
+		return tls.Dial(proto, addr, config)
+	})
+}
+
+func newReconnectingSender(dial func() (net.Conn, error)) *ReconnectingSender {
+	return &ReconnectingSender{
+		MaxRetries: 3,
+		Delay:      250 * time.Millisecond,
+		MaxDelay:   30 * time.Second,
+		dial:       dial,
+	}
+}
+
+func (self *ReconnectingSender) SendMessage(outBytes []byte) (err error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	delay := self.Delay
+	for attempt := 0; ; attempt++ {
+		if self.conn == nil {
+			self.conn, err = self.dial()
+		}
+		if err == nil {
+			if _, err = self.conn.Write(outBytes); err == nil {
+				return nil
+			}
+			self.conn.Close()
+			self.conn = nil
+		}
+		if self.MaxRetries >= 0 && attempt >= self.MaxRetries {
+			return err
+		}
+		time.Sleep(delay)
+		if delay *= 2; delay > self.MaxDelay {
+			delay = self.MaxDelay
+		}
+	}
+}
+
+func (self *ReconnectingSender) Close() {
+	self.lock.Lock()
+	if self.conn != nil {
+		self.conn.Close()
+		self.conn = nil
+	}
+	self.lock.Unlock()
+}
+
+// Sender that queues messages and sends them from a separate goroutine
+// through another Sender, so the application isn't blocked by a slow or
+// unavailable Heka. Messages sent when the queue is full are rejected w/
+// ErrQueueFull.
+type AsyncSender struct {
+	// Called w/ any error returned by the wrapped Sender. Defaults to
+	// logging the error. Must be set before the first message is sent.
+	ErrorHandler func(err error)
+
+	sender Sender
+	queue  chan []byte
+	done   chan struct{}
+}
+
+// Creates an AsyncSender that queues up to queueSize messages for the
+// provided sender.
+func NewAsyncSender(sender Sender, queueSize int) *AsyncSender {
+	self := &AsyncSender{
+		ErrorHandler: func(err error) {
+			LogError.Printf("Error sending message: %s", err)
+		},
+		sender: sender,
+		queue:  make(chan []byte, queueSize),
+		done:   make(chan struct{}),
+	}
+	go self.run()
+	return self
+}
+
+func (self *AsyncSender) run() {
+	defer close(self.done)
+	for outBytes := range self.queue {
+		if err := self.sender.SendMessage(outBytes); err != nil {
+			self.ErrorHandler(err)
+		}
+	}
+}
+
+// Queues a copy of the message data, so the caller may reuse outBytes.
+func (self *AsyncSender) SendMessage(outBytes []byte) (err error) {
+	queued := make([]byte, len(outBytes))
+	copy(queued, outBytes)
+	select {
+	case self.queue <- queued:
+		return nil
+	default:
+		return ErrQueueFull
+	}
+}
+
+// Sends any queued messages, then closes the wrapped Sender. Messages must
+// not be sent after Close is called.
+func (self *AsyncSender) Close() {
+	close(self.queue)
+	<-self.done
+	self.sender.Close()
+}
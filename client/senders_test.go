@@ -0,0 +1,137 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package client
+
+import (
+	"io/ioutil"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Accepts connections, sending all of the data read from each to recvChan.
+func acceptAll(listener net.Listener, recvChan chan []byte) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			data, _ := ioutil.ReadAll(conn)
+			recvChan <- data
+		}()
+	}
+}
+
+func TestReconnectingSenderReconnects(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("can't listen: %s", err)
+	}
+	defer listener.Close()
+	recvChan := make(chan []byte, 2)
+	go acceptAll(listener, recvChan)
+
+	sender := NewReconnectingSender("tcp", listener.Addr().String())
+	sender.Delay = time.Millisecond
+	if err = sender.SendMessage([]byte("first")); err != nil {
+		t.Fatalf("first send failed: %s", err)
+	}
+	// Simulate a dropped connection.
+	sender.conn.Close()
+	if err = sender.SendMessage([]byte("second")); err != nil {
+		t.Fatalf("send after disconnect failed: %s", err)
+	}
+	sender.Close()
+
+	received := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		select {
+		case data := <-recvChan:
+			received[string(data)] = true
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for data")
+		}
+	}
+	if !received["first"] || !received["second"] {
+		t.Errorf("expected both messages, received: %v", received)
+	}
+}
+
+func TestReconnectingSenderGivesUp(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("can't listen: %s", err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+
+	sender := NewReconnectingSender("tcp", addr)
+	sender.Delay = time.Millisecond
+	sender.MaxRetries = 2
+	if err = sender.SendMessage([]byte("lost")); err == nil {
+		t.Errorf("expected an error sending to a closed port")
+	}
+}
+
+type recordingSender struct {
+	lock     sync.Mutex
+	received []string
+	block    chan struct{}
+	closed   bool
+}
+
+func (r *recordingSender) SendMessage(outBytes []byte) error {
+	<-r.block
+	r.lock.Lock()
+	r.received = append(r.received, string(outBytes))
+	r.lock.Unlock()
+	return nil
+}
+
+func (r *recordingSender) Close() {
+	r.closed = true
+}
+
+func TestAsyncSender(t *testing.T) {
+	recorder := &recordingSender{block: make(chan struct{})}
+	sender := NewAsyncSender(recorder, 1)
+
+	buf := []byte("one")
+	if err := sender.SendMessage(buf); err != nil {
+		t.Fatalf("first send failed: %s", err)
+	}
+	// Modifying the buffer mustn't change the queued message.
+	copy(buf, "xxx")
+	// Fill the queue while the first message is blocked in the sender, or
+	// still queued.
+	var err error
+	for i := 0; i < 3 && err == nil; i++ {
+		err = sender.SendMessage([]byte("two"))
+	}
+	if err != ErrQueueFull {
+		t.Errorf("expected ErrQueueFull, got: %v", err)
+	}
+
+	close(recorder.block)
+	sender.Close()
+	if !recorder.closed {
+		t.Errorf("wrapped sender wasn't closed")
+	}
+	if len(recorder.received) == 0 || recorder.received[0] != "one" {
+		t.Errorf("unexpected messages sent: %v", recorder.received)
+	}
+}
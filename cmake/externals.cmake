@@ -154,6 +154,16 @@ git_clone(https://github.com/crankycoder/g2s 2594f7a035ed881bb10618bc5dc4440ef35
 git_clone(https://github.com/crankycoder/xmlpath 670b185b686fd11aa115291fb2f6dc3ed7ebb488)
 git_clone(https://github.com/thoj/go-ircevent 90dc7f966b95d133f1c65531c6959b52effd5e40)
 git_clone(https://github.com/cactus/gostrftime 4544856e3a415ff5668bb75fed36726240ea1f8d)
+git_clone(https://github.com/go-sql-driver/mysql v1.2)
+git_clone(https://github.com/lib/pq 4ded0e9383f75c197b3a2aaa6d590ac52df6fd79)
+git_clone(https://gopkg.in/mgo.v2 r2015.06.03)
+git_clone(https://gopkg.in/inf.v0 v0.9.0)
+git_clone(https://github.com/gocql/gocql 3a5b1a0e2ba1a33b4bf4b3cc4bd87d4da6a7e1cb)
+add_dependencies(gocql snappy-go inf.v0)
+git_clone(https://github.com/syndtr/goleveldb 832fa7ed4d28545eab80f19e1831fc004305cade)
+add_dependencies(goleveldb snappy-go)
+git_clone(https://github.com/mattn/go-xmpp 8b13d0ad771420685f85ed09d8e9bf81757e1e20)
+git_clone(https://github.com/gorilla/websocket ea4d1f681babbce9545c9c5f3d5194a789c89f5b)
 
 hg_clone(https://code.google.com/p/snappy-go default)
 git_clone(https://github.com/Shopify/sarama ab8518c05fd3775bdbf06c97d97389fe8af2dfef)
@@ -0,0 +1,8 @@
+if(NOT PROTOBUF_EXECUTABLE)
+    message(FATAL_ERROR "Google protocol buffers 'protoc' must be installed, riemann.proto has been modified and needs to be regenerated.")
+endif()
+
+execute_process(
+COMMAND ${PROTOBUF_EXECUTABLE} --gogo_out=. -I=. riemann.proto
+WORKING_DIRECTORY "${SRC_DIR}/plugins/riemann"
+)
@@ -28,9 +28,11 @@ import (
 	"fmt"
 	"github.com/mozilla-services/heka/message"
 	"github.com/mozilla-services/heka/pipeline"
+	"github.com/mozilla-services/heka/plugins/archive"
 	"io"
 	"math"
 	"os"
+	"strconv"
 	"time"
 )
 
@@ -46,6 +48,47 @@ func makeSplitterRunner() (pipeline.SplitterRunner, error) {
 	return sRunner, nil
 }
 
+// Parses a time range bound, either an RFC 3339 timestamp or a count of
+// nanoseconds since the epoch. An empty value returns the provided default.
+func parseTimeBound(value string, def int64) (int64, error) {
+	if value == "" {
+		return def, nil
+	}
+	if ns, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return ns, nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil {
+		return 0, fmt.Errorf("expected an RFC 3339 timestamp or nanoseconds "+
+			"since the epoch, got '%s'", value)
+	}
+	return t.UnixNano(), nil
+}
+
+// Uses the sidecar index of the input file to find the part of it holding
+// the time range. Returns the offset to start reading at, and the offsets
+// between which the index says there's nothing to read, or -1 if there's
+// nothing to skip.
+func seekByIndex(path string, size, start, end int64) (from, skipFrom,
+	skipTo int64, err error) {
+
+	idx, err := archive.Read(archive.IndexPath(path))
+	if err != nil {
+		return 0, -1, -1, err
+	}
+	if idx.Size > size {
+		return 0, -1, -1, fmt.Errorf("index covers %d bytes, the file only has %d",
+			idx.Size, size)
+	}
+	from, to := idx.Range(start, end)
+	// Records past the index's size aren't in it and are always read.
+	skipFrom, skipTo = -1, -1
+	if to < idx.Size {
+		skipFrom, skipTo = to, idx.Size
+	}
+	return
+}
+
 func main() {
 	flagMatch := flag.String("match", "TRUE", "message_matcher filter expression")
 	flagFormat := flag.String("format", "txt", "output format [txt|json|heka|count]")
@@ -53,6 +96,12 @@ func main() {
 	flagTail := flag.Bool("tail", false, "don't exit on EOF")
 	flagOffset := flag.Int64("offset", 0, "starting offset for the input file in bytes")
 	flagMaxMessageSize := flag.Uint64("max-message-size", 4*1024*1024, "maximum message size in bytes")
+	flagStart := flag.String("start", "", "only include messages w/ a timestamp at or after this time "+
+		"(RFC 3339 or nanoseconds since the epoch)")
+	flagEnd := flag.String("end", "", "only include messages w/ a timestamp before this time "+
+		"(RFC 3339 or nanoseconds since the epoch)")
+	flagIndex := flag.Bool("index", true, "use the input file's index, if there is one, "+
+		"to only read the part of it holding the -start/-end time range")
 	flag.Parse()
 
 	if flag.NArg() != 1 {
@@ -75,6 +124,16 @@ func main() {
 		os.Exit(2)
 	}
 
+	var start, end int64
+	if start, err = parseTimeBound(*flagStart, math.MinInt64); err != nil {
+		fmt.Fprintf(os.Stderr, "Start time - %s\n", err)
+		os.Exit(2)
+	}
+	if end, err = parseTimeBound(*flagEnd, math.MaxInt64); err != nil {
+		fmt.Fprintf(os.Stderr, "End time - %s\n", err)
+		os.Exit(2)
+	}
+
 	var file *os.File
 	if file, err = os.Open(flag.Arg(0)); err != nil {
 		fmt.Fprintf(os.Stderr, "%s\n", err)
@@ -93,8 +152,22 @@ func main() {
 		defer out.Close()
 	}
 
+	seekTo, skipFrom, skipTo := *flagOffset, int64(-1), int64(-1)
+	if *flagIndex && *flagOffset == 0 && (*flagStart != "" || *flagEnd != "") {
+		fi, e := file.Stat()
+		if e == nil {
+			seekTo, skipFrom, skipTo, e = seekByIndex(flag.Arg(0), fi.Size(), start, end)
+		}
+		if e == nil {
+			fmt.Fprintf(os.Stderr, "Using index %s, starting at offset %d\n",
+				archive.IndexPath(flag.Arg(0)), seekTo)
+		} else if !os.IsNotExist(e) {
+			fmt.Fprintf(os.Stderr, "Not using index - %s\n", e)
+		}
+	}
+
 	var offset int64
-	if offset, err = file.Seek(*flagOffset, 0); err != nil {
+	if offset, err = file.Seek(seekTo, 0); err != nil {
 		fmt.Fprintf(os.Stderr, "%s\n", err)
 		os.Exit(5)
 	}
@@ -110,6 +183,15 @@ func main() {
 	fmt.Fprintf(os.Stderr, "Input:%s  Offset:%d  Match:%s  Format:%s  Tail:%t  Output:%s\n",
 		flag.Arg(0), *flagOffset, *flagMatch, *flagFormat, *flagTail, *flagOutput)
 	for true {
+		if offset >= skipFrom && offset < skipTo {
+			if offset, err = file.Seek(skipTo, 0); err != nil {
+				break
+			}
+			// Drop the data buffered from before the skipped part.
+			if sRunner, err = makeSplitterRunner(); err != nil {
+				break
+			}
+		}
 		n, record, err := sRunner.GetRecordFromStream(file)
 		if n > 0 && n != len(record) {
 			fmt.Fprintf(os.Stderr, "Corruption detected at offset: %d bytes: %d\n", offset, n-len(record))
@@ -126,13 +208,19 @@ func main() {
 		} else {
 			if len(record) > 0 {
 				processed += 1
-				headerLen := int(record[1]) + message.HEADER_FRAMING_SIZE
+				headerLen := message.FramedMessageStart(record)
 				if err = proto.Unmarshal(record[headerLen:], msg); err != nil {
 					fmt.Fprintf(os.Stderr, "Error unmarshalling message at offset: %d error: %s\n", offset, err)
+					offset += int64(n)
 					continue
 				}
 
+				if msg.GetTimestamp() < start || msg.GetTimestamp() >= end {
+					offset += int64(n)
+					continue
+				}
 				if !match.Match(msg) {
+					offset += int64(n)
 					continue
 				}
 				matched += 1
@@ -24,11 +24,15 @@ pipeline.
 package main
 
 import (
+	"bufio"
 	"code.google.com/p/go-uuid/uuid"
 	"flag"
+	"fmt"
 	"github.com/mozilla-services/heka/client"
 	"github.com/mozilla-services/heka/message"
+	"io"
 	"os"
+	"strings"
 	"time"
 )
 
@@ -38,15 +42,21 @@ type HekaClient struct {
 	sender  client.Sender        // e.g. tcp
 }
 
-// NewHekaClient returns a new HekaClient with pre-defined encoder and sender.
-func NewHekaClient(hi string) (hc *HekaClient, err error) {
+// NewHekaClient returns a new HekaClient with a protobuf encoder, signing
+// messages w/ the provided signer config if it isn't nil, and a sender using
+// the specified protocol ("tcp" or "udp").
+func NewHekaClient(proto, hi string, signer *message.MessageSigningConfig) (
+	hc *HekaClient, err error) {
+
+	if proto != "tcp" && proto != "udp" {
+		return nil, fmt.Errorf("unsupported protocol: %s", proto)
+	}
 	hc = &HekaClient{}
-	hc.encoder = client.NewProtobufEncoder(nil)
-	hc.sender, err = client.NewNetworkSender("tcp", hi)
-	if err == nil {
-		return hc, nil
+	hc.encoder = client.NewProtobufEncoder(signer)
+	if hc.sender, err = client.NewNetworkSender(proto, hi); err != nil {
+		return nil, err
 	}
-	return
+	return hc, nil
 }
 
 type InjectData struct {
@@ -71,38 +81,73 @@ func (hc *HekaClient) injectMessage(m *InjectData) (err error) {
 	msg.SetHostname(m.hostname)
 	msg.SetPayload(string(m.payload))
 
-	err = hc.encoder.EncodeMessageStream(msg, &stream)
-	if err != nil {
-		client.LogError.Printf("Inject: [error] encode message: %s\n", err)
+	if err = hc.encoder.EncodeMessageStream(msg, &stream); err != nil {
+		return fmt.Errorf("encode message: %s", err)
 	}
-	err = hc.sender.SendMessage(stream)
-	if err != nil {
-		client.LogError.Printf("Inject: [error] send message: %s\n", err)
+	if err = hc.sender.SendMessage(stream); err != nil {
+		return fmt.Errorf("send message: %s", err)
 	}
 	return nil
 }
 
+// Calls send w/ each payload: the -payload flag's value if it was set, else
+// each of the command line arguments, else each line read from stdin.
+func eachPayload(flagPayload string, payloadSet bool, args []string,
+	stdin io.Reader, send func(payload string)) (err error) {
+
+	if payloadSet {
+		send(flagPayload)
+		return
+	}
+	if len(args) > 0 {
+		for _, arg := range args {
+			send(arg)
+		}
+		return
+	}
+	scanner := bufio.NewScanner(stdin)
+	for scanner.Scan() {
+		send(scanner.Text())
+	}
+	if err = scanner.Err(); err != nil {
+		return fmt.Errorf("reading stdin: %s", err)
+	}
+	return
+}
+
 func main() {
 	flagHekaInstance := flag.String("heka", "127.0.0.1:5565", "Heka instance to inject message")
+	flagProto := flag.String("proto", "tcp", "Protocol used to reach the Heka instance [tcp|udp]")
 	flagType := flag.String("type", "inject.message", "Type of message")
 	flagLogger := flag.String("logger", "Inject Client", "Data source")
 	flagSeverity := flag.Int("severity", 7, "Syslog severity level")
-	flagPayload := flag.String("payload", "", "Textual data")
+	flagPayload := flag.String("payload", "", "Textual data, if not set each argument "+
+		"or, w/o arguments, each line of stdin is sent as a separate message")
 	flagPid := flag.Int("pid", 0, "Process ID generating message")
 	flagHostname := flag.String("hostname", "", "Hostname generating message")
+	flagSigner := flag.String("signer", "", "Name of the message signer, if signing")
+	flagKey := flag.String("key", "", "HMAC key used to sign messages")
+	flagHash := flag.String("hash", "md5", "HMAC hash algorithm used to sign messages [md5|sha1]")
+	flagKeyVersion := flag.Uint("keyversion", 0, "Version of the HMAC signing key")
 
 	flag.Parse()
 
-	if flag.NFlag() == 0 {
+	if flag.NFlag() == 0 && flag.NArg() == 0 {
 		flag.PrintDefaults()
 		os.Exit(0)
 	}
 
+	payloadSet := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "payload" {
+			payloadSet = true
+		}
+	})
+
 	data := &InjectData{
 		mtype:    *flagType,
 		logger:   *flagLogger,
 		severity: *flagSeverity,
-		payload:  *flagPayload,
 	}
 
 	if *flagPid == 0 {
@@ -117,11 +162,40 @@ func main() {
 		data.hostname = *flagHostname
 	}
 
-	hc, err := NewHekaClient(*flagHekaInstance)
-	if err == nil {
-		err := hc.injectMessage(data)
-		if err != nil {
-			client.LogError.Printf("Inject: [error] %s\n", err)
+	var signer *message.MessageSigningConfig
+	if *flagSigner != "" {
+		hash := strings.ToLower(*flagHash)
+		if hash != "md5" && hash != "sha1" {
+			client.LogError.Printf("Inject: [error] unsupported hash: %s\n", *flagHash)
+			os.Exit(1)
+		}
+		signer = &message.MessageSigningConfig{
+			Name:    *flagSigner,
+			Hash:    hash,
+			Key:     *flagKey,
+			Version: uint32(*flagKeyVersion),
 		}
 	}
+
+	hc, err := NewHekaClient(*flagProto, *flagHekaInstance, signer)
+	if err != nil {
+		client.LogError.Printf("Inject: [error] %s\n", err)
+		os.Exit(1)
+	}
+
+	status := 0
+	err = eachPayload(*flagPayload, payloadSet, flag.Args(), os.Stdin,
+		func(payload string) {
+			data.payload = payload
+			if err := hc.injectMessage(data); err != nil {
+				client.LogError.Printf("Inject: [error] %s\n", err)
+				status = 1
+			}
+		})
+	if err != nil {
+		client.LogError.Printf("Inject: [error] %s\n", err)
+		status = 1
+	}
+	hc.sender.Close()
+	os.Exit(status)
 }
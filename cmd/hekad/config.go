@@ -21,10 +21,8 @@ import (
 	"fmt"
 	"github.com/bbangert/toml"
 	"github.com/mozilla-services/heka/pipeline"
-	"io/ioutil"
 	"os"
 	"path/filepath"
-	"strings"
 	"time"
 )
 
@@ -45,6 +43,30 @@ type HekadConfig struct {
 	PidFile               string        `toml:"pid_file"`
 	Hostname              string
 	MaxMessageSize        uint32 `toml:"max_message_size"`
+	ShutdownTimeout       uint   `toml:"shutdown_timeout"`
+	ReportInterval        uint   `toml:"report_interval"`
+	AdminAddress          string `toml:"admin_address"`
+	AdminToken            string `toml:"admin_token"`
+	PoolOverflow          string `toml:"pool_overflow"`
+	PoolOverflowMax       int    `toml:"pool_overflow_max"`
+	FillMessageDefaults   bool   `toml:"fill_message_defaults"`
+	TenantSource          string `toml:"tenant_source"`
+	TenantField           string `toml:"tenant_field"`
+	TenantMaxRate         uint   `toml:"tenant_max_rate"`
+	TenantMaxCount        int    `toml:"tenant_max_count"`
+	TenantIdleTimeout     uint   `toml:"tenant_idle_timeout"`
+	User                  string `toml:"user"`
+	Group                 string `toml:"group"`
+	MaxOpenFiles          uint64 `toml:"max_open_files"`
+	MaxInputProcs         int    `toml:"max_input_procs"`
+	MaxDecoderProcs       int    `toml:"max_decoder_procs"`
+	MaxOutputProcs        int    `toml:"max_output_procs"`
+	AutosizePools         bool   `toml:"autosize_pools"`
+	MemoryBudget          uint64 `toml:"memory_budget"`
+	StallTimeout          uint   `toml:"stall_timeout"`
+	StallShutdown         bool   `toml:"stall_shutdown"`
+	LogMessages           bool   `toml:"log_messages"`
+	NodeReportInterval    uint   `toml:"node_report_interval"`
 }
 
 func LoadHekadConfig(configPath string) (config *HekadConfig, err error) {
@@ -69,37 +91,17 @@ func LoadHekadConfig(configPath string) (config *HekadConfig, err error) {
 		SampleDenominator:     1000,
 		PidFile:               "",
 		Hostname:              hostname,
+		TenantMaxCount:        1000,
+		TenantIdleTimeout:     3600,
 	}
 
 	var configFile map[string]toml.Primitive
-	p, err := os.Open(configPath)
+	paths, err := pipeline.ConfigFilePaths(configPath)
 	if err != nil {
-		return nil, fmt.Errorf("Error opening config file: %s", err)
+		return nil, err
 	}
-	fi, err := p.Stat()
-	if err != nil {
-		return nil, fmt.Errorf("Error fetching config file info: %s", err)
-	}
-
-	if fi.IsDir() {
-		files, _ := ioutil.ReadDir(configPath)
-		for _, f := range files {
-			fName := f.Name()
-			if !strings.HasSuffix(fName, ".toml") {
-				// Skip non *.toml files in a config dir.
-				continue
-			}
-			fPath := filepath.Join(configPath, fName)
-			contents, err := pipeline.ReplaceEnvsFile(fPath)
-			if err != nil {
-				return nil, err
-			}
-			if _, err = toml.Decode(contents, &configFile); err != nil {
-				return nil, fmt.Errorf("Error decoding config file: %s", err)
-			}
-		}
-	} else {
-		contents, err := pipeline.ReplaceEnvsFile(configPath)
+	for _, fPath := range paths {
+		contents, err := pipeline.ReplaceEnvsFile(fPath)
 		if err != nil {
 			return nil, err
 		}
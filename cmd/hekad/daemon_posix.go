@@ -0,0 +1,126 @@
+// +build !windows
+
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Raises the soft limit on open file descriptors to n, raising the hard
+// limit as well if needed (which requires root privileges).
+func setMaxOpenFiles(n uint64) error {
+	var rlimit syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &rlimit); err != nil {
+		return err
+	}
+	rlimit.Cur = n
+	if rlimit.Max < n {
+		rlimit.Max = n
+	}
+	return syscall.Setrlimit(syscall.RLIMIT_NOFILE, &rlimit)
+}
+
+// Switches the process to the specified user and group, either of which may
+// be a name or a numeric id. If no group is specified the user's primary
+// group is used.
+func dropPrivileges(userName, groupName string) error {
+	if err := canDropPrivileges(); err != nil {
+		return err
+	}
+	uid, gid := -1, -1
+	if userName != "" {
+		u, err := lookupUser(userName)
+		if err != nil {
+			return err
+		}
+		if uid, err = strconv.Atoi(u.Uid); err != nil {
+			return fmt.Errorf("invalid uid for user '%s': %s", userName, u.Uid)
+		}
+		if gid, err = strconv.Atoi(u.Gid); err != nil {
+			return fmt.Errorf("invalid gid for user '%s': %s", userName, u.Gid)
+		}
+	}
+	if groupName != "" {
+		var err error
+		if gid, err = lookupGid(groupName); err != nil {
+			return err
+		}
+	}
+	// The group must be changed first, we're no longer allowed to once the
+	// user has been.
+	if gid != -1 {
+		if err := syscall.Setgroups([]int{gid}); err != nil {
+			return fmt.Errorf("can't set supplementary groups: %s", err)
+		}
+		if err := syscall.Setgid(gid); err != nil {
+			return fmt.Errorf("can't set group id: %s", err)
+		}
+	}
+	if uid != -1 {
+		if err := syscall.Setuid(uid); err != nil {
+			return fmt.Errorf("can't set user id: %s", err)
+		}
+	}
+	return nil
+}
+
+func lookupUser(name string) (*user.User, error) {
+	if _, err := strconv.Atoi(name); err == nil {
+		return user.LookupId(name)
+	}
+	return user.Lookup(name)
+}
+
+// Resolves a group name or numeric id to a gid using /etc/group.
+func lookupGid(name string) (int, error) {
+	if gid, err := strconv.Atoi(name); err == nil {
+		return gid, nil
+	}
+	f, err := os.Open("/etc/group")
+	if err != nil {
+		return -1, fmt.Errorf("can't look up group '%s': %s", name, err)
+	}
+	defer f.Close()
+	return gidFromGroupFile(f, name)
+}
+
+// Finds the gid of a named group in the contents of a group(5) file.
+func gidFromGroupFile(r io.Reader, name string) (int, error) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), ":")
+		if len(fields) < 3 || fields[0] != name {
+			continue
+		}
+		gid, err := strconv.Atoi(fields[2])
+		if err != nil {
+			return -1, fmt.Errorf("invalid gid for group '%s': %s", name, fields[2])
+		}
+		return gid, nil
+	}
+	if err := scanner.Err(); err != nil {
+		return -1, err
+	}
+	return -1, fmt.Errorf("unknown group: %s", name)
+}
@@ -0,0 +1,36 @@
+// +build !windows
+
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestGidFromGroupFile(t *testing.T) {
+	groups := "root:x:0:\n# comment\nheka:x:498:alice,bob\n"
+	gid, err := gidFromGroupFile(strings.NewReader(groups), "heka")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gid != 498 {
+		t.Fatalf("gid expected: 498, Got: %d", gid)
+	}
+	if _, err = gidFromGroupFile(strings.NewReader(groups), "missing"); err == nil {
+		t.Fatal("expected an error for an unknown group")
+	}
+}
@@ -0,0 +1,26 @@
+// +build linux,!go1.16
+
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package main
+
+import "errors"
+
+// Before Go 1.16 syscall.Setuid and Setgid always fail w/ EOPNOTSUPP on
+// Linux, since they'd only change the calling thread's ids.
+func canDropPrivileges() error {
+	return errors.New("'user' and 'group' require hekad to be built w/ Go 1.16 " +
+		"or later on Linux")
+}
@@ -0,0 +1,29 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package main
+
+import "errors"
+
+func setMaxOpenFiles(n uint64) error {
+	return errors.New("'max_open_files' isn't supported on Windows")
+}
+
+func canDropPrivileges() error {
+	return errors.New("'user' and 'group' aren't supported on Windows")
+}
+
+func dropPrivileges(userName, groupName string) error {
+	return canDropPrivileges()
+}
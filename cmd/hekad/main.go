@@ -27,21 +27,44 @@ import (
 	"github.com/mozilla-services/heka/pipeline"
 	_ "github.com/mozilla-services/heka/plugins"
 	_ "github.com/mozilla-services/heka/plugins/amqp"
+	_ "github.com/mozilla-services/heka/plugins/cassandra"
+	_ "github.com/mozilla-services/heka/plugins/cloudwatch"
 	_ "github.com/mozilla-services/heka/plugins/dasher"
+	_ "github.com/mozilla-services/heka/plugins/datadog"
 	_ "github.com/mozilla-services/heka/plugins/elasticsearch"
 	_ "github.com/mozilla-services/heka/plugins/file"
 	_ "github.com/mozilla-services/heka/plugins/graphite"
 	_ "github.com/mozilla-services/heka/plugins/http"
+	_ "github.com/mozilla-services/heka/plugins/influxdb"
 	_ "github.com/mozilla-services/heka/plugins/irc"
 	_ "github.com/mozilla-services/heka/plugins/kafka"
+	_ "github.com/mozilla-services/heka/plugins/leveldb"
 	_ "github.com/mozilla-services/heka/plugins/logstreamer"
+	_ "github.com/mozilla-services/heka/plugins/mongo"
 	_ "github.com/mozilla-services/heka/plugins/nagios"
+	_ "github.com/mozilla-services/heka/plugins/opentsdb"
+	_ "github.com/mozilla-services/heka/plugins/otlp"
+	_ "github.com/mozilla-services/heka/plugins/pagerduty"
 	_ "github.com/mozilla-services/heka/plugins/payload"
 	_ "github.com/mozilla-services/heka/plugins/process"
+	_ "github.com/mozilla-services/heka/plugins/prometheus"
+	_ "github.com/mozilla-services/heka/plugins/pubsub"
+	_ "github.com/mozilla-services/heka/plugins/redis"
+	_ "github.com/mozilla-services/heka/plugins/riemann"
+	_ "github.com/mozilla-services/heka/plugins/s3"
+	_ "github.com/mozilla-services/heka/plugins/slack"
 	_ "github.com/mozilla-services/heka/plugins/smtp"
+	_ "github.com/mozilla-services/heka/plugins/sns"
+	_ "github.com/mozilla-services/heka/plugins/splunk"
+	_ "github.com/mozilla-services/heka/plugins/sql"
 	_ "github.com/mozilla-services/heka/plugins/statsd"
+	_ "github.com/mozilla-services/heka/plugins/syslog"
+	_ "github.com/mozilla-services/heka/plugins/tail"
 	_ "github.com/mozilla-services/heka/plugins/tcp"
 	_ "github.com/mozilla-services/heka/plugins/udp"
+	_ "github.com/mozilla-services/heka/plugins/xmpp"
+	_ "github.com/mozilla-services/heka/plugins/zabbix"
+	_ "github.com/mozilla-services/heka/plugins/zipkin"
 	"io/ioutil"
 	"os"
 	"path/filepath"
@@ -50,6 +73,7 @@ import (
 	"strconv"
 	"strings"
 	"syscall"
+	"time"
 )
 
 const (
@@ -67,6 +91,9 @@ func setGlobalConfigs(config *HekadConfig) (*pipeline.GlobalConfigStruct, string
 	maxMsgProcessDuration := config.MaxMsgProcessDuration
 	maxMsgTimerInject := config.MaxMsgTimerInject
 
+	if maxprocs <= 0 {
+		maxprocs = runtime.NumCPU()
+	}
 	runtime.GOMAXPROCS(maxprocs)
 
 	globals := pipeline.DefaultGlobals()
@@ -83,6 +110,26 @@ func setGlobalConfigs(config *HekadConfig) (*pipeline.GlobalConfigStruct, string
 	globals.ShareDir = config.ShareDir
 	globals.SampleDenominator = config.SampleDenominator
 	globals.Hostname = config.Hostname
+	globals.ShutdownTimeout = time.Duration(config.ShutdownTimeout) * time.Second
+	globals.ReportInterval = time.Duration(config.ReportInterval) * time.Second
+	globals.AdminAddress = config.AdminAddress
+	globals.AdminToken = config.AdminToken
+	globals.PoolOverflow = config.PoolOverflow
+	globals.PoolOverflowMax = config.PoolOverflowMax
+	globals.FillMessageDefaults = config.FillMessageDefaults
+	globals.TenantSource = config.TenantSource
+	globals.TenantField = config.TenantField
+	globals.TenantMaxRate = config.TenantMaxRate
+	globals.TenantMaxCount = config.TenantMaxCount
+	globals.TenantIdleTimeout = time.Duration(config.TenantIdleTimeout) * time.Second
+	globals.MaxInputProcs = config.MaxInputProcs
+	globals.MaxDecoderProcs = config.MaxDecoderProcs
+	globals.MaxOutputProcs = config.MaxOutputProcs
+	globals.StallTimeout = time.Duration(config.StallTimeout) * time.Second
+	globals.StallShutdown = config.StallShutdown
+	globals.LogMessages = config.LogMessages
+	globals.NodeReportInterval = time.Duration(config.NodeReportInterval) * time.Second
+	globals.Version = VERSION
 
 	return globals, cpuProfName, memProfName
 }
@@ -92,6 +139,13 @@ func main() {
 		"Config file or directory. If directory is specified then all files "+
 			"in the directory will be loaded.")
 	version := flag.Bool("version", false, "Output version and exit")
+	checkConfig := flag.Bool("check-config", false,
+		"Check the config for errors w/o starting Heka, then exit")
+	traceMatcher := flag.String("trace-matcher", "",
+		"Message matcher selecting messages whose routes are logged and "+
+			"recorded in a `heka.route` field")
+	pidFile := flag.String("pid-file", "",
+		"Location of the pidfile, overriding the 'pid_file' setting")
 	flag.Parse()
 
 	config := &HekadConfig{}
@@ -108,6 +162,15 @@ func main() {
 	if err != nil {
 		pipeline.LogError.Fatal("Error reading config: ", err)
 	}
+	if err = pipeline.ValidPoolOverflow(config.PoolOverflow); err != nil {
+		pipeline.LogError.Fatalln(err)
+	}
+	if err = pipeline.ValidTenantSource(config.TenantSource); err != nil {
+		pipeline.LogError.Fatalln(err)
+	}
+	if *pidFile != "" {
+		config.PidFile = *pidFile
+	}
 	if config.SampleDenominator <= 0 {
 		pipeline.LogError.Fatalln("'sample_denominator' value must be greater than 0.")
 	}
@@ -122,6 +185,43 @@ func main() {
 	} else if config.MaxMessageSize > 0 {
 		pipeline.LogError.Fatalln("Error: 'max_message_size' setting must be greater than 1024.")
 	}
+
+	if config.AutosizePools {
+		budget := config.MemoryBudget
+		if budget == 0 {
+			if budget, err = pipeline.CgroupMemoryLimit(); err != nil {
+				pipeline.LogError.Fatalf("Error autosizing pools w/o a 'memory_budget': %s",
+					err)
+			}
+		}
+		poolSize, maxMsgSize := pipeline.SizeForMemory(budget, globals.PoolSize,
+			message.MAX_MESSAGE_SIZE)
+		if poolSize != globals.PoolSize || maxMsgSize != message.MAX_MESSAGE_SIZE {
+			pipeline.LogInfo.Printf("Memory budget of %d bytes: using a 'poolsize' of %d "+
+				"and a 'max_message_size' of %d", budget, poolSize, maxMsgSize)
+		}
+		globals.PoolSize = poolSize
+		message.SetMaxMessageSize(maxMsgSize)
+	}
+
+	// Find out now rather than after the plugins have started.
+	if config.User != "" || config.Group != "" {
+		if err = canDropPrivileges(); err != nil {
+			pipeline.LogError.Fatalln(err)
+		}
+	}
+
+	if *checkConfig {
+		os.Exit(checkFullConfig(pipeline.NewPipelineConfig(globals), *configPath))
+	}
+
+	if config.MaxOpenFiles > 0 {
+		if err = setMaxOpenFiles(config.MaxOpenFiles); err != nil {
+			pipeline.LogError.Fatalf("Error setting 'max_open_files' to %d: %s",
+				config.MaxOpenFiles, err)
+		}
+	}
+
 	if config.PidFile != "" {
 		contents, err := ioutil.ReadFile(config.PidFile)
 		if err == nil {
@@ -185,39 +285,41 @@ func main() {
 
 	// Set up and load the pipeline configuration and start the daemon.
 	pipeconf := pipeline.NewPipelineConfig(globals)
+	if err = pipeconf.SetTraceMatcher(*traceMatcher); err != nil {
+		pipeline.LogError.Fatal(err)
+	}
 	if err = loadFullConfig(pipeconf, configPath); err != nil {
 		pipeline.LogError.Fatal("Error reading config: ", err)
 	}
+	// The plugins have been initialized, so any privileged ports are already
+	// bound and privileges can be given up.
+	if config.User != "" || config.Group != "" {
+		if err = dropPrivileges(config.User, config.Group); err != nil {
+			pipeline.LogError.Fatal("Error dropping privileges: ", err)
+		}
+		pipeline.LogInfo.Printf("Running as user '%s', group '%s'", config.User,
+			config.Group)
+	}
 	pipeline.Run(pipeconf)
 }
 
-func loadFullConfig(pipeconf *pipeline.PipelineConfig, configPath *string) (err error) {
-	p, err := os.Open(*configPath)
-	if err != nil {
-		return fmt.Errorf("error opening file: %s", err.Error())
+// Checks the config at the provided path w/o starting any plugins, printing
+// all of the errors that are found. Returns the process exit status.
+func checkFullConfig(pipeconf *pipeline.PipelineConfig, configPath string) int {
+	err := pipeconf.PreloadFromConfigPath(configPath)
+	if err == nil {
+		err = pipeconf.CheckConfig()
 	}
-	fi, err := p.Stat()
 	if err != nil {
-		return fmt.Errorf("can't stat file: %s", err.Error())
+		fmt.Fprintf(os.Stderr, "Config check failed: %s\n", err)
+		return 1
 	}
+	fmt.Println("Config OK")
+	return 0
+}
 
-	if fi.IsDir() {
-		files, _ := ioutil.ReadDir(*configPath)
-		for _, f := range files {
-			fName := f.Name()
-			if !strings.HasSuffix(fName, ".toml") {
-				// Skip non *.toml files in a config dir.
-				continue
-			}
-			err = pipeconf.PreloadFromConfigFile(filepath.Join(*configPath, fName))
-			if err != nil {
-				break
-			}
-		}
-	} else {
-		err = pipeconf.PreloadFromConfigFile(*configPath)
-	}
-	if err == nil {
+func loadFullConfig(pipeconf *pipeline.PipelineConfig, configPath *string) (err error) {
+	if err = pipeconf.PreloadFromConfigPath(*configPath); err == nil {
 		err = pipeconf.LoadConfig()
 	}
 	return err
@@ -0,0 +1,57 @@
+define(
+  [
+    "underscore",
+    "jquery",
+    "backbone",
+    "adapters/base_adapter"
+  ],
+  function(_, $, Backbone, BaseAdapter) {
+    "use strict";
+
+    /**
+    * Adapter for retrieving the most recent sandbox alerts.
+    *
+    * Consumes `/data/alerts.json`.
+    *
+    * @class AlertsAdapter
+    * @extends BaseAdapter
+    *
+    * @constructor
+    */
+    var AlertsAdapter = function() {
+      /**
+      * Alerts collection to be filled by the adapter.
+      *
+      * @property {Backbone.Collection} alertsCollection
+      */
+      this.alertsCollection = new Backbone.Collection();
+    };
+
+    _.extend(AlertsAdapter.prototype, new BaseAdapter(), {
+      /**
+      * Fills alertsCollection with data fetched from the server.
+      *
+      * @method fill
+      */
+      fill: function() {
+        this.fetch("data/alerts.json", function(response) {
+          var alerts = _.map(response.alerts, function(alert, index) {
+            return {
+              id: alert.Time + alert.Plugin + alert.Name + index,
+              time: new Date(alert.Time * 1000),
+              plugin: alert.Plugin,
+              name: alert.Name,
+              message: alert.Message
+            };
+          });
+
+          this.alertsCollection.reset(alerts);
+        }.bind(this));
+
+        this.pollForUpdates(5000);
+      }
+    });
+
+    return AlertsAdapter;
+  }
+);
@@ -0,0 +1,36 @@
+define(
+  [
+    "underscore",
+    "moment"
+  ],
+  function(_, moment) {
+    "use strict";
+
+    /**
+    * Presents an alert for use in a view.
+    *
+    * @class AlertPresenter
+    *
+    * @constructor
+    *
+    * @param {Backbone.Model} alert Alert to be presented
+    */
+    var AlertPresenter = function (alert) {
+      _.extend(this, alert.attributes);
+    };
+
+    _.extend(AlertPresenter.prototype, {
+      /**
+      * Format the date and time.
+      *
+      * @method formattedTime
+      * @return {String} Formatted time e.g. Oct 28 2013 2:48 PM
+      */
+      formattedTime: function() {
+        return moment(this.time).format("lll");
+      }
+    });
+
+    return AlertPresenter;
+  }
+);
@@ -9,9 +9,10 @@ define(
     "views/sandboxes/sandbox_output_cbuf_show",
     "views/sandboxes/sandbox_output_txt_show",
     "views/health/plugins_show",
-    "views/termination_report/termination_report_index"
+    "views/termination_report/termination_report_index",
+    "views/alerts/alerts_index"
   ],
-  function($, Backbone, PluginsAdapter, SandboxesAdapter, HealthIndex, SandboxesIndex, SandboxOutputCbufShow, SandboxOutputTxtShow, PluginsShow, TerminationReportIndex) {
+  function($, Backbone, PluginsAdapter, SandboxesAdapter, HealthIndex, SandboxesIndex, SandboxOutputCbufShow, SandboxOutputTxtShow, PluginsShow, TerminationReportIndex, AlertsIndex) {
     "use strict";
 
     /**
@@ -34,6 +35,8 @@ define(
     *
     * - `/#termination_report`
     *
+    * - `/#alerts`
+    *
     * @class Router
     *
     * @constructor
@@ -53,7 +56,9 @@ define(
         "sandboxes/:sandboxName/outputs/:shortFileName": "showSandboxOutput",
         "sandboxes/:sandboxName/outputs/:shortFileName/embed": "showSandboxOutput",
 
-        "termination_report": "showTerminationReportIndex"
+        "termination_report": "showTerminationReportIndex",
+
+        "alerts": "showAlertsIndex"
       },
 
       /**
@@ -161,6 +166,15 @@ define(
         this._switch(new TerminationReportIndex());
       },
 
+      /**
+      * Loads and navigates to the alerts index.
+      *
+      * @method showAlertsIndex
+      */
+      showAlertsIndex: function() {
+        this._switch(new AlertsIndex());
+      },
+
       /**
       * Destroys the previous view and switches to the new one.
       *
@@ -0,0 +1,44 @@
+define(
+  [
+    "views/base_view",
+    "hgn!templates/alerts/alerts_index",
+    "adapters/alerts_adapter",
+    "presenters/alert_presenter"
+  ],
+  function(BaseView, AlertsIndexTemplate, AlertsAdapter, AlertPresenter) {
+    "use strict";
+
+    /**
+    * Index view for recent alerts. This is a top level view that's loaded by the router.
+    *
+    * @class AlertsIndex
+    * @extends BaseView
+    *
+    * @constructor
+    */
+    var AlertsIndex = BaseView.extend({
+      presenter: AlertPresenter,
+      template: AlertsIndexTemplate,
+
+      initialize: function() {
+        this.adapter = new AlertsAdapter();
+        this.collection = this.adapter.alertsCollection;
+
+        this.listenTo(this.collection, "add remove reset change", this.render, this);
+
+        this.adapter.fill();
+      },
+
+      /**
+      * Stops polling for updates before being destroyed.
+      *
+      * @method beforeDestroy
+      */
+      beforeDestroy: function() {
+        this.adapter.stopPollingForUpdates();
+      }
+    });
+
+    return AlertsIndex;
+  }
+);
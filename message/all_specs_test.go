@@ -17,6 +17,7 @@ package message
 import (
 	"bytes"
 	"code.google.com/p/go-uuid/uuid"
+	"code.google.com/p/gogoprotobuf/proto"
 	"github.com/rafrombrc/gospec/src/gospec"
 	gs "github.com/rafrombrc/gospec/src/gospec"
 	"os"
@@ -155,6 +156,92 @@ func MessageFieldsSpec(c gospec.Context) {
 		v2, _ := cmsg.GetFieldValue("foo")
 		c.Expect(v1, gs.Equals, v2)
 	})
+
+	c.Specify("Clear keeps the fields slice", func() {
+		msg := getTestMessage()
+		capacity := cap(msg.Fields)
+		msg.Clear()
+		c.Expect(len(msg.Fields), gs.Equals, 0)
+		c.Expect(cap(msg.Fields), gs.Equals, capacity)
+		c.Expect(msg.GetPayload(), gs.Equals, "")
+		c.Expect(msg.Uuid, gs.IsNil)
+
+		orig := getTestMessage()
+		encoded, err := proto.Marshal(orig)
+		c.Assume(err, gs.IsNil)
+		err = msg.UnmarshalReuse(encoded)
+		c.Expect(err, gs.IsNil)
+		c.Expect(msg, gs.Equals, orig)
+	})
+
+	c.Specify("Fields can be decoded separately", func() {
+		orig := getTestMessage()
+		encoded, err := proto.Marshal(orig)
+		c.Assume(err, gs.IsNil)
+
+		msg := &Message{}
+		skipped, err := msg.UnmarshalSkipFields(encoded)
+		c.Expect(err, gs.IsNil)
+		c.Expect(skipped, gs.IsTrue)
+		c.Expect(len(msg.Fields), gs.Equals, 0)
+		c.Expect(msg.GetType(), gs.Equals, orig.GetType())
+		c.Expect(msg.GetPayload(), gs.Equals, orig.GetPayload())
+
+		c.Expect(msg.UnmarshalFields(encoded), gs.IsNil)
+		c.Expect(msg, gs.Equals, orig)
+
+		_, err = msg.UnmarshalSkipFields(encoded[:len(encoded)-1])
+		c.Expect(err, gs.Not(gs.IsNil))
+	})
+
+	c.Specify("Unknown fields survive decoding, copying, and encoding", func() {
+		orig := getTestMessage()
+		encoded, err := proto.Marshal(orig)
+		c.Assume(err, gs.IsNil)
+		// Field 20 of the message and field 12 of its first field, as a
+		// newer schema version might add them.
+		unknown := []byte{0xa2, 0x01, 0x03, 'n', 'e', 'w'}
+		fieldUnknown := []byte{0x60, 0x01}
+		orig.Fields[0].XXX_unrecognized = fieldUnknown
+		fieldBytes, err := proto.Marshal(orig.Fields[0])
+		c.Assume(err, gs.IsNil)
+		encoded = append(encoded, unknown...)
+		encoded = append(encoded, 0x52, byte(len(fieldBytes)))
+		encoded = append(encoded, fieldBytes...)
+
+		msg := &Message{}
+		c.Assume(msg.UnmarshalReuse(encoded), gs.IsNil)
+		c.Expect(bytes.Equal(msg.XXX_unrecognized, unknown), gs.IsTrue)
+		c.Expect(len(msg.Fields), gs.Equals, 3)
+
+		copied := CopyMessage(msg)
+		c.Expect(bytes.Equal(copied.XXX_unrecognized, unknown), gs.IsTrue)
+		c.Expect(bytes.Equal(copied.Fields[2].XXX_unrecognized, fieldUnknown), gs.IsTrue)
+
+		reencoded, err := proto.Marshal(copied)
+		c.Assume(err, gs.IsNil)
+		relayed := &Message{}
+		c.Assume(relayed.UnmarshalReuse(reencoded), gs.IsNil)
+		c.Expect(bytes.Equal(relayed.XXX_unrecognized, unknown), gs.IsTrue)
+		c.Expect(bytes.Equal(relayed.Fields[2].XXX_unrecognized, fieldUnknown), gs.IsTrue)
+	})
+
+	c.Specify("Handshakes are framed w/o a message", func() {
+		record, err := AppendHandshake(nil, SCHEMA_VERSION)
+		c.Assume(err, gs.IsNil)
+		header := &Header{}
+		messageStart, err := DecodeHeaderV2(record, header)
+		c.Expect(err, gs.IsNil)
+		c.Expect(messageStart, gs.Equals, len(record))
+		c.Expect(IsHandshake(header), gs.IsTrue)
+		c.Expect(header.GetSchemaVersion(), gs.Equals, SCHEMA_VERSION)
+
+		header.SetMessageLength(10)
+		c.Expect(IsHandshake(header), gs.IsFalse)
+		header.Reset()
+		header.SetMessageLength(0)
+		c.Expect(IsHandshake(header), gs.IsFalse)
+	})
 }
 
 func MessageEqualsSpec(c gospec.Context) {
@@ -0,0 +1,141 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package message
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+
+	"code.google.com/p/gogoprotobuf/proto"
+)
+
+// Version 2 of the Heka stream framing. A record consists of the
+// FRAMING_V2_MAGIC bytes, the length of the header as a uvarint, the
+// protobuf encoded header, the big endian CRC-32 (IEEE) checksum of the
+// header, and the message. Version 1 records never have a header length of
+// 0, so the magic can't be mistaken for the start of a version 1 record and
+// both versions can be read from the same stream.
+const (
+	FRAMING_V2_VERSION  = uint8(2)
+	MAX_HEADER_SIZE_V2  = 64 * 1024
+	FRAMING_V2_CRC_SIZE = 4
+)
+
+var FRAMING_V2_MAGIC = []byte{RECORD_SEPARATOR, 0, FRAMING_V2_VERSION}
+
+// Version of the message schema this Heka understands, exchanged w/ peers in
+// handshakes. Since version 1 messages w/ fields unknown to the receiver are
+// passed on w/ those fields intact.
+const SCHEMA_VERSION = uint32(1)
+
+// Returned by DecodeHeaderV2 when the checksum of a header doesn't match.
+var ErrHeaderChecksum = errors.New("header checksum mismatch")
+
+// Returns true if buf starts w/ the beginning of a version 2 record, false
+// if it starts w/ a version 1 record or doesn't contain enough data to tell.
+func IsFramingV2(buf []byte) bool {
+	return len(buf) >= 2 && buf[0] == RECORD_SEPARATOR && buf[1] == 0
+}
+
+// Decodes the framing at the start of buf, which must start w/ the
+// FRAMING_V2_MAGIC bytes, into the header. Returns the offset of the message
+// in buf, or 0 if buf doesn't contain the whole header yet.
+func DecodeHeaderV2(buf []byte, header *Header) (messageStart int, err error) {
+	magicLen := len(FRAMING_V2_MAGIC)
+	if len(buf) < magicLen {
+		return 0, nil
+	}
+	if buf[2] != FRAMING_V2_VERSION {
+		return 0, fmt.Errorf("unsupported framing version: %d", buf[2])
+	}
+	headerLength, n := binary.Uvarint(buf[magicLen:])
+	if n == 0 {
+		return 0, nil
+	}
+	if n < 0 || headerLength == 0 || headerLength > MAX_HEADER_SIZE_V2 {
+		return 0, fmt.Errorf("invalid header length")
+	}
+	headerStart := magicLen + n
+	headerEnd := headerStart + int(headerLength)
+	messageStart = headerEnd + FRAMING_V2_CRC_SIZE
+	if len(buf) < messageStart {
+		return 0, nil
+	}
+	headerBytes := buf[headerStart:headerEnd]
+	if crc32.ChecksumIEEE(headerBytes) != binary.BigEndian.Uint32(buf[headerEnd:]) {
+		return 0, ErrHeaderChecksum
+	}
+	if err = proto.Unmarshal(headerBytes, header); err != nil {
+		return 0, fmt.Errorf("error unmarshaling header: %s", err)
+	}
+	if header.MessageLength == nil {
+		return 0, errors.New("header is missing the message length")
+	}
+	if header.GetMessageLength() > MAX_MESSAGE_SIZE {
+		err = fmt.Errorf("message exceeds the maximum length [%d bytes] len: %d",
+			MAX_MESSAGE_SIZE, header.GetMessageLength())
+		header.Reset()
+		return 0, err
+	}
+	return messageStart, nil
+}
+
+// Returns the offset of the message in a complete, valid record of either
+// framing version.
+func FramedMessageStart(record []byte) int {
+	if !IsFramingV2(record) {
+		return int(record[1]) + HEADER_FRAMING_SIZE
+	}
+	magicLen := len(FRAMING_V2_MAGIC)
+	headerLength, n := binary.Uvarint(record[magicLen:])
+	return magicLen + n + int(headerLength) + FRAMING_V2_CRC_SIZE
+}
+
+// Appends the version 2 framing for a message w/ the provided header to out,
+// returning the extended slice. The message itself must be appended
+// separately.
+func AppendFramingV2(out []byte, header *Header) ([]byte, error) {
+	headerBytes, err := proto.Marshal(header)
+	if err != nil {
+		return out, err
+	}
+	if len(headerBytes) > MAX_HEADER_SIZE_V2 {
+		return out, fmt.Errorf("Message header too big, requires %d (MAX_HEADER_SIZE_V2 = %d)",
+			len(headerBytes), MAX_HEADER_SIZE_V2)
+	}
+	var scratch [binary.MaxVarintLen64]byte
+	out = append(out, FRAMING_V2_MAGIC...)
+	out = append(out, scratch[:binary.PutUvarint(scratch[:], uint64(len(headerBytes)))]...)
+	out = append(out, headerBytes...)
+	binary.BigEndian.PutUint32(scratch[:], crc32.ChecksumIEEE(headerBytes))
+	return append(out, scratch[:FRAMING_V2_CRC_SIZE]...), nil
+}
+
+// Appends a handshake record announcing the provided schema version to out,
+// returning the extended slice. A handshake is a version 2 record w/ an
+// empty message whose header holds a schema version.
+func AppendHandshake(out []byte, schemaVersion uint32) ([]byte, error) {
+	header := &Header{}
+	header.SetMessageLength(0)
+	header.SetSchemaVersion(schemaVersion)
+	return AppendFramingV2(out, header)
+}
+
+// Returns true if the header is the header of a handshake record.
+func IsHandshake(header *Header) bool {
+	return header.SchemaVersion != nil && header.GetMessageLength() == 0
+}
@@ -26,6 +26,7 @@ import (
 	"bytes"
 	"code.google.com/p/gogoprotobuf/proto"
 	"fmt"
+	"io"
 	"reflect"
 )
 
@@ -55,6 +56,79 @@ type MessageSigningConfig struct {
 	Version uint32 `toml:"version"`
 }
 
+// Resets the message to its zero state for reuse. Unlike Reset, the backing
+// array of the Fields slice is kept so a recycled message doesn't need to
+// reallocate it.
+func (m *Message) Clear() {
+	fields := m.Fields
+	for i := range fields {
+		fields[i] = nil
+	}
+	*m = Message{Fields: fields[:0]}
+}
+
+// Decodes the protobuf encoding in buf into the message, reusing the
+// message's existing Fields slice where possible.
+func (m *Message) UnmarshalReuse(buf []byte) error {
+	m.Clear()
+	return m.Unmarshal(buf)
+}
+
+// Protobuf field number of the message's dynamic fields.
+const fieldsFieldNum = 10
+
+// Calls fn w/ the field number and the encoding, including the key, of each
+// top level field in the protobuf encoding in buf.
+func eachEncodedField(buf []byte, fn func(fieldNum uint64, encoded []byte) error) error {
+	for len(buf) > 0 {
+		key, n := proto.DecodeVarint(buf)
+		if n == 0 {
+			return io.ErrUnexpectedEOF
+		}
+		size, err := proto.Skip(buf)
+		if err != nil {
+			return err
+		}
+		if size > len(buf) {
+			return io.ErrUnexpectedEOF
+		}
+		if err = fn(key>>3, buf[:size]); err != nil {
+			return err
+		}
+		buf = buf[size:]
+	}
+	return nil
+}
+
+// Like UnmarshalReuse, but only decodes the header level values, such as the
+// Type, Logger, and Payload, skipping the dynamic fields, which is much
+// cheaper for messages w/ many fields. Returns true if any fields were
+// skipped, in which case UnmarshalFields can be used to decode them later.
+func (m *Message) UnmarshalSkipFields(buf []byte) (skipped bool, err error) {
+	m.Clear()
+	err = eachEncodedField(buf, func(fieldNum uint64, encoded []byte) error {
+		if fieldNum == fieldsFieldNum {
+			skipped = true
+			return nil
+		}
+		return m.Unmarshal(encoded)
+	})
+	return
+}
+
+// Decodes the dynamic fields in the protobuf encoding in buf, appending them
+// to the message's fields. Other values are left untouched, so this completes
+// the decoding of a message decoded by UnmarshalSkipFields even if its header
+// level values have been changed since.
+func (m *Message) UnmarshalFields(buf []byte) error {
+	return eachEncodedField(buf, func(fieldNum uint64, encoded []byte) error {
+		if fieldNum != fieldsFieldNum {
+			return nil
+		}
+		return m.Unmarshal(encoded)
+	})
+}
+
 // Decodes provided byte slice into a Heka protocol header object.
 func DecodeHeader(buf []byte, header *Header) (bool, error) {
 	if buf[len(buf)-1] != UNIT_SEPARATOR {
@@ -106,6 +180,24 @@ func (h *Header) SetHmacKeyVersion(v uint32) {
 	}
 }
 
+func (h *Header) SetMessageCrc32(v uint32) {
+	if h != nil {
+		if h.MessageCrc32 == nil {
+			h.MessageCrc32 = new(uint32)
+		}
+		*h.MessageCrc32 = v
+	}
+}
+
+func (h *Header) SetSchemaVersion(v uint32) {
+	if h != nil {
+		if h.SchemaVersion == nil {
+			h.SchemaVersion = new(uint32)
+		}
+		*h.SchemaVersion = v
+	}
+}
+
 func (h *Header) SetHmac(v []byte) {
 	if h != nil {
 		if cap(h.Hmac) < len(v) {
@@ -236,7 +328,19 @@ func (src *Message) Copy(dst *Message) {
 	for i, v := range src.Fields {
 		dst.Fields[i] = CopyField(v)
 	}
-	// ignore XXX_unrecognized
+	// Keep the values added by newer schema versions, so they survive being
+	// relayed.
+	dst.XXX_unrecognized = copyUnrecognized(src.XXX_unrecognized)
+}
+
+// Copies the encoding of the unknown fields of a message or field.
+func copyUnrecognized(src []byte) []byte {
+	if src == nil {
+		return nil
+	}
+	dst := make([]byte, len(src))
+	copy(dst, src)
+	return dst
 }
 
 // Message copy constructor
@@ -469,6 +573,7 @@ func CopyField(src *Field) *Field {
 		dst.ValueBool = make([]bool, len(src.ValueBool))
 		copy(dst.ValueBool, src.ValueBool)
 	}
+	dst.XXX_unrecognized = copyUnrecognized(src.XXX_unrecognized)
 	return dst
 }
 
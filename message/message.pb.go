@@ -113,6 +113,8 @@ type Header struct {
 	HmacSigner       *string                  `protobuf:"bytes,4,opt,name=hmac_signer" json:"hmac_signer,omitempty"`
 	HmacKeyVersion   *uint32                  `protobuf:"varint,5,opt,name=hmac_key_version" json:"hmac_key_version,omitempty"`
 	Hmac             []byte                   `protobuf:"bytes,6,opt,name=hmac" json:"hmac,omitempty"`
+	MessageCrc32     *uint32                  `protobuf:"fixed32,7,opt,name=message_crc32" json:"message_crc32,omitempty"`
+	SchemaVersion    *uint32                  `protobuf:"varint,8,opt,name=schema_version" json:"schema_version,omitempty"`
 	XXX_unrecognized []byte                   `json:"-"`
 }
 
@@ -157,6 +159,20 @@ func (m *Header) GetHmac() []byte {
 	return nil
 }
 
+func (m *Header) GetMessageCrc32() uint32 {
+	if m != nil && m.MessageCrc32 != nil {
+		return *m.MessageCrc32
+	}
+	return 0
+}
+
+func (m *Header) GetSchemaVersion() uint32 {
+	if m != nil && m.SchemaVersion != nil {
+		return *m.SchemaVersion
+	}
+	return 0
+}
+
 type Field struct {
 	Name             *string          `protobuf:"bytes,1,req,name=name" json:"name,omitempty"`
 	ValueType        *Field_ValueType `protobuf:"varint,2,opt,name=value_type,enum=message.Field_ValueType,def=0" json:"value_type,omitempty"`
@@ -440,6 +456,38 @@ func (m *Header) Unmarshal(data []byte) error {
 			}
 			m.Hmac = append(m.Hmac, data[index:postIndex]...)
 			index = postIndex
+		case 7:
+			if wireType != 5 {
+				return code_google_com_p_gogoprotobuf_proto.ErrWrongType
+			}
+			var v uint32
+			i := index + 4
+			if i > l {
+				return io.ErrUnexpectedEOF
+			}
+			index = i
+			v = uint32(data[i-4])
+			v |= uint32(data[i-3]) << 8
+			v |= uint32(data[i-2]) << 16
+			v |= uint32(data[i-1]) << 24
+			m.MessageCrc32 = &v
+		case 8:
+			if wireType != 0 {
+				return code_google_com_p_gogoprotobuf_proto.ErrWrongType
+			}
+			var v uint32
+			for shift := uint(0); ; shift += 7 {
+				if index >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[index]
+				index++
+				v |= (uint32(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			m.SchemaVersion = &v
 		default:
 			var sizeOfWire int
 			for {
@@ -1042,6 +1090,12 @@ func (m *Header) Size() (n int) {
 		l = len(m.Hmac)
 		n += 1 + l + sovMessage(uint64(l))
 	}
+	if m.MessageCrc32 != nil {
+		n += 5
+	}
+	if m.SchemaVersion != nil {
+		n += 1 + sovMessage(uint64(*m.SchemaVersion))
+	}
 	if m.XXX_unrecognized != nil {
 		n += len(m.XXX_unrecognized)
 	}
@@ -1194,6 +1248,16 @@ func (m *Header) MarshalTo(data []byte) (n int, err error) {
 		i = encodeVarintMessage(data, i, uint64(len(m.Hmac)))
 		i += copy(data[i:], m.Hmac)
 	}
+	if m.MessageCrc32 != nil {
+		data[i] = 0x3d
+		i++
+		i = encodeFixed32Message(data, i, uint32(*m.MessageCrc32))
+	}
+	if m.SchemaVersion != nil {
+		data[i] = 0x40
+		i++
+		i = encodeVarintMessage(data, i, uint64(*m.SchemaVersion))
+	}
 	if m.XXX_unrecognized != nil {
 		i += copy(data[i:], m.XXX_unrecognized)
 	}
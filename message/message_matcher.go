@@ -40,6 +40,60 @@ func (m *MatcherSpecification) Match(message *Message) bool {
 	return evalMatcherSpecification(m.vm, message)
 }
 
+// RequiredValue returns the value that a message's Type or Logger (specified
+// by name) must be equal to for the spec to match, if the spec requires one,
+// i.e. if the spec is `<name> == "<value>"` or that test AND'ed w/ other
+// tests. The router uses this to skip matchers that can't possibly match.
+func (m *MatcherSpecification) RequiredValue(name string) (value string, ok bool) {
+	var tokenId int
+	switch name {
+	case "Type":
+		tokenId = VAR_TYPE
+	case "Logger":
+		tokenId = VAR_LOGGER
+	default:
+		return
+	}
+	return requiredValue(m.vm, tokenId)
+}
+
+func requiredValue(t *tree, tokenId int) (string, bool) {
+	if t == nil {
+		return "", false
+	}
+	if t.left == nil {
+		stmt := t.stmt
+		if stmt.field.tokenId == tokenId && stmt.op.tokenId == OP_EQ &&
+			stmt.value.tokenId == STRING_VALUE {
+			return stmt.value.token, true
+		}
+		return "", false
+	}
+	if t.stmt.op.tokenId != OP_AND {
+		return "", false
+	}
+	if value, ok := requiredValue(t.left, tokenId); ok {
+		return value, true
+	}
+	return requiredValue(t.right, tokenId)
+}
+
+// UsesFields returns true if the spec tests any of the message's dynamic
+// fields, i.e. if the message's fields must be decoded to match it.
+func (m *MatcherSpecification) UsesFields() bool {
+	return usesFields(m.vm)
+}
+
+func usesFields(t *tree) bool {
+	if t == nil {
+		return false
+	}
+	if t.left == nil {
+		return t.stmt.field.tokenId == VAR_FIELDS
+	}
+	return usesFields(t.left) || usesFields(t.right)
+}
+
 // String outputs the spec as text
 func (m *MatcherSpecification) String() string {
 	return m.spec
@@ -195,6 +195,50 @@ func MatcherSpecificationSpec(c gospec.Context) {
 				c.Expect(match, gs.IsTrue)
 			}
 		})
+
+		c.Specify("finds required values", func() {
+			required := map[string]string{
+				"Type == 'TEST'":                                    "TEST",
+				"Severity == 6 && Type == 'TEST'":                   "TEST",
+				"(Type == 'TEST' || Pid > 0) && Logger == 'GoSpec'": "",
+			}
+			for spec, expected := range required {
+				ms, err := CreateMatcherSpecification(spec)
+				c.Assume(err, gs.IsNil)
+				value, ok := ms.RequiredValue("Type")
+				c.Expect(ok, gs.Equals, expected != "")
+				c.Expect(value, gs.Equals, expected)
+			}
+
+			notRequired := []string{
+				"Type == 'TEST' || Type == 'OTHER'",
+				"Type != 'TEST'",
+				"Type =~ /TEST/",
+				"Fields[Type] == 'TEST'",
+				"TRUE",
+			}
+			for _, spec := range notRequired {
+				ms, err := CreateMatcherSpecification(spec)
+				c.Assume(err, gs.IsNil)
+				_, ok := ms.RequiredValue("Type")
+				c.Expect(ok, gs.IsFalse)
+			}
+
+			ms, _ := CreateMatcherSpecification(
+				"(Type == 'TEST' || Pid > 0) && Logger == 'GoSpec'")
+			value, ok := ms.RequiredValue("Logger")
+			c.Expect(ok, gs.IsTrue)
+			c.Expect(value, gs.Equals, "GoSpec")
+		})
+
+		c.Specify("knows whether it tests fields", func() {
+			ms, err := CreateMatcherSpecification("Type == 'TEST' && Severity < 7")
+			c.Assume(err, gs.IsNil)
+			c.Expect(ms.UsesFields(), gs.IsFalse)
+			ms, err = CreateMatcherSpecification("Type == 'TEST' || Fields[foo] == 'bar'")
+			c.Assume(err, gs.IsNil)
+			c.Expect(ms.UsesFields(), gs.IsTrue)
+		})
 	})
 }
 
@@ -0,0 +1,313 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// Plugin categories listed by the admin API, w/ the JSON key for each.
+var adminCategories = map[string]string{
+	"Input":    "inputs",
+	"Splitter": "splitters",
+	"Decoder":  "decoders",
+	"Filter":   "filters",
+	"Encoder":  "encoders",
+	"Output":   "outputs",
+}
+
+// Implemented by input runners whose message delivery can be paused.
+type PausableRunner interface {
+	// Blocks the input's deliveries until Resume is called.
+	Pause()
+	// Unblocks the input's deliveries.
+	Resume()
+	// Returns whether the input is currently paused.
+	Paused() bool
+}
+
+// Description of a configured plugin returned by the admin API.
+type adminPlugin struct {
+	Name   string      `json:"name"`
+	Type   string      `json:"type"`
+	Paused *bool       `json:"paused,omitempty"`
+	Config interface{} `json:"config"`
+}
+
+// HTTP API for inspecting and controlling a running Heka.
+type adminServer struct {
+	pConfig  *PipelineConfig
+	token    string
+	listener net.Listener
+}
+
+// Starts the admin API listening on the provided address. If token isn't
+// empty every request must provide it as a bearer token, an empty token is
+// only allowed on a loopback address.
+func (pc *PipelineConfig) startAdmin(address, token string) (*adminServer, error) {
+	if token == "" && !isLoopback(address) {
+		return nil, fmt.Errorf("admin API needs an `admin_token` to listen on %s, "+
+			"only loopback addresses can go w/o one", address)
+	}
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, fmt.Errorf("admin API can't listen on %s: %s", address, err)
+	}
+	admin := &adminServer{
+		pConfig:  pc,
+		token:    token,
+		listener: listener,
+	}
+	go http.Serve(listener, admin.handler())
+	LogInfo.Printf("Admin API listening on %s", listener.Addr())
+	if token == "" {
+		LogError.Println("Admin API started w/o an `admin_token`, any local user can use it.")
+	}
+	return admin, nil
+}
+
+// Returns whether the address only listens on the loopback interface.
+func isLoopback(address string) bool {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// Parts of setting names that mark the setting's value as secret.
+var secretSettings = []string{"password", "passwd", "secret", "token",
+	"credential", "private", "api_key", "apikey", "access_key", "signing_key"}
+
+const redacted = "<redacted>"
+
+// Returns a copy of a TOML config value w/ the values of secret looking
+// settings, such as passwords and keys, and the passwords in URLs replaced.
+func redactConfig(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		clean := make(map[string]interface{}, len(v))
+		for name, val := range v {
+			if isSecretSetting(name) {
+				clean[name] = redacted
+			} else {
+				clean[name] = redactConfig(val)
+			}
+		}
+		return clean
+	case []map[string]interface{}:
+		clean := make([]interface{}, len(v))
+		for i, val := range v {
+			clean[i] = redactConfig(val)
+		}
+		return clean
+	case []interface{}:
+		clean := make([]interface{}, len(v))
+		for i, val := range v {
+			clean[i] = redactConfig(val)
+		}
+		return clean
+	case string:
+		if u, err := url.Parse(v); err == nil && u.User != nil {
+			if _, ok := u.User.Password(); ok {
+				u.User = url.UserPassword(u.User.Username(), redacted)
+				return u.String()
+			}
+		}
+	}
+	return value
+}
+
+func isSecretSetting(name string) bool {
+	name = strings.ToLower(name)
+	if name == "key" {
+		return true
+	}
+	for _, part := range secretSettings {
+		if strings.Contains(name, part) {
+			return true
+		}
+	}
+	return false
+}
+
+// Stops the admin API from accepting new requests.
+func (a *adminServer) stop() {
+	a.listener.Close()
+}
+
+func (a *adminServer) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/plugins", a.plugins)
+	mux.HandleFunc("/reports", a.reports)
+	mux.HandleFunc("/reload", a.reload)
+	mux.HandleFunc("/inputs/", a.input)
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	return a.authorize(mux)
+}
+
+// Wraps the handler so requests w/o the right bearer token are rejected.
+func (a *adminServer) authorize(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if a.token != "" {
+			auth := req.Header.Get("Authorization")
+			if !strings.HasPrefix(auth, "Bearer ") ||
+				subtle.ConstantTimeCompare([]byte(auth[7:]), []byte(a.token)) != 1 {
+
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+func writeJson(w http.ResponseWriter, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(data); err != nil {
+		LogError.Printf("Admin API can't encode response: %s", err)
+	}
+}
+
+// Lists every configured plugin, by category, along w/ its TOML config, w/
+// secret looking settings redacted.
+func (a *adminServer) plugins(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	pc := a.pConfig
+	data := make(map[string][]adminPlugin)
+	pc.makersLock.RLock()
+	for category, key := range adminCategories {
+		plugins := make([]adminPlugin, 0, len(pc.makers[category]))
+		for name, maker := range pc.makers[category] {
+			plugin := adminPlugin{
+				Name: name,
+				Type: maker.Type(),
+			}
+			if pMaker, ok := maker.(*pluginMaker); ok {
+				plugin.Config = redactConfig(pMaker.tomlSection)
+			}
+			plugins = append(plugins, plugin)
+		}
+		data[key] = plugins
+	}
+	pc.makersLock.RUnlock()
+
+	pc.inputsLock.RLock()
+	for i, plugin := range data["inputs"] {
+		if pausable, ok := pc.InputRunners[plugin.Name].(PausableRunner); ok {
+			paused := pausable.Paused()
+			data["inputs"][i].Paused = &paused
+		}
+	}
+	pc.inputsLock.RUnlock()
+
+	for _, plugins := range data {
+		sort.Sort(adminPluginsByName(plugins))
+	}
+	writeJson(w, data)
+}
+
+type adminPluginsByName []adminPlugin
+
+func (p adminPluginsByName) Len() int           { return len(p) }
+func (p adminPluginsByName) Less(i, j int) bool { return p[i].Name < p[j].Name }
+func (p adminPluginsByName) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+
+// Returns the same report data as the `heka.all-report` message.
+func (a *adminServer) reports(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	_, payload := a.pConfig.allReportsData()
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(payload))
+}
+
+// Reloads the config, as if hekad had received a SIGHUP.
+func (a *adminServer) reload(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	LogInfo.Println("Reload initiated by admin API.")
+	if err := a.pConfig.ReloadConfig(); err != nil {
+		http.Error(w, fmt.Sprintf("error reloading config: %s", err),
+			http.StatusInternalServerError)
+		return
+	}
+	writeJson(w, map[string]string{"status": "reloaded"})
+}
+
+// Handles `/inputs/<name>/pause` and `/inputs/<name>/resume`.
+func (a *adminServer) input(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	parts := strings.Split(strings.TrimPrefix(req.URL.Path, "/inputs/"), "/")
+	if len(parts) != 2 {
+		http.NotFound(w, req)
+		return
+	}
+	name, action := parts[0], parts[1]
+
+	pc := a.pConfig
+	pc.inputsLock.RLock()
+	runner, ok := pc.InputRunners[name]
+	pc.inputsLock.RUnlock()
+	if !ok {
+		http.Error(w, fmt.Sprintf("no input named '%s'", name), http.StatusNotFound)
+		return
+	}
+	pausable, ok := runner.(PausableRunner)
+	if !ok {
+		http.Error(w, fmt.Sprintf("input '%s' can't be paused", name),
+			http.StatusBadRequest)
+		return
+	}
+
+	switch action {
+	case "pause":
+		pausable.Pause()
+		LogInfo.Printf("Input '%s' paused by admin API.", name)
+	case "resume":
+		pausable.Resume()
+		LogInfo.Printf("Input '%s' resumed by admin API.", name)
+	default:
+		http.NotFound(w, req)
+		return
+	}
+	writeJson(w, map[string]bool{"paused": pausable.Paused()})
+}
@@ -36,14 +36,35 @@ func TestAllSpecs(t *testing.T) {
 	r := gospec.NewRunner()
 	r.Parallel = false
 
+	r.AddSpec(AdminSpec)
+	r.AddSpec(BatcherSpec)
 	r.AddSpec(BufferedOutputSpec)
+	r.AddSpec(CharsetSpec)
+	r.AddSpec(ConfigReloadSpec)
+	r.AddSpec(DecoderHarnessSpec)
+	r.AddSpec(DecoderRunnerSpec)
+	r.AddSpec(DeliveryTrackerSpec)
 	r.AddSpec(InputRunnerSpec)
+	r.AddSpec(MatchRunnerSpec)
+	r.AddSpec(MatcherIndexSpec)
+	r.AddSpec(PackPoolSpec)
 	r.AddSpec(OutputRunnerSpec)
 	r.AddSpec(SplitterRunnerSpec)
 	r.AddSpec(MessageTemplateSpec)
 	r.AddSpec(ProtobufDecoderSpec)
 	r.AddSpec(ReportSpec)
+	r.AddSpec(RoundRobinGroupSpec)
+	r.AddSpec(ScheduleSpec)
+	r.AddSpec(ShutdownSpoolSpec)
 	r.AddSpec(StatAccumInputSpec)
+	r.AddSpec(StateStoreSpec)
+	r.AddSpec(TenantTrackerSpec)
+	r.AddSpec(SizeForMemorySpec)
+	r.AddSpec(WatchdogSpec)
+	r.AddSpec(PluginLoggingSpec)
+	r.AddSpec(BackoffSpec)
+	r.AddSpec(NodeReportSpec)
+	r.AddSpec(TruncateSpec)
 	r.AddSpec(TokenSpec)
 	r.AddSpec(RegexSpec)
 	r.AddSpec(HekaFramingSpec)
@@ -57,3 +78,13 @@ func BenchmarkPipelinePackCreation(b *testing.B) {
 		NewPipelinePack(config.inputRecycleChan)
 	}
 }
+
+func BenchmarkPipelinePackRecycle(b *testing.B) {
+	recycleChan := make(chan *PipelinePack, 1)
+	pack := NewPipelinePack(recycleChan)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		pack.Recycle()
+		pack = <-recycleChan
+	}
+}
@@ -0,0 +1,318 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mozilla-services/heka/message"
+)
+
+// Batching settings shared by outputs that use a Batcher. Outputs generally
+// expose this as a `batch` subsection of their config.
+type BatchConfig struct {
+	// Number of records that will trigger a flush. 0 means no limit.
+	FlushCount int `toml:"flush_count"`
+	// Number of bytes of record data that will trigger a flush. 0 means no
+	// limit.
+	FlushBytes int `toml:"flush_bytes"`
+	// Interval at which accumulated records will be flushed, in
+	// milliseconds. 0 means batches are only flushed when full.
+	FlushInterval uint32 `toml:"flush_interval"`
+	// Number of batches that can be flushed concurrently.
+	Concurrency int
+	// Backoff settings for retrying failed flushes. MaxRetries of -1 means
+	// a batch is retried until it succeeds.
+	Retries RetryOptions
+	// What to do w/ a batch once its retries are exhausted: "drop" it,
+	// "block" by retrying it forever, or "dead_letter" to re-inject each of
+	// its records as a message that a dead letter output can capture. A
+	// blocked batch is dead lettered, or failing that dropped, on shutdown.
+	FailureAction string `toml:"failure_action"`
+}
+
+// Returns the default batching settings.
+func DefaultBatchConfig() BatchConfig {
+	return BatchConfig{
+		FlushCount:    100,
+		FlushInterval: 1000,
+		Concurrency:   1,
+		Retries: RetryOptions{
+			MaxDelay:   "30s",
+			Delay:      "250ms",
+			MaxRetries: 3,
+		},
+		FailureAction: "drop",
+	}
+}
+
+// Returns an error if the settings can't be used to create a Batcher, so
+// outputs can check their `batch` settings in Init.
+func (conf BatchConfig) Validate() error {
+	if conf.FlushCount < 0 || conf.FlushBytes < 0 {
+		return errors.New("`flush_count` and `flush_bytes` can't be negative")
+	}
+	if conf.FlushCount == 0 && conf.FlushBytes == 0 && conf.FlushInterval == 0 {
+		return errors.New(
+			"one of `flush_count`, `flush_bytes`, or `flush_interval` is required")
+	}
+	if conf.Concurrency < 1 {
+		return errors.New("`concurrency` must be at least 1")
+	}
+	switch conf.FailureAction {
+	case "", "drop", "block", "dead_letter":
+	default:
+		return fmt.Errorf("`failure_action` must be 'drop', 'block', or "+
+			"'dead_letter', got %s", conf.FailureAction)
+	}
+	// Make sure the retry settings are valid before any flushing happens.
+	if _, err := NewRetryHelper(conf.Retries); err != nil {
+		return fmt.Errorf("invalid retry settings: %s", err)
+	}
+	return nil
+}
+
+// Function that sends a batch of records to its destination. A returned
+// error causes the batch to be retried w/ exponential backoff.
+type BatchFlushFunc func(records [][]byte) error
+
+// Function that handles a record that couldn't be delivered when the
+// Batcher's failure action is "dead_letter".
+type DeadLetterFunc func(record []byte, reason error) error
+
+// Batcher accumulates encoded records and hands them off in batches to a
+// flush function, so outputs don't each have to reimplement the flush
+// trigger, concurrency, and retry logic.
+type Batcher struct {
+	sentBatchCount  int64
+	sentRecordCount int64
+	dropRecordCount int64
+	deadRecordCount int64
+
+	conf       BatchConfig
+	flush      BatchFlushFunc
+	deadLetter DeadLetterFunc
+	logError   func(error)
+	lock       sync.Mutex
+	records    [][]byte
+	size       int
+	batchChan  chan [][]byte
+	stopChan   chan struct{}
+	tickerWg   sync.WaitGroup
+	wg         sync.WaitGroup
+}
+
+// Creates a Batcher that sends its batches to the flush function, using
+// logError to report failed flush attempts. Start must be called before
+// records are added.
+func NewBatcher(conf BatchConfig, flush BatchFlushFunc,
+	logError func(error)) (b *Batcher, err error) {
+
+	if flush == nil {
+		return nil, errors.New("flush function required")
+	}
+	if err = conf.Validate(); err != nil {
+		return nil, err
+	}
+	if conf.FailureAction == "block" {
+		conf.Retries.MaxRetries = -1
+	}
+	b = &Batcher{
+		conf:      conf,
+		flush:     flush,
+		logError:  logError,
+		batchChan: make(chan [][]byte, conf.Concurrency),
+		stopChan:  make(chan struct{}),
+	}
+	return
+}
+
+// Creates a Batcher for an output, reporting errors through, and injecting
+// dead letters using, the output's runner.
+func NewOutputBatcher(conf BatchConfig, flush BatchFlushFunc, or OutputRunner,
+	h PluginHelper) (b *Batcher, err error) {
+
+	if b, err = NewBatcher(conf, flush, or.LogError); err != nil {
+		return
+	}
+	b.SetDeadLetter(func(record []byte, reason error) error {
+		return InjectDeadLetter(or, h, record, reason)
+	})
+	return
+}
+
+// Sets the function used to handle undeliverable records when the failure
+// action is "dead_letter". Must be called before Start.
+func (b *Batcher) SetDeadLetter(deadLetter DeadLetterFunc) {
+	b.deadLetter = deadLetter
+}
+
+// Starts the flushing goroutines and, if configured, the interval timer.
+func (b *Batcher) Start() {
+	for i := 0; i < b.conf.Concurrency; i++ {
+		b.wg.Add(1)
+		go b.flusher()
+	}
+	if b.conf.FlushInterval > 0 {
+		b.tickerWg.Add(1)
+		go b.ticker()
+	}
+}
+
+// Adds a record to the current batch, flushing it if that triggers one of
+// the configured limits. The record is retained, so it must not be reused by
+// the caller. Blocks if all of the flushers are busy.
+func (b *Batcher) Add(record []byte) {
+	b.lock.Lock()
+	b.records = append(b.records, record)
+	b.size += len(record)
+	full := (b.conf.FlushCount > 0 && len(b.records) >= b.conf.FlushCount) ||
+		(b.conf.FlushBytes > 0 && b.size >= b.conf.FlushBytes)
+	var batch [][]byte
+	if full {
+		batch = b.take()
+	}
+	b.lock.Unlock()
+	if batch != nil {
+		b.batchChan <- batch
+	}
+}
+
+// Flushes any accumulated records, regardless of the flush limits.
+func (b *Batcher) Flush() {
+	b.lock.Lock()
+	batch := b.take()
+	b.lock.Unlock()
+	if batch != nil {
+		b.batchChan <- batch
+	}
+}
+
+// Flushes any accumulated records and waits for all in-flight batches to
+// complete. Batches that are being retried forever are given up on, after at
+// most one more attempt, and get the failure action. The Batcher can't be
+// used after it has been stopped.
+func (b *Batcher) Stop() {
+	close(b.stopChan)
+	b.tickerWg.Wait()
+	b.Flush()
+	close(b.batchChan)
+	b.wg.Wait()
+}
+
+// Returns the current batch, if any, and starts a new one. Must be called
+// while holding the lock.
+func (b *Batcher) take() (batch [][]byte) {
+	if len(b.records) == 0 {
+		return nil
+	}
+	batch = b.records
+	b.records = nil
+	b.size = 0
+	return
+}
+
+func (b *Batcher) ticker() {
+	ticker := time.NewTicker(time.Duration(b.conf.FlushInterval) * time.Millisecond)
+	defer func() {
+		ticker.Stop()
+		b.tickerWg.Done()
+	}()
+	for {
+		select {
+		case <-ticker.C:
+			b.Flush()
+		case <-b.stopChan:
+			return
+		}
+	}
+}
+
+func (b *Batcher) flusher() {
+	defer b.wg.Done()
+	rh, _ := NewRetryHelper(b.conf.Retries)
+	// Retrying forever would keep Stop, and w/ it Heka's shutdown, from ever
+	// returning while the destination is down, so unlimited retries give up
+	// once the Batcher is stopping.
+	var stop <-chan struct{}
+	if b.conf.Retries.MaxRetries == -1 {
+		stop = b.stopChan
+	}
+	for batch := range b.batchChan {
+		rh.Reset()
+		for {
+			err := b.flush(batch)
+			if err == nil {
+				atomic.AddInt64(&b.sentBatchCount, 1)
+				atomic.AddInt64(&b.sentRecordCount, int64(len(batch)))
+				break
+			}
+			if b.logError != nil {
+				b.logError(fmt.Errorf("flushing batch: %s", err))
+			}
+			if waitErr := rh.WaitOrStop(stop); waitErr != nil {
+				b.failed(batch, err, waitErr)
+				break
+			}
+		}
+	}
+}
+
+// Applies the failure action to a batch that won't be retried any more,
+// because its retries have been exhausted or the Batcher is stopping. A
+// blocking Batcher that's stopping dead letters the batch if it can.
+func (b *Batcher) failed(batch [][]byte, reason, cause error) {
+	deadLetter := b.conf.FailureAction == "dead_letter" ||
+		(b.conf.FailureAction == "block" && cause == ErrRetryStopped)
+	if deadLetter && b.deadLetter != nil {
+		for i, record := range batch {
+			if err := b.deadLetter(record, reason); err != nil {
+				if b.logError != nil {
+					b.logError(fmt.Errorf("can't dead letter record: %s", err))
+				}
+				b.drop(batch[i:], cause)
+				return
+			}
+			atomic.AddInt64(&b.deadRecordCount, 1)
+		}
+		return
+	}
+	b.drop(batch, cause)
+}
+
+func (b *Batcher) drop(batch [][]byte, cause error) {
+	atomic.AddInt64(&b.dropRecordCount, int64(len(batch)))
+	if b.logError != nil {
+		b.logError(fmt.Errorf("dropped batch of %d records: %s", len(batch),
+			cause))
+	}
+}
+
+// Adds the Batcher's counters to an output's report message.
+func (b *Batcher) ReportMsg(msg *message.Message) error {
+	message.NewInt64Field(msg, "SentBatchCount",
+		atomic.LoadInt64(&b.sentBatchCount), "count")
+	message.NewInt64Field(msg, "SentRecordCount",
+		atomic.LoadInt64(&b.sentRecordCount), "count")
+	message.NewInt64Field(msg, "DropRecordCount",
+		atomic.LoadInt64(&b.dropRecordCount), "count")
+	message.NewInt64Field(msg, "DeadLetterRecordCount",
+		atomic.LoadInt64(&b.deadRecordCount), "count")
+	return nil
+}
@@ -0,0 +1,240 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"errors"
+	"time"
+
+	"github.com/mozilla-services/heka/message"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+)
+
+func BatcherSpec(c gs.Context) {
+	conf := DefaultBatchConfig()
+	conf.FlushCount = 3
+	conf.FlushInterval = 0
+	conf.Retries = RetryOptions{
+		MaxDelay:   "1ms",
+		Delay:      "1ms",
+		MaxJitter:  "1ms",
+		MaxRetries: 2,
+	}
+	batchChan := make(chan [][]byte, 10)
+	flush := func(records [][]byte) error {
+		batchChan <- records
+		return nil
+	}
+
+	c.Specify("A Batcher", func() {
+		c.Specify("requires a flush trigger", func() {
+			conf.FlushCount = 0
+			_, err := NewBatcher(conf, flush, nil)
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+
+		c.Specify("flushes on record count", func() {
+			b, err := NewBatcher(conf, flush, nil)
+			c.Assume(err, gs.IsNil)
+			b.Start()
+			for _, r := range []string{"a", "b", "c", "d"} {
+				b.Add([]byte(r))
+			}
+			batch := <-batchChan
+			c.Expect(len(batch), gs.Equals, 3)
+			c.Expect(string(batch[2]), gs.Equals, "c")
+			b.Stop()
+			batch = <-batchChan
+			c.Expect(len(batch), gs.Equals, 1)
+			c.Expect(string(batch[0]), gs.Equals, "d")
+		})
+
+		c.Specify("flushes on byte size", func() {
+			conf.FlushCount = 0
+			conf.FlushBytes = 5
+			b, err := NewBatcher(conf, flush, nil)
+			c.Assume(err, gs.IsNil)
+			b.Start()
+			b.Add([]byte("abc"))
+			b.Add([]byte("def"))
+			batch := <-batchChan
+			c.Expect(len(batch), gs.Equals, 2)
+			b.Stop()
+			c.Expect(len(batchChan), gs.Equals, 0)
+		})
+
+		c.Specify("flushes on interval", func() {
+			conf.FlushCount = 0
+			conf.FlushInterval = 10
+			b, err := NewBatcher(conf, flush, nil)
+			c.Assume(err, gs.IsNil)
+			b.Start()
+			b.Add([]byte("a"))
+			var batch [][]byte
+			select {
+			case batch = <-batchChan:
+			case <-time.After(time.Second):
+			}
+			c.Expect(len(batch), gs.Equals, 1)
+			b.Stop()
+		})
+
+		c.Specify("retries, then drops failed batches", func() {
+			attempts := 0
+			var logged []error
+			failing := func(records [][]byte) error {
+				attempts++
+				return errors.New("nope")
+			}
+			b, err := NewBatcher(conf, failing, func(err error) {
+				logged = append(logged, err)
+			})
+			c.Assume(err, gs.IsNil)
+			b.Start()
+			b.Add([]byte("a"))
+			b.Stop()
+			c.Expect(attempts, gs.Equals, 3)
+			c.Expect(len(logged), gs.Equals, 4)
+
+			msg := new(message.Message)
+			b.ReportMsg(msg)
+			val, _ := msg.GetFieldValue("DropRecordCount")
+			c.Expect(val, gs.Equals, int64(1))
+			val, _ = msg.GetFieldValue("SentBatchCount")
+			c.Expect(val, gs.Equals, int64(0))
+		})
+
+		c.Specify("rejects an unknown failure action", func() {
+			conf.FailureAction = "panic"
+			_, err := NewBatcher(conf, flush, nil)
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+
+		c.Specify("dead letters records from failed batches", func() {
+			conf.FailureAction = "dead_letter"
+			failing := func(records [][]byte) error {
+				return errors.New("nope")
+			}
+			b, err := NewBatcher(conf, failing, nil)
+			c.Assume(err, gs.IsNil)
+			var dead []string
+			b.SetDeadLetter(func(record []byte, reason error) error {
+				c.Expect(reason.Error(), gs.Equals, "nope")
+				dead = append(dead, string(record))
+				return nil
+			})
+			b.Start()
+			b.Add([]byte("a"))
+			b.Add([]byte("b"))
+			b.Stop()
+			c.Expect(len(dead), gs.Equals, 2)
+			c.Expect(dead[1], gs.Equals, "b")
+
+			msg := new(message.Message)
+			b.ReportMsg(msg)
+			val, _ := msg.GetFieldValue("DeadLetterRecordCount")
+			c.Expect(val, gs.Equals, int64(2))
+			val, _ = msg.GetFieldValue("DropRecordCount")
+			c.Expect(val, gs.Equals, int64(0))
+		})
+
+		c.Specify("keeps retrying w/ the block failure action", func() {
+			conf.FailureAction = "block"
+			attempts := 0
+			sent := make(chan struct{})
+			flaky := func(records [][]byte) error {
+				if attempts++; attempts <= 5 {
+					return errors.New("nope")
+				}
+				close(sent)
+				return nil
+			}
+			b, err := NewBatcher(conf, flaky, nil)
+			c.Assume(err, gs.IsNil)
+			b.Start()
+			b.Add([]byte("a"))
+			b.Flush()
+			<-sent
+			b.Stop()
+			c.Expect(attempts, gs.Equals, 6)
+
+			msg := new(message.Message)
+			b.ReportMsg(msg)
+			val, _ := msg.GetFieldValue("SentRecordCount")
+			c.Expect(val, gs.Equals, int64(1))
+		})
+
+		c.Specify("stops blocking when it's stopped", func() {
+			conf.FailureAction = "block"
+			conf.Retries.Delay = "1h"
+			conf.Retries.MaxDelay = "1h"
+			attempts := make(chan struct{}, 10)
+			failing := func(records [][]byte) error {
+				attempts <- struct{}{}
+				return errors.New("nope")
+			}
+			b, err := NewBatcher(conf, failing, nil)
+			c.Assume(err, gs.IsNil)
+			var dead []string
+			b.SetDeadLetter(func(record []byte, reason error) error {
+				dead = append(dead, string(record))
+				return nil
+			})
+			b.Start()
+			b.Add([]byte("a"))
+			b.Flush()
+			<-attempts
+			b.Add([]byte("b"))
+			b.Stop()
+			c.Expect(len(attempts), gs.Equals, 1)
+			c.Expect(len(dead), gs.Equals, 2)
+
+			c.Specify("and drops w/o a dead letter function", func() {
+				b, err := NewBatcher(conf, failing, nil)
+				c.Assume(err, gs.IsNil)
+				b.Start()
+				b.Add([]byte("c"))
+				b.Stop()
+				msg := new(message.Message)
+				b.ReportMsg(msg)
+				val, _ := msg.GetFieldValue("DropRecordCount")
+				c.Expect(val, gs.Equals, int64(1))
+			})
+		})
+
+		c.Specify("succeeds after a retry", func() {
+			attempts := 0
+			flaky := func(records [][]byte) error {
+				if attempts++; attempts == 1 {
+					return errors.New("nope")
+				}
+				return nil
+			}
+			b, err := NewBatcher(conf, flaky, nil)
+			c.Assume(err, gs.IsNil)
+			b.Start()
+			b.Add([]byte("a"))
+			b.Stop()
+			c.Expect(attempts, gs.Equals, 2)
+
+			msg := new(message.Message)
+			b.ReportMsg(msg)
+			val, _ := msg.GetFieldValue("SentRecordCount")
+			c.Expect(val, gs.Equals, int64(1))
+			val, _ = msg.GetFieldValue("DropRecordCount")
+			c.Expect(val, gs.Equals, int64(0))
+		})
+	})
+}
@@ -229,11 +229,15 @@ func (b *BufferedOutput) streamOutput(sender BufferedOutputSender, outputError,
 		return
 	}
 
-	rh, _ := NewRetryHelper(RetryOptions{
+	rh, err := NewRunnerRetryHelper(b.or, RetryOptions{
 		MaxDelay:   "2s",
 		Delay:      "250ms",
 		MaxRetries: -1,
 	})
+	if err != nil {
+		outputExit <- err
+		return
+	}
 
 	for true {
 		select {
@@ -280,8 +284,7 @@ func (b *BufferedOutput) streamOutput(sender BufferedOutputSender, outputError,
 			if len(record) > 0 {
 				// Remove the framing if we put it there.
 				if !b.or.UsesFraming() {
-					headerLen := int(record[1]) + message.HEADER_FRAMING_SIZE
-					record = record[headerLen:]
+					record = record[message.FramedMessageStart(record):]
 				}
 				rh.Reset()
 				for true {
@@ -296,7 +299,12 @@ func (b *BufferedOutput) streamOutput(sender BufferedOutputSender, outputError,
 						return
 					default:
 						outputError <- err
-						rh.Wait() // this will delay Heka shutdown up to MaxDelay
+						// This will delay Heka shutdown up to MaxDelay.
+						if err = rh.Wait(); err != nil {
+							// Let the runner restart the output.
+							outputExit <- err
+							return
+						}
 					}
 				}
 			} else {
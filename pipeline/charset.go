@@ -0,0 +1,275 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// Converts raw data in a character encoding to valid UTF-8. Bytes that
+// aren't valid in the encoding become U+FFFD.
+type charsetDecoder func(data string) string
+
+const (
+	utf8BOM    = "\xef\xbb\xbf"
+	utf16LEBOM = "\xff\xfe"
+	utf16BEBOM = "\xfe\xff"
+)
+
+// Supported charsets, by lower case name w/o dashes or underscores.
+var charsets = map[string]charsetDecoder{
+	"utf8":        decodeUTF8,
+	"iso88591":    decodeLatin1,
+	"latin1":      decodeLatin1,
+	"windows1252": decodeWindows1252,
+	"cp1252":      decodeWindows1252,
+	"utf16":       utf16Decoder(false),
+	"utf16le":     utf16Decoder(false),
+	"utf16be":     utf16Decoder(true),
+	"shiftjis":    decodeShiftJIS,
+	"sjis":        decodeShiftJIS,
+	"cp932":       decodeShiftJIS,
+	"windows31j":  decodeShiftJIS,
+}
+
+func lookupCharset(name string) (decode charsetDecoder, ok bool) {
+	name = strings.ToLower(name)
+	name = strings.Replace(name, "-", "", -1)
+	name = strings.Replace(name, "_", "", -1)
+	decode, ok = charsets[name]
+	return
+}
+
+// Converts the payloads of the packs a decoder gets to UTF-8, from the
+// decoder's `charset` and `charset_fallback` settings.
+type charsetConverter struct {
+	// nil when the charset is detected.
+	decode   charsetDecoder
+	fallback charsetDecoder
+}
+
+// Returns nil if no charset is set.
+func newCharsetConverter(charset, fallback string) (*charsetConverter, error) {
+	if charset == "" {
+		return nil, nil
+	}
+	c := new(charsetConverter)
+	var ok bool
+	if strings.ToLower(charset) != "auto" {
+		if c.decode, ok = lookupCharset(charset); !ok {
+			return nil, fmt.Errorf("unknown `charset` '%s'", charset)
+		}
+		return c, nil
+	}
+	if fallback == "" {
+		return nil, errors.New("`charset_fallback` is required w/ an 'auto' `charset`")
+	}
+	if c.fallback, ok = lookupCharset(fallback); !ok {
+		return nil, fmt.Errorf("unknown `charset_fallback` '%s'", fallback)
+	}
+	return c, nil
+}
+
+// Converts the pack's payload. Packs that carry an encoded message in their
+// MsgBytes are left alone, since the decoder reads those instead.
+func (c *charsetConverter) convert(pack *PipelinePack) {
+	if len(pack.MsgBytes) > 0 || pack.Message.Payload == nil {
+		return
+	}
+	payload := *pack.Message.Payload
+	if converted := c.convertString(payload); converted != payload {
+		pack.Message.SetPayload(converted)
+	}
+}
+
+func (c *charsetConverter) convertString(data string) string {
+	if c.decode != nil {
+		return c.decode(data)
+	}
+	// Detect the charset from the BOM, or failing that whether the data is
+	// valid UTF-8.
+	switch {
+	case strings.HasPrefix(data, utf8BOM):
+		return decodeUTF8(data)
+	case strings.HasPrefix(data, utf16LEBOM), strings.HasPrefix(data, utf16BEBOM):
+		return charsets["utf16"](data)
+	case utf8.ValidString(data):
+		return data
+	}
+	return c.fallback(data)
+}
+
+func decodeUTF8(data string) string {
+	data = strings.TrimPrefix(data, utf8BOM)
+	if utf8.ValidString(data) {
+		return data
+	}
+	var buf bytes.Buffer
+	buf.Grow(len(data))
+	// Ranging over a string yields U+FFFD for each invalid byte.
+	for _, r := range data {
+		buf.WriteRune(r)
+	}
+	return buf.String()
+}
+
+// Returns whether the data is all ASCII, which every supported charset but
+// UTF-16 passes through unchanged.
+func isASCII(data string) bool {
+	for i := 0; i < len(data); i++ {
+		if data[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+func decodeLatin1(data string) string {
+	if isASCII(data) {
+		return data
+	}
+	var buf bytes.Buffer
+	buf.Grow(len(data) * 2)
+	for i := 0; i < len(data); i++ {
+		buf.WriteRune(rune(data[i]))
+	}
+	return buf.String()
+}
+
+// Windows-1252 assigns most of the C1 control codes to printable characters.
+// The five it leaves unassigned stay control codes, as in web browsers.
+var windows1252High = [32]rune{
+	0x20ac, 0x0081, 0x201a, 0x0192, 0x201e, 0x2026, 0x2020, 0x2021,
+	0x02c6, 0x2030, 0x0160, 0x2039, 0x0152, 0x008d, 0x017d, 0x008f,
+	0x0090, 0x2018, 0x2019, 0x201c, 0x201d, 0x2022, 0x2013, 0x2014,
+	0x02dc, 0x2122, 0x0161, 0x203a, 0x0153, 0x009d, 0x017e, 0x0178,
+}
+
+func decodeWindows1252(data string) string {
+	if isASCII(data) {
+		return data
+	}
+	var buf bytes.Buffer
+	buf.Grow(len(data) * 2)
+	for i := 0; i < len(data); i++ {
+		b := data[i]
+		if b >= 0x80 && b < 0xa0 {
+			buf.WriteRune(windows1252High[b-0x80])
+		} else {
+			buf.WriteRune(rune(b))
+		}
+	}
+	return buf.String()
+}
+
+// Returns a UTF-16 decoder w/ the provided byte order, which a leading BOM
+// overrides.
+func utf16Decoder(bigEndian bool) charsetDecoder {
+	return func(data string) string {
+		bigEndian := bigEndian
+		if strings.HasPrefix(data, utf16LEBOM) {
+			bigEndian = false
+			data = data[2:]
+		} else if strings.HasPrefix(data, utf16BEBOM) {
+			bigEndian = true
+			data = data[2:]
+		}
+		units := make([]uint16, len(data)/2)
+		for i := range units {
+			if bigEndian {
+				units[i] = uint16(data[2*i])<<8 | uint16(data[2*i+1])
+			} else {
+				units[i] = uint16(data[2*i+1])<<8 | uint16(data[2*i])
+			}
+		}
+		var buf bytes.Buffer
+		buf.Grow(len(data))
+		// Unpaired surrogates decode to U+FFFD.
+		for _, r := range utf16.Decode(units) {
+			buf.WriteRune(r)
+		}
+		if len(data)%2 == 1 {
+			buf.WriteRune(utf8.RuneError)
+		}
+		return buf.String()
+	}
+}
+
+// Returns the sjisTable index of a double byte character, or -1 if the bytes
+// can't be one.
+func sjisIndex(lead, trail byte) int {
+	var l, t int
+	switch {
+	case lead >= 0x81 && lead <= 0x9f:
+		l = int(lead) - 0x81
+	case lead >= 0xe0 && lead <= 0xfc:
+		l = int(lead) - 0xc1
+	default:
+		return -1
+	}
+	switch {
+	case trail >= 0x40 && trail <= 0x7e:
+		t = int(trail) - 0x40
+	case trail >= 0x80 && trail <= 0xfc:
+		t = int(trail) - 0x41
+	default:
+		return -1
+	}
+	return l*188 + t
+}
+
+func decodeShiftJIS(data string) string {
+	if isASCII(data) {
+		return data
+	}
+	var buf bytes.Buffer
+	buf.Grow(len(data) * 3 / 2)
+	for i := 0; i < len(data); i++ {
+		b := data[i]
+		switch {
+		case b < 0x80:
+			buf.WriteByte(b)
+			continue
+		case b == 0x80:
+			buf.WriteRune(0x80)
+			continue
+		case b >= 0xa1 && b <= 0xdf:
+			// Half width katakana.
+			buf.WriteRune(0xff61 + rune(b-0xa1))
+			continue
+		}
+		if i+1 < len(data) {
+			if idx := sjisIndex(b, data[i+1]); idx >= 0 {
+				if r := sjisTable[idx]; r != 0 {
+					buf.WriteRune(rune(r))
+					i++
+					continue
+				}
+				// An ASCII trail byte of an unmapped pair is a character of
+				// its own.
+				if data[i+1] >= utf8.RuneSelf {
+					i++
+				}
+			}
+		}
+		buf.WriteRune(utf8.RuneError)
+	}
+	return buf.String()
+}
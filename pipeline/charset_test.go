@@ -0,0 +1,98 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	gs "github.com/rafrombrc/gospec/src/gospec"
+)
+
+func CharsetSpec(c gs.Context) {
+	convert := func(charset, data string) string {
+		converter, err := newCharsetConverter(charset, "windows-1252")
+		c.Assume(err, gs.IsNil)
+		return converter.convertString(data)
+	}
+
+	c.Specify("Charset conversion", func() {
+		c.Specify("replaces invalid UTF-8", func() {
+			c.Expect(convert("utf-8", "\xef\xbb\xbfok"), gs.Equals, "ok")
+			c.Expect(convert("UTF8", "caf\xe9"), gs.Equals, "caf�")
+		})
+
+		c.Specify("decodes Latin-1 and Windows-1252", func() {
+			c.Expect(convert("latin1", "caf\xe9 \x80"), gs.Equals, "café \u0080")
+			c.Expect(convert("ISO-8859-1", "plain"), gs.Equals, "plain")
+			c.Expect(convert("windows-1252", "caf\xe9 \x80\x81"), gs.Equals,
+				"café €\u0081")
+		})
+
+		c.Specify("decodes UTF-16", func() {
+			c.Expect(convert("utf-16le", "h\x00i\x00=\xd8\x00\xde"), gs.Equals,
+				"hi\U0001f600")
+			c.Expect(convert("utf-16be", "\x00h\x00i"), gs.Equals, "hi")
+			c.Expect(convert("utf-16", "\xfe\xff\x00h\x00i"), gs.Equals, "hi")
+			c.Expect(convert("utf-16", "h\x00i"), gs.Equals, "h�")
+			c.Expect(convert("utf-16le", "\x00\xd8h\x00"), gs.Equals, "�h")
+		})
+
+		c.Specify("decodes Shift_JIS", func() {
+			c.Expect(convert("shift_jis", "\x93\xfa\x96{\x8c\xea \xb1\xb2"),
+				gs.Equals, "日本語 ｱｲ")
+			// NEC special characters, from the Windows extensions.
+			c.Expect(convert("sjis", "\x87\x40"), gs.Equals, "①")
+			// The ASCII trail byte of an unmapped pair is kept.
+			c.Expect(convert("sjis", "\x85\x40a\x81"), gs.Equals, "�@a�")
+			c.Expect(convert("sjis", "\xa0\xff"), gs.Equals, "��")
+		})
+
+		c.Specify("detects the charset", func() {
+			c.Expect(convert("auto", "café"), gs.Equals, "café")
+			c.Expect(convert("auto", "\xef\xbb\xbfcaf\xc3\xa9"), gs.Equals, "café")
+			c.Expect(convert("auto", "\xff\xfeh\x00i\x00"), gs.Equals, "hi")
+			c.Expect(convert("auto", "caf\xe9 \x80"), gs.Equals, "café €")
+			converter, err := newCharsetConverter("auto", "shift-jis")
+			c.Assume(err, gs.IsNil)
+			c.Expect(converter.convertString("\x93\xfa\x96{"), gs.Equals, "日本")
+		})
+
+		c.Specify("converts payloads", func() {
+			converter, err := newCharsetConverter("latin1", "")
+			c.Assume(err, gs.IsNil)
+			pack := NewPipelinePack(nil)
+			pack.Message.SetPayload("caf\xe9")
+			converter.convert(pack)
+			c.Expect(pack.Message.GetPayload(), gs.Equals, "café")
+
+			c.Specify("but not encoded messages", func() {
+				pack.Message.SetPayload("caf\xe9")
+				pack.MsgBytes = append(pack.MsgBytes, "\x0a\x10"...)
+				converter.convert(pack)
+				c.Expect(pack.Message.GetPayload(), gs.Equals, "caf\xe9")
+			})
+		})
+
+		c.Specify("rejects bad settings", func() {
+			converter, err := newCharsetConverter("", "")
+			c.Expect(err, gs.IsNil)
+			c.Expect(converter, gs.IsNil)
+			_, err = newCharsetConverter("ebcdic", "")
+			c.Expect(err.Error(), gs.Equals, "unknown `charset` 'ebcdic'")
+			_, err = newCharsetConverter("auto", "auto")
+			c.Expect(err.Error(), gs.Equals, "unknown `charset_fallback` 'auto'")
+			_, err = newCharsetConverter("auto", "")
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+	})
+}
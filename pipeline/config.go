@@ -25,13 +25,17 @@ import (
 	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
 	"reflect"
 	"regexp"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
 	"code.google.com/p/go-uuid/uuid"
 	"github.com/bbangert/toml"
+	"github.com/mozilla-services/heka/message"
 )
 
 const (
@@ -49,8 +53,18 @@ var (
 )
 
 // Adds a plugin to the set of usable Heka plugins that can be referenced from
-// a Heka config file.
+// a Heka config file. Plugins from external packages register themselves the
+// same way, from their package's `init()` function. Panics if the factory is
+// nil or the name doesn't end in a plugin category (e.g. "Input"), so broken
+// registrations are caught when hekad starts rather than when a config file
+// first references the plugin.
 func RegisterPlugin(name string, factory func() interface{}) {
+	if factory == nil {
+		panic(fmt.Sprintf("RegisterPlugin: nil factory for plugin '%s'", name))
+	}
+	if getPluginCategory(name) == "" {
+		panic(fmt.Sprintf("RegisterPlugin: '%s' doesn't end in a plugin category", name))
+	}
 	AvailablePlugins[name] = factory
 }
 
@@ -134,6 +148,16 @@ type PipelineConfig struct {
 	// PipelinePack supply for Filter plugins (separate pool prevents
 	// deadlocks).
 	injectRecycleChan chan *PipelinePack
+	// Instrumented access to the input and inject pack supplies.
+	inputPool  *packPool
+	injectPool *packPool
+	// Concurrency caps for the input, decoder, and output stages.
+	inputProcs   procLimiter
+	decoderProcs procLimiter
+	outputProcs  procLimiter
+	// Matcher for messages whose routes are being traced, nil if tracing is
+	// off.
+	traceSpec *message.MatcherSpecification
 	// Stores log messages generated by plugin config errors.
 	LogMsgs []string
 	// Lock protecting access to the set of running filters so dynamic filters
@@ -174,6 +198,8 @@ type PipelineConfig struct {
 	// Lock protecting access to running outputs so they can be removed
 	// safely.
 	outputsLock sync.RWMutex
+	// Is freed when all OutputRunners have stopped.
+	outputsWg sync.WaitGroup
 	// Internal reporting channel.
 	reportRecycleChan chan *PipelinePack
 
@@ -186,6 +212,17 @@ type PipelineConfig struct {
 	makersByCategory map[string][]PluginMaker
 	// Number of config loading errors.
 	errcnt uint
+
+	// Config files that have been loaded via PreloadFromConfigFile, in load
+	// order. These are re-read when the filter and output config is reloaded.
+	configFiles []string
+	// Config file or directory passed to PreloadFromConfigPath, if any. A
+	// directory is re-scanned when the config is reloaded.
+	configPath string
+	// Config file each plugin section was loaded from, by section name.
+	sectionFiles map[string]string
+	// Mutex preventing concurrent config reloads.
+	reloadLock sync.Mutex
 }
 
 // Creates and initializes a PipelineConfig object. `nil` value for `globals`
@@ -211,8 +248,22 @@ func NewPipelineConfig(globals *GlobalConfigStruct) (config *PipelineConfig) {
 
 	config.allEncoders = make(map[string]Encoder)
 	config.router = NewMessageRouter(globals.PluginChanSize)
+	config.router.tenants = newTenantTracker(globals)
 	config.inputRecycleChan = make(chan *PipelinePack, globals.PoolSize)
 	config.injectRecycleChan = make(chan *PipelinePack, globals.PoolSize)
+	config.inputPool = newPackPool(config.inputRecycleChan, globals.PoolOverflow,
+		globals.PoolOverflowMax)
+	// Injected messages are Heka's own and have nowhere to be dropped to, so
+	// their pool waits rather than rejecting.
+	injectOverflow := globals.PoolOverflow
+	if injectOverflow == POOL_OVERFLOW_REJECT {
+		injectOverflow = POOL_OVERFLOW_BLOCK
+	}
+	config.injectPool = newPackPool(config.injectRecycleChan, injectOverflow,
+		globals.PoolOverflowMax)
+	config.inputProcs = newProcLimiter(globals.MaxInputProcs)
+	config.decoderProcs = newProcLimiter(globals.MaxDecoderProcs)
+	config.outputProcs = newProcLimiter(globals.MaxOutputProcs)
 	config.LogMsgs = make([]string, 0, 4)
 	config.allDecoders = make([]DecoderRunner, 0, 10)
 	config.allSyncDecoders = make([]ReportingDecoder, 0, 10)
@@ -231,7 +282,7 @@ func (self *PipelineConfig) PipelinePack(msgLoopCount uint) *PipelinePack {
 	if msgLoopCount++; msgLoopCount > self.Globals.MaxMsgLoops {
 		return nil
 	}
-	pack := <-self.injectRecycleChan
+	pack := self.injectPool.get()
 	pack.Message.SetTimestamp(time.Now().UnixNano())
 	pack.Message.SetUuid(uuid.NewRandom())
 	pack.Message.SetHostname(self.hostname)
@@ -241,6 +292,29 @@ func (self *PipelineConfig) PipelinePack(msgLoopCount uint) *PipelinePack {
 	return pack
 }
 
+// Fills in the Uuid, Timestamp (w/ the current time), and Hostname (w/ the
+// local hostname) of an input's message if they're missing and the
+// `fill_message_defaults` setting is on. Returns whether the message was
+// changed.
+func (self *PipelineConfig) fillMessageDefaults(msg *message.Message) (changed bool) {
+	if !self.Globals.FillMessageDefaults {
+		return false
+	}
+	if len(msg.GetUuid()) == 0 {
+		msg.SetUuid(uuid.NewRandom())
+		changed = true
+	}
+	if msg.GetTimestamp() == 0 {
+		msg.SetTimestamp(time.Now().UnixNano())
+		changed = true
+	}
+	if msg.GetHostname() == "" {
+		msg.SetHostname(self.hostname)
+		changed = true
+	}
+	return
+}
+
 // Returns the router.
 func (self *PipelineConfig) Router() MessageRouter {
 	return self.router
@@ -293,6 +367,19 @@ func (self *PipelineConfig) Decoder(name string) (decoder Decoder, ok bool) {
 	return
 }
 
+// Returns the converter for the named decoder's `charset` setting, nil if it
+// doesn't have one.
+func (self *PipelineConfig) decoderCharset(name string) *charsetConverter {
+	self.makersLock.RLock()
+	maker, ok := self.DecoderMakers[name].(*pluginMaker)
+	self.makersLock.RUnlock()
+	if !ok {
+		return nil
+	}
+	charset, _ := maker.charsetConverter()
+	return charset
+}
+
 // Instantiates, starts, and returns a DecoderRunner wrapped around a newly
 // created Decoder of the specified name.
 func (self *PipelineConfig) DecoderRunner(baseName, fullName string) (
@@ -335,6 +422,36 @@ func (self *PipelineConfig) StopDecoderRunner(dRunner DecoderRunner) (ok bool) {
 	return
 }
 
+// Makes the decoder available to any inputs that create decoders after it has
+// been added, e.g. TcpInput connections opened from then on. Returns an error
+// if a decoder w/ the same name already exists.
+func (self *PipelineConfig) AddDecoderMaker(maker PluginMaker) error {
+	if maker.Category() != "Decoder" {
+		return fmt.Errorf("AddDecoderMaker '%s' failed: not a decoder", maker.Name())
+	}
+	self.makersLock.Lock()
+	defer self.makersLock.Unlock()
+	if _, ok := self.DecoderMakers[maker.Name()]; ok {
+		return fmt.Errorf("AddDecoderMaker '%s' failed: decoder already exists",
+			maker.Name())
+	}
+	self.DecoderMakers[maker.Name()] = maker
+	return nil
+}
+
+// Removes the named decoder so no new instances of it will be created.
+// Decoders that are already running aren't stopped. Returns true if the
+// decoder was removed.
+func (self *PipelineConfig) RemoveDecoderMaker(name string) bool {
+	self.makersLock.Lock()
+	defer self.makersLock.Unlock()
+	if _, ok := self.DecoderMakers[name]; !ok {
+		return false
+	}
+	delete(self.DecoderMakers, name)
+	return true
+}
+
 // Instantiates and returns an Encoder of the specified name.
 func (self *PipelineConfig) Encoder(baseName, fullName string) (Encoder, bool) {
 	self.makersLock.RLock()
@@ -416,6 +533,9 @@ func (self *PipelineConfig) RemoveFilterRunner(name string) bool {
 	self.filtersLock.Lock()
 	defer self.filtersLock.Unlock()
 	if fRunner, ok := self.FilterRunners[name]; ok {
+		if fo, ok := fRunner.(*foRunner); ok {
+			fo.setRemoved()
+		}
 		self.router.RemoveFilterMatcher() <- fRunner.MatchRunner()
 		delete(self.FilterRunners, name)
 		return true
@@ -432,6 +552,7 @@ func (self *PipelineConfig) AddInputRunner(iRunner InputRunner) error {
 	self.inputsWg.Add(1)
 	if err := iRunner.Start(self, &self.inputsWg); err != nil {
 		self.inputsWg.Done()
+		delete(self.InputRunners, iRunner.Name())
 		return fmt.Errorf("AddInputRunner '%s' failed to start: %s", iRunner.Name(), err)
 	}
 	return nil
@@ -451,9 +572,29 @@ func (self *PipelineConfig) RemoveInputRunner(iRunner InputRunner) {
 	delete(self.InputRunners, name)
 	self.inputsLock.Unlock()
 
+	if pausable, ok := iRunner.(PausableRunner); ok {
+		pausable.Resume()
+	}
 	iRunner.Input().Stop()
 }
 
+// AddOutputRunner starts the provided OutputRunner, adds it to the set of
+// running Outputs, and registers its matcher with the router.
+func (self *PipelineConfig) AddOutputRunner(oRunner OutputRunner) error {
+	self.outputsLock.Lock()
+	defer self.outputsLock.Unlock()
+	self.OutputRunners[oRunner.Name()] = oRunner
+	self.outputsWg.Add(1)
+	if err := oRunner.Start(self, &self.outputsWg); err != nil {
+		self.outputsWg.Done()
+		delete(self.OutputRunners, oRunner.Name())
+		return fmt.Errorf("AddOutputRunner '%s' failed to start: %s",
+			oRunner.Name(), err)
+	}
+	self.router.AddOutputMatcher() <- oRunner.MatchRunner()
+	return nil
+}
+
 // RemoveOutputRunner unregisters the provided OutputRunner from heka, and
 // removes it's message matcher from the heka router.
 func (self *PipelineConfig) RemoveOutputRunner(oRunner OutputRunner) {
@@ -461,6 +602,9 @@ func (self *PipelineConfig) RemoveOutputRunner(oRunner OutputRunner) {
 	self.makersLock.Lock()
 	outputMakers := self.makers["Output"]
 	if _, ok := outputMakers[name]; ok {
+		if fo, ok := oRunner.(*foRunner); ok {
+			fo.setRemoved()
+		}
 		self.router.RemoveOutputMatcher() <- oRunner.MatchRunner()
 		delete(outputMakers, name)
 	}
@@ -546,6 +690,9 @@ func getPluginCategory(pluginType string) string {
 
 type CommonConfig struct {
 	Typ string `toml:"type"`
+	// One of the LOG_LEVEL_* values, controlling what the plugin's runner
+	// logs.
+	LogLevel string `toml:"log_level"`
 }
 
 type CommonInputConfig struct {
@@ -556,6 +703,9 @@ type CommonInputConfig struct {
 	SendDecodeFailures *bool `toml:"send_decode_failures"`
 	CanExit            *bool `toml:"can_exit"`
 	Retries            RetryOptions
+	// Backoff for retries done by the plugin itself, such as reconnecting,
+	// nil unless configured.
+	Backoff *RetryOptions
 }
 
 type CommonFOConfig struct {
@@ -566,6 +716,91 @@ type CommonFOConfig struct {
 	Retries    RetryOptions
 	Encoder    string // Output only.
 	UseFraming *bool  `toml:"use_framing"` // Output only.
+	DropOnFull *bool  `toml:"drop_on_full"`
+	PoolSize   uint   `toml:"pool_size"` // Filter only.
+	Tenant     string `toml:"tenant"`
+	// Filter only.
+	PreserveState      *bool `toml:"preserve_state"`
+	StateFlushInterval uint  `toml:"state_flush_interval"`
+	// Output only.
+	FramingVersion  uint `toml:"framing_version"`
+	FramingChecksum bool `toml:"framing_checksum"`
+	// Backoff for retries done by the plugin itself, such as reconnecting,
+	// nil unless configured.
+	Backoff *RetryOptions
+	// Output only. Size limits applied to messages before they're encoded,
+	// 0 for no limit.
+	MaxPayloadSize   uint   `toml:"max_payload_size"`
+	MaxFieldSize     uint   `toml:"max_field_size"`
+	TruncationMarker string `toml:"truncation_marker"`
+
+	// Severity range the plugin sees, narrowing the message matcher. Nil
+	// unless configured.
+	MinSeverity *int `toml:"min_severity"`
+	MaxSeverity *int `toml:"max_severity"`
+
+	// Output only. Outputs in the same round robin group split the messages
+	// their shared matcher selects, each message going to just one of them.
+	RoundRobinGroup string `toml:"round_robin_group"`
+	// Output only. Name of the output whose messages this output gets a copy
+	// of. A shadow never slows down the output it shadows, and its failures
+	// don't bring down Heka.
+	ShadowOf string `toml:"shadow_of"`
+	// Output only. Cron style windows outside of which the output gets no
+	// messages, in the `schedule_timezone` time zone or local time.
+	Schedule         []string `toml:"schedule"`
+	ScheduleTimezone string   `toml:"schedule_timezone"`
+	// Output only. If true the output only gets messages outside of the
+	// `schedule` windows.
+	ScheduleInvert bool `toml:"schedule_invert"`
+	// If true the watchdog replaces the plugin w/ a new instance when it
+	// stops taking messages for longer than the `stall_timeout`.
+	StallRestart bool `toml:"stall_restart"`
+}
+
+// Returns the message matcher, narrowed to the `min_severity` and
+// `max_severity` range if either is set.
+func (c CommonFOConfig) matcherSpec() (string, error) {
+	matcher := c.Matcher
+	if c.MinSeverity == nil && c.MaxSeverity == nil {
+		return matcher, nil
+	}
+	for _, sev := range []*int{c.MinSeverity, c.MaxSeverity} {
+		if sev != nil && (*sev < 0 || *sev > 7) {
+			return "", fmt.Errorf("severity must be between 0 and 7, got %d", *sev)
+		}
+	}
+	if c.MinSeverity != nil && c.MaxSeverity != nil && *c.MinSeverity > *c.MaxSeverity {
+		return "", errors.New("`min_severity` can't be greater than `max_severity`")
+	}
+	matcher = fmt.Sprintf("(%s)", matcher)
+	if c.MinSeverity != nil {
+		matcher += fmt.Sprintf(" && Severity >= %d", *c.MinSeverity)
+	}
+	if c.MaxSeverity != nil {
+		matcher += fmt.Sprintf(" && Severity <= %d", *c.MaxSeverity)
+	}
+	return matcher, nil
+}
+
+type CommonDecoderConfig struct {
+	PoolSize uint `toml:"pool_size"`
+	// Milliseconds a decoder gets to decode a message before the runner gives
+	// up on it and switches to a new copy of the decoder. 0 means no limit.
+	DecodeTimeout uint `toml:"decode_timeout"`
+	// Seconds a payload that timed out is kept from being decoded again. 0
+	// disables the quarantine.
+	QuarantineTtl uint `toml:"quarantine_ttl"`
+	// Maximum number of quarantined payloads.
+	QuarantineSize uint `toml:"quarantine_size"`
+	// Maximum number of timed out decodes each runner leaves running at
+	// once. Past that the runner waits for the decode instead.
+	MaxAbandoned uint `toml:"max_abandoned"`
+	// Character encoding of the payloads the decoder gets, which are
+	// converted to UTF-8 before decoding. "auto" detects it.
+	Charset string `toml:"charset"`
+	// Charset "auto" assumes for payloads that aren't UTF-8 and lack a BOM.
+	CharsetFallback string `toml:"charset_fallback"`
 }
 
 type CommonSplitterConfig struct {
@@ -617,6 +852,67 @@ func (self *PipelineConfig) RegisterDefault(name string) error {
 	return nil
 }
 
+// Records that the named plugin section was loaded from the given file,
+// returning an error if a section w/ the same name was already loaded from
+// this or another config file. Each plugin instance needs its own section
+// name, multiple instances of a plugin type are configured using the `type`
+// setting.
+func checkDuplicateSection(sectionFiles map[string]string, name,
+	filename string) error {
+
+	if prevFile, ok := sectionFiles[name]; ok {
+		return fmt.Errorf("Duplicate config section [%s] in %s, already loaded from %s",
+			name, filename, prevFile)
+	}
+	sectionFiles[name] = filename
+	return nil
+}
+
+// Returns the config files that should be loaded for the given config path.
+// If the path is a directory, this is every `*.toml` file in it, sorted by
+// name, otherwise it's just the path itself.
+func ConfigFilePaths(configPath string) ([]string, error) {
+	fi, err := os.Stat(configPath)
+	if err != nil {
+		return nil, fmt.Errorf("can't stat config path: %s", err)
+	}
+	if !fi.IsDir() {
+		return []string{configPath}, nil
+	}
+	files, err := ioutil.ReadDir(configPath)
+	if err != nil {
+		return nil, fmt.Errorf("can't read config dir: %s", err)
+	}
+	paths := make([]string, 0, len(files))
+	for _, f := range files {
+		// Skip non *.toml files and subdirectories in a config dir.
+		if f.IsDir() || !strings.HasSuffix(f.Name(), ".toml") {
+			continue
+		}
+		paths = append(paths, filepath.Join(configPath, f.Name()))
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+// PreloadFromConfigPath preloads the plugin configuration from a config
+// file, or from every `*.toml` file in a config directory. When a directory
+// is used, files that are added to or removed from it are picked up by
+// ReloadConfig.
+func (self *PipelineConfig) PreloadFromConfigPath(configPath string) error {
+	paths, err := ConfigFilePaths(configPath)
+	if err != nil {
+		return err
+	}
+	self.configPath = configPath
+	for _, path := range paths {
+		if err = self.PreloadFromConfigFile(path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // PreloadFromConfigFile loads all plugin configuration from a TOML
 // configuration file, generates a PluginMaker for each loaded section, and
 // stores the created PluginMakers in the makersByCategory map. The
@@ -645,12 +941,21 @@ func (self *PipelineConfig) PreloadFromConfigFile(filename string) error {
 	if self.defaultConfigs == nil {
 		self.defaultConfigs = makeDefaultConfigs()
 	}
+	if self.sectionFiles == nil {
+		self.sectionFiles = make(map[string]string)
+	}
+	self.configFiles = append(self.configFiles, filename)
 
 	// Load all the plugin makers and file them by category.
 	for name, conf := range configFile {
 		if name == HEKA_DAEMON {
 			continue
 		}
+		if err = checkDuplicateSection(self.sectionFiles, name, filename); err != nil {
+			self.log(err.Error())
+			self.errcnt++
+			continue
+		}
 		if _, ok := self.defaultConfigs[name]; ok {
 			self.defaultConfigs[name] = true
 		}
@@ -778,11 +1083,15 @@ func subsFromSection(section toml.Primitive) []string {
 	return subs
 }
 
+// Reads the file at the provided path, returning its contents w/ all of the
+// `%ENV[VAR_NAME]` references replaced by the values of the corresponding
+// environment variables.
 func ReplaceEnvsFile(path string) (string, error) {
 	file, err := os.Open(path)
 	if err != nil {
 		return "", err
 	}
+	defer file.Close()
 	r, err := EnvSub(file)
 	if err != nil {
 		return "", err
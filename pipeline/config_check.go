@@ -0,0 +1,141 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/mozilla-services/heka/message"
+)
+
+// Plugin categories that are fully initialized when checking a config. Their
+// Init methods don't open connections or start goroutines, so it's safe to
+// call them w/o running the pipeline.
+var initCheckedCategories = map[string]bool{
+	"Decoder":  true,
+	"Encoder":  true,
+	"Splitter": true,
+}
+
+// CheckConfig verifies all of the plugin config that has been prepped from
+// calls to PreloadFromConfigFile, w/o starting any plugins. Every section's
+// config is decoded. Decoders, encoders, and splitters are initialized.
+// Inputs, filters, and outputs have their common settings checked and, if
+// they implement `ValidatesConfig`, their own config validated. All errors
+// are logged to LogMsgs, so they can be reported together. This should be
+// called instead of LoadConfig, never in addition to it.
+func (self *PipelineConfig) CheckConfig() error {
+	for name, registered := range self.defaultConfigs {
+		if registered {
+			continue
+		}
+		if err := self.RegisterDefault(name); err != nil {
+			self.log(err.Error())
+			self.errcnt++
+		}
+	}
+
+	// Makers need to be registered first so MultiDecoders and inputs can
+	// find the plugins they reference.
+	makersByCategory := self.makersByCategory
+	self.makersLock.Lock()
+	for category, makers := range makersByCategory {
+		if category == "MultiDecoder" {
+			category = "Decoder"
+		}
+		for _, maker := range makers {
+			self.makers[category][maker.Name()] = maker
+		}
+	}
+	self.makersLock.Unlock()
+
+	order := []string{"Decoder", "MultiDecoder", "Encoder", "Splitter", "Input",
+		"Filter", "Output"}
+	for _, category := range order {
+		for _, maker := range makersByCategory[category] {
+			LogInfo.Printf("Checking: [%s]\n", maker.Name())
+			if err := self.checkMaker(category, maker); err != nil {
+				self.log(fmt.Sprintf("[%s]: %s", maker.Name(), err))
+				self.errcnt++
+			}
+		}
+	}
+
+	if self.errcnt != 0 {
+		return fmt.Errorf("%d errors in config", self.errcnt)
+	}
+	return nil
+}
+
+// Checks a single plugin section's config.
+func (self *PipelineConfig) checkMaker(category string, maker PluginMaker) error {
+	if category == "MultiDecoder" {
+		category = "Decoder"
+	}
+	if initCheckedCategories[category] {
+		_, _, err := maker.Make()
+		return err
+	}
+
+	config, err := maker.PrepConfig()
+	if err != nil {
+		return err
+	}
+	mutable, ok := maker.(MutableMaker)
+	if !ok {
+		return nil
+	}
+	commonTypedConfig, err := mutable.OrigPrepCommonTypedConfig()
+	if err != nil {
+		return fmt.Errorf("can't decode common config: %s", err)
+	}
+	switch common := commonTypedConfig.(type) {
+	case CommonInputConfig:
+		if common.Decoder != "" {
+			if _, ok := self.makers["Decoder"][common.Decoder]; !ok {
+				return fmt.Errorf("decoder '%s' isn't configured", common.Decoder)
+			}
+		}
+		if common.Splitter != "" {
+			if _, ok := self.makers["Splitter"][common.Splitter]; !ok {
+				return fmt.Errorf("splitter '%s' isn't configured", common.Splitter)
+			}
+		}
+	case CommonFOConfig:
+		if common.Matcher == "" {
+			return errors.New("missing message matcher")
+		}
+		var matcherSpec string
+		if matcherSpec, err = common.matcherSpec(); err != nil {
+			return fmt.Errorf("invalid severity range: %s", err)
+		}
+		if _, err = message.CreateMatcherSpecification(matcherSpec); err != nil {
+			return fmt.Errorf("invalid message matcher: %s", err)
+		}
+		if common.Encoder != "" {
+			if _, ok := self.makers["Encoder"][common.Encoder]; !ok {
+				return fmt.Errorf("encoder '%s' isn't configured", common.Encoder)
+			}
+		}
+	}
+
+	if pMaker, ok := maker.(*pluginMaker); ok {
+		if validator, ok := pMaker.makePlugin().(ValidatesConfig); ok {
+			return validator.ValidateConfig(config)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,246 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+
+	"github.com/bbangert/toml"
+)
+
+// Plugin categories that can be added, removed, or reconfigured while Heka is
+// running, in the order in which they need to be started. Changes to any of
+// the other categories require a restart.
+var reloadableCategories = []string{"Output", "Filter", "Input"}
+
+// sectionDiff describes the differences between two sets of TOML plugin
+// config sections.
+type sectionDiff struct {
+	added   []string
+	removed []string
+	changed []string
+}
+
+// diffSections compares the currently loaded config sections against a new
+// set, returning the names of the sections that have been added, removed, or
+// changed. Names are sorted so the reload order is predictable.
+func diffSections(current, next map[string]toml.Primitive) (diff sectionDiff) {
+	for name, section := range next {
+		currentSection, ok := current[name]
+		if !ok {
+			diff.added = append(diff.added, name)
+		} else if !reflect.DeepEqual(currentSection, section) {
+			diff.changed = append(diff.changed, name)
+		}
+	}
+	for name := range current {
+		if _, ok := next[name]; !ok {
+			diff.removed = append(diff.removed, name)
+		}
+	}
+	sort.Strings(diff.added)
+	sort.Strings(diff.removed)
+	sort.Strings(diff.changed)
+	return
+}
+
+// ReloadConfig re-reads all of the config files that were loaded at startup,
+// re-scanning the config directory if one was used, and applies any input,
+// filter, and output changes to the running pipeline. New plugins are
+// started, removed plugins are stopped, and plugins whose config has changed
+// are stopped and then started again with the new config. Inputs whose config
+// hasn't changed are left untouched, so their connections aren't dropped.
+// Errors are logged and counted, any plugins that load without error will
+// still be applied.
+func (self *PipelineConfig) ReloadConfig() error {
+	self.reloadLock.Lock()
+	defer self.reloadLock.Unlock()
+
+	if self.Globals.IsShuttingDown() {
+		return errors.New("can't reload config during shutdown")
+	}
+	if len(self.configFiles) == 0 {
+		return errors.New("no config files loaded")
+	}
+	filenames := self.configFiles
+	if self.configPath != "" {
+		var err error
+		if filenames, err = ConfigFilePaths(self.configPath); err != nil {
+			return err
+		}
+	}
+
+	var errcnt uint
+	configFile := make(ConfigFile)
+	sectionFiles := make(map[string]string)
+	for _, filename := range filenames {
+		contents, err := ReplaceEnvsFile(filename)
+		if err != nil {
+			return err
+		}
+		fileConfig := make(ConfigFile)
+		if _, err = toml.Decode(contents, &fileConfig); err != nil {
+			return fmt.Errorf("Error decoding config file: %s", err)
+		}
+		for name, conf := range fileConfig {
+			if name != HEKA_DAEMON {
+				if err = checkDuplicateSection(sectionFiles, name, filename); err != nil {
+					self.log(err.Error())
+					errcnt++
+					continue
+				}
+			}
+			configFile[name] = conf
+		}
+	}
+
+	nextSections := make(map[string]map[string]toml.Primitive)
+	nextMakers := make(map[string]PluginMaker)
+	for _, category := range reloadableCategories {
+		nextSections[category] = make(map[string]toml.Primitive)
+	}
+	for name, conf := range configFile {
+		if name == HEKA_DAEMON {
+			continue
+		}
+		maker, err := NewPluginMaker(name, self, conf)
+		if err != nil {
+			self.log(err.Error())
+			errcnt++
+			continue
+		}
+		if sections, ok := nextSections[maker.Category()]; ok {
+			sections[name] = conf
+			nextMakers[name] = maker
+		}
+	}
+
+	for _, category := range reloadableCategories {
+		currentSections := make(map[string]toml.Primitive)
+		self.makersLock.RLock()
+		for name, maker := range self.makers[category] {
+			if pMaker, ok := maker.(*pluginMaker); ok {
+				currentSections[name] = pMaker.tomlSection
+			}
+		}
+		self.makersLock.RUnlock()
+
+		diff := diffSections(currentSections, nextSections[category])
+		for _, name := range diff.removed {
+			LogInfo.Printf("Reload: removing [%s]\n", name)
+			self.stopReloadable(category, name)
+		}
+		for _, name := range diff.changed {
+			LogInfo.Printf("Reload: restarting [%s]\n", name)
+			self.stopReloadable(category, name)
+			if err := self.startReloadable(category, nextMakers[name]); err != nil {
+				self.log(err.Error())
+				errcnt++
+			}
+		}
+		for _, name := range diff.added {
+			LogInfo.Printf("Reload: adding [%s]\n", name)
+			if err := self.startReloadable(category, nextMakers[name]); err != nil {
+				self.log(err.Error())
+				errcnt++
+			}
+		}
+	}
+
+	if errcnt != 0 {
+		return fmt.Errorf("%d errors reloading plugins", errcnt)
+	}
+	return nil
+}
+
+// stopReloadable removes the named input, filter, or output from the running
+// config and waits for it to stop. Filters and outputs finish processing any
+// messages they've already received.
+func (self *PipelineConfig) stopReloadable(category, name string) {
+	var runner PluginRunner
+	switch category {
+	case "Input":
+		self.inputsLock.RLock()
+		iRunner, ok := self.InputRunners[name]
+		self.inputsLock.RUnlock()
+		if ok {
+			self.RemoveInputRunner(iRunner)
+			runner = iRunner
+		}
+	case "Filter":
+		fRunner, ok := self.Filter(name)
+		if ok && self.RemoveFilterRunner(name) {
+			runner = fRunner
+		}
+	case "Output":
+		self.outputsLock.RLock()
+		oRunner, ok := self.OutputRunners[name]
+		self.outputsLock.RUnlock()
+		if ok {
+			self.RemoveOutputRunner(oRunner)
+			runner = oRunner
+		}
+	}
+
+	self.makersLock.Lock()
+	delete(self.makers[category], name)
+	self.makersLock.Unlock()
+
+	switch r := runner.(type) {
+	case *foRunner:
+		<-r.stopped
+	case *iRunner:
+		// Wait for the input to release any listeners, in case it's being
+		// restarted w/ the same address.
+		if r.stopped != nil {
+			<-r.stopped
+		}
+	}
+}
+
+// startReloadable registers the provided maker, and uses it to create and
+// start a new input, filter, or output.
+func (self *PipelineConfig) startReloadable(category string, maker PluginMaker) error {
+	LogInfo.Printf("Loading: [%s]\n", maker.Name())
+	if _, err := maker.PrepConfig(); err != nil {
+		return err
+	}
+	runner, err := maker.MakeRunner("")
+	if err != nil {
+		return fmt.Errorf("Error making runner for %s: %s", maker.Name(), err.Error())
+	}
+
+	self.makersLock.Lock()
+	self.makers[category][maker.Name()] = maker
+	self.makersLock.Unlock()
+
+	switch category {
+	case "Input":
+		err = self.AddInputRunner(runner.(InputRunner))
+	case "Filter":
+		err = self.AddFilterRunner(runner.(FilterRunner))
+	case "Output":
+		err = self.AddOutputRunner(runner.(OutputRunner))
+	}
+	if err != nil {
+		self.makersLock.Lock()
+		delete(self.makers[category], maker.Name())
+		self.makersLock.Unlock()
+	}
+	return err
+}
@@ -0,0 +1,114 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/bbangert/toml"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+)
+
+func ConfigReloadSpec(c gs.Context) {
+	c.Specify("Diffing config sections", func() {
+		var current, next ConfigFile
+		currentStr := `
+		[unchanged]
+		type = "CounterFilter"
+		message_matcher = "TRUE"
+
+		[changed]
+		type = "CounterFilter"
+		message_matcher = "TRUE"
+
+		[removed]
+		type = "CounterFilter"
+		message_matcher = "TRUE"
+		`
+		nextStr := `
+		[unchanged]
+		type = "CounterFilter"
+		message_matcher = "TRUE"
+
+		[changed]
+		type = "CounterFilter"
+		message_matcher = "Type == 'foo'"
+
+		[added]
+		type = "CounterFilter"
+		message_matcher = "TRUE"
+		`
+		_, err := toml.Decode(currentStr, &current)
+		c.Assume(err, gs.IsNil)
+		_, err = toml.Decode(nextStr, &next)
+		c.Assume(err, gs.IsNil)
+
+		diff := diffSections(current, next)
+		c.Expect(len(diff.added), gs.Equals, 1)
+		c.Expect(diff.added[0], gs.Equals, "added")
+		c.Expect(len(diff.removed), gs.Equals, 1)
+		c.Expect(diff.removed[0], gs.Equals, "removed")
+		c.Expect(len(diff.changed), gs.Equals, 1)
+		c.Expect(diff.changed[0], gs.Equals, "changed")
+
+		c.Specify("finds no changes in identical config", func() {
+			diff = diffSections(next, next)
+			c.Expect(len(diff.added), gs.Equals, 0)
+			c.Expect(len(diff.removed), gs.Equals, 0)
+			c.Expect(len(diff.changed), gs.Equals, 0)
+		})
+	})
+
+	c.Specify("Listing config files", func() {
+		dir, err := ioutil.TempDir("", "heka-config")
+		c.Assume(err, gs.IsNil)
+		defer os.RemoveAll(dir)
+		for _, name := range []string{"b.toml", "a.toml", "notes.txt"} {
+			err = ioutil.WriteFile(filepath.Join(dir, name), nil, 0644)
+			c.Assume(err, gs.IsNil)
+		}
+		err = os.Mkdir(filepath.Join(dir, "sub.toml"), 0755)
+		c.Assume(err, gs.IsNil)
+
+		c.Specify("finds only the toml files in a dir, in order", func() {
+			paths, err := ConfigFilePaths(dir)
+			c.Expect(err, gs.IsNil)
+			c.Expect(len(paths), gs.Equals, 2)
+			c.Expect(paths[0], gs.Equals, filepath.Join(dir, "a.toml"))
+			c.Expect(paths[1], gs.Equals, filepath.Join(dir, "b.toml"))
+		})
+
+		c.Specify("returns a single file as is", func() {
+			path := filepath.Join(dir, "notes.txt")
+			paths, err := ConfigFilePaths(path)
+			c.Expect(err, gs.IsNil)
+			c.Expect(len(paths), gs.Equals, 1)
+			c.Expect(paths[0], gs.Equals, path)
+		})
+
+		c.Specify("errors on a missing path", func() {
+			_, err := ConfigFilePaths(filepath.Join(dir, "missing"))
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+	})
+
+	c.Specify("Reloading without any loaded config files", func() {
+		pConfig := NewPipelineConfig(nil)
+		err := pConfig.ReloadConfig()
+		c.Expect(err, gs.Not(gs.IsNil))
+	})
+}
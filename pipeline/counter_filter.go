@@ -16,8 +16,10 @@
 package pipeline
 
 import (
+	"encoding/json"
 	"fmt"
 	"sort"
+	"sync"
 	"time"
 )
 
@@ -29,6 +31,17 @@ type CounterFilter struct {
 	count     uint
 	rate      float64
 	rates     []float64
+	// Protects the counts, which SaveState reads from another goroutine.
+	lock sync.Mutex
+}
+
+// Version of the CounterFilter's saved state format.
+const counterStateVersion = 1
+
+// Saved state of a CounterFilter.
+type counterState struct {
+	Count uint      `json:"count"`
+	Rates []float64 `json:"rates"`
 }
 
 // CounterFilter config struct, used only for specifying default ticker
@@ -69,7 +82,9 @@ func (this *CounterFilter) Run(fr FilterRunner, h PluginHelper) (err error) {
 				break
 			}
 			msgLoopCount = pack.MsgLoopCount
+			this.lock.Lock()
 			this.count++
+			this.lock.Unlock()
 			pack.Recycle()
 		case <-ticker:
 			this.tally(fr, h, msgLoopCount)
@@ -79,16 +94,44 @@ func (this *CounterFilter) Run(fr FilterRunner, h PluginHelper) (err error) {
 }
 
 func (this *CounterFilter) CleanupForRestart() {
+	this.lock.Lock()
 	this.lastCount = 0
 	this.count = 0
 	this.rate = 0
 	this.rates = nil
+	this.lock.Unlock()
+}
+
+func (this *CounterFilter) SaveState() (version uint, data []byte, err error) {
+	this.lock.Lock()
+	state := counterState{Count: this.count, Rates: this.rates}
+	data, err = json.Marshal(state)
+	this.lock.Unlock()
+	return counterStateVersion, data, err
+}
+
+func (this *CounterFilter) RestoreState(version uint, data []byte) error {
+	if version != counterStateVersion {
+		return fmt.Errorf("unsupported state version: %d", version)
+	}
+	var state counterState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return err
+	}
+	this.lock.Lock()
+	this.count = state.Count
+	this.lastCount = state.Count
+	this.rates = state.Rates
+	this.lock.Unlock()
+	return nil
 }
 
 func (this *CounterFilter) tally(fr FilterRunner, h PluginHelper,
 	msgLoopCount uint) {
 	const msgType = "heka.counter-output"
 
+	this.lock.Lock()
+	defer this.lock.Unlock()
 	msgsSent := this.count - this.lastCount
 	if msgsSent == 0 {
 		return
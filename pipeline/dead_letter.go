@@ -0,0 +1,69 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"errors"
+	"time"
+
+	"code.google.com/p/go-uuid/uuid"
+	"github.com/mozilla-services/heka/message"
+)
+
+// Message type used for records that an output permanently failed to
+// deliver. A FileOutput w/ a `message_matcher` of
+// "Type == 'heka.dead-letter'" can be used to capture them.
+const DEAD_LETTER_TYPE = "heka.dead-letter"
+
+// Implemented by runners that can inject messages into the router. The
+// OutputRunners Heka provides all implement it.
+type MessageInjector interface {
+	Inject(pack *PipelinePack) bool
+}
+
+// Injects a new message carrying a record that an output failed to deliver.
+// The record is stored in the payload, and the `DeadLetterOutput` and
+// `DeadLetterError` fields describe where it was going and why it failed.
+// The message won't be injected if it would be routed back to the failing
+// output.
+func InjectDeadLetter(or OutputRunner, h PluginHelper, record []byte,
+	reason error) error {
+
+	injector, ok := or.(MessageInjector)
+	if !ok {
+		return errors.New("output runner can't inject messages")
+	}
+	pack := h.PipelinePack(0)
+	if pack == nil {
+		return errors.New("exceeded MaxMsgLoops")
+	}
+	pConfig := h.PipelineConfig()
+	pack.Message.SetUuid(uuid.NewRandom())
+	pack.Message.SetTimestamp(time.Now().UnixNano())
+	pack.Message.SetType(DEAD_LETTER_TYPE)
+	pack.Message.SetLogger(or.Name())
+	pack.Message.SetHostname(pConfig.Hostname())
+	pack.Message.SetPid(pConfig.pid)
+	pack.Message.SetSeverity(3)
+	pack.Message.SetPayload(string(record))
+	message.NewStringField(pack.Message, "DeadLetterOutput", or.Name())
+	if reason != nil {
+		message.NewStringField(pack.Message, "DeadLetterError", reason.Error())
+	}
+	if !injector.Inject(pack) {
+		return errors.New("dead letter injection failed")
+	}
+	return nil
+}
@@ -0,0 +1,176 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"errors"
+	"hash/fnv"
+	"sync"
+	"time"
+)
+
+// Returned for packs whose payload is quarantined.
+var ErrQuarantined = errors.New("payload is quarantined")
+
+// Set of payloads that made a decoder time out, by hash, from the decoder's
+// `quarantine_ttl` and `quarantine_size` settings. Decoding a quarantined
+// payload is skipped until its entry expires. Shared by all of the runners
+// of a decoder, so a producer sending the same payload over several
+// connections only stalls a decoder once.
+type quarantine struct {
+	ttl     time.Duration
+	maxSize int
+	lock    sync.Mutex
+	// Expiration time of each entry.
+	entries map[uint64]time.Time
+	now     func() time.Time
+}
+
+func newQuarantine(ttl time.Duration, maxSize int) *quarantine {
+	return &quarantine{
+		ttl:     ttl,
+		maxSize: maxSize,
+		entries: make(map[uint64]time.Time),
+		now:     time.Now,
+	}
+}
+
+// Returns the hash the pack's payload is quarantined by, which covers the
+// whole encoded message for packs decoded from MsgBytes.
+func payloadHash(pack *PipelinePack) uint64 {
+	h := fnv.New64a()
+	if len(pack.MsgBytes) > 0 {
+		h.Write(pack.MsgBytes)
+	} else {
+		h.Write([]byte(pack.Message.GetPayload()))
+	}
+	return h.Sum64()
+}
+
+// Quarantines a payload. When the quarantine is full, expired entries are
+// dropped, and failing that the one closest to expiring.
+func (q *quarantine) add(hash uint64) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	now := q.now()
+	if _, ok := q.entries[hash]; !ok && len(q.entries) >= q.maxSize {
+		var (
+			oldest     uint64
+			oldestTime time.Time
+		)
+		for h, expires := range q.entries {
+			if !expires.After(now) {
+				delete(q.entries, h)
+			} else if oldestTime.IsZero() || expires.Before(oldestTime) {
+				oldest, oldestTime = h, expires
+			}
+		}
+		if len(q.entries) >= q.maxSize {
+			delete(q.entries, oldest)
+		}
+	}
+	q.entries[hash] = now.Add(q.ttl)
+}
+
+// Returns whether a payload is quarantined.
+func (q *quarantine) contains(hash uint64) bool {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	expires, ok := q.entries[hash]
+	if ok && !expires.After(q.now()) {
+		delete(q.entries, hash)
+		return false
+	}
+	return ok
+}
+
+// Returns the number of quarantined payloads, including expired ones that
+// haven't been dropped yet.
+func (q *quarantine) size() int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return len(q.entries)
+}
+
+type decodeResult struct {
+	packs []*PipelinePack
+	err   error
+}
+
+// Runs a decoder on its own goroutine, so a runner w/ a `decode_timeout` can
+// give up on a decode that doesn't return in time.
+type decodeWorker struct {
+	decoder Decoder
+	in      chan *PipelinePack
+	out     chan decodeResult
+}
+
+func newDecodeWorker(decoder Decoder) *decodeWorker {
+	w := &decodeWorker{
+		decoder: decoder,
+		in:      make(chan *PipelinePack),
+		out:     make(chan decodeResult, 1),
+	}
+	go func() {
+		for pack := range w.in {
+			packs, err := w.decoder.Decode(pack)
+			w.out <- decodeResult{packs, err}
+		}
+	}()
+	return w
+}
+
+// Decodes the pack, returning false if the decoder doesn't return before the
+// timer fires. The timer must be stopped and drained.
+func (w *decodeWorker) decode(pack *PipelinePack, timeout time.Duration,
+	timer *time.Timer) (result decodeResult, ok bool) {
+
+	timer.Reset(timeout)
+	w.in <- pack
+	select {
+	case result = <-w.out:
+		if !timer.Stop() {
+			<-timer.C
+		}
+		return result, true
+	case <-timer.C:
+		return result, false
+	}
+}
+
+// Stops the worker once the decode in progress returns, recycling the packs
+// it produced and calling done. The pack must no longer count towards its
+// tracker, which the runner releases when it gives up on the decode.
+func (w *decodeWorker) abandon(pack *PipelinePack, done func()) {
+	close(w.in)
+	go func() {
+		result := <-w.out
+		done()
+		pack.Tracker = nil
+		if result.packs == nil {
+			pack.Recycle()
+			return
+		}
+		for _, p := range result.packs {
+			p.Tracker = nil
+			p.Recycle()
+		}
+	}()
+}
+
+// Stops an idle worker.
+func (w *decodeWorker) stop() {
+	close(w.in)
+}
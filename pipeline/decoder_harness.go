@@ -0,0 +1,398 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"code.google.com/p/go-uuid/uuid"
+	"errors"
+	"fmt"
+	"github.com/bbangert/toml"
+	"github.com/mozilla-services/heka/message"
+	"io/ioutil"
+	"reflect"
+	"runtime"
+	"sort"
+	"time"
+)
+
+// A sample payload in a decoder corpus, w/ the output it's expected to
+// decode to.
+type DecoderCase struct {
+	Name    string
+	Payload string
+	// Whether decoding the payload is expected to fail.
+	Error bool
+	// Number of messages the payload is expected to decode to, 1 if not set.
+	// The header and field expectations apply to the first one.
+	Messages *int
+	// Expected message header values by header name, e.g. "Type" or
+	// "Severity".
+	Headers map[string]interface{}
+	// Expected dynamic field values by field name. Multiple values are
+	// expected as an array.
+	Fields map[string]interface{}
+	// Whether the message is expected to have no fields besides the ones
+	// listed.
+	ExactFields bool `toml:"exact_fields"`
+}
+
+// A set of sample payloads for a decoder. In TOML, a corpus has a `decoder`
+// section configuring the decoder the same way as in a Heka config file, and
+// a `cases` array of tables, one per DecoderCase.
+type DecoderCorpus struct {
+	Decoder toml.Primitive
+	Cases   []DecoderCase
+}
+
+// The outcome of one case of a corpus.
+type DecoderCaseResult struct {
+	Name string
+	// Descriptions of the ways the output didn't match the expectations.
+	Failures []string
+}
+
+// Parses a decoder corpus from its TOML representation.
+func ParseDecoderCorpus(contents string) (corpus *DecoderCorpus, err error) {
+	corpus = new(DecoderCorpus)
+	if _, err = toml.Decode(contents, corpus); err != nil {
+		return nil, fmt.Errorf("can't parse decoder corpus: %s", err)
+	}
+	if len(corpus.Cases) == 0 {
+		return nil, errors.New("decoder corpus has no cases")
+	}
+	for i, c := range corpus.Cases {
+		if c.Name == "" {
+			corpus.Cases[i].Name = fmt.Sprintf("case %d", i+1)
+		}
+	}
+	return
+}
+
+// Loads a decoder corpus from a TOML file.
+func LoadDecoderCorpus(path string) (*DecoderCorpus, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseDecoderCorpus(string(contents))
+}
+
+// A DecoderRunner for decoders run by the harness, which supplies the packs
+// decoders generating several messages ask for.
+type harnessRunner struct {
+	DecoderRunner
+	recycleChan chan *PipelinePack
+}
+
+func (r *harnessRunner) NewPack() *PipelinePack {
+	return NewPipelinePack(r.recycleChan)
+}
+
+// Discards the packs recycled so far.
+func (r *harnessRunner) drain() {
+	for {
+		select {
+		case <-r.recycleChan:
+		default:
+			return
+		}
+	}
+}
+
+// Creates the corpus' decoder, registered under the `type` of its config.
+func (corpus *DecoderCorpus) makeDecoder(pConfig *PipelineConfig) (
+	decoder Decoder, runner *harnessRunner, err error) {
+
+	maker, err := NewPluginMaker("CorpusDecoder", pConfig, corpus.Decoder)
+	if err != nil {
+		return
+	}
+	if maker.Category() != "Decoder" {
+		return nil, nil, fmt.Errorf("'%s' isn't a decoder", maker.Type())
+	}
+	plugin, _, err := maker.Make()
+	if err != nil {
+		return
+	}
+	decoder = plugin.(Decoder)
+	runner = &harnessRunner{
+		DecoderRunner: NewDecoderRunner(maker.Name(), decoder, 1),
+		recycleChan:   make(chan *PipelinePack, 4096),
+	}
+	if wanter, ok := decoder.(WantsDecoderRunner); ok {
+		wanter.SetDecoderRunner(runner)
+	}
+	return
+}
+
+// Returns a pack holding the payload as an input would deliver it.
+func (runner *harnessRunner) newCasePack(payload string) *PipelinePack {
+	pack := runner.NewPack()
+	pack.Message.SetUuid(uuid.NewRandom())
+	pack.Message.SetTimestamp(time.Now().UnixNano())
+	pack.Message.SetPayload(payload)
+	return pack
+}
+
+// Returns the values of a dynamic field.
+func harnessFieldValues(field *message.Field) (values []interface{}) {
+	switch field.GetValueType() {
+	case message.Field_STRING:
+		for _, v := range field.GetValueString() {
+			values = append(values, v)
+		}
+	case message.Field_BYTES:
+		for _, v := range field.GetValueBytes() {
+			values = append(values, string(v))
+		}
+	case message.Field_INTEGER:
+		for _, v := range field.GetValueInteger() {
+			values = append(values, v)
+		}
+	case message.Field_DOUBLE:
+		for _, v := range field.GetValueDouble() {
+			values = append(values, v)
+		}
+	case message.Field_BOOL:
+		for _, v := range field.GetValueBool() {
+			values = append(values, v)
+		}
+	}
+	return
+}
+
+// Returns the value of a message header, w/ the integer headers as int64s
+// to match the values TOML provides.
+func harnessHeaderValue(msg *message.Message, name string) (interface{}, bool) {
+	switch name {
+	case "Uuid":
+		return msg.GetUuidString(), true
+	case "Timestamp":
+		return msg.GetTimestamp(), true
+	case "Type":
+		return msg.GetType(), true
+	case "Logger":
+		return msg.GetLogger(), true
+	case "Severity":
+		return int64(msg.GetSeverity()), true
+	case "Payload":
+		return msg.GetPayload(), true
+	case "EnvVersion":
+		return msg.GetEnvVersion(), true
+	case "Pid":
+		return int64(msg.GetPid()), true
+	case "Hostname":
+		return msg.GetHostname(), true
+	}
+	return nil, false
+}
+
+// Compares a decoded message to the case's expectations.
+func (c *DecoderCase) check(msg *message.Message) (failures []string) {
+	names := make([]string, 0, len(c.Headers))
+	for name := range c.Headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		actual, ok := harnessHeaderValue(msg, name)
+		if !ok {
+			failures = append(failures, fmt.Sprintf("unknown header '%s'", name))
+		} else if !reflect.DeepEqual(actual, c.Headers[name]) {
+			failures = append(failures, fmt.Sprintf("header '%s' is %#v, expected %#v",
+				name, actual, c.Headers[name]))
+		}
+	}
+
+	names = names[:0]
+	for name := range c.Fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		expected := c.Fields[name]
+		field := msg.FindFirstField(name)
+		if field == nil {
+			failures = append(failures, fmt.Sprintf("field '%s' is missing", name))
+			continue
+		}
+		values := harnessFieldValues(field)
+		var actual interface{} = values
+		if _, ok := expected.([]interface{}); !ok && len(values) == 1 {
+			actual = values[0]
+		}
+		if !reflect.DeepEqual(actual, expected) {
+			failures = append(failures, fmt.Sprintf("field '%s' is %#v, expected %#v",
+				name, actual, expected))
+		}
+	}
+	if c.ExactFields {
+		for _, field := range msg.Fields {
+			if _, ok := c.Fields[field.GetName()]; !ok {
+				failures = append(failures, fmt.Sprintf("unexpected field '%s'",
+					field.GetName()))
+			}
+		}
+	}
+	return
+}
+
+// Feeds each of the corpus' payloads through a newly created instance of its
+// decoder, returning a result for each case. Returns an error if the decoder
+// can't be created.
+func (corpus *DecoderCorpus) Run(pConfig *PipelineConfig) (
+	results []DecoderCaseResult, err error) {
+
+	decoder, runner, err := corpus.makeDecoder(pConfig)
+	if err != nil {
+		return
+	}
+	for i := range corpus.Cases {
+		c := &corpus.Cases[i]
+		result := DecoderCaseResult{Name: c.Name}
+		packs, e := decoder.Decode(runner.newCasePack(c.Payload))
+		expected := 1
+		if c.Messages != nil {
+			expected = *c.Messages
+		}
+		switch {
+		case c.Error && e == nil:
+			result.Failures = append(result.Failures, "decoding succeeded, expected an error")
+		case c.Error:
+		case e != nil:
+			result.Failures = append(result.Failures, fmt.Sprintf("decoding failed: %s", e))
+		case len(packs) != expected:
+			result.Failures = append(result.Failures, fmt.Sprintf(
+				"decoded %d messages, expected %d", len(packs), expected))
+		case expected > 0:
+			result.Failures = c.check(packs[0].Message)
+		}
+		runner.drain()
+		results = append(results, result)
+	}
+	return
+}
+
+// The cost of decoding one of a corpus' payloads.
+type DecoderBenchmark struct {
+	// Number of times the payload was decoded.
+	N           int
+	NsPerOp     int64
+	AllocsPerOp int64
+	BytesPerOp  int64
+}
+
+func (b DecoderBenchmark) String() string {
+	return fmt.Sprintf("%d ns/op, %d allocs/op, %d B/op", b.NsPerOp, b.AllocsPerOp,
+		b.BytesPerOp)
+}
+
+// Decodes the payload repeatedly for at least the provided duration. The
+// packs are created between the measured rounds, so only the decoding is
+// measured.
+func (runner *harnessRunner) benchmark(decoder Decoder, payload string,
+	duration time.Duration) (b DecoderBenchmark) {
+
+	var (
+		elapsed         time.Duration
+		mallocs, allocd uint64
+		before, after   runtime.MemStats
+	)
+	packs := make([]*PipelinePack, 0, 1000)
+	for round := 1; elapsed < duration; round *= 2 {
+		if round > cap(packs) {
+			round = cap(packs)
+		}
+		packs = packs[:0]
+		for i := 0; i < round; i++ {
+			packs = append(packs, runner.newCasePack(payload))
+		}
+		runner.drain()
+		runtime.ReadMemStats(&before)
+		start := time.Now()
+		for _, pack := range packs {
+			decoder.Decode(pack)
+		}
+		elapsed += time.Since(start)
+		runtime.ReadMemStats(&after)
+		mallocs += after.Mallocs - before.Mallocs
+		allocd += after.TotalAlloc - before.TotalAlloc
+		b.N += round
+	}
+	b.NsPerOp = elapsed.Nanoseconds() / int64(b.N)
+	b.AllocsPerOp = int64(mallocs) / int64(b.N)
+	b.BytesPerOp = int64(allocd) / int64(b.N)
+	return
+}
+
+// Measures the time and allocations it takes the corpus' decoder to decode
+// each of the corpus' payloads, spending at least the provided duration on
+// each. Returns the results by case name.
+func (corpus *DecoderCorpus) Benchmark(pConfig *PipelineConfig,
+	duration time.Duration) (results map[string]DecoderBenchmark, err error) {
+
+	decoder, runner, err := corpus.makeDecoder(pConfig)
+	if err != nil {
+		return
+	}
+	results = make(map[string]DecoderBenchmark)
+	for _, c := range corpus.Cases {
+		results[c.Name] = runner.benchmark(decoder, c.Payload, duration)
+	}
+	return
+}
+
+// The part of *testing.T used to report a corpus' results.
+type CorpusT interface {
+	Errorf(format string, args ...interface{})
+	Logf(format string, args ...interface{})
+}
+
+// Runs the provided corpus files through their decoders, reporting every
+// mismatch as a test error. If benchTime isn't 0 each case is also
+// benchmarked for that long and the results are logged. Meant for the tests
+// of decoder plugins, including custom ones.
+func CheckDecoderCorpora(t CorpusT, pConfig *PipelineConfig, benchTime time.Duration,
+	paths ...string) {
+
+	for _, path := range paths {
+		corpus, err := LoadDecoderCorpus(path)
+		if err != nil {
+			t.Errorf("%s: %s", path, err)
+			continue
+		}
+		results, err := corpus.Run(pConfig)
+		if err != nil {
+			t.Errorf("%s: %s", path, err)
+			continue
+		}
+		for _, result := range results {
+			for _, failure := range result.Failures {
+				t.Errorf("%s: %s: %s", path, result.Name, failure)
+			}
+		}
+		if benchTime == 0 {
+			continue
+		}
+		benchmarks, err := corpus.Benchmark(pConfig, benchTime)
+		if err != nil {
+			t.Errorf("%s: %s", path, err)
+			continue
+		}
+		for _, c := range corpus.Cases {
+			t.Logf("%s: %s: %s", path, c.Name, benchmarks[c.Name])
+		}
+	}
+}
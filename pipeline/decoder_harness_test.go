@@ -0,0 +1,186 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"errors"
+	"fmt"
+	"github.com/mozilla-services/heka/message"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Decoder turning `name=value` pairs into string fields, w/ a `type` pair
+// setting the type. A payload of "fail" fails, and pairs separated by "|"
+// become separate messages.
+type pairsDecoder struct {
+	runner DecoderRunner
+}
+
+func (d *pairsDecoder) Init(config interface{}) error {
+	return nil
+}
+
+func (d *pairsDecoder) SetDecoderRunner(dr DecoderRunner) {
+	d.runner = dr
+}
+
+func (d *pairsDecoder) Decode(pack *PipelinePack) (packs []*PipelinePack, err error) {
+	payload := pack.Message.GetPayload()
+	if payload == "fail" {
+		return nil, errors.New("told to fail")
+	}
+	for i, part := range strings.Split(payload, "|") {
+		p := pack
+		if i > 0 {
+			p = d.runner.NewPack()
+		}
+		for _, pair := range strings.Fields(part) {
+			kv := strings.SplitN(pair, "=", 2)
+			if len(kv) != 2 {
+				return nil, fmt.Errorf("invalid pair: %s", pair)
+			}
+			if kv[0] == "type" {
+				p.Message.SetType(kv[1])
+				continue
+			}
+			field, _ := message.NewField(kv[0], kv[1], "")
+			p.Message.AddField(field)
+		}
+		packs = append(packs, p)
+	}
+	return
+}
+
+// Collects the errors a corpus check reports.
+type corpusRecorder struct {
+	errors, logs []string
+}
+
+func (r *corpusRecorder) Errorf(format string, args ...interface{}) {
+	r.errors = append(r.errors, fmt.Sprintf(format, args...))
+}
+
+func (r *corpusRecorder) Logf(format string, args ...interface{}) {
+	r.logs = append(r.logs, fmt.Sprintf(format, args...))
+}
+
+func DecoderHarnessSpec(c gs.Context) {
+	RegisterPlugin("PairsDecoder", func() interface{} {
+		return new(pairsDecoder)
+	})
+	defer delete(AvailablePlugins, "PairsDecoder")
+	pConfig := NewPipelineConfig(nil)
+
+	c.Specify("A decoder corpus", func() {
+		contents := `
+[decoder]
+type = "PairsDecoder"
+
+[[cases]]
+name = "fields"
+payload = "type=pairs a=1 b=2"
+exact_fields = true
+    [cases.headers]
+    Type = "pairs"
+    [cases.fields]
+    a = "1"
+    b = "2"
+
+[[cases]]
+name = "wrong"
+payload = "type=other a=3 c=4"
+exact_fields = true
+    [cases.headers]
+    Type = "pairs"
+    [cases.fields]
+    a = "1"
+
+[[cases]]
+name = "split"
+payload = "a=1 | a=2 | a=3"
+messages = 3
+
+[[cases]]
+payload = "fail"
+error = true
+`
+		corpus, err := ParseDecoderCorpus(contents)
+		c.Assume(err, gs.IsNil)
+
+		c.Specify("names unnamed cases", func() {
+			c.Expect(corpus.Cases[3].Name, gs.Equals, "case 4")
+		})
+
+		c.Specify("checks the decoded messages", func() {
+			results, err := corpus.Run(pConfig)
+			c.Assume(err, gs.IsNil)
+			c.Assume(len(results), gs.Equals, 4)
+			c.Expect(len(results[0].Failures), gs.Equals, 0)
+			c.Expect(len(results[2].Failures), gs.Equals, 0)
+			c.Expect(len(results[3].Failures), gs.Equals, 0)
+
+			failures := results[1].Failures
+			c.Assume(len(failures), gs.Equals, 3)
+			c.Expect(failures[0], gs.Equals, `header 'Type' is "other", expected "pairs"`)
+			c.Expect(failures[1], gs.Equals, `field 'a' is "3", expected "1"`)
+			c.Expect(failures[2], gs.Equals, "unexpected field 'c'")
+		})
+
+		c.Specify("measures the decoding", func() {
+			benchmarks, err := corpus.Benchmark(pConfig, time.Millisecond)
+			c.Assume(err, gs.IsNil)
+			b := benchmarks["fields"]
+			c.Expect(b.N > 0, gs.IsTrue)
+			c.Expect(b.AllocsPerOp > 0, gs.IsTrue)
+		})
+
+		c.Specify("reports failures through a test", func() {
+			tmpDir, err := ioutil.TempDir("", "decoder-harness-tests")
+			c.Assume(err, gs.IsNil)
+			defer os.RemoveAll(tmpDir)
+			path := filepath.Join(tmpDir, "corpus.toml")
+			err = ioutil.WriteFile(path, []byte(contents), 0644)
+			c.Assume(err, gs.IsNil)
+
+			recorder := new(corpusRecorder)
+			CheckDecoderCorpora(recorder, pConfig, time.Millisecond, path,
+				filepath.Join(tmpDir, "missing.toml"))
+			c.Assume(len(recorder.errors), gs.Equals, 4)
+			c.Expect(recorder.errors[0], gs.Equals, fmt.Sprintf(
+				`%s: wrong: header 'Type' is "other", expected "pairs"`, path))
+			c.Expect(strings.HasPrefix(recorder.errors[3], filepath.Join(tmpDir,
+				"missing.toml")), gs.IsTrue)
+			c.Expect(len(recorder.logs), gs.Equals, 4)
+		})
+	})
+
+	c.Specify("A corpus w/o cases is an error", func() {
+		_, err := ParseDecoderCorpus("[decoder]\ntype = \"PairsDecoder\"\n")
+		c.Expect(err, gs.Not(gs.IsNil))
+	})
+
+	c.Specify("A corpus for a non-decoder is an error", func() {
+		corpus, err := ParseDecoderCorpus("[decoder]\ntype = \"ProtobufEncoder\"\n" +
+			"[[cases]]\npayload = \"\"\n")
+		c.Assume(err, gs.IsNil)
+		_, err = corpus.Run(pConfig)
+		c.Expect(err, gs.Not(gs.IsNil))
+	})
+}
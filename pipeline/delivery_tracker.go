@@ -0,0 +1,125 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"sync/atomic"
+)
+
+// DeliveryTracker correlates all of the packs generated from a single
+// upstream record, calling an acknowledgement function once each of them has
+// been delivered. A pack counts as delivered once the router has handed it to
+// every matching output, and every one of those outputs that implements
+// AcksDelivery has reported its delivery by calling Done, i.e. once the
+// message has been sent or written to a durable buffer. If any of them calls
+// Fail instead, the negative acknowledgement function is called in place of
+// the acknowledgement. Inputs that can acknowledge records upstream use this
+// to provide at-least-once delivery.
+type DeliveryTracker struct {
+	pending int32
+	failed  int32
+	ack     func()
+	nack    func()
+}
+
+// NewDeliveryTracker returns a tracker holding a single reference on behalf
+// of the caller, who must call Done once all of the packs for the record have
+// been tracked. Either function may be nil.
+func NewDeliveryTracker(ack, nack func()) *DeliveryTracker {
+	return &DeliveryTracker{
+		pending: 1,
+		ack:     ack,
+		nack:    nack,
+	}
+}
+
+// Track attaches the tracker to a pack, unless it's already being tracked.
+// The pack holds a reference until the router has handed it to the outputs
+// that acknowledge delivery, or until it's recycled if it never reaches the
+// router, e.g. because its decoder dropped it.
+func (t *DeliveryTracker) Track(pack *PipelinePack) {
+	if pack.Tracker != nil {
+		return
+	}
+	atomic.AddInt32(&t.pending, 1)
+	pack.Tracker = t
+	pack.trackerHeld = true
+}
+
+// Hold adds a reference that isn't associated w/ any pack, keeping the record
+// from being acknowledged until a matching call to Done or Fail.
+func (t *DeliveryTracker) Hold() {
+	atomic.AddInt32(&t.pending, 1)
+}
+
+// Done releases a reference after a successful delivery, acknowledging the
+// record if none remain. Calling Done on a nil tracker does nothing, so
+// outputs can call it for untracked packs.
+func (t *DeliveryTracker) Done() {
+	if t == nil {
+		return
+	}
+	if atomic.AddInt32(&t.pending, -1) != 0 {
+		return
+	}
+	if atomic.LoadInt32(&t.failed) != 0 {
+		if t.nack != nil {
+			t.nack()
+		}
+	} else if t.ack != nil {
+		t.ack()
+	}
+}
+
+// Fail releases a reference after a failed delivery, so the record is
+// negatively acknowledged once no references remain. Calling Fail on a nil
+// tracker does nothing.
+func (t *DeliveryTracker) Fail() {
+	if t == nil {
+		return
+	}
+	atomic.StoreInt32(&t.failed, 1)
+	t.Done()
+}
+
+// Pending returns the number of outstanding references.
+func (t *DeliveryTracker) Pending() int32 {
+	return atomic.LoadInt32(&t.pending)
+}
+
+// Failed returns whether any delivery has failed.
+func (t *DeliveryTracker) Failed() bool {
+	return atomic.LoadInt32(&t.failed) != 0
+}
+
+// Attaches a decoded pack's tracker to any new packs the decoder generated.
+func trackDecoded(tracker *DeliveryTracker, packs []*PipelinePack) {
+	if tracker == nil {
+		return
+	}
+	for _, p := range packs {
+		tracker.Track(p)
+	}
+}
+
+// Releases the reference a tracked pack holds until it's routed. Called by
+// the router once it has taken a reference for each matching output that
+// acknowledges delivery.
+func (p *PipelinePack) releaseTracker() {
+	if p.trackerHeld {
+		p.trackerHeld = false
+		p.Tracker.Done()
+	}
+}
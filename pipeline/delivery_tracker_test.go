@@ -0,0 +1,111 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	gs "github.com/rafrombrc/gospec/src/gospec"
+)
+
+func DeliveryTrackerSpec(c gs.Context) {
+	recycleChan := make(chan *PipelinePack, 2)
+	acks, nacks := 0, 0
+	tracker := NewDeliveryTracker(func() {
+		acks++
+	}, func() {
+		nacks++
+	})
+	pack0 := NewPipelinePack(recycleChan)
+	pack1 := NewPipelinePack(recycleChan)
+	tracker.Track(pack0)
+	tracker.Track(pack1)
+
+	c.Specify("A DeliveryTracker", func() {
+		c.Specify("acks once all packs are routed", func() {
+			c.Expect(tracker.Pending(), gs.Equals, int32(3))
+			tracker.Done()
+			pack0.releaseTracker()
+			c.Expect(acks, gs.Equals, 0)
+			pack1.releaseTracker()
+			c.Expect(acks, gs.Equals, 1)
+			c.Expect(nacks, gs.Equals, 0)
+		})
+
+		c.Specify("acks packs that are dropped before they're routed", func() {
+			tracker.Done()
+			pack0.Recycle()
+			c.Expect(pack0.Tracker, gs.IsNil)
+			pack1.RefCount = 2
+			pack1.Recycle()
+			c.Expect(acks, gs.Equals, 0)
+			pack1.Recycle()
+			c.Expect(acks, gs.Equals, 1)
+		})
+
+		c.Specify("waits for the caller's reference", func() {
+			pack0.Recycle()
+			pack1.Recycle()
+			c.Expect(acks, gs.Equals, 0)
+			tracker.Done()
+			c.Expect(acks, gs.Equals, 1)
+		})
+
+		c.Specify("waits for outputs to deliver routed packs", func() {
+			tracker.Done()
+			pack1.Recycle()
+			// What the router does for an output that acks delivery.
+			tracker.Hold()
+			pack0.releaseTracker()
+			pack0.Recycle()
+			c.Expect(acks, gs.Equals, 0)
+			tracker.Done()
+			c.Expect(acks, gs.Equals, 1)
+		})
+
+		c.Specify("nacks once a delivery fails", func() {
+			tracker.Hold()
+			tracker.Hold()
+			tracker.Done()
+			pack0.Recycle()
+			pack1.Recycle()
+			tracker.Fail()
+			c.Expect(nacks, gs.Equals, 0)
+			c.Expect(tracker.Failed(), gs.IsTrue)
+			tracker.Done()
+			c.Expect(acks, gs.Equals, 0)
+			c.Expect(nacks, gs.Equals, 1)
+		})
+
+		c.Specify("ignores releases of untracked packs", func() {
+			var untracked *DeliveryTracker
+			untracked.Done()
+			untracked.Fail()
+			pack2 := NewPipelinePack(recycleChan)
+			pack2.Recycle()
+			c.Expect(tracker.Pending(), gs.Equals, int32(3))
+		})
+
+		c.Specify("doesn't track a pack twice", func() {
+			tracker.Track(pack0)
+			c.Expect(tracker.Pending(), gs.Equals, int32(3))
+		})
+
+		c.Specify("is propagated to decoded packs", func() {
+			pack2 := NewPipelinePack(recycleChan)
+			trackDecoded(tracker, []*PipelinePack{pack0, pack2})
+			c.Expect(pack2.Tracker, gs.Equals, tracker)
+			c.Expect(tracker.Pending(), gs.Equals, int32(4))
+		})
+	})
+}
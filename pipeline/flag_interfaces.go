@@ -43,6 +43,17 @@ type EncodesMsgBytes interface {
 	EncodesMsgBytes() bool
 }
 
+// AcksDelivery is implemented by outputs that support at-least-once delivery.
+// If it returns true, the output must call the Done method of the Tracker of
+// every pack it's handed once the pack's message has been sent or written to
+// a durable buffer, or its Fail method if the message couldn't be delivered.
+// The tracker has to be read before the pack is recycled, and both methods
+// can be called on a nil Tracker. Tracked records routed only to outputs that
+// don't implement this are acknowledged once they've been routed.
+type AcksDelivery interface {
+	AcksDelivery() bool
+}
+
 // Restarting indicates a plug-in can handle being restart should it exit
 // before heka is shut-down.
 type Restarting interface {
@@ -69,3 +80,11 @@ func (s *notStoppable) IsStoppable() bool {
 func (s *notStoppable) Unregister(pConfig *PipelineConfig) error {
 	return nil
 }
+
+// ValidatesConfig is implemented by plugins that can check their config
+// without the side effects of Init, such as opening listeners or connecting
+// to remote servers. It's used by `hekad -check-config` for inputs, filters,
+// and outputs, which aren't initialized when checking a config.
+type ValidatesConfig interface {
+	ValidateConfig(config interface{}) error
+}
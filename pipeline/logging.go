@@ -0,0 +1,165 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"code.google.com/p/go-uuid/uuid"
+	"github.com/mozilla-services/heka/message"
+)
+
+// Supported values for a plugin's `log_level` setting.
+const (
+	// Log both errors and informational messages (the default).
+	LOG_LEVEL_INFO = "info"
+	// Only log errors.
+	LOG_LEVEL_ERROR = "error"
+	// Don't log anything.
+	LOG_LEVEL_OFF = "off"
+)
+
+// Syslog severities used for the `heka.log` messages.
+const (
+	severityError = 3
+	severityInfo  = 6
+)
+
+// Validates the value of a `log_level` setting.
+func ValidLogLevel(level string) error {
+	switch level {
+	case "", LOG_LEVEL_INFO, LOG_LEVEL_ERROR, LOG_LEVEL_OFF:
+		return nil
+	}
+	return fmt.Errorf("'log_level' must be '%s', '%s', or '%s', got '%s'",
+		LOG_LEVEL_INFO, LOG_LEVEL_ERROR, LOG_LEVEL_OFF, level)
+}
+
+// A line logged by a plugin, waiting to be injected as a message.
+type pluginLogLine struct {
+	kind     string
+	name     string
+	text     string
+	severity int32
+	at       time.Time
+}
+
+// Receives plugin log lines to be injected as messages, nil unless the
+// `log_messages` global setting is on.
+var pluginLogLines chan pluginLogLine
+
+// Most plugin log lines injected as messages each second, the rest are only
+// written to the log.
+const logInjectLimit = 100
+
+// Counts plugin log lines that weren't injected, either because of the rate
+// limit or because the injection queue was full.
+var droppedLogLines int64
+
+// Rate limits the injection of plugin log lines, a plugin that logs on
+// every message mustn't be able to flood the router.
+type logLimiter struct {
+	lock   sync.Mutex
+	second int64
+	count  int
+}
+
+var injectLimiter logLimiter
+
+// Returns whether another line can be injected during the second containing
+// `now`.
+func (l *logLimiter) allow(now time.Time) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if sec := now.Unix(); sec != l.second {
+		l.second = sec
+		l.count = 0
+	}
+	if l.count >= logInjectLimit {
+		return false
+	}
+	l.count++
+	return true
+}
+
+// Returns whether a plugin w/ the provided log level logs a line.
+func logLevelAllows(level string, isError bool) bool {
+	switch level {
+	case LOG_LEVEL_OFF:
+		return false
+	case LOG_LEVEL_ERROR:
+		return isError
+	}
+	return true
+}
+
+// Writes a line logged by the plugin of the provided kind (e.g. "Input") and
+// name if the level allows it, also queueing it to be injected as a message
+// if that's enabled and `inject` is true.
+func logPluginLine(level, kind, name string, isError bool, text string,
+	inject bool) {
+
+	if !logLevelAllows(level, isError) {
+		return
+	}
+	severity := int32(severityInfo)
+	if isError {
+		severity = severityError
+		LogError.Printf("%s '%s' error: %s", kind, name, text)
+	} else {
+		LogInfo.Printf("%s '%s': %s", kind, name, text)
+	}
+	if pluginLogLines == nil || !inject {
+		return
+	}
+	now := time.Now()
+	if !injectLimiter.allow(now) {
+		atomic.AddInt64(&droppedLogLines, 1)
+		return
+	}
+	// Never block the plugin, the pipeline might be what it's complaining
+	// about.
+	select {
+	case pluginLogLines <- pluginLogLine{kind, name, text, severity, now}:
+	default:
+		atomic.AddInt64(&droppedLogLines, 1)
+	}
+}
+
+// Injects queued plugin log lines as `heka.log` messages until Heka starts
+// shutting down.
+func (pc *PipelineConfig) injectLogLines(lines <-chan pluginLogLine) {
+	for line := range lines {
+		if pc.Globals.IsShuttingDown() {
+			return
+		}
+		pack := pc.injectPool.get()
+		pack.Message.SetUuid(uuid.NewRandom())
+		pack.Message.SetTimestamp(line.at.UnixNano())
+		pack.Message.SetLogger(HEKA_DAEMON)
+		pack.Message.SetType("heka.log")
+		pack.Message.SetSeverity(line.severity)
+		pack.Message.SetHostname(pc.hostname)
+		pack.Message.SetPid(pc.pid)
+		pack.Message.SetPayload(line.text)
+		message.NewStringField(pack.Message, "PluginKind", line.kind)
+		message.NewStringField(pack.Message, "PluginName", line.name)
+		pack.RefCount = 1
+		pc.router.InChan() <- pack
+	}
+}
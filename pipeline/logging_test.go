@@ -0,0 +1,94 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"time"
+
+	"github.com/mozilla-services/heka/message"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+)
+
+func PluginLoggingSpec(c gs.Context) {
+	c.Specify("Plugin logging", func() {
+		c.Specify("logs everything by default", func() {
+			c.Expect(logLevelAllows("", false), gs.IsTrue)
+			c.Expect(logLevelAllows(LOG_LEVEL_INFO, true), gs.IsTrue)
+		})
+
+		c.Specify("respects the log level", func() {
+			c.Expect(logLevelAllows(LOG_LEVEL_ERROR, false), gs.IsFalse)
+			c.Expect(logLevelAllows(LOG_LEVEL_ERROR, true), gs.IsTrue)
+			c.Expect(logLevelAllows(LOG_LEVEL_OFF, true), gs.IsFalse)
+			c.Expect(ValidLogLevel(LOG_LEVEL_OFF), gs.IsNil)
+			c.Expect(ValidLogLevel("loud"), gs.Not(gs.IsNil))
+		})
+
+		c.Specify("injects log lines as messages", func() {
+			pConfig := NewPipelineConfig(nil)
+			pConfig.injectRecycleChan <- NewPipelinePack(pConfig.injectRecycleChan)
+			lines := make(chan pluginLogLine, 1)
+			lines <- pluginLogLine{"Plugin", "bar", "oops", severityError, time.Now()}
+			close(lines)
+			pConfig.injectLogLines(lines)
+
+			pack := <-pConfig.router.InChan()
+			c.Expect(pack.Message.GetType(), gs.Equals, "heka.log")
+			c.Expect(pack.Message.GetSeverity(), gs.Equals, int32(severityError))
+			c.Expect(pack.Message.GetPayload(), gs.Equals, "oops")
+			name, _ := pack.Message.GetFieldValue("PluginName")
+			c.Expect(name, gs.Equals, "bar")
+		})
+
+		c.Specify("doesn't inject the lines of plugins taking heka.log", func() {
+			lines := make(chan pluginLogLine, 10)
+			pluginLogLines = lines
+			defer func() { pluginLogLines = nil }()
+
+			runner := &foRunner{pRunnerBase: pRunnerBase{name: "logs"}}
+			mr, err := NewMatchRunner("Type == 'heka.log'", "", runner, 1)
+			c.Assume(err, gs.IsNil)
+			matchChan := make(chan *PipelinePack, 1)
+			pack := NewPipelinePack(make(chan *PipelinePack, 1))
+			pack.Message = new(message.Message)
+			pack.Message.SetType("heka.log")
+
+			runner.logLine("Plugin", false, "before")
+			c.Expect((<-lines).text, gs.Equals, "before")
+
+			mr.Start(matchChan, 1)
+			mr.inChan <- pack
+			close(mr.inChan)
+			c.Expect(<-matchChan, gs.Equals, pack)
+			// Everything it logs from now on would come straight back to it.
+			runner.logLine("Plugin", true, "can't handle heka.log")
+			c.Expect(len(lines), gs.Equals, 0)
+
+			other := &foRunner{pRunnerBase: pRunnerBase{name: "other"}}
+			other.logLine("Plugin", false, "still injected")
+			c.Expect((<-lines).text, gs.Equals, "still injected")
+		})
+
+		c.Specify("rate limits injection", func() {
+			var limiter logLimiter
+			now := time.Now()
+			for i := 0; i < logInjectLimit; i++ {
+				c.Expect(limiter.allow(now), gs.IsTrue)
+			}
+			c.Expect(limiter.allow(now), gs.IsFalse)
+			c.Expect(limiter.allow(now.Add(time.Second)), gs.IsTrue)
+		})
+	})
+}
@@ -0,0 +1,98 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"errors"
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+const (
+	// Smallest pool size and maximum message size that memory autosizing
+	// will go down to.
+	MIN_AUTOSIZE_POOL_SIZE    = 10
+	MIN_AUTOSIZE_MESSAGE_SIZE = uint32(8 * 1024)
+	// Rough per-pack memory overhead on top of the MsgBytes buffer.
+	packOverhead = 4 * 1024
+)
+
+// Files holding the memory limit of the cgroup we're running in, for cgroup
+// v2 and v1 respectively.
+var cgroupMemoryLimitFiles = []string{
+	"/sys/fs/cgroup/memory.max",
+	"/sys/fs/cgroup/memory/memory.limit_in_bytes",
+}
+
+// Returns the memory limit of the cgroup hekad is running in, or an error if
+// there's no limit or it can't be determined.
+func CgroupMemoryLimit() (uint64, error) {
+	for _, path := range cgroupMemoryLimitFiles {
+		contents, err := ioutil.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		value := strings.TrimSpace(string(contents))
+		if value == "max" {
+			break
+		}
+		limit, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			return 0, err
+		}
+		// cgroup v1 reports something close to the largest int64 when
+		// there's no limit.
+		if limit >= 1<<62 {
+			break
+		}
+		return limit, nil
+	}
+	return 0, errors.New("no cgroup memory limit found")
+}
+
+// Returns the largest pool size (up to poolSize) and maximum message size
+// (up to maxMessageSize) whose input and inject pack pools fit in half of
+// the memory budget, leaving the rest for the plugins and the Go runtime. The
+// pool shrinks first; the message size only shrinks once the pool is down to
+// MIN_AUTOSIZE_POOL_SIZE. Only the pools are sized: the pools are sized
+// before any plugin config is loaded, so the memory outputs use to batch or
+// buffer records, which depends on their settings and isn't bounded by
+// default, has to fit in the other half.
+func SizeForMemory(budget uint64, poolSize int, maxMessageSize uint32) (int,
+	uint32) {
+
+	packBudget := budget / 2
+	// Each pool slot holds an input and an inject pack.
+	slotCost := 2 * (uint64(maxMessageSize) + packOverhead)
+	if uint64(poolSize)*slotCost <= packBudget {
+		return poolSize, maxMessageSize
+	}
+	if fits := int(packBudget / slotCost); fits >= MIN_AUTOSIZE_POOL_SIZE {
+		return fits, maxMessageSize
+	}
+	if poolSize > MIN_AUTOSIZE_POOL_SIZE {
+		poolSize = MIN_AUTOSIZE_POOL_SIZE
+	}
+	perPack := packBudget / uint64(2*poolSize)
+	size := MIN_AUTOSIZE_MESSAGE_SIZE
+	if perPack > packOverhead+uint64(size) {
+		size = uint32(perPack - packOverhead)
+	}
+	if size > maxMessageSize {
+		size = maxMessageSize
+	}
+	return poolSize, size
+}
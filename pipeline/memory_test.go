@@ -0,0 +1,49 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	gs "github.com/rafrombrc/gospec/src/gospec"
+)
+
+func SizeForMemorySpec(c gs.Context) {
+	const mb = 1024 * 1024
+	msgSize := uint32(64 * 1024)
+
+	c.Specify("Sizing for a memory budget", func() {
+		c.Specify("leaves settings that fit alone", func() {
+			poolSize, size := SizeForMemory(1024*mb, 100, msgSize)
+			c.Expect(poolSize, gs.Equals, 100)
+			c.Expect(size, gs.Equals, msgSize)
+		})
+
+		c.Specify("shrinks the pool first", func() {
+			poolSize, size := SizeForMemory(8*mb, 100, msgSize)
+			c.Expect(poolSize, gs.Equals, 30)
+			c.Expect(size, gs.Equals, msgSize)
+		})
+
+		c.Specify("then shrinks the message size", func() {
+			poolSize, size := SizeForMemory(mb, 100, msgSize)
+			c.Expect(poolSize, gs.Equals, MIN_AUTOSIZE_POOL_SIZE)
+			c.Expect(size, gs.Equals, uint32(mb/2/20-packOverhead))
+		})
+
+		c.Specify("won't go below the minimum message size", func() {
+			_, size := SizeForMemory(64*1024, 100, msgSize)
+			c.Expect(size, gs.Equals, MIN_AUTOSIZE_MESSAGE_SIZE)
+		})
+	})
+}
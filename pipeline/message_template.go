@@ -77,20 +77,44 @@ func (mt MessageTemplate) PopulateMessage(msg *message.Message, subs map[string]
 				}
 			}
 		default:
-			fi := strings.SplitN(field, "|", 2)
-			if len(fi) < 2 {
+			// Field names can be followed by `|<representation>` and
+			// `|<type>`, e.g. `ResponseSize|B|int`.
+			fi := strings.SplitN(field, "|", 3)
+			for len(fi) < 3 {
 				fi = append(fi, "")
 			}
-			f, err := message.NewField(fi[0], val, fi[1])
-			msg.AddField(f)
+			value, err := typedFieldValue(val, fi[2])
+			if err != nil {
+				return fmt.Errorf("field '%s': %s", fi[0], err)
+			}
+			f, err := message.NewField(fi[0], value, fi[1])
 			if err != nil {
 				return err
 			}
+			msg.AddField(f)
 		}
 	}
 	return nil
 }
 
+// Converts a template field value to the named field value type, so numeric
+// and boolean values don't have to be stored as strings.
+func typedFieldValue(val, typ string) (interface{}, error) {
+	switch typ {
+	case "", "string":
+		return val, nil
+	case "bytes":
+		return []byte(val), nil
+	case "int":
+		return strconv.ParseInt(val, 10, 64)
+	case "double":
+		return strconv.ParseFloat(val, 64)
+	case "bool":
+		return strconv.ParseBool(val)
+	}
+	return nil, fmt.Errorf("unknown field type '%s'", typ)
+}
+
 // Given a regular expression, return the string resulting from interpolating
 // variables that exist in matchParts
 //
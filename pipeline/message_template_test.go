@@ -15,6 +15,7 @@
 package pipeline
 
 import (
+	"github.com/mozilla-services/heka/message"
 	ts "github.com/mozilla-services/heka/pipeline/testsupport"
 	gs "github.com/rafrombrc/gospec/src/gospec"
 )
@@ -74,5 +75,35 @@ func MessageTemplateSpec(c gs.Context) {
 			c.Expect(value[0], gs.Equals, subs["fieldvalue"])
 			c.Expect(field.GetRepresentation(), gs.Equals, "baz")
 		})
+
+		c.Specify("creates typed fields", func() {
+			mt["size|B|int"] = "%size%"
+			mt["ratio||double"] = "0.5"
+			mt["ok||bool"] = "true"
+			mt["raw||bytes"] = "data"
+			subs := map[string]string{"size": "1024"}
+			err := mt.PopulateMessage(msg, subs)
+			c.Assume(err, gs.IsNil)
+			size := msg.FindFirstField("size")
+			c.Expect(size.GetValueType(), gs.Equals, message.Field_INTEGER)
+			c.Expect(size.GetValue(), gs.Equals, int64(1024))
+			c.Expect(size.GetRepresentation(), gs.Equals, "B")
+			ratio, _ := msg.GetFieldValue("ratio")
+			c.Expect(ratio, gs.Equals, 0.5)
+			ok, _ := msg.GetFieldValue("ok")
+			c.Expect(ok, gs.Equals, true)
+			raw := msg.FindFirstField("raw")
+			c.Expect(raw.GetValueType(), gs.Equals, message.Field_BYTES)
+		})
+
+		c.Specify("rejects invalid typed values", func() {
+			mt["size||int"] = "big"
+			err := mt.PopulateMessage(msg, nil)
+			c.Expect(err, gs.Not(gs.IsNil))
+			delete(mt, "size||int")
+			mt["size||float"] = "1"
+			err = mt.PopulateMessage(msg, nil)
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
 	})
 }
@@ -142,11 +142,11 @@ func (mdr *mDRunner) Decoder() Decoder {
 }
 
 func (mdr *mDRunner) LogError(err error) {
-	LogError.Printf("SubDecoder '%s' error: %s", mdr.name, err)
+	logPluginLine(mdr.logLevel, "SubDecoder", mdr.name, true, fmt.Sprintf("%s", err), true)
 }
 
 func (mdr *mDRunner) LogMessage(msg string) {
-	LogInfo.Printf("SubDecoder '%s': %s", mdr.name, msg)
+	logPluginLine(mdr.logLevel, "SubDecoder", mdr.name, false, msg, true)
 }
 
 type MultiDecoder struct {
@@ -0,0 +1,73 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"strings"
+	"time"
+
+	"github.com/mozilla-services/heka/message"
+)
+
+// Values of a `heka.node-report` message's Status field.
+const (
+	NODE_STATUS_OK        = "ok"
+	NODE_STATUS_UNHEALTHY = "unhealthy"
+)
+
+// How long a pool can go w/o recycling a pack to a waiting plugin before the
+// node reports itself as unhealthy.
+const nodeStallThreshold = time.Second
+
+// Populates msg as a `heka.node-report` message summarizing this node's
+// health for an upstream aggregator: the Heka version, the free packs in
+// each pool, the router's queue depth, the filters and outputs whose input
+// channels are full, and an overall Status. The payload holds the report
+// data of every running plugin, in the same format as `heka.all-report`.
+func (pc *PipelineConfig) nodeReport(now time.Time, msg *message.Message) {
+	_, payload := pc.allReportsData()
+	msg.SetLogger(HEKA_DAEMON)
+	msg.SetType("heka.node-report")
+	msg.SetPayload(payload)
+
+	full := pc.fullRunners()
+	status := NODE_STATUS_OK
+	if len(full) > 0 || pc.inputPool.stalledFor(now) >= nodeStallThreshold ||
+		pc.injectPool.stalledFor(now) >= nodeStallThreshold {
+
+		status = NODE_STATUS_UNHEALTHY
+	}
+	message.NewStringField(msg, "Version", pc.Globals.Version)
+	message.NewStringField(msg, "Status", status)
+	message.NewIntField(msg, "InputPoolFree", len(pc.inputRecycleChan), "count")
+	message.NewIntField(msg, "InjectPoolFree", len(pc.injectRecycleChan), "count")
+	message.NewIntField(msg, "RouterQueueLength", len(pc.router.InChan()), "count")
+	message.NewStringField(msg, "FullPlugins", strings.Join(full, ","))
+}
+
+// Injects a `heka.node-report` message every `interval` until Heka starts
+// shutting down.
+func (pc *PipelineConfig) nodeReportOnInterval(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		if pc.Globals.IsShuttingDown() {
+			return
+		}
+		pack := pc.PipelinePack(0)
+		pc.nodeReport(now, pack.Message)
+		pc.router.InChan() <- pack
+	}
+}
@@ -0,0 +1,59 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"time"
+
+	"github.com/mozilla-services/heka/message"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+)
+
+func NodeReportSpec(c gs.Context) {
+	c.Specify("A node report", func() {
+		globals := DefaultGlobals()
+		globals.Version = "0.10.0"
+		pc := NewPipelineConfig(globals)
+		pc.reportRecycleChan <- NewPipelinePack(pc.reportRecycleChan)
+		pc.inputRecycleChan <- NewPipelinePack(pc.inputRecycleChan)
+		msg := new(message.Message)
+
+		c.Specify("describes a healthy node", func() {
+			pc.nodeReport(time.Now(), msg)
+			c.Expect(msg.GetType(), gs.Equals, "heka.node-report")
+			c.Expect(msg.GetPayload(), gs.Not(gs.Equals), "")
+			version, _ := msg.GetFieldValue("Version")
+			c.Expect(version, gs.Equals, "0.10.0")
+			status, _ := msg.GetFieldValue("Status")
+			c.Expect(status, gs.Equals, NODE_STATUS_OK)
+			free, _ := msg.GetFieldValue("InputPoolFree")
+			c.Expect(free, gs.Equals, int64(1))
+		})
+
+		c.Specify("lists full outputs", func() {
+			runner, err := NewFORunner("out", new(StoppingOutput),
+				CommonFOConfig{Matcher: "TRUE"},
+				"TestOutput", 1)
+			c.Assume(err, gs.IsNil)
+			runner.inChan <- NewPipelinePack(nil)
+			pc.OutputRunners["out"] = runner
+			pc.nodeReport(time.Now(), msg)
+			status, _ := msg.GetFieldValue("Status")
+			c.Expect(status, gs.Equals, NODE_STATUS_UNHEALTHY)
+			full, _ := msg.GetFieldValue("FullPlugins")
+			c.Expect(full, gs.Equals, "out")
+		})
+	})
+}
@@ -0,0 +1,174 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"errors"
+	"fmt"
+)
+
+// The output matchers sharing a round robin group name, and which of them
+// gets the message currently being routed.
+type roundRobinGroup struct {
+	members []*MatchRunner
+	next    int
+	// Router sequence number of the message the chosen member was picked
+	// for.
+	seq int64
+	// Nil if the message doesn't match the group's matcher.
+	chosen *MatchRunner
+}
+
+// Round robin groups by name.
+type roundRobinGroups map[string]*roundRobinGroup
+
+// Groups the non-nil matchers that belong to a round robin group.
+func newRoundRobinGroups(matchers []*MatchRunner) roundRobinGroups {
+	groups := make(roundRobinGroups)
+	for _, matcher := range matchers {
+		if matcher == nil || matcher.roundRobinGroup == "" {
+			continue
+		}
+		group, ok := groups[matcher.roundRobinGroup]
+		if !ok {
+			group = new(roundRobinGroup)
+			groups[matcher.roundRobinGroup] = group
+		}
+		group.members = append(group.members, matcher)
+	}
+	return groups
+}
+
+// Returns whether the matcher is to be handed the pack w/ the provided
+// router sequence number. Matchers outside of any group get every pack,
+// whereas the members of a group take turns at the packs that match the
+// group's matcher, so traffic they'd all reject doesn't skew the rotation.
+func (groups roundRobinGroups) takes(matcher *MatchRunner, pack *PipelinePack,
+	seq int64) bool {
+
+	if matcher.roundRobinGroup == "" {
+		return true
+	}
+	group, ok := groups[matcher.roundRobinGroup]
+	if !ok {
+		return true
+	}
+	if group.seq != seq {
+		group.seq = seq
+		group.chosen = nil
+		// The members share a matcher and signer, see resolveOutputGroup.
+		first := group.members[0]
+		if (len(first.signer) == 0 || first.signer == pack.Signer) &&
+			first.spec.Match(pack.Message) {
+
+			group.chosen = group.members[group.next%len(group.members)]
+			group.next++
+		}
+	}
+	return group.chosen == matcher
+}
+
+// Returns the common config of a filter or output maker, w/ the message
+// matcher falling back to the plugin's default.
+func (m *pluginMaker) foConfig() (config CommonFOConfig, err error) {
+	common, err := m.prepCommonTypedConfig()
+	if err != nil {
+		return
+	}
+	config = common.(CommonFOConfig)
+	if config.Matcher == "" {
+		config.Matcher = getAttr(m.Config(), "MessageMatcher", "").(string)
+	}
+	return
+}
+
+// Returns the makers of the configured outputs, by name, including those
+// not loaded yet.
+func (self *PipelineConfig) outputMakers() map[string]*pluginMaker {
+	makers := make(map[string]*pluginMaker)
+	for _, maker := range self.makersByCategory["Output"] {
+		if pMaker, ok := maker.(*pluginMaker); ok {
+			makers[maker.Name()] = pMaker
+		}
+	}
+	self.makersLock.RLock()
+	for name, maker := range self.makers["Output"] {
+		if pMaker, ok := maker.(*pluginMaker); ok {
+			makers[name] = pMaker
+		}
+	}
+	self.makersLock.RUnlock()
+	return makers
+}
+
+// Checks an output's `round_robin_group` and `shadow_of` settings against
+// the other outputs. A shadow takes its message matcher, signer, and tenant
+// from the output it shadows.
+func (m *pluginMaker) resolveOutputGroup(config *CommonFOConfig) error {
+	makers := m.pConfig.outputMakers()
+	if config.ShadowOf != "" {
+		if config.RoundRobinGroup != "" {
+			return errors.New("a shadow can't be in a round robin group")
+		}
+		if config.ShadowOf == m.name {
+			return errors.New("an output can't shadow itself")
+		}
+		shadowed, ok := makers[config.ShadowOf]
+		if !ok {
+			return fmt.Errorf("can't shadow unknown output '%s'", config.ShadowOf)
+		}
+		common, err := shadowed.foConfig()
+		if err != nil {
+			return fmt.Errorf("can't shadow '%s': %s", config.ShadowOf, err)
+		}
+		if common.ShadowOf != "" {
+			return fmt.Errorf("can't shadow '%s', it's a shadow itself", config.ShadowOf)
+		}
+		config.Matcher = common.Matcher
+		config.MinSeverity = common.MinSeverity
+		config.MaxSeverity = common.MaxSeverity
+		config.Signer = common.Signer
+		config.Tenant = common.Tenant
+		return nil
+	}
+
+	// The router matches once for the whole group before picking a member,
+	// so the members have to select exactly the same messages.
+	spec, err := config.matcherSpec()
+	if err != nil {
+		return err
+	}
+	for name, maker := range makers {
+		if name == m.name {
+			continue
+		}
+		common, err := maker.foConfig()
+		if err != nil || common.RoundRobinGroup != config.RoundRobinGroup {
+			continue
+		}
+		otherSpec, err := common.matcherSpec()
+		if err != nil {
+			continue
+		}
+		if otherSpec != spec || common.Signer != config.Signer ||
+			common.Tenant != config.Tenant {
+
+			return fmt.Errorf("round robin group '%s' members must share the same "+
+				"`message_matcher`, `message_signer`, and `tenant`, '%s' doesn't",
+				config.RoundRobinGroup, name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"github.com/mozilla-services/heka/message"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+)
+
+func RoundRobinGroupSpec(c gs.Context) {
+	newMatcher := func(group string) *MatchRunner {
+		mr, err := NewMatchRunner("Type == 'test'", "", nil, 1)
+		c.Assume(err, gs.IsNil)
+		mr.roundRobinGroup = group
+		return mr
+	}
+
+	c.Specify("Round robin groups", func() {
+		first := newMatcher("es")
+		second := newMatcher("es")
+		other := newMatcher("other")
+		ungrouped := newMatcher("")
+		groups := newRoundRobinGroups([]*MatchRunner{first, nil, second, other,
+			ungrouped})
+		pack := NewPipelinePack(nil)
+		pack.Message = new(message.Message)
+		pack.Message.SetType("test")
+
+		c.Specify("hand each message to one member in turn", func() {
+			for seq := int64(1); seq <= 4; seq++ {
+				takers := 0
+				for _, mr := range []*MatchRunner{first, second} {
+					if groups.takes(mr, pack, seq) {
+						takers++
+					}
+				}
+				c.Expect(takers, gs.Equals, 1)
+				c.Expect(groups.takes(first, pack, seq), gs.Equals, seq%2 == 1)
+				c.Expect(groups.takes(other, pack, seq), gs.IsTrue)
+			}
+		})
+
+		c.Specify("only rotate on messages the group's matcher takes", func() {
+			var firstTakes []bool
+			for seq := int64(1); seq <= 8; seq++ {
+				// Every other message is traffic the group doesn't want.
+				if seq%2 == 0 {
+					pack.Message.SetType("other")
+				} else {
+					pack.Message.SetType("test")
+				}
+				takesFirst := groups.takes(first, pack, seq)
+				takesSecond := groups.takes(second, pack, seq)
+				if seq%2 == 0 {
+					c.Expect(takesFirst || takesSecond, gs.IsFalse)
+					continue
+				}
+				c.Expect(takesFirst != takesSecond, gs.IsTrue)
+				firstTakes = append(firstTakes, takesFirst)
+			}
+			c.Expect(firstTakes[0], gs.IsTrue)
+			c.Expect(firstTakes[1], gs.IsFalse)
+			c.Expect(firstTakes[2], gs.IsTrue)
+			c.Expect(firstTakes[3], gs.IsFalse)
+		})
+
+		c.Specify("hand every message to matchers outside of any group", func() {
+			c.Expect(groups.takes(ungrouped, pack, 1), gs.IsTrue)
+			c.Expect(groups.takes(ungrouped, pack, 2), gs.IsTrue)
+		})
+
+		c.Specify("leave out removed members", func() {
+			groups = newRoundRobinGroups([]*MatchRunner{nil, second})
+			c.Expect(groups.takes(second, pack, 1), gs.IsTrue)
+			c.Expect(groups.takes(second, pack, 2), gs.IsTrue)
+		})
+	})
+}
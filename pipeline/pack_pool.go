@@ -0,0 +1,142 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/mozilla-services/heka/message"
+)
+
+// Supported values for the `pool_overflow` setting.
+const (
+	// Wait for a pack to be recycled when the pool is empty.
+	POOL_OVERFLOW_BLOCK = "block"
+	// Allocate a new pack when the pool is empty, leaving it to the garbage
+	// collector once it's been recycled. Once `pool_overflow_max` such packs
+	// are in use callers wait instead.
+	POOL_OVERFLOW_ALLOCATE = "allocate"
+	// Hand out no pack at all when the pool is empty, so the caller drops
+	// whatever it was going to put in it.
+	POOL_OVERFLOW_REJECT = "reject"
+)
+
+// Validates the value of the `pool_overflow` setting.
+func ValidPoolOverflow(policy string) error {
+	switch policy {
+	case "", POOL_OVERFLOW_BLOCK, POOL_OVERFLOW_ALLOCATE, POOL_OVERFLOW_REJECT:
+		return nil
+	}
+	return fmt.Errorf("'pool_overflow' must be '%s', '%s', or '%s', got '%s'",
+		POOL_OVERFLOW_BLOCK, POOL_OVERFLOW_ALLOCATE, POOL_OVERFLOW_REJECT, policy)
+}
+
+// Hands out packs from a recycle channel, keeping track of how often and for
+// how long callers have to wait for one and applying the overflow policy when
+// the channel is empty.
+type packPool struct {
+	waitCount     int64
+	waitDuration  int64
+	overflowCount int64
+	rejectCount   int64
+	// Number of overflow packs currently in use.
+	overflowLive int64
+	// Number of callers currently waiting for a pack, and when the pool
+	// last made progress for them (in ns since the epoch).
+	waiting      int64
+	waitProgress int64
+
+	recycleChan chan *PipelinePack
+	policy      string
+	maxOverflow int64
+}
+
+// Returns a pool for the recycle channel. At most `maxOverflow` overflow
+// packs are in use at a time w/ the "allocate" policy, 0 meaning as many as
+// the channel holds.
+func newPackPool(recycleChan chan *PipelinePack, overflow string,
+	maxOverflow int) *packPool {
+
+	if maxOverflow <= 0 {
+		maxOverflow = cap(recycleChan)
+	}
+	return &packPool{
+		recycleChan: recycleChan,
+		policy:      overflow,
+		maxOverflow: int64(maxOverflow),
+	}
+}
+
+// Returns a pack from the pool, waiting for one to be recycled or allocating
+// a new one if the pool is empty, depending on the overflow policy. Returns
+// nil if the pool is empty and the policy is to reject.
+func (p *packPool) get() *PipelinePack {
+	select {
+	case pack := <-p.recycleChan:
+		return pack
+	default:
+	}
+	switch p.policy {
+	case POOL_OVERFLOW_REJECT:
+		atomic.AddInt64(&p.rejectCount, 1)
+		return nil
+	case POOL_OVERFLOW_ALLOCATE:
+		if atomic.AddInt64(&p.overflowLive, 1) <= p.maxOverflow {
+			atomic.AddInt64(&p.overflowCount, 1)
+			pack := NewPipelinePack(p.recycleChan)
+			pack.overflow = true
+			pack.overflowLive = &p.overflowLive
+			return pack
+		}
+		atomic.AddInt64(&p.overflowLive, -1)
+	}
+	start := time.Now()
+	if atomic.LoadInt64(&p.waiting) == 0 {
+		atomic.StoreInt64(&p.waitProgress, start.UnixNano())
+	}
+	atomic.AddInt64(&p.waiting, 1)
+	pack := <-p.recycleChan
+	atomic.StoreInt64(&p.waitProgress, time.Now().UnixNano())
+	atomic.AddInt64(&p.waiting, -1)
+	atomic.AddInt64(&p.waitCount, 1)
+	atomic.AddInt64(&p.waitDuration, time.Since(start).Nanoseconds())
+	return pack
+}
+
+// Returns how long callers have been waiting for a pack w/o any being
+// recycled, or 0 if nobody's waiting.
+func (p *packPool) stalledFor(now time.Time) time.Duration {
+	if atomic.LoadInt64(&p.waiting) == 0 {
+		return 0
+	}
+	return now.Sub(time.Unix(0, atomic.LoadInt64(&p.waitProgress)))
+}
+
+// Adds the pool's counters to a report message.
+func (p *packPool) reportMsg(msg *message.Message) {
+	waits := atomic.LoadInt64(&p.waitCount)
+	var avg int64
+	if waits > 0 {
+		avg = atomic.LoadInt64(&p.waitDuration) / waits
+	}
+	message.NewInt64Field(msg, "PoolWaitCount", waits, "count")
+	message.NewInt64Field(msg, "PoolWaitAvgDuration", avg, "ns")
+	message.NewInt64Field(msg, "PoolOverflowCount",
+		atomic.LoadInt64(&p.overflowCount), "count")
+	message.NewInt64Field(msg, "PoolRejectCount",
+		atomic.LoadInt64(&p.rejectCount), "count")
+}
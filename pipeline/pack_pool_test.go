@@ -0,0 +1,111 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"time"
+
+	"github.com/mozilla-services/heka/message"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+)
+
+func PackPoolSpec(c gs.Context) {
+	recycleChan := make(chan *PipelinePack, 1)
+	pack := NewPipelinePack(recycleChan)
+	recycleChan <- pack
+
+	c.Specify("A packPool", func() {
+		c.Specify("hands out pooled packs", func() {
+			pool := newPackPool(recycleChan, POOL_OVERFLOW_BLOCK, 0)
+			c.Expect(pool.get(), gs.Equals, pack)
+			c.Expect(pool.waitCount, gs.Equals, int64(0))
+		})
+
+		c.Specify("waits for a pack when empty", func() {
+			pool := newPackPool(recycleChan, "", 0)
+			pool.get()
+			go func() {
+				time.Sleep(10 * time.Millisecond)
+				pack.Recycle()
+			}()
+			c.Expect(pool.get(), gs.Equals, pack)
+			c.Expect(pool.waitCount, gs.Equals, int64(1))
+			c.Expect(pool.waitDuration > 0, gs.IsTrue)
+		})
+
+		c.Specify("allocates overflow packs when empty", func() {
+			pool := newPackPool(recycleChan, POOL_OVERFLOW_ALLOCATE, 0)
+			pool.get()
+			extra := pool.get()
+			c.Expect(extra, gs.Not(gs.Equals), pack)
+			c.Expect(extra.overflow, gs.IsTrue)
+			c.Expect(pool.overflowCount, gs.Equals, int64(1))
+
+			// Overflow packs aren't added to the pool.
+			extra.Recycle()
+			c.Expect(len(recycleChan), gs.Equals, 0)
+			pack.Recycle()
+			c.Expect(len(recycleChan), gs.Equals, 1)
+
+			msg := new(message.Message)
+			pool.reportMsg(msg)
+			count, _ := msg.GetFieldValue("PoolOverflowCount")
+			c.Expect(count, gs.Equals, int64(1))
+		})
+
+		c.Specify("bounds the overflow packs in use", func() {
+			pool := newPackPool(recycleChan, POOL_OVERFLOW_ALLOCATE, 1)
+			pool.get()
+			extra := pool.get()
+			c.Expect(extra.overflow, gs.IsTrue)
+			c.Expect(pool.overflowLive, gs.Equals, int64(1))
+			// At the bound it waits like the "block" policy.
+			go func() {
+				time.Sleep(10 * time.Millisecond)
+				pack.Recycle()
+			}()
+			c.Expect(pool.get(), gs.Equals, pack)
+			c.Expect(pool.waitCount, gs.Equals, int64(1))
+			c.Expect(pool.overflowCount, gs.Equals, int64(1))
+
+			// Recycling the overflow pack makes room for another.
+			extra.Recycle()
+			c.Expect(pool.overflowLive, gs.Equals, int64(0))
+			another := pool.get()
+			c.Expect(another.overflow, gs.IsTrue)
+			c.Expect(pool.overflowCount, gs.Equals, int64(2))
+		})
+
+		c.Specify("rejects requests when empty", func() {
+			pool := newPackPool(recycleChan, POOL_OVERFLOW_REJECT, 0)
+			c.Expect(pool.get(), gs.Equals, pack)
+			c.Expect(pool.get(), gs.IsNil)
+			c.Expect(pool.rejectCount, gs.Equals, int64(1))
+			pack.Recycle()
+			c.Expect(pool.get(), gs.Equals, pack)
+
+			msg := new(message.Message)
+			pool.reportMsg(msg)
+			count, _ := msg.GetFieldValue("PoolRejectCount")
+			c.Expect(count, gs.Equals, int64(1))
+		})
+
+		c.Specify("rejects unknown overflow policies", func() {
+			c.Expect(ValidPoolOverflow("allocate"), gs.IsNil)
+			c.Expect(ValidPoolOverflow("reject"), gs.IsNil)
+			c.Expect(ValidPoolOverflow("spill"), gs.Not(gs.IsNil))
+		})
+	})
+}
@@ -53,6 +53,59 @@ type GlobalConfigStruct struct {
 	SampleDenominator     int
 	sigChan               chan os.Signal
 	Hostname              string
+	// How long a shutdown can take to drain in-flight messages before Run
+	// gives up and returns. 0 means wait for as long as it takes.
+	ShutdownTimeout time.Duration
+	// Interval at which plugin reports are generated and injected. 0 means
+	// reports are only generated on request.
+	ReportInterval time.Duration
+	// Address on which the admin HTTP API listens. Empty disables the API.
+	AdminAddress string
+	// Bearer token required by the admin API, if not empty.
+	AdminToken string
+	// What to do when a pack pool is empty, one of the POOL_OVERFLOW_*
+	// values. Defaults to blocking until a pack is recycled.
+	PoolOverflow string
+	// Most overflow packs each pool has in use at a time w/ the "allocate"
+	// policy. Defaults to PoolSize.
+	PoolOverflowMax int
+	// Whether messages from inputs missing a Uuid, Timestamp, or Hostname
+	// get them filled in before routing.
+	FillMessageDefaults bool
+	// Where each message's tenant comes from, one of the TENANT_SOURCE_*
+	// values. Empty disables tenancy.
+	TenantSource string
+	// Name of the message field holding the tenant when TenantSource is
+	// TENANT_SOURCE_FIELD.
+	TenantField string
+	// Maximum number of messages per second accepted from each tenant. 0
+	// means no limit.
+	TenantMaxRate uint
+	// Maximum number of tenants tracked individually. Messages from tenants
+	// seen once the limit is reached are counted together. 0 means no limit.
+	TenantMaxCount int
+	// How long a tenant can go w/o any messages before it's no longer
+	// tracked. 0 means tenants are tracked forever.
+	TenantIdleTimeout time.Duration
+	// Maximum number of input, decoder, and output goroutines that can be
+	// processing a message at once. 0 means no limit.
+	MaxInputProcs   int
+	MaxDecoderProcs int
+	MaxOutputProcs  int
+	// How long plugins can wait for a pack w/o any being recycled before
+	// the pipeline is considered stalled. 0 disables the watchdog.
+	StallTimeout time.Duration
+	// Whether Heka shuts down when the pipeline stalls, so a service
+	// manager can restart it.
+	StallShutdown bool
+	// Whether lines logged by plugins are also injected as `heka.log`
+	// messages.
+	LogMessages bool
+	// Interval at which a `heka.node-report` message is injected for an
+	// upstream aggregator. 0 disables node reports.
+	NodeReportInterval time.Duration
+	// Version of Heka that's running, included in node reports.
+	Version string
 }
 
 // Creates a GlobalConfigStruct object populated w/ default values.
@@ -70,6 +123,8 @@ func DefaultGlobals() (globals *GlobalConfigStruct) {
 		SampleDenominator:     1000,
 		sigChan:               make(chan os.Signal, 1),
 		Hostname:              hostname,
+		TenantMaxCount:        1000,
+		TenantIdleTimeout:     time.Hour,
 	}
 }
 
@@ -158,6 +213,29 @@ type PipelinePack struct {
 	// decoder that leaves the pack with a valid protobuf encoding of the
 	// message stored in pack.MsgBytes.
 	TrustMsgBytes bool
+	// Used by inputs that support at-least-once delivery to find out when
+	// the upstream record that generated this pack has been delivered. Nil if
+	// the pack isn't being tracked. Outputs that implement AcksDelivery must
+	// call its Done or Fail method for each pack they're handed.
+	Tracker *DeliveryTracker
+	// Whether the pack still holds its reference on the Tracker, which is
+	// released once it's routed.
+	trackerHeld bool
+	// The message allocated w/ the pack, reused each time it's recycled. A
+	// message that was swapped into the pack is left untouched.
+	msg *message.Message
+	// Whether the pack was allocated because its pool was empty, in which
+	// case it's left to the garbage collector instead of being recycled.
+	overflow bool
+	// Count of the allocating pool's overflow packs in use, if any.
+	overflowLive *int64
+	// Whether the pack's message matched the trace matcher.
+	traced bool
+	// Tenant the pack's message belongs to, if tenancy is enabled.
+	tenant string
+	// Whether the decoder skipped the message's fields, leaving them to be
+	// decoded from MsgBytes if they're needed.
+	fieldsPending bool
 }
 
 // Returns a new PipelinePack pointer that will recycle itself onto the
@@ -170,6 +248,7 @@ func NewPipelinePack(recycleChan chan *PipelinePack) (pack *PipelinePack) {
 	return &PipelinePack{
 		MsgBytes:      msgBytes,
 		Message:       message,
+		msg:           message,
 		RecycleChan:   recycleChan,
 		RefCount:      int32(1),
 		MsgLoopCount:  uint(0),
@@ -186,10 +265,20 @@ func (p *PipelinePack) Zero() {
 	p.Signer = ""
 	p.diagnostics.Reset()
 	p.TrustMsgBytes = false
-
-	// TODO: Possibly zero the message instead depending on benchmark
-	// results of re-allocating a new message
-	p.Message = new(message.Message)
+	p.Tracker = nil
+	p.trackerHeld = false
+	p.traced = false
+	p.tenant = ""
+	p.fieldsPending = false
+
+	// Reuse the pack's own message rather than allocating a new one. Packs
+	// built w/o NewPipelinePack don't have one, so they still get a new one.
+	if p.msg == nil {
+		p.msg = new(message.Message)
+	} else {
+		p.msg.Clear()
+	}
+	p.Message = p.msg
 }
 
 // Recycle decrements the ref count and, if ref count == zero, zeroes the pack
@@ -197,8 +286,15 @@ func (p *PipelinePack) Zero() {
 func (p *PipelinePack) Recycle() {
 	cnt := atomic.AddInt32(&p.RefCount, -1)
 	if cnt == 0 {
-		p.Zero()
-		p.RecycleChan <- p
+		// A pack that's recycled before it's routed was dropped by the
+		// pipeline on purpose, so there's nothing left to deliver.
+		p.releaseTracker()
+		if !p.overflow {
+			p.Zero()
+			p.RecycleChan <- p
+		} else if p.overflowLive != nil {
+			atomic.AddInt64(p.overflowLive, -1)
+		}
 	}
 }
 
@@ -208,6 +304,9 @@ func (p *PipelinePack) EncodeMsgBytes() error {
 	if p.TrustMsgBytes {
 		return nil
 	}
+	if err := p.DecodeFields(); err != nil {
+		return err
+	}
 	msgBytes, err := proto.Marshal(p.Message)
 	if err == nil {
 		if cap(p.MsgBytes) < len(msgBytes) {
@@ -221,22 +320,54 @@ func (p *PipelinePack) EncodeMsgBytes() error {
 	return err
 }
 
+// DecodeFields decodes the message's fields from the pack's MsgBytes if the
+// decoder skipped them, see the ProtobufDecoder's `lazy_fields` setting.
+func (p *PipelinePack) DecodeFields() error {
+	if !p.fieldsPending {
+		return nil
+	}
+	p.fieldsPending = false
+	return p.Message.UnmarshalFields(p.MsgBytes)
+}
+
+// Tracks which group of plugins is being stopped during shutdown, so a
+// shutdown that times out can say what it was waiting for.
+type shutdownStage struct {
+	lock sync.Mutex
+	name string
+}
+
+func (s *shutdownStage) set(name string) {
+	s.lock.Lock()
+	s.name = name
+	s.lock.Unlock()
+}
+
+func (s *shutdownStage) get() string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.name
+}
+
 // Main function driving Heka execution. Loads config, initializes
 // PipelinePack pools, and starts all the runners. Then it listens for signals
 // and drives the shutdown process when that is triggered.
 func Run(config *PipelineConfig) {
 	LogInfo.Println("Starting hekad...")
 
-	var outputsWg sync.WaitGroup
 	var err error
 
 	globals := config.Globals
+	if globals.LogMessages {
+		pluginLogLines = make(chan pluginLogLine, globals.PoolSize)
+		go config.injectLogLines(pluginLogLines)
+	}
 
 	for name, output := range config.OutputRunners {
-		outputsWg.Add(1)
-		if err = output.Start(config, &outputsWg); err != nil {
+		config.outputsWg.Add(1)
+		if err = output.Start(config, &config.outputsWg); err != nil {
 			LogError.Printf("Output '%s' failed to start: %s", name, err)
-			outputsWg.Done()
+			config.outputsWg.Done()
 			if !output.IsStoppable() {
 				globals.ShutDown()
 			}
@@ -296,6 +427,31 @@ func Run(config *PipelineConfig) {
 		LogInfo.Println("Input started:", name)
 	}
 
+	if globals.ReportInterval > 0 {
+		go config.reportOnInterval(globals.ReportInterval)
+	}
+
+	if globals.NodeReportInterval > 0 {
+		go config.nodeReportOnInterval(globals.NodeReportInterval)
+	}
+
+	if globals.StallTimeout > 0 {
+		dog := &watchdog{pConfig: config, timeout: globals.StallTimeout}
+		go dog.run()
+	}
+
+	var admin *adminServer
+	if globals.AdminAddress != "" {
+		if admin, err = config.startAdmin(globals.AdminAddress, globals.AdminToken); err != nil {
+			LogError.Println(err)
+			globals.ShutDown()
+		}
+	}
+
+	if err = sdNotify("READY=1"); err != nil {
+		LogError.Println("Error notifying systemd: ", err)
+	}
+
 	// wait for sigint
 	signal.Notify(globals.sigChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP, SIGUSR1)
 
@@ -308,8 +464,16 @@ func Run(config *PipelineConfig) {
 				if err := notify.Post(RELOAD, nil); err != nil {
 					LogError.Println("Error sending reload event: ", err)
 				}
+				sdNotify("RELOADING=1")
+				go func() {
+					if err := config.ReloadConfig(); err != nil {
+						LogError.Println("Error reloading config: ", err)
+					}
+					sdNotify("READY=1")
+				}()
 			case syscall.SIGINT, syscall.SIGTERM:
 				LogInfo.Println("Shutdown initiated.")
+				sdNotify("STOPPING=1")
 				globals.stop()
 			case SIGUSR1:
 				LogInfo.Println("Queue report initiated.")
@@ -318,48 +482,90 @@ func Run(config *PipelineConfig) {
 		}
 	}
 
-	config.inputsLock.Lock()
-	for _, input := range config.InputRunners {
-		input.Input().Stop()
-		LogInfo.Printf("Stop message sent to input '%s'", input.Name())
-	}
-	config.inputsLock.Unlock()
-	config.inputsWg.Wait()
-
-	config.allDecodersLock.Lock()
-	LogInfo.Println("Waiting for decoders shutdown")
-	for _, decoder := range config.allDecoders {
-		close(decoder.InChan())
-		LogInfo.Printf("Stop message sent to decoder '%s'", decoder.Name())
-	}
-	config.allDecoders = config.allDecoders[:0]
-	config.allDecodersLock.Unlock()
-	config.decodersWg.Wait()
-	LogInfo.Println("Decoders shutdown complete")
-
-	config.filtersLock.Lock()
-	for _, filter := range config.FilterRunners {
-		// needed for a clean shutdown without deadlocking or orphaning messages
-		// 1. removes the matcher from the router
-		// 2. closes the matcher input channel and lets it drain
-		// 3. closes the filter input channel and lets it drain
-		// 4. exits the filter
-		config.router.RemoveFilterMatcher() <- filter.MatchRunner()
-		LogInfo.Printf("Stop message sent to filter '%s'", filter.Name())
+	if admin != nil {
+		admin.stop()
 	}
-	config.filtersLock.Unlock()
-	config.filtersWg.Wait()
 
-	for _, output := range config.OutputRunners {
-		config.router.RemoveOutputMatcher() <- output.MatchRunner()
-		LogInfo.Printf("Stop message sent to output '%s'", output.Name())
-	}
-	outputsWg.Wait()
+	// Stop the plugins in order so in-flight messages can drain: inputs
+	// first, then decoders, filters, and finally outputs.
+	stage := new(shutdownStage)
+	done := make(chan struct{})
+	go func() {
+		stage.set("inputs")
+		config.inputsLock.Lock()
+		for _, input := range config.InputRunners {
+			if pausable, ok := input.(PausableRunner); ok {
+				pausable.Resume()
+			}
+			input.Input().Stop()
+			LogInfo.Printf("Stop message sent to input '%s'", input.Name())
+		}
+		config.inputsLock.Unlock()
+		config.inputsWg.Wait()
+
+		stage.set("decoders")
+		config.allDecodersLock.Lock()
+		LogInfo.Println("Waiting for decoders shutdown")
+		for _, decoder := range config.allDecoders {
+			close(decoder.InChan())
+			LogInfo.Printf("Stop message sent to decoder '%s'", decoder.Name())
+		}
+		config.allDecoders = config.allDecoders[:0]
+		config.allDecodersLock.Unlock()
+		config.decodersWg.Wait()
+		LogInfo.Println("Decoders shutdown complete")
+
+		stage.set("filters")
+		config.filtersLock.Lock()
+		for _, filter := range config.FilterRunners {
+			// needed for a clean shutdown without deadlocking or orphaning messages
+			// 1. removes the matcher from the router
+			// 2. closes the matcher input channel and lets it drain
+			// 3. closes the filter input channel and lets it drain
+			// 4. exits the filter
+			config.router.RemoveFilterMatcher() <- filter.MatchRunner()
+			LogInfo.Printf("Stop message sent to filter '%s'", filter.Name())
+		}
+		config.filtersLock.Unlock()
+		config.filtersWg.Wait()
+
+		stage.set("outputs")
+		config.outputsLock.Lock()
+		for _, output := range config.OutputRunners {
+			config.router.RemoveOutputMatcher() <- output.MatchRunner()
+			LogInfo.Printf("Stop message sent to output '%s'", output.Name())
+		}
+		config.outputsLock.Unlock()
+		config.outputsWg.Wait()
+
+		stage.set("encoders")
+		for name, encoder := range config.allEncoders {
+			if stopper, ok := encoder.(NeedsStopping); ok {
+				LogInfo.Printf("Stopping encoder '%s'", name)
+				stopper.Stop()
+			}
+		}
+		close(done)
+	}()
 
-	for name, encoder := range config.allEncoders {
-		if stopper, ok := encoder.(NeedsStopping); ok {
-			LogInfo.Printf("Stopping encoder '%s'", name)
-			stopper.Stop()
+	if globals.ShutdownTimeout <= 0 {
+		<-done
+	} else {
+		timer := time.NewTimer(globals.ShutdownTimeout)
+		select {
+		case <-done:
+			timer.Stop()
+		case <-timer.C:
+			LogError.Printf("Shutdown timeout of %s exceeded while stopping %s, "+
+				"exiting w/o waiting for the remaining messages to drain.",
+				globals.ShutdownTimeout, stage.get())
+			packs := inFlightPacks(inputTracker, injectTracker)
+			if path, err := config.spoolInFlight(packs); err != nil {
+				LogError.Println(err)
+			} else if path != "" {
+				LogInfo.Printf("Spooled %d in-flight messages to '%s'", len(packs), path)
+			}
+			return
 		}
 	}
 
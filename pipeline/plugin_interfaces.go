@@ -82,6 +82,23 @@ type NeedsStopping interface {
 	Stop()
 }
 
+// Can be implemented by Filters, Outputs, and Encoders to tell Heka whether
+// they use the dynamic fields of the messages they're handed. Plugins that
+// don't implement it are assumed to. The fields of messages from a
+// ProtobufDecoder w/ `lazy_fields` set are only decoded if a plugin they're
+// routed to uses them.
+type UsesFields interface {
+	UsesFields() bool
+}
+
+// Returns false if the plugin implements UsesFields and doesn't use fields.
+func usesFields(plugin interface{}) bool {
+	if uf, ok := plugin.(UsesFields); ok {
+		return uf.UsesFields()
+	}
+	return true
+}
+
 // Heka Output plugin type.
 type Output interface {
 	Run(or OutputRunner, h PluginHelper) (err error)
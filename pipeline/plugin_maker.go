@@ -19,6 +19,8 @@ import (
 	"fmt"
 	"reflect"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/bbangert/toml"
 	"github.com/mozilla-services/heka/message"
@@ -59,6 +61,9 @@ type pluginMaker struct {
 	prepCommonTypedConfig func() (interface{}, error)
 	pConfig               *PipelineConfig
 	plugin                Plugin
+	// Shared by the runners of a decoder w/ a `decode_timeout`.
+	quarantine     *quarantine
+	quarantineOnce sync.Once
 }
 
 // NewPluginMaker creates and returns a PluginMaker that can generate running
@@ -84,6 +89,9 @@ func NewPluginMaker(name string, pConfig *PipelineConfig, tomlSection toml.Primi
 	if maker.commonConfig.Typ == "" {
 		maker.commonConfig.Typ = name
 	}
+	if err = ValidLogLevel(maker.commonConfig.LogLevel); err != nil {
+		return nil, fmt.Errorf("'%s': %s", name, err)
+	}
 	constructor, ok := AvailablePlugins[maker.commonConfig.Typ]
 	if !ok {
 		return nil, fmt.Errorf("No registered plugin type: %s", maker.commonConfig.Typ)
@@ -121,15 +129,34 @@ func (m *pluginMaker) OrigPrepCommonTypedConfig() (interface{}, error) {
 	case "Input":
 		commonInput := CommonInputConfig{
 			Retries: getDefaultRetryOptions(),
+			Backoff: &RetryOptions{MaxRetries: retriesUnset},
 		}
 		err = toml.PrimitiveDecode(m.tomlSection, &commonInput)
 		commonTypedConfig = commonInput
 	case "Filter", "Output":
 		commonFO := CommonFOConfig{
-			Retries: getDefaultRetryOptions(),
+			Retries:          getDefaultRetryOptions(),
+			Backoff:          &RetryOptions{MaxRetries: retriesUnset},
+			TruncationMarker: defaultTruncationMarker,
 		}
 		err = toml.PrimitiveDecode(m.tomlSection, &commonFO)
 		commonTypedConfig = commonFO
+	case "Decoder":
+		commonDecoder := CommonDecoderConfig{
+			QuarantineTtl:   300,
+			QuarantineSize:  1000,
+			MaxAbandoned:    4,
+			CharsetFallback: "windows-1252",
+		}
+		if err = toml.PrimitiveDecode(m.tomlSection, &commonDecoder); err == nil &&
+			commonDecoder.QuarantineSize == 0 {
+			err = errors.New("`quarantine_size` must be greater than 0")
+		}
+		if err == nil {
+			_, err = newCharsetConverter(commonDecoder.Charset,
+				commonDecoder.CharsetFallback)
+		}
+		commonTypedConfig = commonDecoder
 	case "Splitter":
 		commonSplitter := CommonSplitterConfig{}
 		err = toml.PrimitiveDecode(m.tomlSection, &commonSplitter)
@@ -141,6 +168,20 @@ func (m *pluginMaker) OrigPrepCommonTypedConfig() (interface{}, error) {
 	return commonTypedConfig, nil
 }
 
+// Returns the converter for a decoder maker's `charset` setting, nil if it
+// doesn't have one.
+func (m *pluginMaker) charsetConverter() (*charsetConverter, error) {
+	commonConfig, err := m.prepCommonTypedConfig()
+	if err != nil {
+		return nil, err
+	}
+	commonDecoder, ok := commonConfig.(CommonDecoderConfig)
+	if !ok {
+		return nil, nil
+	}
+	return newCharsetConverter(commonDecoder.Charset, commonDecoder.CharsetFallback)
+}
+
 // PrepCommonTypedConfig returns a struct containing all of the common
 // configuration for the maker's plugin type, populated from the provided TOML.
 func (m *pluginMaker) PrepCommonTypedConfig() (interface{}, error) {
@@ -312,6 +353,7 @@ func (m *pluginMaker) makeSplitterRunner(name string, config interface{}, splitt
 	}
 	sr := NewSplitterRunner(name, splitter, commonSplitter)
 	sr.h = m.pConfig
+	sr.logLevel = m.commonConfig.LogLevel
 	return sr, nil
 }
 
@@ -359,6 +401,19 @@ func (m *pluginMaker) makeInputRunner(name string, config interface{}, input Inp
 // given the specified name; if name is an empty string, the plugin name will
 // be used.
 func (m *pluginMaker) MakeRunner(name string) (PluginRunner, error) {
+	runner, err := m.makeRunner(name)
+	if err != nil {
+		return nil, err
+	}
+	if leveled, ok := runner.(interface {
+		setLogLevel(level string)
+	}); ok {
+		leveled.setLogLevel(m.commonConfig.LogLevel)
+	}
+	return runner, nil
+}
+
+func (m *pluginMaker) makeRunner(name string) (PluginRunner, error) {
 	if m.category == "Encoder" {
 		return nil, fmt.Errorf("%s plugins don't support PluginRunners", m.category)
 	}
@@ -376,6 +431,32 @@ func (m *pluginMaker) MakeRunner(name string) (PluginRunner, error) {
 
 	if m.category == "Decoder" {
 		runner = NewDecoderRunner(name, plugin.(Decoder), m.pConfig.Globals.PluginChanSize)
+		commonConfig, err := m.prepCommonTypedConfig()
+		if err != nil {
+			return nil, fmt.Errorf("Can't prep common typed config: %s", err.Error())
+		}
+		dr := runner.(*dRunner)
+		commonDecoder := commonConfig.(CommonDecoderConfig)
+		for i := uint(1); i < commonDecoder.PoolSize; i++ {
+			if plugin, _, err = m.Make(); err != nil {
+				return nil, err
+			}
+			dr.pool = append(dr.pool, plugin.(Decoder))
+		}
+		dr.maker = m
+		dr.decodeTimeout = time.Duration(commonDecoder.DecodeTimeout) * time.Millisecond
+		dr.maxAbandoned = int64(commonDecoder.MaxAbandoned)
+		if dr.decodeTimeout > 0 && commonDecoder.QuarantineTtl > 0 {
+			m.quarantineOnce.Do(func() {
+				m.quarantine = newQuarantine(
+					time.Duration(commonDecoder.QuarantineTtl)*time.Second,
+					int(commonDecoder.QuarantineSize))
+			})
+			dr.quarantine = m.quarantine
+		}
+		if dr.charset, err = m.charsetConverter(); err != nil {
+			return nil, err
+		}
 		return runner, nil
 	}
 
@@ -434,6 +515,35 @@ func (m *pluginMaker) MakeRunner(name string) (PluginRunner, error) {
 		}
 	}
 
-	return NewFORunner(name, plugin, commonFO, m.commonConfig.Typ,
+	if commonFO.PoolSize > 1 && m.category != "Filter" {
+		return nil, fmt.Errorf("'%s': `pool_size` is only supported by filters", name)
+	}
+
+	if len(commonFO.Schedule) > 0 && m.category != "Output" {
+		return nil, fmt.Errorf("'%s': `schedule` is only supported by outputs", name)
+	}
+
+	if commonFO.RoundRobinGroup != "" || commonFO.ShadowOf != "" {
+		if m.category != "Output" {
+			return nil, fmt.Errorf(
+				"'%s': `round_robin_group` and `shadow_of` are only supported by outputs",
+				name)
+		}
+		if err = m.resolveOutputGroup(&commonFO); err != nil {
+			return nil, fmt.Errorf("'%s': %s", name, err)
+		}
+	}
+
+	foRunner, err := NewFORunner(name, plugin, commonFO, m.commonConfig.Typ,
 		m.pConfig.Globals.PluginChanSize)
+	if err != nil {
+		return nil, err
+	}
+	for i := uint(1); i < commonFO.PoolSize; i++ {
+		if plugin, _, err = m.Make(); err != nil {
+			return nil, err
+		}
+		foRunner.pool = append(foRunner.pool, plugin.(Filter))
+	}
+	return foRunner, nil
 }
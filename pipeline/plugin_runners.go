@@ -22,6 +22,7 @@ import (
 	"github.com/mozilla-services/heka/client"
 	"github.com/mozilla-services/heka/message"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -65,6 +66,24 @@ type pRunnerBase struct {
 	h         PluginHelper
 	leakCount int
 	maker     PluginMaker
+	// One of the LOG_LEVEL_* values, empty means LOG_LEVEL_INFO.
+	logLevel string
+	// Set once the plugin has been handed a `heka.log` message, its own log
+	// lines are no longer injected after that since they'd loop back to it.
+	takesLogs int32
+}
+
+func (pr *pRunnerBase) setLogLevel(level string) {
+	pr.logLevel = level
+}
+
+func (pr *pRunnerBase) logLine(kind string, isError bool, text string) {
+	inject := atomic.LoadInt32(&pr.takesLogs) == 0
+	logPluginLine(pr.logLevel, kind, pr.name, isError, text, inject)
+}
+
+func (pr *pRunnerBase) setTakesLogs() {
+	atomic.StoreInt32(&pr.takesLogs, 1)
 }
 
 func (pr *pRunnerBase) Name() string {
@@ -154,8 +173,15 @@ func (d *deliverer) Done() {
 type InputRunner interface {
 	PluginRunner
 	// InChan returns the input channel from which Inputs can get fresh
-	// PipelinePacks, ready to be populated.
+	// PipelinePacks, ready to be populated. Inputs should use NewPack
+	// instead, reading the channel directly bypasses the pool's overflow
+	// policy and accounting.
 	InChan() chan *PipelinePack
+	// NewPack returns a fresh PipelinePack from the input pool, applying the
+	// `pool_overflow` policy if the pool is empty. Returns nil if the policy
+	// is "reject" and no pack is free, in which case the input should drop
+	// whatever it was going to put in the pack.
+	NewPack() *PipelinePack
 	// Input returns the associated Input plugin object.
 	Input() Input
 	// Ticker returns a ticker channel configured to send ticks at an interval
@@ -209,6 +235,11 @@ type iRunner struct {
 	canExit            bool
 	shutdownWanters    []WantsDecoderRunnerShutdown
 	shutdownLock       sync.Mutex
+	// Closed when the input's goroutine exits, nil if it was never started.
+	stopped chan struct{}
+	// Closed to resume a paused input, nil if the input isn't paused.
+	resumeChan chan struct{}
+	pauseLock  sync.Mutex
 }
 
 func (ir *iRunner) Ticker() (ticker <-chan time.Time) {
@@ -261,6 +292,13 @@ func (ir *iRunner) InChan() chan *PipelinePack {
 	return ir.inChan
 }
 
+func (ir *iRunner) NewPack() *PipelinePack {
+	if ir.pConfig == nil {
+		return <-ir.inChan
+	}
+	return ir.pConfig.inputPool.get()
+}
+
 func (ir *iRunner) Start(h PluginHelper, wg *sync.WaitGroup) (err error) {
 	ir.h = h
 	ir.pConfig = h.PipelineConfig()
@@ -271,6 +309,10 @@ func (ir *iRunner) Start(h PluginHelper, wg *sync.WaitGroup) (err error) {
 		ir.ticker = time.Tick(tickLength)
 	}
 
+	if err = validBackoff(ir.config.Backoff); err != nil {
+		return fmt.Errorf("%s has an invalid `backoff`: %s", ir.name, err)
+	}
+
 	if ir.config.Splitter == "" {
 		ir.config.Splitter = "NullSplitter"
 	}
@@ -294,12 +336,16 @@ func (ir *iRunner) Start(h PluginHelper, wg *sync.WaitGroup) (err error) {
 			return fmt.Errorf("no registered '%s' decoder", ir.config.Decoder)
 		}
 	}
+	ir.stopped = make(chan struct{})
 	go ir.Starter(h, wg)
 	return
 }
 
 func (ir *iRunner) Starter(h PluginHelper, wg *sync.WaitGroup) {
 	defer wg.Done()
+	if ir.stopped != nil {
+		defer close(ir.stopped)
+	}
 
 	globals := ir.pConfig.Globals
 	rh, err := NewRetryHelper(ir.config.Retries)
@@ -391,6 +437,10 @@ func (ir *iRunner) Unregister(pConfig *PipelineConfig) error {
 }
 
 func (ir *iRunner) Inject(pack *PipelinePack) {
+	if ir.pConfig.fillMessageDefaults(pack.Message) {
+		pack.TrustMsgBytes = false
+	}
+	ir.pConfig.traceHop(pack, ir.name)
 	if err := pack.EncodeMsgBytes(); err != nil {
 		ir.LogError(fmt.Errorf("encoding message: %s", err.Error()))
 		pack.Recycle()
@@ -399,15 +449,69 @@ func (ir *iRunner) Inject(pack *PipelinePack) {
 	ir.pConfig.router.InChan() <- pack
 }
 
+func (ir *iRunner) backoff() *RetryOptions {
+	return ir.config.Backoff
+}
+
 func (ir *iRunner) LogError(err error) {
-	LogError.Printf("Input '%s' error: %s", ir.name, err)
+	ir.logLine("Input", true, fmt.Sprintf("%s", err))
 }
 
 func (ir *iRunner) LogMessage(msg string) {
-	LogInfo.Printf("Input '%s': %s", ir.name, msg)
+	ir.logLine("Input", false, msg)
+}
+
+// Pause blocks all of the input's deliveries until Resume is called. An input
+// that can't deliver will stop reading, so incoming data backs up to the
+// sender.
+func (ir *iRunner) Pause() {
+	ir.pauseLock.Lock()
+	if ir.resumeChan == nil {
+		ir.resumeChan = make(chan struct{})
+	}
+	ir.pauseLock.Unlock()
 }
 
+// Resume unblocks a paused input's deliveries.
+func (ir *iRunner) Resume() {
+	ir.pauseLock.Lock()
+	if ir.resumeChan != nil {
+		close(ir.resumeChan)
+		ir.resumeChan = nil
+	}
+	ir.pauseLock.Unlock()
+}
+
+func (ir *iRunner) Paused() bool {
+	ir.pauseLock.Lock()
+	defer ir.pauseLock.Unlock()
+	return ir.resumeChan != nil
+}
+
+func (ir *iRunner) waitIfPaused() {
+	ir.pauseLock.Lock()
+	resumeChan := ir.resumeChan
+	ir.pauseLock.Unlock()
+	if resumeChan != nil {
+		<-resumeChan
+	}
+}
+
+// Returns a DeliverFunc for the input's configured decoding, which waits
+// while the input is paused before each delivery.
 func (ir *iRunner) getDeliverFunc(token string) (DeliverFunc, DecoderRunner, Decoder) {
+	deliver, dRunner, decoder := ir.makeDeliverFunc(token)
+	if deliver == nil {
+		return nil, dRunner, decoder
+	}
+	pausable := func(pack *PipelinePack) {
+		ir.waitIfPaused()
+		deliver(pack)
+	}
+	return pausable, dRunner, decoder
+}
+
+func (ir *iRunner) makeDeliverFunc(token string) (DeliverFunc, DecoderRunner, Decoder) {
 	var deliver DeliverFunc
 	decoderName := ir.config.Decoder
 	// If no decoder is specified we just inject into the router.
@@ -468,8 +572,19 @@ func (ir *iRunner) getDeliverFunc(token string) (DeliverFunc, DecoderRunner, Dec
 	ir.pConfig.allSyncDecodersLock.Unlock()
 	// See if the decoder sets TrustMsgBytes for us.
 	_, trustMsgBytes := decoder.(EncodesMsgBytes)
+	charset := ir.pConfig.decoderCharset(decoderName)
 	deliver = func(pack *PipelinePack) {
+		tracker := pack.Tracker
+		if tracker != nil {
+			tracker.Hold()
+			defer tracker.Done()
+		}
+		if charset != nil {
+			charset.convert(pack)
+		}
+		ir.pConfig.decoderProcs.acquire()
 		packs, err := decoder.Decode(pack)
+		ir.pConfig.decoderProcs.release()
 		if err != nil {
 			errMsg := err.Error()
 			ir.LogError(fmt.Errorf("decoding: %s", errMsg))
@@ -484,6 +599,7 @@ func (ir *iRunner) getDeliverFunc(token string) (DeliverFunc, DecoderRunner, Dec
 			ir.Inject(pack)
 			return
 		}
+		trackDecoded(tracker, packs)
 		for _, p := range packs {
 			if !trustMsgBytes {
 				p.TrustMsgBytes = false
@@ -563,13 +679,27 @@ type DecoderRunner interface {
 }
 
 type dRunner struct {
+	timeoutCount     int64
+	quarantinedCount int64
+	// Number of timed out decodes still running.
+	abandonedCount int64
 	pRunnerBase
-	decoder     Decoder
+	decoder Decoder
+	// Additional copies of the decoder, consuming from the same inChan.
+	pool        []Decoder
 	inChan      chan *PipelinePack
 	router      *messageRouter
 	h           PluginHelper
+	pConfig     *PipelineConfig
 	sendFailure bool
 	encodes     bool
+	// From the decoder's `decode_timeout`, `max_abandoned`, and quarantine
+	// settings.
+	decodeTimeout time.Duration
+	maxAbandoned  int64
+	quarantine    *quarantine
+	// From the decoder's `charset` settings.
+	charset *charsetConverter
 }
 
 // Creates and returns a new (but not yet started) DecoderRunner for the
@@ -593,48 +723,206 @@ func (dr *dRunner) Decoder() Decoder {
 
 func (dr *dRunner) Start(h PluginHelper, wg *sync.WaitGroup) {
 	dr.h = h
-	dr.router = h.PipelineConfig().router
+	dr.pConfig = h.PipelineConfig()
+	dr.router = dr.pConfig.router
 	if wanter, ok := dr.decoder.(WantsDecoderRunner); ok {
 		wanter.SetDecoderRunner(dr)
 	}
+	for _, decoder := range dr.pool {
+		if wanter, ok := decoder.(WantsDecoderRunner); ok {
+			wanter.SetDecoderRunner(dr)
+		}
+	}
 	go dr.start(h, wg)
 }
 
 func (dr *dRunner) start(h PluginHelper, wg *sync.WaitGroup) {
+	var poolWg sync.WaitGroup
+	for _, decoder := range dr.pool {
+		poolWg.Add(1)
+		go func(decoder Decoder) {
+			dr.decode(decoder)
+			poolWg.Done()
+		}(decoder)
+	}
+	dr.decode(dr.decoder)
+	poolWg.Wait()
+	dr.LogMessage("stopped")
+	wg.Done()
+}
+
+// Decodes packs from the runner's inChan w/ the provided decoder until the
+// channel is closed.
+func (dr *dRunner) decode(decoder Decoder) {
 	var (
-		pack  *PipelinePack
-		packs []*PipelinePack
-		err   error
+		pack   *PipelinePack
+		packs  []*PipelinePack
+		err    error
+		procs  procLimiter
+		worker *decodeWorker
+		result decodeResult
+		timer  *time.Timer
+		hash   uint64
+		ok     bool
 	)
+	if dr.pConfig != nil {
+		procs = dr.pConfig.decoderProcs
+	}
+	if dr.decodeTimeout > 0 {
+		worker = newDecodeWorker(decoder)
+		timer = time.NewTimer(dr.decodeTimeout)
+		if !timer.Stop() {
+			<-timer.C
+		}
+	}
 	for pack = range dr.inChan {
-		if packs, err = dr.decoder.Decode(pack); packs != nil {
+		// Keep a tracked record from being acknowledged before any packs
+		// generated from it have been delivered.
+		tracker := pack.Tracker
+		if tracker != nil {
+			tracker.Hold()
+		}
+		if dr.quarantine != nil {
+			hash = payloadHash(pack)
+			if dr.quarantine.contains(hash) {
+				atomic.AddInt64(&dr.quarantinedCount, 1)
+				dr.failed(pack, ErrQuarantined)
+				if tracker != nil {
+					tracker.Done()
+				}
+				continue
+			}
+		}
+		if dr.charset != nil {
+			dr.charset.convert(pack)
+		}
+		procs.acquire()
+		if worker == nil {
+			packs, err = decoder.Decode(pack)
+			ok = true
+			procs.release()
+		} else {
+			worker, result, ok = dr.decodeWithTimeout(worker, pack, hash, timer,
+				procs)
+			packs, err = result.packs, result.err
+		}
+		if !ok {
+			// The pack was abandoned along w/ the decoder, so it's dropped.
+			// Release its reference to the tracker, since the abandoned
+			// worker won't, as well as the hold.
+			if tracker != nil {
+				tracker.Done()
+				tracker.Done()
+			}
+			continue
+		}
+		if packs != nil {
+			trackDecoded(tracker, packs)
 			for _, p := range packs {
 				dr.deliver(p)
 			}
+		} else if err != nil {
+			dr.failed(pack, err)
 		} else {
-			if err != nil {
-				dr.LogError(err)
-				if dr.sendFailure {
-					if err = AddDecodeFailureFields(pack.Message, err.Error()); err != nil {
-						dr.LogError(err)
-					}
-					pack.TrustMsgBytes = false
-					dr.deliver(pack)
-					continue
-				}
-			}
 			pack.Recycle()
-			continue
+		}
+		if tracker != nil {
+			tracker.Done()
 		}
 	}
-	if wanter, ok := dr.decoder.(WantsDecoderRunnerShutdown); ok {
+	if worker != nil {
+		worker.stop()
+		decoder = worker.decoder
+	}
+	if wanter, ok := decoder.(WantsDecoderRunnerShutdown); ok {
 		wanter.Shutdown()
 	}
-	dr.LogMessage("stopped")
-	wg.Done()
+}
+
+// Handles a pack that couldn't be decoded, delivering it w/ the decode
+// failure fields if the input asked for it.
+func (dr *dRunner) failed(pack *PipelinePack, err error) {
+	dr.LogError(err)
+	if !dr.sendFailure {
+		pack.Recycle()
+		return
+	}
+	if err = AddDecodeFailureFields(pack.Message, err.Error()); err != nil {
+		dr.LogError(err)
+	}
+	pack.TrustMsgBytes = false
+	dr.deliver(pack)
+}
+
+// Decodes the pack on the worker's goroutine. If the decoder doesn't return
+// within the `decode_timeout` the payload is quarantined and the worker is
+// abandoned, along w/ the pack, in favor of a new one running a new copy of
+// the decoder. Returns false if that happened. Once `max_abandoned` decodes
+// are still running the runner waits for the decode instead, so they can't
+// pile up. Releases the held proc, which an abandoned decode keeps until it
+// returns.
+func (dr *dRunner) decodeWithTimeout(worker *decodeWorker, pack *PipelinePack,
+	hash uint64, timer *time.Timer, procs procLimiter) (*decodeWorker,
+	decodeResult, bool) {
+
+	result, ok := worker.decode(pack, dr.decodeTimeout, timer)
+	if ok {
+		procs.release()
+		return worker, result, true
+	}
+	atomic.AddInt64(&dr.timeoutCount, 1)
+	if dr.quarantine != nil {
+		dr.quarantine.add(hash)
+	}
+	var (
+		decoder Decoder
+		err     error
+	)
+	if abandoned := atomic.LoadInt64(&dr.abandonedCount); abandoned >= dr.maxAbandoned {
+		err = fmt.Errorf("%d timed out decodes are still running", abandoned)
+	} else {
+		decoder, err = dr.newDecoder()
+	}
+	if err != nil {
+		dr.LogError(fmt.Errorf("decoding timed out after %s, waiting for it since "+
+			"the decoder can't be replaced: %s", dr.decodeTimeout, err))
+		result = <-worker.out
+		procs.release()
+		return worker, result, true
+	}
+	dr.LogError(fmt.Errorf("decoding timed out after %s, replacing the decoder",
+		dr.decodeTimeout))
+	atomic.AddInt64(&dr.abandonedCount, 1)
+	worker.abandon(pack, func() {
+		atomic.AddInt64(&dr.abandonedCount, -1)
+		procs.release()
+	})
+	return newDecodeWorker(decoder), result, false
+}
+
+// Creates a new copy of the runner's decoder.
+func (dr *dRunner) newDecoder() (Decoder, error) {
+	if dr.maker == nil {
+		return nil, errors.New("no plugin maker")
+	}
+	plugin, _, err := dr.maker.Make()
+	if err != nil {
+		return nil, err
+	}
+	decoder := plugin.(Decoder)
+	if wanter, ok := decoder.(WantsDecoderRunner); ok {
+		wanter.SetDecoderRunner(dr)
+	}
+	return decoder, nil
 }
 
 func (dr *dRunner) deliver(pack *PipelinePack) {
+	if dr.pConfig != nil {
+		if dr.pConfig.fillMessageDefaults(pack.Message) {
+			pack.TrustMsgBytes = false
+		}
+		dr.pConfig.traceHop(pack, dr.name)
+	}
 	if !dr.encodes || !pack.TrustMsgBytes {
 		err := pack.EncodeMsgBytes()
 		if err != nil {
@@ -659,11 +947,11 @@ func (dr *dRunner) NewPack() *PipelinePack {
 }
 
 func (dr *dRunner) LogError(err error) {
-	LogError.Printf("Decoder '%s' error: %s", dr.name, err)
+	dr.logLine("Decoder", true, fmt.Sprintf("%s", err))
 }
 
 func (dr *dRunner) LogMessage(msg string) {
-	LogInfo.Printf("Decoder '%s': %s", dr.name, msg)
+	dr.logLine("Decoder", false, msg)
 }
 
 func (dr *dRunner) SetSendFailure(sendFailure bool) {
@@ -745,6 +1033,10 @@ type OutputRunner interface {
 	UsesFraming() bool
 	// Allows an output to specify whether or not it's using framing.
 	SetUseFraming(useFraming bool)
+	// Returns the Heka stream framing options set by the output's
+	// framing_version and framing_checksum config options. The Signer is
+	// always nil.
+	FramingOptions() client.FramingOptions
 }
 
 type foRunnerKind int
@@ -783,6 +1075,18 @@ type foRunner struct {
 	kind       foRunnerKind
 	pConfig    *PipelineConfig
 	lastErr    error
+	stopped    chan struct{}
+	removed    int32
+	// Additional copies of the filter, consuming from the same inChan.
+	pool []Filter
+	// Persists the filter's state, nil unless `preserve_state` is set.
+	state *stateStore
+	// Output only, from `max_payload_size` and `max_field_size`.
+	sizeGuard      sizeGuard
+	truncatedCount int64
+	// Makes sure the runner's WaitGroup is only released once, it's released
+	// early when the watchdog gives up on a wedged plugin.
+	leaveOnce sync.Once
 }
 
 // Creates and returns foRunner pointer for use as either a FilterRunner or an
@@ -797,6 +1101,7 @@ func NewFORunner(name string, plugin Plugin, config CommonFOConfig,
 		},
 		pluginType: pluginType,
 		config:     config,
+		stopped:    make(chan struct{}),
 	}
 	runner.inChan = make(chan *PipelinePack, chanSize)
 
@@ -804,16 +1109,39 @@ func NewFORunner(name string, plugin Plugin, config CommonFOConfig,
 		return nil, fmt.Errorf("'%s' missing message matcher", name)
 	}
 
-	matcher, err := NewMatchRunner(config.Matcher, config.Signer, runner, chanSize)
+	matcherSpec, err := config.matcherSpec()
+	if err != nil {
+		return nil, fmt.Errorf("'%s' has an invalid severity range: %s", name, err)
+	}
+	matcher, err := NewMatchRunner(matcherSpec, config.Signer, runner, chanSize)
 	if err != nil {
 		return nil, fmt.Errorf("Can't create message matcher for '%s': %s", name, err)
 	}
 	runner.matcher = matcher
+	matcher.tenant = config.Tenant
+	matcher.roundRobinGroup = config.RoundRobinGroup
+	if config.DropOnFull != nil && *config.DropOnFull {
+		matcher.dropOnFull = true
+	}
 
 	if config.CanExit != nil && *config.CanExit {
 		runner.canExit = true
 	}
 
+	if len(config.Schedule) > 0 {
+		matcher.schedule, err = newSchedule(config.Schedule, config.ScheduleTimezone,
+			config.ScheduleInvert)
+		if err != nil {
+			return nil, fmt.Errorf("'%s' has an invalid `schedule`: %s", name, err)
+		}
+	}
+
+	if config.ShadowOf != "" {
+		// A shadow must neither hold up the router nor take Heka down w/ it.
+		matcher.dropOnFull = true
+		runner.canExit = true
+	}
+
 	if config.UseFraming != nil && *config.UseFraming {
 		runner.useFraming = true
 	}
@@ -822,6 +1150,10 @@ func NewFORunner(name string, plugin Plugin, config CommonFOConfig,
 		runner.kind = foFilter
 	} else if _, ok := plugin.(Output); ok {
 		runner.kind = foOutput
+		// Shadows don't hold up the acknowledgement of tracked records.
+		if acker, ok := plugin.(AcksDelivery); ok && config.ShadowOf == "" {
+			matcher.acksDelivery = acker.AcksDelivery()
+		}
 	} else {
 		err := fmt.Errorf("FORunner plugin must be filter or output, %s is neither",
 			name)
@@ -835,6 +1167,43 @@ func (foRunner *foRunner) Start(h PluginHelper, wg *sync.WaitGroup) (err error)
 	foRunner.h = h
 	foRunner.pConfig = h.PipelineConfig()
 
+	if foRunner.config.Tenant != "" && foRunner.pConfig.router.tenants == nil {
+		return fmt.Errorf("'%s' sets a tenant but `tenant_source` isn't set",
+			foRunner.name)
+	}
+
+	if foRunner.config.PreserveState != nil && *foRunner.config.PreserveState {
+		stateful, ok := foRunner.plugin.(StatefulFilter)
+		if !ok || foRunner.kind != foFilter {
+			return fmt.Errorf("'%s' doesn't support `preserve_state`", foRunner.name)
+		}
+		if len(foRunner.pool) > 0 {
+			return fmt.Errorf("'%s' can't use `preserve_state` w/ a `pool_size` > 1",
+				foRunner.name)
+		}
+		foRunner.state = newStateStore(foRunner.pConfig.Globals, foRunner.name,
+			stateful)
+	}
+
+	if err = validBackoff(foRunner.config.Backoff); err != nil {
+		return fmt.Errorf("'%s' has an invalid `backoff`: %s", foRunner.name, err)
+	}
+
+	if foRunner.config.FramingVersion > 2 {
+		return fmt.Errorf("'%s' has an invalid `framing_version`: %d", foRunner.name,
+			foRunner.config.FramingVersion)
+	}
+
+	foRunner.sizeGuard = sizeGuard{
+		maxPayload: int(foRunner.config.MaxPayloadSize),
+		maxField:   int(foRunner.config.MaxFieldSize),
+		marker:     foRunner.config.TruncationMarker,
+	}
+	if foRunner.sizeGuard.enabled() && foRunner.kind != foOutput {
+		return fmt.Errorf("'%s' doesn't support `max_payload_size` or `max_field_size`",
+			foRunner.name)
+	}
+
 	if foRunner.pluginType == "SandboxFilter" {
 		// No maker means we're a dynamic filter and we can exit.
 		foRunner.pConfig.makersLock.RLock()
@@ -861,6 +1230,9 @@ func (foRunner *foRunner) Start(h PluginHelper, wg *sync.WaitGroup) (err error)
 	}
 
 	if foRunner.matcher != nil {
+		foRunner.matcher.usesFields = foRunner.matcher.spec.UsesFields() ||
+			usesFields(foRunner.plugin) ||
+			(foRunner.encoder != nil && usesFields(foRunner.encoder))
 		switch foRunner.kind {
 		case foFilter:
 			foRunner.pConfig.router.fMatcherMap[foRunner.name] = foRunner.matcher
@@ -893,6 +1265,9 @@ func (foRunner *foRunner) exit() {
 		for pack := range foRunner.inChan {
 			// drain and recycle the orphaned packs
 			orphaned++
+			if foRunner.matcher.acksDelivery {
+				pack.Tracker.Fail()
+			}
 			pack.Recycle()
 		}
 		if orphaned == 1 {
@@ -906,8 +1281,13 @@ func (foRunner *foRunner) exit() {
 		return
 	}
 
-	// Also, if this isn't a "stoppable" plugin we shut everything down.
+	// Also, if this isn't a "stoppable" plugin we shut everything down,
+	// unless the plugin was deliberately removed from the running config.
 	if !foRunner.IsStoppable() {
+		if foRunner.isRemoved() {
+			foRunner.LogMessage("has been removed.")
+			return
+		}
 		foRunner.LogMessage("has stopped, shutting down.")
 		foRunner.pConfig.Globals.ShutDown()
 		return
@@ -951,8 +1331,24 @@ func (foRunner *foRunner) exit() {
 	foRunner.pConfig.router.inChan <- pack
 }
 
+// setRemoved flags the runner as having been deliberately removed from the
+// running configuration, so its exit won't trigger a restart or a shutdown.
+func (foRunner *foRunner) setRemoved() {
+	atomic.StoreInt32(&foRunner.removed, 1)
+}
+
+func (foRunner *foRunner) isRemoved() bool {
+	return atomic.LoadInt32(&foRunner.removed) == 1
+}
+
+// Releases the runner's WaitGroup.
+func (foRunner *foRunner) leave(wg *sync.WaitGroup) {
+	foRunner.leaveOnce.Do(wg.Done)
+}
+
 func (foRunner *foRunner) Starter(helper PluginHelper, wg *sync.WaitGroup) {
-	defer wg.Done()
+	defer foRunner.leave(wg)
+	defer close(foRunner.stopped)
 
 	var err error
 	globals := foRunner.pConfig.Globals
@@ -979,8 +1375,7 @@ func (foRunner *foRunner) Starter(helper PluginHelper, wg *sync.WaitGroup) {
 		// down.
 		switch foRunner.kind {
 		case foFilter:
-			filter := foRunner.Filter()
-			err = filter.Run(foRunner, helper)
+			err = foRunner.runFilters(helper)
 		case foOutput:
 			output := foRunner.Output()
 			err = output.Run(foRunner, helper)
@@ -997,7 +1392,7 @@ func (foRunner *foRunner) Starter(helper PluginHelper, wg *sync.WaitGroup) {
 		foRunner.LogMessage("stopped")
 
 		// Are we supposed to stop? Save ourselves some time by exiting now.
-		if globals.IsShuttingDown() {
+		if globals.IsShuttingDown() || foRunner.isRemoved() {
 			break
 		}
 
@@ -1007,6 +1402,9 @@ func (foRunner *foRunner) Starter(helper PluginHelper, wg *sync.WaitGroup) {
 			break
 		}
 		recon.CleanupForRestart()
+		for _, filter := range foRunner.pool {
+			filter.(Restarting).CleanupForRestart()
+		}
 		if foRunner.maker == nil {
 			var makers map[string]PluginMaker
 			foRunner.pConfig.makersLock.RLock()
@@ -1035,7 +1433,48 @@ func (foRunner *foRunner) Starter(helper PluginHelper, wg *sync.WaitGroup) {
 			foRunner.LogError(err)
 			goto initLoop
 		}
+		for _, filter := range foRunner.pool {
+			if err = filter.(Plugin).Init(foRunner.maker.Config()); err != nil {
+				foRunner.LogError(err)
+				goto initLoop
+			}
+		}
+	}
+}
+
+// Runs the filter and any pooled copies of it, all consuming from the
+// runner's inChan, returning once every copy has stopped. The first error
+// returned by any of them is returned.
+func (foRunner *foRunner) runFilters(helper PluginHelper) (err error) {
+	if foRunner.state != nil {
+		if err = foRunner.state.restore(); err != nil {
+			foRunner.LogError(err)
+		}
+		stop := make(chan struct{})
+		done := make(chan struct{})
+		interval := time.Duration(foRunner.config.StateFlushInterval) * time.Second
+		go func() {
+			foRunner.state.flush(interval, stop, foRunner.LogError)
+			close(done)
+		}()
+		defer func() {
+			close(stop)
+			<-done
+		}()
+	}
+	errChan := make(chan error, len(foRunner.pool))
+	for _, filter := range foRunner.pool {
+		go func(filter Filter) {
+			errChan <- filter.Run(foRunner, helper)
+		}(filter)
 	}
+	err = foRunner.Filter().Run(foRunner, helper)
+	for _ = range foRunner.pool {
+		if e := <-errChan; e != nil && err == nil {
+			err = e
+		}
+	}
+	return
 }
 
 func (foRunner *foRunner) Inject(pack *PipelinePack) bool {
@@ -1047,6 +1486,11 @@ func (foRunner *foRunner) Inject(pack *PipelinePack) bool {
 		foRunner.LogError(fmt.Errorf("attempted to Inject a message to itself"))
 		return false
 	}
+	foRunner.pConfig.traceHop(pack, foRunner.name)
+	if foRunner.config.Tenant != "" {
+		// Keep the filter's output within its tenant's namespace.
+		pack.tenant = foRunner.config.Tenant
+	}
 	// Make sure the pack's MsgBytes is populated.
 	err := pack.EncodeMsgBytes()
 	if err != nil {
@@ -1063,12 +1507,16 @@ func (foRunner *foRunner) Inject(pack *PipelinePack) bool {
 	return true
 }
 
+func (foRunner *foRunner) backoff() *RetryOptions {
+	return foRunner.config.Backoff
+}
+
 func (foRunner *foRunner) LogError(err error) {
-	LogError.Printf("Plugin '%s' error: %s", foRunner.name, err)
+	foRunner.logLine("Plugin", true, fmt.Sprintf("%s", err))
 }
 
 func (foRunner *foRunner) LogMessage(msg string) {
-	LogInfo.Printf("Plugin '%s': %s", foRunner.name, msg)
+	foRunner.logLine("Plugin", false, msg)
 }
 
 func (foRunner *foRunner) Ticker() (ticker <-chan time.Time) {
@@ -1116,17 +1564,33 @@ func (foRunner *foRunner) Encoder() Encoder {
 
 func (foRunner *foRunner) Encode(pack *PipelinePack) (output []byte, err error) {
 	var encoded []byte
+	if foRunner.pConfig != nil {
+		foRunner.pConfig.outputProcs.acquire()
+		defer foRunner.pConfig.outputProcs.release()
+	}
+	if foRunner.sizeGuard.enabled() {
+		if pack, err = foRunner.guardSize(pack); err != nil {
+			return
+		}
+	}
 	if encoded, err = foRunner.encoder.Encode(pack); err != nil || encoded == nil {
 		return
 	}
 	if foRunner.useFraming {
-		client.CreateHekaStream(encoded, &output, nil)
+		client.CreateFramedRecord(encoded, &output, foRunner.FramingOptions())
 	} else {
 		output = encoded
 	}
 	return
 }
 
+func (foRunner *foRunner) FramingOptions() client.FramingOptions {
+	return client.FramingOptions{
+		Version:  int(foRunner.config.FramingVersion),
+		Checksum: foRunner.config.FramingChecksum,
+	}
+}
+
 func (foRunner *foRunner) UsesFraming() bool {
 	return foRunner.useFraming
 }
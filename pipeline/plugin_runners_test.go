@@ -21,6 +21,8 @@ import (
 	"code.google.com/p/gogoprotobuf/proto"
 	"errors"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/mozilla-services/heka/message"
 	ts "github.com/mozilla-services/heka/pipeline/testsupport"
@@ -115,6 +117,50 @@ func InputRunnerSpec(c gs.Context) {
 			c.Expect(stopinputTimes, gs.Equals, 2)
 		})
 
+		c.Specify("fills in missing message defaults", func() {
+			globals.FillMessageDefaults = true
+			defer func() {
+				globals.FillMessageDefaults = false
+			}()
+			runner := NewInputRunner("filler", &StoppingInput{}, commonInput).(*iRunner)
+			runner.pConfig = pConfig
+			pack := NewPipelinePack(pConfig.inputRecycleChan)
+			pack.Message.SetPayload("no header values")
+			runner.Inject(pack)
+			recd := <-pConfig.router.inChan
+			c.Expect(len(recd.Message.GetUuid()), gs.Equals, message.UUID_SIZE)
+			c.Expect(recd.Message.GetTimestamp() > 0, gs.IsTrue)
+			c.Expect(recd.Message.GetHostname(), gs.Equals, pConfig.Hostname())
+			c.Expect(recd.TrustMsgBytes, gs.IsTrue)
+		})
+
+		c.Specify("records the route of traced messages", func() {
+			err := pConfig.SetTraceMatcher("Payload == 'traced'")
+			c.Assume(err, gs.IsNil)
+			defer pConfig.SetTraceMatcher("")
+			runner := NewInputRunner("tracer", &StoppingInput{}, commonInput).(*iRunner)
+			runner.pConfig = pConfig
+
+			pack := NewPipelinePack(pConfig.inputRecycleChan)
+			pack.Message.SetPayload("traced")
+			runner.Inject(pack)
+			recd := <-pConfig.router.inChan
+			c.Expect(recd.traced, gs.IsTrue)
+			c.Expect(routeString(recd.Message), gs.Equals, "tracer")
+
+			pack = NewPipelinePack(pConfig.inputRecycleChan)
+			pack.Message.SetPayload("untraced")
+			runner.Inject(pack)
+			recd = <-pConfig.router.inChan
+			c.Expect(recd.traced, gs.IsFalse)
+			c.Expect(recd.Message.FindFirstField(ROUTE_FIELD), gs.IsNil)
+		})
+
+		c.Specify("rejects an invalid trace matcher", func() {
+			err := pConfig.SetTraceMatcher("Payload ==")
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+
 		c.Specify("delivers messages correctly", func() {
 			input := &StatAccumInput{
 				pConfig: pConfig,
@@ -368,6 +414,195 @@ func (d *_fooDecoder) Decode(pack *PipelinePack) (packs []*PipelinePack, err err
 	return []*PipelinePack{pack}, nil
 }
 
+// Decoder that signals when it starts decoding and then waits to be
+// released, so tests can tell how many packs are being decoded at once.
+type _blockingDecoder struct {
+	started chan struct{}
+	release chan struct{}
+}
+
+func (d *_blockingDecoder) Init(config interface{}) error {
+	return nil
+}
+
+func (d *_blockingDecoder) Decode(pack *PipelinePack) (packs []*PipelinePack, err error) {
+	d.started <- struct{}{}
+	<-d.release
+	return []*PipelinePack{pack}, nil
+}
+
+// Decoder that hangs until released on packs w/ a "hang" payload.
+type _hangingDecoder struct {
+	release chan struct{}
+}
+
+func (d *_hangingDecoder) Init(config interface{}) error {
+	return nil
+}
+
+func (d *_hangingDecoder) Decode(pack *PipelinePack) (packs []*PipelinePack, err error) {
+	if pack.Message.GetPayload() == "hang" {
+		<-d.release
+	}
+	return []*PipelinePack{pack}, nil
+}
+
+func DecoderRunnerSpec(c gs.Context) {
+	c.Specify("A DecoderRunner w/ a pool", func() {
+		pConfig := NewPipelineConfig(nil)
+		started := make(chan struct{})
+		release := make(chan struct{})
+		newDecoder := func() Decoder {
+			return &_blockingDecoder{started: started, release: release}
+		}
+		dr := NewDecoderRunner("pooled", newDecoder(), 3).(*dRunner)
+		dr.pool = []Decoder{newDecoder(), newDecoder()}
+		wg := new(sync.WaitGroup)
+		wg.Add(1)
+		dr.Start(pConfig, wg)
+
+		c.Specify("decodes on every copy concurrently", func() {
+			for i := 0; i < 3; i++ {
+				dr.InChan() <- NewPipelinePack(pConfig.inputRecycleChan)
+			}
+			// All three copies must be in Decode at the same time for each
+			// of them to have signaled before any are released.
+			for i := 0; i < 3; i++ {
+				<-started
+			}
+			close(release)
+			for i := 0; i < 3; i++ {
+				<-pConfig.router.inChan
+			}
+			close(dr.InChan())
+			wg.Wait()
+		})
+	})
+
+	c.Specify("A DecoderRunner w/ a decode timeout", func() {
+		pConfig := NewPipelineConfig(nil)
+		release := make(chan struct{})
+		maker := &pluginMaker{
+			constructor: func() interface{} {
+				return &_hangingDecoder{release: release}
+			},
+			prepConfig: func() (interface{}, error) {
+				return nil, nil
+			},
+		}
+		dr := NewDecoderRunner("guarded", maker.makePlugin().(Decoder), 1).(*dRunner)
+		dr.maker = maker
+		dr.decodeTimeout = 20 * time.Millisecond
+		dr.maxAbandoned = 2
+		dr.quarantine = newQuarantine(time.Minute, 10)
+		wg := new(sync.WaitGroup)
+		wg.Add(1)
+		dr.Start(pConfig, wg)
+
+		send := func(payload string) {
+			pack := NewPipelinePack(pConfig.inputRecycleChan)
+			pack.Message.SetPayload(payload)
+			dr.InChan() <- pack
+		}
+
+		c.Specify("replaces a hanging decoder and quarantines the payload", func() {
+			send("hang")
+			send("fine")
+			pack := <-pConfig.router.inChan
+			c.Expect(pack.Message.GetPayload(), gs.Equals, "fine")
+			c.Expect(atomic.LoadInt64(&dr.timeoutCount), gs.Equals, int64(1))
+			c.Expect(dr.quarantine.size(), gs.Equals, 1)
+
+			send("hang")
+			send("fine again")
+			pack = <-pConfig.router.inChan
+			c.Expect(pack.Message.GetPayload(), gs.Equals, "fine again")
+			c.Expect(atomic.LoadInt64(&dr.timeoutCount), gs.Equals, int64(1))
+			c.Expect(atomic.LoadInt64(&dr.quarantinedCount), gs.Equals, int64(1))
+
+			close(release)
+			close(dr.InChan())
+			wg.Wait()
+		})
+
+		c.Specify("waits for the decode once too many are abandoned", func() {
+			dr.quarantine = nil
+			dr.maxAbandoned = 1
+			send("hang")
+			send("fine")
+			pack := <-pConfig.router.inChan
+			c.Expect(pack.Message.GetPayload(), gs.Equals, "fine")
+			c.Expect(atomic.LoadInt64(&dr.abandonedCount), gs.Equals, int64(1))
+
+			send("hang")
+			send("fine again")
+			select {
+			case pack = <-pConfig.router.inChan:
+				c.Expect(pack.Message.GetPayload(), gs.Equals, "nothing yet")
+			case <-time.After(100 * time.Millisecond):
+			}
+			c.Expect(atomic.LoadInt64(&dr.timeoutCount), gs.Equals, int64(2))
+
+			close(release)
+			pack = <-pConfig.router.inChan
+			c.Expect(pack.Message.GetPayload(), gs.Equals, "hang")
+			pack = <-pConfig.router.inChan
+			c.Expect(pack.Message.GetPayload(), gs.Equals, "fine again")
+			for atomic.LoadInt64(&dr.abandonedCount) > 0 {
+				time.Sleep(time.Millisecond)
+			}
+			close(dr.InChan())
+			wg.Wait()
+		})
+	})
+
+	c.Specify("A DecoderRunner w/ a charset", func() {
+		pConfig := NewPipelineConfig(nil)
+		decoder := &_hangingDecoder{}
+		dr := NewDecoderRunner("converting", decoder, 1).(*dRunner)
+		dr.charset, _ = newCharsetConverter("latin1", "")
+		wg := new(sync.WaitGroup)
+		wg.Add(1)
+		dr.Start(pConfig, wg)
+
+		c.Specify("converts payloads before decoding", func() {
+			pack := NewPipelinePack(pConfig.inputRecycleChan)
+			pack.Message.SetPayload("na\xefve")
+			dr.InChan() <- pack
+			pack = <-pConfig.router.inChan
+			c.Expect(pack.Message.GetPayload(), gs.Equals, "naïve")
+			close(dr.InChan())
+			wg.Wait()
+		})
+	})
+
+	c.Specify("A quarantine", func() {
+		q := newQuarantine(time.Minute, 2)
+		now := time.Now()
+		q.now = func() time.Time {
+			return now
+		}
+
+		c.Specify("expires its entries", func() {
+			q.add(1)
+			c.Expect(q.contains(1), gs.IsTrue)
+			now = now.Add(time.Minute)
+			c.Expect(q.contains(1), gs.IsFalse)
+			c.Expect(q.size(), gs.Equals, 0)
+		})
+
+		c.Specify("evicts the entry closest to expiring when full", func() {
+			q.add(1)
+			now = now.Add(time.Second)
+			q.add(2)
+			q.add(3)
+			c.Expect(q.contains(1), gs.IsFalse)
+			c.Expect(q.contains(2), gs.IsTrue)
+			c.Expect(q.contains(3), gs.IsTrue)
+		})
+	})
+}
+
 type _payloadEncoder struct{}
 
 func (enc *_payloadEncoder) Encode(pack *PipelinePack) (output []byte, err error) {
@@ -422,6 +657,25 @@ func (s *StopResumeOutput) Stop() {
 	return
 }
 
+// Filter that always fails, counting how often each copy is run and
+// reinitialized.
+type _restartingFilter struct {
+	inits int
+	runs  int
+}
+
+func (f *_restartingFilter) Init(config interface{}) error {
+	f.inits++
+	return nil
+}
+
+func (f *_restartingFilter) Run(fr FilterRunner, h PluginHelper) error {
+	f.runs++
+	return errors.New("filter failed")
+}
+
+func (f *_restartingFilter) CleanupForRestart() {}
+
 func OutputRunnerSpec(c gs.Context) {
 	t := new(ts.SimpleT)
 	ctrl := gomock.NewController(t)
@@ -489,6 +743,35 @@ func OutputRunnerSpec(c gs.Context) {
 			c.Expect(oRunner.retainPack, gs.IsNil)
 		})
 
+		c.Specify("restarts every copy of a pooled filter", func() {
+			commonFO.Retries = RetryOptions{
+				MaxDelay:   "1us",
+				Delay:      "1us",
+				MaxJitter:  "1us",
+				MaxRetries: 1,
+			}
+			filter := new(_restartingFilter)
+			fRunner, err := NewFORunner("restartingFilter", filter, commonFO,
+				"RestartingFilter", chanSize)
+			c.Assume(err, gs.IsNil)
+			fRunner.maker = maker
+			pooled := []*_restartingFilter{new(_restartingFilter), new(_restartingFilter)}
+			for _, f := range pooled {
+				fRunner.pool = append(fRunner.pool, f)
+			}
+
+			close(fRunner.inChan) // signal the shutdown
+			mockHelper.EXPECT().PipelineConfig().Return(pConfig)
+			var wg sync.WaitGroup
+			wg.Add(1)
+			fRunner.Start(mockHelper, &wg)
+			wg.Wait()
+			for _, f := range append(pooled, filter) {
+				c.Expect(f.inits, gs.Equals, 1)
+				c.Expect(f.runs, gs.Equals, 2)
+			}
+		})
+
 		c.Specify("can exit without causing shutdown", func() {
 			commonFO.Retries = RetryOptions{MaxRetries: 0}
 			oRunner, err := NewFORunner("stoppingOutput", output, commonFO, "StoppingOutput",
@@ -569,5 +852,34 @@ func OutputRunnerSpec(c gs.Context) {
 				c.Expect(result == nil, gs.IsTrue)
 			})
 		})
+
+		c.Specify("narrows the matcher to a severity range", func() {
+			minSev, maxSev := 2, 4
+			commonFO.MinSeverity = &minSev
+			commonFO.MaxSeverity = &maxSev
+			oRunner, err := NewFORunner("stoppingOutput", output, commonFO,
+				"StoppingOutput", chanSize)
+			c.Assume(err, gs.IsNil)
+			msg := ts.GetTestMessage()
+			for sev, matches := range []bool{false, false, true, true, true, false} {
+				msg.SetSeverity(int32(sev))
+				c.Expect(oRunner.matcher.spec.Match(msg), gs.Equals, matches)
+			}
+		})
+
+		c.Specify("rejects an invalid severity range", func() {
+			minSev, maxSev := 5, 3
+			commonFO.MinSeverity = &minSev
+			commonFO.MaxSeverity = &maxSev
+			_, err := NewFORunner("stoppingOutput", output, commonFO,
+				"StoppingOutput", chanSize)
+			c.Expect(err, gs.Not(gs.IsNil))
+
+			maxSev = 8
+			commonFO.MinSeverity = nil
+			_, err = NewFORunner("stoppingOutput", output, commonFO,
+				"StoppingOutput", chanSize)
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
 	})
 }
@@ -0,0 +1,42 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+// Caps the number of goroutines of one kind (inputs, decoders, or outputs)
+// that can be processing a message at the same time. Tokens are never held
+// while delivering a message further down the pipeline, so the caps can't
+// deadlock each other. A nil procLimiter doesn't limit anything.
+type procLimiter chan struct{}
+
+// Returns a procLimiter allowing max concurrent holders, or nil if max isn't
+// positive.
+func newProcLimiter(max int) procLimiter {
+	if max <= 0 {
+		return nil
+	}
+	return make(procLimiter, max)
+}
+
+func (l procLimiter) acquire() {
+	if l != nil {
+		l <- struct{}{}
+	}
+}
+
+func (l procLimiter) release() {
+	if l != nil {
+		<-l
+	}
+}
@@ -16,7 +16,6 @@
 package pipeline
 
 import (
-	"code.google.com/p/gogoprotobuf/proto"
 	"github.com/mozilla-services/heka/message"
 	"math/rand"
 	"sync"
@@ -34,6 +33,13 @@ type ProtobufDecoder struct {
 	reportLock             sync.Mutex
 	sample                 bool
 	sampleDenominator      int
+	lazyFields             bool
+}
+
+type ProtobufDecoderConfig struct {
+	// If true, the message's fields are only decoded if a message matcher or
+	// a plugin the message is routed to needs them.
+	LazyFields bool `toml:"lazy_fields"`
 }
 
 // Heka will call this before calling any other methods to give us access to
@@ -42,9 +48,16 @@ func (p *ProtobufDecoder) SetPipelineConfig(pConfig *PipelineConfig) {
 	p.pConfig = pConfig
 }
 
+func (p *ProtobufDecoder) ConfigStruct() interface{} {
+	return new(ProtobufDecoderConfig)
+}
+
 func (p *ProtobufDecoder) Init(config interface{}) error {
 	p.sample = true
 	p.sampleDenominator = p.pConfig.Globals.SampleDenominator
+	if conf, ok := config.(*ProtobufDecoderConfig); ok {
+		p.lazyFields = conf.LazyFields
+	}
 	return nil
 }
 
@@ -58,7 +71,12 @@ func (p *ProtobufDecoder) Decode(pack *PipelinePack) (
 		startTime = time.Now()
 	}
 
-	if err = proto.Unmarshal(pack.MsgBytes, pack.Message); err == nil {
+	if p.lazyFields {
+		pack.fieldsPending, err = pack.Message.UnmarshalSkipFields(pack.MsgBytes)
+	} else {
+		err = pack.Message.UnmarshalReuse(pack.MsgBytes)
+	}
+	if err == nil {
 		packs = []*PipelinePack{pack}
 		pack.TrustMsgBytes = true
 	} else {
@@ -153,6 +171,11 @@ func (p *ProtobufEncoder) Stop() {
 	return
 }
 
+// The encoder only uses the pack's MsgBytes.
+func (p *ProtobufEncoder) UsesFields() bool {
+	return false
+}
+
 func (p *ProtobufEncoder) ReportMsg(msg *message.Message) error {
 	p.reportLock.Lock()
 	defer p.reportLock.Unlock()
@@ -55,6 +55,33 @@ func ProtobufDecoderSpec(c gospec.Context) {
 			c.Expect(v, gs.Equals, "bar")
 		})
 
+		c.Specify("defers decoding the fields w/ lazy_fields", func() {
+			decoder.lazyFields = true
+			pack.MsgBytes = encoded
+			_, err := decoder.Decode(pack)
+			c.Expect(err, gs.IsNil)
+			c.Expect(pack.fieldsPending, gs.IsTrue)
+			c.Expect(len(pack.Message.Fields), gs.Equals, 0)
+			c.Expect(pack.Message.GetType(), gs.Equals, msg.GetType())
+
+			c.Expect(pack.DecodeFields(), gs.IsNil)
+			c.Expect(pack.fieldsPending, gs.IsFalse)
+			c.Expect(pack.Message, gs.Equals, msg)
+		})
+
+		c.Specify("decodes pending fields before reencoding", func() {
+			decoder.lazyFields = true
+			pack.MsgBytes = encoded
+			_, err := decoder.Decode(pack)
+			c.Assume(err, gs.IsNil)
+			pack.Message.SetPayload("changed")
+			pack.TrustMsgBytes = false
+			c.Expect(pack.EncodeMsgBytes(), gs.IsNil)
+			v, ok := pack.Message.GetFieldValue("foo")
+			c.Expect(ok, gs.IsTrue)
+			c.Expect(v, gs.Equals, "bar")
+		})
+
 		c.Specify("returns an error for bunk encoding", func() {
 			bunk := append([]byte{0, 0, 0}, encoded...)
 			pack.MsgBytes = bunk
@@ -89,3 +116,20 @@ func BenchmarkDecodeProtobuf(b *testing.B) {
 		decoder.Decode(pack)
 	}
 }
+
+func BenchmarkDecodeProtobufLazyFields(b *testing.B) {
+	b.StopTimer()
+	msg := ts.GetTestMessage()
+	msg.SetPayload("This is a test")
+	encoded, _ := proto.Marshal(msg)
+	config := NewPipelineConfig(nil)
+	pack := NewPipelinePack(config.inputRecycleChan)
+	decoder := new(ProtobufDecoder)
+	decoder.SetPipelineConfig(config)
+	decoder.Init(&ProtobufDecoderConfig{LazyFields: true})
+	pack.MsgBytes = encoded
+	b.StartTimer()
+	for i := 0; i < b.N; i++ {
+		decoder.Decode(pack)
+	}
+}
@@ -0,0 +1,59 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"errors"
+
+	"github.com/mozilla-services/heka/message"
+)
+
+// Name of the message field listing the hostnames of the Heka nodes that
+// have relayed a message to another Heka, oldest first.
+const RELAY_FIELD = "heka.relay"
+
+// Returned when a message being relayed has already been relayed by this
+// node, i.e. the relay topology contains a loop.
+var ErrRelayLoop = errors.New("message has already been relayed by this node")
+
+// Returns whether the hostname is in the message's relay path.
+func RelayedThrough(msg *message.Message, hostname string) bool {
+	field := msg.FindFirstField(RELAY_FIELD)
+	if field == nil {
+		return false
+	}
+	for _, hop := range field.GetValueString() {
+		if hop == hostname {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns a copy of the message w/ the hostname appended to its relay path,
+// leaving the original untouched since it may be shared w/ other plugins.
+// Returns ErrRelayLoop if the hostname is already in the path.
+func AddRelayHop(msg *message.Message, hostname string) (*message.Message, error) {
+	if RelayedThrough(msg, hostname) {
+		return nil, ErrRelayLoop
+	}
+	relayed := message.CopyMessage(msg)
+	if field := relayed.FindFirstField(RELAY_FIELD); field != nil {
+		field.AddValue(hostname)
+	} else {
+		message.NewStringField(relayed, RELAY_FIELD, hostname)
+	}
+	return relayed, nil
+}
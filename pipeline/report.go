@@ -22,6 +22,7 @@ import (
 	"runtime"
 	"strings"
 	"sync/atomic"
+	"time"
 )
 
 // Interface for Heka plugins that will provide reporting data. Plugins can
@@ -65,10 +66,45 @@ func PopulateReportMsg(pr PluginRunner, msg *message.Message) (err error) {
 		}
 		fRunner.MatchRunner().reportLock.Unlock()
 		message.NewInt64Field(msg, "MatchAvgDuration", tmp, "ns")
+		message.NewInt64Field(msg, "MatchDropCount", fRunner.MatchRunner().DropCount(),
+			"count")
 	} else if dRunner, ok := pr.(DecoderRunner); ok {
 		message.NewIntField(msg, "InChanCapacity", cap(dRunner.InChan()), "count")
 		message.NewIntField(msg, "InChanLength", len(dRunner.InChan()), "count")
 	}
+	// Report how many copies of pooled plugins are running.
+	poolSize := 0
+	switch runner := pr.(type) {
+	case *dRunner:
+		poolSize = len(runner.pool)
+	case *foRunner:
+		poolSize = len(runner.pool)
+	}
+	if poolSize > 0 {
+		message.NewIntField(msg, "PoolSize", poolSize+1, "count")
+	}
+	if runner, ok := pr.(*dRunner); ok && runner.decodeTimeout > 0 {
+		message.NewInt64Field(msg, "DecodeTimeoutCount",
+			atomic.LoadInt64(&runner.timeoutCount), "count")
+		message.NewInt64Field(msg, "AbandonedDecodeCount",
+			atomic.LoadInt64(&runner.abandonedCount), "count")
+		if runner.quarantine != nil {
+			message.NewInt64Field(msg, "QuarantinedCount",
+				atomic.LoadInt64(&runner.quarantinedCount), "count")
+			message.NewIntField(msg, "QuarantineSize", runner.quarantine.size(),
+				"count")
+		}
+	}
+	if runner, ok := pr.(*foRunner); ok && runner.sizeGuard.enabled() {
+		message.NewInt64Field(msg, "TruncatedCount",
+			atomic.LoadInt64(&runner.truncatedCount), "count")
+	}
+	if runner, ok := pr.(*foRunner); ok && runner.matcher != nil &&
+		runner.matcher.schedule != nil {
+
+		message.NewInt64Field(msg, "ScheduleMuteCount", runner.matcher.MuteCount(),
+			"count")
+	}
 	msg.SetType("heka.plugin-report")
 	return
 }
@@ -87,6 +123,7 @@ func (pc *PipelineConfig) reports(reportChan chan *PipelinePack) {
 	msg = pack.Message
 	message.NewIntField(msg, "InChanCapacity", cap(pc.inputRecycleChan), "count")
 	message.NewIntField(msg, "InChanLength", len(pc.inputRecycleChan), "count")
+	pc.inputPool.reportMsg(msg)
 	msg.SetLogger(HEKA_DAEMON)
 	msg.SetType("heka.input-report")
 	message.NewStringField(msg, "name", "inputRecycleChan")
@@ -97,6 +134,9 @@ func (pc *PipelineConfig) reports(reportChan chan *PipelinePack) {
 	msg = pack.Message
 	message.NewIntField(msg, "InChanCapacity", cap(pc.injectRecycleChan), "count")
 	message.NewIntField(msg, "InChanLength", len(pc.injectRecycleChan), "count")
+	pc.injectPool.reportMsg(msg)
+	message.NewInt64Field(msg, "DroppedLogLines",
+		atomic.LoadInt64(&droppedLogLines), "count")
 	msg.SetLogger(HEKA_DAEMON)
 	msg.SetType("heka.inject-report")
 	message.NewStringField(msg, "name", "injectRecycleChan")
@@ -169,9 +209,9 @@ func (pc *PipelineConfig) reports(reportChan chan *PipelinePack) {
 		pack.Message.SetType("heka.plugin-report")
 
 		if reporter, hasReports := runner.Splitter().(ReportingPlugin); hasReports {
-			if err = reporter.ReportMsg(msg); err != nil {
+			if err = reporter.ReportMsg(pack.Message); err != nil {
 				if f, e = message.NewField("Error", err.Error(), ""); e == nil {
-					msg.AddField(f)
+					pack.Message.AddField(f)
 				}
 			}
 		}
@@ -204,12 +244,18 @@ func (pc *PipelineConfig) reports(reportChan chan *PipelinePack) {
 	}
 	pc.filtersLock.Unlock()
 
+	pc.outputsLock.Lock()
 	for name, runner := range pc.OutputRunners {
 		pack = getReport(runner)
 		message.NewStringField(pack.Message, "name", name)
 		message.NewStringField(pack.Message, "key", "outputs")
 		reportChan <- pack
 	}
+	pc.outputsLock.Unlock()
+
+	if pc.router.tenants != nil {
+		pc.router.tenants.reports(pc, reportChan)
+	}
 	close(reportChan)
 }
 
@@ -294,6 +340,20 @@ func (pc *PipelineConfig) AllReportsMsg() {
 	pc.router.InChan() <- mempack
 }
 
+// Generates the full set of report messages every `interval` until Heka
+// starts shutting down, so they can be routed to any filter or output
+// instead of only being generated on request.
+func (pc *PipelineConfig) reportOnInterval(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for _ = range ticker.C {
+		if pc.Globals.IsShuttingDown() {
+			return
+		}
+		pc.AllReportsMsg()
+	}
+}
+
 func (pc *PipelineConfig) allReportsStdout() {
 	report_type, msg_payload := pc.allReportsData()
 	pc.log(pc.FormatTextReport(report_type, msg_payload))
@@ -303,9 +363,10 @@ func (pc *PipelineConfig) FormatTextReport(report_type, payload string) string {
 
 	header := []string{
 		"InChanCapacity", "InChanLength", "MatchChanCapacity", "MatchChanLength",
-		"MatchAvgDuration", "ProcessMessageCount", "InjectMessageCount", "Memory",
+		"MatchAvgDuration", "MatchDropCount", "ProcessMessageCount", "InjectMessageCount", "Memory",
 		"MaxMemory", "MaxInstructions", "MaxOutput", "ProcessMessageAvgDuration",
-		"TimerEventAvgDuration", "SynchronousDecode",
+		"TimerEventAvgDuration", "SynchronousDecode", "PoolWaitCount",
+		"PoolWaitAvgDuration", "PoolOverflowCount", "PoolRejectCount", "QuotaDropCount",
 	}
 
 	///////////
@@ -315,6 +376,9 @@ func (pc *PipelineConfig) FormatTextReport(report_type, payload string) string {
 
 	fullReport := make([]string, 0)
 	categories := []string{"globals", "inputs", "splitters", "decoders", "filters", "outputs", "encoders"}
+	if _, ok := m["tenants"]; ok {
+		categories = append(categories, "tenants")
+	}
 	for _, cat := range categories {
 		fullReport = append(fullReport, fmt.Sprintf("\n====%s====", strings.Title(cat)))
 		catReports, ok := m[cat]
@@ -23,6 +23,12 @@ import (
 
 var ErrMaxRetriesExceeded = errors.New("Max retries exceeded")
 
+// Returned by WaitOrStop when it's stopped before the retry is due.
+var ErrRetryStopped = errors.New("Retry stopped")
+
+// Stands in for a `max_retries` that wasn't set in a `backoff` section.
+const retriesUnset = -2
+
 // Retry helper, created with a RetryOptions struct
 //
 // Everytime Wait is called, the times this has been used is incremented.
@@ -76,6 +82,14 @@ func NewRetryHelper(opts RetryOptions) (helper *RetryHelper, err error) {
 //
 // If the max retries has been exceeded, an error will be returned
 func (r *RetryHelper) Wait() error {
+	return r.WaitOrStop(nil)
+}
+
+// Wait for a retry, giving up as soon as the stop channel is closed
+//
+// If the max retries has been exceeded, or the stop channel is closed, an
+// error will be returned
+func (r *RetryHelper) WaitOrStop(stop <-chan struct{}) error {
 	if r.retries != -1 && r.times >= r.retries {
 		return ErrMaxRetriesExceeded
 	}
@@ -85,6 +99,9 @@ func (r *RetryHelper) Wait() error {
 	select {
 	case <-timer.C:
 		break
+	case <-stop:
+		timer.Stop()
+		return ErrRetryStopped
 	}
 	r.curDelay *= 2
 	r.times += 1
@@ -99,3 +116,50 @@ func (r *RetryHelper) Reset() {
 	r.times = 0
 	r.curDelay = r.delay
 }
+
+// Returns the options w/ any settings that weren't configured taken from
+// defaults.
+func (o RetryOptions) withDefaults(defaults RetryOptions) RetryOptions {
+	if o.Delay == "" {
+		o.Delay = defaults.Delay
+	}
+	if o.MaxDelay == "" {
+		o.MaxDelay = defaults.MaxDelay
+	}
+	if o.MaxJitter == "" {
+		o.MaxJitter = defaults.MaxJitter
+	}
+	if o.MaxRetries == retriesUnset {
+		o.MaxRetries = defaults.MaxRetries
+	}
+	return o
+}
+
+// Checks that a `backoff` section's durations can be parsed.
+func validBackoff(opts *RetryOptions) error {
+	if opts == nil {
+		return nil
+	}
+	_, err := NewRetryHelper(opts.withDefaults(getDefaultRetryOptions()))
+	return err
+}
+
+// Implemented by the runners of plugins that can have a `backoff` section.
+type backoffConfigured interface {
+	backoff() *RetryOptions
+}
+
+// Creates a RetryHelper for the retries a plugin does itself, such as
+// reconnecting to a server, so that all network plugins' retries can be
+// tuned the same way. The defaults are the plugin's own choices; any settings
+// in the plugin's `backoff` config section take precedence.
+func NewRunnerRetryHelper(runner PluginRunner, defaults RetryOptions) (*RetryHelper,
+	error) {
+
+	if configured, ok := runner.(backoffConfigured); ok {
+		if opts := configured.backoff(); opts != nil {
+			defaults = opts.withDefaults(defaults)
+		}
+	}
+	return NewRetryHelper(defaults)
+}
@@ -0,0 +1,60 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"time"
+
+	gs "github.com/rafrombrc/gospec/src/gospec"
+)
+
+func BackoffSpec(c gs.Context) {
+	defaults := RetryOptions{
+		Delay:      "1s",
+		MaxDelay:   "10s",
+		MaxJitter:  "1ms",
+		MaxRetries: -1,
+	}
+
+	c.Specify("A backoff section", func() {
+		c.Specify("keeps the plugin's defaults for missing settings", func() {
+			opts := RetryOptions{MaxDelay: "1m", MaxRetries: retriesUnset}
+			merged := opts.withDefaults(defaults)
+			c.Expect(merged.Delay, gs.Equals, "1s")
+			c.Expect(merged.MaxDelay, gs.Equals, "1m")
+			c.Expect(merged.MaxRetries, gs.Equals, -1)
+		})
+
+		c.Specify("is used by a runner's retry helper", func() {
+			config := CommonFOConfig{
+				Matcher: "TRUE",
+				Backoff: &RetryOptions{Delay: "5ms", MaxRetries: 3},
+			}
+			runner, err := NewFORunner("out", new(CounterFilter), config,
+				"CounterFilter", 1)
+			c.Assume(err, gs.IsNil)
+			rh, err := NewRunnerRetryHelper(runner, defaults)
+			c.Expect(err, gs.IsNil)
+			c.Expect(rh.delay, gs.Equals, 5*time.Millisecond)
+			c.Expect(rh.maxDelay, gs.Equals, 10*time.Second)
+			c.Expect(rh.retries, gs.Equals, 3)
+		})
+
+		c.Specify("must have valid durations", func() {
+			c.Expect(validBackoff(nil), gs.IsNil)
+			c.Expect(validBackoff(&RetryOptions{Delay: "soon"}), gs.Not(gs.IsNil))
+		})
+	})
+}
@@ -16,6 +16,7 @@
 package pipeline
 
 import (
+	"fmt"
 	"github.com/mozilla-services/heka/message"
 	"math/rand"
 	"runtime"
@@ -41,6 +42,9 @@ type MessageRouter interface {
 	// be removed from the router, the matcher channel closed and drained, the
 	// filter channel closed and drained, and the filter exited.
 	RemoveFilterMatcher() chan *MatchRunner
+	// Channel to facilitate adding a matcher to the router which starts the
+	// message flow to the associated output.
+	AddOutputMatcher() chan *MatchRunner
 	// Channel to facilitate removing an Output.  If the matcher exists it will
 	// be removed from the router, the matcher channel closed and drained, the
 	// output channel closed and drained, and the output exited.
@@ -52,6 +56,7 @@ type messageRouter struct {
 	inChan              chan *PipelinePack
 	addFilterMatcher    chan *MatchRunner
 	removeFilterMatcher chan *MatchRunner
+	addOutputMatcher    chan *MatchRunner
 	removeOutputMatcher chan *MatchRunner
 	fMatchers           []*MatchRunner
 	oMatchers           []*MatchRunner
@@ -61,6 +66,60 @@ type messageRouter struct {
 	// the definitive list of active matchers.
 	fMatcherMap map[string]*MatchRunner
 	oMatcherMap map[string]*MatchRunner
+	// Index of the active matchers, rebuilt whenever one is added or removed.
+	index *matcherIndex
+	// Round robin groups of the active output matchers, rebuilt along w/ the
+	// index.
+	groups roundRobinGroups
+	// Tenancy support, nil if tenancy is disabled.
+	tenants *tenantTracker
+}
+
+// Indexes matchers by the Type or Logger value their message_matcher
+// requires, if any, so the router only hands each message to the matchers
+// that could possibly match it rather than to every matcher.
+type matcherIndex struct {
+	byType    map[string][]*MatchRunner
+	byLogger  map[string][]*MatchRunner
+	unindexed []*MatchRunner
+}
+
+// Builds an index of the non-nil matchers in the provided slices.
+func newMatcherIndex(matcherSets ...[]*MatchRunner) *matcherIndex {
+	idx := &matcherIndex{
+		byType:   make(map[string][]*MatchRunner),
+		byLogger: make(map[string][]*MatchRunner),
+	}
+	for _, matchers := range matcherSets {
+		for _, matcher := range matchers {
+			if matcher == nil {
+				continue
+			}
+			if value, ok := matcher.spec.RequiredValue("Type"); ok {
+				idx.byType[value] = append(idx.byType[value], matcher)
+			} else if value, ok := matcher.spec.RequiredValue("Logger"); ok {
+				idx.byLogger[value] = append(idx.byLogger[value], matcher)
+			} else {
+				idx.unindexed = append(idx.unindexed, matcher)
+			}
+		}
+	}
+	return idx
+}
+
+// Appends the matchers that might match the message to candidates and
+// returns the result.
+func (idx *matcherIndex) candidates(msg *message.Message,
+	candidates []*MatchRunner) []*MatchRunner {
+
+	candidates = append(candidates, idx.unindexed...)
+	if len(idx.byType) > 0 {
+		candidates = append(candidates, idx.byType[msg.GetType()]...)
+	}
+	if len(idx.byLogger) > 0 {
+		candidates = append(candidates, idx.byLogger[msg.GetLogger()]...)
+	}
+	return candidates
 }
 
 // Creates and returns a (not yet started) Heka message router.
@@ -69,6 +128,7 @@ func NewMessageRouter(chanSize int) (router *messageRouter) {
 	router.inChan = make(chan *PipelinePack, chanSize)
 	router.addFilterMatcher = make(chan *MatchRunner, 0)
 	router.removeFilterMatcher = make(chan *MatchRunner, 0)
+	router.addOutputMatcher = make(chan *MatchRunner, 0)
 	router.removeOutputMatcher = make(chan *MatchRunner, 0)
 	router.fMatcherMap = make(map[string]*MatchRunner)
 	router.oMatcherMap = make(map[string]*MatchRunner)
@@ -87,6 +147,10 @@ func (self *messageRouter) RemoveFilterMatcher() chan *MatchRunner {
 	return self.removeFilterMatcher
 }
 
+func (self *messageRouter) AddOutputMatcher() chan *MatchRunner {
+	return self.addOutputMatcher
+}
+
 func (self *messageRouter) RemoveOutputMatcher() chan *MatchRunner {
 	return self.removeOutputMatcher
 }
@@ -115,29 +179,23 @@ func (self *messageRouter) Start() {
 		var matcher *MatchRunner
 		var ok = true
 		var pack *PipelinePack
+		var candidates []*MatchRunner
+		var seq int64
+		self.index = newMatcherIndex(self.fMatchers, self.oMatchers)
+		self.groups = newRoundRobinGroups(self.oMatchers)
 		for ok {
 			runtime.Gosched()
 			select {
 			case matcher = <-self.addFilterMatcher:
 				if matcher != nil {
-					exists := false
-					available := -1
-					for i, m := range self.fMatchers {
-						if m == nil {
-							available = i
-						}
-						if matcher == m {
-							exists = true
-							break
-						}
-					}
-					if !exists {
-						if available != -1 {
-							self.fMatchers[available] = matcher
-						} else {
-							self.fMatchers = append(self.fMatchers, matcher)
-						}
-					}
+					self.fMatchers = addMatcher(self.fMatchers, matcher)
+					self.index = newMatcherIndex(self.fMatchers, self.oMatchers)
+				}
+			case matcher = <-self.addOutputMatcher:
+				if matcher != nil {
+					self.oMatchers = addMatcher(self.oMatchers, matcher)
+					self.index = newMatcherIndex(self.fMatchers, self.oMatchers)
+					self.groups = newRoundRobinGroups(self.oMatchers)
 				}
 			case matcher = <-self.removeFilterMatcher:
 				if matcher != nil {
@@ -148,6 +206,7 @@ func (self *messageRouter) Start() {
 							break
 						}
 					}
+					self.index = newMatcherIndex(self.fMatchers, self.oMatchers)
 				}
 			case matcher = <-self.removeOutputMatcher:
 				if matcher != nil {
@@ -158,24 +217,64 @@ func (self *messageRouter) Start() {
 							break
 						}
 					}
+					self.index = newMatcherIndex(self.fMatchers, self.oMatchers)
+					self.groups = newRoundRobinGroups(self.oMatchers)
 				}
 			case pack, ok = <-self.inChan:
 				if !ok {
 					break
 				}
 				pack.diagnostics.Reset()
-				atomic.AddInt64(&self.processMessageCount, 1)
-				for _, matcher = range self.fMatchers {
-					if matcher != nil {
-						atomic.AddInt32(&pack.RefCount, 1)
-						matcher.inChan <- pack
+				seq = atomic.AddInt64(&self.processMessageCount, 1)
+				if pack.fieldsPending && self.tenants != nil &&
+					self.tenants.source == TENANT_SOURCE_FIELD {
+					pack.DecodeFields()
+				}
+				if self.tenants != nil &&
+					!self.tenants.allow(self.tenants.tenantOf(pack), time.Now().UnixNano()) {
+					pack.Recycle()
+					continue
+				}
+				if pack.traced {
+					// Skip the index so every matcher logs its result.
+					logTrace(pack.Message, "routing, route: %s", routeString(pack.Message))
+					candidates = append(candidates[:0], self.fMatchers...)
+					candidates = append(candidates, self.oMatchers...)
+				} else {
+					candidates = self.index.candidates(pack.Message, candidates[:0])
+				}
+				if pack.fieldsPending {
+					// The pack is shared by every matcher, so the fields need
+					// to be decoded before it's handed to any of them.
+					for _, matcher = range candidates {
+						if matcher != nil && matcher.usesFields {
+							pack.DecodeFields()
+							break
+						}
 					}
 				}
-				for _, matcher = range self.oMatchers {
-					if matcher != nil {
-						atomic.AddInt32(&pack.RefCount, 1)
-						matcher.inChan <- pack
+				tracker := pack.Tracker
+				if pack.trackerHeld {
+					// Outputs that acknowledge delivery take over from the
+					// pack's own reference, see DeliveryTracker.
+					pack.trackerHeld = false
+				} else {
+					tracker = nil
+				}
+				for _, matcher = range candidates {
+					if matcher == nil ||
+						(matcher.tenant != "" && matcher.tenant != pack.tenant) ||
+						!self.groups.takes(matcher, pack, seq) {
+						continue
 					}
+					if tracker != nil && matcher.acksDelivery {
+						tracker.Hold()
+					}
+					atomic.AddInt32(&pack.RefCount, 1)
+					matcher.inChan <- pack
+				}
+				if tracker != nil {
+					tracker.Done()
 				}
 				pack.Recycle()
 			}
@@ -186,23 +285,71 @@ func (self *messageRouter) Start() {
 			}
 		}
 		for _, matcher = range self.oMatchers {
-			close(matcher.inChan)
+			if matcher != nil {
+				close(matcher.inChan)
+			}
 		}
 		LogInfo.Println("MessageRouter stopped.")
 	}()
 	LogInfo.Println("MessageRouter started.")
 }
 
+// addMatcher adds the provided matcher to the matchers slice, reusing any
+// slot that was vacated by a removed matcher. The matcher won't be added a
+// second time if it's already in the slice.
+func addMatcher(matchers []*MatchRunner, matcher *MatchRunner) []*MatchRunner {
+	available := -1
+	for i, m := range matchers {
+		if m == nil {
+			available = i
+		}
+		if matcher == m {
+			return matchers
+		}
+	}
+	if available != -1 {
+		matchers[available] = matcher
+	} else {
+		matchers = append(matchers, matcher)
+	}
+	return matchers
+}
+
 // Encapsulates the mechanics of testing messages against a specific plugin's
 // message_matcher value.
 type MatchRunner struct {
 	matchSamples  int64
 	matchDuration int64
+	dropCount     int64
 	spec          *message.MatcherSpecification
 	signer        string
 	inChan        chan *PipelinePack
 	pluginRunner  PluginRunner
 	reportLock    sync.Mutex
+	// If true, matching messages are dropped rather than waiting when the
+	// plugin's channel is full.
+	dropOnFull bool
+	// If not empty, only messages belonging to this tenant are matched.
+	tenant string
+	// If not empty, the router hands each message to just one member of the
+	// round robin group.
+	roundRobinGroup string
+	// If not nil, matches are only passed on while the schedule is active.
+	schedule  *schedule
+	muteCount int64
+	// Whether the spec or the plugin use the message's fields.
+	usesFields bool
+	// Whether the plugin is an output that acknowledges the delivery of
+	// tracked packs, in which case the router takes a reference on each
+	// tracked pack's DeliveryTracker that the runner releases if the pack
+	// isn't passed on.
+	acksDelivery bool
+	// When the runner started waiting for room in the plugin's channel, in
+	// ns since the epoch, 0 if it isn't waiting.
+	blockedSince int64
+	// Closed once the plugin's been given up on, see abandon.
+	abandoned   chan struct{}
+	abandonOnce sync.Once
 }
 
 // Creates and returns a new MatchRunner if possible, or a relevant error if
@@ -219,6 +366,8 @@ func NewMatchRunner(filter, signer string, runner PluginRunner, chanSize int) (
 		signer:       signer,
 		inChan:       make(chan *PipelinePack, chanSize),
 		pluginRunner: runner,
+		usesFields:   true,
+		abandoned:    make(chan struct{}),
 	}
 	return
 }
@@ -243,10 +392,79 @@ func (mr *MatchRunner) GetAvgDuration() (duration int64) {
 	return
 }
 
+// Returns the number of matching messages that were dropped because the
+// plugin's channel was full.
+func (mr *MatchRunner) DropCount() int64 {
+	return atomic.LoadInt64(&mr.dropCount)
+}
+
+// Returns the number of matching messages that were dropped because they
+// arrived outside of the plugin's schedule.
+func (mr *MatchRunner) MuteCount() int64 {
+	return atomic.LoadInt64(&mr.muteCount)
+}
+
+// Logs a trace event for a traced pack, naming the matcher's plugin.
+func (mr *MatchRunner) trace(pack *PipelinePack, format string, v ...interface{}) {
+	name := "<unknown>"
+	if mr.pluginRunner != nil {
+		name = mr.pluginRunner.Name()
+	}
+	logTrace(pack.Message, "'%s' %s", name, fmt.Sprintf(format, v...))
+}
+
+// Releases the reference the router took on a tracked pack's DeliveryTracker
+// for a pack that isn't passed on to the plugin, failing the delivery if the
+// pack was dropped.
+func (mr *MatchRunner) release(pack *PipelinePack, dropped bool) {
+	if !mr.acksDelivery {
+		return
+	}
+	if dropped {
+		pack.Tracker.Fail()
+	} else {
+		pack.Tracker.Done()
+	}
+}
+
+// Returns how long the runner has been waiting for room in the plugin's
+// channel, or 0 if it isn't waiting.
+func (mr *MatchRunner) stalledFor(now time.Time) time.Duration {
+	since := atomic.LoadInt64(&mr.blockedSince)
+	if since == 0 {
+		return 0
+	}
+	return now.Sub(time.Unix(0, since))
+}
+
+// Stops passing matches on to a wedged plugin, they're dropped instead, so
+// the router isn't held up while the plugin is replaced.
+func (mr *MatchRunner) abandon() {
+	mr.abandonOnce.Do(func() {
+		close(mr.abandoned)
+	})
+}
+
+// Implemented by runners that stop injecting their plugin's log lines once
+// it's been handed a `heka.log` message.
+type logTaker interface {
+	setTakesLogs()
+}
+
+// Keeps the plugin's own log lines from being injected, they'd be routed
+// straight back to it.
+func (mr *MatchRunner) takesLogs() {
+	if taker, ok := mr.pluginRunner.(logTaker); ok {
+		taker.setTakesLogs()
+	}
+}
+
 // Starts the runner listening for messages on its input channel. Any message
 // that is a match will be placed on the provided matchChan (usually the input
 // channel for a specific Filter or Output plugin). Any messages that are not a
-// match will be immediately recycled.
+// match will be immediately recycled. If the runner was configured to drop on
+// full, matches that don't fit in the matchChan are counted and recycled
+// instead of blocking the router.
 func (mr *MatchRunner) Start(matchChan chan *PipelinePack, sampleDenom int) {
 	go func() {
 		defer func() {
@@ -277,6 +495,10 @@ func (mr *MatchRunner) Start(matchChan chan *PipelinePack, sampleDenom int) {
 		var capacity int64 = int64(cap(mr.inChan))
 		for pack := range mr.inChan {
 			if len(mr.signer) != 0 && mr.signer != pack.Signer {
+				if pack.traced {
+					mr.trace(pack, "signer '%s' doesn't match", pack.Signer)
+				}
+				mr.release(pack, false)
 				pack.Recycle()
 				continue
 			}
@@ -304,10 +526,53 @@ func (mr *MatchRunner) Start(matchChan chan *PipelinePack, sampleDenom int) {
 				counter++
 			}
 
+			if pack.traced {
+				if match {
+					mr.trace(pack, "matched")
+				} else {
+					mr.trace(pack, "not matched")
+				}
+			}
+
+			if match && mr.schedule != nil && !mr.schedule.active(time.Now()) {
+				if pack.traced {
+					mr.trace(pack, "muted by schedule")
+				}
+				atomic.AddInt64(&mr.muteCount, 1)
+				match = false
+			}
+
 			if match {
+				if pluginLogLines != nil && pack.Message.GetType() == "heka.log" {
+					mr.takesLogs()
+				}
 				pack.diagnostics.AddStamp(mr.pluginRunner)
-				matchChan <- pack
+				if !mr.dropOnFull {
+					select {
+					case matchChan <- pack:
+						continue
+					default:
+					}
+					atomic.StoreInt64(&mr.blockedSince, time.Now().UnixNano())
+					select {
+					case matchChan <- pack:
+					case <-mr.abandoned:
+						atomic.AddInt64(&mr.dropCount, 1)
+						mr.release(pack, true)
+						pack.Recycle()
+					}
+					atomic.StoreInt64(&mr.blockedSince, 0)
+					continue
+				}
+				select {
+				case matchChan <- pack:
+				default:
+					atomic.AddInt64(&mr.dropCount, 1)
+					mr.release(pack, true)
+					pack.Recycle()
+				}
 			} else {
+				mr.release(pack, false)
 				pack.Recycle()
 			}
 		}
@@ -0,0 +1,288 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mozilla-services/heka/message"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+)
+
+func MatchRunnerSpec(c gs.Context) {
+	recycleChan := make(chan *PipelinePack, 3)
+	packs := make([]*PipelinePack, 3)
+	for i := range packs {
+		packs[i] = NewPipelinePack(recycleChan)
+		packs[i].Message = new(message.Message)
+		packs[i].Message.SetType("test")
+	}
+
+	c.Specify("A MatchRunner", func() {
+		mr, err := NewMatchRunner("Type == 'test'", "", nil, 3)
+		c.Assume(err, gs.IsNil)
+		matchChan := make(chan *PipelinePack, 1)
+
+		c.Specify("recycles messages that don't match", func() {
+			packs[0].Message.SetType("other")
+			mr.Start(matchChan, 1)
+			mr.inChan <- packs[0]
+			close(mr.inChan)
+			c.Expect(<-recycleChan, gs.Equals, packs[0])
+			_, ok := <-matchChan
+			c.Expect(ok, gs.IsFalse)
+		})
+
+		c.Specify("drops matches when the plugin is full", func() {
+			mr.dropOnFull = true
+			mr.Start(matchChan, 1)
+			for _, pack := range packs {
+				mr.inChan <- pack
+			}
+			close(mr.inChan)
+			c.Expect(<-recycleChan, gs.Equals, packs[1])
+			c.Expect(<-recycleChan, gs.Equals, packs[2])
+			c.Expect(<-matchChan, gs.Equals, packs[0])
+			_, ok := <-matchChan
+			c.Expect(ok, gs.IsFalse)
+			c.Expect(mr.DropCount(), gs.Equals, int64(2))
+		})
+
+		c.Specify("mutes matches outside of its schedule", func() {
+			mr.schedule, err = newSchedule([]string{"* * * * *"}, "UTC", true)
+			c.Assume(err, gs.IsNil)
+			mr.Start(matchChan, 1)
+			mr.inChan <- packs[0]
+			close(mr.inChan)
+			c.Expect(<-recycleChan, gs.Equals, packs[0])
+			_, ok := <-matchChan
+			c.Expect(ok, gs.IsFalse)
+			c.Expect(mr.MuteCount(), gs.Equals, int64(1))
+		})
+
+		c.Specify("measures how long the plugin's been full", func() {
+			mr.Start(matchChan, 1)
+			c.Expect(mr.stalledFor(time.Now()), gs.Equals, time.Duration(0))
+			mr.inChan <- packs[0]
+			mr.inChan <- packs[1]
+			for atomic.LoadInt64(&mr.blockedSince) == 0 {
+				time.Sleep(time.Millisecond)
+			}
+			c.Expect(mr.stalledFor(time.Now().Add(time.Minute)) >= time.Minute,
+				gs.IsTrue)
+
+			// Once abandoned the matches are dropped.
+			mr.abandon()
+			c.Expect(<-recycleChan, gs.Equals, packs[1])
+			mr.inChan <- packs[2]
+			c.Expect(<-recycleChan, gs.Equals, packs[2])
+			c.Expect(mr.DropCount(), gs.Equals, int64(2))
+			c.Expect(mr.stalledFor(time.Now()), gs.Equals, time.Duration(0))
+			close(mr.inChan)
+			c.Expect(<-matchChan, gs.Equals, packs[0])
+		})
+
+		c.Specify("releases the deliveries of tracked packs it doesn't pass on", func() {
+			acks, nacks := 0, 0
+			tracker := NewDeliveryTracker(func() { acks++ }, func() { nacks++ })
+			mr.acksDelivery = true
+			mr.dropOnFull = true
+			packs[0].Message.SetType("other")
+			for _, pack := range packs {
+				// What the router does for each pack.
+				tracker.Track(pack)
+				tracker.Hold()
+				pack.releaseTracker()
+			}
+			tracker.Done()
+			mr.Start(matchChan, 1)
+			for _, pack := range packs {
+				mr.inChan <- pack
+			}
+			close(mr.inChan)
+			for range packs[1:] {
+				<-recycleChan
+			}
+			delivered := <-matchChan
+			c.Expect(delivered, gs.Equals, packs[1])
+			c.Expect(tracker.Pending(), gs.Equals, int32(1))
+			c.Expect(tracker.Failed(), gs.IsTrue)
+			delivered.Tracker.Done()
+			c.Expect(acks, gs.Equals, 0)
+			c.Expect(nacks, gs.Equals, 1)
+		})
+	})
+}
+
+func MatcherIndexSpec(c gs.Context) {
+	newMatcher := func(spec string) *MatchRunner {
+		mr, err := NewMatchRunner(spec, "", nil, 1)
+		c.Assume(err, gs.IsNil)
+		return mr
+	}
+
+	c.Specify("A matcherIndex", func() {
+		byType := newMatcher("Type == 'test' && Severity < 7")
+		otherType := newMatcher("Type == 'other'")
+		byLogger := newMatcher("Logger == 'input'")
+		unindexed := newMatcher("Type =~ /test/ || Logger == 'input'")
+		idx := newMatcherIndex([]*MatchRunner{byType, nil, otherType},
+			[]*MatchRunner{byLogger, unindexed})
+
+		msg := new(message.Message)
+		msg.SetType("test")
+		msg.SetLogger("other")
+
+		c.Specify("only returns matchers that might match", func() {
+			candidates := idx.candidates(msg, nil)
+			c.Expect(len(candidates), gs.Equals, 2)
+			c.Expect(candidates[0], gs.Equals, unindexed)
+			c.Expect(candidates[1], gs.Equals, byType)
+
+			msg.SetType("none")
+			msg.SetLogger("input")
+			candidates = idx.candidates(msg, candidates[:0])
+			c.Expect(len(candidates), gs.Equals, 2)
+			c.Expect(candidates[1], gs.Equals, byLogger)
+		})
+	})
+}
+
+func TenantTrackerSpec(c gs.Context) {
+	globals := DefaultGlobals()
+	globals.TenantSource = TENANT_SOURCE_FIELD
+	globals.TenantMaxRate = 2
+
+	c.Specify("A tenantTracker", func() {
+		tenants := newTenantTracker(globals)
+		pack := NewPipelinePack(nil)
+
+		c.Specify("is disabled w/o a tenant source", func() {
+			c.Expect(newTenantTracker(DefaultGlobals()), gs.IsNil)
+		})
+
+		c.Specify("gets the tenant from the message", func() {
+			c.Expect(tenants.tenantOf(pack), gs.Equals, "")
+			pack.Zero()
+			message.NewStringField(pack.Message, "tenant", "acme")
+			c.Expect(tenants.tenantOf(pack), gs.Equals, "acme")
+
+			// A tenant set by a filter takes precedence.
+			pack.tenant = "other"
+			c.Expect(tenants.tenantOf(pack), gs.Equals, "other")
+
+			tenants.source = TENANT_SOURCE_SIGNER
+			pack.Zero()
+			pack.Signer = "signer"
+			c.Expect(tenants.tenantOf(pack), gs.Equals, "signer")
+		})
+
+		c.Specify("enforces the per tenant quota", func() {
+			now := int64(10e9)
+			c.Expect(tenants.allow("acme", now), gs.IsTrue)
+			c.Expect(tenants.allow("acme", now+1), gs.IsTrue)
+			c.Expect(tenants.allow("acme", now+2), gs.IsFalse)
+			c.Expect(tenants.allow("other", now+2), gs.IsTrue)
+			c.Expect(tenants.allow("", now+2), gs.IsTrue)
+			c.Expect(tenants.allow("", now+3), gs.IsTrue)
+			c.Expect(tenants.allow("", now+4), gs.IsTrue)
+			c.Expect(tenants.allow("acme", now+int64(time.Second)), gs.IsTrue)
+
+			stats := tenants.getStats("acme")
+			c.Expect(stats.processMessageCount, gs.Equals, int64(3))
+			c.Expect(stats.quotaDropCount, gs.Equals, int64(1))
+		})
+
+		c.Specify("counts tenants past the limit together", func() {
+			tenants.maxCount = 2
+			now := int64(10e9)
+			c.Expect(tenants.allow("acme", now), gs.IsTrue)
+			c.Expect(tenants.allow("other", now), gs.IsTrue)
+			c.Expect(tenants.allow("third", now), gs.IsTrue)
+			c.Expect(tenants.allow("fourth", now), gs.IsTrue)
+			c.Expect(len(tenants.stats), gs.Equals, 2)
+			c.Expect(tenants.getStats("third"), gs.Equals, tenants.other)
+			c.Expect(tenants.other.processMessageCount, gs.Equals, int64(2))
+
+			// The untracked tenants share a quota.
+			c.Expect(tenants.allow("fifth", now), gs.IsFalse)
+			c.Expect(tenants.other.quotaDropCount, gs.Equals, int64(1))
+		})
+
+		c.Specify("stops tracking idle tenants", func() {
+			tenants.maxCount = 1
+			tenants.idleTimeout = int64(time.Minute)
+			now := int64(10e9)
+			c.Expect(tenants.allow("acme", now), gs.IsTrue)
+			c.Expect(tenants.allow("other", now+1), gs.IsTrue)
+			c.Expect(tenants.getStats("other"), gs.Equals, tenants.other)
+
+			now += int64(time.Minute)
+			c.Expect(tenants.allow("other", now), gs.IsTrue)
+			c.Expect(len(tenants.stats), gs.Equals, 1)
+			_, ok := tenants.stats["other"]
+			c.Expect(ok, gs.IsTrue)
+			_, ok = tenants.stats["acme"]
+			c.Expect(ok, gs.IsFalse)
+		})
+	})
+}
+
+// Generates matchers for n plugins that each match a different message type,
+// as in a config w/ many type specific filters and outputs.
+func benchMatchers(b *testing.B, n int) []*MatchRunner {
+	matchers := make([]*MatchRunner, n)
+	for i := range matchers {
+		mr, err := NewMatchRunner(fmt.Sprintf("Type == 'type%d' && Severity < 7", i),
+			"", nil, 1)
+		if err != nil {
+			b.Fatal(err)
+		}
+		matchers[i] = mr
+	}
+	return matchers
+}
+
+func BenchmarkMatchEveryMatcher(b *testing.B) {
+	matchers := benchMatchers(b, 500)
+	msg := new(message.Message)
+	msg.SetType("type250")
+	msg.SetSeverity(6)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, mr := range matchers {
+			mr.spec.Match(msg)
+		}
+	}
+}
+
+func BenchmarkMatchIndexedMatchers(b *testing.B) {
+	idx := newMatcherIndex(benchMatchers(b, 500))
+	msg := new(message.Message)
+	msg.SetType("type250")
+	msg.SetSeverity(6)
+	var candidates []*MatchRunner
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		candidates = idx.candidates(msg, candidates[:0])
+		for _, mr := range candidates {
+			mr.spec.Match(msg)
+		}
+	}
+}
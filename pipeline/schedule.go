@@ -0,0 +1,198 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	monthNames = map[string]int{
+		"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+		"jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+	}
+	weekdayNames = map[string]int{
+		"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6,
+	}
+)
+
+// A time window in crontab(5) syntax: minute, hour, day of month, month, and
+// day of week fields. A minute that matches all of the fields is inside the
+// window.
+type cronWindow struct {
+	minutes, hours, days, months, weekdays uint64
+	// As in cron, if either day field is "*" the other one decides which days
+	// match, otherwise a day matching either of them does.
+	anyDay bool
+}
+
+// Parses a crontab(5) style field into a bit set of the values it selects.
+// Supports "*", single values, ranges, steps, comma separated lists, and
+// names if any are provided.
+func parseCronField(field string, min, max int, names map[string]int) (
+	bits uint64, err error) {
+
+	value := func(s string) (int, error) {
+		if v, ok := names[strings.ToLower(s)]; ok {
+			return v, nil
+		}
+		v, err := strconv.Atoi(s)
+		if err != nil || v < min || v > max {
+			return 0, fmt.Errorf("invalid value '%s', must be between %d and %d",
+				s, min, max)
+		}
+		return v, nil
+	}
+
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i != -1 {
+			if step, err = strconv.Atoi(part[i+1:]); err != nil || step < 1 {
+				return 0, fmt.Errorf("invalid step in '%s'", part)
+			}
+			part = part[:i]
+		}
+		var lo, hi int
+		if part == "*" {
+			lo, hi = min, max
+		} else if i := strings.Index(part, "-"); i != -1 {
+			if lo, err = value(part[:i]); err != nil {
+				return
+			}
+			if hi, err = value(part[i+1:]); err != nil {
+				return
+			}
+			if lo > hi {
+				return 0, fmt.Errorf("invalid range '%s'", part)
+			}
+		} else {
+			if lo, err = value(part); err != nil {
+				return
+			}
+			hi = lo
+			if step > 1 {
+				hi = max
+			}
+		}
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return
+}
+
+func parseCronWindow(spec string) (w cronWindow, err error) {
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return w, fmt.Errorf("'%s' must have 5 fields", spec)
+	}
+	if w.minutes, err = parseCronField(fields[0], 0, 59, nil); err != nil {
+		return
+	}
+	if w.hours, err = parseCronField(fields[1], 0, 23, nil); err != nil {
+		return
+	}
+	if w.days, err = parseCronField(fields[2], 1, 31, nil); err != nil {
+		return
+	}
+	if w.months, err = parseCronField(fields[3], 1, 12, monthNames); err != nil {
+		return
+	}
+	if w.weekdays, err = parseCronField(fields[4], 0, 7, weekdayNames); err != nil {
+		return
+	}
+	// Both 0 and 7 are Sunday.
+	if w.weekdays&(1<<7) != 0 {
+		w.weekdays |= 1
+	}
+	w.anyDay = strings.HasPrefix(fields[2], "*") || strings.HasPrefix(fields[4], "*")
+	return
+}
+
+func (w cronWindow) contains(t time.Time) bool {
+	if w.minutes&(1<<uint(t.Minute())) == 0 || w.hours&(1<<uint(t.Hour())) == 0 ||
+		w.months&(1<<uint(t.Month())) == 0 {
+
+		return false
+	}
+	day := w.days&(1<<uint(t.Day())) != 0
+	weekday := w.weekdays&(1<<uint(t.Weekday())) != 0
+	if w.anyDay {
+		return day && weekday
+	}
+	return day || weekday
+}
+
+// Decides whether an output gets messages at a given time, from its
+// `schedule` windows. Only used by the output's MatchRunner goroutine.
+type schedule struct {
+	windows  []cronWindow
+	location *time.Location
+	// If true the output gets messages outside of the windows instead.
+	invert bool
+	// The result for the last minute checked, windows being minute based.
+	lastMinute int64
+	lastActive bool
+}
+
+// Creates a schedule from the provided windows, interpreted in the named
+// time zone, or in local time if it's empty.
+func newSchedule(windows []string, timezone string, invert bool) (*schedule, error) {
+	if len(windows) == 0 {
+		return nil, errors.New("no windows")
+	}
+	s := &schedule{
+		location:   time.Local,
+		invert:     invert,
+		lastMinute: -1,
+	}
+	if timezone != "" {
+		var err error
+		if s.location, err = time.LoadLocation(timezone); err != nil {
+			return nil, fmt.Errorf("invalid time zone '%s': %s", timezone, err)
+		}
+	}
+	for _, spec := range windows {
+		w, err := parseCronWindow(spec)
+		if err != nil {
+			return nil, err
+		}
+		s.windows = append(s.windows, w)
+	}
+	return s, nil
+}
+
+// Returns whether the output gets messages at the provided time.
+func (s *schedule) active(now time.Time) bool {
+	minute := now.Unix() / 60
+	if minute == s.lastMinute {
+		return s.lastActive
+	}
+	t := now.In(s.location)
+	inWindow := false
+	for _, w := range s.windows {
+		if w.contains(t) {
+			inWindow = true
+			break
+		}
+	}
+	s.lastMinute = minute
+	s.lastActive = inWindow != s.invert
+	return s.lastActive
+}
@@ -0,0 +1,91 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"time"
+
+	gs "github.com/rafrombrc/gospec/src/gospec"
+)
+
+func ScheduleSpec(c gs.Context) {
+	// A Monday.
+	monday := time.Date(2015, time.June, 1, 8, 30, 0, 0, time.UTC)
+
+	c.Specify("A schedule", func() {
+		c.Specify("is active within its windows", func() {
+			s, err := newSchedule([]string{"* 9-16 * * Mon-Fri"}, "UTC", false)
+			c.Assume(err, gs.IsNil)
+			c.Expect(s.active(monday), gs.IsFalse)
+			c.Expect(s.active(monday.Add(time.Hour)), gs.IsTrue)
+			c.Expect(s.active(monday.Add(8*time.Hour+29*time.Minute)), gs.IsTrue)
+			c.Expect(s.active(monday.Add(8*time.Hour+30*time.Minute)), gs.IsFalse)
+			// Saturday.
+			c.Expect(s.active(monday.Add(5*24*time.Hour+time.Hour)), gs.IsFalse)
+		})
+
+		c.Specify("is active in any of several windows", func() {
+			s, err := newSchedule([]string{"* 22-23 * * *", "* 0-5 * * *"}, "UTC",
+				false)
+			c.Assume(err, gs.IsNil)
+			c.Expect(s.active(monday), gs.IsFalse)
+			c.Expect(s.active(monday.Add(14*time.Hour)), gs.IsTrue)
+			c.Expect(s.active(monday.Add(18*time.Hour)), gs.IsTrue)
+		})
+
+		c.Specify("uses its time zone", func() {
+			s, err := newSchedule([]string{"* 9-16 * * *"}, "America/New_York", false)
+			c.Assume(err, gs.IsNil)
+			// 08:30 UTC is 04:30 in New York, 13:30 UTC is 09:30.
+			c.Expect(s.active(monday), gs.IsFalse)
+			c.Expect(s.active(monday.Add(5*time.Hour)), gs.IsTrue)
+		})
+
+		c.Specify("can be inverted", func() {
+			s, err := newSchedule([]string{"* 9-16 * * Mon-Fri"}, "UTC", true)
+			c.Assume(err, gs.IsNil)
+			c.Expect(s.active(monday), gs.IsTrue)
+			c.Expect(s.active(monday.Add(time.Hour)), gs.IsFalse)
+		})
+
+		c.Specify("matches either restricted day field", func() {
+			s, err := newSchedule([]string{"* * 15 * Sun"}, "UTC", false)
+			c.Assume(err, gs.IsNil)
+			c.Expect(s.active(monday), gs.IsFalse)
+			c.Expect(s.active(monday.Add(6*24*time.Hour)), gs.IsTrue)
+			c.Expect(s.active(monday.Add(14*24*time.Hour)), gs.IsTrue)
+		})
+
+		c.Specify("supports steps and lists", func() {
+			s, err := newSchedule([]string{"*/15 8,10 * jan-jun 0-7"}, "UTC", false)
+			c.Assume(err, gs.IsNil)
+			c.Expect(s.active(monday), gs.IsTrue)
+			c.Expect(s.active(monday.Add(time.Minute)), gs.IsFalse)
+			c.Expect(s.active(monday.Add(time.Hour)), gs.IsFalse)
+			c.Expect(s.active(monday.Add(2*time.Hour)), gs.IsTrue)
+		})
+
+		c.Specify("rejects invalid windows", func() {
+			for _, spec := range []string{"* * * *", "60 * * * *", "* 5-2 * * *",
+				"* * * * Funday", "*/0 * * * *"} {
+
+				_, err := newSchedule([]string{spec}, "UTC", false)
+				c.Expect(err, gs.Not(gs.IsNil))
+			}
+			_, err := newSchedule([]string{"* * * * *"}, "Nowhere/Special", false)
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+	})
+}
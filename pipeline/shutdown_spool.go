@@ -0,0 +1,94 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	proto "code.google.com/p/gogoprotobuf/proto"
+	"github.com/mozilla-services/heka/client"
+)
+
+// Directory, relative to the base dir, that the messages still in flight
+// when a shutdown times out are spooled to.
+const SHUTDOWN_SPOOL_DIR = "shutdown_spool"
+
+// Returns the packs that have been routed but not yet recycled by all of the
+// plugins they were handed to.
+func inFlightPacks(trackers ...*DiagnosticTracker) (packs []*PipelinePack) {
+	for _, tracker := range trackers {
+		for _, pack := range tracker.packs {
+			pack.diagnostics.rwmutex.RLock()
+			routed := len(pack.diagnostics.lastPlugins) > 0
+			pack.diagnostics.rwmutex.RUnlock()
+			if routed {
+				packs = append(packs, pack)
+			}
+		}
+	}
+	return
+}
+
+// Writes the messages still in flight to a new file in the shutdown spool
+// directory, w/ Heka stream framing, so they can be replayed w/ a
+// LogstreamerInput using the HekaFramingSplitter and the ProtobufDecoder.
+// The plugins holding the packs may still be running, so this is a best
+// effort. Returns the file's path, or "" if nothing was in flight.
+func (pc *PipelineConfig) spoolInFlight(packs []*PipelinePack) (path string,
+	err error) {
+
+	if len(packs) == 0 {
+		return "", nil
+	}
+	dir := pc.Globals.PrependBaseDir(SHUTDOWN_SPOOL_DIR)
+	if err = os.MkdirAll(dir, 0700); err != nil {
+		return "", fmt.Errorf("can't create shutdown spool directory: %s", err)
+	}
+	path = filepath.Join(dir, fmt.Sprintf("%d.log", time.Now().UnixNano()))
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return "", fmt.Errorf("can't create shutdown spool: %s", err)
+	}
+	var (
+		msgBytes []byte
+		framed   []byte
+	)
+	for _, pack := range packs {
+		if pack.TrustMsgBytes {
+			msgBytes = pack.MsgBytes
+		} else if msgBytes, err = proto.Marshal(pack.Message); err != nil {
+			break
+		}
+		if err = client.CreateHekaStream(msgBytes, &framed, nil); err != nil {
+			break
+		}
+		if _, err = file.Write(framed); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if e := file.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		return path, fmt.Errorf("can't write shutdown spool '%s': %s", path, err)
+	}
+	return path, nil
+}
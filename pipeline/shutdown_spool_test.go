@@ -0,0 +1,96 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	proto "code.google.com/p/gogoprotobuf/proto"
+	"github.com/mozilla-services/heka/message"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+)
+
+func ShutdownSpoolSpec(c gs.Context) {
+	tmpDir, err := ioutil.TempDir("", "spool-tests")
+	c.Assume(err, gs.IsNil)
+	defer os.RemoveAll(tmpDir)
+
+	globals := DefaultGlobals()
+	globals.BaseDir = tmpDir
+	pConfig := NewPipelineConfig(globals)
+
+	c.Specify("The shutdown spool", func() {
+		tracker := NewDiagnosticTracker("input", globals)
+		recycleChan := make(chan *PipelinePack, 3)
+		packs := make([]*PipelinePack, 3)
+		for i := range packs {
+			packs[i] = NewPipelinePack(recycleChan)
+			packs[i].Message.SetType("spooled")
+			packs[i].Message.SetPayload(string(rune('a' + i)))
+			tracker.AddPack(packs[i])
+		}
+		// The second pack is still waiting in a recycle channel.
+		runner := &foRunner{pRunnerBase: pRunnerBase{name: "slow"}}
+		packs[0].diagnostics.AddStamp(runner)
+		packs[2].diagnostics.AddStamp(runner)
+
+		c.Specify("only takes the packs that have been routed", func() {
+			inFlight := inFlightPacks(tracker)
+			c.Expect(len(inFlight), gs.Equals, 2)
+			c.Expect(inFlight[0], gs.Equals, packs[0])
+			c.Expect(inFlight[1], gs.Equals, packs[2])
+		})
+
+		c.Specify("writes their messages w/ stream framing", func() {
+			path, err := pConfig.spoolInFlight(inFlightPacks(tracker))
+			c.Expect(err, gs.IsNil)
+			c.Expect(filepath.Dir(path), gs.Equals,
+				filepath.Join(tmpDir, SHUTDOWN_SPOOL_DIR))
+
+			file, err := os.Open(path)
+			c.Assume(err, gs.IsNil)
+			defer file.Close()
+			splitter := &HekaFramingSplitter{}
+			err = splitter.Init(splitter.ConfigStruct())
+			c.Assume(err, gs.IsNil)
+			sRunner := makeSplitterRunner("HekaFramingSplitter", splitter)
+			var payloads []string
+			for {
+				_, record, err := sRunner.GetRecordFromStream(file)
+				if err != nil {
+					break
+				}
+				if len(record) == 0 {
+					continue
+				}
+				msg := new(message.Message)
+				err = proto.Unmarshal(splitter.UnframeRecord(record, nil), msg)
+				c.Expect(err, gs.IsNil)
+				payloads = append(payloads, msg.GetPayload())
+			}
+			c.Expect(len(payloads), gs.Equals, 2)
+			c.Expect(payloads[0], gs.Equals, "a")
+			c.Expect(payloads[1], gs.Equals, "c")
+		})
+
+		c.Specify("writes nothing when nothing is in flight", func() {
+			path, err := pConfig.spoolInFlight(nil)
+			c.Expect(err, gs.IsNil)
+			c.Expect(path, gs.Equals, "")
+		})
+	})
+}
@@ -99,11 +99,11 @@ func NewSplitterRunner(name string, splitter Splitter,
 }
 
 func (sr *sRunner) LogError(err error) {
-	LogError.Printf("Splitter '%s' error: %s", sr.name, err)
+	sr.logLine("Splitter", true, fmt.Sprintf("%s", err))
 }
 
 func (sr *sRunner) LogMessage(msg string) {
-	LogInfo.Printf("Splitter '%s': %s", sr.name, msg)
+	sr.logLine("Splitter", false, msg)
 }
 
 func (sr *sRunner) KeepTruncated() bool {
@@ -251,10 +251,22 @@ func (sr *sRunner) GetRecordFromStream(r io.Reader) (bytesRead int, record []byt
 
 func (sr *sRunner) DeliverRecord(record []byte, del Deliverer) {
 	unframed := record
-	pack := <-sr.ir.InChan()
+	var (
+		pack  *PipelinePack
+		procs procLimiter
+	)
+	if pack = sr.ir.NewPack(); pack == nil {
+		// The pool rejected the record, it's counted in the pool's report.
+		return
+	}
+	if ir, ok := sr.ir.(*iRunner); ok && ir.pConfig != nil {
+		procs = ir.pConfig.inputProcs
+	}
+	procs.acquire()
 	if sr.unframer != nil {
 		unframed = sr.unframer.UnframeRecord(record, pack)
 		if unframed == nil {
+			procs.release()
 			pack.Recycle()
 			return
 		}
@@ -279,6 +291,7 @@ func (sr *sRunner) DeliverRecord(record []byte, del Deliverer) {
 		sr.packDecorator(pack)
 		pack.TrustMsgBytes = false
 	}
+	procs.release()
 	if del == nil {
 		sr.ir.Deliver(pack)
 	} else {
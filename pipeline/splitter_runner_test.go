@@ -25,6 +25,7 @@ import (
 	"io"
 	"io/ioutil"
 	"path/filepath"
+	"testing"
 )
 
 // Dummy reader that will return some data along with the EOF error.
@@ -131,12 +132,12 @@ func SplitterRunnerSpec(c gs.Context) {
 			sr.SetInputRunner(ir)
 			recycleChan := make(chan *PipelinePack, 1)
 			pack := NewPipelinePack(recycleChan)
-			recycleChan <- pack
 			numRecs := 50
-			ir.EXPECT().InChan().Times(numRecs).Return(recycleChan)
+			ir.EXPECT().NewPack().Times(numRecs).Return(pack)
 			delCall := ir.EXPECT().Deliver(pack).Times(numRecs)
 			delCall.Do(func(pack *PipelinePack) {
 				pack.Recycle()
+				<-recycleChan
 			})
 
 			for err == nil {
@@ -285,11 +286,8 @@ func SplitterRunnerSpec(c gs.Context) {
 
 			packSupply := make(chan *PipelinePack, 1)
 			pack := NewPipelinePack(packSupply)
-			packSupply <- pack
 			ir := NewMockInputRunner(ctrl)
-			// ir.EXPECT().InChan().Return(packSupply).Times(numRecs)
-			// ir.EXPECT().Name().Return("foo").Times(numRecs)
-			ir.EXPECT().InChan().Return(packSupply).AnyTimes()
+			ir.EXPECT().NewPack().Return(pack).AnyTimes()
 			ir.EXPECT().Name().Return("foo").AnyTimes()
 
 			incompleteFinal := true
@@ -314,6 +312,7 @@ func SplitterRunnerSpec(c gs.Context) {
 						string(rExpected[:len(rExpected)-1]))
 				}
 				pack.Recycle()
+				<-packSupply
 			})
 			c.Specify("via SplitStream", func() {
 				for err == nil {
@@ -332,3 +331,51 @@ func SplitterRunnerSpec(c gs.Context) {
 
 	})
 }
+
+// Deliverer that decodes each pack w/ a ProtobufDecoder and recycles it, like
+// a synchronously decoding input would.
+type decodingDeliverer struct {
+	decoder *ProtobufDecoder
+}
+
+func (d *decodingDeliverer) Deliver(pack *PipelinePack) {
+	d.decoder.Decode(pack)
+	pack.Recycle()
+}
+
+func (d *decodingDeliverer) DeliverFunc() DeliverFunc {
+	return d.Deliver
+}
+
+func (d *decodingDeliverer) Done() {}
+
+// Measures the TCP / UDP ingest path: splitting a Heka framed protobuf stream
+// into pooled packs and decoding each one. Each op handles the 50 messages
+// in testsupport/multi.dat.
+func BenchmarkSplitAndDecodeProtobuf(b *testing.B) {
+	data, err := ioutil.ReadFile(filepath.Join(".", "testsupport", "multi.dat"))
+	if err != nil {
+		b.Fatal(err)
+	}
+	config := NewPipelineConfig(nil)
+	for i := 0; i < config.Globals.PoolSize; i++ {
+		config.inputRecycleChan <- NewPipelinePack(config.inputRecycleChan)
+	}
+	splitter := &HekaFramingSplitter{}
+	splitter.Init(splitter.ConfigStruct())
+	useMsgBytes := true
+	sr := NewSplitterRunner("HekaFramingSplitter", splitter,
+		CommonSplitterConfig{UseMsgBytes: &useMsgBytes})
+	splitter.SetSplitterRunner(sr)
+	sr.SetInputRunner(&iRunner{pConfig: config})
+	decoder := new(ProtobufDecoder)
+	decoder.SetPipelineConfig(config)
+	decoder.Init(nil)
+	del := &decodingDeliverer{decoder}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		sr.SplitBytes(data, del)
+	}
+}
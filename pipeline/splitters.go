@@ -25,7 +25,9 @@ import (
 	"fmt"
 	"github.com/mozilla-services/heka/message"
 	"hash"
+	"hash/crc32"
 	"regexp"
+	"sync/atomic"
 )
 
 type NullSplitter struct {
@@ -189,10 +191,18 @@ func authenticateMessage(signers map[string]Signer, header *message.Header,
 	return true
 }
 
+// Size of the largest header that only holds a message length, i.e. that
+// isn't signed and doesn't have a checksum.
+const maxBareHeaderSize = 6
+
 type HekaFramingSplitter struct {
 	*HekaFramingSplitterConfig
-	header *message.Header
-	sr     SplitterRunner
+	// Number of records dropped because their checksum didn't match.
+	corruptRecordCount int64
+	header             *message.Header
+	// Reused for decoding the headers of records being authenticated.
+	authHeader *message.Header
+	sr         SplitterRunner
 }
 
 type HekaFramingSplitterConfig struct {
@@ -215,6 +225,7 @@ func (h *HekaFramingSplitter) ConfigStruct() interface{} {
 func (h *HekaFramingSplitter) Init(config interface{}) error {
 	h.HekaFramingSplitterConfig = config.(*HekaFramingSplitterConfig)
 	h.header = &message.Header{}
+	h.authHeader = &message.Header{}
 	return nil
 }
 
@@ -228,6 +239,9 @@ func (h *HekaFramingSplitter) FindRecord(buf []byte) (bytesRead int, record []by
 	if len(buf) < bytesRead+message.HEADER_DELIMITER_SIZE {
 		return // read more data to get the header length byte
 	}
+	if message.IsFramingV2(buf[bytesRead:]) {
+		return h.findRecordV2(buf, bytesRead)
+	}
 	headerLength := int(buf[bytesRead+1])
 	headerEnd := bytesRead + headerLength + message.HEADER_FRAMING_SIZE
 	if len(buf) < headerEnd {
@@ -255,24 +269,98 @@ func (h *HekaFramingSplitter) FindRecord(buf []byte) (bytesRead int, record []by
 	return bytesRead, record
 }
 
+// Finds a version 2 record starting at buf[start].
+func (h *HekaFramingSplitter) findRecordV2(buf []byte, start int) (
+	bytesRead int, record []byte) {
+
+	messageStart, err := message.DecodeHeaderV2(buf[start:], h.header)
+	if err != nil {
+		h.sr.LogError(err)
+		h.header.Reset()
+		bytesRead = start + 1 // advance over the current record separator
+		n, record := h.FindRecord(buf[bytesRead:])
+		return bytesRead + n, record
+	}
+	if messageStart == 0 {
+		return start, nil // read more data to get the remainder of the header
+	}
+	messageEnd := start + messageStart + int(h.header.GetMessageLength())
+	if len(buf) < messageEnd {
+		return start, nil // read more data to get the remainder of the message
+	}
+	h.header.Reset()
+	return messageEnd, buf[start:messageEnd]
+}
+
+func (h *HekaFramingSplitter) unframeRecordV2(framed []byte, pack *PipelinePack) []byte {
+	header := h.authHeader
+	header.Reset()
+	messageStart, err := message.DecodeHeaderV2(framed, header)
+	if err != nil {
+		h.sr.LogError(err)
+		return nil
+	}
+	if message.IsHandshake(header) {
+		// Handshakes are answered by the input, they don't carry a message.
+		return nil
+	}
+	unframed := framed[messageStart:]
+	if !h.checksumMatches(header, unframed) {
+		return nil
+	}
+	if !h.SkipAuth {
+		if !authenticateMessage(h.Signers, header, unframed) {
+			return nil
+		}
+		pack.Signer = header.GetHmacSigner()
+	}
+	return unframed
+}
+
+// Returns false, counting the record as corrupt, if the header has a message
+// checksum and it doesn't match the message.
+func (h *HekaFramingSplitter) checksumMatches(header *message.Header, msg []byte) bool {
+	if header.MessageCrc32 == nil || header.GetMessageCrc32() == crc32.ChecksumIEEE(msg) {
+		return true
+	}
+	atomic.AddInt64(&h.corruptRecordCount, 1)
+	return false
+}
+
 func (h *HekaFramingSplitter) UnframeRecord(framed []byte, pack *PipelinePack) []byte {
-	headerLen := int(framed[1]) + message.HEADER_FRAMING_SIZE
+	if message.IsFramingV2(framed) {
+		return h.unframeRecordV2(framed, pack)
+	}
+	headerSize := int(framed[1])
+	headerLen := headerSize + message.HEADER_FRAMING_SIZE
 	unframed := framed[headerLen:]
-	if !h.SkipAuth && headerLen > message.UUID_SIZE {
-		header := &message.Header{}
+	// Headers that only hold the message length don't need decoding.
+	if headerSize > maxBareHeaderSize {
+		header := h.authHeader
+		header.Reset()
 		decoded, err := message.DecodeHeader(framed[2:headerLen], header)
 		if err != nil {
 			h.sr.LogError(err)
 		}
-		if decoded && authenticateMessage(h.Signers, header, unframed) {
-			pack.Signer = header.GetHmacSigner()
-		} else {
+		if !decoded || !h.checksumMatches(header, unframed) {
 			return nil
 		}
+		if !h.SkipAuth {
+			if !authenticateMessage(h.Signers, header, unframed) {
+				return nil
+			}
+			pack.Signer = header.GetHmacSigner()
+		}
 	}
 	return unframed
 }
 
+func (h *HekaFramingSplitter) ReportMsg(msg *message.Message) error {
+	message.NewInt64Field(msg, "CorruptRecordCount",
+		atomic.LoadInt64(&h.corruptRecordCount), "count")
+	return nil
+}
+
 func init() {
 	RegisterPlugin("NullSplitter", func() interface{} {
 		return &NullSplitter{}
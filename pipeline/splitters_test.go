@@ -21,6 +21,7 @@ import (
 	"crypto/hmac"
 	"crypto/md5"
 	"crypto/sha1"
+	"github.com/mozilla-services/heka/client"
 	"github.com/mozilla-services/heka/message"
 	ts "github.com/mozilla-services/heka/pipeline/testsupport"
 	gs "github.com/rafrombrc/gospec/src/gospec"
@@ -336,6 +337,99 @@ func HekaFramingSpec(c gs.Context) {
 			c.Expect(string(record), gs.Equals, string(b[5:]))
 		})
 
+		c.Specify("splits v2 framed records mixed w/ v1 records", func() {
+			msg := ts.GetTestMessage()
+			mbytes, _ := proto.Marshal(msg)
+			var v1, v2 []byte
+			c.Assume(client.CreateHekaStream(mbytes, &v1, nil), gs.IsNil)
+			c.Assume(client.CreateHekaStreamV2(mbytes, &v2, nil), gs.IsNil)
+			c.Expect(message.FramedMessageStart(v2), gs.Equals, len(v2)-len(mbytes))
+
+			// Corrupt the header checksum of a copy of the v2 record.
+			corrupt := append([]byte{}, v2...)
+			corrupt[message.FramedMessageStart(v2)-1] ^= 0xff
+
+			var b []byte
+			b = append(b, v2...)
+			b = append(b, v1...)
+			b = append(b, corrupt...)
+			b = append(b, v2...)
+			reader := bytes.NewReader(b)
+			err := splitter.Init(config)
+			c.Assume(err, gs.IsNil)
+
+			_, record, err := sRunner.GetRecordFromStream(reader)
+			c.Expect(err, gs.IsNil)
+			c.Expect(string(record), gs.Equals, string(v2))
+			_, record, err = sRunner.GetRecordFromStream(reader)
+			c.Expect(err, gs.IsNil)
+			c.Expect(string(record), gs.Equals, string(v1))
+			_, record, err = sRunner.GetRecordFromStream(reader)
+			c.Expect(err, gs.IsNil)
+			c.Expect(string(record), gs.Equals, string(v2)) // skips the corrupt record
+
+			pack := NewPipelinePack(nil)
+			unframed := splitter.UnframeRecord(record, pack)
+			c.Expect(string(unframed), gs.Equals, string(mbytes))
+		})
+
+		c.Specify("authenticates v2 framed records", func() {
+			config.Signers = map[string]Signer{"test_1": {"testkey"}}
+			err := splitter.Init(config)
+			c.Assume(err, gs.IsNil)
+			mbytes, _ := proto.Marshal(ts.GetTestMessage())
+			msc := &message.MessageSigningConfig{Name: "test", Key: "testkey",
+				Version: 1}
+			var framed []byte
+			c.Assume(client.CreateHekaStreamV2(mbytes, &framed, msc), gs.IsNil)
+
+			pack := NewPipelinePack(nil)
+			unframed := splitter.UnframeRecord(framed, pack)
+			c.Expect(pack.Signer, gs.Equals, "test")
+			c.Expect(string(unframed), gs.Equals, string(mbytes))
+
+			msc.Key = "wrongkey"
+			c.Assume(client.CreateHekaStreamV2(mbytes, &framed, msc), gs.IsNil)
+			pack.Signer = ""
+			unframed = splitter.UnframeRecord(framed, pack)
+			c.Expect(pack.Signer, gs.Equals, "")
+			c.Expect(string(unframed), gs.Equals, "")
+		})
+
+		c.Specify("discards handshake records", func() {
+			err := splitter.Init(config)
+			c.Assume(err, gs.IsNil)
+			handshake, err := message.AppendHandshake(nil, message.SCHEMA_VERSION)
+			c.Assume(err, gs.IsNil)
+			reader := bytes.NewReader(handshake)
+			_, record, err := sRunner.GetRecordFromStream(reader)
+			c.Expect(err, gs.IsNil)
+			c.Expect(string(record), gs.Equals, string(handshake))
+			unframed := splitter.UnframeRecord(record, NewPipelinePack(nil))
+			c.Expect(string(unframed), gs.Equals, "")
+		})
+
+		c.Specify("drops records w/ a bad message checksum", func() {
+			err := splitter.Init(config)
+			c.Assume(err, gs.IsNil)
+			mbytes, _ := proto.Marshal(ts.GetTestMessage())
+			pack := NewPipelinePack(nil)
+
+			for _, version := range []int{1, 2} {
+				var framed []byte
+				opts := client.FramingOptions{Version: version, Checksum: true}
+				err = client.CreateFramedRecord(mbytes, &framed, opts)
+				c.Assume(err, gs.IsNil)
+				unframed := splitter.UnframeRecord(framed, pack)
+				c.Expect(string(unframed), gs.Equals, string(mbytes))
+
+				framed[len(framed)-1] ^= 0xff
+				unframed = splitter.UnframeRecord(framed, pack)
+				c.Expect(string(unframed), gs.Equals, "")
+			}
+			c.Expect(splitter.corruptRecordCount, gs.Equals, int64(2))
+		})
+
 		c.Specify("using authentication", func() {
 			key := "testkey"
 			config.Signers = map[string]Signer{"test_1": {key}}
@@ -52,7 +52,6 @@ type StatAccumInput struct {
 	config   *StatAccumInputConfig
 	ir       InputRunner
 	tickChan <-chan time.Time
-	inChan   chan *PipelinePack
 	stopChan chan bool
 }
 
@@ -146,7 +145,6 @@ func (sm *StatAccumInput) Run(ir InputRunner, h PluginHelper) (err error) {
 	)
 
 	sm.ir = ir
-	sm.inChan = ir.InChan()
 	sm.tickChan = ir.Ticker()
 	ok := true
 	for ok {
@@ -206,7 +204,11 @@ func (sm *StatAccumInput) Flush() {
 	now := time.Now().UTC()
 	nowUnix := now.Unix()
 	buffer := bytes.NewBufferString("")
-	pack := <-sm.inChan
+	pack := sm.ir.NewPack()
+	if pack == nil {
+		sm.ir.LogError(errors.New("no pack available, flushing w/ the next interval"))
+		return
+	}
 
 	rootNs := NewRootNamespace()
 
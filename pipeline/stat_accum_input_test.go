@@ -69,8 +69,6 @@ func StatAccumInputSpec(c gs.Context) {
 			ith.MockHelper = NewMockPluginHelper(ctrl)
 			ith.MockInputRunner = NewMockInputRunner(ctrl)
 			ith.Pack = NewPipelinePack(pConfig.inputRecycleChan)
-			ith.PackSupply = make(chan *PipelinePack, 1)
-			ith.PackSupply <- ith.Pack
 
 			tickChan := make(chan time.Time)
 			var inputStarted sync.WaitGroup
@@ -92,7 +90,7 @@ func StatAccumInputSpec(c gs.Context) {
 				}()
 			}
 
-			ith.MockInputRunner.EXPECT().InChan().Return(ith.PackSupply)
+			ith.MockInputRunner.EXPECT().NewPack().Return(ith.Pack).AnyTimes()
 			ith.MockInputRunner.EXPECT().Name().Return("StatAccumInput").AnyTimes()
 
 			injectCall := ith.MockInputRunner.EXPECT().Inject(ith.Pack)
@@ -210,7 +208,6 @@ func StatAccumInputSpec(c gs.Context) {
 
 					injectCalled.Wait()
 					ith.Pack.Recycle()
-					ith.PackSupply <- ith.Pack
 					ith.MockInputRunner.EXPECT().Inject(ith.Pack)
 
 					msg, err := finalizeSendingStats()
@@ -236,7 +233,6 @@ func StatAccumInputSpec(c gs.Context) {
 
 					sendTimer("sample2.timer", 10, 20)
 					ith.Pack.Recycle()
-					ith.PackSupply <- ith.Pack
 					ith.MockInputRunner.EXPECT().Inject(ith.Pack)
 					msg, err := finalizeSendingStats()
 					c.Assume(err, gs.IsNil)
@@ -376,8 +372,7 @@ func StatAccumInputSpec(c gs.Context) {
 					injectCalled.Wait()
 					validateMsgPayload(ith.Pack.Message)
 
-					// Prep pack and EXPECTS for the close.
-					ith.PackSupply <- ith.Pack
+					// Prep EXPECTS for the close.
 					ith.MockInputRunner.EXPECT().Inject(ith.Pack)
 
 					close(statAccumInput.statChan)
@@ -0,0 +1,130 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Directory, relative to the base_dir, that filter state is saved in.
+const STATE_DIR = "filter_state"
+
+// Can be implemented by filters that keep state, such as counters or
+// deduplication windows, that should survive a restart of the filter or of
+// Heka. When the filter's `preserve_state` setting is true the state is saved
+// when the filter stops and every `state_flush_interval` seconds, and
+// restored before the filter is (re)started.
+type StatefulFilter interface {
+	// Returns the filter's state, along w/ the version of the format it's
+	// in. Called from a goroutine other than the one running the filter, so
+	// access to the state must be synchronized.
+	SaveState() (version uint, data []byte, err error)
+	// Restores state returned by an earlier SaveState call, possibly by a
+	// previous version of the filter; the version allows older formats to
+	// be upgraded or rejected. Called before the filter's Run method. If an
+	// error is returned the filter starts w/o any saved state.
+	RestoreState(version uint, data []byte) error
+}
+
+// Saves and restores a StatefulFilter's state to and from a file.
+type stateStore struct {
+	path   string
+	filter StatefulFilter
+}
+
+func newStateStore(globals *GlobalConfigStruct, name string,
+	filter StatefulFilter) *stateStore {
+
+	return &stateStore{
+		path:   filepath.Join(globals.PrependBaseDir(STATE_DIR), name+".state"),
+		filter: filter,
+	}
+}
+
+// Writes the filter's current state to disk. The file is replaced
+// atomically, so a crash while saving leaves the previous state intact.
+func (s *stateStore) save() error {
+	version, data, err := s.filter.SaveState()
+	if err != nil {
+		return fmt.Errorf("can't save state: %s", err)
+	}
+	if err = os.MkdirAll(filepath.Dir(s.path), 0700); err != nil {
+		return fmt.Errorf("can't create state directory: %s", err)
+	}
+	buf := bytes.NewBufferString(fmt.Sprintf("%d\n", version))
+	buf.Write(data)
+	tmpPath := s.path + ".tmp"
+	if err = ioutil.WriteFile(tmpPath, buf.Bytes(), 0600); err != nil {
+		return fmt.Errorf("can't write state: %s", err)
+	}
+	if err = os.Rename(tmpPath, s.path); err != nil {
+		return fmt.Errorf("can't replace state file: %s", err)
+	}
+	return nil
+}
+
+// Hands the saved state, if any, to the filter.
+func (s *stateStore) restore() error {
+	contents, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("can't read state: %s", err)
+	}
+	var version uint
+	i := bytes.IndexByte(contents, '\n')
+	if i < 0 {
+		return fmt.Errorf("invalid state file: %s", s.path)
+	}
+	if _, err = fmt.Sscanf(string(contents[:i]), "%d", &version); err != nil {
+		return fmt.Errorf("invalid state file version: %s", s.path)
+	}
+	if err = s.filter.RestoreState(version, contents[i+1:]); err != nil {
+		return fmt.Errorf("can't restore state: %s", err)
+	}
+	return nil
+}
+
+// Saves the state every interval until told to stop, then saves it one last
+// time. Errors are passed to logError.
+func (s *stateStore) flush(interval time.Duration, stop <-chan struct{},
+	logError func(error)) {
+
+	var tick <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		select {
+		case <-tick:
+		case <-stop:
+			if err := s.save(); err != nil {
+				logError(err)
+			}
+			return
+		}
+		if err := s.save(); err != nil {
+			logError(err)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	gs "github.com/rafrombrc/gospec/src/gospec"
+)
+
+func StateStoreSpec(c gs.Context) {
+	tmpDir, err := ioutil.TempDir("", "state-tests")
+	c.Assume(err, gs.IsNil)
+	defer func() {
+		c.Expect(os.RemoveAll(tmpDir), gs.IsNil)
+	}()
+
+	globals := DefaultGlobals()
+	globals.BaseDir = tmpDir
+
+	c.Specify("A stateStore", func() {
+		counter := new(CounterFilter)
+		store := newStateStore(globals, "counter", counter)
+		path := filepath.Join(tmpDir, STATE_DIR, "counter.state")
+
+		c.Specify("does nothing w/o saved state", func() {
+			c.Expect(store.restore(), gs.IsNil)
+			c.Expect(counter.count, gs.Equals, uint(0))
+		})
+
+		c.Specify("restores saved state", func() {
+			counter.count = 42
+			counter.rates = []float64{1.5, 2}
+			c.Expect(store.save(), gs.IsNil)
+			contents, err := ioutil.ReadFile(path)
+			c.Expect(err, gs.IsNil)
+			c.Expect(string(contents), gs.Equals,
+				"1\n{\"count\":42,\"rates\":[1.5,2]}")
+
+			restored := new(CounterFilter)
+			store = newStateStore(globals, "counter", restored)
+			c.Expect(store.restore(), gs.IsNil)
+			c.Expect(restored.count, gs.Equals, uint(42))
+			c.Expect(restored.lastCount, gs.Equals, uint(42))
+			c.Expect(len(restored.rates), gs.Equals, 2)
+		})
+
+		c.Specify("rejects unknown versions", func() {
+			err := os.MkdirAll(filepath.Dir(path), 0700)
+			c.Assume(err, gs.IsNil)
+			err = ioutil.WriteFile(path, []byte("2\n{}"), 0600)
+			c.Assume(err, gs.IsNil)
+			c.Expect(store.restore(), gs.Not(gs.IsNil))
+		})
+
+		c.Specify("saves when stopped", func() {
+			counter.count = 7
+			stop := make(chan struct{})
+			close(stop)
+			store.flush(0, stop, func(err error) {
+				c.Expect(err, gs.IsNil)
+			})
+			c.Expect(store.restore(), gs.IsNil)
+			c.Expect(counter.count, gs.Equals, uint(7))
+		})
+	})
+}
@@ -0,0 +1,212 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mozilla-services/heka/message"
+)
+
+// Sources a message's tenant can be derived from.
+const (
+	TENANT_SOURCE_SIGNER = "signer"
+	TENANT_SOURCE_FIELD  = "field"
+)
+
+// Checks that the provided tenant source is empty, which disables tenancy,
+// or one of the TENANT_SOURCE_* values.
+func ValidTenantSource(source string) error {
+	switch source {
+	case "", TENANT_SOURCE_SIGNER, TENANT_SOURCE_FIELD:
+		return nil
+	}
+	return fmt.Errorf("`tenant_source` must be '%s' or '%s', got %s",
+		TENANT_SOURCE_SIGNER, TENANT_SOURCE_FIELD, source)
+}
+
+// Per tenant counters.
+type tenantStats struct {
+	processMessageCount int64
+	quotaDropCount      int64
+	// Start of the current one second quota window, in nanoseconds, and the
+	// number of messages accepted during it. Only used by the router
+	// goroutine.
+	windowStart int64
+	windowCount uint
+	// When the tenant's last message was routed, in nanoseconds.
+	lastSeen int64
+}
+
+// Works out which tenant each message belongs to, enforcing the per tenant
+// message rate quota and keeping per tenant metrics.
+type tenantTracker struct {
+	source      string
+	field       string
+	maxRate     uint
+	maxCount    int
+	idleTimeout int64
+	lock        sync.RWMutex
+	stats       map[string]*tenantStats
+	// Shared by the tenants seen while `maxCount` tenants are being tracked.
+	other *tenantStats
+	// When idle tenants were last expired, in nanoseconds. Only used by the
+	// router goroutine.
+	lastExpiry int64
+}
+
+// Returns a tenantTracker for the tenancy settings, or nil if tenancy is
+// disabled.
+func newTenantTracker(globals *GlobalConfigStruct) *tenantTracker {
+	if globals.TenantSource == "" {
+		return nil
+	}
+	field := globals.TenantField
+	if field == "" {
+		field = "tenant"
+	}
+	return &tenantTracker{
+		source:      globals.TenantSource,
+		field:       field,
+		maxRate:     globals.TenantMaxRate,
+		maxCount:    globals.TenantMaxCount,
+		idleTimeout: int64(globals.TenantIdleTimeout),
+		stats:       make(map[string]*tenantStats),
+		other:       new(tenantStats),
+	}
+}
+
+// Returns the tenant of the pack's message, setting it on the pack. Packs
+// injected by a filter already carry the filter's tenant.
+func (t *tenantTracker) tenantOf(pack *PipelinePack) string {
+	if pack.tenant != "" {
+		return pack.tenant
+	}
+	if t.source == TENANT_SOURCE_SIGNER {
+		pack.tenant = pack.Signer
+	} else if val, ok := pack.Message.GetFieldValue(t.field); ok {
+		pack.tenant, _ = val.(string)
+	}
+	return pack.tenant
+}
+
+// Returns the tenant's stats, starting to track the tenant if it's new.
+// Tenants that show up while `maxCount` tenants are tracked get the shared
+// "other" stats, and so share a quota, until idle tenants expire.
+func (t *tenantTracker) getStats(tenant string) *tenantStats {
+	t.lock.RLock()
+	stats, ok := t.stats[tenant]
+	t.lock.RUnlock()
+	if !ok {
+		t.lock.Lock()
+		if stats, ok = t.stats[tenant]; !ok {
+			if t.maxCount > 0 && len(t.stats) >= t.maxCount {
+				stats = t.other
+			} else {
+				stats = new(tenantStats)
+				t.stats[tenant] = stats
+			}
+		}
+		t.lock.Unlock()
+	}
+	return stats
+}
+
+// Stops tracking the tenants that haven't had a message routed in
+// `idleTimeout`, checking at most once per `idleTimeout`. Must only be
+// called from the router goroutine.
+func (t *tenantTracker) expire(now int64) {
+	if t.idleTimeout <= 0 || now-t.lastExpiry < t.idleTimeout {
+		return
+	}
+	t.lastExpiry = now
+	t.lock.Lock()
+	for name, stats := range t.stats {
+		if now-atomic.LoadInt64(&stats.lastSeen) >= t.idleTimeout {
+			delete(t.stats, name)
+		}
+	}
+	t.lock.Unlock()
+}
+
+// Counts the message against its tenant's quota, returning false if the
+// message exceeds it and should be dropped. Messages w/o a tenant aren't
+// subject to a quota. Must only be called from the router goroutine.
+func (t *tenantTracker) allow(tenant string, now int64) bool {
+	t.expire(now)
+	stats := t.getStats(tenant)
+	atomic.StoreInt64(&stats.lastSeen, now)
+	if t.maxRate > 0 && tenant != "" {
+		if now-stats.windowStart >= int64(time.Second) {
+			stats.windowStart = now
+			stats.windowCount = 0
+		}
+		if stats.windowCount >= t.maxRate {
+			atomic.AddInt64(&stats.quotaDropCount, 1)
+			return false
+		}
+		stats.windowCount++
+	}
+	atomic.AddInt64(&stats.processMessageCount, 1)
+	return true
+}
+
+// Generates a report message for each tracked tenant, in name order,
+// followed by one for the untracked tenants if there were any, and hands
+// them to the report channel.
+func (t *tenantTracker) reports(pc *PipelineConfig, reportChan chan *PipelinePack) {
+	t.lock.RLock()
+	names := make([]string, 0, len(t.stats))
+	tracked := make(map[string]*tenantStats, len(t.stats))
+	for name, stats := range t.stats {
+		names = append(names, name)
+		tracked[name] = stats
+	}
+	t.lock.RUnlock()
+	sort.Strings(names)
+
+	for _, name := range names {
+		stats := tracked[name]
+		if name == "" {
+			name = "<none>"
+		}
+		reportChan <- t.reportPack(pc, name, stats)
+	}
+	if atomic.LoadInt64(&t.other.processMessageCount) > 0 ||
+		atomic.LoadInt64(&t.other.quotaDropCount) > 0 {
+
+		reportChan <- t.reportPack(pc, "<other>", t.other)
+	}
+}
+
+func (t *tenantTracker) reportPack(pc *PipelineConfig, name string,
+	stats *tenantStats) *PipelinePack {
+
+	pack := <-pc.reportRecycleChan
+	msg := pack.Message
+	message.NewInt64Field(msg, "ProcessMessageCount",
+		atomic.LoadInt64(&stats.processMessageCount), "count")
+	message.NewInt64Field(msg, "QuotaDropCount",
+		atomic.LoadInt64(&stats.quotaDropCount), "count")
+	msg.SetLogger(HEKA_DAEMON)
+	msg.SetType("heka.tenant-report")
+	message.NewStringField(msg, "name", name)
+	message.NewStringField(msg, "key", "tenants")
+	return pack
+}
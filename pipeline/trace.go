@@ -0,0 +1,79 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/mozilla-services/heka/message"
+)
+
+// Name of the message field listing the plugins a traced message has passed
+// through.
+const ROUTE_FIELD = "heka.route"
+
+// Turns on route tracing for messages matching the provided message matcher
+// spec. Traced messages get the name of each input, decoder, and filter they
+// pass through appended to their `heka.route` field, and the router logs
+// whether or not each filter and output matched them. An empty spec turns
+// tracing off. Must be called before Heka is started.
+func (pc *PipelineConfig) SetTraceMatcher(spec string) (err error) {
+	if spec == "" {
+		pc.traceSpec = nil
+		return
+	}
+	if pc.traceSpec, err = message.CreateMatcherSpecification(spec); err != nil {
+		return fmt.Errorf("invalid trace matcher: %s", err)
+	}
+	LogInfo.Printf("Tracing routes of messages matching: %s", spec)
+	return
+}
+
+// Records that the pack's message passed through the named plugin, if the
+// message is being traced.
+func (pc *PipelineConfig) traceHop(pack *PipelinePack, name string) {
+	if pc == nil || pc.traceSpec == nil {
+		return
+	}
+	pack.DecodeFields()
+	if !pack.traced {
+		if !pc.traceSpec.Match(pack.Message) {
+			return
+		}
+		pack.traced = true
+	}
+	if field := pack.Message.FindFirstField(ROUTE_FIELD); field != nil {
+		field.AddValue(name)
+	} else {
+		message.NewStringField(pack.Message, ROUTE_FIELD, name)
+	}
+	pack.TrustMsgBytes = false
+}
+
+// Returns the hops recorded in the message's `heka.route` field, separated by
+// " -> ".
+func routeString(msg *message.Message) string {
+	field := msg.FindFirstField(ROUTE_FIELD)
+	if field == nil {
+		return ""
+	}
+	return strings.Join(field.GetValueString(), " -> ")
+}
+
+// Logs a trace event for a traced message.
+func logTrace(msg *message.Message, format string, v ...interface{}) {
+	LogInfo.Printf("Trace %s: %s", msg.GetUuidString(), fmt.Sprintf(format, v...))
+}
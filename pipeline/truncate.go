@@ -0,0 +1,139 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"sync/atomic"
+	"unicode/utf8"
+
+	"github.com/mozilla-services/heka/message"
+)
+
+const defaultTruncationMarker = "...[truncated]"
+
+// Limits on the size of the messages an output encodes, from the output's
+// `max_payload_size`, `max_field_size`, and `truncation_marker` settings.
+type sizeGuard struct {
+	maxPayload int
+	maxField   int
+	marker     string
+}
+
+// Returns whether any limit is set.
+func (g sizeGuard) enabled() bool {
+	return g.maxPayload > 0 || g.maxField > 0
+}
+
+// Returns whether msg's payload or any of its string or bytes field values
+// exceed the limits.
+func (g sizeGuard) exceeded(msg *message.Message) bool {
+	if g.maxPayload > 0 && len(msg.GetPayload()) > g.maxPayload {
+		return true
+	}
+	if g.maxField == 0 {
+		return false
+	}
+	for _, f := range msg.Fields {
+		for _, s := range f.ValueString {
+			if len(s) > g.maxField {
+				return true
+			}
+		}
+		for _, b := range f.ValueBytes {
+			if len(b) > g.maxField {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Returns the length s can be cut to so that it, plus the marker, fits in
+// max bytes w/o splitting a UTF-8 sequence. The marker is left off if it
+// doesn't fit on its own.
+func (g sizeGuard) cutLen(s []byte, max int) (n int, marker string) {
+	n, marker = max-len(g.marker), g.marker
+	if n < 0 {
+		n, marker = max, ""
+	}
+	for n > 0 && n < len(s) && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return
+}
+
+func (g sizeGuard) truncateString(s string, max int) string {
+	if len(s) <= max {
+		return s
+	}
+	n, marker := g.cutLen([]byte(s), max)
+	return s[:n] + marker
+}
+
+func (g sizeGuard) truncateBytes(b []byte, max int) []byte {
+	if len(b) <= max {
+		return b
+	}
+	n, marker := g.cutLen(b, max)
+	truncated := make([]byte, n, n+len(marker))
+	copy(truncated, b)
+	return append(truncated, marker...)
+}
+
+// Cuts msg's payload and string and bytes field values down to the limits,
+// ending each truncated value w/ the marker.
+func (g sizeGuard) truncate(msg *message.Message) {
+	if g.maxPayload > 0 {
+		if payload := msg.GetPayload(); len(payload) > g.maxPayload {
+			msg.SetPayload(g.truncateString(payload, g.maxPayload))
+		}
+	}
+	if g.maxField == 0 {
+		return
+	}
+	for _, f := range msg.Fields {
+		for i, s := range f.ValueString {
+			f.ValueString[i] = g.truncateString(s, g.maxField)
+		}
+		for i, b := range f.ValueBytes {
+			f.ValueBytes[i] = g.truncateBytes(b, g.maxField)
+		}
+	}
+}
+
+// Returns a pack holding a truncated copy of pack's message if the message
+// exceeds the output's size limits, or pack itself if it doesn't. The pack's
+// own message is shared w/ the other outputs and is never modified.
+func (foRunner *foRunner) guardSize(pack *PipelinePack) (*PipelinePack, error) {
+	if err := pack.DecodeFields(); err != nil {
+		return nil, err
+	}
+	if !foRunner.sizeGuard.exceeded(pack.Message) {
+		return pack, nil
+	}
+	msg := message.CopyMessage(pack.Message)
+	foRunner.sizeGuard.truncate(msg)
+	truncated := &PipelinePack{
+		Message:      msg,
+		Signer:       pack.Signer,
+		MsgLoopCount: pack.MsgLoopCount,
+		tenant:       pack.tenant,
+	}
+	if err := truncated.EncodeMsgBytes(); err != nil {
+		return nil, err
+	}
+	atomic.AddInt64(&foRunner.truncatedCount, 1)
+	return truncated, nil
+}
@@ -0,0 +1,79 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"strings"
+
+	"github.com/mozilla-services/heka/message"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+)
+
+func TruncateSpec(c gs.Context) {
+	c.Specify("An output's size guard", func() {
+		runner, err := NewFORunner("out", new(StoppingOutput),
+			CommonFOConfig{Matcher: "TRUE"},
+			"TestOutput", 1)
+		c.Assume(err, gs.IsNil)
+		runner.sizeGuard = sizeGuard{maxPayload: 20, maxField: 10, marker: "..."}
+		pack := NewPipelinePack(nil)
+		pack.Message.SetPayload(strings.Repeat("a", 30))
+		message.NewStringField(pack.Message, "short", "abc")
+		message.NewStringField(pack.Message, "long", strings.Repeat("b", 30))
+		f, _ := message.NewField("blob", []byte(strings.Repeat("c", 30)), "")
+		pack.Message.AddField(f)
+
+		c.Specify("truncates a copy of an oversized message", func() {
+			guarded, err := runner.guardSize(pack)
+			c.Expect(err, gs.IsNil)
+			c.Expect(guarded, gs.Not(gs.Equals), pack)
+			c.Expect(guarded.Message.GetPayload(), gs.Equals,
+				strings.Repeat("a", 17)+"...")
+			long, _ := guarded.Message.GetFieldValue("long")
+			c.Expect(long, gs.Equals, strings.Repeat("b", 7)+"...")
+			short, _ := guarded.Message.GetFieldValue("short")
+			c.Expect(short, gs.Equals, "abc")
+			blob, _ := guarded.Message.GetFieldValue("blob")
+			c.Expect(string(blob.([]byte)), gs.Equals, strings.Repeat("c", 7)+"...")
+			c.Expect(len(guarded.MsgBytes), gs.Not(gs.Equals), 0)
+			c.Expect(runner.truncatedCount, gs.Equals, int64(1))
+
+			// The original is shared w/ the other outputs and isn't touched.
+			c.Expect(len(pack.Message.GetPayload()), gs.Equals, 30)
+			long, _ = pack.Message.GetFieldValue("long")
+			c.Expect(len(long.(string)), gs.Equals, 30)
+		})
+
+		c.Specify("passes a message within the limits through", func() {
+			pack.Message.SetPayload("small")
+			pack.Message.Fields = nil
+			guarded, err := runner.guardSize(pack)
+			c.Expect(err, gs.IsNil)
+			c.Expect(guarded, gs.Equals, pack)
+			c.Expect(runner.truncatedCount, gs.Equals, int64(0))
+		})
+
+		c.Specify("doesn't split UTF-8 sequences", func() {
+			guard := sizeGuard{maxPayload: 8, marker: "..."}
+			truncated := guard.truncateString("aé€€€", 8)
+			c.Expect(truncated, gs.Equals, "aé...")
+		})
+
+		c.Specify("drops the marker when it doesn't fit", func() {
+			guard := sizeGuard{maxField: 2, marker: "..."}
+			c.Expect(guard.truncateString("abcdef", 2), gs.Equals, "ab")
+		})
+	})
+}
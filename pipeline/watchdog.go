@@ -0,0 +1,255 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"runtime/pprof"
+	"sort"
+	"strings"
+	"time"
+
+	"code.google.com/p/go-uuid/uuid"
+	"github.com/mozilla-services/heka/message"
+)
+
+// Watches the pack pools for a stalled pipeline, i.e. plugins waiting for a
+// pack while none have been recycled for longer than the stall timeout, and
+// the filters and outputs for ones that haven't taken a message for that
+// long.
+type watchdog struct {
+	pConfig *PipelineConfig
+	timeout time.Duration
+	// Whether we've already reported the current stall.
+	stalled bool
+	// Names of the stalled filters and outputs that have been reported.
+	stalledRunners map[string]bool
+	// Backoff for the restarts of each `stall_restart` plugin.
+	restarts map[string]*RetryHelper
+}
+
+// Checks the pools every second until Heka starts shutting down.
+func (w *watchdog) run() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		if w.pConfig.Globals.IsShuttingDown() {
+			return
+		}
+		w.check(now)
+	}
+}
+
+func (w *watchdog) check(now time.Time) {
+	w.checkRunners(now)
+
+	pool, stalledFor := "input", w.pConfig.inputPool.stalledFor(now)
+	if injectStall := w.pConfig.injectPool.stalledFor(now); injectStall > stalledFor {
+		pool, stalledFor = "inject", injectStall
+	}
+	if stalledFor < w.timeout {
+		w.stalled = false
+		return
+	}
+	if w.stalled {
+		return
+	}
+	w.stalled = true
+
+	wedged := w.pConfig.fullRunners()
+	LogError.Printf("Pipeline stalled: no %s packs recycled for %s, full plugins: %s",
+		pool, stalledFor, strings.Join(wedged, ", "))
+	logGoroutines()
+
+	pack := w.alert(now, fmt.Sprintf("no %s packs recycled for %s", pool, stalledFor))
+	message.NewStringField(pack.Message, "Pool", pool)
+	message.NewInt64Field(pack.Message, "StalledFor", stalledFor.Nanoseconds(), "ns")
+	message.NewStringField(pack.Message, "FullPlugins", strings.Join(wedged, ","))
+	w.inject(pack)
+
+	if w.pConfig.Globals.StallShutdown {
+		LogError.Println("Shutting down due to the stall.")
+		w.pConfig.Globals.ShutDown()
+	}
+}
+
+// Reports the filters and outputs whose matchers have been waiting for room
+// in their channel for longer than the stall timeout, restarting the ones
+// that set `stall_restart`.
+func (w *watchdog) checkRunners(now time.Time) {
+	stalled := make(map[string]bool)
+	for name, runner := range w.pConfig.foRunners() {
+		stalledFor := runner.matcher.stalledFor(now)
+		if stalledFor < w.timeout {
+			continue
+		}
+		stalled[name] = true
+		if w.stalledRunners[name] {
+			continue
+		}
+
+		LogError.Printf("Plugin '%s' stalled: no messages taken for %s", name,
+			stalledFor)
+		logGoroutines()
+		pack := w.alert(now, fmt.Sprintf("'%s' took no messages for %s", name,
+			stalledFor))
+		message.NewStringField(pack.Message, "Plugin", name)
+		message.NewInt64Field(pack.Message, "StalledFor", stalledFor.Nanoseconds(), "ns")
+		w.inject(pack)
+
+		if runner.config.StallRestart {
+			w.restart(runner)
+		}
+	}
+	w.stalledRunners = stalled
+}
+
+// Replaces the wedged runner w/ a new one in the background, once the
+// plugin's `retries` backoff allows it.
+func (w *watchdog) restart(runner *foRunner) {
+	if w.restarts == nil {
+		w.restarts = make(map[string]*RetryHelper)
+	}
+	rh, ok := w.restarts[runner.name]
+	if !ok {
+		var err error
+		if rh, err = NewRetryHelper(runner.config.Retries); err != nil {
+			runner.LogError(fmt.Errorf("can't restart: %s", err))
+			return
+		}
+		w.restarts[runner.name] = rh
+	}
+	go func() {
+		if err := rh.Wait(); err != nil {
+			runner.LogError(fmt.Errorf("can't restart: %s", err))
+			return
+		}
+		if err := w.pConfig.replaceRunner(runner); err != nil {
+			runner.LogError(fmt.Errorf("can't restart: %s", err))
+		}
+	}()
+}
+
+func logGoroutines() {
+	var dump bytes.Buffer
+	pprof.Lookup("goroutine").WriteTo(&dump, 2)
+	LogError.Printf("Goroutine dump:\n%s", dump.String())
+}
+
+// Returns a stall alert. The pools might be empty, so the alert gets a pack
+// of its own.
+func (w *watchdog) alert(now time.Time, payload string) *PipelinePack {
+	pack := NewPipelinePack(nil)
+	pack.overflow = true
+	pack.Message.SetUuid(uuid.NewRandom())
+	pack.Message.SetTimestamp(now.UnixNano())
+	pack.Message.SetLogger(HEKA_DAEMON)
+	pack.Message.SetType("heka.stall")
+	pack.Message.SetHostname(w.pConfig.hostname)
+	pack.Message.SetPid(w.pConfig.pid)
+	pack.Message.SetPayload(payload)
+	pack.RefCount = 1
+	return pack
+}
+
+// Injects the alert in the background in case the router is wedged too.
+func (w *watchdog) inject(pack *PipelinePack) {
+	go func() {
+		w.pConfig.router.InChan() <- pack
+	}()
+}
+
+// Returns the running filters and outputs, by name.
+func (pc *PipelineConfig) foRunners() map[string]*foRunner {
+	runners := make(map[string]*foRunner)
+	pc.filtersLock.RLock()
+	for name, runner := range pc.FilterRunners {
+		if fr, ok := runner.(*foRunner); ok && fr.matcher != nil {
+			runners[name] = fr
+		}
+	}
+	pc.filtersLock.RUnlock()
+	pc.outputsLock.RLock()
+	for name, runner := range pc.OutputRunners {
+		if fr, ok := runner.(*foRunner); ok && fr.matcher != nil {
+			runners[name] = fr
+		}
+	}
+	pc.outputsLock.RUnlock()
+	return runners
+}
+
+// Gives up on a wedged filter or output and starts a new instance from its
+// config in its place. The wedged instance's goroutine can't be stopped, it
+// keeps the packs it's holding until its plugin returns, but the router
+// drops its matches from now on and hekad doesn't wait for it on shutdown.
+func (pc *PipelineConfig) replaceRunner(runner *foRunner) error {
+	if _, ok := runner.plugin.(Restarting); !ok {
+		return errors.New("plugin doesn't support restarting")
+	}
+	category, wg := "Filter", &pc.filtersWg
+	if runner.kind == foOutput {
+		category, wg = "Output", &pc.outputsWg
+	}
+	pc.makersLock.RLock()
+	maker := pc.makers[category][runner.name]
+	pc.makersLock.RUnlock()
+	if maker == nil {
+		return errors.New("no config to restart it from")
+	}
+
+	runner.LogMessage("replacing stalled plugin")
+	runner.matcher.abandon()
+	switch runner.kind {
+	case foFilter:
+		if !pc.RemoveFilterRunner(runner.name) {
+			return errors.New("shutting down")
+		}
+	case foOutput:
+		if pc.Globals.IsShuttingDown() {
+			return errors.New("shutting down")
+		}
+		pc.RemoveOutputRunner(runner)
+	}
+	runner.leave(wg)
+	return pc.startReloadable(category, maker)
+}
+
+// Returns the names of the filters and outputs whose input channels are full,
+// which are the likely culprits of a stall.
+func (pc *PipelineConfig) fullRunners() []string {
+	var names []string
+	full := func(name string, runner interface{}) {
+		if fr, ok := runner.(*foRunner); ok && fr.inChan != nil &&
+			cap(fr.inChan) > 0 && len(fr.inChan) == cap(fr.inChan) {
+
+			names = append(names, name)
+		}
+	}
+	pc.filtersLock.RLock()
+	for name, runner := range pc.FilterRunners {
+		full(name, runner)
+	}
+	pc.filtersLock.RUnlock()
+	pc.outputsLock.RLock()
+	for name, runner := range pc.OutputRunners {
+		full(name, runner)
+	}
+	pc.outputsLock.RUnlock()
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,103 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"sync/atomic"
+	"time"
+
+	gs "github.com/rafrombrc/gospec/src/gospec"
+)
+
+func WatchdogSpec(c gs.Context) {
+	c.Specify("A watchdog", func() {
+		pConfig := NewPipelineConfig(nil)
+		dog := &watchdog{pConfig: pConfig, timeout: time.Minute}
+		pool := pConfig.inputPool
+
+		c.Specify("ignores pools nobody's waiting on", func() {
+			dog.check(time.Now().Add(time.Hour))
+			c.Expect(dog.stalled, gs.IsFalse)
+		})
+
+		c.Specify("reports a stall once", func() {
+			got := make(chan *PipelinePack)
+			go func() {
+				got <- pool.get()
+			}()
+			for atomic.LoadInt64(&pool.waiting) == 0 {
+				time.Sleep(time.Millisecond)
+			}
+
+			dog.check(time.Now())
+			c.Expect(dog.stalled, gs.IsFalse)
+
+			dog.check(time.Now().Add(2 * time.Minute))
+			c.Expect(dog.stalled, gs.IsTrue)
+			alert := <-pConfig.router.InChan()
+			c.Expect(alert.Message.GetType(), gs.Equals, "heka.stall")
+			poolName, _ := alert.Message.GetFieldValue("Pool")
+			c.Expect(poolName, gs.Equals, "input")
+
+			dog.check(time.Now().Add(3 * time.Minute))
+			c.Expect(len(pConfig.router.InChan()), gs.Equals, 0)
+
+			pConfig.inputRecycleChan <- NewPipelinePack(pConfig.inputRecycleChan)
+			<-got
+			dog.check(time.Now().Add(4 * time.Minute))
+			c.Expect(dog.stalled, gs.IsFalse)
+		})
+
+		c.Specify("reports a stalled plugin once", func() {
+			mr, err := NewMatchRunner("TRUE", "", nil, 1)
+			c.Assume(err, gs.IsNil)
+			runner := &foRunner{pRunnerBase: pRunnerBase{name: "stuck"}, matcher: mr,
+				kind: foOutput}
+			pConfig.OutputRunners["stuck"] = runner
+			atomic.StoreInt64(&mr.blockedSince, time.Now().UnixNano())
+
+			dog.check(time.Now())
+			c.Expect(len(dog.stalledRunners), gs.Equals, 0)
+
+			dog.check(time.Now().Add(2 * time.Minute))
+			c.Expect(dog.stalledRunners["stuck"], gs.IsTrue)
+			alert := <-pConfig.router.InChan()
+			c.Expect(alert.Message.GetType(), gs.Equals, "heka.stall")
+			plugin, _ := alert.Message.GetFieldValue("Plugin")
+			c.Expect(plugin, gs.Equals, "stuck")
+
+			dog.check(time.Now().Add(3 * time.Minute))
+			c.Expect(len(pConfig.router.InChan()), gs.Equals, 0)
+
+			atomic.StoreInt64(&mr.blockedSince, 0)
+			dog.check(time.Now().Add(4 * time.Minute))
+			c.Expect(len(dog.stalledRunners), gs.Equals, 0)
+		})
+
+		c.Specify("won't replace plugins that can't restart", func() {
+			mr, err := NewMatchRunner("TRUE", "", nil, 1)
+			c.Assume(err, gs.IsNil)
+			runner := &foRunner{pRunnerBase: pRunnerBase{name: "stuck"}, matcher: mr,
+				kind: foOutput}
+			err = pConfig.replaceRunner(runner)
+			c.Expect(err, gs.Not(gs.IsNil))
+			select {
+			case <-mr.abandoned:
+				c.Expect("abandoned", gs.Equals, "not abandoned")
+			default:
+			}
+		})
+	})
+}
@@ -27,6 +27,12 @@ func TestAllSpecs(t *testing.T) {
 	r.AddSpec(ScribbleDecoderSpec)
 	r.AddSpec(PayloadEncoderSpec)
 	r.AddSpec(RstEncoderSpec)
+	r.AddSpec(InterpolateMessageStringSpec)
+	r.AddSpec(LogOutputSpec)
+	r.AddSpec(JsonEncoderSpec)
+	r.AddSpec(JsonDecoderSpec)
+	r.AddSpec(TemplateEncoderSpec)
+	r.AddSpec(FieldNameSanitizerSpec)
 
 	gospec.MainGoTest(r, t)
 }
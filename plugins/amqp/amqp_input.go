@@ -72,6 +72,11 @@ type AMQPInputConfig struct {
 	// Specify whether the user is read-only. The exchange and queue must
 	// already exist. Defaults to false.
 	ReadOnly bool `toml:"read_only"`
+	// Whether each AMQP message should only be acknowledged once all of the
+	// Heka messages generated from it have been fully processed by every
+	// matching filter and output, rather than as soon as it's been read.
+	// Defaults to false.
+	AtLeastOnce bool `toml:"at_least_once"`
 }
 
 type AMQPInput struct {
@@ -178,8 +183,17 @@ func (ai *AMQPInput) Run(ir InputRunner, h PluginHelper) (err error) {
 		return
 	}
 
+	var tracker *DeliveryTracker
 	sRunner := ir.NewSplitterRunner("")
-	if !sRunner.UseMsgBytes() {
+	useMsgBytes := sRunner.UseMsgBytes()
+	if ai.config.AtLeastOnce {
+		sRunner.SetPackDecorator(func(pack *PipelinePack) {
+			if !useMsgBytes {
+				ai.packDecorator(pack)
+			}
+			tracker.Track(pack)
+		})
+	} else if !useMsgBytes {
 		sRunner.SetPackDecorator(ai.packDecorator)
 	}
 
@@ -194,6 +208,20 @@ func (ai *AMQPInput) Run(ir InputRunner, h PluginHelper) (err error) {
 			break
 		}
 
+		if ai.config.AtLeastOnce {
+			delivery := msg
+			tracker = NewDeliveryTracker(func() {
+				if err := delivery.Ack(false); err != nil {
+					ir.LogError(fmt.Errorf("acknowledging message: %s", err))
+				}
+			}, func() {
+				// Requeue the message so the broker redelivers it.
+				if err := delivery.Nack(false, true); err != nil {
+					ir.LogError(fmt.Errorf("rejecting message: %s", err))
+				}
+			})
+		}
+
 		n, e = sRunner.SplitBytes(msg.Body, nil)
 		if e != nil {
 			ir.LogError(fmt.Errorf("processing message of type %s: %s", msg.Type, e.Error()))
@@ -201,7 +229,12 @@ func (ai *AMQPInput) Run(ir InputRunner, h PluginHelper) (err error) {
 		if n > 0 && n != len(msg.Body) {
 			ir.LogError(fmt.Errorf("extra data in message of type %s dropped", msg.Type))
 		}
-		msg.Ack(false)
+		if tracker != nil {
+			// Acks once the generated packs have all been delivered.
+			tracker.Done()
+		} else {
+			msg.Ack(false)
+		}
 	}
 	return nil
 }
@@ -20,6 +20,7 @@ import (
 	"errors"
 	"fmt"
 	. "github.com/mozilla-services/heka/pipeline"
+	"github.com/mozilla-services/heka/plugins"
 	"github.com/mozilla-services/heka/plugins/tcp"
 	"github.com/streadway/amqp"
 	"strings"
@@ -43,7 +44,9 @@ type AMQPOutputConfig struct {
 	// Defaults to auto-delete
 	ExchangeAutoDelete bool `toml:"exchange_auto_delete"`
 	// Routing key for the message to send, or when used for consumer
-	// the routing key to bind the queue to the exchange with
+	// the routing key to bind the queue to the exchange with. May contain
+	// `%{<name>}` placeholders that will be replaced by the value of the
+	// corresponding message header or field (e.g. `logs.%{Logger}`).
 	// Defaults to empty string
 	RoutingKey string `toml:"routing_key"`
 	// Whether messages published should be marked as persistent or
@@ -62,6 +65,13 @@ type AMQPOutputConfig struct {
 	Encoder string
 	// Allows us to use framing by default.
 	UseFraming bool `toml:"use_framing"`
+	// Whether the channel should be put into confirm mode, so that each
+	// message is only considered sent after it's been acked by the broker.
+	// Defaults to false.
+	PublisherConfirms bool `toml:"publisher_confirms"`
+	// How many times a message nacked by the broker is republished before
+	// it's given up on and injected as a dead letter. Defaults to 3.
+	NackRetries int `toml:"nack_retries"`
 }
 
 type AMQPOutput struct {
@@ -79,6 +89,12 @@ type AMQPOutput struct {
 	connWg *sync.WaitGroup
 	// Hold a reference to the connection hub.
 	amqpHub AMQPConnectionHub
+	// Channels that receive broker acks and nacks when publisher confirms
+	// are enabled.
+	ackChan  chan uint64
+	nackChan chan uint64
+	// Whether the routing key contains placeholders needing interpolation.
+	interpKey bool
 }
 
 func (ao *AMQPOutput) ConfigStruct() interface{} {
@@ -90,6 +106,7 @@ func (ao *AMQPOutput) ConfigStruct() interface{} {
 		Encoder:            "ProtobufEncoder",
 		UseFraming:         true,
 		ContentType:        "application/hekad",
+		NackRetries:        3,
 	}
 }
 
@@ -122,10 +139,60 @@ func (ao *AMQPOutput) Init(config interface{}) (err error) {
 		usageWg.Done()
 		return
 	}
+	if conf.PublisherConfirms {
+		if err = ch.Confirm(false); err != nil {
+			usageWg.Done()
+			return fmt.Errorf("can't enable publisher confirms: %s", err)
+		}
+		ao.ackChan, ao.nackChan = ch.NotifyConfirm(make(chan uint64, 1),
+			make(chan uint64, 1))
+	}
+	ao.interpKey = strings.Contains(conf.RoutingKey, "%{")
 	ao.ch = ch
 	return
 }
 
+var errNacked = errors.New("message was nacked by the broker")
+
+// Waits for the broker to ack or nack the most recently published message.
+func (ao *AMQPOutput) waitForConfirm(stopChan chan struct{}) error {
+	select {
+	case <-ao.ackChan:
+		return nil
+	case <-ao.nackChan:
+		return errNacked
+	case <-stopChan:
+		return errors.New("channel closed before message was confirmed")
+	}
+}
+
+// Publishes a message, republishing it if the broker nacks it. A message
+// that still isn't confirmed once the retries have run out is injected as a
+// dead letter. Only returns an error if the channel can't be published to.
+func (ao *AMQPOutput) publish(or OutputRunner, h PluginHelper, routingKey string,
+	msg amqp.Publishing, stopChan chan struct{}) error {
+
+	conf := ao.config
+	for attempt := 0; ; attempt++ {
+		err := ao.ch.Publish(conf.Exchange, routingKey, false, false, msg)
+		if err != nil || !conf.PublisherConfirms {
+			return err
+		}
+		if err = ao.waitForConfirm(stopChan); err == nil {
+			return nil
+		}
+		if err == errNacked && attempt < conf.NackRetries {
+			or.LogError(fmt.Errorf("%s, republishing", err))
+			continue
+		}
+		or.LogError(err)
+		if e := InjectDeadLetter(or, h, msg.Body, err); e != nil {
+			or.LogError(fmt.Errorf("can't inject dead letter: %s", e))
+		}
+		return nil
+	}
+}
+
 func (ao *AMQPOutput) Run(or OutputRunner, h PluginHelper) (err error) {
 	if or.Encoder() == nil {
 		return errors.New("Encoder required.")
@@ -135,11 +202,13 @@ func (ao *AMQPOutput) Run(or OutputRunner, h PluginHelper) (err error) {
 	conf := ao.config
 
 	var (
-		pack     *PipelinePack
-		persist  uint8
-		ok       bool = true
-		amqpMsg  amqp.Publishing
-		outBytes []byte
+		pack       *PipelinePack
+		persist    uint8
+		ok         bool = true
+		amqpMsg    amqp.Publishing
+		outBytes   []byte
+		routingKey string
+		closeErr   *amqp.Error
 	)
 	if conf.Persistent {
 		persist = amqp.Persistent
@@ -151,7 +220,7 @@ func (ao *AMQPOutput) Run(or OutputRunner, h PluginHelper) (err error) {
 	// the AMQP lib w/o deadlocking on our `AMQPChannel.Publish` call.
 	stopChan := make(chan struct{})
 	go func() {
-		<-ao.closeChan
+		closeErr = <-ao.closeChan
 		close(stopChan)
 	}()
 
@@ -171,6 +240,10 @@ func (ao *AMQPOutput) Run(or OutputRunner, h PluginHelper) (err error) {
 				pack.Recycle()
 				continue
 			}
+			routingKey = conf.RoutingKey
+			if ao.interpKey {
+				routingKey = plugins.InterpolateMessageString(routingKey, pack.Message)
+			}
 			pack.Recycle()
 			amqpMsg = amqp.Publishing{
 				DeliveryMode: persist,
@@ -178,9 +251,7 @@ func (ao *AMQPOutput) Run(or OutputRunner, h PluginHelper) (err error) {
 				ContentType:  conf.ContentType,
 				Body:         outBytes,
 			}
-			err = ao.ch.Publish(conf.Exchange, conf.RoutingKey,
-				false, false, amqpMsg)
-			if err != nil {
+			if err = ao.publish(or, h, routingKey, amqpMsg, stopChan); err != nil {
 				ok = false
 			}
 		}
@@ -189,6 +260,11 @@ func (ao *AMQPOutput) Run(or OutputRunner, h PluginHelper) (err error) {
 	ao.amqpHub.Close(conf.URL, ao.connWg)
 	ao.connWg.Wait()
 	<-stopChan
+	// A close error means the broker connection dropped out from under us.
+	// Returning it lets the runner restart the output, which reconnects.
+	if err == nil && closeErr != nil {
+		err = fmt.Errorf("AMQP channel closed: %s", closeErr)
+	}
 	return
 }
 
@@ -185,6 +185,75 @@ func AMQPPluginSpec(c gs.Context) {
 			err = <-errChan
 			c.Expect(err, gs.IsNil)
 		})
+
+		c.Specify("acks only after processing w/ at_least_once", func() {
+			config.AtLeastOnce = true
+			streamChan := make(chan amqp.Delivery, 1)
+			ack := &fakeAcknowledger{
+				acks:  make(chan uint64, 1),
+				nacks: make(chan uint64, 1),
+			}
+			streamChan <- amqp.Delivery{
+				ContentType:  "text/plain",
+				Body:         []byte("This is a message"),
+				Timestamp:    time.Now(),
+				DeliveryTag:  42,
+				Acknowledger: ack,
+			}
+			mch.EXPECT().Consume("", "", false, false, false, false,
+				gomock.Any()).Return(streamChan, nil)
+
+			// Increase the usage since Run decrements it on close.
+			ug.Add(1)
+
+			var decorator func(*PipelinePack)
+			packChan := make(chan *PipelinePack, 1)
+			ith.MockSplitterRunner.EXPECT().UseMsgBytes().Return(false)
+			decCall := ith.MockSplitterRunner.EXPECT().SetPackDecorator(gomock.Any())
+			decCall.Do(func(dec func(*PipelinePack)) {
+				decorator = dec
+			})
+			splitCall := ith.MockSplitterRunner.EXPECT().SplitBytes(gomock.Any(),
+				nil)
+			splitCall.Do(func(recd []byte, del Deliverer) {
+				decorator(ith.Pack)
+				packChan <- ith.Pack
+			})
+			ith.MockSplitterRunner.EXPECT().Done()
+			go func() {
+				err := amqpInput.Run(ith.MockInputRunner, ith.MockHelper)
+				errChan <- err
+			}()
+
+			pack := <-packChan
+			c.Expect(pack.Message.GetType(), gs.Equals, "amqp")
+			tracker := pack.Tracker
+			c.Expect(tracker, gs.Not(gs.IsNil))
+			// Route the pack to an output that acks delivery.
+			tracker.Hold()
+			pack.Recycle()
+			select {
+			case <-ack.acks:
+				c.Expect("acked before delivery", gs.Equals, "")
+			case <-time.After(10 * time.Millisecond):
+			}
+
+			c.Specify("once the output has delivered it", func() {
+				tracker.Done()
+				tag := <-ack.acks
+				c.Expect(tag, gs.Equals, uint64(42))
+			})
+
+			c.Specify("and requeues it if the delivery fails", func() {
+				tracker.Fail()
+				tag := <-ack.nacks
+				c.Expect(tag, gs.Equals, uint64(42))
+				c.Expect(len(ack.acks), gs.Equals, 0)
+			})
+			close(streamChan)
+			err = <-errChan
+			c.Expect(err, gs.IsNil)
+		})
 	})
 
 	c.Specify("An amqp output", func() {
@@ -275,5 +344,120 @@ func AMQPPluginSpec(c gs.Context) {
 			err = <-errChan
 			c.Expect(err, gs.IsNil)
 		})
+
+		c.Specify("publishes w/ an interpolated routing key and confirms", func() {
+			encoder := new(plugins.PayloadEncoder)
+			encoder.Init(encoder.ConfigStruct())
+			payloadBytes, err := encoder.Encode(pack)
+
+			config.RoutingKey = "%{Logger}.%{foo}.%{missing}"
+			config.PublisherConfirms = true
+			oth.MockOutputRunner.EXPECT().Encoder().Return(encoder)
+			oth.MockOutputRunner.EXPECT().Encode(pack).Return(payloadBytes, nil)
+
+			ackChan := make(chan uint64, 1)
+			nackChan := make(chan uint64, 1)
+			mch.EXPECT().Confirm(false).Return(nil)
+			mch.EXPECT().NotifyConfirm(gomock.Any(), gomock.Any()).Return(ackChan,
+				nackChan)
+
+			err = amqpOutput.Init(config)
+			c.Assume(err, gs.IsNil)
+
+			mch.EXPECT().Publish("", "GoSpec.bar.", false, false,
+				gomock.Any()).Return(nil)
+			ackChan <- 1
+			inChan <- pack
+			close(inChan)
+
+			go func() {
+				err := amqpOutput.Run(oth.MockOutputRunner, oth.MockHelper)
+				errChan <- err
+			}()
+			ug.Wait()
+			close(closeChan)
+			err = <-errChan
+			c.Expect(err, gs.IsNil)
+			c.Expect(len(ackChan), gs.Equals, 0)
+		})
+
+		c.Specify("w/ publisher confirms", func() {
+			encoder := new(plugins.PayloadEncoder)
+			encoder.Init(encoder.ConfigStruct())
+			payloadBytes, err := encoder.Encode(pack)
+			config.RoutingKey = "test"
+			config.PublisherConfirms = true
+			config.NackRetries = 1
+			oth.MockOutputRunner.EXPECT().Encoder().Return(encoder)
+			oth.MockOutputRunner.EXPECT().Encode(pack).Return(payloadBytes, nil)
+
+			// Buffered so the broker's replies can be queued up front.
+			ackChan := make(chan uint64, 2)
+			nackChan := make(chan uint64, 2)
+			mch.EXPECT().Confirm(false).Return(nil)
+			mch.EXPECT().NotifyConfirm(gomock.Any(), gomock.Any()).Return(ackChan,
+				nackChan)
+			err = amqpOutput.Init(config)
+			c.Assume(err, gs.IsNil)
+
+			run := func() {
+				inChan <- pack
+				close(inChan)
+				go func() {
+					err := amqpOutput.Run(oth.MockOutputRunner, oth.MockHelper)
+					errChan <- err
+				}()
+				ug.Wait()
+				close(closeChan)
+				err = <-errChan
+				c.Expect(err, gs.IsNil)
+			}
+
+			c.Specify("republishes nacked messages", func() {
+				mch.EXPECT().Publish("", "test", false, false,
+					gomock.Any()).Return(nil).Times(2)
+				oth.MockOutputRunner.EXPECT().LogError(gomock.Any())
+				nackChan <- 1
+				ackChan <- 2
+				run()
+				c.Expect(len(ackChan), gs.Equals, 0)
+				c.Expect(len(nackChan), gs.Equals, 0)
+			})
+
+			c.Specify("gives up on messages nacked too often", func() {
+				mch.EXPECT().Publish("", "test", false, false,
+					gomock.Any()).Return(nil).Times(2)
+				// The retry, the final nack, and the dead letter injection,
+				// which mock runners don't support.
+				oth.MockOutputRunner.EXPECT().LogError(gomock.Any()).Times(3)
+				nackChan <- 1
+				nackChan <- 2
+				run()
+				c.Expect(len(nackChan), gs.Equals, 0)
+			})
+		})
 	})
 }
+
+// Acknowledger that records the delivery tags of acknowledged and requeued
+// messages.
+type fakeAcknowledger struct {
+	acks  chan uint64
+	nacks chan uint64
+}
+
+func (f *fakeAcknowledger) Ack(tag uint64, multiple bool) error {
+	f.acks <- tag
+	return nil
+}
+
+func (f *fakeAcknowledger) Nack(tag uint64, multiple bool, requeue bool) error {
+	if requeue {
+		f.nacks <- tag
+	}
+	return nil
+}
+
+func (f *fakeAcknowledger) Reject(tag uint64, requeue bool) error {
+	return nil
+}
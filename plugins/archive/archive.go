@@ -0,0 +1,223 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+/*
+
+Sidecar indexes for archives of Heka framed protobuf messages, like the ones
+FileOutput writes. An index records the time range, message count, and
+message types of its archive, plus the offset of every Nth record, so readers
+can seek to the part of the archive holding a time range instead of scanning
+all of it.
+
+An index is stored as JSON next to its archive, w/ the IndexSuffix appended
+to the archive's path.
+
+*/
+package archive
+
+import (
+	"code.google.com/p/gogoprotobuf/proto"
+	"encoding/json"
+	"fmt"
+	"github.com/mozilla-services/heka/message"
+	"github.com/mozilla-services/heka/pipeline"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+)
+
+const (
+	IndexVersion = 1
+	IndexSuffix  = ".idx"
+)
+
+// Returns the path of the index for the archive at the provided path.
+func IndexPath(path string) string {
+	return path + IndexSuffix
+}
+
+// A record appended to an archive.
+type Record struct {
+	Timestamp int64
+	Type      string
+	// Size of the framed record in bytes.
+	Size int
+}
+
+// A block of up to `Interval` consecutive records of an archive.
+type Entry struct {
+	// Offset of the block's first record.
+	Offset int64 `json:"offset"`
+	// Number of records before the block.
+	Record       int64 `json:"record"`
+	MinTimestamp int64 `json:"min_timestamp"`
+	MaxTimestamp int64 `json:"max_timestamp"`
+}
+
+type Index struct {
+	Version int `json:"version"`
+	// Number of records in each entry's block.
+	Interval int64 `json:"interval"`
+	// Number of bytes of the archive covered by the index. Records past it
+	// were appended after the index was last written.
+	Size  int64 `json:"size"`
+	Count int64 `json:"count"`
+	// Earliest and latest message timestamps.
+	Start int64 `json:"start"`
+	End   int64 `json:"end"`
+	// Number of messages of each type.
+	Types   map[string]int64 `json:"types"`
+	Entries []Entry          `json:"entries"`
+}
+
+// Creates an empty index w/ an entry every `interval` records.
+func New(interval int64) *Index {
+	return &Index{
+		Version:  IndexVersion,
+		Interval: interval,
+		Start:    math.MaxInt64,
+		End:      math.MinInt64,
+		Types:    make(map[string]int64),
+	}
+}
+
+// Adds a record written at the provided offset. Returns true if the record
+// starts a new entry.
+func (idx *Index) Add(offset int64, rec Record) (newEntry bool) {
+	if idx.Count%idx.Interval == 0 {
+		idx.Entries = append(idx.Entries, Entry{
+			Offset:       offset,
+			Record:       idx.Count,
+			MinTimestamp: rec.Timestamp,
+			MaxTimestamp: rec.Timestamp,
+		})
+		newEntry = true
+	} else {
+		entry := &idx.Entries[len(idx.Entries)-1]
+		if rec.Timestamp < entry.MinTimestamp {
+			entry.MinTimestamp = rec.Timestamp
+		}
+		if rec.Timestamp > entry.MaxTimestamp {
+			entry.MaxTimestamp = rec.Timestamp
+		}
+	}
+	if rec.Timestamp < idx.Start {
+		idx.Start = rec.Timestamp
+	}
+	if rec.Timestamp > idx.End {
+		idx.End = rec.Timestamp
+	}
+	idx.Types[rec.Type]++
+	idx.Count++
+	idx.Size = offset + int64(rec.Size)
+	return
+}
+
+// Returns the part of the archive holding the records w/ a timestamp in
+// [start, end), from the first to the last block the range overlaps. The
+// records past the index's `Size` have to be read as well. If no block
+// overlaps the range both offsets are `Size`.
+func (idx *Index) Range(start, end int64) (from, to int64) {
+	from, to = idx.Size, idx.Size
+	first := -1
+	for i, entry := range idx.Entries {
+		if entry.MaxTimestamp < start || entry.MinTimestamp >= end {
+			continue
+		}
+		if first == -1 {
+			first = i
+			from = entry.Offset
+		}
+		to = idx.Size
+		if i+1 < len(idx.Entries) {
+			to = idx.Entries[i+1].Offset
+		}
+	}
+	return
+}
+
+// Writes the index to the provided path. The index is written to a temporary
+// file first, so readers never see a partial index.
+func (idx *Index) Write(path string) error {
+	contents, err := json.Marshal(idx)
+	if err != nil {
+		return err
+	}
+	tmpPath := path + ".tmp"
+	if err = ioutil.WriteFile(tmpPath, contents, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// Reads the index stored at the provided path.
+func Read(path string) (*Index, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	idx := new(Index)
+	if err = json.Unmarshal(contents, idx); err != nil {
+		return nil, fmt.Errorf("can't parse index '%s': %s", path, err)
+	}
+	if idx.Version != IndexVersion {
+		return nil, fmt.Errorf("unsupported index version: %d", idx.Version)
+	}
+	if idx.Interval < 1 {
+		return nil, fmt.Errorf("invalid index interval: %d", idx.Interval)
+	}
+	if idx.Types == nil {
+		idx.Types = make(map[string]int64)
+	}
+	return idx, nil
+}
+
+// Builds an index for an existing archive by scanning its records. Records
+// that can't be unmarshalled are skipped.
+func Build(r io.Reader, interval int64) (*Index, error) {
+	splitter := &pipeline.HekaFramingSplitter{}
+	if err := splitter.Init(splitter.ConfigStruct()); err != nil {
+		return nil, err
+	}
+	sRunner := pipeline.NewSplitterRunner("HekaFramingSplitter", splitter,
+		pipeline.CommonSplitterConfig{})
+
+	idx := New(interval)
+	msg := new(message.Message)
+	var offset int64
+	for {
+		n, record, err := sRunner.GetRecordFromStream(r)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(record) > 0 {
+			// Skip anything preceding the record.
+			recOffset := offset + int64(n-len(record))
+			if e := proto.Unmarshal(record[message.FramedMessageStart(record):], msg); e == nil {
+				idx.Add(recOffset, Record{
+					Timestamp: msg.GetTimestamp(),
+					Type:      msg.GetType(),
+					Size:      len(record),
+				})
+			}
+		}
+		offset += int64(n)
+	}
+	idx.Size = offset
+	return idx, nil
+}
@@ -0,0 +1,124 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package archive
+
+import (
+	"bytes"
+	"github.com/mozilla-services/heka/client"
+	pipeline_ts "github.com/mozilla-services/heka/pipeline/testsupport"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+func ArchiveSpec(c gs.Context) {
+	c.Specify("An archive index", func() {
+		idx := New(2)
+		// Records of 10 bytes each, w/ out of order timestamps.
+		timestamps := []int64{100, 300, 200, 400, 500}
+		for i, ts := range timestamps {
+			typ := "a"
+			if i%2 == 1 {
+				typ = "b"
+			}
+			idx.Add(int64(i*10), Record{Timestamp: ts, Type: typ, Size: 10})
+		}
+
+		c.Specify("summarizes the records", func() {
+			c.Expect(idx.Count, gs.Equals, int64(5))
+			c.Expect(idx.Size, gs.Equals, int64(50))
+			c.Expect(idx.Start, gs.Equals, int64(100))
+			c.Expect(idx.End, gs.Equals, int64(500))
+			c.Expect(idx.Types["a"], gs.Equals, int64(3))
+			c.Expect(idx.Types["b"], gs.Equals, int64(2))
+		})
+
+		c.Specify("has an entry every interval records", func() {
+			c.Expect(len(idx.Entries), gs.Equals, 3)
+			c.Expect(idx.Entries[1], gs.Equals, Entry{
+				Offset:       20,
+				Record:       2,
+				MinTimestamp: 200,
+				MaxTimestamp: 400,
+			})
+			c.Expect(idx.Entries[2].Offset, gs.Equals, int64(40))
+		})
+
+		c.Specify("finds the blocks overlapping a time range", func() {
+			from, to := idx.Range(250, 350)
+			c.Expect(from, gs.Equals, int64(0))
+			c.Expect(to, gs.Equals, int64(40))
+
+			from, to = idx.Range(350, 450)
+			c.Expect(from, gs.Equals, int64(20))
+			c.Expect(to, gs.Equals, int64(40))
+
+			from, to = idx.Range(450, 1000)
+			c.Expect(from, gs.Equals, int64(40))
+			c.Expect(to, gs.Equals, int64(50))
+
+			from, to = idx.Range(1000, 2000)
+			c.Expect(from, gs.Equals, int64(50))
+			c.Expect(to, gs.Equals, int64(50))
+		})
+
+		c.Specify("is written to and read from a file", func() {
+			tmpDir, err := ioutil.TempDir("", "archive-tests")
+			c.Assume(err, gs.IsNil)
+			defer os.RemoveAll(tmpDir)
+			path := IndexPath(filepath.Join(tmpDir, "archive.log"))
+			c.Expect(filepath.Base(path), gs.Equals, "archive.log.idx")
+
+			err = idx.Write(path)
+			c.Assume(err, gs.IsNil)
+			read, err := Read(path)
+			c.Expect(err, gs.IsNil)
+			c.Expect(read.Count, gs.Equals, idx.Count)
+			c.Expect(read.Size, gs.Equals, idx.Size)
+			c.Expect(read.Types["b"], gs.Equals, int64(2))
+			c.Expect(len(read.Entries), gs.Equals, len(idx.Entries))
+			c.Expect(read.Entries[1], gs.Equals, idx.Entries[1])
+		})
+	})
+
+	c.Specify("Building an index", func() {
+		encoder := client.NewProtobufEncoder(nil)
+		msg := pipeline_ts.GetTestMessage()
+		buf := new(bytes.Buffer)
+		var offsets []int64
+		var framed []byte
+		for i := 0; i < 3; i++ {
+			msg.SetTimestamp(int64(1000 * (i + 1)))
+			err := encoder.EncodeMessageStream(msg, &framed)
+			c.Assume(err, gs.IsNil)
+			offsets = append(offsets, int64(buf.Len()))
+			buf.Write(framed)
+		}
+		size := int64(buf.Len())
+		// Garbage at the end, like a partially written record.
+		buf.WriteString("garbage")
+
+		idx, err := Build(bytes.NewReader(buf.Bytes()), 2)
+		c.Expect(err, gs.IsNil)
+		c.Expect(idx.Count, gs.Equals, int64(3))
+		c.Expect(idx.Size >= size, gs.IsTrue)
+		c.Expect(idx.Start, gs.Equals, int64(1000))
+		c.Expect(idx.End, gs.Equals, int64(3000))
+		c.Expect(idx.Types["TEST"], gs.Equals, int64(3))
+		c.Expect(len(idx.Entries), gs.Equals, 2)
+		c.Expect(idx.Entries[1].Offset, gs.Equals, offsets[2])
+	})
+}
@@ -0,0 +1,407 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package cassandra
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gocql/gocql"
+	"github.com/mozilla-services/heka/message"
+	. "github.com/mozilla-services/heka/pipeline"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Output plugin that writes message data into a Cassandra or ScyllaDB table.
+type CassandraOutput struct {
+	*CassandraOutputConfig
+	cluster             *gocql.ClusterConfig
+	session             *gocql.Session
+	consistency         gocql.Consistency
+	columns             []string
+	keyIndexes          []int
+	insert              string
+	retryHelper         *RetryHelper
+	batch               [][]interface{}
+	processMessageCount int64
+	dropMessageCount    int64
+	reportLock          sync.Mutex
+	// Writes the rows of one partition, swapped out by the tests.
+	writePartition func(rows [][]interface{}) error
+}
+
+// ConfigStruct for CassandraOutput plugin.
+type CassandraOutputConfig struct {
+	// Addresses of the cluster's nodes the driver connects to first.
+	Hosts []string
+	// Keyspace and table the rows are written to.
+	Keyspace string
+	Table    string
+	// Map of column name to the message header or field name its value is
+	// taken from.
+	Columns map[string]string
+	// Columns making up the table's partition key.
+	PartitionKey []string `toml:"partition_key"`
+	// Time to live of the written rows, in seconds. 0 means rows don't
+	// expire.
+	Ttl int
+	// Consistency level of the writes.
+	Consistency string
+	// Whether writes go directly to a replica of their partition.
+	TokenAware bool `toml:"token_aware"`
+	// Credentials for password authentication.
+	Username string
+	Password string
+	// Timeout for connecting and for each write, in milliseconds.
+	Timeout uint32
+	// Number of rows that will trigger a write.
+	BatchSize int `toml:"batch_size"`
+	// Interval at which accumulated rows will be written, in milliseconds.
+	FlushInterval uint32 `toml:"flush_interval"`
+	// What to do when a batch can't be written: "retry" or "drop".
+	OnError string `toml:"on_error"`
+	// Maximum number of retries when `on_error` is "retry". -1 means retry
+	// forever.
+	MaxRetries int `toml:"max_retries"`
+}
+
+var consistencies = map[string]gocql.Consistency{
+	"any":          gocql.Any,
+	"one":          gocql.One,
+	"two":          gocql.Two,
+	"three":        gocql.Three,
+	"quorum":       gocql.Quorum,
+	"all":          gocql.All,
+	"local_quorum": gocql.LocalQuorum,
+	"each_quorum":  gocql.EachQuorum,
+	"local_one":    gocql.LocalOne,
+}
+
+func (o *CassandraOutput) ConfigStruct() interface{} {
+	return &CassandraOutputConfig{
+		Hosts:         []string{"localhost:9042"},
+		Consistency:   "local_quorum",
+		TokenAware:    true,
+		Timeout:       5000,
+		BatchSize:     100,
+		FlushInterval: 1000,
+		OnError:       "retry",
+		MaxRetries:    -1,
+	}
+}
+
+// Quotes a CQL identifier, keeping its case.
+func quoteIdent(ident string) string {
+	return `"` + strings.Replace(ident, `"`, `""`, -1) + `"`
+}
+
+// Generates the INSERT statement.
+func insertStatement(keyspace, table string, columns []string, ttl int) string {
+	quoted := make([]string, len(columns))
+	placeholders := make([]string, len(columns))
+	for i, column := range columns {
+		quoted[i] = quoteIdent(column)
+		placeholders[i] = "?"
+	}
+	stmt := fmt.Sprintf("INSERT INTO %s.%s (%s) VALUES (%s)", quoteIdent(keyspace),
+		quoteIdent(table), strings.Join(quoted, ", "), strings.Join(placeholders, ", "))
+	if ttl > 0 {
+		stmt += fmt.Sprintf(" USING TTL %d", ttl)
+	}
+	return stmt
+}
+
+func (o *CassandraOutput) Init(config interface{}) (err error) {
+	o.CassandraOutputConfig = config.(*CassandraOutputConfig)
+
+	if len(o.Hosts) == 0 {
+		return errors.New("at least one host must be configured")
+	}
+	if o.Keyspace == "" || o.Table == "" {
+		return errors.New("`keyspace` and `table` settings are required")
+	}
+	if len(o.Columns) == 0 {
+		return errors.New("at least one column must be configured")
+	}
+	if o.BatchSize < 1 {
+		return errors.New("`batch_size` must be at least 1")
+	}
+	if o.Ttl < 0 {
+		return errors.New("`ttl` must not be negative")
+	}
+	if o.OnError != "retry" && o.OnError != "drop" {
+		return fmt.Errorf("`on_error` must be 'retry' or 'drop', got %s", o.OnError)
+	}
+	var ok bool
+	if o.consistency, ok = consistencies[strings.ToLower(o.Consistency)]; !ok {
+		return fmt.Errorf("unknown consistency level: %s", o.Consistency)
+	}
+
+	o.columns = make([]string, 0, len(o.Columns))
+	for column := range o.Columns {
+		o.columns = append(o.columns, column)
+	}
+	sort.Strings(o.columns)
+	o.keyIndexes = make([]int, len(o.PartitionKey))
+	for i, key := range o.PartitionKey {
+		idx := sort.SearchStrings(o.columns, key)
+		if idx == len(o.columns) || o.columns[idx] != key {
+			return fmt.Errorf("partition key column '%s' isn't in `columns`", key)
+		}
+		o.keyIndexes[i] = idx
+	}
+	o.insert = insertStatement(o.Keyspace, o.Table, o.columns, o.Ttl)
+
+	o.retryHelper, err = NewRetryHelper(o.retryOptions())
+	if err != nil {
+		return fmt.Errorf("can't create retry helper: %s", err.Error())
+	}
+
+	// The session is created on the first write, so an unavailable cluster
+	// won't prevent Heka from starting.
+	o.cluster = gocql.NewCluster(o.Hosts...)
+	o.cluster.Keyspace = o.Keyspace
+	o.cluster.Consistency = o.consistency
+	o.cluster.Timeout = time.Duration(o.Timeout) * time.Millisecond
+	if o.Username != "" {
+		o.cluster.Authenticator = gocql.PasswordAuthenticator{
+			Username: o.Username,
+			Password: o.Password,
+		}
+	}
+	if o.TokenAware {
+		o.cluster.PoolConfig.HostSelectionPolicy = gocql.TokenAwareHostPolicy(
+			gocql.RoundRobinHostPolicy())
+	}
+	o.writePartition = o.execute
+	return
+}
+
+// Extracts the value for a column from a message. Message headers are
+// referenced by name, e.g. "Timestamp" or "Hostname", anything else is
+// looked up as a dynamic field. Missing fields result in a null.
+func columnValue(msg *message.Message, source string) interface{} {
+	switch source {
+	case "Timestamp":
+		return time.Unix(0, msg.GetTimestamp()).UTC()
+	case "Type":
+		return msg.GetType()
+	case "Logger":
+		return msg.GetLogger()
+	case "Hostname":
+		return msg.GetHostname()
+	case "EnvVersion":
+		return msg.GetEnvVersion()
+	case "Severity":
+		return int(msg.GetSeverity())
+	case "Pid":
+		return int(msg.GetPid())
+	case "Uuid":
+		return msg.GetUuidString()
+	case "Payload":
+		return msg.GetPayload()
+	}
+	if val, ok := msg.GetFieldValue(source); ok {
+		return val
+	}
+	return nil
+}
+
+// Generates the row for a message.
+func (o *CassandraOutput) row(msg *message.Message) ([]interface{}, error) {
+	row := make([]interface{}, len(o.columns))
+	for i, column := range o.columns {
+		row[i] = columnValue(msg, o.Columns[column])
+	}
+	for i, idx := range o.keyIndexes {
+		if row[idx] == nil {
+			return nil, fmt.Errorf("message has no value for partition key column '%s'",
+				o.PartitionKey[i])
+		}
+	}
+	return row, nil
+}
+
+// Splits rows into groups sharing the same partition key, in the order the
+// partitions are first seen. W/o a partition key all rows are one group.
+func (o *CassandraOutput) partitions(rows [][]interface{}) [][][]interface{} {
+	if len(o.keyIndexes) == 0 {
+		return [][][]interface{}{rows}
+	}
+	var groups [][][]interface{}
+	seen := make(map[string]int)
+	parts := make([]string, len(o.keyIndexes))
+	for _, row := range rows {
+		for i, idx := range o.keyIndexes {
+			parts[i] = fmt.Sprintf("%#v", row[idx])
+		}
+		key := strings.Join(parts, "\x00")
+		if i, ok := seen[key]; ok {
+			groups[i] = append(groups[i], row)
+			continue
+		}
+		seen[key] = len(groups)
+		groups = append(groups, [][]interface{}{row})
+	}
+	return groups
+}
+
+// Writes the rows of a single partition, as an unlogged batch if there's
+// more than one. Since all of a batch's rows belong to the same partition
+// the coordinator doesn't have to spread it over the cluster.
+func (o *CassandraOutput) execute(rows [][]interface{}) (err error) {
+	if o.session == nil {
+		if o.session, err = o.cluster.CreateSession(); err != nil {
+			o.session = nil
+			return fmt.Errorf("can't connect to cluster: %s", err)
+		}
+	}
+	if len(rows) == 1 {
+		return o.session.Query(o.insert, rows[0]...).Exec()
+	}
+	b := o.session.NewBatch(gocql.UnloggedBatch)
+	b.Cons = o.consistency
+	for _, row := range rows {
+		b.Query(o.insert, row...)
+	}
+	return o.session.ExecuteBatch(b)
+}
+
+// Writes the current batch, one partition at a time. Partitions that were
+// written are dropped from the batch, so only the failed ones are retried.
+func (o *CassandraOutput) writeBatch() error {
+	groups := o.partitions(o.batch)
+	for i, group := range groups {
+		if err := o.writePartition(group); err != nil {
+			var remaining [][]interface{}
+			for _, g := range groups[i:] {
+				remaining = append(remaining, g...)
+			}
+			o.batch = remaining
+			return fmt.Errorf("write failed: %s", err)
+		}
+		atomic.AddInt64(&o.processMessageCount, int64(len(group)))
+	}
+	o.batch = o.batch[:0]
+	return nil
+}
+
+// Writes the current batch, handling failures according to the `on_error`
+// setting. Returns the error if rows were dropped.
+func (o *CassandraOutput) flush(or OutputRunner) (err error) {
+	if len(o.batch) == 0 {
+		return
+	}
+	o.retryHelper.Reset()
+	for {
+		if err = o.writeBatch(); err == nil {
+			return
+		}
+		if o.OnError != "retry" || o.retryHelper.Wait() != nil {
+			break
+		}
+		or.LogMessage(fmt.Sprintf("%s; retrying", err.Error()))
+	}
+	atomic.AddInt64(&o.dropMessageCount, int64(len(o.batch)))
+	o.batch = o.batch[:0]
+	return
+}
+
+// The output's own retry settings, which a `backoff` section can override.
+func (o *CassandraOutput) retryOptions() RetryOptions {
+	return RetryOptions{
+		MaxDelay:   "30s",
+		Delay:      "250ms",
+		MaxRetries: o.MaxRetries,
+	}
+}
+
+func (o *CassandraOutput) Run(or OutputRunner, h PluginHelper) (err error) {
+	var (
+		ok     = true
+		pack   *PipelinePack
+		row    []interface{}
+		e      error
+		inChan = or.InChan()
+		tick   <-chan time.Time
+	)
+	if o.retryHelper, err = NewRunnerRetryHelper(or, o.retryOptions()); err != nil {
+		return fmt.Errorf("can't create retry helper: %s", err.Error())
+	}
+
+	defer func() {
+		if o.session != nil {
+			o.session.Close()
+			o.session = nil
+		}
+	}()
+
+	if o.FlushInterval > 0 {
+		ticker := time.NewTicker(time.Duration(o.FlushInterval) * time.Millisecond)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	flush := func() {
+		if e := o.flush(or); e != nil {
+			or.LogError(e)
+		}
+	}
+
+	for ok {
+		select {
+		case pack, ok = <-inChan:
+			if !ok {
+				flush()
+				break
+			}
+			row, e = o.row(pack.Message)
+			pack.Recycle()
+			if e != nil {
+				or.LogError(e)
+				atomic.AddInt64(&o.dropMessageCount, 1)
+				continue
+			}
+			if o.batch = append(o.batch, row); len(o.batch) >= o.BatchSize {
+				flush()
+			}
+		case <-tick:
+			flush()
+		}
+	}
+	return
+}
+
+// Satisfies the `pipeline.ReportingPlugin` interface to provide plugin state
+// information to the Heka report and dashboard.
+func (o *CassandraOutput) ReportMsg(msg *message.Message) error {
+	o.reportLock.Lock()
+	defer o.reportLock.Unlock()
+
+	message.NewInt64Field(msg, "ProcessMessageCount",
+		atomic.LoadInt64(&o.processMessageCount), "count")
+	message.NewInt64Field(msg, "DropMessageCount",
+		atomic.LoadInt64(&o.dropMessageCount), "count")
+	return nil
+}
+
+func init() {
+	RegisterPlugin("CassandraOutput", func() interface{} {
+		return new(CassandraOutput)
+	})
+}
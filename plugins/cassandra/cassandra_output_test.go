@@ -0,0 +1,147 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package cassandra
+
+import (
+	"errors"
+	"github.com/gocql/gocql"
+	"github.com/mozilla-services/heka/message"
+	pipeline_ts "github.com/mozilla-services/heka/pipeline/testsupport"
+	plugins_ts "github.com/mozilla-services/heka/plugins/testsupport"
+	"github.com/rafrombrc/gomock/gomock"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+	"time"
+)
+
+func CassandraOutputSpec(c gs.Context) {
+	t := new(pipeline_ts.SimpleT)
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	output := new(CassandraOutput)
+	config := output.ConfigStruct().(*CassandraOutputConfig)
+	config.Keyspace = "metrics"
+	config.Table = "events"
+	config.Columns = map[string]string{
+		"host":   "Hostname",
+		"ts":     "Timestamp",
+		"status": "status",
+	}
+
+	newMsg := func(host string, status int64) *message.Message {
+		msg := pipeline_ts.GetTestMessage()
+		msg.SetHostname(host)
+		field, _ := message.NewField("status", status, "")
+		msg.AddField(field)
+		return msg
+	}
+
+	c.Specify("A CassandraOutput", func() {
+		c.Specify("rejects an unknown consistency level", func() {
+			config.Consistency = "most"
+			err := output.Init(config)
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+
+		c.Specify("requires partition key columns to be mapped", func() {
+			config.PartitionKey = []string{"day"}
+			err := output.Init(config)
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+
+		c.Specify("generates the insert statement", func() {
+			config.Ttl = 86400
+			config.Consistency = "QUORUM"
+			err := output.Init(config)
+			c.Assume(err, gs.IsNil)
+			c.Expect(output.insert, gs.Equals, `INSERT INTO "metrics"."events" `+
+				`("host", "status", "ts") VALUES (?, ?, ?) USING TTL 86400`)
+			c.Expect(output.consistency, gs.Equals, gocql.Quorum)
+		})
+
+		c.Specify("converts messages to rows", func() {
+			err := output.Init(config)
+			c.Assume(err, gs.IsNil)
+			row, err := output.row(newMsg("web1", 200))
+			c.Assume(err, gs.IsNil)
+			c.Expect(row[0], gs.Equals, "web1")
+			c.Expect(row[1], gs.Equals, int64(200))
+			c.Expect(row[2].(time.Time).Unix(), gs.Equals, int64(1136239445))
+		})
+
+		c.Specify("rejects messages w/o a partition key value", func() {
+			config.Columns["day"] = "day"
+			config.PartitionKey = []string{"host", "day"}
+			err := output.Init(config)
+			c.Assume(err, gs.IsNil)
+			_, err = output.row(newMsg("web1", 200))
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+
+		c.Specify("writes batches", func() {
+			config.PartitionKey = []string{"host"}
+			config.MaxRetries = 1
+			err := output.Init(config)
+			c.Assume(err, gs.IsNil)
+
+			var (
+				written [][][]interface{}
+				fail    int
+			)
+			output.writePartition = func(rows [][]interface{}) error {
+				if fail > 0 {
+					fail--
+					return errors.New("write timeout")
+				}
+				written = append(written, rows)
+				return nil
+			}
+			for _, host := range []string{"web1", "web2", "web1"} {
+				row, _ := output.row(newMsg(host, 200))
+				output.batch = append(output.batch, row)
+			}
+			oth := plugins_ts.NewOutputTestHelper(ctrl)
+
+			c.Specify("one partition at a time", func() {
+				err = output.flush(oth.MockOutputRunner)
+				c.Expect(err, gs.IsNil)
+				c.Expect(len(written), gs.Equals, 2)
+				c.Expect(len(written[0]), gs.Equals, 2)
+				c.Expect(written[0][1][0], gs.Equals, "web1")
+				c.Expect(written[1][0][0], gs.Equals, "web2")
+				c.Expect(output.processMessageCount, gs.Equals, int64(3))
+				c.Expect(len(output.batch), gs.Equals, 0)
+			})
+
+			c.Specify("retrying failed writes", func() {
+				fail = 1
+				oth.MockOutputRunner.EXPECT().LogMessage(gomock.Any())
+				err = output.flush(oth.MockOutputRunner)
+				c.Expect(err, gs.IsNil)
+				c.Expect(len(written), gs.Equals, 2)
+				c.Expect(output.processMessageCount, gs.Equals, int64(3))
+			})
+
+			c.Specify("dropping rows once the retries are used up", func() {
+				fail = 2
+				oth.MockOutputRunner.EXPECT().LogMessage(gomock.Any())
+				err = output.flush(oth.MockOutputRunner)
+				c.Expect(err, gs.Not(gs.IsNil))
+				c.Expect(output.dropMessageCount, gs.Equals, int64(3))
+				c.Expect(len(output.batch), gs.Equals, 0)
+			})
+		})
+	})
+}
@@ -0,0 +1,522 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package cloudwatch
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/mozilla-services/heka/message"
+	. "github.com/mozilla-services/heka/pipeline"
+	"github.com/mozilla-services/heka/plugins"
+	"github.com/mozilla-services/heka/plugins/sigv4"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// API limits for a single request.
+	maxMetricsPerRequest = 20
+	maxEventsPerRequest  = 10000
+	maxEventBytes        = 1024 * 1024
+	// Per event overhead counted towards maxEventBytes.
+	eventOverhead = 26
+)
+
+// Units accepted by the CloudWatch API. Field representations matching one
+// of these are used as the metric unit.
+var validUnits = map[string]bool{
+	"Seconds": true, "Microseconds": true, "Milliseconds": true,
+	"Bytes": true, "Kilobytes": true, "Megabytes": true, "Gigabytes": true,
+	"Terabytes": true, "Bits": true, "Kilobits": true, "Megabits": true,
+	"Gigabits": true, "Terabits": true, "Percent": true, "Count": true,
+	"Bytes/Second": true, "Kilobytes/Second": true, "Megabytes/Second": true,
+	"Gigabytes/Second": true, "Terabytes/Second": true, "Bits/Second": true,
+	"Kilobits/Second": true, "Megabits/Second": true, "Gigabits/Second": true,
+	"Terabits/Second": true, "Count/Second": true, "None": true,
+}
+
+// Output plugin that sends numeric message fields to CloudWatch as metrics,
+// and/or message contents to CloudWatch Logs.
+type CloudWatchOutput struct {
+	*CloudWatchOutputConfig
+	creds               *sigv4.Credentials
+	client              *http.Client
+	dimensionNames      []string
+	metrics             map[string][]*metricDatum
+	metricCount         int
+	events              map[logStream][]*logEvent
+	eventCount          int
+	tokens              map[logStream]string
+	now                 func() time.Time
+	processMessageCount int64
+	dropMessageCount    int64
+	reportLock          sync.Mutex
+}
+
+// ConfigStruct for CloudWatchOutput plugin.
+type CloudWatchOutputConfig struct {
+	// AWS region and credentials. If the credentials are empty, the
+	// standard AWS environment variables are used.
+	Region          string
+	AccessKeyId     string `toml:"access_key_id"`
+	SecretAccessKey string `toml:"secret_access_key"`
+	SessionToken    string `toml:"session_token"`
+	// Metric namespace, may contain `%{<name>}` placeholders.
+	Namespace string
+	// Numeric message fields sent as metrics.
+	MetricFields []string `toml:"metric_fields"`
+	// Map of dimension name to value template.
+	Dimensions map[string]string
+	// Log group and stream the messages are sent to. Logs are only sent if
+	// a log group is set. The stream may contain `%{<name>}` placeholders.
+	LogGroup  string `toml:"log_group"`
+	LogStream string `toml:"log_stream"`
+	// Number of metrics and log events that will trigger a flush.
+	FlushCount int `toml:"flush_count"`
+	// Interval at which accumulated data will be sent, in milliseconds.
+	FlushInterval uint32 `toml:"flush_interval"`
+	// HTTP request timeout, in milliseconds. 0 means no timeout.
+	HttpTimeout uint32 `toml:"http_timeout"`
+	// API endpoint overrides, defaulting to the region's endpoints.
+	MetricsEndpoint string `toml:"metrics_endpoint"`
+	LogsEndpoint    string `toml:"logs_endpoint"`
+}
+
+type dimension struct {
+	name  string
+	value string
+}
+
+type metricDatum struct {
+	name       string
+	value      float64
+	unit       string
+	timestamp  time.Time
+	dimensions []dimension
+}
+
+type logStream struct {
+	group  string
+	stream string
+}
+
+type logEvent struct {
+	Timestamp int64  `json:"timestamp"`
+	Message   string `json:"message"`
+}
+
+// Error returned by the CloudWatch Logs API.
+type awsError struct {
+	Type                  string `json:"__type"`
+	Message               string `json:"message"`
+	ExpectedSequenceToken string `json:"expectedSequenceToken"`
+	status                string
+}
+
+func (e *awsError) Error() string {
+	return fmt.Sprintf("%s: %s - %s", e.status, e.Type, e.Message)
+}
+
+func (o *CloudWatchOutput) ConfigStruct() interface{} {
+	return &CloudWatchOutputConfig{
+		Region:        "us-east-1",
+		Namespace:     "Heka",
+		LogStream:     "%{Hostname}",
+		FlushCount:    500,
+		FlushInterval: 1000,
+		HttpTimeout:   10000,
+	}
+}
+
+func (o *CloudWatchOutput) Init(config interface{}) (err error) {
+	o.CloudWatchOutputConfig = config.(*CloudWatchOutputConfig)
+
+	if len(o.MetricFields) == 0 && o.LogGroup == "" {
+		return errors.New("at least one of `metric_fields` or `log_group` must be set")
+	}
+	if o.Region == "" {
+		return errors.New("`region` must not be empty")
+	}
+	if o.Namespace == "" {
+		return errors.New("`namespace` must not be empty")
+	}
+	if o.LogGroup != "" && o.LogStream == "" {
+		return errors.New("`log_stream` must not be empty")
+	}
+
+	o.creds, err = sigv4.NewCredentials(o.AccessKeyId, o.SecretAccessKey, o.SessionToken)
+	if err != nil {
+		return
+	}
+
+	if o.MetricsEndpoint == "" {
+		o.MetricsEndpoint = fmt.Sprintf("https://monitoring.%s.amazonaws.com/", o.Region)
+	}
+	if o.LogsEndpoint == "" {
+		o.LogsEndpoint = fmt.Sprintf("https://logs.%s.amazonaws.com/", o.Region)
+	}
+
+	o.client = new(http.Client)
+	if o.HttpTimeout > 0 {
+		o.client.Timeout = time.Duration(o.HttpTimeout) * time.Millisecond
+	}
+	o.dimensionNames = make([]string, 0, len(o.Dimensions))
+	for name := range o.Dimensions {
+		o.dimensionNames = append(o.dimensionNames, name)
+	}
+	sort.Strings(o.dimensionNames)
+
+	o.metrics = make(map[string][]*metricDatum)
+	o.events = make(map[logStream][]*logEvent)
+	o.tokens = make(map[logStream]string)
+	if o.now == nil {
+		o.now = time.Now
+	}
+	return
+}
+
+// Adds the message's metric fields to the pending metrics. Returns false if
+// the message didn't contain any metrics.
+func (o *CloudWatchOutput) addMetrics(msg *message.Message) bool {
+	var dims []dimension
+	for _, name := range o.dimensionNames {
+		if val := plugins.InterpolateMessageString(o.Dimensions[name], msg); val != "" {
+			dims = append(dims, dimension{name, val})
+		}
+	}
+	namespace := plugins.InterpolateMessageString(o.Namespace, msg)
+	ts := time.Unix(0, msg.GetTimestamp()).UTC()
+	added := false
+	for _, name := range o.MetricFields {
+		field := msg.FindFirstField(name)
+		if field == nil {
+			continue
+		}
+		var value float64
+		switch v := field.GetValue().(type) {
+		case int64:
+			value = float64(v)
+		case float64:
+			value = v
+		default:
+			continue
+		}
+		unit := field.GetRepresentation()
+		if !validUnits[unit] {
+			unit = "None"
+		}
+		o.metrics[namespace] = append(o.metrics[namespace], &metricDatum{
+			name:       name,
+			value:      value,
+			unit:       unit,
+			timestamp:  ts,
+			dimensions: dims,
+		})
+		o.metricCount++
+		added = true
+	}
+	return added
+}
+
+// Adds a log event for the message.
+func (o *CloudWatchOutput) addEvent(msg *message.Message, text string) {
+	key := logStream{o.LogGroup, plugins.InterpolateMessageString(o.LogStream, msg)}
+	o.events[key] = append(o.events[key], &logEvent{
+		Timestamp: msg.GetTimestamp() / int64(time.Millisecond),
+		Message:   text,
+	})
+	o.eventCount++
+}
+
+// Generates the PutMetricData query parameters for a set of metrics.
+func metricParams(namespace string, data []*metricDatum) url.Values {
+	params := url.Values{
+		"Action":    {"PutMetricData"},
+		"Version":   {"2010-08-01"},
+		"Namespace": {namespace},
+	}
+	for i, datum := range data {
+		prefix := fmt.Sprintf("MetricData.member.%d.", i+1)
+		params.Set(prefix+"MetricName", datum.name)
+		params.Set(prefix+"Value", strconv.FormatFloat(datum.value, 'f', -1, 64))
+		params.Set(prefix+"Unit", datum.unit)
+		params.Set(prefix+"Timestamp", datum.timestamp.Format(time.RFC3339))
+		for j, dim := range datum.dimensions {
+			dimPrefix := fmt.Sprintf("%sDimensions.member.%d.", prefix, j+1)
+			params.Set(dimPrefix+"Name", dim.name)
+			params.Set(dimPrefix+"Value", dim.value)
+		}
+	}
+	return params
+}
+
+// Makes a signed request, returning the response body for successful
+// requests.
+func (o *CloudWatchOutput) request(endpoint, service string, headers map[string]string,
+	body []byte) (respBody []byte, status int, err error) {
+
+	req, err := http.NewRequest("POST", endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, 0, fmt.Errorf("can't create HTTP request: %s", err)
+	}
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	sigv4.Sign(req, body, o.creds, o.Region, service, o.now())
+
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return nil, 0, fmt.Errorf("error making HTTP request: %s", err)
+	}
+	defer resp.Body.Close()
+	respBody, err = ioutil.ReadAll(resp.Body)
+	return respBody, resp.StatusCode, err
+}
+
+func (o *CloudWatchOutput) putMetricData(namespace string, data []*metricDatum) error {
+	body := []byte(metricParams(namespace, data).Encode())
+	headers := map[string]string{
+		"Content-Type": "application/x-www-form-urlencoded; charset=utf-8",
+	}
+	respBody, status, err := o.request(o.MetricsEndpoint, "monitoring", headers, body)
+	if err != nil {
+		return err
+	}
+	if status >= 300 {
+		return fmt.Errorf("PutMetricData failed: %d - %s", status,
+			strings.TrimSpace(string(respBody)))
+	}
+	return nil
+}
+
+// Makes a CloudWatch Logs API call. Error responses are returned as an
+// *awsError.
+func (o *CloudWatchOutput) logsCall(action string, in, out interface{}) error {
+	body, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	headers := map[string]string{
+		"Content-Type": "application/x-amz-json-1.1",
+		"X-Amz-Target": "Logs_20140328." + action,
+	}
+	respBody, status, err := o.request(o.LogsEndpoint, "logs", headers, body)
+	if err != nil {
+		return err
+	}
+	if status >= 300 {
+		awsErr := &awsError{status: strconv.Itoa(status)}
+		json.Unmarshal(respBody, awsErr)
+		if i := strings.LastIndex(awsErr.Type, "#"); i != -1 {
+			awsErr.Type = awsErr.Type[i+1:]
+		}
+		if awsErr.ExpectedSequenceToken == "" {
+			const marker = "sequenceToken is: "
+			if i := strings.Index(awsErr.Message, marker); i != -1 {
+				awsErr.ExpectedSequenceToken = strings.TrimSpace(
+					awsErr.Message[i+len(marker):])
+			}
+		}
+		return awsErr
+	}
+	if out != nil {
+		return json.Unmarshal(respBody, out)
+	}
+	return nil
+}
+
+type putLogEventsRequest struct {
+	LogGroupName  string      `json:"logGroupName"`
+	LogStreamName string      `json:"logStreamName"`
+	LogEvents     []*logEvent `json:"logEvents"`
+	SequenceToken string      `json:"sequenceToken,omitempty"`
+}
+
+type putLogEventsResponse struct {
+	NextSequenceToken string `json:"nextSequenceToken"`
+}
+
+type createLogStreamRequest struct {
+	LogGroupName  string `json:"logGroupName"`
+	LogStreamName string `json:"logStreamName"`
+}
+
+// Sends a batch of events to a stream. The sequence token of each stream is
+// tracked, and refreshed from the error response if it's rejected. Streams
+// that don't exist yet are created.
+func (o *CloudWatchOutput) putLogEvents(key logStream, events []*logEvent) (err error) {
+	for attempt := 0; attempt < 3; attempt++ {
+		req := &putLogEventsRequest{
+			LogGroupName:  key.group,
+			LogStreamName: key.stream,
+			LogEvents:     events,
+			SequenceToken: o.tokens[key],
+		}
+		resp := new(putLogEventsResponse)
+		if err = o.logsCall("PutLogEvents", req, resp); err == nil {
+			o.tokens[key] = resp.NextSequenceToken
+			return
+		}
+		awsErr, ok := err.(*awsError)
+		if !ok {
+			return
+		}
+		switch awsErr.Type {
+		case "InvalidSequenceTokenException":
+			o.tokens[key] = awsErr.ExpectedSequenceToken
+		case "DataAlreadyAcceptedException":
+			o.tokens[key] = awsErr.ExpectedSequenceToken
+			return nil
+		case "ResourceNotFoundException":
+			createReq := &createLogStreamRequest{key.group, key.stream}
+			if e := o.logsCall("CreateLogStream", createReq, nil); e != nil {
+				return fmt.Errorf("can't create log stream '%s': %s", key.stream, e)
+			}
+			delete(o.tokens, key)
+		default:
+			return
+		}
+	}
+	return
+}
+
+type eventsByTime []*logEvent
+
+func (e eventsByTime) Len() int           { return len(e) }
+func (e eventsByTime) Less(i, j int) bool { return e[i].Timestamp < e[j].Timestamp }
+func (e eventsByTime) Swap(i, j int)      { e[i], e[j] = e[j], e[i] }
+
+// Sends all pending metrics and log events, split into batches that are
+// within the API limits. Data that can't be sent is dropped.
+func (o *CloudWatchOutput) flush(or OutputRunner) {
+	for namespace, data := range o.metrics {
+		for len(data) > 0 {
+			n := len(data)
+			if n > maxMetricsPerRequest {
+				n = maxMetricsPerRequest
+			}
+			if err := o.putMetricData(namespace, data[:n]); err != nil {
+				or.LogError(err)
+			}
+			data = data[n:]
+		}
+		delete(o.metrics, namespace)
+	}
+	o.metricCount = 0
+
+	for key, events := range o.events {
+		// Events in a single request must be in chronological order.
+		sort.Stable(eventsByTime(events))
+		for len(events) > 0 {
+			n, size := 0, 0
+			for n < len(events) && n < maxEventsPerRequest {
+				eventSize := len(events[n].Message) + eventOverhead
+				if n > 0 && size+eventSize > maxEventBytes {
+					break
+				}
+				size += eventSize
+				n++
+			}
+			if err := o.putLogEvents(key, events[:n]); err != nil {
+				or.LogError(fmt.Errorf("PutLogEvents to '%s' failed: %s", key.stream, err))
+			}
+			events = events[n:]
+		}
+		delete(o.events, key)
+	}
+	o.eventCount = 0
+}
+
+func (o *CloudWatchOutput) Run(or OutputRunner, h PluginHelper) (err error) {
+	var (
+		ok       = true
+		pack     *PipelinePack
+		outBytes []byte
+		e        error
+		inChan   = or.InChan()
+		tick     <-chan time.Time
+	)
+
+	if o.FlushInterval > 0 {
+		ticker := time.NewTicker(time.Duration(o.FlushInterval) * time.Millisecond)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for ok {
+		select {
+		case pack, ok = <-inChan:
+			if !ok {
+				o.flush(or)
+				break
+			}
+			used := false
+			if len(o.MetricFields) > 0 {
+				used = o.addMetrics(pack.Message)
+			}
+			if o.LogGroup != "" {
+				if or.Encoder() == nil {
+					o.addEvent(pack.Message, pack.Message.GetPayload())
+					used = true
+				} else if outBytes, e = or.Encode(pack); e != nil {
+					or.LogError(e)
+				} else if outBytes != nil {
+					o.addEvent(pack.Message, string(outBytes))
+					used = true
+				}
+			}
+			pack.Recycle()
+			if used {
+				atomic.AddInt64(&o.processMessageCount, 1)
+			} else {
+				atomic.AddInt64(&o.dropMessageCount, 1)
+			}
+			if o.metricCount+o.eventCount >= o.FlushCount {
+				o.flush(or)
+			}
+		case <-tick:
+			o.flush(or)
+		}
+	}
+	return
+}
+
+// Satisfies the `pipeline.ReportingPlugin` interface to provide plugin state
+// information to the Heka report and dashboard.
+func (o *CloudWatchOutput) ReportMsg(msg *message.Message) error {
+	o.reportLock.Lock()
+	defer o.reportLock.Unlock()
+
+	message.NewInt64Field(msg, "ProcessMessageCount",
+		atomic.LoadInt64(&o.processMessageCount), "count")
+	message.NewInt64Field(msg, "DropMessageCount",
+		atomic.LoadInt64(&o.dropMessageCount), "count")
+	return nil
+}
+
+func init() {
+	RegisterPlugin("CloudWatchOutput", func() interface{} {
+		return new(CloudWatchOutput)
+	})
+}
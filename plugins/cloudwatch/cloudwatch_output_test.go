@@ -0,0 +1,126 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package cloudwatch
+
+import (
+	"encoding/json"
+	"github.com/mozilla-services/heka/message"
+	pipeline_ts "github.com/mozilla-services/heka/pipeline/testsupport"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+)
+
+func CloudWatchOutputSpec(c gs.Context) {
+	output := new(CloudWatchOutput)
+	config := output.ConfigStruct().(*CloudWatchOutputConfig)
+	config.AccessKeyId = "AKIDEXAMPLE"
+	config.SecretAccessKey = "secret"
+
+	msg := pipeline_ts.GetTestMessage()
+	field, _ := message.NewField("latency", 12.5, "Milliseconds")
+	msg.AddField(field)
+	field, _ = message.NewField("requests", int64(3), "count")
+	msg.AddField(field)
+
+	c.Specify("A CloudWatchOutput", func() {
+		c.Specify("requires metrics or logs", func() {
+			err := output.Init(config)
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+
+		c.Specify("generates metric data", func() {
+			config.Namespace = "Heka/%{Type}"
+			config.MetricFields = []string{"latency", "requests", "foo", "missing"}
+			config.Dimensions = map[string]string{
+				"Host":  "%{Hostname}",
+				"Empty": "%{missing}",
+			}
+			err := output.Init(config)
+			c.Assume(err, gs.IsNil)
+
+			c.Expect(output.addMetrics(msg), gs.IsTrue)
+			c.Expect(output.metricCount, gs.Equals, 2)
+			data := output.metrics["Heka/TEST"]
+			c.Expect(len(data), gs.Equals, 2)
+
+			params := metricParams("Heka/TEST", data)
+			c.Expect(params.Get("Action"), gs.Equals, "PutMetricData")
+			c.Expect(params.Get("Namespace"), gs.Equals, "Heka/TEST")
+			c.Expect(params.Get("MetricData.member.1.MetricName"), gs.Equals, "latency")
+			c.Expect(params.Get("MetricData.member.1.Value"), gs.Equals, "12.5")
+			c.Expect(params.Get("MetricData.member.1.Unit"), gs.Equals, "Milliseconds")
+			c.Expect(params.Get("MetricData.member.1.Timestamp"), gs.Equals,
+				"2006-01-02T22:04:05Z")
+			c.Expect(params.Get("MetricData.member.1.Dimensions.member.1.Name"),
+				gs.Equals, "Host")
+			c.Expect(params.Get("MetricData.member.1.Dimensions.member.1.Value"),
+				gs.Equals, "my.host.name")
+			c.Expect(params.Get("MetricData.member.1.Dimensions.member.2.Name"),
+				gs.Equals, "")
+			c.Expect(params.Get("MetricData.member.2.Unit"), gs.Equals, "None")
+		})
+
+		c.Specify("handles log stream sequence tokens", func() {
+			var targets, tokens []string
+			server := httptest.NewServer(http.HandlerFunc(
+				func(w http.ResponseWriter, r *http.Request) {
+					target := r.Header.Get("X-Amz-Target")
+					targets = append(targets, target)
+					c.Expect(strings.HasPrefix(r.Header.Get("Authorization"),
+						"AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/"), gs.IsTrue)
+					body, _ := ioutil.ReadAll(r.Body)
+					req := new(putLogEventsRequest)
+					json.Unmarshal(body, req)
+
+					switch {
+					case target == "Logs_20140328.CreateLogStream":
+						w.Write([]byte("{}"))
+					case len(targets) == 1:
+						w.WriteHeader(400)
+						w.Write([]byte(`{"__type": "ResourceNotFoundException",` +
+							`"message": "The specified log stream does not exist."}`))
+					case req.SequenceToken == "":
+						tokens = append(tokens, req.SequenceToken)
+						w.WriteHeader(400)
+						w.Write([]byte(`{"__type": "InvalidSequenceTokenException",` +
+							`"message": "The given sequenceToken is invalid. ` +
+							`The next expected sequenceToken is: 123"}`))
+					default:
+						tokens = append(tokens, req.SequenceToken)
+						w.Write([]byte(`{"nextSequenceToken": "456"}`))
+					}
+				}))
+			defer server.Close()
+
+			config.LogGroup = "heka"
+			config.LogsEndpoint = server.URL
+			err := output.Init(config)
+			c.Assume(err, gs.IsNil)
+
+			key := logStream{"heka", "my.host.name"}
+			events := []*logEvent{{Timestamp: 1, Message: "hi"}}
+			err = output.putLogEvents(key, events)
+			c.Expect(err, gs.IsNil)
+			c.Expect(len(targets), gs.Equals, 4)
+			c.Expect(targets[1], gs.Equals, "Logs_20140328.CreateLogStream")
+			c.Expect(len(tokens), gs.Equals, 2)
+			c.Expect(tokens[1], gs.Equals, "123")
+			c.Expect(output.tokens[key], gs.Equals, "456")
+		})
+	})
+}
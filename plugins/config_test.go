@@ -20,6 +20,7 @@
 package plugins
 
 import (
+	"fmt"
 	. "github.com/mozilla-services/heka/pipeline"
 	_ "github.com/mozilla-services/heka/plugins/payload"
 	_ "github.com/mozilla-services/heka/plugins/statsd"
@@ -29,6 +30,7 @@ import (
 	"os"
 	"path/filepath"
 	"runtime"
+	"strings"
 	"sync"
 )
 
@@ -216,6 +218,38 @@ func LoadFromConfigSpec(c gs.Context) {
 				gs.Values("No registered plugin type: CounterOutput"))
 		})
 
+		c.Specify("checks a config w/o starting any plugins", func() {
+			err := pipeConfig.PreloadFromConfigFile("./testsupport/config_check_test.toml")
+			c.Assume(err, gs.IsNil)
+			err = pipeConfig.CheckConfig()
+			c.Assume(err, gs.Not(gs.IsNil))
+			c.Expect(err.Error(), gs.Equals, "2 errors in config")
+			c.Expect(pipeConfig.LogMsgs, gs.ContainsAny,
+				gs.Values("[bad_input]: decoder 'MissingDecoder' isn't configured"))
+			found := false
+			for _, msg := range pipeConfig.LogMsgs {
+				if strings.HasPrefix(msg, "[bad_matcher]: invalid message matcher") {
+					found = true
+				}
+			}
+			c.Expect(found, gs.IsTrue)
+			c.Expect(len(pipeConfig.InputRunners), gs.Equals, 0)
+			c.Expect(len(pipeConfig.OutputRunners), gs.Equals, 0)
+		})
+
+		c.Specify("errors on duplicate section names", func() {
+			fName := "./testsupport/config_bad_outputs.toml"
+			err := pipeConfig.PreloadFromConfigFile(fName)
+			c.Assume(err, gs.IsNil)
+			err = pipeConfig.PreloadFromConfigFile(fName)
+			c.Assume(err, gs.IsNil)
+			err = pipeConfig.LoadConfig()
+			c.Assume(err, gs.Not(gs.IsNil))
+			c.Expect(pipeConfig.LogMsgs, gs.ContainsAny,
+				gs.Values(fmt.Sprintf("Duplicate config section [udp_stats] in %s, "+
+					"already loaded from %s", fName, fName)))
+		})
+
 		c.Specify("handles missing config file correctly", func() {
 			err := pipeConfig.PreloadFromConfigFile("no_such_file.toml")
 			c.Assume(err, gs.Not(gs.IsNil))
@@ -236,6 +270,38 @@ func LoadFromConfigSpec(c gs.Context) {
 			c.Expect(msg, ts.StringContains, "No registered plugin type:")
 		})
 
+		c.Specify("works w/ output groups", func() {
+			err := pipeConfig.PreloadFromConfigFile("./testsupport/config_test_output_groups.toml")
+			c.Assume(err, gs.IsNil)
+			err = pipeConfig.LoadConfig()
+			c.Assume(err, gs.IsNil)
+			staging, ok := pipeConfig.OutputRunners["staging"]
+			c.Assume(ok, gs.IsTrue)
+			matcher := staging.MatchRunner().MatcherSpecification().String()
+			c.Expect(matcher, gs.Equals, "Type == 'nginx'")
+			c.Expect(staging.IsStoppable(), gs.IsTrue)
+		})
+
+		c.Specify("errors on round robin group members w/ different matchers", func() {
+			err := pipeConfig.PreloadFromConfigFile("./testsupport/config_bad_output_groups.toml")
+			c.Assume(err, gs.IsNil)
+			err = pipeConfig.LoadConfig()
+			c.Assume(err, gs.Not(gs.IsNil))
+			msg := pipeConfig.LogMsgs[0]
+			c.Expect(msg, ts.StringContains, "round robin group 'es' members must share")
+		})
+
+		c.Specify("won't register a plugin w/o a category", func() {
+			defer func() {
+				c.Expect(recover(), gs.Not(gs.IsNil))
+				_, ok := AvailablePlugins["DefaultsTest"]
+				c.Expect(ok, gs.IsFalse)
+			}()
+			RegisterPlugin("DefaultsTest", func() interface{} {
+				return new(DefaultsTestOutput)
+			})
+		})
+
 		c.Specify("for a DefaultsTestOutput", func() {
 			RegisterPlugin("DefaultsTestOutput", func() interface{} {
 				return new(DefaultsTestOutput)
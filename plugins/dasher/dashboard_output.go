@@ -52,6 +52,8 @@ type DashboardOutputConfig struct {
 	MessageMatcher string
 	// Custom http headers
 	Headers http.Header
+	// Number of recent sandbox alerts shown on the dashboard. Defaults to 100.
+	MaxAlerts uint `toml:"max_alerts"`
 }
 
 func (self *DashboardOutput) ConfigStruct() interface{} {
@@ -60,6 +62,7 @@ func (self *DashboardOutput) ConfigStruct() interface{} {
 		StaticDirectory:  "dasher",
 		WorkingDirectory: "dashboard",
 		TickerInterval:   uint(5),
+		MaxAlerts:        uint(100),
 		MessageMatcher:   "Type == 'heka.all-report' || Type == 'heka.sandbox-terminated' || Type == 'heka.sandbox-output'",
 	}
 }
@@ -71,6 +74,7 @@ type DashboardOutput struct {
 	dataDirectory    string
 	server           *http.Server
 	handler          http.Handler
+	maxAlerts        int
 	pConfig          *PipelineConfig
 	starterFunc      func(output *DashboardOutput) error
 }
@@ -89,6 +93,7 @@ func (self *DashboardOutput) Init(config interface{}) (err error) {
 	self.workingDirectory = globals.PrependBaseDir(conf.WorkingDirectory)
 	self.relDataPath = "data"
 	self.dataDirectory = filepath.Join(self.workingDirectory, self.relDataPath)
+	self.maxAlerts = int(conf.MaxAlerts)
 
 	if self.starterFunc == nil {
 		self.starterFunc = defaultStarter
@@ -178,6 +183,8 @@ func (self *DashboardOutput) Run(or OutputRunner, h PluginHelper) (err error) {
 	// sandboxes.json file.
 	sandboxes := make(map[string]*DashPluginListItem)
 	sbxsLock := new(sync.Mutex)
+	// Most recent alerts, newest first, used to generate the alerts.json file.
+	alerts := make([]*DashAlert, 0, self.maxAlerts)
 	reNotWord, _ := regexp.Compile("\\W")
 	for ok {
 		select {
@@ -211,6 +218,22 @@ func (self *DashboardOutput) Run(or OutputRunner, h PluginHelper) (err error) {
 
 					payloadType = reNotWord.ReplaceAllString(payloadType, "")
 					filterName := msg.GetLogger()
+					if payloadType == "alert" && self.maxAlerts > 0 {
+						alert := &DashAlert{
+							Time:    msg.GetTimestamp() / 1e9,
+							Plugin:  filterName,
+							Name:    payloadName,
+							Message: msg.GetPayload(),
+						}
+						if len(alerts) == self.maxAlerts {
+							alerts = alerts[:len(alerts)-1]
+						}
+						alerts = append([]*DashAlert{alert}, alerts...)
+						if err := overwriteAlertsFile(self.dataDirectory, alerts); err != nil {
+							or.LogError(fmt.Errorf("Can't write alerts file to '%s': %s",
+								self.dataDirectory, err))
+						}
+					}
 					fn := filterName + nameExt + "." + payloadType
 					ofn := filepath.Join(self.dataDirectory, fn)
 					relPath := path.Join(self.relDataPath, fn) // Used for generating HTTP URLs.
@@ -337,6 +360,27 @@ func overwritePluginListFile(dir string, sbxs map[string]*DashPluginListItem) (e
 	return
 }
 
+type DashAlert struct {
+	Time    int64
+	Plugin  string
+	Name    string
+	Message string
+}
+
+func overwriteAlertsFile(dir string, alerts []*DashAlert) (err error) {
+	output := map[string][]*DashAlert{
+		"alerts": alerts,
+	}
+	var file *os.File
+	filename := filepath.Join(dir, "alerts.json")
+	if file, err = os.OpenFile(filename, os.O_WRONLY|os.O_TRUNC+os.O_CREATE, 0644); err == nil {
+		enc := json.NewEncoder(file)
+		err = enc.Encode(output)
+		file.Close()
+	}
+	return
+}
+
 func init() {
 	RegisterPlugin("DashboardOutput", func() interface{} {
 		return new(DashboardOutput)
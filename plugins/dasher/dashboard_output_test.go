@@ -15,6 +15,8 @@
 package dasher
 
 import (
+	"encoding/json"
+	"github.com/mozilla-services/heka/message"
 	"github.com/mozilla-services/heka/pipeline"
 	pipeline_ts "github.com/mozilla-services/heka/pipeline/testsupport"
 	"github.com/mozilla-services/heka/pipelinemock"
@@ -25,6 +27,7 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
 	"reflect"
 	"runtime"
 	"testing"
@@ -130,6 +133,39 @@ func DashboardOutputSpec(c gs.Context) {
 					c.Expect(eq, gs.IsTrue)
 				})
 
+				c.Specify("writes recent alerts", func() {
+					config.MaxAlerts = 2
+					err = dashboardOutput.Init(config)
+					c.Assume(err, gs.IsNil)
+
+					startOutput()
+					<-startedChan
+
+					for _, payload := range []string{"first", "second", "third"} {
+						pack.Message = pipeline_ts.GetTestMessage()
+						pack.Message.SetType("heka.sandbox-output")
+						pack.Message.SetLogger("alerter")
+						pack.Message.SetPayload(payload)
+						field, _ := message.NewField("payload_type", "alert", "")
+						pack.Message.AddField(field)
+						inChan <- pack
+						<-recycleChan
+					}
+
+					contents, err := ioutil.ReadFile(filepath.Join(tmpdir, "data",
+						"alerts.json"))
+					c.Assume(err, gs.IsNil)
+					var result map[string][]*DashAlert
+					err = json.Unmarshal(contents, &result)
+					c.Assume(err, gs.IsNil)
+					alerts := result["alerts"]
+					c.Expect(len(alerts), gs.Equals, 2)
+					c.Expect(alerts[0].Message, gs.Equals, "third")
+					c.Expect(alerts[0].Plugin, gs.Equals, "alerter")
+					c.Expect(alerts[0].Time, gs.Equals, int64(1136239445))
+					c.Expect(alerts[1].Message, gs.Equals, "second")
+				})
+
 				close(inChan)
 				c.Expect(<-errChan, gs.IsNil)
 
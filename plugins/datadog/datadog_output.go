@@ -0,0 +1,295 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package datadog
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/mozilla-services/heka/message"
+	. "github.com/mozilla-services/heka/pipeline"
+	"github.com/mozilla-services/heka/plugins"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Longest we'll wait on a rate limited response before retrying.
+const maxRateLimitWait = 60 * time.Second
+
+// Output plugin that sends metric messages to the Datadog series API.
+type DatadogOutput struct {
+	*DatadogOutputConfig
+	client              *http.Client
+	processMessageCount int64
+	dropMessageCount    int64
+	rateLimitCount      int64
+	reportLock          sync.Mutex
+	batcher             *Batcher
+	or                  OutputRunner
+	// Swapped out by the tests.
+	sleep func(time.Duration)
+}
+
+// ConfigStruct for DatadogOutput plugin.
+type DatadogOutputConfig struct {
+	// URL of the series API endpoint.
+	Url string
+	// Datadog API key.
+	ApiKey string `toml:"api_key"`
+	// Metric name template, may contain `%{<name>}` placeholders.
+	Metric string
+	// Name of the message field containing the metric value.
+	ValueField string `toml:"value_field"`
+	// Metric type, one of "gauge", "count", or "rate".
+	MetricType string `toml:"metric_type"`
+	// Interval in seconds the values of "count" and "rate" metrics cover.
+	Interval int64
+	// Host name template, may contain `%{<name>}` placeholders.
+	Host string
+	// Tags added to every metric, in "name:value" form.
+	Tags []string
+	// Dynamic message fields written as "field:value" tags.
+	TagFields []string `toml:"tag_fields"`
+	// Batching settings, from the `batch` subsection.
+	Batch BatchConfig `toml:"batch"`
+	// HTTP request timeout, in milliseconds. 0 means no timeout.
+	HttpTimeout uint32 `toml:"http_timeout"`
+}
+
+// A single series in a series API request.
+type ddSeries struct {
+	Metric   string       `json:"metric"`
+	Points   [][2]float64 `json:"points"`
+	Type     string       `json:"type"`
+	Interval int64        `json:"interval,omitempty"`
+	Host     string       `json:"host,omitempty"`
+	Tags     []string     `json:"tags,omitempty"`
+}
+
+type ddRequest struct {
+	Series []json.RawMessage `json:"series"`
+}
+
+func (o *DatadogOutput) ConfigStruct() interface{} {
+	batch := DefaultBatchConfig()
+	batch.FlushInterval = 10000
+	return &DatadogOutputConfig{
+		Url:         "https://api.datadoghq.com/api/v1/series",
+		Metric:      "%{Type}",
+		ValueField:  "value",
+		MetricType:  "gauge",
+		Host:        "%{Hostname}",
+		HttpTimeout: 5000,
+		Batch:       batch,
+	}
+}
+
+func (o *DatadogOutput) Init(config interface{}) (err error) {
+	o.DatadogOutputConfig = config.(*DatadogOutputConfig)
+
+	if o.ApiKey == "" {
+		return errors.New("`api_key` setting is required")
+	}
+	if o.Metric == "" {
+		return errors.New("`metric` must not be empty")
+	}
+	if o.ValueField == "" {
+		return errors.New("`value_field` must not be empty")
+	}
+	switch o.MetricType {
+	case "gauge":
+	case "count", "rate":
+		if o.Interval <= 0 {
+			return fmt.Errorf("`interval` is required for '%s' metrics", o.MetricType)
+		}
+	default:
+		return fmt.Errorf("unsupported `metric_type`: %s", o.MetricType)
+	}
+	u, err := url.Parse(o.Url)
+	if err != nil {
+		return fmt.Errorf("can't parse URL '%s': %s", o.Url, err.Error())
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return errors.New("`url` must contain an absolute http or https URL")
+	}
+
+	o.client = new(http.Client)
+	if o.HttpTimeout > 0 {
+		o.client.Timeout = time.Duration(o.HttpTimeout) * time.Millisecond
+	}
+	o.sleep = time.Sleep
+	err = o.Batch.Validate()
+	return
+}
+
+// Generates the series for a message.
+func (o *DatadogOutput) makeSeries(msg *message.Message) (*ddSeries, error) {
+	val, ok := msg.GetFieldValue(o.ValueField)
+	if !ok {
+		return nil, fmt.Errorf("message has no '%s' field", o.ValueField)
+	}
+	var value float64
+	switch v := val.(type) {
+	case int64:
+		value = float64(v)
+	case float64:
+		value = v
+	default:
+		return nil, fmt.Errorf("field '%s' isn't numeric", o.ValueField)
+	}
+
+	series := &ddSeries{
+		Metric: plugins.InterpolateMessageString(o.Metric, msg),
+		Points: [][2]float64{{float64(msg.GetTimestamp() / int64(time.Second)), value}},
+		Type:   o.MetricType,
+		Host:   plugins.InterpolateMessageString(o.Host, msg),
+	}
+	if series.Metric == "" {
+		return nil, errors.New("empty metric name generated for message")
+	}
+	if o.MetricType != "gauge" {
+		series.Interval = o.Interval
+	}
+	series.Tags = append(series.Tags, o.Tags...)
+	for _, name := range o.TagFields {
+		if val, ok := msg.GetFieldValue(name); ok {
+			series.Tags = append(series.Tags, fmt.Sprintf("%s:%v", name, val))
+		}
+	}
+	return series, nil
+}
+
+// Returns how long a rate limited response asks us to wait, from its
+// Retry-After or X-RateLimit-Reset header.
+func rateLimitWait(resp *http.Response) time.Duration {
+	for _, name := range []string{"Retry-After", "X-RateLimit-Reset"} {
+		if secs, err := strconv.Atoi(resp.Header.Get(name)); err == nil && secs > 0 {
+			wait := time.Duration(secs) * time.Second
+			if wait > maxRateLimitWait {
+				wait = maxRateLimitWait
+			}
+			return wait
+		}
+	}
+	return 0
+}
+
+// Satisfies `pipeline.BatchFlushFunc`, sending a batch of JSON encoded
+// series. Rate limited requests wait for the limit to reset before they're
+// retried, requests Datadog rejects as invalid are dropped.
+func (o *DatadogOutput) flush(records [][]byte) error {
+	body, err := json.Marshal(&ddRequest{Series: toRaw(records)})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", o.Url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("can't create HTTP request: %s", err.Error())
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("DD-API-KEY", o.ApiKey)
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("error making HTTP request: %s", err.Error())
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 300 {
+		atomic.AddInt64(&o.processMessageCount, int64(len(records)))
+		return nil
+	}
+	respBody, _ := ioutil.ReadAll(resp.Body)
+	err = fmt.Errorf("Datadog request failed: %s - %s", resp.Status,
+		strings.TrimSpace(string(respBody)))
+	switch {
+	case resp.StatusCode == 429:
+		atomic.AddInt64(&o.rateLimitCount, 1)
+		o.sleep(rateLimitWait(resp))
+		return err
+	case resp.StatusCode >= 500:
+		return err
+	}
+	o.or.LogError(err)
+	atomic.AddInt64(&o.dropMessageCount, int64(len(records)))
+	return nil
+}
+
+func toRaw(records [][]byte) []json.RawMessage {
+	raw := make([]json.RawMessage, len(records))
+	for i, record := range records {
+		raw[i] = json.RawMessage(record)
+	}
+	return raw
+}
+
+func (o *DatadogOutput) Run(or OutputRunner, h PluginHelper) (err error) {
+	o.or = or
+	if o.batcher, err = NewOutputBatcher(o.Batch, o.flush, or, h); err != nil {
+		return
+	}
+	o.batcher.Start()
+
+	var (
+		series *ddSeries
+		record []byte
+		e      error
+	)
+	for pack := range or.InChan() {
+		series, e = o.makeSeries(pack.Message)
+		pack.Recycle()
+		if e == nil {
+			record, e = json.Marshal(series)
+		}
+		if e != nil {
+			or.LogError(e)
+			atomic.AddInt64(&o.dropMessageCount, 1)
+			continue
+		}
+		o.batcher.Add(record)
+	}
+	o.batcher.Stop()
+	return
+}
+
+// Satisfies the `pipeline.ReportingPlugin` interface to provide plugin state
+// information to the Heka report and dashboard.
+func (o *DatadogOutput) ReportMsg(msg *message.Message) error {
+	o.reportLock.Lock()
+	defer o.reportLock.Unlock()
+
+	message.NewInt64Field(msg, "ProcessMessageCount",
+		atomic.LoadInt64(&o.processMessageCount), "count")
+	message.NewInt64Field(msg, "DropMessageCount",
+		atomic.LoadInt64(&o.dropMessageCount), "count")
+	message.NewInt64Field(msg, "RateLimitCount",
+		atomic.LoadInt64(&o.rateLimitCount), "count")
+	if o.batcher != nil {
+		o.batcher.ReportMsg(msg)
+	}
+	return nil
+}
+
+func init() {
+	RegisterPlugin("DatadogOutput", func() interface{} {
+		return new(DatadogOutput)
+	})
+}
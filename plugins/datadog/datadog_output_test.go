@@ -0,0 +1,162 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package datadog
+
+import (
+	"encoding/json"
+	"github.com/mozilla-services/heka/message"
+	pipeline_ts "github.com/mozilla-services/heka/pipeline/testsupport"
+	plugins_ts "github.com/mozilla-services/heka/plugins/testsupport"
+	"github.com/rafrombrc/gomock/gomock"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"time"
+)
+
+type receivedSeries struct {
+	Series []ddSeries `json:"series"`
+}
+
+func DatadogOutputSpec(c gs.Context) {
+	t := new(pipeline_ts.SimpleT)
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	output := new(DatadogOutput)
+	config := output.ConfigStruct().(*DatadogOutputConfig)
+	config.ApiKey = "secret"
+
+	msg := pipeline_ts.GetTestMessage()
+	field, _ := message.NewField("value", 12.5, "")
+	msg.AddField(field)
+
+	c.Specify("A DatadogOutput", func() {
+		c.Specify("requires an api key", func() {
+			config.ApiKey = ""
+			err := output.Init(config)
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+
+		c.Specify("requires an interval for rate metrics", func() {
+			config.MetricType = "rate"
+			err := output.Init(config)
+			c.Expect(err, gs.Not(gs.IsNil))
+			config.Interval = 10
+			err = output.Init(config)
+			c.Expect(err, gs.IsNil)
+		})
+
+		c.Specify("converts messages to series", func() {
+			config.Metric = "heka.%{Logger}"
+			config.Tags = []string{"env:prod"}
+			config.TagFields = []string{"foo", "missing"}
+			err := output.Init(config)
+			c.Assume(err, gs.IsNil)
+			series, err := output.makeSeries(msg)
+			c.Assume(err, gs.IsNil)
+			c.Expect(series.Metric, gs.Equals, "heka.GoSpec")
+			c.Expect(series.Host, gs.Equals, "my.host.name")
+			c.Expect(series.Type, gs.Equals, "gauge")
+			c.Expect(series.Points[0][0], gs.Equals, float64(1136239445))
+			c.Expect(series.Points[0][1], gs.Equals, 12.5)
+			c.Expect(len(series.Tags), gs.Equals, 2)
+			c.Expect(series.Tags[0], gs.Equals, "env:prod")
+			c.Expect(series.Tags[1], gs.Equals, "foo:bar")
+		})
+
+		c.Specify("rejects messages w/o a numeric value", func() {
+			config.ValueField = "foo"
+			err := output.Init(config)
+			c.Assume(err, gs.IsNil)
+			_, err = output.makeSeries(msg)
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+
+		c.Specify("sends batches", func() {
+			var (
+				requests   int
+				status     = http.StatusAccepted
+				retryAfter string
+				received   receivedSeries
+				apiKey     string
+				slept      time.Duration
+			)
+			server := httptest.NewServer(http.HandlerFunc(
+				func(w http.ResponseWriter, r *http.Request) {
+					requests++
+					apiKey = r.Header.Get("DD-API-KEY")
+					body, _ := ioutil.ReadAll(r.Body)
+					json.Unmarshal(body, &received)
+					if retryAfter != "" {
+						w.Header().Set("Retry-After", retryAfter)
+					}
+					w.WriteHeader(status)
+					w.Write([]byte("{}"))
+				}))
+			defer server.Close()
+
+			config.Url = server.URL
+			err := output.Init(config)
+			c.Assume(err, gs.IsNil)
+			output.sleep = func(d time.Duration) { slept = d }
+			series, _ := output.makeSeries(msg)
+			record, _ := json.Marshal(series)
+
+			c.Specify("to the series endpoint", func() {
+				err = output.flush([][]byte{record, record})
+				c.Expect(err, gs.IsNil)
+				c.Expect(requests, gs.Equals, 1)
+				c.Expect(apiKey, gs.Equals, "secret")
+				c.Expect(len(received.Series), gs.Equals, 2)
+				c.Expect(received.Series[0].Metric, gs.Equals, "TEST")
+				c.Expect(output.processMessageCount, gs.Equals, int64(2))
+			})
+
+			c.Specify("and waits out the rate limit before a retry", func() {
+				status = 429
+				retryAfter = "7"
+				err = output.flush([][]byte{record})
+				c.Expect(err, gs.Not(gs.IsNil))
+				c.Expect(slept, gs.Equals, 7*time.Second)
+				c.Expect(output.rateLimitCount, gs.Equals, int64(1))
+			})
+
+			c.Specify("and caps the rate limit wait", func() {
+				status = 429
+				retryAfter = "3600"
+				output.flush([][]byte{record})
+				c.Expect(slept, gs.Equals, maxRateLimitWait)
+			})
+
+			c.Specify("and asks for a retry on server errors", func() {
+				status = http.StatusServiceUnavailable
+				err = output.flush([][]byte{record})
+				c.Expect(err, gs.Not(gs.IsNil))
+			})
+
+			c.Specify("and drops batches Datadog rejects", func() {
+				status = http.StatusForbidden
+				oth := plugins_ts.NewOutputTestHelper(ctrl)
+				oth.MockOutputRunner.EXPECT().LogError(gomock.Any())
+				output.or = oth.MockOutputRunner
+				err = output.flush([][]byte{record})
+				c.Expect(err, gs.IsNil)
+				c.Expect(output.dropMessageCount, gs.Equals, int64(1))
+			})
+		})
+	})
+}
@@ -78,14 +78,13 @@ func (dei *DockerEventInput) Run(ir pipeline.InputRunner, h pipeline.PluginHelpe
 	)
 	hostname := h.Hostname()
 
-	// Provides empty PipelinePacks
-	packSupply := ir.InChan()
-
 	ok = true
 	for ok {
 		select {
 		case event := <-dei.eventStream:
-			pack = <-packSupply
+			if pack = ir.NewPack(); pack == nil {
+				continue
+			}
 			pack.Message.SetType("DockerEvent")
 			pack.Message.SetLogger(event.ID)
 			pack.Message.SetHostname(hostname)
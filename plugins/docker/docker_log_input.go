@@ -75,15 +75,14 @@ func (di *DockerLogInput) Run(ir pipeline.InputRunner, h pipeline.PluginHelper)
 
 	go di.attachMgr.Listen(di.logstream, di.closer)
 
-	// Get the InputRunner's chan to receive empty PipelinePacks
-	packSupply := ir.InChan()
-
 	ok = true
 	var err error
 	for ok {
 		select {
 		case logline := <-di.logstream:
-			pack = <-packSupply
+			if pack = ir.NewPack(); pack == nil {
+				continue
+			}
 
 			pack.Message.SetType("DockerLog")
 			pack.Message.SetLogger(logline.Type) // stderr or stdout
@@ -25,6 +25,10 @@ import (
 	"time"
 )
 
+// Clock used for index names when the message timestamp isn't used,
+// replaceable in tests.
+var now = time.Now
+
 // ElasticSearchCoordinates stores the coordinates (_index, _type, _id) of an
 // ElasticSearch document.
 type ElasticSearchCoordinates struct {
@@ -65,7 +69,8 @@ func (e *ElasticSearchCoordinates) PopulateBuffer(m *message.Message, buf *bytes
 	buf.WriteString(`}}`)
 }
 
-// Replaces a date pattern (ex: %{2012.09.19} in the index name
+// Replaces a date pattern (ex: %{%Y.%m.%d} or %{2006.01.02}) in the index
+// name
 func interpolateFlag(e *ElasticSearchCoordinates, m *message.Message, name string) (
 	interpolatedValue string, err error) {
 
@@ -101,9 +106,16 @@ func interpolateFlag(e *ElasticSearchCoordinates, m *message.Message, name strin
 					if e.ESIndexFromTimestamp && m.Timestamp != nil {
 						t = time.Unix(0, *m.Timestamp).UTC()
 					} else {
-						t = time.Now().UTC()
+						t = now().UTC()
+					}
+					var formatted string
+					if strings.Contains(elVal, "2006") {
+						// Go-style reference time layout.
+						formatted = t.Format(elVal)
+					} else {
+						formatted = gostrftime.Strftime(elVal, t)
 					}
-					iSlice[i] = strings.Replace(iSlice[i], element[:elEnd+1], gostrftime.Strftime(elVal, t), -1)
+					iSlice[i] = strings.Replace(iSlice[i], element[:elEnd+1], formatted, -1)
 				}
 			}
 			if iSlice[i] == elVal {
@@ -100,6 +100,19 @@ type ElasticSearchOutputConfig struct {
 	// Specifies action which should be executed if queue is full. Possible
 	// values are "shutdown", "drop", or "block".
 	QueueFullAction string `toml:"queue_full_action"`
+	// Number of times a bulk request that failed w/ a retryable error (i.e.
+	// a connection error, a 429, or a 5xx response) will be retried before
+	// the batch is dropped, when buffering isn't in use. -1 means retry
+	// forever. Defaults to 3.
+	MaxIndexRetries int `toml:"max_index_retries"`
+	// Optional proxy to send HTTP bulk requests through.
+	Proxy *tcp.ProxyConfig `toml:"proxy"`
+	// Number of seconds the addresses the server's host name resolves to are
+	// cached for. 0 re-resolves the name on every new connection.
+	DnsCacheTtl uint `toml:"dns_cache_ttl"`
+	// Optional pool of host:port addresses to spread HTTP bulk requests
+	// across, in place of the host of the Server URL.
+	Endpoints *tcp.EndpointPoolConfig `toml:"endpoints"`
 }
 
 func (o *ElasticSearchOutput) ConfigStruct() interface{} {
@@ -115,6 +128,8 @@ func (o *ElasticSearchOutput) ConfigStruct() interface{} {
 		UseBuffering:          true,
 		QueueMaxBufferSize:    0,
 		QueueFullAction:       "shutdown",
+		MaxIndexRetries:       3,
+		DnsCacheTtl:           30,
 	}
 }
 
@@ -143,10 +158,39 @@ func (o *ElasticSearchOutput) Init(config interface{}) (err error) {
 				}
 			}
 
-			o.bulkIndexer = NewHttpBulkIndexer(scheme, serverUrl.Host, serverUrl.Path,
+			indexer := NewHttpBulkIndexer(scheme, serverUrl.Host, serverUrl.Path,
 				o.conf.FlushCount, o.conf.Username, o.conf.Password, o.conf.HTTPTimeout,
 				o.conf.HTTPDisableKeepalives, o.conf.ConnectTimeout, tlsConf)
+			if o.conf.Proxy != nil {
+				forward := &net.Dialer{
+					Timeout: time.Duration(o.conf.ConnectTimeout) * time.Millisecond,
+				}
+				var dial func(network, address string) (net.Conn, error)
+				if dial, err = tcp.NewProxyDialer(o.conf.Proxy, forward); err != nil {
+					return err
+				}
+				indexer.client.Transport.(*http.Transport).Dial = dial
+			} else {
+				forward := &net.Dialer{
+					Timeout: time.Duration(o.conf.ConnectTimeout) * time.Millisecond,
+				}
+				ttl := time.Duration(o.conf.DnsCacheTtl) * time.Second
+				indexer.client.Transport.(*http.Transport).Dial = tcp.NewCachingDialer(
+					forward, ttl).Dial
+			}
+			if o.conf.Endpoints != nil {
+				if indexer.endpoints, err = tcp.NewEndpointPool(o.conf.Endpoints); err != nil {
+					return err
+				}
+			}
+			o.bulkIndexer = indexer
 		case "udp":
+			if o.conf.Proxy != nil {
+				return errors.New("`proxy` can only be used w/ an `http` or `https` server.")
+			}
+			if o.conf.Endpoints != nil {
+				return errors.New("`endpoints` can only be used w/ an `http` or `https` server.")
+			}
 			o.bulkIndexer = NewUDPBulkIndexer(serverUrl.Host, o.conf.FlushCount)
 		default:
 			err = errors.New("Server URL must specify one of `udp`, `http`, or `https`.")
@@ -222,6 +266,12 @@ func (o *ElasticSearchOutput) Run(or OutputRunner, h PluginHelper) (err error) {
 	}
 
 	o.pConfig = h.PipelineConfig()
+
+	if indexer, ok := o.bulkIndexer.(*HttpBulkIndexer); ok && indexer.endpoints != nil {
+		stopChecks := make(chan struct{})
+		defer close(stopChecks)
+		go indexer.endpoints.HealthCheck(probeEndpoint, stopChecks)
+	}
 	o.or = or
 
 	if o.conf.UseBuffering {
@@ -313,10 +363,26 @@ func (o *ElasticSearchOutput) Run(or OutputRunner, h PluginHelper) (err error) {
 func (o *ElasticSearchOutput) committer() {
 	o.backChan <- make([]byte, 0, 10000)
 
+	rh, _ := NewRunnerRetryHelper(o.or, RetryOptions{
+		MaxDelay:   "5s",
+		Delay:      "250ms",
+		MaxRetries: o.conf.MaxIndexRetries,
+	})
+
+	var err error
 	for b := range o.batchChan {
-		if err := o.SendRecord(b.batch); err != nil {
-			atomic.AddInt64(&o.dropMessageCount, b.count)
+		rh.Reset()
+		for {
+			if err = o.SendRecord(b.batch); err == nil {
+				break
+			}
 			o.or.LogError(err)
+			if o.pConfig.Globals.IsShuttingDown() || rh.Wait() != nil {
+				break
+			}
+		}
+		if err != nil {
+			atomic.AddInt64(&o.dropMessageCount, b.count)
 		} else {
 			atomic.AddInt64(&o.processMessageCount, b.count)
 		}
@@ -385,9 +451,21 @@ func (o *ElasticSearchOutput) ReportMsg(msg *message.Message) error {
 	if o.conf.UseBuffering {
 		o.bufferedOut.ReportMsg(msg)
 	}
+	if indexer, ok := o.bulkIndexer.(*HttpBulkIndexer); ok && indexer.endpoints != nil {
+		indexer.endpoints.ReportMsg(msg)
+	}
 	return nil
 }
 
+// Probes an ejected ElasticSearch node by opening a connection to it.
+func probeEndpoint(address string) error {
+	conn, err := net.DialTimeout("tcp", address, 5*time.Second)
+	if err == nil {
+		conn.Close()
+	}
+	return err
+}
+
 // A BulkIndexer is used to index documents in ElasticSearch
 type BulkIndexer interface {
 	// Index documents
@@ -413,6 +491,8 @@ type HttpBulkIndexer struct {
 	username string
 	// Optional password for HTTP authentication
 	password string
+	// Optional pool of hosts to spread the requests across.
+	endpoints *tcp.EndpointPool
 }
 
 func NewHttpBulkIndexer(protocol string, domain string, path string, maxCount int,
@@ -450,10 +530,27 @@ func (h *HttpBulkIndexer) CheckFlush(count int, length int) bool {
 }
 
 func (h *HttpBulkIndexer) Index(body []byte) (err error, retry bool) {
+	if h.endpoints == nil {
+		return h.indexTo(h.Domain, body)
+	}
+	endpoint := h.endpoints.Acquire()
+	err, retry = h.indexTo(endpoint.Address, body)
+	// Only errors that can be retried say anything about the endpoint's
+	// health, the others are caused by the request.
+	if retry {
+		h.endpoints.Release(endpoint, err)
+	} else {
+		h.endpoints.Release(endpoint, nil)
+	}
+	return
+}
+
+// Sends a bulk request to the ElasticSearch node at domain.
+func (h *HttpBulkIndexer) indexTo(domain string, body []byte) (err error, retry bool) {
 	var response_body []byte
 	var response_body_json map[string]interface{}
 
-	url := fmt.Sprintf("%s://%s%s%s", h.Protocol, h.Domain, h.Path, "/_bulk")
+	url := fmt.Sprintf("%s://%s%s%s", h.Protocol, domain, h.Path, "/_bulk")
 
 	// Creating ElasticSearch Bulk HTTP request
 	request, err := http.NewRequest("POST", url, bytes.NewReader(body))
@@ -480,6 +577,12 @@ func (h *HttpBulkIndexer) Index(body []byte) (err error, retry bool) {
 	}
 	if response != nil {
 		defer response.Body.Close()
+		if response.StatusCode == http.StatusTooManyRequests ||
+			response.StatusCode >= http.StatusInternalServerError {
+			// The cluster is overloaded or temporarily unavailable, the
+			// request can be retried.
+			return fmt.Errorf("HTTP response error status: %s", response.Status), true
+		}
 		if response.StatusCode > 304 {
 			return fmt.Errorf("HTTP response error status: %s", response.Status), false
 		}
@@ -22,6 +22,7 @@ import (
 	"github.com/cactus/gostrftime"
 	"github.com/mozilla-services/heka/message"
 	. "github.com/mozilla-services/heka/pipeline"
+	"github.com/mozilla-services/heka/plugins"
 	"strconv"
 	"strings"
 	"time"
@@ -85,12 +86,12 @@ func writeQuotedString(b *bytes.Buffer, str string) {
 
 }
 
-func writeField(first bool, b *bytes.Buffer, f *message.Field, raw bool) {
+func writeField(first bool, b *bytes.Buffer, name string, f *message.Field, raw bool) {
 	if !first {
 		b.WriteString(`,`)
 	}
 
-	writeQuotedString(b, f.GetName())
+	writeQuotedString(b, name)
 	b.WriteString(`:`)
 
 	switch f.GetValueType() {
@@ -210,6 +211,7 @@ type ESJsonEncoder struct {
 	rawBytesFields  []string
 	coord           *ElasticSearchCoordinates
 	fieldMappings   *ESFieldMappings
+	fieldNames      *plugins.FieldNameSanitizer
 }
 
 // Heka fields to ElasticSearch mapping
@@ -244,6 +246,8 @@ type ESJsonEncoderConfig struct {
 	RawBytesFields []string `toml:"raw_bytes_fields"`
 	// Overriding names for Heka fields
 	FieldMappings *ESFieldMappings `toml:"field_mappings"`
+	// Clean up of dynamic field names, nil unless configured.
+	FieldNames *plugins.FieldNameConfig `toml:"field_names"`
 }
 
 func (e *ESJsonEncoder) ConfigStruct() interface{} {
@@ -294,6 +298,7 @@ func (e *ESJsonEncoder) Init(config interface{}) (err error) {
 		Id:                   conf.Id,
 	}
 	e.fieldMappings = conf.FieldMappings
+	e.fieldNames = plugins.NewFieldNameSanitizer(conf.FieldNames)
 	return
 }
 
@@ -335,7 +340,7 @@ func (e *ESJsonEncoder) Encode(pack *PipelinePack) (output []byte, err error) {
 						}
 					}
 				}
-				writeField(first, &buf, field, raw)
+				writeField(first, &buf, e.fieldNames.Sanitize(field.GetName()), field, raw)
 				first = false
 			}
 		default:
@@ -358,6 +363,7 @@ type ESLogstashV0Encoder struct {
 	fields          []string
 	timestampFormat string
 	useMessageType  bool
+	fieldNames      *plugins.FieldNameSanitizer
 }
 
 type ESLogstashV0EncoderConfig struct {
@@ -379,6 +385,8 @@ type ESLogstashV0EncoderConfig struct {
 	Id string
 	// Fields to which formatting will not be applied.
 	RawBytesFields []string `toml:"raw_bytes_fields"`
+	// Clean up of dynamic field names, nil unless configured.
+	FieldNames *plugins.FieldNameConfig `toml:"field_names"`
 }
 func (e *ESLogstashV0Encoder) ConfigStruct() interface{} {
 
@@ -413,6 +421,7 @@ func (e *ESLogstashV0Encoder) Init(config interface{}) (err error) {
 	e.fields = conf.Fields
 	e.timestampFormat = conf.Timestamp
 	e.useMessageType = conf.UseMessageType
+	e.fieldNames = plugins.NewFieldNameSanitizer(conf.FieldNames)
 	e.coord = &ElasticSearchCoordinates{
 		Index:                conf.Index,
 		Type:                 conf.TypeName,
@@ -477,7 +486,8 @@ func (e *ESLogstashV0Encoder) Encode(pack *PipelinePack) (output []byte, err err
 						}
 					}
 				}
-				writeField(firstfield, &buf, field, raw)
+				writeField(firstfield, &buf, e.fieldNames.Sanitize(field.GetName()), field,
+					raw)
 				firstfield = false
 			}
 			buf.WriteString(`}`) // end of fields
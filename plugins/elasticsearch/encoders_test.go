@@ -22,6 +22,7 @@ import (
 	"encoding/json"
 	"github.com/mozilla-services/heka/message"
 	. "github.com/mozilla-services/heka/pipeline"
+	"github.com/mozilla-services/heka/plugins"
 	gs "github.com/rafrombrc/gospec/src/gospec"
 	"strings"
 	"testing"
@@ -136,6 +137,17 @@ func ESEncodersSpec(c gs.Context) {
 			c.Expect(interpolatedType, gs.Equals, "TEST")
 		})
 
+		c.Specify("should interpolate Go time layouts", func() {
+			now = func() time.Time {
+				return time.Date(2015, time.March, 7, 23, 59, 59, 0, time.UTC)
+			}
+			defer func() { now = time.Now }()
+			interpolatedIndex, err := interpolateFlag(&ElasticSearchCoordinates{},
+				pack.Message, "logs-%{Type}-%{2006.01.02}")
+			c.Expect(err, gs.IsNil)
+			c.Expect(interpolatedIndex, gs.Equals, "logs-TEST-2015.03.07")
+		})
+
 		c.Specify("should interpolate from message field", func() {
 			id := "%{idField}"
 			interpolatedId, err := interpolateFlag(&ElasticSearchCoordinates{},
@@ -372,6 +384,26 @@ func ESEncodersSpec(c gs.Context) {
 			c.Expect(decoded["XHostname"], gs.Equals, "hostname")
 		})
 
+		c.Specify("sanitizes dynamic field names", func() {
+			config.FieldNames = &plugins.FieldNameConfig{
+				Lowercase:   true,
+				ReplaceDots: "_",
+			}
+			err := encoder.Init(config)
+			c.Assume(err, gs.IsNil)
+			b, err := encoder.Encode(pack)
+			c.Assume(err, gs.IsNil)
+
+			lines := strings.Split(string(b), string(NEWLINE))
+			decoded := make(map[string]interface{})
+			err = json.Unmarshal([]byte(lines[1]), &decoded)
+			c.Assume(err, gs.IsNil)
+			c.Expect(decoded["idfield"], gs.Equals, "1234")
+			c.Expect(decoded["idField"], gs.IsNil)
+			// Message headers aren't dynamic fields and are left alone.
+			c.Expect(decoded["Type"], gs.Equals, "TEST")
+		})
+
 		c.Specify("encodes w/ a different timestamp format", func() {
 			config.Timestamp = "%Y/%m/%d %H:%M:%S %z"
 			err := encoder.Init(config)
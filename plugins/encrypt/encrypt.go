@@ -0,0 +1,439 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+// Package encrypt seals the data outputs archive w/ AES-256-GCM.
+//
+// Encrypted data is a sequence of frames, each a type byte and a big endian
+// uint32 payload length followed by the payload. A key frame ('K') starts a
+// segment: it names the key used for the data frames ('D') after it and
+// holds a random segment id. Each data frame holds a random nonce and the
+// sealed data, and the segment ends w/ a sealed, empty end frame ('E'). The
+// frame type, segment id, and frame's position in the segment are
+// authenticated along w/ each frame, so frames can't be dropped, reordered,
+// or moved to another segment, and a segment w/o its end frame is reported
+// as truncated. Appending to encrypted data, w/ the same key or another one,
+// just means writing another segment.
+package encrypt
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+const (
+	keyFrame       = 'K'
+	dataFrame      = 'D'
+	endFrame       = 'E'
+	frameVersion   = 2
+	headerLen      = 5
+	keyLen         = 32
+	nonceLen       = 12
+	segmentIdLen   = 16
+	maxFrameLen    = 1 << 30
+	fingerprintLen = 16
+)
+
+// Returned by a Reader when a segment ends w/o its end frame, e.g. because
+// the writer crashed or the data was cut short.
+var ErrTruncated = errors.New("encrypted data is truncated")
+
+// Encryption settings, used as the `encryption` section of the outputs that
+// support it. Either a key file or a KMS key must be set.
+type Config struct {
+	// Path of a file holding a 256 bit key, either raw or hex encoded.
+	KeyFile string `toml:"key_file"`
+	// Id recorded w/ data encrypted using the key file's key. Defaults to a
+	// fingerprint of the key.
+	KeyId string `toml:"key_id"`
+	// Id, ARN, or alias of the AWS KMS key that generates a data key for each
+	// run.
+	KmsKeyId string `toml:"kms_key_id"`
+	// AWS region of the KMS key.
+	KmsRegion string `toml:"kms_region"`
+	// AWS credentials used to call KMS. If empty, they're read from the
+	// environment.
+	AccessKeyId     string `toml:"access_key_id"`
+	SecretAccessKey string `toml:"secret_access_key"`
+	// Overrides the KMS endpoint, for testing.
+	KmsEndpoint string `toml:"kms_endpoint"`
+}
+
+// Checks that exactly one key source is configured.
+func (conf *Config) Validate() error {
+	if (conf.KeyFile == "") == (conf.KmsKeyId == "") {
+		return errors.New("either `key_file` or `kms_key_id` must be set")
+	}
+	if conf.KmsKeyId != "" && conf.KmsRegion == "" {
+		return errors.New("`kms_region` must be set w/ `kms_key_id`")
+	}
+	return nil
+}
+
+// A data encryption key.
+type Key struct {
+	// Id recorded w/ the data the key encrypts.
+	Id string
+	// The key encrypted by KMS, empty for keys read from a file.
+	Wrapped []byte
+	aead    cipher.AEAD
+}
+
+func newKey(id string, plain, wrapped []byte) (*Key, error) {
+	if len(plain) != keyLen {
+		return nil, fmt.Errorf("key must be %d bytes, got %d", keyLen, len(plain))
+	}
+	block, err := aes.NewCipher(plain)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &Key{Id: id, Wrapped: wrapped, aead: aead}, nil
+}
+
+// Reads a raw or hex encoded key from a file, returning its fingerprint as
+// the id unless one is given.
+func readKeyFile(path, id string) (*Key, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("can't read key file: %s", err)
+	}
+	plain := contents
+	if trimmed := strings.TrimSpace(string(contents)); len(trimmed) == 2*keyLen {
+		if plain, err = hex.DecodeString(trimmed); err != nil {
+			return nil, fmt.Errorf("can't decode key file: %s", err)
+		}
+	}
+	if id == "" {
+		sum := sha256.Sum256(plain)
+		id = "sha256:" + hex.EncodeToString(sum[:])[:fingerprintLen]
+	}
+	return newKey(id, plain, nil)
+}
+
+// Returns the key new data is to be encrypted w/: the key file's key, or a
+// freshly generated KMS data key.
+func NewKey(conf *Config) (*Key, error) {
+	if err := conf.Validate(); err != nil {
+		return nil, err
+	}
+	if conf.KeyFile != "" {
+		return readKeyFile(conf.KeyFile, conf.KeyId)
+	}
+	return generateDataKey(conf)
+}
+
+// Returns the key w/ the given id, the wrapped key being the one recorded w/
+// the data, if any.
+type KeyResolver func(id string, wrapped []byte) (*Key, error)
+
+// Returns a resolver for the keys the configuration's key source produces.
+func (conf *Config) Resolver() KeyResolver {
+	return func(id string, wrapped []byte) (*Key, error) {
+		if conf.KeyFile == "" {
+			return decryptDataKey(conf, id, wrapped)
+		}
+		key, err := readKeyFile(conf.KeyFile, conf.KeyId)
+		if err != nil {
+			return nil, err
+		}
+		if key.Id != id {
+			return nil, fmt.Errorf("data was encrypted w/ key '%s', not '%s'", id,
+				key.Id)
+		}
+		return key, nil
+	}
+}
+
+func frame(typ byte, payload []byte) []byte {
+	buf := make([]byte, headerLen+len(payload))
+	buf[0] = typ
+	binary.BigEndian.PutUint32(buf[1:headerLen], uint32(len(payload)))
+	copy(buf[headerLen:], payload)
+	return buf
+}
+
+// Returns the key frame starting a segment w/ the provided id.
+func (k *Key) header(segment []byte) []byte {
+	payload := make([]byte, 1, 3+segmentIdLen+len(k.Id)+len(k.Wrapped))
+	payload[0] = frameVersion
+	payload = append(payload, segment...)
+	payload = append(payload, 0, 0)
+	binary.BigEndian.PutUint16(payload[1+segmentIdLen:], uint16(len(k.Id)))
+	payload = append(payload, k.Id...)
+	payload = append(payload, k.Wrapped...)
+	return frame(keyFrame, payload)
+}
+
+// Returns the additional data authenticated along w/ the frame of the given
+// type at position `seq` of a segment. The key id is included so frames
+// can't be passed off as encrypted by another key.
+func (k *Key) frameData(typ byte, segment []byte, seq uint64) []byte {
+	ad := make([]byte, 1, 1+segmentIdLen+8+len(k.Id))
+	ad[0] = typ
+	ad = append(ad, segment...)
+	var seqBytes [8]byte
+	binary.BigEndian.PutUint64(seqBytes[:], seq)
+	ad = append(ad, seqBytes[:]...)
+	return append(ad, k.Id...)
+}
+
+// Seals the data into a frame of the given type at position `seq` of a
+// segment.
+func (k *Key) seal(typ byte, segment []byte, seq uint64, data []byte) ([]byte, error) {
+	nonce := make([]byte, nonceLen, nonceLen+len(data)+k.aead.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, fmt.Errorf("can't generate nonce: %s", err)
+	}
+	ad := k.frameData(typ, segment, seq)
+	return frame(typ, k.aead.Seal(nonce, nonce, data, ad)), nil
+}
+
+// Opens the payload of a frame of the given type at position `seq` of a
+// segment.
+func (k *Key) open(typ byte, segment []byte, seq uint64, payload []byte) (
+	[]byte, error) {
+
+	if len(payload) < nonceLen {
+		return nil, errors.New("truncated frame payload")
+	}
+	nonce := payload[:nonceLen]
+	ad := k.frameData(typ, segment, seq)
+	plain, err := k.aead.Open(nil, nonce, payload[nonceLen:], ad)
+	if err != nil {
+		return nil, fmt.Errorf("can't decrypt frame: %s", err)
+	}
+	return plain, nil
+}
+
+// Encrypts everything written to it as a segment, each write becoming a data
+// frame. The key frame is written ahead of the first one, and Close writes
+// the end frame.
+type Writer struct {
+	w       io.Writer
+	key     *Key
+	segment []byte
+	seq     uint64
+	closed  bool
+}
+
+// Returns a Writer encrypting w/ the key to the underlying writer.
+func (k *Key) NewWriter(w io.Writer) *Writer {
+	return &Writer{w: w, key: k}
+}
+
+func (w *Writer) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, errors.New("write to a closed encrypting writer")
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	var header []byte
+	if w.segment == nil {
+		segment := make([]byte, segmentIdLen)
+		if _, err := io.ReadFull(rand.Reader, segment); err != nil {
+			return 0, fmt.Errorf("can't generate segment id: %s", err)
+		}
+		header = w.key.header(segment)
+		w.segment = segment
+	}
+	sealed, err := w.key.seal(dataFrame, w.segment, w.seq, p)
+	if err != nil {
+		return 0, err
+	}
+	if header != nil {
+		sealed = append(header, sealed...)
+	}
+	if _, err = w.w.Write(sealed); err != nil {
+		return 0, err
+	}
+	w.seq++
+	return len(p), nil
+}
+
+// Ends the segment by writing the end frame, w/o closing the underlying
+// writer. Nothing is written if nothing was written before.
+func (w *Writer) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	if w.segment == nil {
+		return nil
+	}
+	sealed, err := w.key.seal(endFrame, w.segment, w.seq, nil)
+	if err != nil {
+		return err
+	}
+	_, err = w.w.Write(sealed)
+	return err
+}
+
+// Reads a frame, returning io.EOF only if there's no data at all.
+func readFrame(r io.Reader) (typ byte, payload []byte, err error) {
+	header := make([]byte, headerLen)
+	if _, err = io.ReadFull(r, header); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			err = ErrTruncated
+		}
+		return
+	}
+	length := binary.BigEndian.Uint32(header[1:])
+	if length > maxFrameLen {
+		return 0, nil, fmt.Errorf("frame too large: %d bytes", length)
+	}
+	payload = make([]byte, length)
+	if _, err = io.ReadFull(r, payload); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			err = ErrTruncated
+		}
+		return 0, nil, err
+	}
+	return header[0], payload, nil
+}
+
+// Parses a key frame's payload into the segment id, the key's id, and the
+// wrapped key.
+func parseKeyFrame(payload []byte) (segment []byte, id string, wrapped []byte,
+	err error) {
+
+	const idStart = 3 + segmentIdLen
+	if len(payload) < idStart || payload[0] != frameVersion {
+		return nil, "", nil, errors.New("unsupported key frame")
+	}
+	segment = payload[1 : 1+segmentIdLen]
+	idLen := int(binary.BigEndian.Uint16(payload[1+segmentIdLen : idStart]))
+	if len(payload) < idStart+idLen {
+		return nil, "", nil, errors.New("truncated key frame")
+	}
+	return segment, string(payload[idStart : idStart+idLen]),
+		payload[idStart+idLen:], nil
+}
+
+// Returns the id of the key that encrypted the data, from its first frame.
+func ReadKeyId(r io.Reader) (string, error) {
+	typ, payload, err := readFrame(r)
+	if err != nil {
+		return "", err
+	}
+	if typ != keyFrame {
+		return "", errors.New("data doesn't start w/ a key frame")
+	}
+	_, id, _, err := parseKeyFrame(payload)
+	return id, err
+}
+
+// Decrypts data written by Writers, resolving the keys named by the key
+// frames as they come up. Segments that are cut short make Read fail w/
+// ErrTruncated, as do any frames that were dropped from the end of a
+// segment.
+type Reader struct {
+	// If set, a segment cut short is read up to where it ends instead, as
+	// when recovering the data of a writer that crashed.
+	AllowTruncated bool
+	r              io.Reader
+	resolve        KeyResolver
+	key            *Key
+	segment        []byte
+	seq            uint64
+	// Whether the current segment's end frame is yet to come.
+	open  bool
+	plain []byte
+}
+
+func NewReader(r io.Reader, resolve KeyResolver) *Reader {
+	return &Reader{r: r, resolve: resolve}
+}
+
+// Returns ErrTruncated for a segment that ended early, unless that's
+// allowed.
+func (r *Reader) truncated() error {
+	r.open = false
+	if r.AllowTruncated {
+		return nil
+	}
+	return ErrTruncated
+}
+
+func (r *Reader) Read(p []byte) (n int, err error) {
+	for len(r.plain) == 0 {
+		typ, payload, err := readFrame(r.r)
+		if err == io.EOF && r.open {
+			err = r.truncated()
+			if err == nil {
+				err = io.EOF
+			}
+		} else if err == ErrTruncated && r.AllowTruncated {
+			err = io.EOF
+		}
+		if err != nil {
+			return 0, err
+		}
+		switch typ {
+		case keyFrame:
+			if r.open {
+				if err = r.truncated(); err != nil {
+					return 0, err
+				}
+			}
+			segment, id, wrapped, err := parseKeyFrame(payload)
+			if err != nil {
+				return 0, err
+			}
+			if r.key == nil || r.key.Id != id {
+				if r.key, err = r.resolve(id, wrapped); err != nil {
+					return 0, fmt.Errorf("can't get key '%s': %s", id, err)
+				}
+			}
+			r.segment = segment
+			r.seq = 0
+			r.open = true
+		case dataFrame:
+			if !r.open {
+				return 0, errors.New("data frame outside of a segment")
+			}
+			if r.plain, err = r.key.open(dataFrame, r.segment, r.seq,
+				payload); err != nil {
+
+				return 0, err
+			}
+			r.seq++
+		case endFrame:
+			if !r.open {
+				return 0, errors.New("end frame outside of a segment")
+			}
+			if _, err = r.key.open(endFrame, r.segment, r.seq, payload); err != nil {
+				return 0, err
+			}
+			r.open = false
+		default:
+			return 0, fmt.Errorf("unknown frame type '%c'", typ)
+		}
+	}
+	n = copy(p, r.plain)
+	r.plain = r.plain[n:]
+	return n, nil
+}
@@ -0,0 +1,230 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package encrypt
+
+import (
+	"bytes"
+	"encoding/json"
+	pipeline_ts "github.com/mozilla-services/heka/pipeline/testsupport"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const testKeyHex = "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f"
+
+// Writes the data w/ a Writer, one write per chunk, returning the offset of
+// each frame in the output after the key frame.
+func encryptFrames(key *Key, chunks ...string) (data []byte, offsets []int) {
+	buf := new(bytes.Buffer)
+	w := key.NewWriter(buf)
+	for _, chunk := range chunks {
+		w.Write([]byte(chunk))
+		offsets = append(offsets, buf.Len())
+	}
+	w.Close()
+	return buf.Bytes(), offsets
+}
+
+func encryptChunks(key *Key, chunks ...string) []byte {
+	data, _ := encryptFrames(key, chunks...)
+	return data
+}
+
+func EncryptSpec(c gs.Context) {
+	tmpDir, err := ioutil.TempDir("", "encrypt-tests")
+	c.Assume(err, gs.IsNil)
+	defer os.RemoveAll(tmpDir)
+	keyPath := filepath.Join(tmpDir, "key")
+	err = ioutil.WriteFile(keyPath, []byte(testKeyHex+"\n"), 0600)
+	c.Assume(err, gs.IsNil)
+
+	c.Specify("Encryption w/ a key file", func() {
+		conf := &Config{KeyFile: keyPath}
+		key, err := NewKey(conf)
+		c.Assume(err, gs.IsNil)
+
+		c.Specify("identifies the key by its fingerprint", func() {
+			c.Expect(strings.HasPrefix(key.Id, "sha256:"), gs.IsTrue)
+			c.Expect(len(key.Id), gs.Equals, len("sha256:")+16)
+			conf.KeyId = "archive-2015"
+			key, err = NewKey(conf)
+			c.Assume(err, gs.IsNil)
+			c.Expect(key.Id, gs.Equals, "archive-2015")
+		})
+
+		c.Specify("round trips the data", func() {
+			data := encryptChunks(key, "first line\n", "second line\n")
+			c.Expect(bytes.Contains(data, []byte("line")), gs.IsFalse)
+
+			id, err := ReadKeyId(bytes.NewReader(data))
+			c.Expect(err, gs.IsNil)
+			c.Expect(id, gs.Equals, key.Id)
+
+			plain, err := ioutil.ReadAll(NewReader(bytes.NewReader(data), conf.Resolver()))
+			c.Expect(err, gs.IsNil)
+			c.Expect(string(plain), gs.Equals, "first line\nsecond line\n")
+		})
+
+		c.Specify("reads data appended w/ a new writer", func() {
+			data := encryptChunks(key, "one\n")
+			data = append(data, encryptChunks(key, "two\n")...)
+			plain, err := ioutil.ReadAll(NewReader(bytes.NewReader(data), conf.Resolver()))
+			c.Expect(err, gs.IsNil)
+			c.Expect(string(plain), gs.Equals, "one\ntwo\n")
+		})
+
+		c.Specify("detects tampering", func() {
+			data := encryptChunks(key, "some data")
+			data[len(data)-1] ^= 1
+			_, err := ioutil.ReadAll(NewReader(bytes.NewReader(data), conf.Resolver()))
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+
+		c.Specify("detects truncation", func() {
+			data, offsets := encryptFrames(key, "one\n", "two\n", "three\n")
+			// Without the end frame, and without the last data frame too.
+			for _, end := range offsets[1:] {
+				reader := NewReader(bytes.NewReader(data[:end]), conf.Resolver())
+				_, err := ioutil.ReadAll(reader)
+				c.Expect(err, gs.Equals, ErrTruncated)
+			}
+			// Cut in the middle of a frame.
+			_, err := ioutil.ReadAll(NewReader(bytes.NewReader(data[:len(data)-3]),
+				conf.Resolver()))
+			c.Expect(err, gs.Equals, ErrTruncated)
+			// A segment cut short followed by another one.
+			cut := append(data[:offsets[1]:offsets[1]], encryptChunks(key, "four\n")...)
+			_, err = ioutil.ReadAll(NewReader(bytes.NewReader(cut), conf.Resolver()))
+			c.Expect(err, gs.Equals, ErrTruncated)
+
+			c.Specify("unless that's allowed", func() {
+				reader := NewReader(bytes.NewReader(cut), conf.Resolver())
+				reader.AllowTruncated = true
+				plain, err := ioutil.ReadAll(reader)
+				c.Expect(err, gs.IsNil)
+				c.Expect(string(plain), gs.Equals, "one\ntwo\nfour\n")
+			})
+		})
+
+		c.Specify("detects dropped and reordered frames", func() {
+			data, offsets := encryptFrames(key, "one\n", "two\n", "three\n")
+			first := data[offsets[0]:offsets[1]]
+			second := data[offsets[1]:offsets[2]]
+			var dropped, swapped []byte
+			dropped = append(dropped, data[:offsets[0]]...)
+			dropped = append(dropped, data[offsets[1]:]...)
+			swapped = append(swapped, data[:offsets[0]]...)
+			swapped = append(swapped, second...)
+			swapped = append(swapped, first...)
+			swapped = append(swapped, data[offsets[2]:]...)
+			for _, bad := range [][]byte{dropped, swapped} {
+				_, err := ioutil.ReadAll(NewReader(bytes.NewReader(bad), conf.Resolver()))
+				c.Expect(err, gs.Not(gs.IsNil))
+			}
+		})
+
+		c.Specify("won't take frames from another segment", func() {
+			data, offsets := encryptFrames(key, "one\n", "two\n")
+			other, otherOffsets := encryptFrames(key, "evil\n", "data\n")
+			var spliced []byte
+			spliced = append(spliced, data[:offsets[0]]...)
+			spliced = append(spliced, other[otherOffsets[0]:]...)
+			_, err := ioutil.ReadAll(NewReader(bytes.NewReader(spliced), conf.Resolver()))
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+
+		c.Specify("won't decrypt w/ another key", func() {
+			data := encryptChunks(key, "some data")
+			other := &Config{KeyFile: keyPath, KeyId: "other"}
+			_, err := ioutil.ReadAll(NewReader(bytes.NewReader(data), other.Resolver()))
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+
+		c.Specify("rejects keys of the wrong size", func() {
+			err := ioutil.WriteFile(keyPath, []byte("too short"), 0600)
+			c.Assume(err, gs.IsNil)
+			_, err = NewKey(conf)
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+	})
+
+	c.Specify("Encryption config", func() {
+		c.Specify("requires exactly one key source", func() {
+			c.Expect((&Config{}).Validate(), gs.Not(gs.IsNil))
+			conf := &Config{KeyFile: keyPath, KmsKeyId: "alias/logs", KmsRegion: "us-east-1"}
+			c.Expect(conf.Validate(), gs.Not(gs.IsNil))
+			c.Expect((&Config{KmsKeyId: "alias/logs"}).Validate(), gs.Not(gs.IsNil))
+		})
+	})
+
+	c.Specify("Encryption w/ KMS", func() {
+		plainKey := bytes.Repeat([]byte{7}, keyLen)
+		wrapped := []byte("wrapped key")
+		var targets []string
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter,
+			req *http.Request) {
+
+			targets = append(targets, req.Header.Get("X-Amz-Target"))
+			var params map[string]interface{}
+			json.NewDecoder(req.Body).Decode(&params)
+			if req.Header.Get("X-Amz-Target") == "TrentService.Decrypt" &&
+				params["CiphertextBlob"] != "d3JhcHBlZCBrZXk=" {
+
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(`{"__type":"InvalidCiphertextException"}`))
+				return
+			}
+			json.NewEncoder(w).Encode(kmsDataKey{
+				KeyId:          "arn:aws:kms:us-east-1:123456789012:key/abcd",
+				Plaintext:      plainKey,
+				CiphertextBlob: wrapped,
+			})
+		}))
+		defer server.Close()
+		conf := &Config{
+			KmsKeyId:        "alias/logs",
+			KmsRegion:       "us-east-1",
+			AccessKeyId:     "AKIDEXAMPLE",
+			SecretAccessKey: "secret",
+			KmsEndpoint:     server.URL,
+		}
+
+		c.Specify("generates a data key and unwraps it for reading", func() {
+			key, err := NewKey(conf)
+			c.Assume(err, gs.IsNil)
+			c.Expect(key.Id, gs.Equals, "arn:aws:kms:us-east-1:123456789012:key/abcd")
+			c.Expect(string(key.Wrapped), gs.Equals, "wrapped key")
+
+			data := encryptChunks(key, "some data")
+			plain, err := ioutil.ReadAll(NewReader(bytes.NewReader(data), conf.Resolver()))
+			c.Expect(err, gs.IsNil)
+			c.Expect(string(plain), gs.Equals, "some data")
+			c.Expect(len(targets), gs.Equals, 2)
+			c.Expect(targets[0], gs.Equals, "TrentService.GenerateDataKey")
+			c.Expect(targets[1], gs.Equals, "TrentService.Decrypt")
+		})
+
+		c.Specify("reports KMS errors", func() {
+			_, err := conf.Resolver()("some key", []byte("bogus"))
+			c.Expect(err, gs.Not(gs.IsNil))
+			c.Expect(err.Error(), pipeline_ts.StringContains, "InvalidCiphertextException")
+		})
+	})
+}
@@ -0,0 +1,111 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package encrypt
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/mozilla-services/heka/plugins/sigv4"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+var kmsClient = &http.Client{Timeout: 30 * time.Second}
+
+// Calls a KMS API action w/ the JSON protocol, decoding the response into
+// result.
+func kmsCall(conf *Config, action string, params, result interface{}) error {
+	creds, err := sigv4.NewCredentials(conf.AccessKeyId, conf.SecretAccessKey, "")
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+	endpoint := conf.KmsEndpoint
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://kms.%s.amazonaws.com/", conf.KmsRegion)
+	}
+	req, err := http.NewRequest("POST", endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "TrentService."+action)
+	sigv4.Sign(req, body, creds, conf.KmsRegion, "kms", time.Now())
+
+	resp, err := kmsClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("KMS %s request failed: %s", action, err)
+	}
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("can't read KMS %s response: %s", action, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		var kmsErr struct {
+			Type    string `json:"__type"`
+			Message string `json:"message"`
+		}
+		json.Unmarshal(respBody, &kmsErr)
+		return fmt.Errorf("KMS %s failed: %d %s %s", action, resp.StatusCode,
+			kmsErr.Type, kmsErr.Message)
+	}
+	return json.Unmarshal(respBody, result)
+}
+
+// Data key returned by KMS, w/ the []byte fields base64 encoded in the JSON.
+type kmsDataKey struct {
+	KeyId          string
+	Plaintext      []byte
+	CiphertextBlob []byte
+}
+
+// Generates a new data key under the configured KMS key. The key's id is
+// the ARN of the KMS key, and the wrapped key its encrypted copy.
+func generateDataKey(conf *Config) (*Key, error) {
+	var result kmsDataKey
+	err := kmsCall(conf, "GenerateDataKey", map[string]string{
+		"KeyId":   conf.KmsKeyId,
+		"KeySpec": "AES_256",
+	}, &result)
+	if err != nil {
+		return nil, err
+	}
+	if result.KeyId == "" || len(result.CiphertextBlob) == 0 {
+		return nil, errors.New("KMS returned an incomplete data key")
+	}
+	return newKey(result.KeyId, result.Plaintext, result.CiphertextBlob)
+}
+
+// Has KMS decrypt a wrapped data key.
+func decryptDataKey(conf *Config, id string, wrapped []byte) (*Key, error) {
+	if len(wrapped) == 0 {
+		return nil, errors.New("no wrapped data key")
+	}
+	var result kmsDataKey
+	err := kmsCall(conf, "Decrypt", map[string][]byte{
+		"CiphertextBlob": wrapped,
+	}, &result)
+	if err != nil {
+		return nil, err
+	}
+	return newKey(id, result.Plaintext, wrapped)
+}
@@ -0,0 +1,109 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package plugins
+
+import (
+	"strings"
+	"sync"
+)
+
+// Settings for cleaning up dynamic field names before they're written to a
+// schema-on-write store, so producer field names can't create invalid keys
+// or an ever growing number of mappings.
+type FieldNameConfig struct {
+	// If set, every "." in a field name is replaced w/ this string, so the
+	// store doesn't treat dotted names as nested objects.
+	ReplaceDots string `toml:"replace_dots"`
+	// If set, each run of whitespace inside a field name is replaced w/ this
+	// string, and leading and trailing whitespace is dropped.
+	ReplaceSpaces string `toml:"replace_spaces"`
+	// Whether field names are lowercased.
+	Lowercase bool
+	// Maximum number of dot separated levels a name may nest, the levels
+	// past it are joined w/ "_". 0 means no limit.
+	MaxDepth int `toml:"max_depth"`
+}
+
+// Rewrites field names as described by a FieldNameConfig. Rewritten names
+// are cached, since the same few names show up in message after message.
+type FieldNameSanitizer struct {
+	conf  FieldNameConfig
+	lock  sync.RWMutex
+	names map[string]string
+}
+
+// Returns a sanitizer for conf, or nil if conf is nil. A nil sanitizer leaves
+// names unchanged.
+func NewFieldNameSanitizer(conf *FieldNameConfig) *FieldNameSanitizer {
+	if conf == nil {
+		return nil
+	}
+	return &FieldNameSanitizer{
+		conf:  *conf,
+		names: make(map[string]string),
+	}
+}
+
+// Returns the sanitized version of name.
+func (s *FieldNameSanitizer) Sanitize(name string) string {
+	if s == nil {
+		return name
+	}
+	s.lock.RLock()
+	clean, ok := s.names[name]
+	s.lock.RUnlock()
+	if ok {
+		return clean
+	}
+	clean = s.sanitize(name)
+	s.lock.Lock()
+	// Keep the cache from growing w/o bound when names are unique per
+	// message.
+	if len(s.names) >= 10000 {
+		s.names = make(map[string]string)
+	}
+	s.names[name] = clean
+	s.lock.Unlock()
+	return clean
+}
+
+func (s *FieldNameSanitizer) sanitize(name string) string {
+	if s.conf.Lowercase {
+		name = strings.ToLower(name)
+	}
+	if s.conf.ReplaceSpaces != "" {
+		name = strings.Join(strings.Fields(name), s.conf.ReplaceSpaces)
+	}
+	// Empty levels, as in "a..b" or ".a", make invalid keys.
+	levels := strings.Split(name, ".")
+	kept := levels[:0]
+	for _, level := range levels {
+		if level != "" {
+			kept = append(kept, level)
+		}
+	}
+	if len(kept) == 0 {
+		return "_"
+	}
+	if s.conf.MaxDepth > 0 && len(kept) > s.conf.MaxDepth {
+		last := strings.Join(kept[s.conf.MaxDepth-1:], "_")
+		kept = append(kept[:s.conf.MaxDepth-1], last)
+	}
+	sep := "."
+	if s.conf.ReplaceDots != "" {
+		sep = s.conf.ReplaceDots
+	}
+	return strings.Join(kept, sep)
+}
@@ -0,0 +1,59 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package plugins
+
+import (
+	gs "github.com/rafrombrc/gospec/src/gospec"
+)
+
+func FieldNameSanitizerSpec(c gs.Context) {
+	c.Specify("A field name sanitizer", func() {
+		conf := new(FieldNameConfig)
+
+		c.Specify("leaves names alone when nil", func() {
+			var s *FieldNameSanitizer
+			c.Expect(NewFieldNameSanitizer(nil), gs.IsNil)
+			c.Expect(s.Sanitize("Some.Name"), gs.Equals, "Some.Name")
+		})
+
+		c.Specify("replaces dots and spaces", func() {
+			conf.ReplaceDots = "_"
+			conf.ReplaceSpaces = "-"
+			s := NewFieldNameSanitizer(conf)
+			c.Expect(s.Sanitize(" request time.ms "), gs.Equals, "request-time_ms")
+		})
+
+		c.Specify("lowercases", func() {
+			conf.Lowercase = true
+			s := NewFieldNameSanitizer(conf)
+			c.Expect(s.Sanitize("UserAgent"), gs.Equals, "useragent")
+			// Cached names come back the same.
+			c.Expect(s.Sanitize("UserAgent"), gs.Equals, "useragent")
+		})
+
+		c.Specify("limits the nesting depth", func() {
+			conf.MaxDepth = 2
+			s := NewFieldNameSanitizer(conf)
+			c.Expect(s.Sanitize("a.b.c.d"), gs.Equals, "a.b_c_d")
+			c.Expect(s.Sanitize("a.b"), gs.Equals, "a.b")
+		})
+
+		c.Specify("drops empty levels", func() {
+			s := NewFieldNameSanitizer(conf)
+			c.Expect(s.Sanitize(".a..b."), gs.Equals, "a.b")
+			c.Expect(s.Sanitize("..."), gs.Equals, "_")
+		})
+	})
+}
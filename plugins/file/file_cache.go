@@ -0,0 +1,122 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package file
+
+import (
+	"container/list"
+	"fmt"
+	"github.com/mozilla-services/heka/plugins"
+	"github.com/mozilla-services/heka/plugins/encrypt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// An output file that's being held open by a fileCache.
+type cachedFile struct {
+	path  string
+	file  *os.File
+	dirty bool
+	// Where the data is written, the file or an encrypting writer for it.
+	out io.Writer
+}
+
+// Bounded cache of open output files, used when the output path is derived
+// from message data. When the cache is full the least recently used file is
+// closed to make room.
+type fileCache struct {
+	max        int
+	perm       os.FileMode
+	folderPerm os.FileMode
+	files      map[string]*list.Element
+	lru        *list.List
+	// If set, the files' data is encrypted w/ this key.
+	key *encrypt.Key
+}
+
+func newFileCache(max int, perm, folderPerm os.FileMode) *fileCache {
+	return &fileCache{
+		max:        max,
+		perm:       perm,
+		folderPerm: folderPerm,
+		files:      make(map[string]*list.Element),
+		lru:        list.New(),
+	}
+}
+
+// Returns the open file for the specified path, opening it if necessary.
+func (fc *fileCache) get(path string) (cf *cachedFile, err error) {
+	if elem, ok := fc.files[path]; ok {
+		fc.lru.MoveToFront(elem)
+		return elem.Value.(*cachedFile), nil
+	}
+	for fc.lru.Len() >= fc.max {
+		fc.remove(fc.lru.Back())
+	}
+
+	basePath := filepath.Dir(path)
+	if err = os.MkdirAll(basePath, fc.folderPerm); err != nil {
+		return nil, fmt.Errorf("can't create directory '%s': %s", basePath, err)
+	}
+	if err = plugins.CheckWritePermission(basePath); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, fc.perm)
+	if err != nil {
+		return nil, err
+	}
+	cf = &cachedFile{path: path, file: file, out: file}
+	if fc.key != nil {
+		cf.out = fc.key.NewWriter(file)
+	}
+	fc.files[path] = fc.lru.PushFront(cf)
+	return cf, nil
+}
+
+// Number of files currently open.
+func (fc *fileCache) len() int {
+	return fc.lru.Len()
+}
+
+// Syncs any files w/ unsynced data.
+func (fc *fileCache) sync() {
+	for elem := fc.lru.Front(); elem != nil; elem = elem.Next() {
+		cf := elem.Value.(*cachedFile)
+		if cf.dirty {
+			cf.file.Sync()
+			cf.dirty = false
+		}
+	}
+}
+
+// Syncs and closes all of the open files.
+func (fc *fileCache) closeAll() {
+	for fc.lru.Len() > 0 {
+		fc.remove(fc.lru.Back())
+	}
+}
+
+func (fc *fileCache) remove(elem *list.Element) {
+	cf := fc.lru.Remove(elem).(*cachedFile)
+	delete(fc.files, cf.path)
+	if w, ok := cf.out.(*encrypt.Writer); ok {
+		w.Close()
+		cf.dirty = true
+	}
+	if cf.dirty {
+		cf.file.Sync()
+	}
+	cf.file.Close()
+}
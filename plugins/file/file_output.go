@@ -22,10 +22,14 @@ import (
 	. "github.com/mozilla-services/heka/pipeline"
 	"github.com/cactus/gostrftime"
 	"github.com/mozilla-services/heka/plugins"
+	"github.com/mozilla-services/heka/plugins/archive"
+	"github.com/mozilla-services/heka/plugins/encrypt"
 	"github.com/rafrombrc/go-notify"
+	"io"
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -36,12 +40,24 @@ type FileOutput struct {
 	perm       os.FileMode
 	flushOpAnd bool
 	file       *os.File
+	// Where the data is written, the file or an encrypting writer for it.
+	out        io.Writer
+	key        *encrypt.Key
 	batchChan  chan []byte
 	backChan   chan []byte
 	folderPerm os.FileMode
 	timerChan  <-chan time.Time
 	rotateChan chan time.Time
 	closing    chan struct{}
+	size       int64
+	dirty      bool
+	// Set if the path contains message placeholders.
+	dynamic bool
+	files   *fileCache
+	// Index of the current file, and the channel the receiver hands the
+	// records of each batch to the committer on.
+	index      *archive.Index
+	recordChan chan []archive.Record
 }
 
 // ConfigStruct for FileOutput plugin.
@@ -50,6 +66,8 @@ type FileOutputConfig struct {
 	// If date rotation is in use, then the output file name can support
 	// Go's time.Format syntax to embed timestamps in the filename:
 	// http://golang.org/pkg/time/#Time.Format
+	// The path may also contain `%{<name>}` placeholders, in which case each
+	// message is written to the file generated from its own data.
 	Path string
 
 	// Output file permissions (default "644").
@@ -83,6 +101,32 @@ type FileOutputConfig struct {
 	// output. We do some magic to default to true if ProtobufEncoder is used,
 	// false otherwise.
 	UseFraming *bool `toml:"use_framing"`
+
+	// Size in bytes at which the output file should be rotated. The current
+	// file will be renamed with a numeric suffix (i.e. `<path>.1`, `<path>.2`,
+	// etc., higher numbers being newer) and a new file will be opened
+	// (default 0, i.e. disabled).
+	RotationSize uint64 `toml:"rotation_size"`
+
+	// Interval at which written file data should be fsynced to disk, in
+	// milliseconds. Set to 0 to sync after every write (default 0).
+	SyncInterval uint32 `toml:"sync_interval"`
+
+	// Maximum number of files that will be held open at once when the path
+	// contains message placeholders (default 32).
+	MaxOpenFiles int `toml:"max_open_files"`
+
+	// If set, the data is encrypted w/ AES-GCM using the configured key.
+	Encryption *encrypt.Config `toml:"encryption"`
+
+	// If true, a sidecar index w/ the time range, message count, and message
+	// types of each file, and the offset of every `index_interval`th record,
+	// is maintained next to it (default false).
+	Index bool
+
+	// Number of records between the offsets stored in the index (default
+	// 1000).
+	IndexInterval uint32 `toml:"index_interval"`
 }
 
 func (o *FileOutput) ConfigStruct() interface{} {
@@ -93,6 +137,8 @@ func (o *FileOutput) ConfigStruct() interface{} {
 		FlushCount:       1,
 		FlushOperator:    "AND",
 		FolderPerm:       "700",
+		MaxOpenFiles:     32,
+		IndexInterval:    1000,
 	}
 }
 
@@ -130,6 +176,38 @@ func (o *FileOutput) Init(config interface{}) (err error) {
 		return err
 	}
 
+	if conf.Encryption != nil {
+		if o.key, err = encrypt.NewKey(conf.Encryption); err != nil {
+			return fmt.Errorf("FileOutput '%s' can't get encryption key: %s", o.Path, err)
+		}
+	}
+
+	if conf.Index {
+		if conf.Encryption != nil {
+			return errors.New("`index` isn't supported w/ `encryption`")
+		}
+		if conf.IndexInterval < 1 {
+			return errors.New("`index_interval` must be at least 1")
+		}
+	}
+
+	if o.dynamic = strings.Contains(conf.Path, "%{"); o.dynamic {
+		if conf.Index {
+			return errors.New(
+				"`index` isn't supported when `path` contains message placeholders")
+		}
+		if conf.RotationInterval != 0 || conf.RotationSize != 0 {
+			return errors.New(
+				"rotation isn't supported when `path` contains message placeholders")
+		}
+		if conf.MaxOpenFiles < 1 {
+			return errors.New("`max_open_files` must be at least 1")
+		}
+		o.files = newFileCache(conf.MaxOpenFiles, o.perm, o.folderPerm)
+		o.files.key = o.key
+		return nil
+	}
+
 	o.closing = make(chan struct{})
 	switch conf.RotationInterval {
 	case 0:
@@ -151,6 +229,9 @@ func (o *FileOutput) Init(config interface{}) (err error) {
 	o.batchChan = make(chan []byte)
 	o.backChan = make(chan []byte, 2) // Never block on the hand-back
 	o.rotateChan = make(chan time.Time)
+	if conf.Index {
+		o.recordChan = make(chan []archive.Record, 1)
+	}
 	return nil
 }
 
@@ -189,10 +270,152 @@ func (o *FileOutput) openFile() (err error) {
 	if err = plugins.CheckWritePermission(basePath); err != nil {
 		return
 	}
-	o.file, err = os.OpenFile(o.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, o.perm)
+	if o.file, err = os.OpenFile(o.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE,
+		o.perm); err != nil {
+		return
+	}
+	o.size = 0
+	if fi, e := o.file.Stat(); e == nil {
+		o.size = fi.Size()
+	}
+	o.out = o.file
+	if o.key != nil {
+		o.out = o.key.NewWriter(o.file)
+	}
+	if o.Index {
+		if err = o.loadIndex(); err != nil {
+			o.file.Close()
+		}
+	}
+	return
+}
+
+// Loads the index of the current file. If the file has no index, or one that
+// doesn't cover all of it, the index is rebuilt from the file's contents.
+func (o *FileOutput) loadIndex() (err error) {
+	interval := int64(o.IndexInterval)
+	idx, e := archive.Read(archive.IndexPath(o.path))
+	if e == nil && idx.Size == o.size && idx.Interval == interval {
+		o.index = idx
+		return
+	}
+	if o.size == 0 {
+		o.index = archive.New(interval)
+		return
+	}
+	f, err := os.Open(o.path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	if idx, err = archive.Build(io.LimitReader(f, o.size), interval); err != nil {
+		return fmt.Errorf("can't rebuild index: %s", err)
+	}
+	idx.Size = o.size
+	o.index = idx
+	return idx.Write(archive.IndexPath(o.path))
+}
+
+// Adds the records of a batch written at the provided offset to the index,
+// writing the index out if they started a new entry.
+func (o *FileOutput) indexRecords(offset int64, records []archive.Record) error {
+	var newEntry bool
+	for _, rec := range records {
+		if o.index.Add(offset, rec) {
+			newEntry = true
+		}
+		offset += int64(rec.Size)
+	}
+	if !newEntry {
+		return nil
+	}
+	return o.index.Write(archive.IndexPath(o.path))
+}
+
+// Hands the records of a batch that's about to be sent on the batch channel
+// to the committer, if the output maintains an index. Returns the slice to
+// collect the next batch's records in.
+func (o *FileOutput) sendRecords(records []archive.Record) []archive.Record {
+	if o.recordChan == nil {
+		return records
+	}
+	o.recordChan <- records
+	return make([]archive.Record, 0, cap(records))
+}
+
+// closeFile ends any encrypted segment, syncs any unsynced data, writes out
+// the index, and closes the current output file.
+func (o *FileOutput) closeFile() (err error) {
+	if w, ok := o.out.(*encrypt.Writer); ok {
+		if err = w.Close(); err != nil {
+			err = fmt.Errorf("can't end encrypted data in '%s': %s", o.path, err)
+		}
+		o.dirty = true
+	}
+	if o.dirty {
+		o.file.Sync()
+		o.dirty = false
+	}
+	o.file.Close()
+	if o.index != nil {
+		if e := o.index.Write(archive.IndexPath(o.path)); e != nil && err == nil {
+			err = fmt.Errorf("can't write index for '%s': %s", o.path, e)
+		}
+	}
+	return
+}
+
+// Returns the highest numeric suffix of the size rotated copies of the
+// output file, 0 if there are none.
+func (o *FileOutput) maxRotatedSuffix() (max int, err error) {
+	dir, base := filepath.Split(o.path)
+	if dir == "" {
+		dir = "."
+	}
+	d, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	names, err := d.Readdirnames(-1)
+	d.Close()
+	if err != nil {
+		return
+	}
+	for _, name := range names {
+		if !strings.HasPrefix(name, base+".") {
+			continue
+		}
+		if i, e := strconv.Atoi(name[len(base)+1:]); e == nil && i > max {
+			max = i
+		}
+	}
 	return
 }
 
+// rotateBySize moves the current output file out of the way, renaming it w/
+// a numeric suffix one higher than that of any existing rotated copy, so
+// higher suffixes are always newer even after older copies are removed, and
+// opens a fresh file at the original path.
+func (o *FileOutput) rotateBySize() (err error) {
+	if err = o.closeFile(); err != nil {
+		return
+	}
+	max, err := o.maxRotatedSuffix()
+	if err != nil {
+		return fmt.Errorf("can't list rotated copies of '%s': %s", o.path, err)
+	}
+	rotatedPath := fmt.Sprintf("%s.%d", o.path, max+1)
+	if err = os.Rename(o.path, rotatedPath); err != nil {
+		return fmt.Errorf("can't rename '%s' to '%s': %s", o.path, rotatedPath, err)
+	}
+	if o.index != nil {
+		if err = os.Rename(archive.IndexPath(o.path), archive.IndexPath(rotatedPath)); err != nil {
+			return fmt.Errorf("can't rename index of '%s': %s", o.path, err)
+		}
+	}
+	return o.openFile()
+}
+
 func (o *FileOutput) Run(or OutputRunner, h PluginHelper) error {
 	enc := or.Encoder()
 	if enc == nil {
@@ -205,12 +428,91 @@ func (o *FileOutput) Run(or OutputRunner, h PluginHelper) error {
 			or.SetUseFraming(true)
 		}
 	}
+	if o.Index {
+		// Readers of the index expect Heka framed protobuf messages.
+		_, ok := enc.(*ProtobufEncoder)
+		if !ok || (o.UseFraming != nil && !*o.UseFraming) {
+			return errors.New("`index` requires ProtobufEncoder w/ framing")
+		}
+	}
 
+	if o.dynamic {
+		return o.dynamicReceiver(or)
+	}
 	errChan := make(chan error, 1)
 	go o.committer(or, errChan)
 	return o.receiver(or, errChan)
 }
 
+// Keeps message data from escaping the configured directory structure.
+func sanitizePathValue(val string) string {
+	val = strings.Replace(val, string(os.PathSeparator), "_", -1)
+	return strings.Replace(val, "..", "_", -1)
+}
+
+// Returns the file path for a message when the path contains placeholders.
+func (o *FileOutput) dynamicPath(pack *PipelinePack) string {
+	return plugins.InterpolateMessageStringEscaped(o.Path, pack.Message, sanitizePathValue)
+}
+
+// Writes each message directly to the file generated from its data, keeping
+// a bounded set of files open.
+func (o *FileOutput) dynamicReceiver(or OutputRunner) (err error) {
+	var (
+		pack     *PipelinePack
+		outBytes []byte
+		cf       *cachedFile
+		e        error
+		n        int
+		ok       = true
+		inChan   = or.InChan()
+		syncChan <-chan time.Time
+	)
+	defer o.files.closeAll()
+
+	hupChan := make(chan interface{})
+	notify.Start(RELOAD, hupChan)
+	defer notify.Stop(RELOAD, hupChan)
+
+	if o.SyncInterval > 0 {
+		syncTicker := time.NewTicker(time.Duration(o.SyncInterval) * time.Millisecond)
+		defer syncTicker.Stop()
+		syncChan = syncTicker.C
+	}
+
+	for ok {
+		select {
+		case pack, ok = <-inChan:
+			if !ok {
+				break
+			}
+			if outBytes, e = or.Encode(pack); e != nil {
+				or.LogError(e)
+			} else if outBytes != nil {
+				path := o.dynamicPath(pack)
+				if cf, e = o.files.get(path); e != nil {
+					or.LogError(fmt.Errorf("can't open '%s': %s", path, e))
+				} else if n, e = cf.out.Write(outBytes); e != nil {
+					or.LogError(fmt.Errorf("Can't write to %s: %s", path, e))
+				} else if n != len(outBytes) {
+					or.LogError(fmt.Errorf("Truncated output for %s", path))
+				} else if o.SyncInterval == 0 {
+					cf.file.Sync()
+				} else {
+					cf.dirty = true
+				}
+			}
+			pack.Recycle()
+		case <-syncChan:
+			o.files.sync()
+		case <-hupChan:
+			// Files will be reopened as they're needed.
+			o.files.closeAll()
+		}
+	}
+	return
+}
+
 func (o *FileOutput) receiver(or OutputRunner, errChan chan error) (err error) {
 	var (
 		pack            *PipelinePack
@@ -220,6 +522,7 @@ func (o *FileOutput) receiver(or OutputRunner, errChan chan error) (err error) {
 		msgCounter      uint32
 		intervalElapsed bool
 		outBytes        []byte
+		records         []archive.Record
 	)
 	ok := true
 	outBatch := make([]byte, 0, 10000)
@@ -239,6 +542,7 @@ func (o *FileOutput) receiver(or OutputRunner, errChan chan error) (err error) {
 			if !ok {
 				// Closed inChan => we're shutting down, flush data
 				if len(outBatch) > 0 {
+					o.sendRecords(records)
 					o.batchChan <- outBatch
 				}
 				close(o.batchChan)
@@ -249,6 +553,13 @@ func (o *FileOutput) receiver(or OutputRunner, errChan chan error) (err error) {
 			} else if outBytes != nil {
 				outBatch = append(outBatch, outBytes...)
 				msgCounter++
+				if o.recordChan != nil {
+					records = append(records, archive.Record{
+						Timestamp: pack.Message.GetTimestamp(),
+						Type:      pack.Message.GetType(),
+						Size:      len(outBytes),
+					})
+				}
 			}
 			pack.Recycle()
 
@@ -260,6 +571,7 @@ func (o *FileOutput) receiver(or OutputRunner, errChan chan error) (err error) {
 				if !o.flushOpAnd || o.FlushInterval == 0 || intervalElapsed {
 					// This will block until the other side is ready to accept
 					// this batch, freeing us to start on the next one.
+					records = o.sendRecords(records)
 					o.batchChan <- outBatch
 					outBatch = <-o.backChan
 					msgCounter = 0
@@ -275,6 +587,7 @@ func (o *FileOutput) receiver(or OutputRunner, errChan chan error) (err error) {
 
 				// This will block until the other side is ready to accept
 				// this batch, freeing us to start on the next one.
+				records = o.sendRecords(records)
 				o.batchChan <- outBatch
 				outBatch = <-o.backChan
 				msgCounter = 0
@@ -304,27 +617,64 @@ func (o *FileOutput) committer(or OutputRunner, errChan chan error) {
 	hupChan := make(chan interface{})
 	notify.Start(RELOAD, hupChan)
 
+	var syncChan <-chan time.Time
+	if o.SyncInterval > 0 {
+		syncTicker := time.NewTicker(time.Duration(o.SyncInterval) * time.Millisecond)
+		defer syncTicker.Stop()
+		syncChan = syncTicker.C
+	}
+
 	for ok {
 		select {
 		case outBatch, ok = <-o.batchChan:
 			if !ok {
 				// Channel is closed => we're shutting down, exit cleanly.
-				o.file.Close()
+				if err = o.closeFile(); err != nil {
+					or.LogError(err)
+				}
 				close(o.closing)
 				break
 			}
-			n, err := o.file.Write(outBatch)
+			offset := o.size
+			n, err := o.out.Write(outBatch)
+			o.size += int64(n)
 			if err != nil {
 				or.LogError(fmt.Errorf("Can't write to %s: %s", o.path, err))
 			} else if n != len(outBatch) {
 				or.LogError(fmt.Errorf("Truncated output for %s", o.path))
-			} else {
+			} else if o.SyncInterval == 0 {
 				o.file.Sync()
+			} else {
+				o.dirty = true
+			}
+			if o.recordChan != nil {
+				records := <-o.recordChan
+				if n == len(outBatch) {
+					if err = o.indexRecords(offset, records); err != nil {
+						or.LogError(fmt.Errorf("can't write index for '%s': %s", o.path, err))
+					}
+				}
 			}
 			outBatch = outBatch[:0]
 			o.backChan <- outBatch
+			if o.RotationSize > 0 && uint64(o.size) >= o.RotationSize {
+				if err = o.rotateBySize(); err != nil {
+					close(o.closing)
+					err = fmt.Errorf("unable to rotate file '%s': %s", o.path, err)
+					errChan <- err
+					ok = false
+					break
+				}
+			}
+		case <-syncChan:
+			if o.dirty {
+				o.file.Sync()
+				o.dirty = false
+			}
 		case <-hupChan:
-			o.file.Close()
+			if err = o.closeFile(); err != nil {
+				or.LogError(err)
+			}
 			if err = o.openFile(); err != nil {
 				close(o.closing)
 				err = fmt.Errorf("unable to reopen file '%s': %s", o.path, err)
@@ -333,7 +683,9 @@ func (o *FileOutput) committer(or OutputRunner, errChan chan error) {
 				break
 			}
 		case rotateTime := <-o.rotateChan:
-			o.file.Close()
+			if err = o.closeFile(); err != nil {
+				or.LogError(err)
+			}
 			o.path = gostrftime.Strftime(o.FileOutputConfig.Path, rotateTime)
 			if err = o.openFile(); err != nil {
 				close(o.closing)
@@ -16,10 +16,13 @@
 package file
 
 import (
+	"bytes"
 	"fmt"
 	. "github.com/mozilla-services/heka/pipeline"
 	pipeline_ts "github.com/mozilla-services/heka/pipeline/testsupport"
 	"github.com/mozilla-services/heka/plugins"
+	"github.com/mozilla-services/heka/plugins/archive"
+	"github.com/mozilla-services/heka/plugins/encrypt"
 	plugins_ts "github.com/mozilla-services/heka/plugins/testsupport"
 	"github.com/rafrombrc/gomock/gomock"
 	gs "github.com/rafrombrc/gospec/src/gospec"
@@ -151,6 +154,58 @@ func FileOutputSpec(c gs.Context) {
 			c.Expect(string(outBatch), gs.Equals, payload)
 		})
 
+		c.Specify("w/ message placeholders in the path", func() {
+			tmpDir, err := ioutil.TempDir("", "fileoutput-dynamic")
+			c.Assume(err, gs.IsNil)
+			defer os.RemoveAll(tmpDir)
+			config.Path = filepath.Join(tmpDir, "%{Logger}", "%{foo}.log")
+
+			c.Specify("rejects rotation settings", func() {
+				config.RotationSize = 1024
+				err := fileOutput.Init(config)
+				c.Expect(err, gs.Not(gs.IsNil))
+			})
+
+			c.Specify("sanitizes the generated path", func() {
+				err := fileOutput.Init(config)
+				c.Assume(err, gs.IsNil)
+				pack.Message.SetLogger("../../etc")
+				c.Expect(fileOutput.dynamicPath(pack), gs.Equals,
+					filepath.Join(tmpDir, "____etc", "bar.log"))
+			})
+
+			c.Specify("writes each message to its own file", func() {
+				config.MaxOpenFiles = 1
+				err := fileOutput.Init(config)
+				c.Assume(err, gs.IsNil)
+
+				pack2 := NewPipelinePack(pConfig.InputRecycleChan())
+				pack2.Message = pipeline_ts.GetTestMessage()
+				pack2.Message.SetLogger("Other")
+				pack2.Message.SetPayload("Other Payload")
+
+				oth.MockOutputRunner.EXPECT().InChan().Return(inChan)
+				oth.MockOutputRunner.EXPECT().Encode(pack).Return(encoder.Encode(pack))
+				oth.MockOutputRunner.EXPECT().Encode(pack2).Return(encoder.Encode(pack2))
+				done := make(chan error)
+				go func() {
+					done <- fileOutput.dynamicReceiver(oth.MockOutputRunner)
+				}()
+				inChan <- pack
+				inChan <- pack2
+				close(inChan)
+				c.Expect(<-done, gs.IsNil)
+				c.Expect(fileOutput.files.len(), gs.Equals, 0)
+
+				contents, err := ioutil.ReadFile(filepath.Join(tmpDir, "GoSpec", "bar.log"))
+				c.Expect(err, gs.IsNil)
+				c.Expect(string(contents), gs.Equals, "Test Payload\n")
+				contents, err = ioutil.ReadFile(filepath.Join(tmpDir, "Other", "bar.log"))
+				c.Expect(err, gs.IsNil)
+				c.Expect(string(contents), gs.Equals, "Other Payload\n")
+			})
+		})
+
 		c.Specify("commits to a file", func() {
 			outStr := "Write me out to the log file"
 			outBytes := []byte(outStr)
@@ -180,6 +235,36 @@ func FileOutputSpec(c gs.Context) {
 				c.Expect(string(contents), gs.Equals, outStr)
 			})
 
+			c.Specify("encrypted w/ a key file", func() {
+				keyPath := tmpFilePath + ".key"
+				defer os.Remove(keyPath)
+				err := ioutil.WriteFile(keyPath, bytes.Repeat([]byte{1}, 32), 0600)
+				c.Assume(err, gs.IsNil)
+				config.Encryption = &encrypt.Config{KeyFile: keyPath, KeyId: "test-key"}
+				err = fileOutput.Init(config)
+				c.Assume(err, gs.IsNil)
+
+				go fileOutput.committer(oth.MockOutputRunner, errChan)
+				go func() {
+					fileOutput.batchChan <- outBytes
+					_ = <-fileOutput.backChan
+					close(fileOutput.batchChan)
+				}()
+				<-fileOutput.closing
+
+				contents, err := ioutil.ReadFile(tmpFilePath)
+				c.Assume(err, gs.IsNil)
+				c.Expect(bytes.Contains(contents, outBytes), gs.IsFalse)
+				id, err := encrypt.ReadKeyId(bytes.NewReader(contents))
+				c.Expect(err, gs.IsNil)
+				c.Expect(id, gs.Equals, "test-key")
+				reader := encrypt.NewReader(bytes.NewReader(contents),
+					config.Encryption.Resolver())
+				plain, err := ioutil.ReadAll(reader)
+				c.Expect(err, gs.IsNil)
+				c.Expect(string(plain), gs.Equals, outStr)
+			})
+
 			c.Specify("with different Perm settings", func() {
 				config.Perm = "600"
 				err := fileOutput.Init(config)
@@ -211,6 +296,112 @@ func FileOutputSpec(c gs.Context) {
 					c.Expect(fileMode.String(), pipeline_ts.StringContains, "-------")
 				}
 			})
+
+			c.Specify("with a rotation size", func() {
+				config.RotationSize = uint64(len(outBytes))
+				config.SyncInterval = 100
+				err := fileOutput.Init(config)
+				c.Assume(err, gs.IsNil)
+				rotatedPath := tmpFilePath + ".1"
+				defer os.Remove(rotatedPath)
+
+				// Start committer loop.
+				go fileOutput.committer(oth.MockOutputRunner, errChan)
+
+				// Feed two batches, the first should trigger a rotation.
+				go func() {
+					fileOutput.batchChan <- outBytes
+					_ = <-fileOutput.backChan
+					fileOutput.batchChan <- outBytes[:5]
+					_ = <-fileOutput.backChan
+					close(fileOutput.batchChan)
+				}()
+
+				// Wait until we know processing has finished.
+				<-fileOutput.closing
+
+				contents, err := ioutil.ReadFile(rotatedPath)
+				c.Assume(err, gs.IsNil)
+				c.Expect(string(contents), gs.Equals, outStr)
+				contents, err = ioutil.ReadFile(tmpFilePath)
+				c.Assume(err, gs.IsNil)
+				c.Expect(string(contents), gs.Equals, outStr[:5])
+
+				c.Specify("after the highest existing suffix", func() {
+					// .1 was removed, .2 and .3 are older rotations.
+					os.Remove(rotatedPath)
+					for _, i := range []int{2, 3} {
+						path := fmt.Sprintf("%s.%d", tmpFilePath, i)
+						err = ioutil.WriteFile(path, []byte("old"), 0644)
+						c.Assume(err, gs.IsNil)
+						defer os.Remove(path)
+					}
+					c.Expect(fileOutput.rotateBySize(), gs.IsNil)
+					defer os.Remove(tmpFilePath + ".4")
+					fileOutput.closeFile()
+
+					_, err = os.Stat(rotatedPath)
+					c.Expect(os.IsNotExist(err), gs.IsTrue)
+					contents, err = ioutil.ReadFile(tmpFilePath + ".4")
+					c.Assume(err, gs.IsNil)
+					c.Expect(string(contents), gs.Equals, outStr[:5])
+				})
+			})
+
+			c.Specify("w/ an index", func() {
+				config.Index = true
+				config.IndexInterval = 2
+				err := fileOutput.Init(config)
+				c.Assume(err, gs.IsNil)
+				indexPath := archive.IndexPath(tmpFilePath)
+				defer os.Remove(indexPath)
+
+				go fileOutput.committer(oth.MockOutputRunner, errChan)
+
+				// Three records in two batches, the first batch holding two.
+				size := len(outBytes)
+				go func() {
+					fileOutput.recordChan <- []archive.Record{
+						{Timestamp: 20, Type: "a", Size: size},
+						{Timestamp: 10, Type: "b", Size: size},
+					}
+					fileOutput.batchChan <- append(append([]byte{}, outBytes...), outBytes...)
+					_ = <-fileOutput.backChan
+					fileOutput.recordChan <- []archive.Record{
+						{Timestamp: 30, Type: "a", Size: size},
+					}
+					fileOutput.batchChan <- outBytes
+					_ = <-fileOutput.backChan
+					close(fileOutput.batchChan)
+				}()
+				<-fileOutput.closing
+
+				idx, err := archive.Read(indexPath)
+				c.Assume(err, gs.IsNil)
+				c.Expect(idx.Count, gs.Equals, int64(3))
+				c.Expect(idx.Size, gs.Equals, int64(3*size))
+				c.Expect(idx.Start, gs.Equals, int64(10))
+				c.Expect(idx.End, gs.Equals, int64(30))
+				c.Expect(idx.Types["a"], gs.Equals, int64(2))
+				c.Expect(len(idx.Entries), gs.Equals, 2)
+				c.Expect(idx.Entries[1].Offset, gs.Equals, int64(2*size))
+
+				c.Specify("which is reused when the file is reopened", func() {
+					fileOutput = new(FileOutput)
+					err = fileOutput.Init(config)
+					c.Assume(err, gs.IsNil)
+					fileOutput.file.Close()
+					c.Expect(fileOutput.index.Count, gs.Equals, int64(3))
+					c.Expect(len(fileOutput.index.Entries), gs.Equals, 2)
+				})
+			})
+
+			c.Specify("rejects an index w/ message placeholders in the path", func() {
+				config.Index = true
+				config.Path = filepath.Join(os.TempDir(), "%{Logger}.log")
+				err := fileOutput.Init(config)
+				c.Expect(err, gs.Not(gs.IsNil))
+			})
 		})
 
 		if runtime.GOOS != "windows" {
@@ -0,0 +1,234 @@
+// +build !windows
+
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package file
+
+import (
+	"errors"
+	"fmt"
+	"github.com/mozilla-services/heka/message"
+	. "github.com/mozilla-services/heka/pipeline"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// Output plugin that writes message contents to a named pipe (FIFO), for
+// consumers that read their input from one.
+type NamedPipeOutput struct {
+	*NamedPipeOutputConfig
+	perm                os.FileMode
+	pipe                *os.File
+	lastAttempt         time.Time
+	processMessageCount int64
+	dropMessageCount    int64
+	reconnectCount      int64
+	reportLock          sync.Mutex
+}
+
+// ConfigStruct for NamedPipeOutput plugin.
+type NamedPipeOutputConfig struct {
+	// Path of the named pipe.
+	Path string
+	// Whether the pipe is created if it doesn't exist.
+	Create bool
+	// Permissions of a created pipe, must be a string representation of an
+	// octal integer.
+	Perm string
+	// Whether the output waits for a reader rather than dropping messages
+	// while there is none.
+	WaitForReader bool `toml:"wait_for_reader"`
+	// Interval at which opening the pipe is retried while there's no
+	// reader, in milliseconds.
+	ReopenInterval uint32 `toml:"reopen_interval"`
+	// Specifies whether or not Heka's stream framing will be applied to the
+	// output. Defaults to true if ProtobufEncoder is used, false otherwise.
+	UseFraming *bool `toml:"use_framing"`
+}
+
+func (o *NamedPipeOutput) ConfigStruct() interface{} {
+	return &NamedPipeOutputConfig{
+		Create:         true,
+		Perm:           "644",
+		ReopenInterval: 1000,
+	}
+}
+
+func (o *NamedPipeOutput) Init(config interface{}) (err error) {
+	o.NamedPipeOutputConfig = config.(*NamedPipeOutputConfig)
+
+	if o.Path == "" {
+		return errors.New("`path` must be set")
+	}
+	intPerm, err := strconv.ParseInt(o.Perm, 8, 32)
+	if err != nil {
+		return fmt.Errorf("NamedPipeOutput '%s' can't parse `perm`, is it an octal integer string?",
+			o.Path)
+	}
+	o.perm = os.FileMode(intPerm)
+
+	info, err := os.Stat(o.Path)
+	if os.IsNotExist(err) && o.Create {
+		if err = syscall.Mkfifo(o.Path, uint32(o.perm)); err != nil {
+			return fmt.Errorf("can't create named pipe '%s': %s", o.Path, err)
+		}
+		// Mkfifo is subject to the umask, set the permissions explicitly.
+		return os.Chmod(o.Path, o.perm)
+	}
+	if err != nil {
+		return fmt.Errorf("can't stat named pipe '%s': %s", o.Path, err)
+	}
+	if info.Mode()&os.ModeNamedPipe == 0 {
+		return fmt.Errorf("'%s' isn't a named pipe", o.Path)
+	}
+	return
+}
+
+// Opens the pipe for writing w/o blocking, which fails w/ ENXIO if there's
+// no reader. Once it's open the writes are made blocking, so a slow reader
+// slows down the output rather than losing data.
+func (o *NamedPipeOutput) open() error {
+	fd, err := syscall.Open(o.Path, syscall.O_WRONLY|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		return err
+	}
+	if err = syscall.SetNonblock(fd, false); err != nil {
+		syscall.Close(fd)
+		return err
+	}
+	o.pipe = os.NewFile(uintptr(fd), o.Path)
+	return nil
+}
+
+func (o *NamedPipeOutput) close() {
+	if o.pipe != nil {
+		o.pipe.Close()
+		o.pipe = nil
+	}
+}
+
+// Makes sure the pipe is open, returning false if there's no reader. Opening
+// is only attempted once per reopen interval, unless waitForReader is set
+// in which case it's retried until a reader shows up.
+func (o *NamedPipeOutput) ensureOpen(or OutputRunner) (bool, error) {
+	interval := time.Duration(o.ReopenInterval) * time.Millisecond
+	for o.pipe == nil {
+		if !o.WaitForReader && time.Since(o.lastAttempt) < interval {
+			return false, nil
+		}
+		o.lastAttempt = time.Now()
+		err := o.open()
+		if err == nil {
+			or.LogMessage(fmt.Sprintf("reader connected to '%s'", o.Path))
+			break
+		}
+		if err != syscall.ENXIO {
+			return false, fmt.Errorf("can't open named pipe '%s': %s", o.Path, err)
+		}
+		if !o.WaitForReader {
+			return false, nil
+		}
+		time.Sleep(interval)
+	}
+	return true, nil
+}
+
+// Writes the data, reopening the pipe once if the reader went away.
+func (o *NamedPipeOutput) write(or OutputRunner, outBytes []byte) (bool, error) {
+	for attempt := 0; attempt < 2; attempt++ {
+		if ok, err := o.ensureOpen(or); !ok {
+			return false, err
+		}
+		_, err := o.pipe.Write(outBytes)
+		if err == nil {
+			return true, nil
+		}
+		o.close()
+		if pathErr, ok := err.(*os.PathError); !ok || pathErr.Err != syscall.EPIPE {
+			return false, fmt.Errorf("can't write to named pipe '%s': %s", o.Path, err)
+		}
+		atomic.AddInt64(&o.reconnectCount, 1)
+		or.LogMessage(fmt.Sprintf("reader of '%s' went away", o.Path))
+		o.lastAttempt = time.Time{}
+	}
+	return false, nil
+}
+
+func (o *NamedPipeOutput) Run(or OutputRunner, h PluginHelper) (err error) {
+	enc := or.Encoder()
+	if enc == nil {
+		return errors.New("Encoder required.")
+	}
+	if o.UseFraming == nil {
+		// Nothing was specified, we'll default to framing IFF ProtobufEncoder
+		// is being used.
+		if _, ok := enc.(*ProtobufEncoder); ok {
+			or.SetUseFraming(true)
+		}
+	}
+	defer o.close()
+
+	var (
+		outBytes []byte
+		written  bool
+		e        error
+	)
+	for pack := range or.InChan() {
+		outBytes, e = or.Encode(pack)
+		pack.Recycle()
+		if e != nil {
+			or.LogError(e)
+			atomic.AddInt64(&o.dropMessageCount, 1)
+			continue
+		}
+		if outBytes == nil {
+			continue
+		}
+		if written, e = o.write(or, outBytes); e != nil {
+			or.LogError(e)
+		}
+		if written {
+			atomic.AddInt64(&o.processMessageCount, 1)
+		} else {
+			atomic.AddInt64(&o.dropMessageCount, 1)
+		}
+	}
+	return
+}
+
+// Satisfies the `pipeline.ReportingPlugin` interface to provide plugin state
+// information to the Heka report and dashboard.
+func (o *NamedPipeOutput) ReportMsg(msg *message.Message) error {
+	o.reportLock.Lock()
+	defer o.reportLock.Unlock()
+
+	message.NewInt64Field(msg, "ProcessMessageCount",
+		atomic.LoadInt64(&o.processMessageCount), "count")
+	message.NewInt64Field(msg, "DropMessageCount",
+		atomic.LoadInt64(&o.dropMessageCount), "count")
+	message.NewInt64Field(msg, "ReconnectCount",
+		atomic.LoadInt64(&o.reconnectCount), "count")
+	return nil
+}
+
+func init() {
+	RegisterPlugin("NamedPipeOutput", func() interface{} {
+		return new(NamedPipeOutput)
+	})
+}
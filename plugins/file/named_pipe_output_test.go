@@ -0,0 +1,109 @@
+// +build !windows
+
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package file
+
+import (
+	pipeline_ts "github.com/mozilla-services/heka/pipeline/testsupport"
+	plugins_ts "github.com/mozilla-services/heka/plugins/testsupport"
+	"github.com/rafrombrc/gomock/gomock"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+// Named pipes don't exist on Windows, so these specs have their own runner.
+func TestNamedPipeOutputSpecs(t *testing.T) {
+	r := gs.NewRunner()
+	r.Parallel = false
+	r.AddSpec(NamedPipeOutputSpec)
+	gs.MainGoTest(r, t)
+}
+
+func NamedPipeOutputSpec(c gs.Context) {
+	t := new(pipeline_ts.SimpleT)
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	tmpDir, err := ioutil.TempDir("", "named-pipe-tests")
+	c.Assume(err, gs.IsNil)
+	defer os.RemoveAll(tmpDir)
+	pipePath := filepath.Join(tmpDir, "pipe")
+
+	oth := plugins_ts.NewOutputTestHelper(ctrl)
+	oth.MockOutputRunner.EXPECT().LogMessage(gomock.Any()).AnyTimes()
+
+	output := new(NamedPipeOutput)
+	config := output.ConfigStruct().(*NamedPipeOutputConfig)
+	config.Path = pipePath
+	config.ReopenInterval = 0
+
+	c.Specify("A NamedPipeOutput", func() {
+		c.Specify("creates the pipe", func() {
+			err := output.Init(config)
+			c.Assume(err, gs.IsNil)
+			info, err := os.Stat(pipePath)
+			c.Assume(err, gs.IsNil)
+			c.Expect(info.Mode()&os.ModeNamedPipe != 0, gs.IsTrue)
+			c.Expect(info.Mode().Perm(), gs.Equals, os.FileMode(0644))
+		})
+
+		c.Specify("rejects a path that isn't a pipe", func() {
+			ioutil.WriteFile(pipePath, []byte{}, 0644)
+			err := output.Init(config)
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+
+		c.Specify("writes to a reader", func() {
+			err := output.Init(config)
+			c.Assume(err, gs.IsNil)
+			defer output.close()
+
+			written, err := output.write(oth.MockOutputRunner, []byte("dropped\n"))
+			c.Expect(err, gs.IsNil)
+			c.Expect(written, gs.IsFalse)
+
+			reader, err := os.OpenFile(pipePath, os.O_RDONLY|syscall.O_NONBLOCK, 0)
+			c.Assume(err, gs.IsNil)
+			written, err = output.write(oth.MockOutputRunner, []byte("hello\n"))
+			c.Expect(err, gs.IsNil)
+			c.Expect(written, gs.IsTrue)
+			buf := make([]byte, 64)
+			n, _ := reader.Read(buf)
+			c.Expect(string(buf[:n]), gs.Equals, "hello\n")
+
+			c.Specify("and reconnects when the reader goes away", func() {
+				reader.Close()
+				written, err = output.write(oth.MockOutputRunner, []byte("lost\n"))
+				c.Expect(err, gs.IsNil)
+				c.Expect(written, gs.IsFalse)
+				c.Expect(output.reconnectCount, gs.Equals, int64(1))
+
+				reader, err = os.OpenFile(pipePath, os.O_RDONLY|syscall.O_NONBLOCK, 0)
+				c.Assume(err, gs.IsNil)
+				defer reader.Close()
+				written, err = output.write(oth.MockOutputRunner, []byte("again\n"))
+				c.Expect(written, gs.IsTrue)
+				n, _ = reader.Read(buf)
+				c.Expect(string(buf[:n]), gs.Equals, "again\n")
+			})
+			reader.Close()
+		})
+	})
+}
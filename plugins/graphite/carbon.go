@@ -18,8 +18,11 @@ package graphite
 
 import (
 	"bytes"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	. "github.com/mozilla-services/heka/pipeline"
+	"math"
 	"net"
 	"strconv"
 	"strings"
@@ -33,6 +36,9 @@ type CarbonOutput struct {
 	*net.TCPAddr
 	*net.TCPConn
 	send func(or OutputRunner, data []byte)
+	// Data that couldn't be delivered due to connection problems, to be
+	// sent ahead of the next batch.
+	pending []byte
 }
 
 // ConfigStruct for CarbonOutput plugin.
@@ -44,10 +50,29 @@ type CarbonOutputConfig struct {
 	TCPKeepAlive bool `toml:"tcp_keep_alive"`
 	// If true, use UDP rather than TCP (default) to send the data
 	Protocol string `toml:"protocol"`
+	// Wire format for the data, either "plaintext" (default) or "pickle".
+	// The pickle format is only supported over TCP.
+	Format string `toml:"format"`
+	// Maximum number of bytes of undeliverable data that will be held in
+	// memory while the TCP connection is down. Data that would exceed this
+	// limit is dropped. Set to 0 to disable buffering. Defaults to 1MiB.
+	MaxBufferSize int `toml:"max_buffer_size"`
+}
+
+// A single parsed statmetric, along w/ the original line it came from.
+type carbonMetric struct {
+	line      string
+	name      string
+	value     float64
+	timestamp uint64
 }
 
 func (t *CarbonOutput) ConfigStruct() interface{} {
-	return &CarbonOutputConfig{Address: "localhost:2003"}
+	return &CarbonOutputConfig{
+		Address:       "localhost:2003",
+		Format:        "plaintext",
+		MaxBufferSize: 1024 * 1024,
+	}
 }
 
 func (t *CarbonOutput) Init(config interface{}) (err error) {
@@ -64,19 +89,34 @@ func (t *CarbonOutput) Init(config interface{}) (err error) {
 	default:
 		err = fmt.Errorf(`CarbonOutput: "%s" is not a supported protocol, must be "tcp" or "udp"`, t.Protocol)
 	}
+	if err != nil {
+		return
+	}
+
+	switch t.Format {
+	case "", "plaintext":
+	case "pickle":
+		if t.Protocol == "udp" {
+			err = errors.New(`CarbonOutput: "pickle" format requires the "tcp" protocol`)
+		}
+	default:
+		err = fmt.Errorf(`CarbonOutput: "%s" is not a supported format, must be "plaintext" or "pickle"`, t.Format)
+	}
 
 	return
 }
 
 func (t *CarbonOutput) ProcessPack(pack *PipelinePack, or OutputRunner) {
-	var e error
+	var (
+		e      error
+		metric carbonMetric
+	)
 
 	payload := strings.Trim(pack.Message.GetPayload(), " \t\n")
 	pack.Recycle() // Once we've copied the payload we're done w/ the pack.
 	lines := strings.Split(payload, "\n")
 
-	clean_statmetrics := make([]string, len(lines))
-	index := 0
+	clean_statmetrics := make([]carbonMetric, 0, len(lines))
 	for _, line := range lines {
 		// `fields` should be "<name> <value> <timestamp>"
 		fields := strings.Fields(line)
@@ -85,23 +125,31 @@ func (t *CarbonOutput) ProcessPack(pack *PipelinePack, or OutputRunner) {
 			continue
 		}
 
-		if _, e = strconv.ParseUint(fields[2], 0, 32); e != nil {
+		if metric.timestamp, e = strconv.ParseUint(fields[2], 0, 32); e != nil {
 			or.LogError(fmt.Errorf("parsing time: %s", e))
 			continue
 		}
-		if _, e = strconv.ParseFloat(fields[1], 64); e != nil {
+		if metric.value, e = strconv.ParseFloat(fields[1], 64); e != nil {
 			or.LogError(fmt.Errorf("parsing value '%s': %s", fields[1], e))
 			continue
 		}
-		clean_statmetrics[index] = line
-		index += 1
+		metric.line = line
+		metric.name = fields[0]
+		clean_statmetrics = append(clean_statmetrics, metric)
 	}
-	clean_statmetrics = clean_statmetrics[:index]
 
-	// Stuff each parseable statmetric into a bytebuffer
 	buffer := &bytes.Buffer{}
-	for i := 0; i < len(clean_statmetrics); i++ {
-		buffer.WriteString(clean_statmetrics[i] + "\n")
+	if t.Format == "pickle" {
+		if len(clean_statmetrics) > 0 {
+			encodePickle(clean_statmetrics, buffer)
+		}
+		t.send(or, buffer.Bytes())
+		return
+	}
+
+	// Stuff each parseable statmetric into a bytebuffer
+	for _, m := range clean_statmetrics {
+		buffer.WriteString(m.line + "\n")
 		// UDP packets must be < 64KiB, we cap buffer len at ~62KiB
 		if t.bufSplitSize > 0 && buffer.Len() > t.bufSplitSize {
 			t.send(or, buffer.Bytes())
@@ -112,7 +160,55 @@ func (t *CarbonOutput) ProcessPack(pack *PipelinePack, or OutputRunner) {
 	t.send(or, buffer.Bytes())
 }
 
+// Writes the provided metrics to the buffer using carbon's pickle protocol,
+// i.e. a 4 byte big-endian length header followed by a pickled list of
+// `(name, (timestamp, value))` tuples. Only the handful of pickle protocol 2
+// opcodes needed to represent that structure are emitted.
+func encodePickle(metrics []carbonMetric, buf *bytes.Buffer) {
+	var (
+		body  bytes.Buffer
+		word  [4]byte
+		dword [8]byte
+	)
+	body.Write([]byte{0x80, 0x02}) // PROTO 2
+	body.WriteByte(']')            // EMPTY_LIST
+	body.WriteByte('(')            // MARK
+	for _, m := range metrics {
+		body.WriteByte('X') // BINUNICODE
+		binary.LittleEndian.PutUint32(word[:], uint32(len(m.name)))
+		body.Write(word[:])
+		body.WriteString(m.name)
+		if m.timestamp <= math.MaxInt32 {
+			body.WriteByte('J') // BININT
+			binary.LittleEndian.PutUint32(word[:], uint32(m.timestamp))
+			body.Write(word[:])
+		} else {
+			body.Write([]byte{0x8a, 0x08}) // LONG1, 8 bytes
+			binary.LittleEndian.PutUint64(dword[:], m.timestamp)
+			body.Write(dword[:])
+		}
+		body.WriteByte('G') // BINFLOAT
+		binary.BigEndian.PutUint64(dword[:], math.Float64bits(m.value))
+		body.Write(dword[:])
+		body.Write([]byte{0x86, 0x86}) // TUPLE2, TUPLE2
+	}
+	body.WriteByte('e') // APPENDS
+	body.WriteByte('.') // STOP
+
+	binary.BigEndian.PutUint32(word[:], uint32(body.Len()))
+	buf.Write(word[:])
+	buf.Write(body.Bytes())
+}
+
 func (t *CarbonOutput) sendTCP(or OutputRunner, data []byte) {
+	if len(t.pending) > 0 {
+		data = append(t.pending, data...)
+		t.pending = t.pending[:0]
+	}
+	if len(data) == 0 {
+		return
+	}
+
 	write := func() (err error) {
 		if t.TCPConn == nil {
 			t.TCPConn, err = net.DialTCP("tcp", nil, t.TCPAddr)
@@ -150,8 +246,20 @@ func (t *CarbonOutput) sendTCP(or OutputRunner, data []byte) {
 		// try to reset the connection as it might have gone bad
 		or.LogError(fmt.Errorf(`Error "%s", connection reset, retrying`, err.Error()))
 		disconnect()
-		err = write()
+		if err = write(); err == nil {
+			return
+		}
+	}
+	// Connection is down, hold on to the data so we can try again w/ the
+	// next batch.
+	disconnect()
+	if len(data) > t.MaxBufferSize {
+		if t.MaxBufferSize > 0 {
+			or.LogError(fmt.Errorf("buffer full, dropping %d bytes", len(data)))
+		}
+		return
 	}
+	t.pending = append(t.pending, data...)
 }
 
 func (t *CarbonOutput) sendUDP(or OutputRunner, data []byte) {
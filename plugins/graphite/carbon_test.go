@@ -17,6 +17,7 @@
 package graphite
 
 import (
+	"bytes"
 	"fmt"
 	. "github.com/mozilla-services/heka/pipeline"
 	pipeline_ts "github.com/mozilla-services/heka/pipeline/testsupport"
@@ -261,5 +262,43 @@ func CarbonOutputSpec(c gs.Context) {
 				c.Expect(err, gs.IsNil)
 			})
 		})
+
+		c.Specify("rejects the pickle format over UDP", func() {
+			config.Protocol = "udp"
+			config.Format = "pickle"
+			err = output.Init(config)
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+
+		c.Specify("buffers data while the server is unreachable", func() {
+			// Grab a free port, then close the listener so nothing's there.
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			c.Assume(err, gs.IsNil)
+			config.Address = listener.Addr().String()
+			listener.Close()
+			err = output.Init(config)
+			c.Assume(err, gs.IsNil)
+
+			oth.MockOutputRunner.EXPECT().LogError(gomock.Any()).AnyTimes()
+			output.ProcessPack(pack, oth.MockOutputRunner)
+			c.Expect(string(output.pending), gs.Equals, expected_data)
+
+			c.Specify("and drops it when the buffer is full", func() {
+				output.MaxBufferSize = len(expected_data) + 1
+				output.ProcessPack(newpack(), oth.MockOutputRunner)
+				c.Expect(len(output.pending), gs.Equals, 0)
+			})
+		})
+	})
+
+	c.Specify("Pickle encoding", func() {
+		metrics := []carbonMetric{{name: "stats.a", value: 1.5, timestamp: 1400000000}}
+		buf := new(bytes.Buffer)
+		encodePickle(metrics, buf)
+		// Python: pickle.dumps([(u'stats.a', (1400000000, 1.5))], 2), w/ a
+		// length header.
+		expected := "\x00\x00\x00\x22\x80\x02](X\x07\x00\x00\x00stats.aJ\x00NrS" +
+			"G?\xf8\x00\x00\x00\x00\x00\x00\x86\x86e."
+		c.Expect(buf.String(), gs.Equals, expected)
 	})
 }
@@ -22,6 +22,8 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -111,6 +113,27 @@ type WhisperOutput struct {
 	dbs                map[string]WhisperRunner
 	folderPerm         os.FileMode
 	pConfig            *PipelineConfig
+	schemas            []*whisperSchema
+}
+
+// Storage schema applied to new whisper db files whose metric name matches
+// the pattern.
+type WhisperSchemaConfig struct {
+	// Regular expression matched against the metric name.
+	Pattern string
+	// Comma separated list of `<precision>:<retention>` pairs, as used in
+	// carbon's storage-schemas.conf, e.g. "10s:6h,1m:7d,10m:5y".
+	Retentions string
+	// Aggregation method for the matching db files, defaults to the
+	// `default_agg_method`.
+	AggMethod whisper.AggregationMethod `toml:"agg_method"`
+}
+
+type whisperSchema struct {
+	name        string
+	pattern     *regexp.Regexp
+	archiveInfo []whisper.ArchiveInfo
+	aggMethod   whisper.AggregationMethod
 }
 
 // WhisperOutput config struct.
@@ -132,6 +155,63 @@ type WhisperOutputConfig struct {
 	// tree. Must be a string representation of an octal integer. Defaults to
 	// "700".
 	FolderPerm string `toml:"folder_perm"`
+
+	// Storage schemas keyed by name. Schemas are checked in order of their
+	// names, the first schema w/ a pattern matching the metric name is used
+	// when a new db file is created. Metrics that don't match any schema use
+	// the default archive info and aggregation method.
+	Schemas map[string]*WhisperSchemaConfig
+}
+
+// Parses a duration w/ an optional unit suffix (s, m, h, d, w, y) into
+// seconds. Values w/o a unit are returned as is.
+func parseRetentionValue(s string) (value uint32, hasUnit bool, err error) {
+	units := map[byte]uint32{
+		's': 1,
+		'm': 60,
+		'h': 3600,
+		'd': 86400,
+		'w': 604800,
+		'y': 31536000,
+	}
+	mult := uint32(1)
+	if len(s) > 0 {
+		if m, ok := units[s[len(s)-1]]; ok {
+			mult = m
+			hasUnit = true
+			s = s[:len(s)-1]
+		}
+	}
+	v, err := strconv.ParseUint(s, 10, 32)
+	if err != nil || v == 0 {
+		return 0, false, fmt.Errorf("invalid retention value: '%s'", s)
+	}
+	return uint32(v) * mult, hasUnit, nil
+}
+
+// Parses a carbon style retention definition, e.g. "10s:6h,1m:7d". The
+// retention part may also be given as a number of data points, e.g.
+// "60:1440".
+func parseRetentions(def string) (archiveInfo []whisper.ArchiveInfo, err error) {
+	for _, spec := range strings.Split(def, ",") {
+		parts := strings.Split(strings.TrimSpace(spec), ":")
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid retention: '%s'", spec)
+		}
+		precision, _, err := parseRetentionValue(parts[0])
+		if err != nil {
+			return nil, err
+		}
+		points, hasUnit, err := parseRetentionValue(parts[1])
+		if err != nil {
+			return nil, err
+		}
+		if hasUnit {
+			points = points / precision
+		}
+		archiveInfo = append(archiveInfo, whisper.ArchiveInfo{0, precision, points})
+	}
+	return
 }
 
 func (o *WhisperOutput) ConfigStruct() interface{} {
@@ -187,10 +267,47 @@ func (o *WhisperOutput) Init(config interface{}) (err error) {
 		}
 		o.defaultArchiveInfo[i] = whisper.ArchiveInfo{aiSpec[0], aiSpec[1], aiSpec[2]}
 	}
+
+	names := make([]string, 0, len(conf.Schemas))
+	for name := range conf.Schemas {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	o.schemas = make([]*whisperSchema, len(names))
+	for i, name := range names {
+		schemaConf := conf.Schemas[name]
+		schema := &whisperSchema{
+			name:      name,
+			aggMethod: schemaConf.AggMethod,
+		}
+		if schema.aggMethod == 0 {
+			schema.aggMethod = o.defaultAggMethod
+		}
+		if schema.pattern, err = regexp.Compile(schemaConf.Pattern); err != nil {
+			return fmt.Errorf("schema '%s' has an invalid pattern: %s", name, err)
+		}
+		if schema.archiveInfo, err = parseRetentions(schemaConf.Retentions); err != nil {
+			return fmt.Errorf("schema '%s': %s", name, err)
+		}
+		o.schemas[i] = schema
+	}
 	o.dbs = make(map[string]WhisperRunner)
 	return
 }
 
+// Returns the archive info and aggregation method to use when creating a
+// db file for the named metric.
+func (o *WhisperOutput) schemaFor(statName string) ([]whisper.ArchiveInfo,
+	whisper.AggregationMethod) {
+
+	for _, schema := range o.schemas {
+		if schema.pattern.MatchString(statName) {
+			return schema.archiveInfo, schema.aggMethod
+		}
+	}
+	return o.defaultArchiveInfo, o.defaultAggMethod
+}
+
 func (o *WhisperOutput) getFsPath(statName string) (statPath string) {
 	statPath = strings.Replace(statName, ".", string(os.PathSeparator), -1)
 	statPath = strings.Join([]string{statPath, "wsp"}, ".")
@@ -222,9 +339,11 @@ func (o *WhisperOutput) Run(or OutputRunner, h PluginHelper) (err error) {
 			}
 			if wr = o.dbs[fields[0]]; wr == nil {
 				wg.Add(1)
-				wr, e = NewWhisperRunner(o.getFsPath(fields[0]), o.defaultArchiveInfo,
-					o.defaultAggMethod, o.folderPerm, &wg)
+				archiveInfo, aggMethod := o.schemaFor(fields[0])
+				wr, e = NewWhisperRunner(o.getFsPath(fields[0]), archiveInfo,
+					aggMethod, o.folderPerm, &wg)
 				if e != nil {
+					wg.Done()
 					or.LogError(fmt.Errorf("can't create WhisperRunner: %s", e))
 					continue
 				}
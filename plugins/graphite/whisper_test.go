@@ -154,5 +154,39 @@ func WhisperOutputSpec(c gospec.Context) {
 				i++
 			}
 		})
+
+		c.Specify("uses the first matching storage schema", func() {
+			config.Schemas = map[string]*WhisperSchemaConfig{
+				"a_timers": {Pattern: `^stats\.timers\.`, Retentions: "10s:1h,1m:1d"},
+				"b_stats": {
+					Pattern:    `^stats\.`,
+					Retentions: "60:1440",
+					AggMethod:  whisper.AggregationSum,
+				},
+			}
+			err := o.Init(config)
+			c.Assume(err, gs.IsNil)
+
+			archiveInfo, aggMethod := o.schemaFor("stats.timers.foo")
+			c.Expect(len(archiveInfo), gs.Equals, 2)
+			c.Expect(archiveInfo[0], gs.Equals, whisper.ArchiveInfo{0, 10, 360})
+			c.Expect(archiveInfo[1], gs.Equals, whisper.ArchiveInfo{0, 60, 1440})
+			c.Expect(aggMethod, gs.Equals, whisper.AggregationAverage)
+
+			archiveInfo, aggMethod = o.schemaFor("stats.counters.foo")
+			c.Expect(archiveInfo[0], gs.Equals, whisper.ArchiveInfo{0, 60, 1440})
+			c.Expect(aggMethod, gs.Equals, whisper.AggregationSum)
+
+			archiveInfo, _ = o.schemaFor("other.foo")
+			c.Expect(len(archiveInfo), gs.Equals, 4)
+		})
+
+		c.Specify("rejects an invalid retention", func() {
+			config.Schemas = map[string]*WhisperSchemaConfig{
+				"bad": {Pattern: ".*", Retentions: "10s"},
+			}
+			err := o.Init(config)
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
 	})
 }
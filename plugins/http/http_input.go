@@ -162,7 +162,10 @@ func (hi *HttpInput) fetchUrl(url string, sRunner SplitterRunner) {
 	resp, err := httpClient.Do(req)
 	responseTime := time.Since(responseTimeStart)
 	if err != nil {
-		pack := <-hi.ir.InChan()
+		pack := hi.ir.NewPack()
+		if pack == nil {
+			return
+		}
 		pack.Message.SetUuid(uuid.NewRandom())
 		pack.Message.SetTimestamp(time.Now().UnixNano())
 		pack.Message.SetType("heka.httpinput.error")
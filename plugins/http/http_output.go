@@ -16,12 +16,15 @@ package http
 
 import (
 	"bytes"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/mozilla-services/heka/pipeline"
+	"github.com/mozilla-services/heka/plugins"
 	"github.com/mozilla-services/heka/plugins/tcp"
 	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/url"
 	"strings"
@@ -32,8 +35,11 @@ type HttpOutput struct {
 	*HttpOutputConfig
 	url          *url.URL
 	client       *http.Client
+	headers      http.Header
 	useBasicAuth bool
 	sendBody     bool
+	retryHelper  *pipeline.RetryHelper
+	escape       func(string) string
 }
 
 type HttpOutputConfig struct {
@@ -43,17 +49,51 @@ type HttpOutputConfig struct {
 	Headers     http.Header
 	Username    string `toml:"username"`
 	Password    string `toml:"password"`
+	// Token to send in a bearer token `Authorization` header.
+	BearerToken string `toml:"bearer_token"`
 	Tls         tcp.TlsConfig
+	// Template used to generate the request body for each message, in place
+	// of the encoder. May contain `%{<name>}` placeholders.
+	BodyTemplate string `toml:"body_template"`
+	// Escaping applied to values interpolated into the body template, either
+	// "json" or "none".
+	TemplateEscape string `toml:"template_escape"`
+	// Number of messages that will be sent in a single request.
+	FlushCount int `toml:"flush_count"`
+	// Interval at which partial batches will be sent, in milliseconds.
+	FlushInterval uint32 `toml:"flush_interval"`
+	// Strings used to wrap and separate the messages in a batched request
+	// body.
+	BatchPrefix    string `toml:"batch_prefix"`
+	BatchSeparator string `toml:"batch_separator"`
+	BatchSuffix    string `toml:"batch_suffix"`
+	// Number of times a failed request will be retried. Requests are retried
+	// on connection errors and on 429 and 5xx responses.
+	MaxRetries int `toml:"max_retries"`
+	// Optional proxy to send requests through.
+	Proxy *tcp.ProxyConfig `toml:"proxy"`
+	// Number of seconds the addresses the server's host name resolves to are
+	// cached for. 0 re-resolves the name on every new connection.
+	DnsCacheTtl uint `toml:"dns_cache_ttl"`
 }
 
 func (o *HttpOutput) ConfigStruct() interface{} {
 	return &HttpOutputConfig{
-		HttpTimeout: 0,
-		Headers:     make(http.Header),
-		Method:      "POST",
+		HttpTimeout:    0,
+		Headers:        make(http.Header),
+		Method:         "POST",
+		TemplateEscape: "json",
+		FlushCount:     1,
+		DnsCacheTtl:    30,
 	}
 }
 
+// Escapes a string so it can be safely embedded in a JSON string literal.
+func jsonEscape(s string) string {
+	b, _ := json.Marshal(s)
+	return string(b[1 : len(b)-1])
+}
+
 func (o *HttpOutput) Init(config interface{}) (err error) {
 	o.HttpOutputConfig = config.(*HttpOutputConfig)
 	if o.url, err = url.Parse(o.Address); err != nil {
@@ -76,46 +116,187 @@ func (o *HttpOutput) Init(config interface{}) (err error) {
 	if o.Username != "" || o.Password != "" {
 		o.useBasicAuth = true
 	}
+	o.headers = make(http.Header)
+	for key, vals := range o.Headers {
+		o.headers[key] = vals
+	}
+	if o.BearerToken != "" {
+		if o.useBasicAuth {
+			return errors.New("Can't use both basic auth and a bearer token.")
+		}
+		o.headers.Set("Authorization", "Bearer "+o.BearerToken)
+	}
+	transport := &http.Transport{}
 	if o.url.Scheme == "https" {
-		transport := &http.Transport{}
 		if transport.TLSClientConfig, err = tcp.CreateGoTlsConfig(&o.Tls); err != nil {
 			return fmt.Errorf("TLS init error: %s", err.Error())
 		}
-		o.client.Transport = transport
+	}
+	if o.Proxy != nil {
+		if transport.Dial, err = tcp.NewProxyDialer(o.Proxy, new(net.Dialer)); err != nil {
+			return err
+		}
+	} else {
+		ttl := time.Duration(o.DnsCacheTtl) * time.Second
+		transport.Dial = tcp.NewCachingDialer(new(net.Dialer), ttl).Dial
+	}
+	o.client.Transport = transport
+	switch o.TemplateEscape {
+	case "json":
+		o.escape = jsonEscape
+	case "none", "":
+		o.escape = nil
+	default:
+		return fmt.Errorf("`template_escape` must be 'json' or 'none', got %s",
+			o.TemplateEscape)
+	}
+	if o.FlushCount < 1 {
+		o.FlushCount = 1
+	}
+	if o.MaxRetries < 0 {
+		return errors.New("`max_retries` must not be negative.")
+	}
+	o.retryHelper, err = pipeline.NewRetryHelper(o.retryOptions())
+	if err != nil {
+		return fmt.Errorf("can't create retry helper: %s", err.Error())
 	}
 	return
 }
 
+// The output's own retry settings, which a `backoff` section can override.
+func (o *HttpOutput) retryOptions() pipeline.RetryOptions {
+	return pipeline.RetryOptions{
+		MaxDelay:   "5s",
+		Delay:      "250ms",
+		MaxRetries: o.MaxRetries,
+	}
+}
+
+// Generates the request data for a single message, using either the body
+// template or the output's encoder.
+func (o *HttpOutput) encode(or pipeline.OutputRunner, pack *pipeline.PipelinePack) (
+	[]byte, error) {
+
+	if o.BodyTemplate != "" {
+		return []byte(plugins.InterpolateMessageStringEscaped(o.BodyTemplate, pack.Message,
+			o.escape)), nil
+	}
+	return or.Encode(pack)
+}
+
 func (o *HttpOutput) Run(or pipeline.OutputRunner, h pipeline.PluginHelper) (err error) {
-	if or.Encoder() == nil {
+	if o.BodyTemplate == "" && or.Encoder() == nil {
 		return errors.New("Encoder must be specified.")
 	}
+	o.retryHelper, err = pipeline.NewRunnerRetryHelper(or, o.retryOptions())
+	if err != nil {
+		return fmt.Errorf("can't create retry helper: %s", err.Error())
+	}
 
 	var (
 		e        error
 		outBytes []byte
+		pack     *pipeline.PipelinePack
+		ok       = true
+		count    int
+		batch    bytes.Buffer
+		tick     <-chan time.Time
+		// Trackers of the batched messages, released once it's sent.
+		trackers []*pipeline.DeliveryTracker
 	)
 	inChan := or.InChan()
 
-	for pack := range inChan {
-		outBytes, e = or.Encode(pack)
-		pack.Recycle()
+	if o.FlushInterval > 0 && o.FlushCount > 1 {
+		ticker := time.NewTicker(time.Duration(o.FlushInterval) * time.Millisecond)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	flush := func() {
+		if count == 0 {
+			return
+		}
+		batch.WriteString(o.BatchSuffix)
+		e := o.request(or, batch.Bytes())
 		if e != nil {
 			or.LogError(e)
-			continue
 		}
-		if outBytes == nil {
-			continue
+		for _, tracker := range trackers {
+			if e != nil {
+				tracker.Fail()
+			} else {
+				tracker.Done()
+			}
 		}
-		if e = o.request(or, outBytes); e != nil {
-			or.LogError(e)
+		trackers = trackers[:0]
+		batch.Reset()
+		count = 0
+	}
+
+	for ok {
+		select {
+		case pack, ok = <-inChan:
+			if !ok {
+				flush()
+				break
+			}
+			tracker := pack.Tracker
+			outBytes, e = o.encode(or, pack)
+			pack.Recycle()
+			if e != nil {
+				or.LogError(e)
+				tracker.Fail()
+				continue
+			}
+			if outBytes == nil {
+				tracker.Done()
+				continue
+			}
+			if tracker != nil {
+				trackers = append(trackers, tracker)
+			}
+			if count == 0 {
+				batch.WriteString(o.BatchPrefix)
+			} else {
+				batch.WriteString(o.BatchSeparator)
+			}
+			batch.Write(outBytes)
+			if count++; count >= o.FlushCount {
+				flush()
+			}
+		case <-tick:
+			flush()
 		}
 	}
 
 	return
 }
 
+// Tracked messages are only acknowledged once the request they're sent in has
+// succeeded.
+func (o *HttpOutput) AcksDelivery() bool {
+	return true
+}
+
+// Makes the HTTP request, retrying failures according to the `max_retries`
+// setting.
 func (o *HttpOutput) request(or pipeline.OutputRunner, outBytes []byte) (err error) {
+	var retry bool
+	o.retryHelper.Reset()
+	for {
+		if err, retry = o.doRequest(outBytes); err == nil || !retry {
+			return
+		}
+		if o.retryHelper.Wait() != nil {
+			return
+		}
+		or.LogMessage(fmt.Sprintf("%s; retrying", err.Error()))
+	}
+}
+
+// Makes a single HTTP request. The returned bool indicates whether or not a
+// failed request can be retried.
+func (o *HttpOutput) doRequest(outBytes []byte) (err error, retry bool) {
 	var (
 		resp       *http.Response
 		reader     io.Reader
@@ -125,7 +306,7 @@ func (o *HttpOutput) request(or pipeline.OutputRunner, outBytes []byte) (err err
 	req := &http.Request{
 		Method: o.Method,
 		URL:    o.url,
-		Header: o.Headers,
+		Header: o.headers,
 	}
 	if o.useBasicAuth {
 		req.SetBasicAuth(o.Username, o.Password)
@@ -138,17 +319,18 @@ func (o *HttpOutput) request(or pipeline.OutputRunner, outBytes []byte) (err err
 		req.Body = readCloser
 	}
 	if resp, err = o.client.Do(req); err != nil {
-		return fmt.Errorf("Error making HTTP request: %s", err.Error())
+		return fmt.Errorf("Error making HTTP request: %s", err.Error()), true
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode >= 400 {
+		retry = resp.StatusCode == 429 || resp.StatusCode >= 500
 		body, err := ioutil.ReadAll(resp.Body)
 		if err != nil {
-			return fmt.Errorf("Error reading HTTP response: %s", err.Error())
+			return fmt.Errorf("Error reading HTTP response: %s", err.Error()), retry
 		}
 		return fmt.Errorf("HTTP Error code returned: %d %s - %s",
-			resp.StatusCode, resp.Status, string(body))
+			resp.StatusCode, resp.Status, string(body)), retry
 	}
 	return
 }
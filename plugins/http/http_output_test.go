@@ -97,6 +97,26 @@ func HttpOutputSpec(c gs.Context) {
 			c.Expect(err, gs.Not(gs.IsNil))
 		})
 
+		c.Specify("rejects basic auth combined w/ a bearer token", func() {
+			config.Address = "http://localhost:8080/"
+			config.Username = "user"
+			config.BearerToken = "token"
+			err := httpOutput.Init(config)
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+
+		c.Specify("renders a JSON body template", func() {
+			config.Address = "http://localhost:8080/"
+			config.BodyTemplate = `{"text": "%{Payload}", "host": "%{Hostname}"}`
+			err := httpOutput.Init(config)
+			c.Assume(err, gs.IsNil)
+			pack.Message.SetPayload(`say "hi"`)
+			body, err := httpOutput.encode(oth.MockOutputRunner, pack)
+			c.Expect(err, gs.IsNil)
+			c.Expect(string(body), gs.Equals,
+				`{"text": "say \"hi\"", "host": "my.host.name"}`)
+		})
+
 		c.Specify("that is started", func() {
 			server := httptest.NewServer(handler)
 			defer server.Close()
@@ -197,6 +217,69 @@ func HttpOutputSpec(c gs.Context) {
 				c.Expect(string(decodedAuth), gs.Equals, "user:pass")
 			})
 
+			c.Specify("uses a bearer token when specified", func() {
+				config.BearerToken = "s3cr3t"
+				err := httpOutput.Init(config)
+				c.Expect(err, gs.IsNil)
+				runWg.Add(1)
+				go runOutput()
+				handleWg.Add(1)
+				inChan <- pack
+				close(inChan)
+				handleWg.Wait()
+				runWg.Wait()
+				c.Expect(reqHeader.Get("Authorization"), gs.Equals, "Bearer s3cr3t")
+				c.Expect(len(config.Headers["Authorization"]), gs.Equals, 0)
+			})
+
+			c.Specify("batches messages", func() {
+				config.FlushCount = 2
+				config.BatchPrefix = "["
+				config.BatchSeparator = ","
+				config.BatchSuffix = "]"
+				err := httpOutput.Init(config)
+				c.Expect(err, gs.IsNil)
+				oth.MockOutputRunner.EXPECT().Encode(gomock.Any()).Return(
+					[]byte(payload), nil)
+				pack2 := pipeline.NewPipelinePack(make(chan *pipeline.PipelinePack, 1))
+				pack2.Message = pipeline_ts.GetTestMessage()
+				runWg.Add(1)
+				handleWg.Add(1)
+				inChan <- pack
+				go runOutput()
+				inChan <- pack2
+				close(inChan)
+				handleWg.Wait()
+				runWg.Wait()
+				c.Expect(reqBody, gs.Equals, "["+payload+","+payload+"]")
+			})
+
+			c.Specify("retries failed requests", func() {
+				config.MaxRetries = 2
+				err := httpOutput.Init(config)
+				c.Expect(err, gs.IsNil)
+				handler.respBody = ""
+				handler.respCode = 503
+				origServe := handler.serveHttp
+				requests := 0
+				handler.serveHttp = func(rw http.ResponseWriter, req *http.Request) {
+					if requests++; requests > 1 {
+						handler.respBody = "OK"
+					}
+					origServe(rw, req)
+				}
+				oth.MockOutputRunner.EXPECT().LogMessage(gomock.Any())
+				runWg.Add(1)
+				go runOutput()
+				handleWg.Add(2)
+				inChan <- pack
+				close(inChan)
+				handleWg.Wait()
+				runWg.Wait()
+				c.Expect(requests, gs.Equals, 2)
+				c.Expect(reqBody, gs.Equals, payload)
+			})
+
 			c.Specify("logs error responses", func() {
 				handler.respBody = ""
 				handler.respCode = 500
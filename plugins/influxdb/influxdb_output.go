@@ -0,0 +1,349 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package influxdb
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/mozilla-services/heka/message"
+	. "github.com/mozilla-services/heka/pipeline"
+	"github.com/mozilla-services/heka/plugins"
+	"github.com/mozilla-services/heka/plugins/tcp"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Output plugin that writes message data to InfluxDB using the line
+// protocol HTTP write API.
+type InfluxDbOutput struct {
+	*InfluxDbOutputConfig
+	url                 *url.URL
+	client              *http.Client
+	tagNames            []string
+	skipFields          map[string]bool
+	fieldNames          *plugins.FieldNameSanitizer
+	precision           time.Duration
+	processMessageCount int64
+	dropMessageCount    int64
+	reportLock          sync.Mutex
+}
+
+// ConfigStruct for InfluxDbOutput plugin.
+type InfluxDbOutputConfig struct {
+	// Base URL of the InfluxDB HTTP API.
+	Address string
+	// Database the points should be written to.
+	Database string
+	// Retention policy to write to, if empty the database default is used.
+	RetentionPolicy string `toml:"retention_policy"`
+	// Credentials for InfluxDB authentication.
+	Username string
+	Password string
+	// Precision of the point timestamps, one of "n", "u", "ms", "s", "m", or
+	// "h".
+	Precision string `toml:"timestamp_precision"`
+	// Measurement name, may contain `%{<name>}` placeholders.
+	Measurement string
+	// Map of tag name to tag value template. Values may contain
+	// `%{<name>}` placeholders.
+	Tags map[string]string
+	// Dynamic message fields that should be written as point fields. If
+	// empty, all dynamic fields not listed in `skip_fields` are written.
+	Fields []string
+	// Dynamic message fields that should never be written as point fields.
+	SkipFields []string `toml:"skip_fields"`
+	// Number of points that will trigger a write.
+	FlushCount int `toml:"flush_count"`
+	// Interval at which accumulated points will be written, in
+	// milliseconds.
+	FlushInterval uint32 `toml:"flush_interval"`
+	// HTTP request timeout, in milliseconds. 0 means no timeout.
+	HttpTimeout uint32 `toml:"http_timeout"`
+	Tls         tcp.TlsConfig
+	// Clean up of point field names, nil unless configured.
+	FieldNames *plugins.FieldNameConfig `toml:"field_names"`
+}
+
+func (o *InfluxDbOutput) ConfigStruct() interface{} {
+	return &InfluxDbOutputConfig{
+		Address:       "http://localhost:8086",
+		Precision:     "ms",
+		Measurement:   "%{Type}",
+		FlushCount:    1000,
+		FlushInterval: 1000,
+		HttpTimeout:   5000,
+	}
+}
+
+func (o *InfluxDbOutput) Init(config interface{}) (err error) {
+	o.InfluxDbOutputConfig = config.(*InfluxDbOutputConfig)
+
+	if o.Database == "" {
+		return errors.New("`database` setting is required")
+	}
+	if o.Measurement == "" {
+		return errors.New("`measurement` must not be empty")
+	}
+
+	switch o.Precision {
+	case "n":
+		o.precision = time.Nanosecond
+	case "u":
+		o.precision = time.Microsecond
+	case "ms":
+		o.precision = time.Millisecond
+	case "s":
+		o.precision = time.Second
+	case "m":
+		o.precision = time.Minute
+	case "h":
+		o.precision = time.Hour
+	default:
+		return fmt.Errorf("unsupported `timestamp_precision`: %s", o.Precision)
+	}
+
+	if o.url, err = url.Parse(o.Address); err != nil {
+		return fmt.Errorf("can't parse URL '%s': %s", o.Address, err.Error())
+	}
+	if o.url.Scheme != "http" && o.url.Scheme != "https" {
+		return errors.New("`address` must contain an absolute http or https URL")
+	}
+	o.url.Path = strings.TrimRight(o.url.Path, "/") + "/write"
+	query := o.url.Query()
+	query.Set("db", o.Database)
+	query.Set("precision", o.Precision)
+	if o.RetentionPolicy != "" {
+		query.Set("rp", o.RetentionPolicy)
+	}
+	o.url.RawQuery = query.Encode()
+
+	o.client = new(http.Client)
+	if o.HttpTimeout > 0 {
+		o.client.Timeout = time.Duration(o.HttpTimeout) * time.Millisecond
+	}
+	if o.url.Scheme == "https" {
+		transport := &http.Transport{}
+		if transport.TLSClientConfig, err = tcp.CreateGoTlsConfig(&o.Tls); err != nil {
+			return fmt.Errorf("TLS init error: %s", err.Error())
+		}
+		o.client.Transport = transport
+	}
+
+	// Sort the tag names, InfluxDB performs best when tags are in key order.
+	o.tagNames = make([]string, 0, len(o.Tags))
+	for name := range o.Tags {
+		o.tagNames = append(o.tagNames, name)
+	}
+	sort.Strings(o.tagNames)
+
+	o.skipFields = make(map[string]bool)
+	for _, name := range o.SkipFields {
+		o.skipFields[name] = true
+	}
+	o.fieldNames = plugins.NewFieldNameSanitizer(o.FieldNames)
+	return
+}
+
+// Escapes the characters that have special meaning in the line protocol.
+var (
+	measurementEscaper = strings.NewReplacer(",", `\,`, " ", `\ `)
+	keyEscaper         = strings.NewReplacer(",", `\,`, " ", `\ `, "=", `\=`)
+	stringEscaper      = strings.NewReplacer(`"`, `\"`, `\`, `\\`)
+)
+
+// Appends a line protocol representation of a field value to the buffer.
+// Returns false if the value type isn't supported.
+func writeFieldValue(buf *bytes.Buffer, value interface{}) bool {
+	switch v := value.(type) {
+	case string:
+		buf.WriteByte('"')
+		buf.WriteString(stringEscaper.Replace(v))
+		buf.WriteByte('"')
+	case int64:
+		buf.WriteString(strconv.FormatInt(v, 10))
+		buf.WriteByte('i')
+	case float64:
+		buf.WriteString(strconv.FormatFloat(v, 'f', -1, 64))
+	case bool:
+		buf.WriteString(strconv.FormatBool(v))
+	default:
+		return false
+	}
+	return true
+}
+
+// Appends a single line protocol point describing the message to the
+// buffer.
+func (o *InfluxDbOutput) writePoint(msg *message.Message, buf *bytes.Buffer) error {
+	start := buf.Len()
+	measurement := plugins.InterpolateMessageString(o.Measurement, msg)
+	buf.WriteString(measurementEscaper.Replace(measurement))
+	for _, name := range o.tagNames {
+		val := plugins.InterpolateMessageString(o.Tags[name], msg)
+		if val == "" {
+			// Empty tag values aren't allowed.
+			continue
+		}
+		buf.WriteByte(',')
+		buf.WriteString(keyEscaper.Replace(name))
+		buf.WriteByte('=')
+		buf.WriteString(keyEscaper.Replace(val))
+	}
+
+	sep := byte(' ')
+	writeField := func(field *message.Field) {
+		value := field.GetValue()
+		if value == nil {
+			return
+		}
+		mark := buf.Len()
+		buf.WriteByte(sep)
+		buf.WriteString(keyEscaper.Replace(o.fieldNames.Sanitize(field.GetName())))
+		buf.WriteByte('=')
+		if !writeFieldValue(buf, value) {
+			buf.Truncate(mark)
+			return
+		}
+		sep = ','
+	}
+
+	if len(o.Fields) > 0 {
+		for _, name := range o.Fields {
+			if field := msg.FindFirstField(name); field != nil {
+				writeField(field)
+			}
+		}
+	} else {
+		for _, field := range msg.Fields {
+			if !o.skipFields[field.GetName()] {
+				writeField(field)
+			}
+		}
+	}
+	if sep == ' ' {
+		buf.Truncate(start)
+		return errors.New("message has no usable fields")
+	}
+
+	buf.WriteByte(' ')
+	buf.WriteString(strconv.FormatInt(msg.GetTimestamp()/int64(o.precision), 10))
+	buf.WriteByte('\n')
+	return nil
+}
+
+func (o *InfluxDbOutput) Run(or OutputRunner, h PluginHelper) (err error) {
+	var (
+		ok     = true
+		pack   *PipelinePack
+		count  int
+		inChan = or.InChan()
+		buf    = new(bytes.Buffer)
+		tick   <-chan time.Time
+	)
+
+	if o.FlushInterval > 0 {
+		ticker := time.NewTicker(time.Duration(o.FlushInterval) * time.Millisecond)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	flush := func() {
+		if count == 0 {
+			return
+		}
+		if e := o.write(buf.Bytes()); e != nil {
+			or.LogError(e)
+			atomic.AddInt64(&o.dropMessageCount, int64(count))
+		} else {
+			atomic.AddInt64(&o.processMessageCount, int64(count))
+		}
+		buf.Reset()
+		count = 0
+	}
+
+	for ok {
+		select {
+		case pack, ok = <-inChan:
+			if !ok {
+				flush()
+				break
+			}
+			e := o.writePoint(pack.Message, buf)
+			pack.Recycle()
+			if e != nil {
+				or.LogError(e)
+				atomic.AddInt64(&o.dropMessageCount, 1)
+				continue
+			}
+			if count++; o.FlushCount > 0 && count >= o.FlushCount {
+				flush()
+			}
+		case <-tick:
+			flush()
+		}
+	}
+	return
+}
+
+// Sends a batch of points to the InfluxDB write endpoint.
+func (o *InfluxDbOutput) write(body []byte) (err error) {
+	req, err := http.NewRequest("POST", o.url.String(), bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("can't create HTTP request: %s", err.Error())
+	}
+	req.Header.Set("Content-Type", "text/plain")
+	if o.Username != "" || o.Password != "" {
+		req.SetBasicAuth(o.Username, o.Password)
+	}
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("error making HTTP request: %s", err.Error())
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		respBody, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("InfluxDB write failed: %s - %s", resp.Status,
+			strings.TrimSpace(string(respBody)))
+	}
+	return
+}
+
+// Satisfies the `pipeline.ReportingPlugin` interface to provide plugin state
+// information to the Heka report and dashboard.
+func (o *InfluxDbOutput) ReportMsg(msg *message.Message) error {
+	o.reportLock.Lock()
+	defer o.reportLock.Unlock()
+
+	message.NewInt64Field(msg, "ProcessMessageCount",
+		atomic.LoadInt64(&o.processMessageCount), "count")
+	message.NewInt64Field(msg, "DropMessageCount",
+		atomic.LoadInt64(&o.dropMessageCount), "count")
+	return nil
+}
+
+func init() {
+	RegisterPlugin("InfluxDbOutput", func() interface{} {
+		return new(InfluxDbOutput)
+	})
+}
@@ -0,0 +1,176 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package influxdb
+
+import (
+	"bytes"
+	"github.com/mozilla-services/heka/message"
+	. "github.com/mozilla-services/heka/pipeline"
+	pipeline_ts "github.com/mozilla-services/heka/pipeline/testsupport"
+	"github.com/mozilla-services/heka/plugins"
+	plugins_ts "github.com/mozilla-services/heka/plugins/testsupport"
+	"github.com/rafrombrc/gomock/gomock"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+)
+
+func InfluxDbOutputSpec(c gs.Context) {
+	t := new(pipeline_ts.SimpleT)
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	output := new(InfluxDbOutput)
+	config := output.ConfigStruct().(*InfluxDbOutputConfig)
+	config.Database = "metrics"
+
+	msg := pipeline_ts.GetTestMessage()
+	field, _ := message.NewField("count", int64(5), "")
+	msg.AddField(field)
+	field, _ = message.NewField("rate", 1.5, "")
+	msg.AddField(field)
+
+	c.Specify("An InfluxDbOutput", func() {
+		c.Specify("requires a database", func() {
+			config.Database = ""
+			err := output.Init(config)
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+
+		c.Specify("rejects an unknown precision", func() {
+			config.Precision = "fortnight"
+			err := output.Init(config)
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+
+		c.Specify("builds the write URL", func() {
+			config.RetentionPolicy = "weekly"
+			err := output.Init(config)
+			c.Assume(err, gs.IsNil)
+			c.Expect(output.url.String(), gs.Equals,
+				"http://localhost:8086/write?db=metrics&precision=ms&rp=weekly")
+		})
+
+		c.Specify("encodes points", func() {
+			config.Measurement = "heka.%{Logger}"
+			config.Tags = map[string]string{
+				"host": "%{Hostname}",
+				"type": "%{Type}",
+				"none": "%{missing}",
+			}
+			buf := new(bytes.Buffer)
+
+			c.Specify("w/ all fields", func() {
+				err := output.Init(config)
+				c.Assume(err, gs.IsNil)
+				err = output.writePoint(msg, buf)
+				c.Expect(err, gs.IsNil)
+				c.Expect(buf.String(), gs.Equals,
+					`heka.GoSpec,host=my.host.name,type=TEST foo="bar",count=5i,rate=1.5 `+
+						"1136239445000\n")
+			})
+
+			c.Specify("w/ selected fields", func() {
+				config.Fields = []string{"rate", "missing"}
+				err := output.Init(config)
+				c.Assume(err, gs.IsNil)
+				err = output.writePoint(msg, buf)
+				c.Expect(err, gs.IsNil)
+				c.Expect(buf.String(), gs.Equals,
+					"heka.GoSpec,host=my.host.name,type=TEST rate=1.5 1136239445000\n")
+			})
+
+			c.Specify("w/ sanitized field names", func() {
+				field, _ := message.NewField("Disk Free.root", int64(7), "")
+				msg.AddField(field)
+				config.Fields = []string{"Disk Free.root"}
+				config.FieldNames = &plugins.FieldNameConfig{
+					Lowercase:     true,
+					ReplaceSpaces: "_",
+					ReplaceDots:   "_",
+				}
+				err := output.Init(config)
+				c.Assume(err, gs.IsNil)
+				err = output.writePoint(msg, buf)
+				c.Expect(err, gs.IsNil)
+				c.Expect(buf.String(), gs.Equals,
+					"heka.GoSpec,host=my.host.name,type=TEST disk_free_root=7i 1136239445000\n")
+			})
+
+			c.Specify("and skips messages w/o fields", func() {
+				config.SkipFields = []string{"foo", "count", "rate"}
+				err := output.Init(config)
+				c.Assume(err, gs.IsNil)
+				err = output.writePoint(msg, buf)
+				c.Expect(err, gs.Not(gs.IsNil))
+				c.Expect(buf.Len(), gs.Equals, 0)
+			})
+		})
+
+		c.Specify("writes batches to the server", func() {
+			var (
+				reqBody  string
+				reqQuery string
+				username string
+				password string
+			)
+			done := make(chan struct{}, 1)
+			server := httptest.NewServer(http.HandlerFunc(
+				func(rw http.ResponseWriter, req *http.Request) {
+					body, _ := ioutil.ReadAll(req.Body)
+					reqBody = string(body)
+					reqQuery = req.URL.RawQuery
+					username, password, _ = req.BasicAuth()
+					rw.WriteHeader(http.StatusNoContent)
+					done <- struct{}{}
+				}))
+			defer server.Close()
+
+			config.Address = server.URL
+			config.Username = "heka"
+			config.Password = "secret"
+			config.Fields = []string{"count"}
+			config.FlushCount = 2
+			config.FlushInterval = 0
+			err := output.Init(config)
+			c.Assume(err, gs.IsNil)
+
+			oth := plugins_ts.NewOutputTestHelper(ctrl)
+			inChan := make(chan *PipelinePack, 2)
+			oth.MockOutputRunner.EXPECT().InChan().Return(inChan)
+			for i := 0; i < 2; i++ {
+				pack := NewPipelinePack(make(chan *PipelinePack, 1))
+				pack.Message = msg
+				inChan <- pack
+			}
+			errChan := make(chan error, 1)
+			go func() {
+				errChan <- output.Run(oth.MockOutputRunner, oth.MockHelper)
+			}()
+			<-done
+			close(inChan)
+			err = <-errChan
+			c.Expect(err, gs.IsNil)
+
+			c.Expect(reqQuery, gs.Equals, "db=metrics&precision=ms")
+			c.Expect(username, gs.Equals, "heka")
+			c.Expect(password, gs.Equals, "secret")
+			line := "TEST count=5i 1136239445000\n"
+			c.Expect(reqBody, gs.Equals, line+line)
+			c.Expect(output.processMessageCount, gs.Equals, int64(2))
+		})
+	})
+}
@@ -18,6 +18,7 @@ import (
 	"errors"
 	"fmt"
 	"github.com/mozilla-services/heka/pipeline"
+	"github.com/mozilla-services/heka/plugins"
 	"github.com/mozilla-services/heka/plugins/tcp"
 	"github.com/thoj/go-ircevent"
 	"strings"
@@ -57,6 +58,13 @@ type IrcOutputConfig struct {
 	// Max number of attempts to rejoin an irc channel before giving up
 	MaxJoinRetries    uint `toml:"max_join_retries"`
 	VerboseIRCLogging bool `toml:"verbose_irc_logging"`
+	// Template used to generate the announced text, may contain `%{<name>}`
+	// placeholders. If set, no encoder is required.
+	Template string `toml:"template"`
+	// Password sent to NickServ in an IDENTIFY command after connecting.
+	NickServPassword string `toml:"nickserv_password"`
+	// Nick of the nickname service.
+	NickServNick string `toml:"nickserv_nick"`
 }
 
 func (output *IrcOutput) ConfigStruct() interface{} {
@@ -67,6 +75,7 @@ func (output *IrcOutput) ConfigStruct() interface{} {
 		TimeBeforeReconnect: uint(3),
 		TimeBeforeRejoin:    uint(3),
 		MaxJoinRetries:      uint(3),
+		NickServNick:        "NickServ",
 	}
 }
 
@@ -130,7 +139,7 @@ func (output *IrcOutput) Init(config interface{}) error {
 
 func (output *IrcOutput) Run(runner pipeline.OutputRunner,
 	helper pipeline.PluginHelper) error {
-	if runner.Encoder() == nil {
+	if runner.Encoder() == nil && output.Template == "" {
 		return errors.New("Encoder required.")
 	}
 
@@ -166,20 +175,15 @@ func (output *IrcOutput) Run(runner pipeline.OutputRunner,
 		if !ok {
 			break
 		}
-		outgoing, err = runner.Encode(pack)
+		if output.Template != "" {
+			outgoing = []byte(plugins.InterpolateMessageString(output.Template, pack.Message))
+		} else {
+			outgoing, err = runner.Encode(pack)
+		}
 		if err != nil {
 			output.runner.LogError(err)
 		} else if outgoing != nil {
-			// Send the message to each irc channel. If the out queue is full,
-			// then we need to drop the message and log an error.
-			for i, ircChannel := range output.Channels {
-				ircMsg := IrcMsg{outgoing, ircChannel, i}
-				select {
-				case output.OutQueue <- ircMsg:
-				default:
-					output.runner.LogError(ErrOutQueueFull)
-				}
-			}
+			output.queueLines(outgoing)
 		}
 		pack.Recycle()
 	}
@@ -187,6 +191,26 @@ func (output *IrcOutput) Run(runner pipeline.OutputRunner,
 	return nil
 }
 
+// queueLines sends each line of the outgoing text to each irc channel as a
+// separate message, since an irc message can't contain line breaks. If the out
+// queue is full, then we need to drop the message and log an error.
+func (output *IrcOutput) queueLines(outgoing []byte) {
+	for _, line := range strings.Split(string(outgoing), "\n") {
+		line = strings.TrimRight(line, "\r")
+		if line == "" {
+			continue
+		}
+		for i, ircChannel := range output.Channels {
+			ircMsg := IrcMsg{[]byte(line), ircChannel, i}
+			select {
+			case output.OutQueue <- ircMsg:
+			default:
+				output.runner.LogError(ErrOutQueueFull)
+			}
+		}
+	}
+}
+
 func (output *IrcOutput) CleanupForRestart() {
 	// Intentially left empty. Cleanup happens in Run()
 }
@@ -390,6 +414,11 @@ func processOutQueue(output *IrcOutput) {
 func registerCallbacks(output *IrcOutput) {
 	// add a callback to check if we've gotten successfully connected
 	output.Conn.AddCallback(CONNECTED, func(event *irc.Event) {
+		// Identify before joining, channels may require a registered nick.
+		if output.NickServPassword != "" {
+			output.Conn.Privmsg(output.NickServNick,
+				"IDENTIFY "+output.NickServPassword)
+		}
 		// We use the config channels for joining,
 		// since they contain the channel keys
 		for _, ircChan := range output.IrcOutputConfig.Channels {
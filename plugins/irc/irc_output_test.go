@@ -119,6 +119,36 @@ func IrcOutputSpec(c gs.Context) {
 				c.Expect(msgs[0], gs.Equals, string(*msg.Payload))
 			})
 
+			c.Specify("identifies w/ NickServ and sends templated lines", func() {
+				config.NickServPassword = "secret"
+				config.Template = "%{Type}: %{Payload}\nsecond line\n"
+				err := ircOutput.Init(config)
+				c.Assume(err, gs.IsNil)
+				ircChan := ircOutput.Channels[0]
+
+				startOutput()
+				c.Expect(len(mockIrcConn.msgs["NickServ"]), gs.Equals, 1)
+				c.Expect(mockIrcConn.msgs["NickServ"][0], gs.Equals, "IDENTIFY secret")
+
+				inChan <- pack
+				// wait for both lines to arrive
+				p1 := <-ircOutput.OutQueue
+				p2 := <-ircOutput.OutQueue
+				ircOutput.OutQueue <- p1
+				ircOutput.OutQueue <- p2
+				// one line is sent per tick
+				tickChan <- time.Now()
+				tickChan <- time.Now()
+
+				close(inChan)
+				wg.Wait()
+
+				msgs := mockIrcConn.msgs[ircChan]
+				c.Expect(len(msgs), gs.Equals, 2)
+				c.Expect(msgs[0], gs.Equals, "TEST: Test Payload")
+				c.Expect(msgs[1], gs.Equals, "second line")
+			})
+
 			c.Specify("drops messages when outqueue is full", func() {
 				config.QueueSize = 1
 				err := ircOutput.Init(config)
@@ -0,0 +1,441 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package plugins
+
+import (
+	"bytes"
+	"code.google.com/p/go-uuid/uuid"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/mozilla-services/heka/message"
+	"github.com/mozilla-services/heka/pipeline"
+	"sort"
+	"strings"
+	"time"
+)
+
+// JsonDecoder parses messages from the JSON object representation the
+// JsonEncoder generates.
+type JsonDecoder struct {
+	*JsonDecoderConfig
+	strict  bool
+	include map[string]bool
+	runner  pipeline.DecoderRunner
+}
+
+// ConfigStruct for JsonDecoder plugin.
+type JsonDecoderConfig struct {
+	// "strict" rejects JSON w/ unknown or missing headers, "lenient" accepts
+	// partial messages, leaving the headers the JSON doesn't set as they
+	// were.
+	Mode string
+	// Message headers taken from the JSON, as in JsonEncoder's `fields`.
+	// Strict mode requires all of them. Defaults to all of them.
+	Headers []string
+	// Whether the payload may hold an array of messages rather than a single
+	// one.
+	AcceptArrays bool `toml:"accept_arrays"`
+	// Whether the JSON objects hold only dynamic fields, as application JSON
+	// does, rather than Heka's representation of a message.
+	FieldsOnly bool `toml:"fields_only"`
+	// Whether nested objects and arrays in the dynamic fields are flattened
+	// into separate fields.
+	Flatten bool
+	// Separator joining the keys of flattened fields.
+	FlattenSeparator string `toml:"flatten_separator"`
+	// Maximum number of keys joined into a flattened field name, deeper
+	// values are stored as JSON strings. 0 means no limit.
+	FlattenMaxDepth int `toml:"flatten_max_depth"`
+	// How flattened arrays are handled: "index" appends each element's index
+	// to the key, "join" joins the elements into a string, "first" only
+	// keeps the first element.
+	FlattenArrays string `toml:"flatten_arrays"`
+	// Separator used by the "join" array handling.
+	FlattenJoinSeparator string `toml:"flatten_join_separator"`
+}
+
+func (jd *JsonDecoder) ConfigStruct() interface{} {
+	return &JsonDecoderConfig{
+		Mode:                 "lenient",
+		Headers:              jsonHeaderNames,
+		FlattenSeparator:     ".",
+		FlattenArrays:        "index",
+		FlattenJoinSeparator: ",",
+	}
+}
+
+func (jd *JsonDecoder) Init(config interface{}) (err error) {
+	jd.JsonDecoderConfig = config.(*JsonDecoderConfig)
+	switch jd.Mode {
+	case "strict":
+		jd.strict = true
+	case "lenient":
+		jd.strict = false
+	default:
+		return fmt.Errorf("`mode` must be 'strict' or 'lenient', got '%s'", jd.Mode)
+	}
+	jd.include = make(map[string]bool)
+	for _, name := range jd.Headers {
+		valid := false
+		for _, header := range jsonHeaderNames {
+			if name == header {
+				valid = true
+				break
+			}
+		}
+		if !valid {
+			return fmt.Errorf("unknown message header: %s", name)
+		}
+		jd.include[name] = true
+	}
+	if jd.Flatten {
+		switch jd.FlattenArrays {
+		case "index", "join", "first":
+		default:
+			return fmt.Errorf("`flatten_arrays` must be 'index', 'join', or 'first', got '%s'",
+				jd.FlattenArrays)
+		}
+		if jd.FlattenMaxDepth < 0 {
+			return errors.New("`flatten_max_depth` can't be negative")
+		}
+	}
+	return
+}
+
+// Implement `WantsDecoderRunner`
+func (jd *JsonDecoder) SetDecoderRunner(dr pipeline.DecoderRunner) {
+	jd.runner = dr
+}
+
+// Converts a JSON value of a dynamic field to a value of one of the field
+// value types.
+func jsonScalarValue(v interface{}) (interface{}, bool) {
+	switch v := v.(type) {
+	case string, bool:
+		return v, true
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i, true
+		}
+		if f, err := v.Float64(); err == nil {
+			return f, true
+		}
+	}
+	return nil, false
+}
+
+// Creates a dynamic field from its JSON value, which is a scalar or an
+// array of scalars of the same type. Integers are promoted to doubles in
+// arrays that mix them.
+func jsonField(name string, v interface{}) (*message.Field, error) {
+	unsupported := fmt.Errorf("field '%s' has an unsupported value", name)
+	values, ok := v.([]interface{})
+	if !ok {
+		values = []interface{}{v}
+	}
+	if len(values) == 0 {
+		return nil, unsupported
+	}
+	scalars := make([]interface{}, len(values))
+	var hasFloat bool
+	for i, value := range values {
+		if scalars[i], ok = jsonScalarValue(value); !ok {
+			return nil, unsupported
+		}
+		_, isFloat := scalars[i].(float64)
+		hasFloat = hasFloat || isFloat
+	}
+	if hasFloat {
+		for i, scalar := range scalars {
+			if n, isInt := scalar.(int64); isInt {
+				scalars[i] = float64(n)
+			}
+		}
+	}
+	field, err := message.NewField(name, scalars[0], "")
+	if err != nil {
+		return nil, unsupported
+	}
+	for _, scalar := range scalars[1:] {
+		if err = field.AddValue(scalar); err != nil {
+			return nil, unsupported
+		}
+	}
+	return field, nil
+}
+
+// Returns the keys of a JSON object in order.
+func sortedKeys(obj map[string]interface{}) []string {
+	keys := make([]string, 0, len(obj))
+	for key := range obj {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Renders a JSON value as a string, scalars as is and anything else as JSON.
+func jsonString(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	}
+	encoded, _ := json.Marshal(v)
+	return string(encoded)
+}
+
+// Flattens a dynamic field value into fields, w/ `depth` being the number of
+// keys joined in the name so far. Returns the first error, values that
+// can't be stored in a field are skipped in lenient mode.
+func (jd *JsonDecoder) flatten(name string, v interface{}, depth int,
+	add func(*message.Field)) error {
+
+	limited := jd.FlattenMaxDepth > 0 && depth >= jd.FlattenMaxDepth
+	switch value := v.(type) {
+	case map[string]interface{}:
+		if limited {
+			return jd.flatten(name, jsonString(value), depth, add)
+		}
+		for _, key := range sortedKeys(value) {
+			if err := jd.flatten(name+jd.FlattenSeparator+key, value[key], depth+1,
+				add); err != nil {
+				return err
+			}
+		}
+		return nil
+	case []interface{}:
+		switch jd.FlattenArrays {
+		case "first":
+			if len(value) == 0 {
+				return nil
+			}
+			return jd.flatten(name, value[0], depth, add)
+		case "join":
+			parts := make([]string, len(value))
+			for i, element := range value {
+				parts[i] = jsonString(element)
+			}
+			return jd.flatten(name, strings.Join(parts, jd.FlattenJoinSeparator), depth, add)
+		}
+		if limited {
+			return jd.flatten(name, jsonString(value), depth, add)
+		}
+		for i, element := range value {
+			if err := jd.flatten(fmt.Sprintf("%s%s%d", name, jd.FlattenSeparator, i),
+				element, depth+1, add); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	field, err := jsonField(name, v)
+	if err != nil {
+		if jd.strict {
+			return err
+		}
+		return nil
+	}
+	add(field)
+	return nil
+}
+
+// Sets the message's dynamic fields from a JSON object. In strict mode the
+// existing fields are replaced and values that can't be stored in a field
+// are an error, in lenient mode such values are skipped.
+func (jd *JsonDecoder) decodeFields(raw json.RawMessage, msg *message.Message) error {
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	var fields map[string]interface{}
+	if err := dec.Decode(&fields); err != nil {
+		if jd.FieldsOnly {
+			return fmt.Errorf("not a JSON object: %s", err)
+		}
+		return fmt.Errorf("invalid Fields: %s", err)
+	}
+
+	if jd.strict {
+		msg.Fields = nil
+	}
+	add := func(field *message.Field) {
+		for _, f := range msg.FindAllFields(field.GetName()) {
+			msg.DeleteField(f)
+		}
+		msg.AddField(field)
+	}
+	for _, name := range sortedKeys(fields) {
+		if fields[name] == nil && !jd.strict {
+			continue
+		}
+		if jd.Flatten {
+			if err := jd.flatten(name, fields[name], 1, add); err != nil {
+				return err
+			}
+			continue
+		}
+		field, err := jsonField(name, fields[name])
+		if err != nil {
+			if jd.strict {
+				return err
+			}
+			continue
+		}
+		add(field)
+	}
+	return nil
+}
+
+// Sets the message headers and fields from a JSON object.
+func (jd *JsonDecoder) decodeObject(raw json.RawMessage, msg *message.Message) (err error) {
+	if jd.FieldsOnly {
+		return jd.decodeFields(raw, msg)
+	}
+	var obj map[string]json.RawMessage
+	if err = json.Unmarshal(raw, &obj); err != nil {
+		return fmt.Errorf("not a JSON object: %s", err)
+	}
+	if jd.strict {
+		for name := range obj {
+			if !jd.include[name] {
+				return fmt.Errorf("unknown header '%s'", name)
+			}
+		}
+		for _, name := range jd.Headers {
+			if _, ok := obj[name]; !ok {
+				return fmt.Errorf("missing header '%s'", name)
+			}
+		}
+	}
+
+	str := func(name string, set func(string)) {
+		value, ok := obj[name]
+		if !ok || !jd.include[name] || err != nil {
+			return
+		}
+		var s string
+		if err = json.Unmarshal(value, &s); err != nil {
+			err = fmt.Errorf("invalid %s: %s", name, err)
+			return
+		}
+		set(s)
+	}
+	integer := func(name string, set func(int32)) {
+		value, ok := obj[name]
+		if !ok || !jd.include[name] || err != nil {
+			return
+		}
+		var i int32
+		if err = json.Unmarshal(value, &i); err != nil {
+			err = fmt.Errorf("invalid %s: %s", name, err)
+			return
+		}
+		set(i)
+	}
+
+	str("Uuid", func(s string) {
+		u := uuid.Parse(s)
+		if u == nil {
+			err = fmt.Errorf("invalid Uuid: '%s'", s)
+			return
+		}
+		msg.SetUuid(u)
+	})
+	if value, ok := obj["Timestamp"]; ok && jd.include["Timestamp"] && err == nil {
+		var ts int64
+		if ts, err = jsonTimestamp(value); err != nil {
+			return
+		}
+		msg.SetTimestamp(ts)
+	}
+	str("Type", msg.SetType)
+	str("Logger", msg.SetLogger)
+	integer("Severity", msg.SetSeverity)
+	str("Payload", msg.SetPayload)
+	str("EnvVersion", msg.SetEnvVersion)
+	integer("Pid", msg.SetPid)
+	str("Hostname", msg.SetHostname)
+	if err != nil {
+		return
+	}
+	if value, ok := obj["Fields"]; ok && jd.include["Fields"] {
+		err = jd.decodeFields(value, msg)
+	}
+	return
+}
+
+// Parses a timestamp, either an RFC 3339 string or a number of nanoseconds
+// since the epoch.
+func jsonTimestamp(value json.RawMessage) (int64, error) {
+	var s string
+	if err := json.Unmarshal(value, &s); err == nil {
+		t, err := time.Parse(time.RFC3339Nano, s)
+		if err != nil {
+			return 0, fmt.Errorf("invalid Timestamp: %s", err)
+		}
+		return t.UnixNano(), nil
+	}
+	var ns int64
+	if err := json.Unmarshal(value, &ns); err != nil {
+		return 0, errors.New("invalid Timestamp: must be an RFC 3339 string or " +
+			"nanoseconds since the epoch")
+	}
+	return ns, nil
+}
+
+func (jd *JsonDecoder) Decode(pack *pipeline.PipelinePack) (packs []*pipeline.PipelinePack,
+	err error) {
+
+	payload := bytes.TrimSpace([]byte(pack.Message.GetPayload()))
+	objs := []json.RawMessage{payload}
+	if jd.AcceptArrays && len(payload) > 0 && payload[0] == '[' {
+		if err = json.Unmarshal(payload, &objs); err != nil {
+			return nil, fmt.Errorf("invalid JSON array: %s", err)
+		}
+		if len(objs) == 0 {
+			return nil, nil
+		}
+	}
+
+	// Each message is decoded into a copy of the original, so the original
+	// is left intact if any of them fails.
+	msgs := make([]*message.Message, len(objs))
+	for i, obj := range objs {
+		msgs[i] = message.CopyMessage(pack.Message)
+		if err = jd.decodeObject(obj, msgs[i]); err != nil {
+			if len(objs) > 1 {
+				err = fmt.Errorf("message %d: %s", i, err)
+			}
+			return nil, err
+		}
+	}
+	packs = make([]*pipeline.PipelinePack, len(msgs))
+	for i, msg := range msgs {
+		if i == 0 {
+			packs[i] = pack
+		} else {
+			packs[i] = jd.runner.NewPack()
+		}
+		msg.Copy(packs[i].Message)
+	}
+	return
+}
+
+func init() {
+	pipeline.RegisterPlugin("JsonDecoder", func() interface{} {
+		return new(JsonDecoder)
+	})
+}
@@ -0,0 +1,234 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package plugins
+
+import (
+	"fmt"
+	"github.com/mozilla-services/heka/pipeline"
+	pipeline_ts "github.com/mozilla-services/heka/pipeline/testsupport"
+	"github.com/mozilla-services/heka/pipelinemock"
+	"github.com/rafrombrc/gomock/gomock"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+	"strings"
+)
+
+// Collects the errors a decoder corpus check reports.
+type corpusRecorder struct {
+	errors []string
+}
+
+func (r *corpusRecorder) Errorf(format string, args ...interface{}) {
+	r.errors = append(r.errors, fmt.Sprintf(format, args...))
+}
+
+func (r *corpusRecorder) Logf(format string, args ...interface{}) {}
+
+func JsonDecoderSpec(c gs.Context) {
+	t := &pipeline_ts.SimpleT{}
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	c.Specify("A JsonDecoder", func() {
+		decoder := new(JsonDecoder)
+		config := decoder.ConfigStruct().(*JsonDecoderConfig)
+		pack := pipeline.NewPipelinePack(make(chan *pipeline.PipelinePack, 1))
+		pack.Message.SetType("original")
+		pack.Message.SetHostname("input.host")
+
+		encoder := new(JsonEncoder)
+		encoder.Init(encoder.ConfigStruct())
+		encoded := pipeline.NewPipelinePack(make(chan *pipeline.PipelinePack, 1))
+		encoded.Message = pipeline_ts.GetTestMessage()
+		output, err := encoder.Encode(encoded)
+		c.Assume(err, gs.IsNil)
+
+		c.Specify("decodes JsonEncoder output", func() {
+			err := decoder.Init(config)
+			c.Assume(err, gs.IsNil)
+			pack.Message.SetPayload(string(output))
+			packs, err := decoder.Decode(pack)
+			c.Expect(err, gs.IsNil)
+			c.Expect(len(packs), gs.Equals, 1)
+			c.Expect(pack.Message.Equals(encoded.Message), gs.IsTrue)
+		})
+
+		c.Specify("in lenient mode", func() {
+			err := decoder.Init(config)
+			c.Assume(err, gs.IsNil)
+
+			c.Specify("keeps the headers the JSON doesn't set", func() {
+				pack.Message.SetPayload(`{"Type": "partial", "Bogus": 1, ` +
+					`"Timestamp": 1000, "Fields": {"n": 2, "x": [1, 2.5], "ignored": {}}}`)
+				_, err := decoder.Decode(pack)
+				c.Expect(err, gs.IsNil)
+				c.Expect(pack.Message.GetType(), gs.Equals, "partial")
+				c.Expect(pack.Message.GetHostname(), gs.Equals, "input.host")
+				c.Expect(pack.Message.GetTimestamp(), gs.Equals, int64(1000))
+				n, _ := pack.Message.GetFieldValue("n")
+				c.Expect(n, gs.Equals, int64(2))
+				x := pack.Message.FindFirstField("x")
+				c.Assume(x, gs.Not(gs.IsNil))
+				c.Expect(len(x.GetValueDouble()), gs.Equals, 2)
+				c.Expect(pack.Message.FindFirstField("ignored"), gs.IsNil)
+			})
+
+			c.Specify("rejects invalid header values", func() {
+				pack.Message.SetPayload(`{"Severity": "high"}`)
+				_, err := decoder.Decode(pack)
+				c.Expect(err, gs.Not(gs.IsNil))
+			})
+		})
+
+		c.Specify("in strict mode", func() {
+			config.Mode = "strict"
+			config.Headers = []string{"Type", "Payload"}
+			err := decoder.Init(config)
+			c.Assume(err, gs.IsNil)
+
+			c.Specify("accepts the expected headers", func() {
+				pack.Message.SetPayload(`{"Type": "strict", "Payload": "hi"}`)
+				_, err := decoder.Decode(pack)
+				c.Expect(err, gs.IsNil)
+				c.Expect(pack.Message.GetType(), gs.Equals, "strict")
+				c.Expect(pack.Message.GetPayload(), gs.Equals, "hi")
+			})
+
+			c.Specify("rejects unknown headers", func() {
+				payload := `{"Type": "strict", "Payload": "hi", "Logger": "x"}`
+				pack.Message.SetPayload(payload)
+				_, err := decoder.Decode(pack)
+				c.Expect(err.Error(), gs.Equals, "unknown header 'Logger'")
+				// The original message is left for error routing.
+				c.Expect(pack.Message.GetPayload(), gs.Equals, payload)
+				c.Expect(pack.Message.GetType(), gs.Equals, "original")
+			})
+
+			c.Specify("rejects missing headers", func() {
+				pack.Message.SetPayload(`{"Type": "strict"}`)
+				_, err := decoder.Decode(pack)
+				c.Expect(err.Error(), gs.Equals, "missing header 'Payload'")
+			})
+		})
+
+		c.Specify("w/ arrays accepted", func() {
+			config.AcceptArrays = true
+			err := decoder.Init(config)
+			c.Assume(err, gs.IsNil)
+			dRunner := pipelinemock.NewMockDecoderRunner(ctrl)
+			decoder.SetDecoderRunner(dRunner)
+
+			c.Specify("generates a message per element", func() {
+				dRunner.EXPECT().NewPack().Return(pipeline.NewPipelinePack(nil))
+				pack.Message.SetPayload(`[{"Type": "one"}, {"Type": "two"}]`)
+				packs, err := decoder.Decode(pack)
+				c.Expect(err, gs.IsNil)
+				c.Assume(len(packs), gs.Equals, 2)
+				c.Expect(packs[0], gs.Equals, pack)
+				c.Expect(packs[0].Message.GetType(), gs.Equals, "one")
+				c.Expect(packs[1].Message.GetType(), gs.Equals, "two")
+				c.Expect(packs[1].Message.GetHostname(), gs.Equals, "input.host")
+			})
+
+			c.Specify("drops empty arrays", func() {
+				pack.Message.SetPayload(`[]`)
+				packs, err := decoder.Decode(pack)
+				c.Expect(err, gs.IsNil)
+				c.Expect(len(packs), gs.Equals, 0)
+			})
+
+			c.Specify("fails if any element does", func() {
+				pack.Message.SetPayload(`[{"Type": "one"}, 5]`)
+				packs, err := decoder.Decode(pack)
+				c.Expect(err, gs.Not(gs.IsNil))
+				c.Expect(packs, gs.IsNil)
+			})
+		})
+
+		c.Specify("flattening application JSON", func() {
+			config.FieldsOnly = true
+			config.Flatten = true
+			payload := `{"user": {"id": 7, "tags": ["a", "b"], ` +
+				`"geo": {"city": {"name": "Oslo"}}}, "ok": true}`
+			pack.Message.SetPayload(payload)
+
+			value := func(name string) interface{} {
+				v, _ := pack.Message.GetFieldValue(name)
+				return v
+			}
+
+			c.Specify("joins the keys and indexes arrays", func() {
+				err := decoder.Init(config)
+				c.Assume(err, gs.IsNil)
+				_, err = decoder.Decode(pack)
+				c.Expect(err, gs.IsNil)
+				c.Expect(value("user.id"), gs.Equals, int64(7))
+				c.Expect(value("user.tags.0"), gs.Equals, "a")
+				c.Expect(value("user.tags.1"), gs.Equals, "b")
+				c.Expect(value("user.geo.city.name"), gs.Equals, "Oslo")
+				c.Expect(value("ok"), gs.Equals, true)
+				c.Expect(pack.Message.GetType(), gs.Equals, "original")
+			})
+
+			c.Specify("honors the separator and max depth", func() {
+				config.FlattenSeparator = "_"
+				config.FlattenMaxDepth = 2
+				err := decoder.Init(config)
+				c.Assume(err, gs.IsNil)
+				_, err = decoder.Decode(pack)
+				c.Expect(err, gs.IsNil)
+				c.Expect(value("user_id"), gs.Equals, int64(7))
+				c.Expect(value("user_tags"), gs.Equals, `["a","b"]`)
+				c.Expect(value("user_geo"), gs.Equals, `{"city":{"name":"Oslo"}}`)
+			})
+
+			c.Specify("joins arrays", func() {
+				config.FlattenArrays = "join"
+				config.FlattenJoinSeparator = "|"
+				err := decoder.Init(config)
+				c.Assume(err, gs.IsNil)
+				_, err = decoder.Decode(pack)
+				c.Expect(err, gs.IsNil)
+				c.Expect(value("user.tags"), gs.Equals, "a|b")
+			})
+
+			c.Specify("keeps the first array element", func() {
+				config.FlattenArrays = "first"
+				err := decoder.Init(config)
+				c.Assume(err, gs.IsNil)
+				_, err = decoder.Decode(pack)
+				c.Expect(err, gs.IsNil)
+				c.Expect(value("user.tags"), gs.Equals, "a")
+			})
+
+			c.Specify("rejects unknown array handling", func() {
+				config.FlattenArrays = "last"
+				c.Expect(decoder.Init(config), gs.Not(gs.IsNil))
+			})
+		})
+
+		c.Specify("passes its corpus", func() {
+			recorder := new(corpusRecorder)
+			pConfig := pipeline.NewPipelineConfig(nil)
+			pipeline.CheckDecoderCorpora(recorder, pConfig, 0,
+				"./testsupport/json_decoder_corpus.toml")
+			c.Expect(strings.Join(recorder.errors, "\n"), gs.Equals, "")
+		})
+
+		c.Specify("rejects an unknown mode", func() {
+			config.Mode = "sloppy"
+			c.Expect(decoder.Init(config), gs.Not(gs.IsNil))
+		})
+	})
+}
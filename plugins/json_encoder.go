@@ -0,0 +1,161 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package plugins
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/cactus/gostrftime"
+	"github.com/mozilla-services/heka/message"
+	"github.com/mozilla-services/heka/pipeline"
+	"time"
+)
+
+var jsonHeaderNames = []string{"Uuid", "Timestamp", "Type", "Logger", "Severity",
+	"Payload", "EnvVersion", "Pid", "Hostname", "Fields"}
+
+// JsonEncoder generates a JSON object representation of a Heka message,
+// suitable for any output that needs a generic structured format.
+type JsonEncoder struct {
+	*JsonEncoderConfig
+	include map[string]bool
+}
+
+// ConfigStruct for JsonEncoder plugin.
+type JsonEncoderConfig struct {
+	// Message headers to include in the output. "Fields" includes all of
+	// the dynamic message fields. Defaults to all of them.
+	Fields []string
+	// strftime format used for the timestamp. If empty, RFC 3339 w/
+	// nanosecond precision is used.
+	TimestampFormat string `toml:"timestamp_format"`
+	// Whether a newline is appended to each encoded message.
+	AppendNewlines bool `toml:"append_newlines"`
+}
+
+func (je *JsonEncoder) ConfigStruct() interface{} {
+	return &JsonEncoderConfig{
+		Fields:         jsonHeaderNames,
+		AppendNewlines: true,
+	}
+}
+
+func (je *JsonEncoder) Init(config interface{}) (err error) {
+	je.JsonEncoderConfig = config.(*JsonEncoderConfig)
+	je.include = make(map[string]bool)
+	for _, name := range je.Fields {
+		valid := false
+		for _, header := range jsonHeaderNames {
+			if name == header {
+				valid = true
+				break
+			}
+		}
+		if !valid {
+			return fmt.Errorf("unknown message header: %s", name)
+		}
+		je.include[name] = true
+	}
+	return
+}
+
+// Returns the values of a dynamic field, unwrapped if there's only one.
+func jsonFieldValue(field *message.Field) interface{} {
+	var values []interface{}
+	switch field.GetValueType() {
+	case message.Field_STRING:
+		for _, v := range field.GetValueString() {
+			values = append(values, v)
+		}
+	case message.Field_BYTES:
+		for _, v := range field.GetValueBytes() {
+			values = append(values, v)
+		}
+	case message.Field_INTEGER:
+		for _, v := range field.GetValueInteger() {
+			values = append(values, v)
+		}
+	case message.Field_DOUBLE:
+		for _, v := range field.GetValueDouble() {
+			values = append(values, v)
+		}
+	case message.Field_BOOL:
+		for _, v := range field.GetValueBool() {
+			values = append(values, v)
+		}
+	}
+	if len(values) == 1 {
+		return values[0]
+	}
+	return values
+}
+
+func (je *JsonEncoder) Encode(pack *pipeline.PipelinePack) (output []byte, err error) {
+	msg := pack.Message
+	obj := make(map[string]interface{})
+	if je.include["Uuid"] {
+		obj["Uuid"] = msg.GetUuidString()
+	}
+	if je.include["Timestamp"] {
+		ts := time.Unix(0, msg.GetTimestamp()).UTC()
+		if je.TimestampFormat == "" {
+			obj["Timestamp"] = ts.Format(time.RFC3339Nano)
+		} else {
+			obj["Timestamp"] = gostrftime.Strftime(je.TimestampFormat, ts)
+		}
+	}
+	if je.include["Type"] {
+		obj["Type"] = msg.GetType()
+	}
+	if je.include["Logger"] {
+		obj["Logger"] = msg.GetLogger()
+	}
+	if je.include["Severity"] {
+		obj["Severity"] = msg.GetSeverity()
+	}
+	if je.include["Payload"] {
+		obj["Payload"] = msg.GetPayload()
+	}
+	if je.include["EnvVersion"] {
+		obj["EnvVersion"] = msg.GetEnvVersion()
+	}
+	if je.include["Pid"] {
+		obj["Pid"] = msg.GetPid()
+	}
+	if je.include["Hostname"] {
+		obj["Hostname"] = msg.GetHostname()
+	}
+	if je.include["Fields"] {
+		fields := make(map[string]interface{})
+		for _, field := range msg.Fields {
+			fields[field.GetName()] = jsonFieldValue(field)
+		}
+		obj["Fields"] = fields
+	}
+
+	if output, err = json.Marshal(obj); err != nil {
+		return nil, err
+	}
+	if je.AppendNewlines {
+		output = append(output, '\n')
+	}
+	return
+}
+
+func init() {
+	pipeline.RegisterPlugin("JsonEncoder", func() interface{} {
+		return new(JsonEncoder)
+	})
+}
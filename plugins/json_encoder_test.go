@@ -0,0 +1,63 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package plugins
+
+import (
+	"github.com/mozilla-services/heka/message"
+	"github.com/mozilla-services/heka/pipeline"
+	pipeline_ts "github.com/mozilla-services/heka/pipeline/testsupport"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+)
+
+func JsonEncoderSpec(c gs.Context) {
+	c.Specify("A JsonEncoder", func() {
+		encoder := new(JsonEncoder)
+		config := encoder.ConfigStruct().(*JsonEncoderConfig)
+		pack := pipeline.NewPipelinePack(make(chan *pipeline.PipelinePack, 1))
+		pack.Message = pipeline_ts.GetTestMessage()
+		field, _ := message.NewField("count", int64(3), "")
+		field.AddValue(int64(4))
+		pack.Message.AddField(field)
+
+		c.Specify("encodes all headers and fields", func() {
+			err := encoder.Init(config)
+			c.Assume(err, gs.IsNil)
+			output, err := encoder.Encode(pack)
+			c.Expect(err, gs.IsNil)
+			c.Expect(string(output), gs.Equals, `{"EnvVersion":"0.8",`+
+				`"Fields":{"count":[3,4],"foo":"bar"},"Hostname":"my.host.name",`+
+				`"Logger":"GoSpec","Payload":"Test Payload","Pid":43,"Severity":6,`+
+				`"Timestamp":"2006-01-02T22:04:05Z","Type":"TEST",`+
+				`"Uuid":"8e414f01-9d7f-4a48-a5e1-ae92e5954df5"}`+"\n")
+		})
+
+		c.Specify("honors the fields and timestamp settings", func() {
+			config.Fields = []string{"Timestamp", "Payload"}
+			config.TimestampFormat = "%Y.%m.%d"
+			config.AppendNewlines = false
+			err := encoder.Init(config)
+			c.Assume(err, gs.IsNil)
+			output, err := encoder.Encode(pack)
+			c.Expect(err, gs.IsNil)
+			c.Expect(string(output), gs.Equals,
+				`{"Payload":"Test Payload","Timestamp":"2006.01.02"}`)
+		})
+
+		c.Specify("rejects unknown headers", func() {
+			config.Fields = []string{"Payload", "Bogus"}
+			c.Expect(encoder.Init(config), gs.Not(gs.IsNil))
+		})
+	})
+}
@@ -21,6 +21,7 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -55,6 +56,11 @@ type KafkaInputConfig struct {
 	MaxWaitTime      uint32 `toml:"max_wait_time"`
 	OffsetMethod     string `toml:"offset_method"` // Manual, Newest, Oldest
 	EventBufferSize  int    `toml:"event_buffer_size"`
+
+	// Only advance the checkpoint past a Kafka message once all of the Heka
+	// messages generated from it have been fully processed by every matching
+	// filter and output. Requires the Manual offset_method.
+	AtLeastOnce bool `toml:"at_least_once"`
 }
 
 type KafkaInput struct {
@@ -72,6 +78,46 @@ type KafkaInput struct {
 	stopChan           chan bool
 	name               string
 	checkpointFilename string
+	offsets            *offsetTracker
+}
+
+// Tracks the offsets of Kafka messages that are still being processed, so
+// that the checkpoint only ever advances past offsets that are complete, even
+// when processing finishes out of order.
+type offsetTracker struct {
+	lock    sync.Mutex
+	pending []int64
+	done    map[int64]bool
+}
+
+func newOffsetTracker() *offsetTracker {
+	return &offsetTracker{done: make(map[int64]bool)}
+}
+
+// Registers an offset that has been handed to the pipeline.
+func (o *offsetTracker) add(offset int64) {
+	o.lock.Lock()
+	o.pending = append(o.pending, offset)
+	o.lock.Unlock()
+}
+
+// Marks an offset as complete, calling commit w/ the next offset to consume
+// if the checkpoint can advance. Commits are serialized.
+func (o *offsetTracker) complete(offset int64, commit func(next int64)) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	o.done[offset] = true
+	advanced := false
+	var next int64
+	for len(o.pending) > 0 && o.done[o.pending[0]] {
+		delete(o.done, o.pending[0])
+		next = o.pending[0] + 1
+		o.pending = o.pending[1:]
+		advanced = true
+	}
+	if advanced {
+		commit(next)
+	}
 }
 
 func (k *KafkaInput) ConfigStruct() interface{} {
@@ -190,6 +236,12 @@ func (k *KafkaInput) Init(config interface{}) (err error) {
 	default:
 		return fmt.Errorf("invalid offset_method: %s", k.config.OffsetMethod)
 	}
+	if k.config.AtLeastOnce {
+		if k.config.OffsetMethod != "Manual" {
+			return errors.New("at_least_once requires the Manual offset_method")
+		}
+		k.offsets = newOffsetTracker()
+	}
 
 	k.consumerConfig.EventBufferSize = k.config.EventBufferSize
 
@@ -217,8 +269,14 @@ func (k *KafkaInput) Run(ir pipeline.InputRunner, h pipeline.PluginHelper) (err
 	defer func() {
 		k.consumer.Close()
 		k.client.Close()
+		if k.offsets != nil {
+			// Late completions will reopen the file as needed.
+			k.offsets.lock.Lock()
+			defer k.offsets.lock.Unlock()
+		}
 		if k.checkpointFile != nil {
 			k.checkpointFile.Close()
+			k.checkpointFile = nil
 		}
 		sRunner.Done()
 	}()
@@ -232,6 +290,7 @@ func (k *KafkaInput) Run(ir pipeline.InputRunner, h pipeline.PluginHelper) (err
 		n        int
 	)
 
+	var tracker *pipeline.DeliveryTracker
 	packDec := func(pack *pipeline.PipelinePack) {
 		pack.Message.SetType("heka.kafka")
 		pack.Message.SetLogger(k.name)
@@ -241,9 +300,22 @@ func (k *KafkaInput) Run(ir pipeline.InputRunner, h pipeline.PluginHelper) (err
 		k.addField(pack, "Partition", event.Partition, "")
 		k.addField(pack, "Offset", event.Offset, "")
 	}
-	if !sRunner.UseMsgBytes() {
+	useMsgBytes := sRunner.UseMsgBytes()
+	if k.offsets != nil {
+		sRunner.SetPackDecorator(func(pack *pipeline.PipelinePack) {
+			if !useMsgBytes {
+				packDec(pack)
+			}
+			tracker.Track(pack)
+		})
+	} else if !useMsgBytes {
 		sRunner.SetPackDecorator(packDec)
 	}
+	commit := func(next int64) {
+		if err := k.writeCheckpoint(next); err != nil {
+			ir.LogError(fmt.Errorf("writing checkpoint: %s", err))
+		}
+	}
 
 	for {
 		select {
@@ -269,6 +341,18 @@ func (k *KafkaInput) Run(ir pipeline.InputRunner, h pipeline.PluginHelper) (err
 				ir.LogError(event.Err)
 				break
 			}
+			if k.offsets != nil {
+				offset, topic := event.Offset, event.Topic
+				k.offsets.add(offset)
+				tracker = pipeline.NewDeliveryTracker(func() {
+					k.offsets.complete(offset, commit)
+				}, func() {
+					// Leave the offset pending, so the checkpoint stops short
+					// of it and the message is consumed again on restart.
+					ir.LogError(fmt.Errorf("delivery failed for offset %d of topic %s, "+
+						"the checkpoint won't advance past it", offset, topic))
+				})
+			}
 			if n, err = sRunner.SplitBytes(event.Value, nil); err != nil {
 				ir.LogError(fmt.Errorf("processing message from topic %s: %s",
 					event.Topic, err))
@@ -278,7 +362,11 @@ func (k *KafkaInput) Run(ir pipeline.InputRunner, h pipeline.PluginHelper) (err
 					event.Topic))
 			}
 
-			if k.config.OffsetMethod == "Manual" {
+			if tracker != nil {
+				// Checkpoints once the generated packs have all been
+				// delivered.
+				tracker.Done()
+			} else if k.config.OffsetMethod == "Manual" {
 				if err = k.writeCheckpoint(event.Offset + 1); err != nil {
 					return
 				}
@@ -58,6 +58,48 @@ func TestInvalidOffsetMethod(t *testing.T) {
 	}
 }
 
+func TestAtLeastOnceRequiresManualOffset(t *testing.T) {
+	pConfig := NewPipelineConfig(nil)
+	ki := new(KafkaInput)
+	ki.SetName("test")
+	ki.SetPipelineConfig(pConfig)
+
+	config := ki.ConfigStruct().(*KafkaInputConfig)
+	config.Addrs = append(config.Addrs, "localhost:5432")
+	config.OffsetMethod = "Newest"
+	config.AtLeastOnce = true
+	err := ki.Init(config)
+
+	errmsg := "at_least_once requires the Manual offset_method"
+	if err.Error() != errmsg {
+		t.Errorf("Expected: %s, received: %s", errmsg, err)
+	}
+}
+
+func TestOffsetTrackerCommitsInOrder(t *testing.T) {
+	var commits []int64
+	commit := func(next int64) {
+		commits = append(commits, next)
+	}
+	o := newOffsetTracker()
+	o.add(10)
+	o.add(11)
+	o.add(12)
+
+	o.complete(11, commit)
+	if len(commits) != 0 {
+		t.Errorf("Expected no commits, received: %v", commits)
+	}
+	o.complete(10, commit)
+	if len(commits) != 1 || commits[0] != 12 {
+		t.Errorf("Expected: [12], received: %v", commits)
+	}
+	o.complete(12, commit)
+	if len(commits) != 2 || commits[1] != 13 {
+		t.Errorf("Expected: [12 13], received: %v", commits)
+	}
+}
+
 func TestReceivePayloadMessage(t *testing.T) {
 	b1 := sarama.NewMockBroker(t, 1)
 	b2 := sarama.NewMockBroker(t, 2)
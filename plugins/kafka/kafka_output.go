@@ -21,6 +21,7 @@ import (
 	"github.com/mozilla-services/heka/message"
 	"github.com/mozilla-services/heka/pipeline"
 	"regexp"
+	"runtime"
 	"strconv"
 	"sync"
 	"sync/atomic"
@@ -55,6 +56,17 @@ type KafkaOutputConfig struct {
 	MaxBufferTime              uint32 `toml:"max_buffer_time"`
 	MaxBufferedBytes           uint32 `toml:"max_buffered_bytes"`
 	BackPressureThresholdBytes uint32 `toml:"back_pressure_threshold_bytes"`
+
+	// Buffer Config
+	// Whether or not to buffer records to disk before sending them to Kafka,
+	// so they can be replayed when the brokers are unavailable.
+	UseBuffering bool `toml:"use_buffering"`
+	// Specifies size of queue buffer for output. 0 means that buffer is
+	// unlimited.
+	QueueMaxBufferSize uint64 `toml:"queue_max_buffer_size"`
+	// Specifies action which should be executed if queue is full. Possible
+	// values are "shutdown", "drop", or "block".
+	QueueFullAction string `toml:"queue_full_action"`
 }
 
 var Shutdown = errors.New("Shutdown Kafka error processing")
@@ -73,6 +85,7 @@ type KafkaOutput struct {
 	processMessageDiscards int64
 	kafkaDroppedMessages   int64
 	kafkaEncodingErrors    int64
+	dropMessageCount       int64
 
 	hashVariable   *messageVariable
 	topicVariable  *messageVariable
@@ -82,6 +95,9 @@ type KafkaOutput struct {
 	client         *sarama.Client
 	producer       *sarama.Producer
 	pipelineConfig *pipeline.PipelineConfig
+	bufferedOut    *pipeline.BufferedOutput
+	outputBlock    *pipeline.RetryHelper
+	or             pipeline.OutputRunner
 }
 
 func (k *KafkaOutput) ConfigStruct() interface{} {
@@ -101,6 +117,7 @@ func (k *KafkaOutput) ConfigStruct() interface{} {
 		MaxBufferTime:              1,
 		MaxBufferedBytes:           1,
 		BackPressureThresholdBytes: 50 * 1024 * 1024,
+		QueueFullAction:            "shutdown",
 	}
 }
 
@@ -245,6 +262,17 @@ func (k *KafkaOutput) Init(config interface{}) (err error) {
 		return errors.New("topic and topic_variable cannot both be set")
 	}
 
+	if k.config.UseBuffering {
+		if k.topicVariable != nil || k.hashVariable != nil {
+			return errors.New("use_buffering requires a static topic and can't be used with the Hash partitioner")
+		}
+		switch k.config.QueueFullAction {
+		case "shutdown", "drop", "block":
+		default:
+			return fmt.Errorf("invalid queue_full_action: %s", k.config.QueueFullAction)
+		}
+	}
+
 	switch k.config.RequiredAcks {
 	case "NoResponse":
 		k.pconfig.RequiredAcks = sarama.NoResponse
@@ -310,6 +338,10 @@ func (k *KafkaOutput) Run(or pipeline.OutputRunner, h pipeline.PluginHelper) (er
 		return errors.New("Encoder required.")
 	}
 
+	if k.config.UseBuffering {
+		return k.runBuffered(or, h)
+	}
+
 	inChan := or.InChan()
 	errChan := k.producer.Errors()
 	var wg sync.WaitGroup
@@ -353,6 +385,127 @@ func (k *KafkaOutput) Run(or pipeline.OutputRunner, h pipeline.PluginHelper) (er
 	return
 }
 
+// Writes encoded messages to a disk queue, from which they are synchronously
+// sent to Kafka, retrying until the brokers accept them.
+func (k *KafkaOutput) runBuffered(or pipeline.OutputRunner, h pipeline.PluginHelper) (err error) {
+	var (
+		ok          = true
+		pack        *pipeline.PipelinePack
+		inChan      = or.InChan()
+		ticker      = or.Ticker()
+		outputExit  = make(chan error)
+		outputError = make(chan error, 5)
+		stopChan    = make(chan bool, 1)
+	)
+
+	k.outputBlock, err = pipeline.NewRetryHelper(pipeline.RetryOptions{
+		MaxDelay:   "5s",
+		MaxRetries: -1,
+	})
+	if err != nil {
+		return fmt.Errorf("can't create retry helper: %s", err.Error())
+	}
+	k.or = or
+
+	re := regexp.MustCompile("\\W")
+	name := re.ReplaceAllString(or.Name(), "_")
+	k.bufferedOut, err = pipeline.NewBufferedOutput("output_queue", name, or, h,
+		k.config.QueueMaxBufferSize)
+	if err != nil {
+		if err == pipeline.QueueIsFull {
+			or.LogMessage("Queue capacity is already reached.")
+		} else {
+			return
+		}
+	}
+	k.bufferedOut.Start(k, outputError, outputExit, stopChan)
+
+	dupFullMsg := false // Prevents log from overflowing w/ dup queue full msgs
+	for ok {
+		select {
+		case e := <-outputError:
+			or.LogError(e)
+
+		case pack, ok = <-inChan:
+			if !ok {
+				stopChan <- true
+				// Make sure buffer isn't blocked on sending to outputError
+				select {
+				case e := <-outputError:
+					or.LogError(e)
+				default:
+				}
+				<-outputExit
+				break
+			}
+			atomic.AddInt64(&k.processMessageCount, 1)
+			if e := k.bufferedOut.QueueRecord(pack); e != nil {
+				if e == pipeline.QueueIsFull {
+					if !dupFullMsg {
+						or.LogError(e)
+						dupFullMsg = true
+					}
+					ok = k.queueFull(pack)
+				} else {
+					atomic.AddInt64(&k.processMessageFailures, 1)
+					or.LogError(e)
+					dupFullMsg = false
+				}
+			} else {
+				dupFullMsg = false
+			}
+			pack.Recycle()
+
+		case <-ticker:
+			if err = k.bufferedOut.RollQueue(); err != nil {
+				return fmt.Errorf("can't create new buffer queue file: %s", err.Error())
+			}
+
+		case err = <-outputExit:
+			ok = false
+		}
+	}
+	return
+}
+
+// This function will be called if the queue is full and another item is sent
+// to the queue. The result depends on the configured queue full action.
+// The returned bool indicates if the queue can continue to accept items.
+func (k *KafkaOutput) queueFull(pack *pipeline.PipelinePack) bool {
+	switch k.config.QueueFullAction {
+	// Tries to queue message until its possible to send it to output.
+	case "block":
+		for k.outputBlock.Wait() == nil {
+			if k.pipelineConfig.Globals.IsShuttingDown() {
+				return false
+			}
+			if k.bufferedOut.QueueRecord(pack) == nil {
+				k.outputBlock.Reset()
+				break
+			}
+			runtime.Gosched()
+		}
+	// Terminate Heka activity.
+	case "shutdown":
+		k.pipelineConfig.Globals.ShutDown()
+		return false
+
+	// Drop packets
+	case "drop":
+		atomic.AddInt64(&k.dropMessageCount, 1)
+	}
+	return true
+}
+
+// Satisfies the `pipeline.BufferedOutputSender` interface, synchronously
+// producing a record read from the disk queue.
+func (k *KafkaOutput) SendRecord(record []byte) (err error) {
+	if err = k.producer.SendMessage(k.config.Topic, nil, sarama.ByteEncoder(record)); err != nil {
+		return fmt.Errorf("sending to Kafka: %s", err)
+	}
+	return
+}
+
 func (k *KafkaOutput) ReportMsg(msg *message.Message) error {
 	message.NewInt64Field(msg, "ProcessMessageCount",
 		atomic.LoadInt64(&k.processMessageCount), "count")
@@ -364,6 +517,11 @@ func (k *KafkaOutput) ReportMsg(msg *message.Message) error {
 		atomic.LoadInt64(&k.kafkaDroppedMessages), "count")
 	message.NewInt64Field(msg, "KafkaEncodingErrors",
 		atomic.LoadInt64(&k.kafkaEncodingErrors), "count")
+	if k.bufferedOut != nil {
+		message.NewInt64Field(msg, "DropMessageCount",
+			atomic.LoadInt64(&k.dropMessageCount), "count")
+		k.bufferedOut.ReportMsg(msg)
+	}
 	return nil
 }
 
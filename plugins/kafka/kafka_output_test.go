@@ -354,3 +354,36 @@ func TestSendMessage(t *testing.T) {
 		t.Errorf("Invalid ending processMessageFailures %d", msgcount)
 	}
 }
+
+func TestBufferingWithTopicVariable(t *testing.T) {
+	pConfig := NewPipelineConfig(nil)
+	ko := new(KafkaOutput)
+	ko.SetPipelineConfig(pConfig)
+	config := ko.ConfigStruct().(*KafkaOutputConfig)
+	config.Addrs = append(config.Addrs, "localhost:5432")
+	config.TopicVariable = "Type"
+	config.UseBuffering = true
+	err := ko.Init(config)
+
+	errmsg := "use_buffering requires a static topic and can't be used with the Hash partitioner"
+	if err.Error() != errmsg {
+		t.Errorf("Expected: %s, received: %s", errmsg, err)
+	}
+}
+
+func TestInvalidQueueFullAction(t *testing.T) {
+	pConfig := NewPipelineConfig(nil)
+	ko := new(KafkaOutput)
+	ko.SetPipelineConfig(pConfig)
+	config := ko.ConfigStruct().(*KafkaOutputConfig)
+	config.Addrs = append(config.Addrs, "localhost:5432")
+	config.Topic = "test"
+	config.UseBuffering = true
+	config.QueueFullAction = "panic"
+	err := ko.Init(config)
+
+	errmsg := "invalid queue_full_action: panic"
+	if err.Error() != errmsg {
+		t.Errorf("Expected: %s, received: %s", errmsg, err)
+	}
+}
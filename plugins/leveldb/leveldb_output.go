@@ -0,0 +1,424 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package leveldb
+
+import (
+	"code.google.com/p/go-uuid/uuid"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/mozilla-services/heka/message"
+	. "github.com/mozilla-services/heka/pipeline"
+	gldb "github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Key prefixes. Messages are stored by UUID, and indexed by timestamp and
+// by hostname and timestamp. Index keys end w/ the big endian timestamp and
+// the raw 16 byte UUID, so they sort chronologically.
+const (
+	messagePrefix = "m/"
+	timePrefix    = "t/"
+	hostPrefix    = "h/"
+)
+
+// Output plugin that stores messages in an embedded LevelDB database and
+// serves queries for them over HTTP.
+type LevelDbOutput struct {
+	*LevelDbOutputConfig
+	db                  *gldb.DB
+	pConfig             *PipelineConfig
+	name                string
+	path                string
+	listener            net.Listener
+	now                 func() time.Time
+	processMessageCount int64
+	dropMessageCount    int64
+	expiredMessageCount int64
+	reportLock          sync.Mutex
+}
+
+// ConfigStruct for LevelDbOutput plugin.
+type LevelDbOutputConfig struct {
+	// Directory holding the database, relative to Heka's base_dir. Defaults
+	// to "leveldb/<plugin name>".
+	Path string
+	// Number of seconds messages are kept. 0 means messages never expire.
+	Ttl int64
+	// Interval at which expired messages are removed, in seconds.
+	PurgeInterval uint32 `toml:"purge_interval"`
+	// TCP address the query API listens on. Empty disables the API.
+	Address string
+	// Maximum number of messages a single query returns.
+	MaxResults int `toml:"max_results"`
+}
+
+func (o *LevelDbOutput) SetPipelineConfig(pConfig *PipelineConfig) {
+	o.pConfig = pConfig
+}
+
+func (o *LevelDbOutput) SetName(name string) {
+	o.name = name
+}
+
+func (o *LevelDbOutput) ConfigStruct() interface{} {
+	return &LevelDbOutputConfig{
+		Ttl:           86400,
+		PurgeInterval: 60,
+		Address:       "127.0.0.1:4356",
+		MaxResults:    1000,
+	}
+}
+
+func (o *LevelDbOutput) Init(config interface{}) (err error) {
+	o.LevelDbOutputConfig = config.(*LevelDbOutputConfig)
+
+	if o.Ttl < 0 {
+		return errors.New("`ttl` must not be negative")
+	}
+	if o.Ttl > 0 && o.PurgeInterval == 0 {
+		return errors.New("`purge_interval` must be greater than 0")
+	}
+	if o.MaxResults < 1 {
+		return errors.New("`max_results` must be at least 1")
+	}
+	path := o.Path
+	if path == "" {
+		path = filepath.Join("leveldb", o.name)
+	}
+	o.path = o.pConfig.Globals.PrependBaseDir(path)
+	o.now = time.Now
+	return
+}
+
+// Returns the 8 byte big endian timestamp followed by the 16 byte UUID.
+func indexSuffix(ts int64, id []byte) []byte {
+	suffix := make([]byte, 8, 8+len(id))
+	binary.BigEndian.PutUint64(suffix, uint64(ts))
+	return append(suffix, id...)
+}
+
+func timeKey(ts int64, id []byte) []byte {
+	return append([]byte(timePrefix), indexSuffix(ts, id)...)
+}
+
+// Host keys separate the hostname from the suffix w/ a 0 byte, so one
+// host's keys can't run into those of a host whose name it's a prefix of.
+func hostKey(host string, ts int64, id []byte) []byte {
+	key := append([]byte(hostPrefix+host), 0)
+	return append(key, indexSuffix(ts, id)...)
+}
+
+func messageKey(id []byte) []byte {
+	return append([]byte(messagePrefix), id...)
+}
+
+// Stores a message and its index entries. The time index entry holds the
+// hostname, so expiry can find the host index entry.
+func (o *LevelDbOutput) store(pack *PipelinePack) error {
+	if err := pack.EncodeMsgBytes(); err != nil {
+		return err
+	}
+	msg := pack.Message
+	id := msg.GetUuid()
+	if len(id) != 16 {
+		return errors.New("message has no valid UUID")
+	}
+	ts := msg.GetTimestamp()
+	batch := new(gldb.Batch)
+	batch.Put(messageKey(id), pack.MsgBytes)
+	batch.Put(timeKey(ts, id), []byte(msg.GetHostname()))
+	batch.Put(hostKey(msg.GetHostname(), ts, id), nil)
+	return o.db.Write(batch, nil)
+}
+
+// Removes the messages older than the TTL, returning how many were removed.
+func (o *LevelDbOutput) purge() (count int64, err error) {
+	cutoff := o.now().Add(-time.Duration(o.Ttl) * time.Second).UnixNano()
+	if cutoff < 0 {
+		return
+	}
+	iter := o.db.NewIterator(&util.Range{
+		Start: []byte(timePrefix),
+		Limit: timeKey(cutoff, nil),
+	}, nil)
+	defer iter.Release()
+
+	batch := new(gldb.Batch)
+	for iter.Next() {
+		suffix := iter.Key()[len(timePrefix):]
+		ts := int64(binary.BigEndian.Uint64(suffix))
+		id := suffix[8:]
+		batch.Delete(iter.Key())
+		batch.Delete(hostKey(string(iter.Value()), ts, id))
+		batch.Delete(messageKey(id))
+		count++
+		if batch.Len() >= 3000 {
+			if err = o.db.Write(batch, nil); err != nil {
+				return
+			}
+			batch.Reset()
+		}
+	}
+	if err = iter.Error(); err == nil && batch.Len() > 0 {
+		err = o.db.Write(batch, nil)
+	}
+	return
+}
+
+// Criteria of a message query.
+type query struct {
+	host  string
+	typ   string
+	since int64
+	until int64
+	limit int
+}
+
+// Parses a query time, either a duration before now, e.g. "1h", or an
+// RFC3339 timestamp.
+func (o *LevelDbOutput) parseTime(value string) (int64, error) {
+	if d, err := time.ParseDuration(value); err == nil {
+		return o.now().Add(-d).UnixNano(), nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time '%s', use a duration or an RFC3339 timestamp",
+			value)
+	}
+	return t.UnixNano(), nil
+}
+
+// Generates the query from a request's parameters.
+func (o *LevelDbOutput) parseQuery(req *http.Request) (q *query, err error) {
+	params := req.URL.Query()
+	q = &query{
+		host:  params.Get("host"),
+		typ:   params.Get("type"),
+		until: o.now().UnixNano(),
+		limit: o.MaxResults,
+	}
+	if v := params.Get("since"); v != "" {
+		if q.since, err = o.parseTime(v); err != nil {
+			return nil, err
+		}
+	}
+	if v := params.Get("until"); v != "" {
+		if q.until, err = o.parseTime(v); err != nil {
+			return nil, err
+		}
+	}
+	if v := params.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 1 {
+			return nil, fmt.Errorf("invalid limit '%s'", v)
+		}
+		if limit < q.limit {
+			q.limit = limit
+		}
+	}
+	if q.since < 0 {
+		q.since = 0
+	}
+	return
+}
+
+// Returns the messages matching a query, oldest first.
+func (o *LevelDbOutput) find(q *query) (msgs []*message.Message, err error) {
+	var prefix []byte
+	if q.host != "" {
+		prefix = append([]byte(hostPrefix+q.host), 0)
+	} else {
+		prefix = []byte(timePrefix)
+	}
+	start := append(append([]byte{}, prefix...), indexSuffix(q.since, nil)...)
+	limit := append(append([]byte{}, prefix...), indexSuffix(q.until+1, nil)...)
+	iter := o.db.NewIterator(&util.Range{Start: start, Limit: limit}, nil)
+	defer iter.Release()
+
+	for iter.Next() && len(msgs) < q.limit {
+		id := iter.Key()[len(prefix)+8:]
+		msgBytes, err := o.db.Get(messageKey(id), nil)
+		if err == gldb.ErrNotFound {
+			// Expired since the iterator was created.
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		msg := new(message.Message)
+		if err = msg.Unmarshal(msgBytes); err != nil {
+			return nil, fmt.Errorf("can't decode message %s: %s", uuid.UUID(id), err)
+		}
+		if q.typ == "" || msg.GetType() == q.typ {
+			msgs = append(msgs, msg)
+		}
+	}
+	return msgs, iter.Error()
+}
+
+// Looks up a single message by UUID.
+func (o *LevelDbOutput) get(id string) (*message.Message, error) {
+	raw := uuid.Parse(id)
+	if raw == nil {
+		return nil, nil
+	}
+	msgBytes, err := o.db.Get(messageKey(raw), nil)
+	if err == gldb.ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	msg := new(message.Message)
+	if err = msg.Unmarshal(msgBytes); err != nil {
+		return nil, fmt.Errorf("can't decode message %s: %s", id, err)
+	}
+	return msg, nil
+}
+
+// Serves `/messages`, which returns the messages matching the query
+// parameters as a JSON array, and `/messages/<uuid>`, which returns a single
+// message.
+func (o *LevelDbOutput) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var (
+		result interface{}
+		err    error
+	)
+	if id := strings.TrimPrefix(req.URL.Path, "/messages/"); id != req.URL.Path {
+		var msg *message.Message
+		if msg, err = o.get(id); err == nil && msg == nil {
+			http.NotFound(w, req)
+			return
+		}
+		result = msg
+	} else {
+		var q *query
+		if q, err = o.parseQuery(req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		msgs, e := o.find(q)
+		if msgs == nil {
+			msgs = []*message.Message{}
+		}
+		result, err = msgs, e
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	body, err := json.Marshal(result)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
+
+func (o *LevelDbOutput) Run(or OutputRunner, h PluginHelper) (err error) {
+	if o.db, err = gldb.OpenFile(o.path, nil); err != nil {
+		return fmt.Errorf("can't open database %s: %s", o.path, err)
+	}
+	defer o.db.Close()
+
+	if o.Address != "" {
+		if o.listener, err = net.Listen("tcp", o.Address); err != nil {
+			return fmt.Errorf("can't listen on %s: %s", o.Address, err)
+		}
+		defer o.listener.Close()
+		or.LogMessage(fmt.Sprintf("Serving queries on %s", o.listener.Addr()))
+
+		mux := http.NewServeMux()
+		mux.Handle("/messages", o)
+		mux.Handle("/messages/", o)
+		server := &http.Server{
+			Handler:      mux,
+			ReadTimeout:  10 * time.Second,
+			WriteTimeout: 30 * time.Second,
+		}
+		go server.Serve(o.listener)
+	}
+
+	var tick <-chan time.Time
+	if o.Ttl > 0 {
+		ticker := time.NewTicker(time.Duration(o.PurgeInterval) * time.Second)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	var (
+		ok     = true
+		pack   *PipelinePack
+		inChan = or.InChan()
+	)
+	for ok {
+		select {
+		case pack, ok = <-inChan:
+			if !ok {
+				break
+			}
+			if e := o.store(pack); e != nil {
+				or.LogError(fmt.Errorf("can't store message: %s", e))
+				atomic.AddInt64(&o.dropMessageCount, 1)
+			} else {
+				atomic.AddInt64(&o.processMessageCount, 1)
+			}
+			pack.Recycle()
+		case <-tick:
+			count, e := o.purge()
+			atomic.AddInt64(&o.expiredMessageCount, count)
+			if e != nil {
+				or.LogError(fmt.Errorf("can't remove expired messages: %s", e))
+			}
+		}
+	}
+	return
+}
+
+// Satisfies the `pipeline.ReportingPlugin` interface to provide plugin state
+// information to the Heka report and dashboard.
+func (o *LevelDbOutput) ReportMsg(msg *message.Message) error {
+	o.reportLock.Lock()
+	defer o.reportLock.Unlock()
+
+	message.NewInt64Field(msg, "ProcessMessageCount",
+		atomic.LoadInt64(&o.processMessageCount), "count")
+	message.NewInt64Field(msg, "DropMessageCount",
+		atomic.LoadInt64(&o.dropMessageCount), "count")
+	message.NewInt64Field(msg, "ExpiredMessageCount",
+		atomic.LoadInt64(&o.expiredMessageCount), "count")
+	return nil
+}
+
+func init() {
+	RegisterPlugin("LevelDbOutput", func() interface{} {
+		return new(LevelDbOutput)
+	})
+}
@@ -0,0 +1,177 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package leveldb
+
+import (
+	"code.google.com/p/go-uuid/uuid"
+	"encoding/json"
+	"github.com/mozilla-services/heka/message"
+	. "github.com/mozilla-services/heka/pipeline"
+	pipeline_ts "github.com/mozilla-services/heka/pipeline/testsupport"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+	gldb "github.com/syndtr/goleveldb/leveldb"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+func LevelDbOutputSpec(c gs.Context) {
+	tmpDir, err := ioutil.TempDir("", "leveldb-tests")
+	c.Assume(err, gs.IsNil)
+	defer os.RemoveAll(tmpDir)
+
+	pConfig := NewPipelineConfig(nil)
+	pConfig.Globals.BaseDir = tmpDir
+	output := new(LevelDbOutput)
+	output.SetPipelineConfig(pConfig)
+	output.SetName("store")
+	config := output.ConfigStruct().(*LevelDbOutputConfig)
+
+	start := time.Unix(1136239445, 0)
+	newPack := func(host, typ string, offset time.Duration) *PipelinePack {
+		msg := pipeline_ts.GetTestMessage()
+		msg.SetUuid(uuid.NewRandom())
+		msg.SetHostname(host)
+		msg.SetType(typ)
+		msg.SetTimestamp(start.Add(offset).UnixNano())
+		pack := NewPipelinePack(nil)
+		pack.Message = msg
+		return pack
+	}
+
+	c.Specify("A LevelDbOutput", func() {
+		c.Specify("defaults to a directory named after it", func() {
+			err := output.Init(config)
+			c.Assume(err, gs.IsNil)
+			c.Expect(output.path, gs.Equals, filepath.Join(tmpDir, "leveldb", "store"))
+		})
+
+		c.Specify("requires a purge interval w/ a ttl", func() {
+			config.PurgeInterval = 0
+			err := output.Init(config)
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+
+		c.Specify("stores messages", func() {
+			config.Ttl = 3600
+			err := output.Init(config)
+			c.Assume(err, gs.IsNil)
+			output.db, err = gldb.OpenFile(output.path, nil)
+			c.Assume(err, gs.IsNil)
+			defer output.db.Close()
+			output.now = func() time.Time { return start.Add(time.Hour) }
+
+			packs := []*PipelinePack{
+				newPack("web1", "nginx", 0),
+				newPack("web2", "nginx", time.Minute),
+				newPack("web1", "app", 2*time.Minute),
+				newPack("web10", "app", 3*time.Minute),
+			}
+			for _, pack := range packs {
+				err = output.store(pack)
+				c.Assume(err, gs.IsNil)
+			}
+
+			find := func(q *query) []*message.Message {
+				if q.until == 0 {
+					q.until = output.now().UnixNano()
+				}
+				if q.limit == 0 {
+					q.limit = output.MaxResults
+				}
+				msgs, err := output.find(q)
+				c.Assume(err, gs.IsNil)
+				return msgs
+			}
+
+			c.Specify("indexed by time", func() {
+				msgs := find(&query{})
+				c.Expect(len(msgs), gs.Equals, 4)
+				c.Expect(msgs[0].GetUuidString(), gs.Equals, packs[0].Message.GetUuidString())
+				c.Expect(msgs[3].GetHostname(), gs.Equals, "web10")
+
+				msgs = find(&query{since: start.Add(time.Minute).UnixNano(),
+					until: start.Add(2 * time.Minute).UnixNano()})
+				c.Expect(len(msgs), gs.Equals, 2)
+				c.Expect(msgs[0].GetHostname(), gs.Equals, "web2")
+			})
+
+			c.Specify("indexed by host", func() {
+				msgs := find(&query{host: "web1"})
+				c.Expect(len(msgs), gs.Equals, 2)
+				c.Expect(msgs[1].GetType(), gs.Equals, "app")
+				c.Expect(msgs[1].GetPayload(), gs.Equals, "Test Payload")
+			})
+
+			c.Specify("filtered by type and limited", func() {
+				msgs := find(&query{typ: "app", limit: 1})
+				c.Expect(len(msgs), gs.Equals, 1)
+				c.Expect(msgs[0].GetHostname(), gs.Equals, "web1")
+			})
+
+			c.Specify("by UUID", func() {
+				msg, err := output.get(packs[1].Message.GetUuidString())
+				c.Expect(err, gs.IsNil)
+				c.Expect(msg.GetHostname(), gs.Equals, "web2")
+				msg, err = output.get(uuid.NewRandom().String())
+				c.Expect(err, gs.IsNil)
+				c.Expect(msg == nil, gs.IsTrue)
+			})
+
+			c.Specify("that expire", func() {
+				output.now = func() time.Time { return start.Add(time.Hour + 90*time.Second) }
+				count, err := output.purge()
+				c.Expect(err, gs.IsNil)
+				c.Expect(count, gs.Equals, int64(2))
+				c.Expect(len(find(&query{})), gs.Equals, 2)
+				c.Expect(len(find(&query{host: "web1"})), gs.Equals, 1)
+				c.Expect(len(find(&query{host: "web2"})), gs.Equals, 0)
+				msg, _ := output.get(packs[0].Message.GetUuidString())
+				c.Expect(msg == nil, gs.IsTrue)
+			})
+
+			c.Specify("served over HTTP", func() {
+				serve := func(url string) *httptest.ResponseRecorder {
+					req, _ := http.NewRequest("GET", url, nil)
+					w := httptest.NewRecorder()
+					output.ServeHTTP(w, req)
+					return w
+				}
+
+				w := serve("/messages?host=web1&since=1h&limit=10")
+				c.Expect(w.Code, gs.Equals, http.StatusOK)
+				var msgs []*message.Message
+				err := json.Unmarshal(w.Body.Bytes(), &msgs)
+				c.Expect(err, gs.IsNil)
+				c.Expect(len(msgs), gs.Equals, 2)
+
+				w = serve("/messages?since=30m")
+				c.Expect(w.Body.String(), gs.Equals, "[]")
+
+				w = serve("/messages?since=yesterday")
+				c.Expect(w.Code, gs.Equals, http.StatusBadRequest)
+
+				w = serve("/messages/" + packs[2].Message.GetUuidString())
+				c.Expect(w.Code, gs.Equals, http.StatusOK)
+
+				w = serve("/messages/" + uuid.NewRandom().String())
+				c.Expect(w.Code, gs.Equals, http.StatusNotFound)
+			})
+		})
+	})
+}
@@ -16,26 +16,114 @@
 package plugins
 
 import (
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
 	. "github.com/mozilla-services/heka/pipeline"
-	"os"
 	"log"
+	"os"
+
+	"code.google.com/p/gogoprotobuf/proto"
 )
 
-var logOut = log.New(os.Stdout, "", log.LstdFlags)
+var (
+	logOut = log.New(os.Stdout, "", log.LstdFlags)
+	logErr = log.New(os.Stderr, "", log.LstdFlags)
+)
 
 // Output plugin that writes message contents out using Go standard library's
 // `log` package.
 type LogOutput struct {
+	*LogOutputConfig
+	out *log.Logger
+}
+
+// ConfigStruct for LogOutput plugin.
+type LogOutputConfig struct {
+	// Stream messages are written to, either "stdout" or "stderr".
+	Stream string
+	// Messages w/ a severity at or below this value are always written to
+	// stderr. A negative value disables this.
+	StderrSeverity int32 `toml:"stderr_severity"`
+	// How messages are rendered: "encoder", "text", "json", or
+	// "protobuf_hex". If empty, the encoder is used if one is specified,
+	// otherwise the text format.
+	Format string
+	// Template used by the "text" format, may contain `%{<name>}`
+	// placeholders.
+	Template string
+	// Output longer than this many bytes is truncated. 0 means no limit.
+	MaxLength int `toml:"max_length"`
+}
+
+func (self *LogOutput) ConfigStruct() interface{} {
+	return &LogOutputConfig{
+		Stream:         "stdout",
+		StderrSeverity: -1,
+		Template:       "%{Type} [%{Logger}@%{Hostname}] %{Payload}",
+	}
 }
 
 func (self *LogOutput) Init(config interface{}) (err error) {
+	self.LogOutputConfig = config.(*LogOutputConfig)
+
+	switch self.Stream {
+	case "stdout":
+		self.out = logOut
+	case "stderr":
+		self.out = logErr
+	default:
+		return fmt.Errorf("unsupported `stream`: %s", self.Stream)
+	}
+	switch self.Format {
+	case "", "encoder", "text", "json", "protobuf_hex":
+	default:
+		return fmt.Errorf("unsupported `format`: %s", self.Format)
+	}
+	if self.MaxLength < 0 {
+		return errors.New("`max_length` can't be negative")
+	}
 	return
 }
 
+// Renders the message in the configured format.
+func (self *LogOutput) render(or OutputRunner, pack *PipelinePack) (
+	outBytes []byte, err error) {
+
+	switch self.Format {
+	case "encoder":
+		return or.Encode(pack)
+	case "json":
+		return json.Marshal(pack.Message)
+	case "protobuf_hex":
+		if outBytes, err = proto.Marshal(pack.Message); err != nil {
+			return nil, err
+		}
+		return []byte(hex.EncodeToString(outBytes)), nil
+	}
+	return []byte(InterpolateMessageString(self.Template, pack.Message)), nil
+}
+
+// Writes the rendered message to the appropriate stream.
+func (self *LogOutput) write(pack *PipelinePack, outBytes []byte) {
+	if self.MaxLength > 0 && len(outBytes) > self.MaxLength {
+		outBytes = append(outBytes[:self.MaxLength:self.MaxLength], "..."...)
+	}
+	out := self.out
+	if pack.Message.GetSeverity() <= self.StderrSeverity {
+		out = logErr
+	}
+	out.Print(string(outBytes))
+}
+
 func (self *LogOutput) Run(or OutputRunner, h PluginHelper) (err error) {
-	if or.Encoder() == nil {
+	if self.Format == "" {
+		self.Format = "text"
+		if or.Encoder() != nil {
+			self.Format = "encoder"
+		}
+	} else if self.Format == "encoder" && or.Encoder() == nil {
 		return errors.New("Encoder required.")
 	}
 
@@ -46,10 +134,10 @@ func (self *LogOutput) Run(or OutputRunner, h PluginHelper) (err error) {
 		e        error
 	)
 	for pack = range inChan {
-		if outBytes, e = or.Encode(pack); e != nil {
+		if outBytes, e = self.render(or, pack); e != nil {
 			or.LogError(fmt.Errorf("Error encoding message: %s", e))
 		} else if outBytes != nil {
-			logOut.Print(string(outBytes))
+			self.write(pack, outBytes)
 		}
 		pack.Recycle()
 	}
@@ -0,0 +1,130 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package plugins
+
+import (
+	"bytes"
+	"encoding/hex"
+	"github.com/mozilla-services/heka/pipeline"
+	pipeline_ts "github.com/mozilla-services/heka/pipeline/testsupport"
+	"github.com/mozilla-services/heka/pipelinemock"
+	"github.com/rafrombrc/gomock/gomock"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+	"log"
+	"strings"
+
+	"code.google.com/p/gogoprotobuf/proto"
+)
+
+func LogOutputSpec(c gs.Context) {
+	t := &pipeline_ts.SimpleT{}
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	c.Specify("A LogOutput", func() {
+		output := new(LogOutput)
+		config := output.ConfigStruct().(*LogOutputConfig)
+		pack := pipeline.NewPipelinePack(make(chan *pipeline.PipelinePack, 1))
+		pack.Message = pipeline_ts.GetTestMessage()
+
+		origOut, origErr := logOut, logErr
+		stdout, stderr := new(bytes.Buffer), new(bytes.Buffer)
+		logOut = log.New(stdout, "", 0)
+		logErr = log.New(stderr, "", 0)
+		defer func() {
+			logOut, logErr = origOut, origErr
+		}()
+
+		emit := func() {
+			outBytes, err := output.render(nil, pack)
+			c.Assume(err, gs.IsNil)
+			output.write(pack, outBytes)
+		}
+
+		c.Specify("rejects an unknown stream or format", func() {
+			config.Stream = "stdin"
+			c.Expect(output.Init(config), gs.Not(gs.IsNil))
+			config.Stream = "stdout"
+			config.Format = "xml"
+			c.Expect(output.Init(config), gs.Not(gs.IsNil))
+		})
+
+		c.Specify("writes the text template to stdout", func() {
+			config.Format = "text"
+			err := output.Init(config)
+			c.Assume(err, gs.IsNil)
+			emit()
+			c.Expect(stdout.String(), gs.Equals,
+				"TEST [GoSpec@my.host.name] Test Payload\n")
+			c.Expect(stderr.Len(), gs.Equals, 0)
+		})
+
+		c.Specify("renders the template w/ fields when run", func() {
+			config.Template = "%{Severity} %{foo}: %{Payload}"
+			err := output.Init(config)
+			c.Assume(err, gs.IsNil)
+			oRunner := pipelinemock.NewMockOutputRunner(ctrl)
+			inChan := make(chan *pipeline.PipelinePack, 1)
+			oRunner.EXPECT().Encoder().Return(nil)
+			oRunner.EXPECT().InChan().Return(inChan)
+			inChan <- pack
+			close(inChan)
+			err = output.Run(oRunner, nil)
+			c.Expect(err, gs.IsNil)
+			c.Expect(stdout.String(), gs.Equals, "6 bar: Test Payload\n")
+		})
+
+		c.Specify("writes severe messages to stderr", func() {
+			config.Format = "text"
+			config.Template = "%{Payload}"
+			config.StderrSeverity = 3
+			err := output.Init(config)
+			c.Assume(err, gs.IsNil)
+			emit()
+			pack.Message.SetSeverity(2)
+			emit()
+			c.Expect(stdout.String(), gs.Equals, "Test Payload\n")
+			c.Expect(stderr.String(), gs.Equals, "Test Payload\n")
+		})
+
+		c.Specify("writes JSON", func() {
+			config.Format = "json"
+			err := output.Init(config)
+			c.Assume(err, gs.IsNil)
+			emit()
+			c.Expect(strings.Contains(stdout.String(), `"payload":"Test Payload"`),
+				gs.IsTrue)
+		})
+
+		c.Specify("writes hex encoded protobuf", func() {
+			config.Format = "protobuf_hex"
+			err := output.Init(config)
+			c.Assume(err, gs.IsNil)
+			emit()
+			expected, _ := proto.Marshal(pack.Message)
+			c.Expect(stdout.String(), gs.Equals, hex.EncodeToString(expected)+"\n")
+		})
+
+		c.Specify("truncates long output", func() {
+			config.Format = "text"
+			config.Template = "%{Payload}"
+			config.MaxLength = 4
+			err := output.Init(config)
+			c.Assume(err, gs.IsNil)
+			emit()
+			c.Expect(stdout.String(), gs.Equals, "Test...\n")
+		})
+	})
+}
@@ -0,0 +1,346 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package mongo
+
+import (
+	"errors"
+	"fmt"
+	"github.com/mozilla-services/heka/message"
+	. "github.com/mozilla-services/heka/pipeline"
+	"github.com/mozilla-services/heka/plugins"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Output plugin that inserts messages as documents into MongoDB.
+type MongoOutput struct {
+	*MongoOutputConfig
+	dialInfo            *mgo.DialInfo
+	session             *mgo.Session
+	safe                *mgo.Safe
+	fieldNames          *plugins.FieldNameSanitizer
+	created             map[string]bool
+	processMessageCount int64
+	dropMessageCount    int64
+	reportLock          sync.Mutex
+	batcher             *Batcher
+}
+
+// ConfigStruct for MongoOutput plugin.
+type MongoOutputConfig struct {
+	// MongoDB connection string, see the mgo driver's `Dial` function.
+	Url string
+	// Database the documents are inserted into.
+	Database string
+	// Collection name template, may contain `%{<name>}` placeholders.
+	Collection string
+	// Whether missing collections are created as capped collections.
+	Capped bool
+	// Size of created capped collections, in bytes.
+	CappedSize int `toml:"capped_size"`
+	// Maximum number of documents in created capped collections. 0 means
+	// no limit other than the size.
+	CappedMaxDocs int `toml:"capped_max_docs"`
+	// Write concern acknowledgement, a number of nodes or "majority". "0"
+	// means writes aren't acknowledged.
+	W string
+	// How long to wait for the write concern, in milliseconds. 0 means no
+	// limit.
+	WriteTimeout int `toml:"write_timeout"`
+	// Whether writes must be journaled before they're acknowledged.
+	Journal bool
+	// Settings for cleaning up dynamic field names, which can't contain
+	// dots or start w/ a "$".
+	FieldNames *plugins.FieldNameConfig `toml:"field_names"`
+	// Timeout for connecting to the server, in milliseconds.
+	ConnectTimeout uint32 `toml:"connect_timeout"`
+	// Batching settings, from the `batch` subsection.
+	Batch BatchConfig `toml:"batch"`
+}
+
+// A document and the collection it's inserted into, as stored in a batch.
+type mongoRecord struct {
+	Collection string   `bson:"c"`
+	Doc        bson.Raw `bson:"d"`
+}
+
+func (o *MongoOutput) ConfigStruct() interface{} {
+	return &MongoOutputConfig{
+		Url:            "mongodb://localhost:27017",
+		Database:       "heka",
+		Collection:     "%{Type}",
+		CappedSize:     100 * 1024 * 1024,
+		W:              "1",
+		FieldNames:     &plugins.FieldNameConfig{ReplaceDots: "_"},
+		ConnectTimeout: 5000,
+		Batch:          DefaultBatchConfig(),
+	}
+}
+
+// Generates the driver's write concern from the output's settings, nil
+// meaning writes aren't acknowledged.
+func (o *MongoOutput) writeConcern() (*mgo.Safe, error) {
+	safe := &mgo.Safe{WTimeout: o.WriteTimeout, J: o.Journal}
+	if o.W == "majority" {
+		safe.WMode = o.W
+		return safe, nil
+	}
+	w, err := strconv.Atoi(o.W)
+	if err != nil || w < 0 {
+		return nil, fmt.Errorf("`w` must be a number of nodes or 'majority', got %s", o.W)
+	}
+	if w == 0 {
+		if o.Journal {
+			return nil, errors.New("`journal` requires acknowledged writes")
+		}
+		return nil, nil
+	}
+	safe.W = w
+	return safe, nil
+}
+
+func (o *MongoOutput) Init(config interface{}) (err error) {
+	o.MongoOutputConfig = config.(*MongoOutputConfig)
+
+	if o.dialInfo, err = mgo.ParseURL(o.Url); err != nil {
+		return fmt.Errorf("can't parse URL '%s': %s", o.Url, err.Error())
+	}
+	o.dialInfo.Timeout = time.Duration(o.ConnectTimeout) * time.Millisecond
+	if o.Database == "" {
+		return errors.New("`database` must not be empty")
+	}
+	if o.Collection == "" {
+		return errors.New("`collection` must not be empty")
+	}
+	if o.Capped && o.CappedSize <= 0 {
+		return errors.New("`capped_size` must be greater than 0")
+	}
+	if o.safe, err = o.writeConcern(); err != nil {
+		return
+	}
+	o.fieldNames = plugins.NewFieldNameSanitizer(o.FieldNames)
+	o.created = make(map[string]bool)
+	err = o.Batch.Validate()
+	return
+}
+
+// Returns the document key for a dynamic field name. Names starting w/ a
+// "$" would be taken for operators.
+func (o *MongoOutput) fieldName(name string) string {
+	name = o.fieldNames.Sanitize(name)
+	if strings.HasPrefix(name, "$") {
+		name = "_" + name[1:]
+	}
+	return name
+}
+
+// Generates the document for a message. The message UUID is used as the
+// document ID, so retried writes can't insert a message twice. Dynamic fields
+// are stored in the document's `Fields` sub-document, fields w/ several
+// values as arrays.
+func (o *MongoOutput) document(msg *message.Message) bson.M {
+	doc := bson.M{
+		"_id":        msg.GetUuidString(),
+		"Timestamp":  time.Unix(0, msg.GetTimestamp()).UTC(),
+		"Type":       msg.GetType(),
+		"Logger":     msg.GetLogger(),
+		"Severity":   msg.GetSeverity(),
+		"Payload":    msg.GetPayload(),
+		"EnvVersion": msg.GetEnvVersion(),
+		"Pid":        msg.GetPid(),
+		"Hostname":   msg.GetHostname(),
+	}
+	if len(msg.Fields) == 0 {
+		return doc
+	}
+	fields := bson.M{}
+	for _, f := range msg.Fields {
+		var values []interface{}
+		switch f.GetValueType() {
+		case message.Field_STRING:
+			for _, v := range f.ValueString {
+				values = append(values, v)
+			}
+		case message.Field_BYTES:
+			for _, v := range f.ValueBytes {
+				values = append(values, v)
+			}
+		case message.Field_INTEGER:
+			for _, v := range f.ValueInteger {
+				values = append(values, v)
+			}
+		case message.Field_DOUBLE:
+			for _, v := range f.ValueDouble {
+				values = append(values, v)
+			}
+		case message.Field_BOOL:
+			for _, v := range f.ValueBool {
+				values = append(values, v)
+			}
+		}
+		if len(values) == 1 {
+			fields[o.fieldName(f.GetName())] = values[0]
+		} else {
+			fields[o.fieldName(f.GetName())] = values
+		}
+	}
+	doc["Fields"] = fields
+	return doc
+}
+
+// Generates the BSON encoded batch record for a message.
+func (o *MongoOutput) makeRecord(msg *message.Message) ([]byte, error) {
+	collection := plugins.InterpolateMessageString(o.Collection, msg)
+	if collection == "" {
+		return nil, errors.New("empty collection name generated for message")
+	}
+	doc, err := bson.Marshal(o.document(msg))
+	if err != nil {
+		return nil, err
+	}
+	return bson.Marshal(bson.M{
+		"c": collection,
+		"d": bson.Raw{Kind: 0x03, Data: doc},
+	})
+}
+
+// Connects to the server if there's no session yet.
+func (o *MongoOutput) connect() (err error) {
+	if o.session != nil {
+		return
+	}
+	if o.session, err = mgo.DialWithInfo(o.dialInfo); err != nil {
+		o.session = nil
+		return fmt.Errorf("can't connect to MongoDB: %s", err.Error())
+	}
+	o.session.SetSafe(o.safe)
+	return
+}
+
+// Creates a capped collection the first time a batch is written to it.
+// Creating a collection that already exists isn't an error.
+func (o *MongoOutput) ensureCapped(coll *mgo.Collection) error {
+	if !o.Capped || o.created[coll.Name] {
+		return nil
+	}
+	err := coll.Create(&mgo.CollectionInfo{
+		Capped:   true,
+		MaxBytes: o.CappedSize,
+		MaxDocs:  o.CappedMaxDocs,
+	})
+	if err != nil {
+		if qerr, ok := err.(*mgo.QueryError); !ok || qerr.Code != 48 {
+			return fmt.Errorf("can't create capped collection '%s': %s", coll.Name,
+				err.Error())
+		}
+	}
+	o.created[coll.Name] = true
+	return nil
+}
+
+// Satisfies `pipeline.BatchFlushFunc`, writing a batch of records using one
+// unordered bulk write per collection. Failed batches are retried in full,
+// documents that were already written by an earlier attempt are rejected as
+// duplicates and skipped.
+func (o *MongoOutput) flush(records [][]byte) error {
+	// Keep the collections in the order they're first seen.
+	var names []string
+	docs := make(map[string][]interface{})
+	for _, record := range records {
+		rec := new(mongoRecord)
+		if err := bson.Unmarshal(record, rec); err != nil {
+			return fmt.Errorf("can't decode record: %s", err.Error())
+		}
+		if _, ok := docs[rec.Collection]; !ok {
+			names = append(names, rec.Collection)
+		}
+		docs[rec.Collection] = append(docs[rec.Collection], rec.Doc)
+	}
+
+	if err := o.connect(); err != nil {
+		return err
+	}
+	db := o.session.DB(o.Database)
+	for _, name := range names {
+		coll := db.C(name)
+		if err := o.ensureCapped(coll); err != nil {
+			o.session.Refresh()
+			return err
+		}
+		bulk := coll.Bulk()
+		bulk.Unordered()
+		bulk.Insert(docs[name]...)
+		if _, err := bulk.Run(); err != nil && !mgo.IsDup(err) {
+			o.session.Refresh()
+			return fmt.Errorf("write to '%s' failed: %s", name, err.Error())
+		}
+	}
+	atomic.AddInt64(&o.processMessageCount, int64(len(records)))
+	return nil
+}
+
+func (o *MongoOutput) Run(or OutputRunner, h PluginHelper) (err error) {
+	if o.batcher, err = NewOutputBatcher(o.Batch, o.flush, or, h); err != nil {
+		return
+	}
+	o.batcher.Start()
+
+	var (
+		record []byte
+		e      error
+	)
+	for pack := range or.InChan() {
+		record, e = o.makeRecord(pack.Message)
+		pack.Recycle()
+		if e != nil {
+			or.LogError(e)
+			atomic.AddInt64(&o.dropMessageCount, 1)
+			continue
+		}
+		o.batcher.Add(record)
+	}
+	o.batcher.Stop()
+	if o.session != nil {
+		o.session.Close()
+	}
+	return
+}
+
+// Satisfies the `pipeline.ReportingPlugin` interface to provide plugin state
+// information to the Heka report and dashboard.
+func (o *MongoOutput) ReportMsg(msg *message.Message) error {
+	o.reportLock.Lock()
+	defer o.reportLock.Unlock()
+
+	message.NewInt64Field(msg, "ProcessMessageCount",
+		atomic.LoadInt64(&o.processMessageCount), "count")
+	message.NewInt64Field(msg, "DropMessageCount",
+		atomic.LoadInt64(&o.dropMessageCount), "count")
+	if o.batcher != nil {
+		o.batcher.ReportMsg(msg)
+	}
+	return nil
+}
+
+func init() {
+	RegisterPlugin("MongoOutput", func() interface{} {
+		return new(MongoOutput)
+	})
+}
@@ -0,0 +1,105 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package mongo
+
+import (
+	"github.com/mozilla-services/heka/message"
+	pipeline_ts "github.com/mozilla-services/heka/pipeline/testsupport"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+	"gopkg.in/mgo.v2/bson"
+	"time"
+)
+
+func MongoOutputSpec(c gs.Context) {
+	output := new(MongoOutput)
+	config := output.ConfigStruct().(*MongoOutputConfig)
+
+	msg := pipeline_ts.GetTestMessage()
+	field, _ := message.NewField("http.status", int64(200), "")
+	msg.AddField(field)
+	field, _ = message.NewField("$where", "ok", "")
+	msg.AddField(field)
+	field, _ = message.NewField("tags", "a", "")
+	field.AddValue("b")
+	msg.AddField(field)
+
+	c.Specify("A MongoOutput", func() {
+		c.Specify("rejects an invalid url", func() {
+			config.Url = "mongodb://localhost/?bogus=1"
+			err := output.Init(config)
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+
+		c.Specify("generates the write concern", func() {
+			config.WriteTimeout = 2000
+			config.Journal = true
+
+			c.Specify("for a number of nodes", func() {
+				config.W = "2"
+				err := output.Init(config)
+				c.Assume(err, gs.IsNil)
+				c.Expect(output.safe.W, gs.Equals, 2)
+				c.Expect(output.safe.WTimeout, gs.Equals, 2000)
+				c.Expect(output.safe.J, gs.IsTrue)
+			})
+
+			c.Specify("for a majority", func() {
+				config.W = "majority"
+				err := output.Init(config)
+				c.Assume(err, gs.IsNil)
+				c.Expect(output.safe.WMode, gs.Equals, "majority")
+			})
+
+			c.Specify("rejecting journaling of unacknowledged writes", func() {
+				config.W = "0"
+				err := output.Init(config)
+				c.Expect(err, gs.Not(gs.IsNil))
+			})
+
+			c.Specify("rejecting an invalid value", func() {
+				config.W = "all"
+				err := output.Init(config)
+				c.Expect(err, gs.Not(gs.IsNil))
+			})
+		})
+
+		c.Specify("converts messages to records", func() {
+			config.Collection = "logs_%{Logger}"
+			err := output.Init(config)
+			c.Assume(err, gs.IsNil)
+			b, err := output.makeRecord(msg)
+			c.Assume(err, gs.IsNil)
+
+			rec := new(mongoRecord)
+			err = bson.Unmarshal(b, rec)
+			c.Assume(err, gs.IsNil)
+			c.Expect(rec.Collection, gs.Equals, "logs_GoSpec")
+			doc := bson.M{}
+			err = rec.Doc.Unmarshal(&doc)
+			c.Assume(err, gs.IsNil)
+
+			c.Expect(doc["_id"], gs.Equals, msg.GetUuidString())
+			c.Expect(doc["Timestamp"].(time.Time).Unix(), gs.Equals, int64(1136239445))
+			c.Expect(doc["Type"], gs.Equals, "TEST")
+			c.Expect(doc["Payload"], gs.Equals, "Test Payload")
+			c.Expect(doc["Severity"], gs.Equals, 6)
+			fields := doc["Fields"].(bson.M)
+			c.Expect(fields["foo"], gs.Equals, "bar")
+			c.Expect(fields["http_status"], gs.Equals, int64(200))
+			c.Expect(fields["_where"], gs.Equals, "ok")
+			c.Expect(len(fields["tags"].([]interface{})), gs.Equals, 2)
+		})
+	})
+}
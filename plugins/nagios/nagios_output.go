@@ -25,15 +25,18 @@ import (
 	"io"
 	"net/http"
 	"net/url"
+	"os"
 	"strings"
 	"time"
 )
 
 // NagiosOutput can be configured to use the http client to submit the passive
-// checks directly to the nagios cgi, or pipe them to the send_nsca program.
-// To use send_nsca, one needs to provide the send_nsca_bin, and optionally
-// send_nsca_args config entries. To use http, one needs to provide Url, and
-// optionally username, password, and response_header_timeout.
+// checks directly to the nagios cgi, pipe them to the send_nsca program, or
+// write them to the Nagios external command file. To use send_nsca, one needs
+// to provide the send_nsca_bin, and optionally send_nsca_args config
+// entries. To use the command file, one needs to provide command_file. To use
+// http, one needs to provide Url, and optionally username, password, and
+// response_header_timeout.
 type NagiosOutputConfig struct {
 	// Must match Nagios service's service_description attribute; if not
 	// specified in the config explicitly, the name of the output is used.
@@ -50,6 +53,15 @@ type NagiosOutputConfig struct {
 	SendNscaArgs           []string `toml:"send_nsca_args"`
 	SendNscaTimeoutSeconds uint     `toml:"send_nsca_timeout"`
 
+	// Path to the Nagios external command file (usually nagios.cmd). If set,
+	// check results are written directly to the command file.
+	CommandFile string `toml:"command_file"`
+
+	// If true the check state is derived from the message severity, and the
+	// whole payload is used as the check output, rather than expecting the
+	// payload to start with the state.
+	UseSeverity bool `toml:"use_severity"`
+
 	// URL to the Nagios cmd.cgi
 	Url string
 	// Nagios username
@@ -83,8 +95,14 @@ type NagiosOutput struct {
 func (n *NagiosOutput) Init(config interface{}) (err error) {
 	n.conf = config.(*NagiosOutputConfig)
 
+	if n.conf.SendNscaBin != "" && n.conf.CommandFile != "" {
+		return fmt.Errorf("send_nsca_bin and command_file can't both be set")
+	}
+
 	n.submitter = n.submitSendNsca
-	if n.conf.SendNscaBin == "" {
+	if n.conf.CommandFile != "" {
+		n.submitter = n.submitCommandFile
+	} else if n.conf.SendNscaBin == "" {
 		// HTTP is implied.
 		n.submitter = n.submitHttp
 
@@ -111,26 +129,14 @@ func (n *NagiosOutput) Run(or OutputRunner, h PluginHelper) (err error) {
 	inChan := or.InChan()
 
 	var (
-		pack    *PipelinePack
-		msg     *message.Message
-		payload string
+		pack          *PipelinePack
+		msg           *message.Message
+		state, output string
 	)
 
 	for pack = range inChan {
 		msg = pack.Message
-		payload = msg.GetPayload()
-		pos := strings.IndexAny(payload, ":")
-		state := "3" // UNKNOWN
-		if pos != -1 {
-			switch payload[:pos] {
-			case "OK":
-				state = "0"
-			case "WARNING":
-				state = "1"
-			case "CRITICAL":
-				state = "2"
-			}
-		}
+		state, output = n.checkResult(msg)
 
 		host := n.conf.NagiosHost
 		if host == "" {
@@ -140,9 +146,7 @@ func (n *NagiosOutput) Run(or OutputRunner, h PluginHelper) (err error) {
 		if service_description == "" {
 			service_description = msg.GetLogger()
 		}
-		payload = payload[pos+1:]
-
-		err = n.submitter(host, service_description, state, payload)
+		err = n.submitter(host, service_description, state, output)
 		if err != nil {
 			or.LogError(err)
 		}
@@ -152,6 +156,36 @@ func (n *NagiosOutput) Run(or OutputRunner, h PluginHelper) (err error) {
 	return
 }
 
+// Extracts the check state and output from a message.
+func (n *NagiosOutput) checkResult(msg *message.Message) (state, output string) {
+	payload := msg.GetPayload()
+	if n.conf.UseSeverity {
+		switch sev := msg.GetSeverity(); {
+		case sev <= 3: // emerg, alert, crit, err
+			state = "2" // CRITICAL
+		case sev == 4: // warning
+			state = "1" // WARNING
+		default:
+			state = "0" // OK
+		}
+		return state, payload
+	}
+
+	pos := strings.IndexAny(payload, ":")
+	state = "3" // UNKNOWN
+	if pos != -1 {
+		switch payload[:pos] {
+		case "OK":
+			state = "0"
+		case "WARNING":
+			state = "1"
+		case "CRITICAL":
+			state = "2"
+		}
+	}
+	return state, payload[pos+1:]
+}
+
 func (n *NagiosOutput) submitSendNsca(host, service_description, state,
 	output string) (err error) {
 
@@ -180,6 +214,25 @@ func (n *NagiosOutput) submitSendNsca(host, service_description, state,
 	return
 }
 
+func (n *NagiosOutput) submitCommandFile(host, service_description, state,
+	output string) (err error) {
+
+	// The command file is a named pipe, so it's opened for each write rather
+	// than being held open while Nagios might be restarting.
+	var f *os.File
+	if f, err = os.OpenFile(n.conf.CommandFile, os.O_WRONLY|os.O_APPEND, 0); err != nil {
+		return
+	}
+	// Line breaks and semicolons would break the command syntax.
+	output = strings.NewReplacer("\n", " ", ";", ",").Replace(output)
+	_, err = fmt.Fprintf(f, "[%d] PROCESS_SERVICE_CHECK_RESULT;%s;%s;%s;%s\n",
+		time.Now().Unix(), host, service_description, state, output)
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	return
+}
+
 func (n *NagiosOutput) submitHttp(host, service_description, state,
 	output string) (err error) {
 
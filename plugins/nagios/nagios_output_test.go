@@ -129,6 +129,60 @@ func NagiosOutputSpec(c gs.Context) {
 			})
 		})
 
+		c.Specify("using a command file", func() {
+			cmdPath := pipeline_ts.WriteStringToTmpFile("")
+			defer os.Remove(cmdPath)
+			config.CommandFile = cmdPath
+
+			readCommand := func() string {
+				outFile, err := os.Open(cmdPath)
+				c.Assume(err, gs.IsNil)
+				defer outFile.Close()
+				line, _, err := bufio.NewReader(outFile).ReadLine()
+				c.Assume(err, gs.IsNil)
+				// Strip the timestamp.
+				return string(line[strings.Index(string(line), "]")+2:])
+			}
+
+			c.Specify("writes the check result", func() {
+				err := output.Init(config)
+				c.Assume(err, gs.IsNil)
+				outputWg.Add(1)
+				go run()
+
+				msg.SetPayload("WARNING:" + payload + ";\nmore")
+				inChan <- pack
+				close(inChan)
+				outputWg.Wait()
+
+				c.Expect(readCommand(), gs.Equals,
+					"PROCESS_SERVICE_CHECK_RESULT;my.host.name;GoSpec;1;"+payload+", more")
+			})
+
+			c.Specify("maps the message severity", func() {
+				config.UseSeverity = true
+				err := output.Init(config)
+				c.Assume(err, gs.IsNil)
+				outputWg.Add(1)
+				go run()
+
+				msg.SetPayload(payload)
+				msg.SetSeverity(3)
+				inChan <- pack
+				close(inChan)
+				outputWg.Wait()
+
+				c.Expect(readCommand(), gs.Equals,
+					"PROCESS_SERVICE_CHECK_RESULT;my.host.name;GoSpec;2;"+payload)
+			})
+
+			c.Specify("can't be combined w/ send_nsca", func() {
+				config.SendNscaBin = "/usr/sbin/send_nsca"
+				err := output.Init(config)
+				c.Expect(err, gs.Not(gs.IsNil))
+			})
+		})
+
 		if runtime.GOOS != "windows" {
 			outPath := filepath.Join(os.TempDir(), "heka-nagios-test-output.txt")
 			echoFile := fmt.Sprintf(echoFileTmpl, outPath)
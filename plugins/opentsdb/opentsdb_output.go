@@ -0,0 +1,307 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package opentsdb
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/mozilla-services/heka/message"
+	. "github.com/mozilla-services/heka/pipeline"
+	"github.com/mozilla-services/heka/plugins"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Output plugin that sends numeric message data to OpenTSDB using the telnet
+// style `put` protocol.
+type OpenTsdbOutput struct {
+	*OpenTsdbOutputConfig
+	conn                net.Conn
+	tagNames            []string
+	retryQueue          []queuedBatch
+	retryQueueSize      int
+	processMessageCount int64
+	dropMessageCount    int64
+	reportLock          sync.Mutex
+}
+
+// A batch of `put` lines waiting to be written, along w/ the number of
+// messages it holds.
+type queuedBatch struct {
+	data  []byte
+	count int
+}
+
+// ConfigStruct for OpenTsdbOutput plugin.
+type OpenTsdbOutputConfig struct {
+	// TCP address of the OpenTSDB server.
+	Address string
+	// Metric name, may contain `%{<name>}` placeholders.
+	Metric string
+	// Name of the message field containing the metric value.
+	ValueField string `toml:"value_field"`
+	// Map of tag name to tag value template. Values may contain `%{<name>}`
+	// placeholders.
+	Tags map[string]string
+	// Whether timestamps should be sent in milliseconds rather than seconds.
+	UseMilliseconds bool `toml:"use_milliseconds"`
+	// Number of points that will trigger a write.
+	FlushCount int `toml:"flush_count"`
+	// Interval at which accumulated points will be written, in
+	// milliseconds.
+	FlushInterval uint32 `toml:"flush_interval"`
+	// Maximum number of bytes of unsent data to hold on to for retrying
+	// while the OpenTSDB server is unreachable.
+	MaxRetryQueueSize int `toml:"max_retry_queue_size"`
+	// Connection timeout, in milliseconds.
+	ConnectTimeout uint32 `toml:"connect_timeout"`
+	// Time a write can take before the connection is given up on, in
+	// milliseconds. 0 means no limit.
+	WriteTimeout uint32 `toml:"write_timeout"`
+}
+
+func (o *OpenTsdbOutput) ConfigStruct() interface{} {
+	return &OpenTsdbOutputConfig{
+		Address:           "localhost:4242",
+		Metric:            "%{Type}",
+		ValueField:        "value",
+		FlushCount:        100,
+		FlushInterval:     1000,
+		MaxRetryQueueSize: 1024 * 1024,
+		ConnectTimeout:    5000,
+		WriteTimeout:      5000,
+	}
+}
+
+func (o *OpenTsdbOutput) Init(config interface{}) (err error) {
+	o.OpenTsdbOutputConfig = config.(*OpenTsdbOutputConfig)
+
+	if o.Metric == "" {
+		return errors.New("`metric` must not be empty")
+	}
+	if o.ValueField == "" {
+		return errors.New("`value_field` must not be empty")
+	}
+	if len(o.Tags) == 0 {
+		// OpenTSDB requires at least one tag.
+		o.Tags = map[string]string{"host": "%{Hostname}"}
+	}
+	o.tagNames = make([]string, 0, len(o.Tags))
+	for name := range o.Tags {
+		o.tagNames = append(o.tagNames, name)
+	}
+	sort.Strings(o.tagNames)
+	return
+}
+
+// Replaces any characters OpenTSDB doesn't allow in metric names, tag names,
+// and tag values with underscores.
+func sanitize(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		case r == '-', r == '_', r == '.', r == '/':
+			return r
+		}
+		return '_'
+	}, s)
+}
+
+// Appends a `put` line for the message to the buffer.
+func (o *OpenTsdbOutput) writePut(msg *message.Message, buf *bytes.Buffer) error {
+	val, ok := msg.GetFieldValue(o.ValueField)
+	if !ok {
+		return fmt.Errorf("message has no '%s' field", o.ValueField)
+	}
+	var valStr string
+	switch v := val.(type) {
+	case int64:
+		valStr = strconv.FormatInt(v, 10)
+	case float64:
+		valStr = strconv.FormatFloat(v, 'f', -1, 64)
+	default:
+		return fmt.Errorf("field '%s' isn't numeric", o.ValueField)
+	}
+
+	ts := msg.GetTimestamp() / int64(time.Second)
+	if o.UseMilliseconds {
+		ts = msg.GetTimestamp() / int64(time.Millisecond)
+	}
+
+	start := buf.Len()
+	fmt.Fprintf(buf, "put %s %d %s",
+		sanitize(plugins.InterpolateMessageString(o.Metric, msg)), ts, valStr)
+	tagCount := 0
+	for _, name := range o.tagNames {
+		tagVal := plugins.InterpolateMessageString(o.Tags[name], msg)
+		if tagVal == "" {
+			continue
+		}
+		fmt.Fprintf(buf, " %s=%s", sanitize(name), sanitize(tagVal))
+		tagCount++
+	}
+	if tagCount == 0 {
+		buf.Truncate(start)
+		return errors.New("no tag values could be generated for message")
+	}
+	buf.WriteByte('\n')
+	return nil
+}
+
+// Sends all queued batches, stopping at the first failure. Batches that
+// couldn't be sent stay in the queue for the next attempt. The messages of a
+// batch are only counted as processed once it's been written.
+func (o *OpenTsdbOutput) sendQueued(or OutputRunner) {
+	for len(o.retryQueue) > 0 {
+		batch := o.retryQueue[0]
+		if err := o.send(batch.data); err != nil {
+			or.LogError(err)
+			return
+		}
+		o.retryQueue = o.retryQueue[1:]
+		o.retryQueueSize -= len(batch.data)
+		atomic.AddInt64(&o.processMessageCount, int64(batch.count))
+	}
+}
+
+// Adds a batch of count messages to the retry queue, evicting the oldest
+// batches if needed to stay under the maximum queue size. The messages of
+// dropped batches are counted as dropped. Returns the number of bytes
+// dropped.
+func (o *OpenTsdbOutput) queueBatch(data []byte, count int) (dropped int) {
+	if len(data) > o.MaxRetryQueueSize {
+		atomic.AddInt64(&o.dropMessageCount, int64(count))
+		return len(data)
+	}
+	for o.retryQueueSize+len(data) > o.MaxRetryQueueSize {
+		oldest := o.retryQueue[0]
+		dropped += len(oldest.data)
+		o.retryQueueSize -= len(oldest.data)
+		o.retryQueue = o.retryQueue[1:]
+		atomic.AddInt64(&o.dropMessageCount, int64(oldest.count))
+	}
+	o.retryQueue = append(o.retryQueue, queuedBatch{data, count})
+	o.retryQueueSize += len(data)
+	return
+}
+
+// Writes data to the OpenTSDB server, connecting first if necessary. A
+// server that doesn't take the data within the `write_timeout` is
+// disconnected from, so it can't hold up the output.
+func (o *OpenTsdbOutput) send(data []byte) (err error) {
+	if o.conn == nil {
+		timeout := time.Duration(o.ConnectTimeout) * time.Millisecond
+		if o.conn, err = net.DialTimeout("tcp", o.Address, timeout); err != nil {
+			o.conn = nil
+			return fmt.Errorf("can't connect to %s: %s", o.Address, err)
+		}
+	}
+	if o.WriteTimeout > 0 {
+		o.conn.SetWriteDeadline(time.Now().Add(
+			time.Duration(o.WriteTimeout) * time.Millisecond))
+	}
+	if _, err = o.conn.Write(data); err != nil {
+		o.conn.Close()
+		o.conn = nil
+		return fmt.Errorf("writing to %s: %s", o.Address, err)
+	}
+	return
+}
+
+func (o *OpenTsdbOutput) Run(or OutputRunner, h PluginHelper) (err error) {
+	var (
+		ok     = true
+		pack   *PipelinePack
+		count  int
+		inChan = or.InChan()
+		buf    = new(bytes.Buffer)
+		tick   <-chan time.Time
+	)
+
+	if o.FlushInterval > 0 {
+		ticker := time.NewTicker(time.Duration(o.FlushInterval) * time.Millisecond)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	defer func() {
+		if o.conn != nil {
+			o.conn.Close()
+			o.conn = nil
+		}
+	}()
+
+	flush := func() {
+		if count > 0 {
+			batch := make([]byte, buf.Len())
+			copy(batch, buf.Bytes())
+			if dropped := o.queueBatch(batch, count); dropped > 0 {
+				or.LogError(fmt.Errorf("retry queue full, dropped %d bytes", dropped))
+			}
+			buf.Reset()
+			count = 0
+		}
+		o.sendQueued(or)
+	}
+
+	for ok {
+		select {
+		case pack, ok = <-inChan:
+			if !ok {
+				flush()
+				break
+			}
+			e := o.writePut(pack.Message, buf)
+			pack.Recycle()
+			if e != nil {
+				or.LogError(e)
+				atomic.AddInt64(&o.dropMessageCount, 1)
+				continue
+			}
+			if count++; o.FlushCount > 0 && count >= o.FlushCount {
+				flush()
+			}
+		case <-tick:
+			flush()
+		}
+	}
+	return
+}
+
+// Satisfies the `pipeline.ReportingPlugin` interface to provide plugin state
+// information to the Heka report and dashboard.
+func (o *OpenTsdbOutput) ReportMsg(msg *message.Message) error {
+	o.reportLock.Lock()
+	defer o.reportLock.Unlock()
+
+	message.NewInt64Field(msg, "ProcessMessageCount",
+		atomic.LoadInt64(&o.processMessageCount), "count")
+	message.NewInt64Field(msg, "DropMessageCount",
+		atomic.LoadInt64(&o.dropMessageCount), "count")
+	return nil
+}
+
+func init() {
+	RegisterPlugin("OpenTsdbOutput", func() interface{} {
+		return new(OpenTsdbOutput)
+	})
+}
@@ -0,0 +1,157 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package opentsdb
+
+import (
+	"bytes"
+	"github.com/mozilla-services/heka/message"
+	. "github.com/mozilla-services/heka/pipeline"
+	pipeline_ts "github.com/mozilla-services/heka/pipeline/testsupport"
+	plugins_ts "github.com/mozilla-services/heka/plugins/testsupport"
+	"github.com/rafrombrc/gomock/gomock"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+	"io/ioutil"
+	"net"
+)
+
+func OpenTsdbOutputSpec(c gs.Context) {
+	t := new(pipeline_ts.SimpleT)
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	output := new(OpenTsdbOutput)
+	config := output.ConfigStruct().(*OpenTsdbOutputConfig)
+
+	msg := pipeline_ts.GetTestMessage()
+	field, _ := message.NewField("value", 2.5, "")
+	msg.AddField(field)
+
+	c.Specify("An OpenTsdbOutput", func() {
+		buf := new(bytes.Buffer)
+
+		c.Specify("defaults to a host tag", func() {
+			err := output.Init(config)
+			c.Assume(err, gs.IsNil)
+			err = output.writePut(msg, buf)
+			c.Expect(err, gs.IsNil)
+			c.Expect(buf.String(), gs.Equals, "put TEST 1136239445 2.5 host=my.host.name\n")
+		})
+
+		c.Specify("interpolates and sanitizes metrics and tags", func() {
+			config.Metric = "heka %{Logger}"
+			config.UseMilliseconds = true
+			config.Tags = map[string]string{
+				"type": "%{Type}",
+				"foo":  "%{foo}:%{Pid}",
+			}
+			err := output.Init(config)
+			c.Assume(err, gs.IsNil)
+			err = output.writePut(msg, buf)
+			c.Expect(err, gs.IsNil)
+			c.Expect(buf.String(), gs.Equals,
+				"put heka_GoSpec 1136239445000 2.5 foo=bar_43 type=TEST\n")
+		})
+
+		c.Specify("rejects messages w/o a numeric value", func() {
+			config.ValueField = "foo"
+			err := output.Init(config)
+			c.Assume(err, gs.IsNil)
+			err = output.writePut(msg, buf)
+			c.Expect(err, gs.Not(gs.IsNil))
+			c.Expect(buf.Len(), gs.Equals, 0)
+		})
+
+		c.Specify("evicts the oldest batches when the retry queue is full", func() {
+			config.MaxRetryQueueSize = 10
+			err := output.Init(config)
+			c.Assume(err, gs.IsNil)
+			c.Expect(output.queueBatch([]byte("12345"), 2), gs.Equals, 0)
+			c.Expect(output.queueBatch([]byte("6789"), 1), gs.Equals, 0)
+			c.Expect(output.queueBatch([]byte("abc"), 1), gs.Equals, 5)
+			c.Expect(len(output.retryQueue), gs.Equals, 2)
+			c.Expect(output.retryQueueSize, gs.Equals, 7)
+			c.Expect(output.dropMessageCount, gs.Equals, int64(2))
+			c.Expect(output.queueBatch([]byte("way too large"), 3), gs.Equals, 13)
+			c.Expect(output.dropMessageCount, gs.Equals, int64(5))
+		})
+
+		c.Specify("only counts messages once they're written", func() {
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			c.Assume(err, gs.IsNil)
+			config.Address = ln.Addr().String()
+			ln.Close()
+			config.FlushCount = 2
+			config.FlushInterval = 0
+			config.ConnectTimeout = 100
+			err = output.Init(config)
+			c.Assume(err, gs.IsNil)
+
+			oth := plugins_ts.NewOutputTestHelper(ctrl)
+			inChan := make(chan *PipelinePack, 2)
+			oth.MockOutputRunner.EXPECT().InChan().Return(inChan)
+			oth.MockOutputRunner.EXPECT().LogError(gomock.Any()).AnyTimes()
+			for i := 0; i < 2; i++ {
+				pack := NewPipelinePack(make(chan *PipelinePack, 1))
+				pack.Message = msg
+				inChan <- pack
+			}
+			close(inChan)
+			err = output.Run(oth.MockOutputRunner, oth.MockHelper)
+			c.Expect(err, gs.IsNil)
+			c.Expect(output.processMessageCount, gs.Equals, int64(0))
+			c.Expect(len(output.retryQueue), gs.Equals, 1)
+			c.Expect(output.retryQueue[0].count, gs.Equals, 2)
+		})
+
+		c.Specify("sends batches over TCP", func() {
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			c.Assume(err, gs.IsNil)
+			defer ln.Close()
+			dataChan := make(chan string, 1)
+			go func() {
+				conn, err := ln.Accept()
+				if err != nil {
+					dataChan <- err.Error()
+					return
+				}
+				data, _ := ioutil.ReadAll(conn)
+				dataChan <- string(data)
+			}()
+
+			config.Address = ln.Addr().String()
+			config.FlushCount = 2
+			config.FlushInterval = 0
+			err = output.Init(config)
+			c.Assume(err, gs.IsNil)
+
+			oth := plugins_ts.NewOutputTestHelper(ctrl)
+			inChan := make(chan *PipelinePack, 2)
+			oth.MockOutputRunner.EXPECT().InChan().Return(inChan)
+			for i := 0; i < 2; i++ {
+				pack := NewPipelinePack(make(chan *PipelinePack, 1))
+				pack.Message = msg
+				inChan <- pack
+			}
+			close(inChan)
+			err = output.Run(oth.MockOutputRunner, oth.MockHelper)
+			c.Expect(err, gs.IsNil)
+
+			line := "put TEST 1136239445 2.5 host=my.host.name\n"
+			c.Expect(<-dataChan, gs.Equals, line+line)
+			c.Expect(len(output.retryQueue), gs.Equals, 0)
+			c.Expect(output.processMessageCount, gs.Equals, int64(2))
+		})
+	})
+}
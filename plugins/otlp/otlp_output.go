@@ -0,0 +1,506 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package otlp
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/mozilla-services/heka/message"
+	. "github.com/mozilla-services/heka/pipeline"
+	"github.com/mozilla-services/heka/plugins"
+	"github.com/mozilla-services/heka/plugins/tcp"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Output plugin that exports messages as OpenTelemetry log records to an
+// OTLP/HTTP endpoint, such as an OpenTelemetry collector. Only the HTTP
+// transport w/ JSON encoding is implemented, OTLP/gRPC isn't supported.
+type OtlpOutput struct {
+	*OtlpOutputConfig
+	client              *http.Client
+	attrNames           []string
+	resourceFields      map[string]bool
+	processMessageCount int64
+	dropMessageCount    int64
+	rejectedRecordCount int64
+	reportLock          sync.Mutex
+	batcher             *Batcher
+	or                  OutputRunner
+}
+
+// ConfigStruct for OtlpOutput plugin.
+type OtlpOutputConfig struct {
+	// URL of the OTLP/HTTP logs endpoint.
+	Url string
+	// Extra HTTP headers sent w/ every request, e.g. for authentication.
+	Headers map[string]string
+	// Map of resource attribute name to value template. Values may contain
+	// `%{<name>}` placeholders.
+	ResourceAttributes map[string]string `toml:"resource_attributes"`
+	// Dynamic message fields that are written as resource attributes rather
+	// than log record attributes.
+	ResourceFields []string `toml:"resource_fields"`
+	// Dynamic message fields holding the hex encoded trace and span IDs the
+	// record belongs to.
+	TraceIdField string `toml:"trace_id_field"`
+	SpanIdField  string `toml:"span_id_field"`
+	// Batching settings, from the `batch` subsection.
+	Batch BatchConfig `toml:"batch"`
+	// HTTP request timeout, in milliseconds. 0 means no timeout.
+	HttpTimeout uint32 `toml:"http_timeout"`
+	Tls         tcp.TlsConfig
+}
+
+// OTLP JSON structures, see the opentelemetry-proto repository's JSON
+// mapping of ExportLogsServiceRequest. 64 bit integers are encoded as
+// strings.
+type otlpAnyValue struct {
+	StringValue *string         `json:"stringValue,omitempty"`
+	IntValue    *string         `json:"intValue,omitempty"`
+	DoubleValue *float64        `json:"doubleValue,omitempty"`
+	BoolValue   *bool           `json:"boolValue,omitempty"`
+	BytesValue  *string         `json:"bytesValue,omitempty"`
+	ArrayValue  *otlpArrayValue `json:"arrayValue,omitempty"`
+}
+
+type otlpArrayValue struct {
+	Values []*otlpAnyValue `json:"values"`
+}
+
+type otlpKeyValue struct {
+	Key   string        `json:"key"`
+	Value *otlpAnyValue `json:"value"`
+}
+
+type otlpLogRecord struct {
+	TimeUnixNano         string          `json:"timeUnixNano"`
+	ObservedTimeUnixNano string          `json:"observedTimeUnixNano"`
+	SeverityNumber       int             `json:"severityNumber"`
+	SeverityText         string          `json:"severityText"`
+	Body                 *otlpAnyValue   `json:"body,omitempty"`
+	Attributes           []*otlpKeyValue `json:"attributes,omitempty"`
+	TraceId              string          `json:"traceId,omitempty"`
+	SpanId               string          `json:"spanId,omitempty"`
+}
+
+type otlpResource struct {
+	Attributes []*otlpKeyValue `json:"attributes"`
+}
+
+type otlpScope struct {
+	Name    string `json:"name"`
+	Version string `json:"version,omitempty"`
+}
+
+type otlpScopeLogs struct {
+	Scope      otlpScope         `json:"scope"`
+	LogRecords []json.RawMessage `json:"logRecords"`
+}
+
+type otlpResourceLogs struct {
+	Resource  json.RawMessage  `json:"resource"`
+	ScopeLogs []*otlpScopeLogs `json:"scopeLogs"`
+}
+
+type otlpExportRequest struct {
+	ResourceLogs []*otlpResourceLogs `json:"resourceLogs"`
+}
+
+type otlpPartialSuccess struct {
+	RejectedLogRecords string `json:"rejectedLogRecords"`
+	ErrorMessage       string `json:"errorMessage"`
+}
+
+type otlpExportResponse struct {
+	PartialSuccess *otlpPartialSuccess `json:"partialSuccess"`
+}
+
+// A batched record, holding a log record and the resource it belongs to so
+// records can be grouped by resource when they're exported.
+type otlpRecord struct {
+	Resource json.RawMessage `json:"resource"`
+	Record   json.RawMessage `json:"record"`
+}
+
+func (o *OtlpOutput) ConfigStruct() interface{} {
+	return &OtlpOutputConfig{
+		Url:          "http://localhost:4318/v1/logs",
+		TraceIdField: "trace_id",
+		SpanIdField:  "span_id",
+		HttpTimeout:  5000,
+		Batch:        DefaultBatchConfig(),
+	}
+}
+
+func (o *OtlpOutput) Init(config interface{}) (err error) {
+	o.OtlpOutputConfig = config.(*OtlpOutputConfig)
+
+	u, err := url.Parse(o.Url)
+	if err != nil {
+		return fmt.Errorf("can't parse URL '%s': %s", o.Url, err.Error())
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return errors.New("`url` must contain an absolute http or https URL")
+	}
+
+	o.client = new(http.Client)
+	if o.HttpTimeout > 0 {
+		o.client.Timeout = time.Duration(o.HttpTimeout) * time.Millisecond
+	}
+	if u.Scheme == "https" {
+		transport := &http.Transport{}
+		if transport.TLSClientConfig, err = tcp.CreateGoTlsConfig(&o.Tls); err != nil {
+			return fmt.Errorf("TLS init error: %s", err.Error())
+		}
+		o.client.Transport = transport
+	}
+
+	// Resource attributes are sorted so records from the same resource
+	// always encode the same way and end up in the same group.
+	o.attrNames = make([]string, 0, len(o.ResourceAttributes))
+	for name := range o.ResourceAttributes {
+		o.attrNames = append(o.attrNames, name)
+	}
+	sort.Strings(o.attrNames)
+
+	o.resourceFields = make(map[string]bool)
+	for _, name := range o.ResourceFields {
+		o.resourceFields[name] = true
+	}
+	err = o.Batch.Validate()
+	return
+}
+
+// Maps a syslog severity onto an OpenTelemetry severity number and text.
+func otlpSeverity(severity int32) (int, string) {
+	switch {
+	case severity <= 2:
+		return 21, "FATAL"
+	case severity == 3:
+		return 17, "ERROR"
+	case severity == 4:
+		return 13, "WARN"
+	case severity == 5:
+		return 10, "INFO2"
+	case severity == 6:
+		return 9, "INFO"
+	}
+	return 5, "DEBUG"
+}
+
+func stringValue(s string) *otlpAnyValue {
+	return &otlpAnyValue{StringValue: &s}
+}
+
+// Converts a single value of a message field into an OTLP value.
+func anyValue(value interface{}) *otlpAnyValue {
+	switch v := value.(type) {
+	case string:
+		return stringValue(v)
+	case []byte:
+		s := base64.StdEncoding.EncodeToString(v)
+		return &otlpAnyValue{BytesValue: &s}
+	case int64:
+		s := strconv.FormatInt(v, 10)
+		return &otlpAnyValue{IntValue: &s}
+	case float64:
+		return &otlpAnyValue{DoubleValue: &v}
+	case bool:
+		return &otlpAnyValue{BoolValue: &v}
+	}
+	return nil
+}
+
+// Converts a message field into an OTLP value, using an array value for
+// fields w/ more than one value.
+func fieldValue(field *message.Field) *otlpAnyValue {
+	var values []interface{}
+	switch field.GetValueType() {
+	case message.Field_STRING:
+		for _, v := range field.GetValueString() {
+			values = append(values, v)
+		}
+	case message.Field_BYTES:
+		for _, v := range field.GetValueBytes() {
+			values = append(values, v)
+		}
+	case message.Field_INTEGER:
+		for _, v := range field.GetValueInteger() {
+			values = append(values, v)
+		}
+	case message.Field_DOUBLE:
+		for _, v := range field.GetValueDouble() {
+			values = append(values, v)
+		}
+	case message.Field_BOOL:
+		for _, v := range field.GetValueBool() {
+			values = append(values, v)
+		}
+	}
+	switch len(values) {
+	case 0:
+		return nil
+	case 1:
+		return anyValue(values[0])
+	}
+	array := &otlpArrayValue{Values: make([]*otlpAnyValue, len(values))}
+	for i, v := range values {
+		array.Values[i] = anyValue(v)
+	}
+	return &otlpAnyValue{ArrayValue: array}
+}
+
+// Returns a hex encoded ID of the given byte length from a message field,
+// or "" if the field is missing or isn't a valid ID.
+func fieldId(msg *message.Message, name string, size int) string {
+	if name == "" {
+		return ""
+	}
+	val, ok := msg.GetFieldValue(name)
+	if !ok {
+		return ""
+	}
+	id, ok := val.(string)
+	if !ok {
+		return ""
+	}
+	id = strings.ToLower(strings.Replace(id, "-", "", -1))
+	if b, err := hex.DecodeString(id); err != nil || len(b) != size {
+		return ""
+	}
+	return id
+}
+
+// Generates the batched record for a message.
+func (o *OtlpOutput) makeRecord(msg *message.Message) (record []byte, err error) {
+	resource := &otlpResource{Attributes: []*otlpKeyValue{}}
+	hasHost := false
+	for _, name := range o.attrNames {
+		val := plugins.InterpolateMessageString(o.ResourceAttributes[name], msg)
+		resource.Attributes = append(resource.Attributes,
+			&otlpKeyValue{Key: name, Value: stringValue(val)})
+		hasHost = hasHost || name == "host.name"
+	}
+	if !hasHost && msg.GetHostname() != "" {
+		resource.Attributes = append(resource.Attributes,
+			&otlpKeyValue{Key: "host.name", Value: stringValue(msg.GetHostname())})
+	}
+
+	sevNumber, sevText := otlpSeverity(msg.GetSeverity())
+	logRecord := &otlpLogRecord{
+		TimeUnixNano:         strconv.FormatInt(msg.GetTimestamp(), 10),
+		ObservedTimeUnixNano: strconv.FormatInt(time.Now().UnixNano(), 10),
+		SeverityNumber:       sevNumber,
+		SeverityText:         sevText,
+		TraceId:              fieldId(msg, o.TraceIdField, 16),
+		SpanId:               fieldId(msg, o.SpanIdField, 8),
+	}
+	if payload := msg.GetPayload(); payload != "" {
+		logRecord.Body = stringValue(payload)
+	}
+	for name, val := range map[string]string{
+		"heka.type":   msg.GetType(),
+		"heka.logger": msg.GetLogger(),
+		"heka.uuid":   msg.GetUuidString(),
+	} {
+		if val != "" {
+			logRecord.Attributes = append(logRecord.Attributes,
+				&otlpKeyValue{Key: name, Value: stringValue(val)})
+		}
+	}
+	// Map iteration order is random, keep the headers in a stable order.
+	sort.Sort(byKey(logRecord.Attributes))
+
+	for _, field := range msg.Fields {
+		name := field.GetName()
+		if name == o.TraceIdField || name == o.SpanIdField {
+			continue
+		}
+		value := fieldValue(field)
+		if value == nil {
+			continue
+		}
+		kv := &otlpKeyValue{Key: name, Value: value}
+		if o.resourceFields[name] {
+			resource.Attributes = append(resource.Attributes, kv)
+		} else {
+			logRecord.Attributes = append(logRecord.Attributes, kv)
+		}
+	}
+
+	rec := new(otlpRecord)
+	if rec.Resource, err = json.Marshal(resource); err != nil {
+		return
+	}
+	if rec.Record, err = json.Marshal(logRecord); err != nil {
+		return
+	}
+	return json.Marshal(rec)
+}
+
+type byKey []*otlpKeyValue
+
+func (b byKey) Len() int           { return len(b) }
+func (b byKey) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b byKey) Less(i, j int) bool { return b[i].Key < b[j].Key }
+
+// Builds an export request from a batch of records, grouping the log records
+// by resource.
+func exportRequest(records [][]byte) (*otlpExportRequest, error) {
+	req := new(otlpExportRequest)
+	groups := make(map[string]*otlpScopeLogs)
+	for _, data := range records {
+		rec := new(otlpRecord)
+		if err := json.Unmarshal(data, rec); err != nil {
+			return nil, err
+		}
+		scopeLogs, ok := groups[string(rec.Resource)]
+		if !ok {
+			scopeLogs = &otlpScopeLogs{Scope: otlpScope{Name: "heka"}}
+			groups[string(rec.Resource)] = scopeLogs
+			req.ResourceLogs = append(req.ResourceLogs, &otlpResourceLogs{
+				Resource:  rec.Resource,
+				ScopeLogs: []*otlpScopeLogs{scopeLogs},
+			})
+		}
+		scopeLogs.LogRecords = append(scopeLogs.LogRecords, rec.Record)
+	}
+	return req, nil
+}
+
+// Satisfies `pipeline.BatchFlushFunc`, exporting a batch of records.
+// Requests that are throttled or fail w/ a server or network error are
+// retried, ones the endpoint rejects as invalid are dropped.
+func (o *OtlpOutput) flush(records [][]byte) error {
+	req, err := exportRequest(records)
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	rejected, err, retry := o.post(body)
+	if err != nil {
+		if retry {
+			return err
+		}
+		o.or.LogError(err)
+		atomic.AddInt64(&o.dropMessageCount, int64(len(records)))
+		return nil
+	}
+	if rejected > 0 {
+		atomic.AddInt64(&o.rejectedRecordCount, rejected)
+	}
+	atomic.AddInt64(&o.processMessageCount, int64(len(records))-rejected)
+	return nil
+}
+
+// Makes a single export request, returning the number of records the
+// endpoint rejected. The returned bool indicates whether or not a failed
+// request can be retried.
+func (o *OtlpOutput) post(body []byte) (rejected int64, err error, retry bool) {
+	req, err := http.NewRequest("POST", o.Url, bytes.NewReader(body))
+	if err != nil {
+		return 0, fmt.Errorf("can't create HTTP request: %s", err.Error()), false
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range o.Headers {
+		req.Header.Set(name, value)
+	}
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("error making HTTP request: %s", err.Error()), true
+	}
+	defer resp.Body.Close()
+	respBody, _ := ioutil.ReadAll(resp.Body)
+
+	if resp.StatusCode >= 300 {
+		retry = resp.StatusCode == 429 || resp.StatusCode == 502 ||
+			resp.StatusCode == 503 || resp.StatusCode == 504
+		return 0, fmt.Errorf("OTLP export failed: %s - %s", resp.Status,
+			strings.TrimSpace(string(respBody))), retry
+	}
+	exportResp := new(otlpExportResponse)
+	if json.Unmarshal(respBody, exportResp) == nil && exportResp.PartialSuccess != nil {
+		rejected, _ = strconv.ParseInt(exportResp.PartialSuccess.RejectedLogRecords, 10, 64)
+		if rejected > 0 {
+			o.or.LogError(fmt.Errorf("OTLP endpoint rejected %d log records: %s",
+				rejected, exportResp.PartialSuccess.ErrorMessage))
+		}
+	}
+	return
+}
+
+func (o *OtlpOutput) Run(or OutputRunner, h PluginHelper) (err error) {
+	o.or = or
+	if o.batcher, err = NewOutputBatcher(o.Batch, o.flush, or, h); err != nil {
+		return
+	}
+	o.batcher.Start()
+
+	var (
+		record []byte
+		e      error
+	)
+	for pack := range or.InChan() {
+		record, e = o.makeRecord(pack.Message)
+		pack.Recycle()
+		if e != nil {
+			or.LogError(e)
+			atomic.AddInt64(&o.dropMessageCount, 1)
+			continue
+		}
+		o.batcher.Add(record)
+	}
+	o.batcher.Stop()
+	return
+}
+
+// Satisfies the `pipeline.ReportingPlugin` interface to provide plugin state
+// information to the Heka report and dashboard.
+func (o *OtlpOutput) ReportMsg(msg *message.Message) error {
+	o.reportLock.Lock()
+	defer o.reportLock.Unlock()
+
+	message.NewInt64Field(msg, "ProcessMessageCount",
+		atomic.LoadInt64(&o.processMessageCount), "count")
+	message.NewInt64Field(msg, "DropMessageCount",
+		atomic.LoadInt64(&o.dropMessageCount), "count")
+	message.NewInt64Field(msg, "RejectedRecordCount",
+		atomic.LoadInt64(&o.rejectedRecordCount), "count")
+	if o.batcher != nil {
+		o.batcher.ReportMsg(msg)
+	}
+	return nil
+}
+
+func init() {
+	RegisterPlugin("OtlpOutput", func() interface{} {
+		return new(OtlpOutput)
+	})
+}
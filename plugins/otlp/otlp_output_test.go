@@ -0,0 +1,160 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package otlp
+
+import (
+	"encoding/json"
+	"github.com/mozilla-services/heka/message"
+	pipeline_ts "github.com/mozilla-services/heka/pipeline/testsupport"
+	plugins_ts "github.com/mozilla-services/heka/plugins/testsupport"
+	"github.com/rafrombrc/gomock/gomock"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+)
+
+func OtlpOutputSpec(c gs.Context) {
+	t := new(pipeline_ts.SimpleT)
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	output := new(OtlpOutput)
+	config := output.ConfigStruct().(*OtlpOutputConfig)
+
+	msg := pipeline_ts.GetTestMessage()
+	field, _ := message.NewField("trace_id", "4bf92f3577b34da6a3ce929d0e0e4736", "")
+	msg.AddField(field)
+	field, _ = message.NewField("service", "web", "")
+	msg.AddField(field)
+	field, _ = message.NewField("number", int64(64), "")
+	msg.AddField(field)
+
+	decode := func(record []byte) (resource otlpResource, logRecord otlpLogRecord) {
+		rec := new(otlpRecord)
+		json.Unmarshal(record, rec)
+		json.Unmarshal(rec.Resource, &resource)
+		json.Unmarshal(rec.Record, &logRecord)
+		return
+	}
+
+	c.Specify("An OtlpOutput", func() {
+		c.Specify("rejects an invalid url", func() {
+			config.Url = "localhost:4318"
+			err := output.Init(config)
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+
+		c.Specify("converts messages to log records", func() {
+			config.ResourceAttributes = map[string]string{
+				"deployment.environment": "prod",
+			}
+			config.ResourceFields = []string{"service"}
+			err := output.Init(config)
+			c.Assume(err, gs.IsNil)
+			record, err := output.makeRecord(msg)
+			c.Assume(err, gs.IsNil)
+			resource, logRecord := decode(record)
+
+			attrs := make(map[string]string)
+			for _, kv := range resource.Attributes {
+				attrs[kv.Key] = *kv.Value.StringValue
+			}
+			c.Expect(attrs["deployment.environment"], gs.Equals, "prod")
+			c.Expect(attrs["host.name"], gs.Equals, "my.host.name")
+			c.Expect(attrs["service"], gs.Equals, "web")
+
+			c.Expect(logRecord.TimeUnixNano, gs.Equals, "1136239445000000000")
+			c.Expect(logRecord.SeverityNumber, gs.Equals, 9)
+			c.Expect(logRecord.SeverityText, gs.Equals, "INFO")
+			c.Expect(*logRecord.Body.StringValue, gs.Equals, "Test Payload")
+			c.Expect(logRecord.TraceId, gs.Equals, "4bf92f3577b34da6a3ce929d0e0e4736")
+			c.Expect(logRecord.SpanId, gs.Equals, "")
+			recAttrs := make(map[string]*otlpAnyValue)
+			for _, kv := range logRecord.Attributes {
+				recAttrs[kv.Key] = kv.Value
+			}
+			c.Expect(*recAttrs["heka.type"].StringValue, gs.Equals, "TEST")
+			c.Expect(*recAttrs["foo"].StringValue, gs.Equals, "bar")
+			c.Expect(*recAttrs["number"].IntValue, gs.Equals, "64")
+			c.Expect(recAttrs["service"] == nil, gs.IsTrue)
+			c.Expect(recAttrs["trace_id"] == nil, gs.IsTrue)
+		})
+
+		c.Specify("groups records by resource", func() {
+			err := output.Init(config)
+			c.Assume(err, gs.IsNil)
+			first, _ := output.makeRecord(msg)
+			second, _ := output.makeRecord(msg)
+			msg.SetHostname("other.host")
+			third, _ := output.makeRecord(msg)
+			req, err := exportRequest([][]byte{first, second, third})
+			c.Expect(err, gs.IsNil)
+			c.Expect(len(req.ResourceLogs), gs.Equals, 2)
+			c.Expect(len(req.ResourceLogs[0].ScopeLogs[0].LogRecords), gs.Equals, 2)
+			c.Expect(len(req.ResourceLogs[1].ScopeLogs[0].LogRecords), gs.Equals, 1)
+		})
+
+		c.Specify("exports batches", func() {
+			var (
+				requests int
+				status   = http.StatusOK
+				received otlpExportRequest
+				apiKey   string
+			)
+			server := httptest.NewServer(http.HandlerFunc(
+				func(w http.ResponseWriter, r *http.Request) {
+					requests++
+					apiKey = r.Header.Get("X-Api-Key")
+					body, _ := ioutil.ReadAll(r.Body)
+					json.Unmarshal(body, &received)
+					w.WriteHeader(status)
+					w.Write([]byte("{}"))
+				}))
+			defer server.Close()
+
+			config.Url = server.URL
+			config.Headers = map[string]string{"X-Api-Key": "secret"}
+			err := output.Init(config)
+			c.Assume(err, gs.IsNil)
+			record, _ := output.makeRecord(msg)
+
+			c.Specify("to the endpoint", func() {
+				err = output.flush([][]byte{record})
+				c.Expect(err, gs.IsNil)
+				c.Expect(requests, gs.Equals, 1)
+				c.Expect(apiKey, gs.Equals, "secret")
+				c.Expect(len(received.ResourceLogs), gs.Equals, 1)
+				c.Expect(output.processMessageCount, gs.Equals, int64(1))
+			})
+
+			c.Specify("and asks for a retry when throttled", func() {
+				status = 429
+				err = output.flush([][]byte{record})
+				c.Expect(err, gs.Not(gs.IsNil))
+			})
+
+			c.Specify("and drops batches the endpoint rejects", func() {
+				status = http.StatusBadRequest
+				oth := plugins_ts.NewOutputTestHelper(ctrl)
+				oth.MockOutputRunner.EXPECT().LogError(gomock.Any())
+				output.or = oth.MockOutputRunner
+				err = output.flush([][]byte{record})
+				c.Expect(err, gs.IsNil)
+				c.Expect(output.dropMessageCount, gs.Equals, int64(1))
+			})
+		})
+	})
+}
@@ -0,0 +1,290 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pagerduty
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/mozilla-services/heka/message"
+	. "github.com/mozilla-services/heka/pipeline"
+	"github.com/mozilla-services/heka/plugins"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Output plugin that sends alert messages to the PagerDuty Events API.
+type PagerDutyOutput struct {
+	*PagerDutyOutputConfig
+	client              *http.Client
+	retryHelper         *RetryHelper
+	processMessageCount int64
+	dropMessageCount    int64
+	reportLock          sync.Mutex
+}
+
+// ConfigStruct for PagerDutyOutput plugin.
+type PagerDutyOutputConfig struct {
+	// Events API endpoint.
+	Url string
+	// Integration (routing) key used for messages that don't match any of
+	// the `routing_keys`.
+	RoutingKey string `toml:"routing_key"`
+	// Message field containing the name of the service an alert belongs to.
+	ServiceField string `toml:"service_field"`
+	// Map of service name to integration key.
+	RoutingKeys map[string]string `toml:"routing_keys"`
+	// Message field containing the event action. A value of "resolve" or
+	// "acknowledge" maps onto the matching event action, anything else
+	// triggers an incident.
+	ActionField string `toml:"action_field"`
+	// Templates for the event's dedup key, summary, and source. May contain
+	// `%{<name>}` placeholders.
+	DedupKey string `toml:"dedup_key"`
+	Summary  string
+	Source   string
+	// Dynamic message fields included in the event's custom details.
+	Fields []string
+	// Maximum number of times a rate limited or failed request is retried.
+	// -1 means retry forever.
+	MaxRetries int `toml:"max_retries"`
+	// HTTP request timeout, in milliseconds. 0 means no timeout.
+	HttpTimeout uint32 `toml:"http_timeout"`
+}
+
+// PagerDuty Events API v2 event structures.
+type pdPayload struct {
+	Summary       string                 `json:"summary"`
+	Source        string                 `json:"source"`
+	Severity      string                 `json:"severity"`
+	Timestamp     string                 `json:"timestamp,omitempty"`
+	Component     string                 `json:"component,omitempty"`
+	CustomDetails map[string]interface{} `json:"custom_details,omitempty"`
+}
+
+type pdEvent struct {
+	RoutingKey  string     `json:"routing_key"`
+	EventAction string     `json:"event_action"`
+	DedupKey    string     `json:"dedup_key,omitempty"`
+	Payload     *pdPayload `json:"payload,omitempty"`
+}
+
+func (o *PagerDutyOutput) ConfigStruct() interface{} {
+	return &PagerDutyOutputConfig{
+		Url:          "https://events.pagerduty.com/v2/enqueue",
+		ServiceField: "service",
+		ActionField:  "event_action",
+		DedupKey:     "%{Logger}:%{Hostname}",
+		Summary:      "%{Payload}",
+		Source:       "%{Hostname}",
+		MaxRetries:   5,
+		HttpTimeout:  5000,
+	}
+}
+
+func (o *PagerDutyOutput) Init(config interface{}) (err error) {
+	o.PagerDutyOutputConfig = config.(*PagerDutyOutputConfig)
+
+	if o.RoutingKey == "" && len(o.RoutingKeys) == 0 {
+		return errors.New("either `routing_key` or `routing_keys` must be set")
+	}
+	if o.DedupKey == "" {
+		return errors.New("`dedup_key` must not be empty")
+	}
+	u, err := url.Parse(o.Url)
+	if err != nil {
+		return fmt.Errorf("can't parse URL '%s': %s", o.Url, err.Error())
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return errors.New("`url` must contain an absolute http or https URL")
+	}
+	if o.MaxRetries < -1 {
+		return errors.New("`max_retries` must be -1 or greater")
+	}
+
+	o.client = new(http.Client)
+	if o.HttpTimeout > 0 {
+		o.client.Timeout = time.Duration(o.HttpTimeout) * time.Millisecond
+	}
+	o.retryHelper, err = NewRetryHelper(o.retryOptions())
+	if err != nil {
+		return fmt.Errorf("can't create retry helper: %s", err.Error())
+	}
+	return
+}
+
+// Maps a syslog severity onto a PagerDuty severity.
+func pdSeverity(severity int32) string {
+	switch {
+	case severity <= 2:
+		return "critical"
+	case severity == 3:
+		return "error"
+	case severity == 4:
+		return "warning"
+	}
+	return "info"
+}
+
+// Returns the string value of a message field, or "" if it doesn't exist.
+func fieldString(msg *message.Message, name string) string {
+	if name == "" {
+		return ""
+	}
+	if val, ok := msg.GetFieldValue(name); ok {
+		return fmt.Sprint(val)
+	}
+	return ""
+}
+
+// Generates the PagerDuty event for a message.
+func (o *PagerDutyOutput) event(msg *message.Message) (event *pdEvent, err error) {
+	service := fieldString(msg, o.ServiceField)
+	routingKey, ok := o.RoutingKeys[service]
+	if !ok {
+		routingKey = o.RoutingKey
+	}
+	if routingKey == "" {
+		return nil, fmt.Errorf("no routing key for service '%s'", service)
+	}
+
+	event = &pdEvent{
+		RoutingKey: routingKey,
+		DedupKey:   plugins.InterpolateMessageString(o.DedupKey, msg),
+	}
+	switch strings.ToLower(fieldString(msg, o.ActionField)) {
+	case "resolve", "resolved":
+		event.EventAction = "resolve"
+		return
+	case "acknowledge", "acknowledged":
+		event.EventAction = "acknowledge"
+		return
+	}
+
+	event.EventAction = "trigger"
+	event.Payload = &pdPayload{
+		Summary:   plugins.InterpolateMessageString(o.Summary, msg),
+		Source:    plugins.InterpolateMessageString(o.Source, msg),
+		Severity:  pdSeverity(msg.GetSeverity()),
+		Timestamp: time.Unix(0, msg.GetTimestamp()).UTC().Format(time.RFC3339),
+		Component: service,
+	}
+	if event.Payload.Summary == "" {
+		event.Payload.Summary = msg.GetType()
+	}
+	if len(o.Fields) > 0 {
+		event.Payload.CustomDetails = make(map[string]interface{})
+		for _, name := range o.Fields {
+			if val, ok := msg.GetFieldValue(name); ok {
+				event.Payload.CustomDetails[name] = val
+			}
+		}
+	}
+	return
+}
+
+// The output's own retry settings, which a `backoff` section can override.
+func (o *PagerDutyOutput) retryOptions() RetryOptions {
+	return RetryOptions{
+		MaxDelay:   "30s",
+		Delay:      "1s",
+		MaxRetries: o.MaxRetries,
+	}
+}
+
+func (o *PagerDutyOutput) Run(or OutputRunner, h PluginHelper) (err error) {
+	if o.retryHelper, err = NewRunnerRetryHelper(or, o.retryOptions()); err != nil {
+		return fmt.Errorf("can't create retry helper: %s", err.Error())
+	}
+	for pack := range or.InChan() {
+		event, e := o.event(pack.Message)
+		pack.Recycle()
+		if e != nil {
+			or.LogError(e)
+			atomic.AddInt64(&o.dropMessageCount, 1)
+			continue
+		}
+		if e = o.send(or, event); e != nil {
+			or.LogError(e)
+			atomic.AddInt64(&o.dropMessageCount, 1)
+			continue
+		}
+		atomic.AddInt64(&o.processMessageCount, 1)
+	}
+	return
+}
+
+// Sends an event, retrying according to the `max_retries` setting when
+// PagerDuty rate limits the request or is unavailable.
+func (o *PagerDutyOutput) send(or OutputRunner, event *pdEvent) (err error) {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("can't encode PagerDuty event: %s", err.Error())
+	}
+	var retry bool
+	o.retryHelper.Reset()
+	for {
+		if err, retry = o.post(body); err == nil || !retry {
+			return
+		}
+		if o.retryHelper.Wait() != nil {
+			return
+		}
+		or.LogMessage(fmt.Sprintf("%s; retrying", err.Error()))
+	}
+}
+
+// Makes a single request. The returned bool indicates whether or not a
+// failed request can be retried.
+func (o *PagerDutyOutput) post(body []byte) (err error, retry bool) {
+	resp, err := o.client.Post(o.Url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("error making HTTP request: %s", err.Error()), true
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		retry = resp.StatusCode == 429 || resp.StatusCode >= 500
+		respBody, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("PagerDuty request failed: %s - %s", resp.Status,
+			strings.TrimSpace(string(respBody))), retry
+	}
+	return
+}
+
+// Satisfies the `pipeline.ReportingPlugin` interface to provide plugin state
+// information to the Heka report and dashboard.
+func (o *PagerDutyOutput) ReportMsg(msg *message.Message) error {
+	o.reportLock.Lock()
+	defer o.reportLock.Unlock()
+
+	message.NewInt64Field(msg, "ProcessMessageCount",
+		atomic.LoadInt64(&o.processMessageCount), "count")
+	message.NewInt64Field(msg, "DropMessageCount",
+		atomic.LoadInt64(&o.dropMessageCount), "count")
+	return nil
+}
+
+func init() {
+	RegisterPlugin("PagerDutyOutput", func() interface{} {
+		return new(PagerDutyOutput)
+	})
+}
@@ -0,0 +1,134 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pagerduty
+
+import (
+	"encoding/json"
+	"github.com/mozilla-services/heka/message"
+	. "github.com/mozilla-services/heka/pipeline"
+	pipeline_ts "github.com/mozilla-services/heka/pipeline/testsupport"
+	plugins_ts "github.com/mozilla-services/heka/plugins/testsupport"
+	"github.com/rafrombrc/gomock/gomock"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+)
+
+func PagerDutyOutputSpec(c gs.Context) {
+	t := new(pipeline_ts.SimpleT)
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	output := new(PagerDutyOutput)
+	config := output.ConfigStruct().(*PagerDutyOutputConfig)
+	config.RoutingKey = "default-key"
+
+	msg := pipeline_ts.GetTestMessage()
+
+	c.Specify("A PagerDutyOutput", func() {
+		c.Specify("requires a routing key", func() {
+			config.RoutingKey = ""
+			err := output.Init(config)
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+
+		c.Specify("triggers an incident by default", func() {
+			config.Fields = []string{"foo"}
+			err := output.Init(config)
+			c.Assume(err, gs.IsNil)
+			event, err := output.event(msg)
+			c.Assume(err, gs.IsNil)
+			c.Expect(event.RoutingKey, gs.Equals, "default-key")
+			c.Expect(event.EventAction, gs.Equals, "trigger")
+			c.Expect(event.DedupKey, gs.Equals, "GoSpec:my.host.name")
+			c.Expect(event.Payload.Summary, gs.Equals, "Test Payload")
+			c.Expect(event.Payload.Source, gs.Equals, "my.host.name")
+			c.Expect(event.Payload.Severity, gs.Equals, "info")
+			c.Expect(event.Payload.Timestamp, gs.Equals, "2006-01-02T22:04:05Z")
+			c.Expect(event.Payload.CustomDetails["foo"], gs.Equals, "bar")
+		})
+
+		c.Specify("routes by service and resolves", func() {
+			config.RoutingKeys = map[string]string{"db": "db-key"}
+			err := output.Init(config)
+			c.Assume(err, gs.IsNil)
+			field, _ := message.NewField("service", "db", "")
+			msg.AddField(field)
+			field, _ = message.NewField("event_action", "resolve", "")
+			msg.AddField(field)
+
+			event, err := output.event(msg)
+			c.Assume(err, gs.IsNil)
+			c.Expect(event.RoutingKey, gs.Equals, "db-key")
+			c.Expect(event.EventAction, gs.Equals, "resolve")
+			c.Expect(event.Payload == nil, gs.IsTrue)
+		})
+
+		c.Specify("retries rate limited requests", func() {
+			var requests int
+			var received pdEvent
+			server := httptest.NewServer(http.HandlerFunc(
+				func(w http.ResponseWriter, r *http.Request) {
+					requests++
+					if requests < 3 {
+						http.Error(w, "slow down", 429)
+						return
+					}
+					body, _ := ioutil.ReadAll(r.Body)
+					json.Unmarshal(body, &received)
+					w.WriteHeader(http.StatusAccepted)
+				}))
+			defer server.Close()
+
+			config.Url = server.URL
+			err := output.Init(config)
+			c.Assume(err, gs.IsNil)
+			output.retryHelper, _ = NewRetryHelper(RetryOptions{
+				Delay:      "1ms",
+				MaxDelay:   "1ms",
+				MaxRetries: 5,
+			})
+
+			oth := plugins_ts.NewOutputTestHelper(ctrl)
+			oth.MockOutputRunner.EXPECT().LogMessage(gomock.Any()).Times(2)
+			event, err := output.event(msg)
+			c.Assume(err, gs.IsNil)
+			err = output.send(oth.MockOutputRunner, event)
+			c.Expect(err, gs.IsNil)
+			c.Expect(requests, gs.Equals, 3)
+			c.Expect(received.DedupKey, gs.Equals, "GoSpec:my.host.name")
+		})
+
+		c.Specify("doesn't retry bad requests", func() {
+			var requests int
+			server := httptest.NewServer(http.HandlerFunc(
+				func(w http.ResponseWriter, r *http.Request) {
+					requests++
+					http.Error(w, "invalid event", http.StatusBadRequest)
+				}))
+			defer server.Close()
+
+			config.Url = server.URL
+			err := output.Init(config)
+			c.Assume(err, gs.IsNil)
+			event, err := output.event(msg)
+			c.Assume(err, gs.IsNil)
+			err = output.send(nil, event)
+			c.Expect(err, gs.Not(gs.IsNil))
+			c.Expect(requests, gs.Equals, 1)
+		})
+	})
+}
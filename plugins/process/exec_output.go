@@ -0,0 +1,274 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+#***** END LICENSE BLOCK *****/
+
+package process
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mozilla-services/heka/message"
+	. "github.com/mozilla-services/heka/pipeline"
+)
+
+// A child that ran for at least this long resets the restart delay.
+const stableRunTime = time.Minute
+
+// Output plugin that runs a long-running program and streams encoded
+// messages to its standard input, restarting it whenever it exits.
+type ExecOutput struct {
+	*ExecOutputConfig
+	or                  OutputRunner
+	retryHelper         *RetryHelper
+	cmd                 *exec.Cmd
+	stdin               io.WriteCloser
+	exited              chan error
+	started             time.Time
+	processMessageCount int64
+	dropMessageCount    int64
+	restartCount        int64
+	reportLock          sync.Mutex
+}
+
+// ConfigStruct for ExecOutput plugin.
+type ExecOutputConfig struct {
+	// Program to run, w/ its arguments, environment, and working directory.
+	Command cmdConfig
+	// Whether lines the program writes to its standard error are logged.
+	LogStderr bool `toml:"log_stderr"`
+	// Time to wait for the program to exit after its standard input is
+	// closed, in milliseconds, before it's killed.
+	ShutdownTimeout uint32 `toml:"shutdown_timeout"`
+	// Maximum number of consecutive restarts before the output gives up. -1
+	// means restart forever.
+	MaxRetries int `toml:"max_retries"`
+	// Specifies whether or not Heka's stream framing will be applied to the
+	// output. Defaults to true if ProtobufEncoder is used, false otherwise.
+	UseFraming *bool `toml:"use_framing"`
+}
+
+func (o *ExecOutput) ConfigStruct() interface{} {
+	return &ExecOutputConfig{
+		LogStderr:       true,
+		ShutdownTimeout: 5000,
+		MaxRetries:      -1,
+	}
+}
+
+func (o *ExecOutput) Init(config interface{}) (err error) {
+	o.ExecOutputConfig = config.(*ExecOutputConfig)
+
+	if o.Command.Bin == "" {
+		return errors.New("`command.bin` must be set")
+	}
+	if _, err = exec.LookPath(o.Command.Bin); err != nil {
+		return fmt.Errorf("can't find program '%s': %s", o.Command.Bin, err)
+	}
+	o.retryHelper, err = NewRetryHelper(o.retryOptions())
+	if err != nil {
+		return fmt.Errorf("can't create retry helper: %s", err.Error())
+	}
+	return
+}
+
+// The output's own restart settings, which a `backoff` section can
+// override.
+func (o *ExecOutput) retryOptions() RetryOptions {
+	return RetryOptions{
+		MaxDelay:   "30s",
+		Delay:      "1s",
+		MaxRetries: o.MaxRetries,
+	}
+}
+
+// Logs the lines the program writes to its standard error.
+func (o *ExecOutput) logStderr(stderr io.Reader) {
+	scanner := bufio.NewScanner(stderr)
+	for scanner.Scan() {
+		if o.LogStderr {
+			o.or.LogMessage(fmt.Sprintf("%s: %s", o.Command.Bin, scanner.Text()))
+		}
+	}
+}
+
+// Starts the program, reporting its exit on the exited channel.
+func (o *ExecOutput) start() (err error) {
+	cmd := exec.Command(o.Command.Bin, o.Command.Args...)
+	cmd.Dir = o.Command.Directory
+	cmd.Env = o.Command.Env
+	if o.stdin, err = cmd.StdinPipe(); err != nil {
+		return
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		o.stdin.Close()
+		return
+	}
+	if err = cmd.Start(); err != nil {
+		o.stdin.Close()
+		return fmt.Errorf("can't start '%s': %s", o.Command.Bin, err)
+	}
+	exited := make(chan error, 1)
+	go func() {
+		o.logStderr(stderr)
+		exited <- cmd.Wait()
+	}()
+	o.cmd, o.exited, o.started = cmd, exited, time.Now()
+	return
+}
+
+// Logs an unexpected exit of the program, w/ the error `Wait` returned.
+func (o *ExecOutput) logExit(err error) {
+	if err == nil {
+		err = errors.New("exit status 0")
+	}
+	o.or.LogError(fmt.Errorf("'%s' exited: %s", o.Command.Bin, err))
+}
+
+// Makes sure the program is running, restarting it w/ an increasing delay
+// if it exited. Returns an error once the restarts are used up.
+func (o *ExecOutput) ensureRunning() error {
+	if o.cmd != nil {
+		select {
+		case err := <-o.exited:
+			o.stdin.Close()
+			o.cmd = nil
+			o.logExit(err)
+		default:
+			return nil
+		}
+	}
+	for {
+		if !o.started.IsZero() {
+			if time.Since(o.started) >= stableRunTime {
+				o.retryHelper.Reset()
+			}
+			if err := o.retryHelper.Wait(); err != nil {
+				return fmt.Errorf("giving up restarting '%s'", o.Command.Bin)
+			}
+			atomic.AddInt64(&o.restartCount, 1)
+		}
+		err := o.start()
+		if err == nil {
+			return nil
+		}
+		o.or.LogError(err)
+		o.started = time.Now()
+	}
+}
+
+// Writes the data to the program's standard input. If the program exited,
+// it's restarted and the data is written to the new process.
+func (o *ExecOutput) write(outBytes []byte) error {
+	for {
+		if err := o.ensureRunning(); err != nil {
+			return err
+		}
+		if _, err := o.stdin.Write(outBytes); err == nil {
+			return nil
+		}
+		// A failed write means the program is going away, wait for it.
+		o.logExit(o.stop())
+	}
+}
+
+// Closes the program's standard input and waits for it to exit, killing it
+// if it doesn't exit in time. Returns the error `Wait` returned.
+func (o *ExecOutput) stop() (err error) {
+	if o.cmd == nil {
+		return
+	}
+	o.stdin.Close()
+	select {
+	case err = <-o.exited:
+	case <-time.After(time.Duration(o.ShutdownTimeout) * time.Millisecond):
+		o.cmd.Process.Kill()
+		err = <-o.exited
+	}
+	o.cmd = nil
+	return
+}
+
+func (o *ExecOutput) Run(or OutputRunner, h PluginHelper) (err error) {
+	enc := or.Encoder()
+	if enc == nil {
+		return errors.New("Encoder required.")
+	}
+	if o.UseFraming == nil {
+		// Nothing was specified, we'll default to framing IFF ProtobufEncoder
+		// is being used.
+		if _, ok := enc.(*ProtobufEncoder); ok {
+			or.SetUseFraming(true)
+		}
+	}
+	o.or = or
+	if o.retryHelper, err = NewRunnerRetryHelper(or, o.retryOptions()); err != nil {
+		return fmt.Errorf("can't create retry helper: %s", err.Error())
+	}
+	defer func() {
+		if e := o.stop(); e != nil {
+			o.logExit(e)
+		}
+	}()
+
+	var (
+		outBytes []byte
+		e        error
+	)
+	for pack := range or.InChan() {
+		outBytes, e = or.Encode(pack)
+		pack.Recycle()
+		if e != nil {
+			or.LogError(e)
+			atomic.AddInt64(&o.dropMessageCount, 1)
+			continue
+		}
+		if outBytes == nil {
+			continue
+		}
+		if e = o.write(outBytes); e != nil {
+			atomic.AddInt64(&o.dropMessageCount, 1)
+			return e
+		}
+		atomic.AddInt64(&o.processMessageCount, 1)
+	}
+	return
+}
+
+// Satisfies the `pipeline.ReportingPlugin` interface to provide plugin state
+// information to the Heka report and dashboard.
+func (o *ExecOutput) ReportMsg(msg *message.Message) error {
+	o.reportLock.Lock()
+	defer o.reportLock.Unlock()
+
+	message.NewInt64Field(msg, "ProcessMessageCount",
+		atomic.LoadInt64(&o.processMessageCount), "count")
+	message.NewInt64Field(msg, "DropMessageCount",
+		atomic.LoadInt64(&o.dropMessageCount), "count")
+	message.NewInt64Field(msg, "RestartCount",
+		atomic.LoadInt64(&o.restartCount), "count")
+	return nil
+}
+
+func init() {
+	RegisterPlugin("ExecOutput", func() interface{} {
+		return new(ExecOutput)
+	})
+}
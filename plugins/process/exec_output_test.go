@@ -0,0 +1,115 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+#***** END LICENSE BLOCK *****/
+
+package process
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/mozilla-services/heka/pipeline"
+	pipeline_ts "github.com/mozilla-services/heka/pipeline/testsupport"
+	plugins_ts "github.com/mozilla-services/heka/plugins/testsupport"
+	"github.com/rafrombrc/gomock/gomock"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+)
+
+func ExecOutputSpec(c gs.Context) {
+	t := &pipeline_ts.SimpleT{}
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	tmpDir, err := ioutil.TempDir("", "exec-output-tests")
+	c.Assume(err, gs.IsNil)
+	defer os.RemoveAll(tmpDir)
+	outPath := filepath.Join(tmpDir, "out.txt")
+
+	oth := plugins_ts.NewOutputTestHelper(ctrl)
+	oth.MockOutputRunner.EXPECT().LogError(gomock.Any()).AnyTimes()
+	oth.MockOutputRunner.EXPECT().LogMessage(gomock.Any()).AnyTimes()
+
+	output := new(ExecOutput)
+	config := output.ConfigStruct().(*ExecOutputConfig)
+	config.Command = cmdConfig{
+		Bin:  EXEC_OUTPUT_CMD,
+		Args: EXEC_OUTPUT_ARGS,
+		Env:  []string{"EXEC_OUTPUT_FILE=" + outPath, "PATH=" + os.Getenv("PATH")},
+	}
+
+	readOutput := func(expected string) string {
+		var data []byte
+		for i := 0; i < 100; i++ {
+			data, _ = ioutil.ReadFile(outPath)
+			if string(data) == expected {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		return string(data)
+	}
+
+	c.Specify("An ExecOutput", func() {
+		c.Specify("requires an existing program", func() {
+			config.Command.Bin = "not-a-real-program"
+			err := output.Init(config)
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+
+		c.Specify("streams data to the program", func() {
+			err := output.Init(config)
+			c.Assume(err, gs.IsNil)
+			output.or = oth.MockOutputRunner
+
+			c.Expect(output.write([]byte("hello"+EXEC_OUTPUT_NEWLINE)), gs.IsNil)
+			c.Expect(output.write([]byte("world"+EXEC_OUTPUT_NEWLINE)), gs.IsNil)
+			c.Expect(output.stop(), gs.IsNil)
+			c.Expect(readOutput("hello"+EXEC_OUTPUT_NEWLINE+"world"+EXEC_OUTPUT_NEWLINE),
+				gs.Equals, "hello"+EXEC_OUTPUT_NEWLINE+"world"+EXEC_OUTPUT_NEWLINE)
+		})
+
+		c.Specify("restarts the program when it exits", func() {
+			config.Command.Args = EXEC_OUTPUT_ONE_LINE_ARGS
+			err := output.Init(config)
+			c.Assume(err, gs.IsNil)
+			output.or = oth.MockOutputRunner
+			output.retryHelper, err = NewRetryHelper(RetryOptions{
+				MaxDelay:   "10ms",
+				Delay:      "10ms",
+				MaxJitter:  "1ms",
+				MaxRetries: 1,
+			})
+			c.Assume(err, gs.IsNil)
+
+			c.Expect(output.write([]byte("first"+EXEC_OUTPUT_NEWLINE)), gs.IsNil)
+			// Wait for the program to exit, leaving the exit for the output.
+			exitErr := <-output.exited
+			output.exited <- exitErr
+
+			c.Expect(output.write([]byte("second"+EXEC_OUTPUT_NEWLINE)), gs.IsNil)
+			expected := "first" + EXEC_OUTPUT_NEWLINE + "second" + EXEC_OUTPUT_NEWLINE
+			c.Expect(readOutput(expected), gs.Equals, expected)
+			c.Expect(output.restartCount, gs.Equals, int64(1))
+
+			c.Specify("and gives up once the restarts are used up", func() {
+				exitErr = <-output.exited
+				output.exited <- exitErr
+				err = output.write([]byte("third" + EXEC_OUTPUT_NEWLINE))
+				c.Expect(err, gs.Not(gs.IsNil))
+			})
+			output.stop()
+		})
+	})
+}
@@ -60,3 +60,11 @@ const PROCESSINPUT_PIPE_CMD2 = "grep"
 
 var PROCESSINPUT_PIPE_CMD2_ARGS = []string{"ignore"}
 var PROCESSINPUT_PIPE_OUTPUT = "ignore this line"
+
+// ExecOutput test configuration
+const EXEC_OUTPUT_CMD = "sh"
+
+var EXEC_OUTPUT_ARGS = []string{"-c", "cat >> \"$EXEC_OUTPUT_FILE\""}
+var EXEC_OUTPUT_ONE_LINE_ARGS = []string{"-c", "head -n 1 >> \"$EXEC_OUTPUT_FILE\""}
+
+const EXEC_OUTPUT_NEWLINE = "\n"
@@ -60,3 +60,11 @@ const PROCESSINPUT_PIPE_CMD2 = "findstr"
 
 var PROCESSINPUT_PIPE_CMD2_ARGS = []string{"ignore"}
 var PROCESSINPUT_PIPE_OUTPUT = []string{"ignore ", "this ", "line\r"}
+
+// ExecOutput test configuration
+const EXEC_OUTPUT_CMD = "cmd"
+
+var EXEC_OUTPUT_ARGS = []string{"/c", "more >> %EXEC_OUTPUT_FILE%"}
+var EXEC_OUTPUT_ONE_LINE_ARGS = []string{"/c", "set /p LINE= && call echo %LINE%>> %EXEC_OUTPUT_FILE%"}
+
+const EXEC_OUTPUT_NEWLINE = "\r\n"
@@ -0,0 +1,411 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package prometheus
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/mozilla-services/heka/message"
+	. "github.com/mozilla-services/heka/pipeline"
+	"github.com/mozilla-services/heka/plugins"
+	"math"
+	"net"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	validMetricName = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+	validLabelName  = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+	labelEscaper    = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	helpEscaper     = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	defaultBuckets  = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+)
+
+// Output plugin that maintains Prometheus counters, gauges, and histograms
+// from message data, and exposes them on an HTTP endpoint for scraping.
+type PrometheusOutput struct {
+	*PrometheusOutputConfig
+	metrics             []*metric
+	lock                sync.Mutex
+	listener            net.Listener
+	now                 func() time.Time
+	processMessageCount int64
+	dropMessageCount    int64
+	reportLock          sync.Mutex
+}
+
+// ConfigStruct for PrometheusOutput plugin.
+type PrometheusOutputConfig struct {
+	// TCP address the HTTP endpoint listens on.
+	Address string
+	// URL path the metrics are served from.
+	Path string
+	// Number of seconds after which a series that hasn't been updated is
+	// removed. 0 means series never expire.
+	ExpireAfter uint32 `toml:"expire_after"`
+	// Map of metric name to metric config.
+	Metrics map[string]*PrometheusMetricConfig
+}
+
+// Config for a single metric.
+type PrometheusMetricConfig struct {
+	// One of "counter", "gauge", or "histogram".
+	Type string
+	// Help text included in the exposition output.
+	Help string
+	// Optional matcher selecting the messages that update the metric. If
+	// empty, all messages received by the output are used.
+	MessageMatcher string `toml:"message_matcher"`
+	// Name of the message field containing the value. Counters w/o a value
+	// field are incremented by one for each message.
+	ValueField string `toml:"value_field"`
+	// Map of label name to label value template.
+	Labels map[string]string
+	// Histogram bucket upper bounds.
+	Buckets []float64
+}
+
+type metric struct {
+	name       string
+	conf       *PrometheusMetricConfig
+	matcher    *message.MatcherSpecification
+	labelNames []string
+	buckets    []float64
+	series     map[string]*series
+}
+
+type series struct {
+	labelValues []string
+	value       float64
+	counts      []uint64
+	count       uint64
+	updated     time.Time
+}
+
+func (o *PrometheusOutput) ConfigStruct() interface{} {
+	return &PrometheusOutputConfig{
+		Address: ":9145",
+		Path:    "/metrics",
+	}
+}
+
+func (o *PrometheusOutput) Init(config interface{}) (err error) {
+	o.PrometheusOutputConfig = config.(*PrometheusOutputConfig)
+
+	if len(o.Metrics) == 0 {
+		return errors.New("at least one metric must be configured")
+	}
+	if !strings.HasPrefix(o.Path, "/") {
+		return errors.New("`path` must begin with '/'")
+	}
+
+	names := make([]string, 0, len(o.Metrics))
+	for name := range o.Metrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	o.metrics = make([]*metric, 0, len(names))
+	for _, name := range names {
+		m, err := newMetric(name, o.Metrics[name])
+		if err != nil {
+			return fmt.Errorf("metric '%s': %s", name, err)
+		}
+		o.metrics = append(o.metrics, m)
+	}
+	if o.now == nil {
+		o.now = time.Now
+	}
+	return
+}
+
+func newMetric(name string, conf *PrometheusMetricConfig) (m *metric, err error) {
+	if !validMetricName.MatchString(name) {
+		return nil, errors.New("invalid metric name")
+	}
+	m = &metric{
+		name:   name,
+		conf:   conf,
+		series: make(map[string]*series),
+	}
+	switch conf.Type {
+	case "counter":
+	case "gauge", "histogram":
+		if conf.ValueField == "" {
+			return nil, fmt.Errorf("`value_field` is required for a %s", conf.Type)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported type: '%s'", conf.Type)
+	}
+	if conf.MessageMatcher != "" {
+		if m.matcher, err = message.CreateMatcherSpecification(conf.MessageMatcher); err != nil {
+			return nil, fmt.Errorf("invalid `message_matcher`: %s", err)
+		}
+	}
+	for label := range conf.Labels {
+		if !validLabelName.MatchString(label) || strings.HasPrefix(label, "__") {
+			return nil, fmt.Errorf("invalid label name: '%s'", label)
+		}
+		if label == "le" && conf.Type == "histogram" {
+			return nil, errors.New("histograms can't use the 'le' label")
+		}
+		m.labelNames = append(m.labelNames, label)
+	}
+	sort.Strings(m.labelNames)
+
+	if conf.Type == "histogram" {
+		m.buckets = conf.Buckets
+		if len(m.buckets) == 0 {
+			m.buckets = defaultBuckets
+		}
+		m.buckets = append([]float64(nil), m.buckets...)
+		sort.Float64s(m.buckets)
+		// The +Inf bucket is always rendered from the total count.
+		if math.IsInf(m.buckets[len(m.buckets)-1], 1) {
+			m.buckets = m.buckets[:len(m.buckets)-1]
+		}
+	}
+	return
+}
+
+// Applies the message to the metric, returning false if the message wasn't
+// relevant to it.
+func (m *metric) update(msg *message.Message, now time.Time) bool {
+	if m.matcher != nil && !m.matcher.Match(msg) {
+		return false
+	}
+	value := 1.0
+	if m.conf.ValueField != "" {
+		tmp, ok := msg.GetFieldValue(m.conf.ValueField)
+		if !ok {
+			return false
+		}
+		switch v := tmp.(type) {
+		case int64:
+			value = float64(v)
+		case float64:
+			value = v
+		default:
+			return false
+		}
+	}
+	if m.conf.Type == "counter" && value < 0 {
+		// Counters can only go up.
+		return false
+	}
+
+	values := make([]string, len(m.labelNames))
+	for i, label := range m.labelNames {
+		values[i] = plugins.InterpolateMessageString(m.conf.Labels[label], msg)
+	}
+	key := strings.Join(values, "\x00")
+	s, ok := m.series[key]
+	if !ok {
+		s = &series{labelValues: values}
+		if m.conf.Type == "histogram" {
+			s.counts = make([]uint64, len(m.buckets))
+		}
+		m.series[key] = s
+	}
+
+	switch m.conf.Type {
+	case "counter":
+		s.value += value
+	case "gauge":
+		s.value = value
+	case "histogram":
+		for i, bound := range m.buckets {
+			if value <= bound {
+				s.counts[i]++
+			}
+		}
+		s.value += value
+		s.count++
+	}
+	s.updated = now
+	return true
+}
+
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	case math.IsNaN(f):
+		return "NaN"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// Appends the label set for a sample to the buffer, w/ an optional extra
+// label appended at the end.
+func (m *metric) writeLabels(buf *bytes.Buffer, values []string, extraName,
+	extraValue string) {
+
+	if len(m.labelNames) == 0 && extraName == "" {
+		return
+	}
+	buf.WriteByte('{')
+	for i, label := range m.labelNames {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		fmt.Fprintf(buf, `%s="%s"`, label, labelEscaper.Replace(values[i]))
+	}
+	if extraName != "" {
+		if len(m.labelNames) > 0 {
+			buf.WriteByte(',')
+		}
+		fmt.Fprintf(buf, `%s="%s"`, extraName, labelEscaper.Replace(extraValue))
+	}
+	buf.WriteByte('}')
+}
+
+// Appends the metric in the Prometheus text exposition format. Series are
+// written in label order.
+func (m *metric) write(buf *bytes.Buffer) {
+	if m.conf.Help != "" {
+		fmt.Fprintf(buf, "# HELP %s %s\n", m.name, helpEscaper.Replace(m.conf.Help))
+	}
+	fmt.Fprintf(buf, "# TYPE %s %s\n", m.name, m.conf.Type)
+
+	keys := make([]string, 0, len(m.series))
+	for key := range m.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		s := m.series[key]
+		if m.conf.Type != "histogram" {
+			buf.WriteString(m.name)
+			m.writeLabels(buf, s.labelValues, "", "")
+			fmt.Fprintf(buf, " %s\n", formatFloat(s.value))
+			continue
+		}
+		for i, bound := range m.buckets {
+			buf.WriteString(m.name + "_bucket")
+			m.writeLabels(buf, s.labelValues, "le", formatFloat(bound))
+			fmt.Fprintf(buf, " %d\n", s.counts[i])
+		}
+		buf.WriteString(m.name + "_bucket")
+		m.writeLabels(buf, s.labelValues, "le", "+Inf")
+		fmt.Fprintf(buf, " %d\n", s.count)
+		buf.WriteString(m.name + "_sum")
+		m.writeLabels(buf, s.labelValues, "", "")
+		fmt.Fprintf(buf, " %s\n", formatFloat(s.value))
+		buf.WriteString(m.name + "_count")
+		m.writeLabels(buf, s.labelValues, "", "")
+		fmt.Fprintf(buf, " %d\n", s.count)
+	}
+}
+
+// Updates all of the metrics the message applies to. Returns false if the
+// message didn't update any metric.
+func (o *PrometheusOutput) update(msg *message.Message) (updated bool) {
+	now := o.now()
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	for _, m := range o.metrics {
+		if m.update(msg, now) {
+			updated = true
+		}
+	}
+	return
+}
+
+// Removes any series that haven't been updated within the expiry window.
+func (o *PrometheusOutput) expire() {
+	if o.ExpireAfter == 0 {
+		return
+	}
+	cutoff := o.now().Add(-time.Duration(o.ExpireAfter) * time.Second)
+	for _, m := range o.metrics {
+		for key, s := range m.series {
+			if s.updated.Before(cutoff) {
+				delete(m.series, key)
+			}
+		}
+	}
+}
+
+// Serves the current metric values in the Prometheus text format.
+func (o *PrometheusOutput) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	buf := new(bytes.Buffer)
+	o.lock.Lock()
+	o.expire()
+	for _, m := range o.metrics {
+		m.write(buf)
+	}
+	o.lock.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write(buf.Bytes())
+}
+
+func (o *PrometheusOutput) Run(or OutputRunner, h PluginHelper) (err error) {
+	if o.listener, err = net.Listen("tcp", o.Address); err != nil {
+		return fmt.Errorf("can't listen on %s: %s", o.Address, err)
+	}
+	defer o.listener.Close()
+	or.LogMessage(fmt.Sprintf("Serving metrics on %s%s", o.listener.Addr(), o.Path))
+
+	mux := http.NewServeMux()
+	mux.Handle(o.Path, o)
+	server := &http.Server{
+		Handler:      mux,
+		ReadTimeout:  10 * time.Second,
+		WriteTimeout: 10 * time.Second,
+	}
+	go server.Serve(o.listener)
+
+	for pack := range or.InChan() {
+		if o.update(pack.Message) {
+			atomic.AddInt64(&o.processMessageCount, 1)
+		} else {
+			atomic.AddInt64(&o.dropMessageCount, 1)
+		}
+		pack.Recycle()
+	}
+	return
+}
+
+// Satisfies the `pipeline.ReportingPlugin` interface to provide plugin state
+// information to the Heka report and dashboard.
+func (o *PrometheusOutput) ReportMsg(msg *message.Message) error {
+	o.reportLock.Lock()
+	defer o.reportLock.Unlock()
+
+	message.NewInt64Field(msg, "ProcessMessageCount",
+		atomic.LoadInt64(&o.processMessageCount), "count")
+	message.NewInt64Field(msg, "DropMessageCount",
+		atomic.LoadInt64(&o.dropMessageCount), "count")
+	return nil
+}
+
+func init() {
+	RegisterPlugin("PrometheusOutput", func() interface{} {
+		return new(PrometheusOutput)
+	})
+}
@@ -0,0 +1,156 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package prometheus
+
+import (
+	"github.com/mozilla-services/heka/message"
+	pipeline_ts "github.com/mozilla-services/heka/pipeline/testsupport"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+	"net/http/httptest"
+	"time"
+)
+
+func PrometheusOutputSpec(c gs.Context) {
+	output := new(PrometheusOutput)
+	config := output.ConfigStruct().(*PrometheusOutputConfig)
+	now := time.Unix(1136239445, 0)
+	output.now = func() time.Time { return now }
+
+	msg := pipeline_ts.GetTestMessage()
+	field, _ := message.NewField("latency", 0.3, "s")
+	msg.AddField(field)
+
+	render := func() string {
+		recorder := httptest.NewRecorder()
+		output.ServeHTTP(recorder, nil)
+		c.Expect(recorder.HeaderMap.Get("Content-Type"), gs.Equals,
+			"text/plain; version=0.0.4")
+		return recorder.Body.String()
+	}
+
+	c.Specify("A PrometheusOutput", func() {
+		c.Specify("requires at least one metric", func() {
+			err := output.Init(config)
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+
+		c.Specify("rejects invalid metrics", func() {
+			config.Metrics = map[string]*PrometheusMetricConfig{
+				"bad-name": {Type: "counter"},
+			}
+			c.Expect(output.Init(config), gs.Not(gs.IsNil))
+			config.Metrics = map[string]*PrometheusMetricConfig{
+				"gauge": {Type: "gauge"},
+			}
+			c.Expect(output.Init(config), gs.Not(gs.IsNil))
+			config.Metrics = map[string]*PrometheusMetricConfig{
+				"hist": {
+					Type:       "histogram",
+					ValueField: "latency",
+					Labels:     map[string]string{"le": "%{foo}"},
+				},
+			}
+			c.Expect(output.Init(config), gs.Not(gs.IsNil))
+		})
+
+		c.Specify("maintains counters and gauges", func() {
+			config.Metrics = map[string]*PrometheusMetricConfig{
+				"messages_total": {
+					Type:   "counter",
+					Help:   "Messages seen.",
+					Labels: map[string]string{"type": "%{Type}", "host": "%{Hostname}"},
+				},
+				"latency_seconds": {
+					Type:       "gauge",
+					ValueField: "latency",
+				},
+				"other_total": {
+					Type:           "counter",
+					MessageMatcher: "Type == 'OTHER'",
+				},
+			}
+			err := output.Init(config)
+			c.Assume(err, gs.IsNil)
+
+			c.Expect(output.update(msg), gs.IsTrue)
+			c.Expect(output.update(msg), gs.IsTrue)
+			msg.SetHostname("other\"host")
+			c.Expect(output.update(msg), gs.IsTrue)
+
+			c.Expect(render(), gs.Equals, "# TYPE latency_seconds gauge\n"+
+				"latency_seconds 0.3\n"+
+				"# HELP messages_total Messages seen.\n"+
+				"# TYPE messages_total counter\n"+
+				"messages_total{host=\"my.host.name\",type=\"TEST\"} 2\n"+
+				"messages_total{host=\"other\\\"host\",type=\"TEST\"} 1\n"+
+				"# TYPE other_total counter\n")
+		})
+
+		c.Specify("maintains histograms", func() {
+			config.Metrics = map[string]*PrometheusMetricConfig{
+				"latency_seconds": {
+					Type:       "histogram",
+					ValueField: "latency",
+					Labels:     map[string]string{"type": "%{Type}"},
+					Buckets:    []float64{1, 0.5, 0.25},
+				},
+			}
+			err := output.Init(config)
+			c.Assume(err, gs.IsNil)
+
+			output.update(msg)
+			msg.Fields[1].ValueDouble[0] = 2
+			output.update(msg)
+
+			c.Expect(render(), gs.Equals, "# TYPE latency_seconds histogram\n"+
+				"latency_seconds_bucket{type=\"TEST\",le=\"0.25\"} 0\n"+
+				"latency_seconds_bucket{type=\"TEST\",le=\"0.5\"} 1\n"+
+				"latency_seconds_bucket{type=\"TEST\",le=\"1\"} 1\n"+
+				"latency_seconds_bucket{type=\"TEST\",le=\"+Inf\"} 2\n"+
+				"latency_seconds_sum{type=\"TEST\"} 2.3\n"+
+				"latency_seconds_count{type=\"TEST\"} 2\n")
+		})
+
+		c.Specify("ignores messages w/o a usable value", func() {
+			config.Metrics = map[string]*PrometheusMetricConfig{
+				"foo": {Type: "gauge", ValueField: "foo"},
+			}
+			err := output.Init(config)
+			c.Assume(err, gs.IsNil)
+			c.Expect(output.update(msg), gs.IsFalse)
+		})
+
+		c.Specify("expires stale series", func() {
+			config.ExpireAfter = 60
+			config.Metrics = map[string]*PrometheusMetricConfig{
+				"messages_total": {
+					Type:   "counter",
+					Labels: map[string]string{"host": "%{Hostname}"},
+				},
+			}
+			err := output.Init(config)
+			c.Assume(err, gs.IsNil)
+
+			output.update(msg)
+			now = now.Add(45 * time.Second)
+			msg.SetHostname("new.host")
+			output.update(msg)
+			now = now.Add(30 * time.Second)
+
+			c.Expect(render(), gs.Equals, "# TYPE messages_total counter\n"+
+				"messages_total{host=\"new.host\"} 1\n")
+		})
+	})
+}
@@ -0,0 +1,279 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pubsub
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/mozilla-services/heka/message"
+	. "github.com/mozilla-services/heka/pipeline"
+	"github.com/mozilla-services/heka/plugins"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// API limits for a single publish request.
+	maxMessagesPerRequest = 1000
+	maxRequestBytes       = 10 * 1024 * 1024
+	// Limit on the number of attributes of a single message.
+	maxAttributes = 100
+)
+
+// Output plugin that publishes messages to a Google Cloud Pub/Sub topic.
+type GooglePubSubOutput struct {
+	*GooglePubSubOutputConfig
+	client              *http.Client
+	tokens              *tokenSource
+	publishUrl          string
+	processMessageCount int64
+	dropMessageCount    int64
+	reportLock          sync.Mutex
+	batcher             *Batcher
+	or                  OutputRunner
+}
+
+// ConfigStruct for GooglePubSubOutput plugin.
+type GooglePubSubOutputConfig struct {
+	// Project and topic the messages are published to.
+	Project string
+	Topic   string
+	// Service account JSON key file. If empty, access tokens are fetched
+	// from the GCE metadata server.
+	CredentialsFile string `toml:"credentials_file"`
+	// Dynamic message fields sent as message attributes.
+	AttributeFields []string `toml:"attribute_fields"`
+	// Template for the ordering key, may contain `%{<name>}` placeholders.
+	// The topic's subscriptions must have message ordering enabled.
+	OrderingKey string `toml:"ordering_key"`
+	// Batching settings, from the `batch` subsection.
+	Batch BatchConfig `toml:"batch"`
+	// HTTP request timeout, in milliseconds. 0 means no timeout.
+	HttpTimeout uint32 `toml:"http_timeout"`
+	// API endpoint override.
+	Endpoint string
+}
+
+// A published message, also used as the batched record. Data is base64
+// encoded by the JSON encoding of []byte, as the API requires.
+type pubsubMessage struct {
+	Data        []byte            `json:"data"`
+	Attributes  map[string]string `json:"attributes,omitempty"`
+	OrderingKey string            `json:"orderingKey,omitempty"`
+}
+
+type publishRequest struct {
+	Messages []json.RawMessage `json:"messages"`
+}
+
+type publishResponse struct {
+	MessageIds []string `json:"messageIds"`
+}
+
+func (o *GooglePubSubOutput) ConfigStruct() interface{} {
+	return &GooglePubSubOutputConfig{
+		HttpTimeout: 10000,
+		Endpoint:    "https://pubsub.googleapis.com",
+		Batch:       DefaultBatchConfig(),
+	}
+}
+
+func (o *GooglePubSubOutput) Init(config interface{}) (err error) {
+	o.GooglePubSubOutputConfig = config.(*GooglePubSubOutputConfig)
+
+	if o.Project == "" || o.Topic == "" {
+		return errors.New("`project` and `topic` must be set")
+	}
+	if o.Batch.FlushCount < 1 || o.Batch.FlushCount > maxMessagesPerRequest {
+		return fmt.Errorf("`batch` `flush_count` must be between 1 and %d", maxMessagesPerRequest)
+	}
+	if len(o.AttributeFields) > maxAttributes {
+		return fmt.Errorf("at most %d `attribute_fields` are allowed", maxAttributes)
+	}
+	o.publishUrl = fmt.Sprintf("%s/v1/projects/%s/topics/%s:publish",
+		strings.TrimRight(o.Endpoint, "/"), o.Project, o.Topic)
+
+	o.client = new(http.Client)
+	if o.HttpTimeout > 0 {
+		o.client.Timeout = time.Duration(o.HttpTimeout) * time.Millisecond
+	}
+	if o.tokens, err = newTokenSource(o.CredentialsFile, o.client); err != nil {
+		return fmt.Errorf("can't load credentials: %s", err)
+	}
+	err = o.Batch.Validate()
+	return
+}
+
+// Generates the published message for a message and its encoded contents.
+func (o *GooglePubSubOutput) makeMessage(msg *message.Message, contents []byte) (
+	[]byte, error) {
+
+	pm := &pubsubMessage{Data: contents}
+	for _, name := range o.AttributeFields {
+		if val, ok := msg.GetFieldValue(name); ok {
+			if pm.Attributes == nil {
+				pm.Attributes = make(map[string]string)
+			}
+			if b, ok := val.([]byte); ok {
+				pm.Attributes[name] = string(b)
+			} else {
+				pm.Attributes[name] = fmt.Sprintf("%v", val)
+			}
+		}
+	}
+	if o.OrderingKey != "" {
+		pm.OrderingKey = plugins.InterpolateMessageString(o.OrderingKey, msg)
+	}
+	record, err := json.Marshal(pm)
+	if err == nil && len(record) > maxRequestBytes {
+		err = fmt.Errorf("encoded message too large: %d bytes", len(contents))
+	}
+	return record, err
+}
+
+// Makes a publish request. Throttling, server errors, and rejected tokens
+// are returned so the batch is retried. Other failures are logged and the
+// messages dropped.
+func (o *GooglePubSubOutput) publish(messages []json.RawMessage) error {
+	body, err := json.Marshal(&publishRequest{messages})
+	if err != nil {
+		return err
+	}
+	token, err := o.tokens.Token()
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", o.publishUrl, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("can't create HTTP request: %s", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("error making HTTP request: %s", err)
+	}
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("can't read response: %s", err)
+	}
+
+	if resp.StatusCode >= 300 {
+		err = fmt.Errorf("publish failed: %d - %s", resp.StatusCode,
+			strings.TrimSpace(string(respBody)))
+		switch {
+		case resp.StatusCode == http.StatusUnauthorized:
+			o.tokens.Invalidate()
+			return err
+		case resp.StatusCode == 429 || resp.StatusCode >= 500:
+			return err
+		}
+		o.or.LogError(err)
+		atomic.AddInt64(&o.dropMessageCount, int64(len(messages)))
+		return nil
+	}
+	result := new(publishResponse)
+	if err = json.Unmarshal(respBody, result); err != nil {
+		return fmt.Errorf("can't decode response: %s", err)
+	}
+	atomic.AddInt64(&o.processMessageCount, int64(len(messages)))
+	return nil
+}
+
+// Satisfies `pipeline.BatchFlushFunc`, splitting the batch into requests
+// that stay under the API's size limit.
+func (o *GooglePubSubOutput) flush(records [][]byte) error {
+	var (
+		messages []json.RawMessage
+		size     int
+	)
+	for _, record := range records {
+		if len(messages) > 0 && size+len(record) > maxRequestBytes {
+			if err := o.publish(messages); err != nil {
+				return err
+			}
+			messages, size = nil, 0
+		}
+		messages = append(messages, json.RawMessage(record))
+		size += len(record) + 1
+	}
+	if len(messages) > 0 {
+		return o.publish(messages)
+	}
+	return nil
+}
+
+func (o *GooglePubSubOutput) Run(or OutputRunner, h PluginHelper) (err error) {
+	if or.Encoder() == nil {
+		return errors.New("Encoder required.")
+	}
+	o.or = or
+	if o.batcher, err = NewOutputBatcher(o.Batch, o.flush, or, h); err != nil {
+		return
+	}
+	o.batcher.Start()
+
+	var (
+		outgoing, record []byte
+		e                error
+	)
+	for pack := range or.InChan() {
+		if outgoing, e = or.Encode(pack); e == nil && outgoing != nil {
+			record, e = o.makeMessage(pack.Message, outgoing)
+		}
+		pack.Recycle()
+		if e != nil {
+			or.LogError(e)
+			atomic.AddInt64(&o.dropMessageCount, 1)
+			continue
+		}
+		if outgoing == nil {
+			continue
+		}
+		o.batcher.Add(record)
+	}
+	o.batcher.Stop()
+	return
+}
+
+// Satisfies the `pipeline.ReportingPlugin` interface to provide plugin state
+// information to the Heka report and dashboard.
+func (o *GooglePubSubOutput) ReportMsg(msg *message.Message) error {
+	o.reportLock.Lock()
+	defer o.reportLock.Unlock()
+
+	message.NewInt64Field(msg, "ProcessMessageCount",
+		atomic.LoadInt64(&o.processMessageCount), "count")
+	message.NewInt64Field(msg, "DropMessageCount",
+		atomic.LoadInt64(&o.dropMessageCount), "count")
+	if o.batcher != nil {
+		o.batcher.ReportMsg(msg)
+	}
+	return nil
+}
+
+func init() {
+	RegisterPlugin("GooglePubSubOutput", func() interface{} {
+		return new(GooglePubSubOutput)
+	})
+}
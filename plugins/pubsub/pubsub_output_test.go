@@ -0,0 +1,185 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pubsub
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"github.com/mozilla-services/heka/message"
+	pipeline_ts "github.com/mozilla-services/heka/pipeline/testsupport"
+	plugins_ts "github.com/mozilla-services/heka/plugins/testsupport"
+	"github.com/rafrombrc/gomock/gomock"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+func decodeBase64Url(s string) []byte {
+	if m := len(s) % 4; m != 0 {
+		s += strings.Repeat("=", 4-m)
+	}
+	b, _ := base64.URLEncoding.DecodeString(s)
+	return b
+}
+
+func GooglePubSubOutputSpec(c gs.Context) {
+	t := new(pipeline_ts.SimpleT)
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	tmpDir, err := ioutil.TempDir("", "pubsub-tests")
+	c.Assume(err, gs.IsNil)
+	defer os.RemoveAll(tmpDir)
+
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	c.Assume(err, gs.IsNil)
+
+	var (
+		tokenRequests int
+		assertion     string
+		published     publishRequest
+		status        = http.StatusOK
+		auth          string
+	)
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/token" {
+				tokenRequests++
+				r.ParseForm()
+				assertion = r.PostForm.Get("assertion")
+				w.Write([]byte(`{"access_token": "abc", "expires_in": 3600}`))
+				return
+			}
+			auth = r.Header.Get("Authorization")
+			body, _ := ioutil.ReadAll(r.Body)
+			json.Unmarshal(body, &published)
+			w.WriteHeader(status)
+			w.Write([]byte(`{"messageIds": ["1"]}`))
+		}))
+	defer server.Close()
+
+	keyBytes, _ := json.Marshal(&serviceAccountKey{
+		ClientEmail: "heka@project.iam.gserviceaccount.com",
+		PrivateKey: string(pem.EncodeToMemory(&pem.Block{
+			Type:  "RSA PRIVATE KEY",
+			Bytes: x509.MarshalPKCS1PrivateKey(key),
+		})),
+		TokenUri: server.URL + "/token",
+	})
+	keyFile := filepath.Join(tmpDir, "key.json")
+	ioutil.WriteFile(keyFile, keyBytes, 0600)
+
+	output := new(GooglePubSubOutput)
+	config := output.ConfigStruct().(*GooglePubSubOutputConfig)
+	config.Project = "project"
+	config.Topic = "heka"
+	config.CredentialsFile = keyFile
+	config.Endpoint = server.URL
+
+	msg := pipeline_ts.GetTestMessage()
+	field, _ := message.NewField("count", int64(3), "")
+	msg.AddField(field)
+
+	c.Specify("A GooglePubSubOutput", func() {
+		c.Specify("requires a topic", func() {
+			config.Topic = ""
+			err := output.Init(config)
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+
+		c.Specify("generates messages", func() {
+			config.AttributeFields = []string{"foo", "count", "missing"}
+			config.OrderingKey = "%{Hostname}"
+			err := output.Init(config)
+			c.Assume(err, gs.IsNil)
+			record, err := output.makeMessage(msg, []byte{0xff, 'h', 'i'})
+			c.Assume(err, gs.IsNil)
+
+			pm := new(pubsubMessage)
+			json.Unmarshal(record, pm)
+			c.Expect(string(pm.Data), gs.Equals, "\xffhi")
+			c.Expect(len(pm.Attributes), gs.Equals, 2)
+			c.Expect(pm.Attributes["foo"], gs.Equals, "bar")
+			c.Expect(pm.Attributes["count"], gs.Equals, "3")
+			c.Expect(pm.OrderingKey, gs.Equals, "my.host.name")
+		})
+
+		c.Specify("publishes batches", func() {
+			err := output.Init(config)
+			c.Assume(err, gs.IsNil)
+			oth := plugins_ts.NewOutputTestHelper(ctrl)
+			output.or = oth.MockOutputRunner
+			record, _ := output.makeMessage(msg, []byte("hello"))
+
+			c.Specify("w/ a token from the service account", func() {
+				err = output.flush([][]byte{record, record})
+				c.Expect(err, gs.IsNil)
+				c.Expect(len(published.Messages), gs.Equals, 2)
+				c.Expect(auth, gs.Equals, "Bearer abc")
+				c.Expect(output.processMessageCount, gs.Equals, int64(2))
+
+				parts := strings.Split(assertion, ".")
+				c.Assume(len(parts), gs.Equals, 3)
+				claims := make(map[string]interface{})
+				json.Unmarshal(decodeBase64Url(parts[1]), &claims)
+				c.Expect(claims["iss"], gs.Equals, "heka@project.iam.gserviceaccount.com")
+				c.Expect(claims["aud"], gs.Equals, server.URL+"/token")
+				hashed := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+				err = rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, hashed[:],
+					decodeBase64Url(parts[2]))
+				c.Expect(err, gs.IsNil)
+
+				// The token is cached.
+				err = output.flush([][]byte{record})
+				c.Expect(err, gs.IsNil)
+				c.Expect(tokenRequests, gs.Equals, 1)
+			})
+
+			c.Specify("and fetches a new token when it's rejected", func() {
+				status = http.StatusUnauthorized
+				err = output.flush([][]byte{record})
+				c.Expect(err, gs.Not(gs.IsNil))
+				status = http.StatusOK
+				err = output.flush([][]byte{record})
+				c.Expect(err, gs.IsNil)
+				c.Expect(tokenRequests, gs.Equals, 2)
+			})
+
+			c.Specify("and asks for a retry when throttled", func() {
+				status = 429
+				err = output.flush([][]byte{record})
+				c.Expect(err, gs.Not(gs.IsNil))
+			})
+
+			c.Specify("and drops batches the API rejects", func() {
+				status = http.StatusNotFound
+				oth.MockOutputRunner.EXPECT().LogError(gomock.Any())
+				err = output.flush([][]byte{record})
+				c.Expect(err, gs.IsNil)
+				c.Expect(output.dropMessageCount, gs.Equals, int64(1))
+			})
+		})
+	})
+}
@@ -0,0 +1,191 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pubsub
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	metadataTokenUrl = "http://metadata.google.internal/computeMetadata/v1/" +
+		"instance/service-accounts/default/token"
+	defaultTokenUrl = "https://oauth2.googleapis.com/token"
+	pubsubScope     = "https://www.googleapis.com/auth/pubsub"
+	// Tokens are refreshed this long before they expire.
+	tokenExpiryMargin = time.Minute
+)
+
+// Relevant parts of a service account JSON key file.
+type serviceAccountKey struct {
+	ClientEmail string `json:"client_email"`
+	PrivateKey  string `json:"private_key"`
+	TokenUri    string `json:"token_uri"`
+}
+
+type tokenResponse struct {
+	AccessToken string `json:"access_token"`
+	ExpiresIn   int64  `json:"expires_in"`
+}
+
+// Fetches and caches OAuth2 access tokens, either by signing a JWT w/ a
+// service account key or from the GCE metadata server.
+type tokenSource struct {
+	client   *http.Client
+	email    string
+	key      *rsa.PrivateKey
+	tokenUrl string
+	now      func() time.Time
+	lock     sync.Mutex
+	token    string
+	expiry   time.Time
+}
+
+// Creates a token source from a service account key file, or one using the
+// metadata server if no file is given.
+func newTokenSource(keyFile string, client *http.Client) (*tokenSource, error) {
+	ts := &tokenSource{client: client, tokenUrl: metadataTokenUrl, now: time.Now}
+	if keyFile == "" {
+		return ts, nil
+	}
+	data, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	saKey := new(serviceAccountKey)
+	if err = json.Unmarshal(data, saKey); err != nil {
+		return nil, fmt.Errorf("can't parse key file: %s", err)
+	}
+	if saKey.ClientEmail == "" {
+		return nil, errors.New("key file has no client_email")
+	}
+	block, _ := pem.Decode([]byte(saKey.PrivateKey))
+	if block == nil {
+		return nil, errors.New("key file has no PEM encoded private_key")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		if key, err = x509.ParsePKCS1PrivateKey(block.Bytes); err != nil {
+			return nil, fmt.Errorf("can't parse private key: %s", err)
+		}
+	}
+	var ok bool
+	if ts.key, ok = key.(*rsa.PrivateKey); !ok {
+		return nil, errors.New("private key isn't an RSA key")
+	}
+	ts.email = saKey.ClientEmail
+	ts.tokenUrl = saKey.TokenUri
+	if ts.tokenUrl == "" {
+		ts.tokenUrl = defaultTokenUrl
+	}
+	return ts, nil
+}
+
+func base64Url(data []byte) string {
+	return strings.TrimRight(base64.URLEncoding.EncodeToString(data), "=")
+}
+
+// Generates the signed JWT exchanged for an access token.
+func (ts *tokenSource) assertion(now time.Time) (string, error) {
+	header := base64Url([]byte(`{"alg":"RS256","typ":"JWT"}`))
+	claims, err := json.Marshal(map[string]interface{}{
+		"iss":   ts.email,
+		"scope": pubsubScope,
+		"aud":   ts.tokenUrl,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+	unsigned := header + "." + base64Url(claims)
+	hashed := sha256.Sum256([]byte(unsigned))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, ts.key, crypto.SHA256, hashed[:])
+	if err != nil {
+		return "", err
+	}
+	return unsigned + "." + base64Url(sig), nil
+}
+
+func (ts *tokenSource) fetch(now time.Time) (*http.Response, error) {
+	if ts.key == nil {
+		req, err := http.NewRequest("GET", ts.tokenUrl, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Metadata-Flavor", "Google")
+		return ts.client.Do(req)
+	}
+	jwt, err := ts.assertion(now)
+	if err != nil {
+		return nil, fmt.Errorf("can't sign token request: %s", err)
+	}
+	return ts.client.PostForm(ts.tokenUrl, url.Values{
+		"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+		"assertion":  {jwt},
+	})
+}
+
+// Returns a valid access token, fetching a new one if needed.
+func (ts *tokenSource) Token() (string, error) {
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+
+	now := ts.now()
+	if ts.token != "" && now.Before(ts.expiry) {
+		return ts.token, nil
+	}
+	resp, err := ts.fetch(now)
+	if err != nil {
+		return "", fmt.Errorf("can't fetch access token: %s", err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("can't read token response: %s", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("can't fetch access token: %d - %s", resp.StatusCode,
+			strings.TrimSpace(string(body)))
+	}
+	token := new(tokenResponse)
+	if err = json.Unmarshal(body, token); err != nil || token.AccessToken == "" {
+		return "", errors.New("invalid token response")
+	}
+	ts.token = token.AccessToken
+	ts.expiry = now.Add(time.Duration(token.ExpiresIn)*time.Second - tokenExpiryMargin)
+	return ts.token, nil
+}
+
+// Discards the cached token, e.g. after it's been rejected.
+func (ts *tokenSource) Invalidate() {
+	ts.lock.Lock()
+	ts.token = ""
+	ts.lock.Unlock()
+}
@@ -0,0 +1,272 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package redis
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"github.com/mozilla-services/heka/message"
+	. "github.com/mozilla-services/heka/pipeline"
+	"github.com/mozilla-services/heka/plugins"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Output plugin that pushes encoded messages onto Redis lists, or publishes
+// them to Redis channels.
+type RedisOutput struct {
+	*RedisOutputConfig
+	conn                net.Conn
+	reader              *bufio.Reader
+	command             []byte
+	batch               []byte
+	batchCount          int
+	trimKeys            map[string]bool
+	processMessageCount int64
+	dropMessageCount    int64
+	reportLock          sync.Mutex
+}
+
+// ConfigStruct for RedisOutput plugin.
+type RedisOutputConfig struct {
+	// Address of the Redis server.
+	Address string
+	// Database number to select.
+	Database int
+	// Password for Redis AUTH.
+	Password string
+	// Either "list", which pushes the messages onto a list w/ LPUSH, or
+	// "publish", which publishes them to a channel.
+	Mode string
+	// List key or channel name, may contain `%{<name>}` placeholders.
+	Key string
+	// If greater than 0, lists are trimmed to this many of the most recent
+	// messages after each write.
+	MaxListLength int `toml:"max_list_length"`
+	// Number of messages that will be sent in a single pipelined write.
+	FlushCount int `toml:"flush_count"`
+	// Interval at which accumulated messages will be written, in
+	// milliseconds.
+	FlushInterval uint32 `toml:"flush_interval"`
+	// Connection and I/O timeout, in milliseconds.
+	Timeout uint32
+}
+
+func (o *RedisOutput) ConfigStruct() interface{} {
+	return &RedisOutputConfig{
+		Address:       "localhost:6379",
+		Mode:          "list",
+		Key:           "heka",
+		FlushCount:    100,
+		FlushInterval: 100,
+		Timeout:       5000,
+	}
+}
+
+func (o *RedisOutput) Init(config interface{}) (err error) {
+	o.RedisOutputConfig = config.(*RedisOutputConfig)
+
+	switch o.Mode {
+	case "list":
+		o.command = []byte("LPUSH")
+	case "publish":
+		o.command = []byte("PUBLISH")
+		if o.MaxListLength > 0 {
+			return errors.New("`max_list_length` can only be used in list mode")
+		}
+	default:
+		return fmt.Errorf("`mode` must be 'list' or 'publish', got %s", o.Mode)
+	}
+	if o.Key == "" {
+		return errors.New("`key` must not be empty")
+	}
+	if o.FlushCount < 1 {
+		return errors.New("`flush_count` must be at least 1")
+	}
+	o.trimKeys = make(map[string]bool)
+	return
+}
+
+// Adds a command for the encoded message to the current batch.
+func (o *RedisOutput) queue(msg *message.Message, data []byte) {
+	key := plugins.InterpolateMessageString(o.Key, msg)
+	o.batch = appendCommand(o.batch, o.command, []byte(key), data)
+	o.batchCount++
+	if o.MaxListLength > 0 {
+		o.trimKeys[key] = true
+	}
+}
+
+// Connects to the server, authenticating and selecting the database as
+// needed.
+func (o *RedisOutput) connect() (err error) {
+	timeout := time.Duration(o.Timeout) * time.Millisecond
+	if o.conn, err = net.DialTimeout("tcp", o.Address, timeout); err != nil {
+		o.conn = nil
+		return fmt.Errorf("can't connect to %s: %s", o.Address, err)
+	}
+	o.reader = bufio.NewReader(o.conn)
+
+	var setup []byte
+	count := 0
+	if o.Password != "" {
+		setup = appendCommand(setup, []byte("AUTH"), []byte(o.Password))
+		count++
+	}
+	if o.Database != 0 {
+		setup = appendCommand(setup, []byte("SELECT"),
+			[]byte(strconv.Itoa(o.Database)))
+		count++
+	}
+	if count > 0 {
+		if err = o.roundTrip(setup, count); err != nil {
+			o.disconnect()
+		}
+	}
+	return
+}
+
+func (o *RedisOutput) disconnect() {
+	if o.conn != nil {
+		o.conn.Close()
+		o.conn = nil
+	}
+}
+
+// Writes the pipelined commands and reads the expected number of replies,
+// returning the first error reply, if any.
+func (o *RedisOutput) roundTrip(commands []byte, count int) (err error) {
+	if o.Timeout > 0 {
+		o.conn.SetDeadline(time.Now().Add(time.Duration(o.Timeout) * time.Millisecond))
+	}
+	if _, err = o.conn.Write(commands); err != nil {
+		o.disconnect()
+		return fmt.Errorf("writing to %s: %s", o.Address, err)
+	}
+	var replyErr error
+	for i := 0; i < count; i++ {
+		reply, err := readReply(o.reader)
+		if err != nil {
+			o.disconnect()
+			return fmt.Errorf("reading from %s: %s", o.Address, err)
+		}
+		if e, ok := reply.(redisError); ok && replyErr == nil {
+			replyErr = e
+		}
+	}
+	return replyErr
+}
+
+// Sends the current batch, followed by any needed LTRIM commands.
+func (o *RedisOutput) flush() (err error) {
+	if o.batchCount == 0 {
+		return
+	}
+	count := o.batchCount
+	limit := []byte(strconv.Itoa(o.MaxListLength - 1))
+	for key := range o.trimKeys {
+		o.batch = appendCommand(o.batch, []byte("LTRIM"), []byte(key),
+			[]byte("0"), limit)
+		count++
+		delete(o.trimKeys, key)
+	}
+	defer func() {
+		o.batch = o.batch[:0]
+		o.batchCount = 0
+	}()
+	if o.conn == nil {
+		if err = o.connect(); err != nil {
+			return
+		}
+	}
+	return o.roundTrip(o.batch, count)
+}
+
+func (o *RedisOutput) Run(or OutputRunner, h PluginHelper) (err error) {
+	var (
+		ok       = true
+		pack     *PipelinePack
+		outBytes []byte
+		e        error
+		inChan   = or.InChan()
+		tick     <-chan time.Time
+	)
+
+	if or.Encoder() == nil {
+		return errors.New("Encoder required.")
+	}
+	if o.FlushInterval > 0 {
+		ticker := time.NewTicker(time.Duration(o.FlushInterval) * time.Millisecond)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	defer o.disconnect()
+
+	flush := func() {
+		count := int64(o.batchCount)
+		if e := o.flush(); e != nil {
+			or.LogError(e)
+			atomic.AddInt64(&o.dropMessageCount, count)
+		} else {
+			atomic.AddInt64(&o.processMessageCount, count)
+		}
+	}
+
+	for ok {
+		select {
+		case pack, ok = <-inChan:
+			if !ok {
+				flush()
+				break
+			}
+			if outBytes, e = or.Encode(pack); e != nil {
+				or.LogError(e)
+				atomic.AddInt64(&o.dropMessageCount, 1)
+			} else if outBytes != nil {
+				o.queue(pack.Message, outBytes)
+			}
+			pack.Recycle()
+			if o.batchCount >= o.FlushCount {
+				flush()
+			}
+		case <-tick:
+			flush()
+		}
+	}
+	return
+}
+
+// Satisfies the `pipeline.ReportingPlugin` interface to provide plugin state
+// information to the Heka report and dashboard.
+func (o *RedisOutput) ReportMsg(msg *message.Message) error {
+	o.reportLock.Lock()
+	defer o.reportLock.Unlock()
+
+	message.NewInt64Field(msg, "ProcessMessageCount",
+		atomic.LoadInt64(&o.processMessageCount), "count")
+	message.NewInt64Field(msg, "DropMessageCount",
+		atomic.LoadInt64(&o.dropMessageCount), "count")
+	return nil
+}
+
+func init() {
+	RegisterPlugin("RedisOutput", func() interface{} {
+		return new(RedisOutput)
+	})
+}
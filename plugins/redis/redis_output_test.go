@@ -0,0 +1,137 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package redis
+
+import (
+	"bufio"
+	"bytes"
+	pipeline_ts "github.com/mozilla-services/heka/pipeline/testsupport"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+	"net"
+	"strings"
+)
+
+// Fake Redis server that records the commands it receives, replying w/ an
+// error to any command listed in `fail`.
+func fakeRedis(listener net.Listener, commands chan<- string, fail string) {
+	conn, err := listener.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		reply, err := readReply(r)
+		if err != nil {
+			close(commands)
+			return
+		}
+		var args []string
+		for _, arg := range reply.([]interface{}) {
+			args = append(args, string(arg.([]byte)))
+		}
+		if args[0] == fail {
+			conn.Write([]byte("-ERR failed\r\n"))
+		} else {
+			conn.Write([]byte(":1\r\n"))
+		}
+		commands <- strings.Join(args, " ")
+	}
+}
+
+func RedisOutputSpec(c gs.Context) {
+	output := new(RedisOutput)
+	config := output.ConfigStruct().(*RedisOutputConfig)
+	msg := pipeline_ts.GetTestMessage()
+
+	c.Specify("RESP encoding", func() {
+		cmd := appendCommand(nil, []byte("LPUSH"), []byte("heka"), []byte("a\r\nb"))
+		c.Expect(string(cmd), gs.Equals,
+			"*3\r\n$5\r\nLPUSH\r\n$4\r\nheka\r\n$4\r\na\r\nb\r\n")
+
+		reply, err := readReply(bufio.NewReader(bytes.NewReader(cmd)))
+		c.Expect(err, gs.IsNil)
+		items := reply.([]interface{})
+		c.Expect(len(items), gs.Equals, 3)
+		c.Expect(string(items[2].([]byte)), gs.Equals, "a\r\nb")
+
+		reply, err = readReply(bufio.NewReader(strings.NewReader("-ERR wrong\r\n")))
+		c.Expect(err, gs.IsNil)
+		c.Expect(reply.(redisError).Error(), gs.Equals, "ERR wrong")
+	})
+
+	c.Specify("A RedisOutput", func() {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		c.Assume(err, gs.IsNil)
+		defer listener.Close()
+		config.Address = listener.Addr().String()
+		commands := make(chan string, 10)
+
+		c.Specify("pipelines list pushes and trims the list", func() {
+			config.Key = "heka:%{Type}"
+			config.MaxListLength = 100
+			config.Password = "secret"
+			err = output.Init(config)
+			c.Assume(err, gs.IsNil)
+			go fakeRedis(listener, commands, "")
+
+			output.queue(msg, []byte("one"))
+			output.queue(msg, []byte("two"))
+			err = output.flush()
+			c.Expect(err, gs.IsNil)
+			output.disconnect()
+
+			c.Expect(<-commands, gs.Equals, "AUTH secret")
+			c.Expect(<-commands, gs.Equals, "LPUSH heka:TEST one")
+			c.Expect(<-commands, gs.Equals, "LPUSH heka:TEST two")
+			c.Expect(<-commands, gs.Equals, "LTRIM heka:TEST 0 99")
+			c.Expect(output.batchCount, gs.Equals, 0)
+		})
+
+		c.Specify("publishes to a channel", func() {
+			config.Mode = "publish"
+			config.Database = 2
+			err = output.Init(config)
+			c.Assume(err, gs.IsNil)
+			go fakeRedis(listener, commands, "")
+
+			output.queue(msg, []byte("one"))
+			err = output.flush()
+			c.Expect(err, gs.IsNil)
+			output.disconnect()
+
+			c.Expect(<-commands, gs.Equals, "SELECT 2")
+			c.Expect(<-commands, gs.Equals, "PUBLISH heka one")
+		})
+
+		c.Specify("returns error replies", func() {
+			err = output.Init(config)
+			c.Assume(err, gs.IsNil)
+			go fakeRedis(listener, commands, "LPUSH")
+
+			output.queue(msg, []byte("one"))
+			err = output.flush()
+			c.Expect(err, gs.Not(gs.IsNil))
+			output.disconnect()
+		})
+
+		c.Specify("can't trim in publish mode", func() {
+			config.Mode = "publish"
+			config.MaxListLength = 10
+			err = output.Init(config)
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+	})
+}
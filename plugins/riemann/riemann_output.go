@@ -0,0 +1,314 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package riemann
+
+import (
+	proto "code.google.com/p/gogoprotobuf/proto"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/mozilla-services/heka/message"
+	. "github.com/mozilla-services/heka/pipeline"
+	"github.com/mozilla-services/heka/plugins"
+	"github.com/mozilla-services/heka/plugins/tcp"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Largest response we'll accept, Riemann only sends back an ok or an error.
+const maxResponseSize = 1 << 20
+
+// Output plugin that sends messages to Riemann as events.
+type RiemannOutput struct {
+	*RiemannOutputConfig
+	tlsConfig           *tls.Config
+	conn                net.Conn
+	processMessageCount int64
+	dropMessageCount    int64
+	reportLock          sync.Mutex
+	batcher             *Batcher
+	or                  OutputRunner
+}
+
+// ConfigStruct for RiemannOutput plugin.
+type RiemannOutputConfig struct {
+	// Address of the Riemann server's TCP listener.
+	Address string
+	// Event templates, may contain `%{<name>}` placeholders. An empty state
+	// is derived from the message severity.
+	Host        string
+	Service     string
+	State       string
+	Description string
+	// Name of the message field containing the event's metric.
+	MetricField string `toml:"metric_field"`
+	// Event time to live, in seconds. 0 uses the server's default.
+	Ttl float32
+	// Name of the message field holding the time to live, overriding `ttl`.
+	TtlField string `toml:"ttl_field"`
+	// Tags added to every event.
+	Tags []string
+	// Dynamic message fields sent as event attributes.
+	AttributeFields []string `toml:"attribute_fields"`
+	// Timeout for connecting and for each request, in milliseconds.
+	Timeout uint32
+	// Batching settings, from the `batch` subsection.
+	Batch  BatchConfig `toml:"batch"`
+	UseTls bool        `toml:"use_tls"`
+	Tls    tcp.TlsConfig
+}
+
+func (o *RiemannOutput) ConfigStruct() interface{} {
+	return &RiemannOutputConfig{
+		Address:     "localhost:5555",
+		Host:        "%{Hostname}",
+		Service:     "%{Type}",
+		Description: "%{Payload}",
+		MetricField: "metric",
+		TtlField:    "ttl",
+		Timeout:     5000,
+		Batch:       DefaultBatchConfig(),
+	}
+}
+
+func (o *RiemannOutput) Init(config interface{}) (err error) {
+	o.RiemannOutputConfig = config.(*RiemannOutputConfig)
+
+	if _, _, err = net.SplitHostPort(o.Address); err != nil {
+		return fmt.Errorf("invalid address '%s': %s", o.Address, err)
+	}
+	if o.Service == "" {
+		return errors.New("`service` must not be empty")
+	}
+	if o.Ttl < 0 {
+		return errors.New("`ttl` must not be negative")
+	}
+	if o.UseTls {
+		if o.tlsConfig, err = tcp.CreateGoTlsConfig(&o.Tls); err != nil {
+			return fmt.Errorf("TLS init error: %s", err)
+		}
+	}
+	err = o.Batch.Validate()
+	return
+}
+
+// Returns the Riemann state for a message severity.
+func severityState(severity int32) string {
+	switch {
+	case severity <= 3:
+		return "critical"
+	case severity == 4:
+		return "warning"
+	}
+	return "ok"
+}
+
+// Returns a message field's value as a float64, if it's numeric.
+func numericField(msg *message.Message, name string) (float64, bool) {
+	if name == "" {
+		return 0, false
+	}
+	val, ok := msg.GetFieldValue(name)
+	if !ok {
+		return 0, false
+	}
+	switch v := val.(type) {
+	case int64:
+		return float64(v), true
+	case float64:
+		return v, true
+	}
+	return 0, false
+}
+
+// Generates the event for a message.
+func (o *RiemannOutput) makeEvent(msg *message.Message) *Event {
+	ts := msg.GetTimestamp()
+	event := &Event{
+		Time:       proto.Int64(ts / int64(time.Second)),
+		TimeMicros: proto.Int64(ts / int64(time.Microsecond)),
+		Service:    proto.String(plugins.InterpolateMessageString(o.Service, msg)),
+		Tags:       o.Tags,
+	}
+	if o.Host != "" {
+		event.Host = proto.String(plugins.InterpolateMessageString(o.Host, msg))
+	}
+	state := severityState(msg.GetSeverity())
+	if o.State != "" {
+		state = plugins.InterpolateMessageString(o.State, msg)
+	}
+	event.State = proto.String(state)
+	if o.Description != "" {
+		event.Description = proto.String(plugins.InterpolateMessageString(o.Description, msg))
+	}
+
+	// Integer metrics are sent as such so they don't lose precision.
+	if val, ok := msg.GetFieldValue(o.MetricField); ok {
+		switch v := val.(type) {
+		case int64:
+			event.MetricSint64 = proto.Int64(v)
+		case float64:
+			event.MetricD = proto.Float64(v)
+		}
+	}
+	if ttl, ok := numericField(msg, o.TtlField); ok {
+		event.Ttl = proto.Float32(float32(ttl))
+	} else if o.Ttl > 0 {
+		event.Ttl = proto.Float32(o.Ttl)
+	}
+	for _, name := range o.AttributeFields {
+		if val, ok := msg.GetFieldValue(name); ok {
+			event.Attributes = append(event.Attributes, &Attribute{
+				Key:   proto.String(name),
+				Value: proto.String(fmt.Sprintf("%v", val)),
+			})
+		}
+	}
+	return event
+}
+
+// Connects to the server if there's no connection yet.
+func (o *RiemannOutput) connect() (err error) {
+	if o.conn != nil {
+		return
+	}
+	dialer := &net.Dialer{Timeout: time.Duration(o.Timeout) * time.Millisecond}
+	if o.UseTls {
+		o.conn, err = tls.DialWithDialer(dialer, "tcp", o.Address, o.tlsConfig)
+	} else {
+		o.conn, err = dialer.Dial("tcp", o.Address)
+	}
+	if err != nil {
+		o.conn = nil
+		return fmt.Errorf("can't connect to %s: %s", o.Address, err)
+	}
+	return
+}
+
+func (o *RiemannOutput) disconnect() {
+	if o.conn != nil {
+		o.conn.Close()
+		o.conn = nil
+	}
+}
+
+// Sends a length prefixed message and reads the server's response.
+func (o *RiemannOutput) request(msgBytes []byte) (*Msg, error) {
+	if o.Timeout > 0 {
+		o.conn.SetDeadline(time.Now().Add(time.Duration(o.Timeout) * time.Millisecond))
+	}
+	frame := make([]byte, 4, 4+len(msgBytes))
+	binary.BigEndian.PutUint32(frame, uint32(len(msgBytes)))
+	if _, err := o.conn.Write(append(frame, msgBytes...)); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(o.conn, frame[:4]); err != nil {
+		return nil, err
+	}
+	size := binary.BigEndian.Uint32(frame[:4])
+	if size > maxResponseSize {
+		return nil, fmt.Errorf("response too large: %d bytes", size)
+	}
+	respBytes := make([]byte, size)
+	if _, err := io.ReadFull(o.conn, respBytes); err != nil {
+		return nil, err
+	}
+	resp := new(Msg)
+	if err := proto.Unmarshal(respBytes, resp); err != nil {
+		return nil, fmt.Errorf("can't decode response: %s", err)
+	}
+	return resp, nil
+}
+
+// Satisfies `pipeline.BatchFlushFunc`, sending a batch of protobuf encoded
+// events in a single message. Batches that fail due to connection problems
+// are retried, batches the server rejects are logged and dropped.
+func (o *RiemannOutput) flush(records [][]byte) error {
+	// A message's repeated events field is the events' encodings, each
+	// prefixed w/ the field key and its length.
+	buf := proto.NewBuffer(nil)
+	for _, record := range records {
+		buf.EncodeVarint(uint64(6<<3 | proto.WireBytes))
+		buf.EncodeRawBytes(record)
+	}
+
+	if err := o.connect(); err != nil {
+		return err
+	}
+	resp, err := o.request(buf.Bytes())
+	if err != nil {
+		o.disconnect()
+		return fmt.Errorf("request to %s failed: %s", o.Address, err)
+	}
+	if !resp.GetOk() {
+		o.or.LogError(fmt.Errorf("Riemann rejected events: %s", resp.GetError()))
+		atomic.AddInt64(&o.dropMessageCount, int64(len(records)))
+		return nil
+	}
+	atomic.AddInt64(&o.processMessageCount, int64(len(records)))
+	return nil
+}
+
+func (o *RiemannOutput) Run(or OutputRunner, h PluginHelper) (err error) {
+	o.or = or
+	if o.batcher, err = NewOutputBatcher(o.Batch, o.flush, or, h); err != nil {
+		return
+	}
+	o.batcher.Start()
+
+	var (
+		record []byte
+		e      error
+	)
+	for pack := range or.InChan() {
+		record, e = proto.Marshal(o.makeEvent(pack.Message))
+		pack.Recycle()
+		if e != nil {
+			or.LogError(e)
+			atomic.AddInt64(&o.dropMessageCount, 1)
+			continue
+		}
+		o.batcher.Add(record)
+	}
+	o.batcher.Stop()
+	o.disconnect()
+	return
+}
+
+// Satisfies the `pipeline.ReportingPlugin` interface to provide plugin state
+// information to the Heka report and dashboard.
+func (o *RiemannOutput) ReportMsg(msg *message.Message) error {
+	o.reportLock.Lock()
+	defer o.reportLock.Unlock()
+
+	message.NewInt64Field(msg, "ProcessMessageCount",
+		atomic.LoadInt64(&o.processMessageCount), "count")
+	message.NewInt64Field(msg, "DropMessageCount",
+		atomic.LoadInt64(&o.dropMessageCount), "count")
+	if o.batcher != nil {
+		o.batcher.ReportMsg(msg)
+	}
+	return nil
+}
+
+func init() {
+	RegisterPlugin("RiemannOutput", func() interface{} {
+		return new(RiemannOutput)
+	})
+}
@@ -0,0 +1,167 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package riemann
+
+import (
+	proto "code.google.com/p/gogoprotobuf/proto"
+	"encoding/binary"
+	"github.com/mozilla-services/heka/message"
+	pipeline_ts "github.com/mozilla-services/heka/pipeline/testsupport"
+	plugins_ts "github.com/mozilla-services/heka/plugins/testsupport"
+	"github.com/rafrombrc/gomock/gomock"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+	"io"
+	"net"
+)
+
+// Fake Riemann server, answering each request w/ the response and passing
+// the received messages on.
+func fakeServer(listener net.Listener, resp *Msg, received chan *Msg) {
+	respBytes, _ := proto.Marshal(resp)
+	frame := make([]byte, 4)
+	binary.BigEndian.PutUint32(frame, uint32(len(respBytes)))
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go func(conn net.Conn) {
+			defer conn.Close()
+			for {
+				size := make([]byte, 4)
+				if _, err := io.ReadFull(conn, size); err != nil {
+					return
+				}
+				msgBytes := make([]byte, binary.BigEndian.Uint32(size))
+				if _, err := io.ReadFull(conn, msgBytes); err != nil {
+					return
+				}
+				msg := new(Msg)
+				proto.Unmarshal(msgBytes, msg)
+				received <- msg
+				conn.Write(append(frame, respBytes...))
+			}
+		}(conn)
+	}
+}
+
+func RiemannOutputSpec(c gs.Context) {
+	t := new(pipeline_ts.SimpleT)
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	output := new(RiemannOutput)
+	config := output.ConfigStruct().(*RiemannOutputConfig)
+
+	msg := pipeline_ts.GetTestMessage()
+	field, _ := message.NewField("metric", 0.25, "")
+	msg.AddField(field)
+	field, _ = message.NewField("ttl", int64(30), "")
+	msg.AddField(field)
+
+	c.Specify("A RiemannOutput", func() {
+		c.Specify("rejects an invalid address", func() {
+			config.Address = "localhost"
+			err := output.Init(config)
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+
+		c.Specify("converts messages to events", func() {
+			config.Service = "heka %{Logger}"
+			config.Tags = []string{"heka"}
+			config.AttributeFields = []string{"foo", "missing"}
+			err := output.Init(config)
+			c.Assume(err, gs.IsNil)
+			event := output.makeEvent(msg)
+			c.Expect(event.GetTime(), gs.Equals, int64(1136239445))
+			c.Expect(event.GetHost(), gs.Equals, "my.host.name")
+			c.Expect(event.GetService(), gs.Equals, "heka GoSpec")
+			c.Expect(event.GetState(), gs.Equals, "ok")
+			c.Expect(event.GetDescription(), gs.Equals, "Test Payload")
+			c.Expect(event.GetMetricD(), gs.Equals, 0.25)
+			c.Expect(event.MetricSint64 == nil, gs.IsTrue)
+			c.Expect(event.GetTtl(), gs.Equals, float32(30))
+			c.Expect(len(event.Tags), gs.Equals, 1)
+			c.Expect(len(event.Attributes), gs.Equals, 1)
+			c.Expect(event.Attributes[0].GetKey(), gs.Equals, "foo")
+			c.Expect(event.Attributes[0].GetValue(), gs.Equals, "bar")
+		})
+
+		c.Specify("derives the state from the severity", func() {
+			config.TtlField = ""
+			config.Ttl = 120
+			err := output.Init(config)
+			c.Assume(err, gs.IsNil)
+			msg.SetSeverity(3)
+			event := output.makeEvent(msg)
+			c.Expect(event.GetState(), gs.Equals, "critical")
+			c.Expect(event.GetTtl(), gs.Equals, float32(120))
+			msg.SetSeverity(4)
+			c.Expect(output.makeEvent(msg).GetState(), gs.Equals, "warning")
+
+			config.State = "%{foo}"
+			c.Expect(output.makeEvent(msg).GetState(), gs.Equals, "bar")
+		})
+
+		c.Specify("sends batches", func() {
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			c.Assume(err, gs.IsNil)
+			defer listener.Close()
+			resp := &Msg{Ok: proto.Bool(true)}
+			received := make(chan *Msg, 2)
+
+			config.Address = listener.Addr().String()
+			err = output.Init(config)
+			c.Assume(err, gs.IsNil)
+			record, _ := proto.Marshal(output.makeEvent(msg))
+
+			c.Specify("in a single message", func() {
+				go fakeServer(listener, resp, received)
+				err = output.flush([][]byte{record, record})
+				c.Expect(err, gs.IsNil)
+				sent := <-received
+				c.Expect(len(sent.Events), gs.Equals, 2)
+				c.Expect(sent.Events[1].GetService(), gs.Equals, "TEST")
+				c.Expect(output.processMessageCount, gs.Equals, int64(2))
+
+				err = output.flush([][]byte{record})
+				c.Expect(err, gs.IsNil)
+				<-received
+				c.Expect(output.processMessageCount, gs.Equals, int64(3))
+				output.disconnect()
+			})
+
+			c.Specify("and drops batches the server rejects", func() {
+				resp = &Msg{Ok: proto.Bool(false), Error: proto.String("bad")}
+				go fakeServer(listener, resp, received)
+				oth := plugins_ts.NewOutputTestHelper(ctrl)
+				oth.MockOutputRunner.EXPECT().LogError(gomock.Any())
+				output.or = oth.MockOutputRunner
+				err = output.flush([][]byte{record})
+				c.Expect(err, gs.IsNil)
+				<-received
+				c.Expect(output.dropMessageCount, gs.Equals, int64(1))
+				output.disconnect()
+			})
+
+			c.Specify("and asks for a retry when the server is down", func() {
+				listener.Close()
+				err = output.flush([][]byte{record})
+				c.Expect(err, gs.Not(gs.IsNil))
+				c.Expect(output.conn == nil, gs.IsTrue)
+			})
+		})
+	})
+}
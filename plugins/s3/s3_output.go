@@ -0,0 +1,625 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package s3
+
+import (
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"github.com/AdRoll/goamz/aws"
+	amzs3 "github.com/AdRoll/goamz/s3"
+	"github.com/cactus/gostrftime"
+	"github.com/mozilla-services/heka/message"
+	. "github.com/mozilla-services/heka/pipeline"
+	"github.com/mozilla-services/heka/plugins"
+	"github.com/mozilla-services/heka/plugins/encrypt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"code.google.com/p/go-uuid/uuid"
+)
+
+const (
+	bufferExt  = ".buf"
+	objectExt  = ".obj"
+	keyExt     = ".key"
+	tmpExt     = ".tmp"
+	encryptExt = ".enc"
+	minPartLen = 5 * 1024 * 1024 // S3's minimum multipart part size.
+	// Metadata holding the id of the key an encrypted object was encrypted
+	// w/, stored as the `x-amz-meta-heka-key-id` header.
+	keyIdMeta = "heka-key-id"
+)
+
+// Uploads a finished local object file to the given key. Abstracted so the
+// S3 interaction can be swapped out in tests.
+type uploader interface {
+	Upload(key string, file *os.File, size int64, meta map[string][]string) error
+}
+
+// Output plugin that buffers encoded messages in local files and uploads
+// them to S3 as (optionally compressed) objects.
+type S3Output struct {
+	*S3OutputConfig
+	name      string
+	pConfig   *PipelineConfig
+	bufferDir string
+	buffers   map[string]*s3Buffer
+	uploader  uploader
+	key       *encrypt.Key
+	// Tells the uploader there are new object files, w/o ever blocking the
+	// message loop: the files themselves are the queue.
+	uploadSignal chan struct{}
+	uploadWg     sync.WaitGroup
+	stopChan     chan struct{}
+
+	processMessageCount int64
+	uploadCount         int64
+	uploadFailCount     int64
+	reportLock          sync.Mutex
+}
+
+// ConfigStruct for S3Output plugin.
+type S3OutputConfig struct {
+	// AWS credentials. If empty, the credentials will be read from the
+	// environment or the EC2 instance metadata.
+	AccessKeyId     string `toml:"access_key_id"`
+	SecretAccessKey string `toml:"secret_access_key"`
+	// AWS region name, e.g. "us-east-1".
+	Region string
+	// Name of the bucket the objects will be stored in.
+	Bucket string
+	// Template for the object key prefix. May contain `%{<name>}` message
+	// placeholders and strftime codes, which are based on the message
+	// timestamp. Messages resolving to different prefixes are buffered
+	// separately.
+	KeyPrefix string `toml:"key_prefix"`
+	// Local directory used for buffering, relative to Heka's base_dir.
+	BufferPath string `toml:"buffer_path"`
+	// Size in bytes at which a buffer will be uploaded.
+	BufferMaxSize int64 `toml:"buffer_max_size"`
+	// Age in seconds at which a buffer will be uploaded.
+	BufferMaxAge uint32 `toml:"buffer_max_age"`
+	// Either "gzip" or "none".
+	Compression string
+	// Size in bytes of each part of a multipart upload. Objects smaller than
+	// this are uploaded w/ a single request.
+	PartSize int64 `toml:"part_size"`
+	// Canned S3 ACL applied to the uploaded objects.
+	Acl string
+	// If set, the buffers and objects are encrypted w/ AES-GCM using the
+	// configured key.
+	Encryption *encrypt.Config `toml:"encryption"`
+}
+
+// A local buffer file collecting data for a single key prefix.
+type s3Buffer struct {
+	prefix  string
+	file    *os.File
+	size    int64
+	created time.Time
+	// Where the data is written, the file or an encrypting writer for it.
+	out io.Writer
+}
+
+func (o *S3Output) ConfigStruct() interface{} {
+	return &S3OutputConfig{
+		Region:        "us-east-1",
+		KeyPrefix:     "%{Type}/%Y/%m/%d/",
+		BufferPath:    "s3_buffers",
+		BufferMaxSize: 100 * 1024 * 1024,
+		BufferMaxAge:  3600,
+		Compression:   "gzip",
+		PartSize:      minPartLen,
+		Acl:           string(amzs3.Private),
+	}
+}
+
+func (o *S3Output) SetName(name string) {
+	re := regexp.MustCompile("\\W")
+	o.name = re.ReplaceAllString(name, "_")
+}
+
+func (o *S3Output) SetPipelineConfig(pConfig *PipelineConfig) {
+	o.pConfig = pConfig
+}
+
+func (o *S3Output) Init(config interface{}) (err error) {
+	o.S3OutputConfig = config.(*S3OutputConfig)
+
+	if o.Bucket == "" {
+		return errors.New("`bucket` setting is required")
+	}
+	switch o.Compression {
+	case "gzip", "none":
+	default:
+		return fmt.Errorf("`compression` must be 'gzip' or 'none', got %s",
+			o.Compression)
+	}
+	if o.PartSize < minPartLen {
+		return fmt.Errorf("`part_size` must be at least %d", minPartLen)
+	}
+	if o.BufferMaxSize <= 0 {
+		return errors.New("`buffer_max_size` must be greater than 0")
+	}
+
+	if o.Encryption != nil {
+		if o.key, err = encrypt.NewKey(o.Encryption); err != nil {
+			return fmt.Errorf("can't get encryption key: %s", err)
+		}
+	}
+
+	o.bufferDir = filepath.Join(o.pConfig.Globals.PrependBaseDir(o.BufferPath),
+		o.name)
+	if err = os.MkdirAll(o.bufferDir, 0700); err != nil {
+		return fmt.Errorf("can't create buffer directory '%s': %s", o.bufferDir, err)
+	}
+
+	if o.uploader == nil {
+		region, ok := aws.Regions[o.Region]
+		if !ok {
+			return fmt.Errorf("unknown AWS region: %s", o.Region)
+		}
+		auth, err := aws.GetAuth(o.AccessKeyId, o.SecretAccessKey, "", time.Now())
+		if err != nil {
+			return fmt.Errorf("can't get AWS credentials: %s", err)
+		}
+		o.uploader = &s3Uploader{
+			bucket:   amzs3.New(auth, region).Bucket(o.Bucket),
+			partSize: o.PartSize,
+			acl:      amzs3.ACL(o.Acl),
+		}
+	}
+	return
+}
+
+// Escapes strftime directives in interpolated values so they're inserted
+// literally.
+func escapePercent(s string) string {
+	return strings.Replace(s, "%", "%%", -1)
+}
+
+// Resolves the key prefix template for the message.
+func (o *S3Output) keyPrefix(msg *message.Message) string {
+	prefix := plugins.InterpolateMessageStringEscaped(o.KeyPrefix, msg, escapePercent)
+	return gostrftime.Strftime(prefix, time.Unix(0, msg.GetTimestamp()).UTC())
+}
+
+// Returns the buffer for the given key prefix, opening a new one if needed.
+func (o *S3Output) buffer(prefix string) (buf *s3Buffer, err error) {
+	if buf = o.buffers[prefix]; buf != nil {
+		return
+	}
+	path := filepath.Join(o.bufferDir, url.QueryEscape(prefix)+bufferExt)
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("can't open buffer file: %s", err)
+	}
+	buf = &s3Buffer{prefix: prefix, file: file, created: time.Now(), out: file}
+	if o.key != nil {
+		buf.out = o.key.NewWriter(file)
+	}
+	if fi, e := file.Stat(); e == nil {
+		buf.size = fi.Size()
+	}
+	o.buffers[prefix] = buf
+	return
+}
+
+// Closes the buffer and turns it into an object file that's ready for upload,
+// compressing it if required. The buffer file is only removed once the
+// object file and its key have been written, so a crash at any point leaves
+// either the buffer or the finished object on disk.
+func (o *S3Output) finalize(buf *s3Buffer) (id string, err error) {
+	delete(o.buffers, buf.prefix)
+	bufPath := buf.file.Name()
+	if w, ok := buf.out.(*encrypt.Writer); ok {
+		err = w.Close()
+	}
+	buf.file.Close()
+	if err != nil {
+		return "", fmt.Errorf("can't end encrypted buffer: %s", err)
+	}
+	if buf.size == 0 {
+		return "", os.Remove(bufPath)
+	}
+	return o.finalizePath(buf.prefix, bufPath, false)
+}
+
+// Turns the buffer file at the path into an object file. A buffer left
+// behind by a crash may end in a cut short encrypted segment, which is only
+// accepted when `recovered` is set.
+func (o *S3Output) finalizePath(prefix, bufPath string, recovered bool) (id string,
+	err error) {
+
+	id = uuid.NewRandom().String()
+	key := prefix + id
+	if o.Compression == "gzip" {
+		key += ".gz"
+	}
+	if o.key != nil {
+		key += encryptExt
+	}
+	objPath := filepath.Join(o.bufferDir, id+objectExt)
+	tmpPath := objPath + tmpExt
+
+	in, err := os.Open(bufPath)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return "", err
+	}
+	var (
+		src       io.Reader = in
+		dst       io.Writer = out
+		buffered  *bufio.Writer
+		encrypter *encrypt.Writer
+	)
+	if o.key != nil {
+		// The buffer is encrypted too, so it has to be decrypted to be
+		// compressed. Writes are buffered to keep the frames large.
+		reader := encrypt.NewReader(in, o.Encryption.Resolver())
+		reader.AllowTruncated = recovered
+		src = reader
+		encrypter = o.key.NewWriter(out)
+		buffered = bufio.NewWriterSize(encrypter, 64*1024)
+		dst = buffered
+	}
+	if o.Compression == "gzip" {
+		gz := gzip.NewWriter(dst)
+		if _, err = io.Copy(gz, src); err == nil {
+			err = gz.Close()
+		}
+	} else {
+		_, err = io.Copy(dst, src)
+	}
+	if buffered != nil && err == nil {
+		if err = buffered.Flush(); err == nil {
+			err = encrypter.Close()
+		}
+	}
+	if e := out.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return "", fmt.Errorf("can't write object file: %s", err)
+	}
+
+	keyPath := filepath.Join(o.bufferDir, id+keyExt)
+	if err = ioutil.WriteFile(keyPath, []byte(key), 0600); err != nil {
+		os.Remove(tmpPath)
+		return "", fmt.Errorf("can't write object key file: %s", err)
+	}
+	if err = os.Rename(tmpPath, objPath); err != nil {
+		return "", err
+	}
+	return id, os.Remove(bufPath)
+}
+
+// Finds any data left behind by a previous run: half written object files
+// are removed, w/ the buffers they came from being finalized again, and
+// finished object files are returned so they'll be uploaded.
+func (o *S3Output) recover(or OutputRunner) (ids []string) {
+	tmps, _ := filepath.Glob(filepath.Join(o.bufferDir, "*"+tmpExt))
+	for _, path := range tmps {
+		os.Remove(path)
+	}
+	bufs, _ := filepath.Glob(filepath.Join(o.bufferDir, "*"+bufferExt))
+	for _, path := range bufs {
+		prefix, err := url.QueryUnescape(strings.TrimSuffix(filepath.Base(path),
+			bufferExt))
+		if err != nil {
+			or.LogError(fmt.Errorf("bad buffer file name: %s", path))
+			continue
+		}
+		if fi, err := os.Stat(path); err == nil && fi.Size() == 0 {
+			os.Remove(path)
+			continue
+		}
+		if _, err = o.finalizePath(prefix, path, true); err != nil {
+			or.LogError(fmt.Errorf("can't recover buffer '%s': %s", path, err))
+		}
+	}
+	objs, _ := filepath.Glob(filepath.Join(o.bufferDir, "*"+objectExt))
+	for _, path := range objs {
+		ids = append(ids, strings.TrimSuffix(filepath.Base(path), objectExt))
+	}
+	return
+}
+
+// Uploads a single object file, removing it once it's been stored.
+func (o *S3Output) upload(id string) (err error) {
+	objPath := filepath.Join(o.bufferDir, id+objectExt)
+	keyPath := filepath.Join(o.bufferDir, id+keyExt)
+	key, err := ioutil.ReadFile(keyPath)
+	if err != nil {
+		return fmt.Errorf("can't read key for object %s: %s", id, err)
+	}
+	file, err := os.Open(objPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	fi, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	var meta map[string][]string
+	if strings.HasSuffix(string(key), encryptExt) {
+		// Objects left behind by an earlier run may use another key.
+		keyId, err := encrypt.ReadKeyId(file)
+		if err != nil {
+			return fmt.Errorf("can't read key id of object %s: %s", id, err)
+		}
+		if _, err = file.Seek(0, 0); err != nil {
+			return err
+		}
+		meta = map[string][]string{keyIdMeta: {keyId}}
+	}
+	if err = o.uploader.Upload(string(key), file, fi.Size(), meta); err != nil {
+		return fmt.Errorf("uploading '%s': %s", key, err)
+	}
+	os.Remove(objPath)
+	os.Remove(keyPath)
+	return
+}
+
+// Returns the ids of the object files waiting to be uploaded, oldest first.
+func (o *S3Output) pendingObjects() []string {
+	paths, _ := filepath.Glob(filepath.Join(o.bufferDir, "*"+objectExt))
+	objs := make(objectsByAge, 0, len(paths))
+	for _, path := range paths {
+		if fi, err := os.Stat(path); err == nil {
+			objs = append(objs, fi)
+		}
+	}
+	sort.Sort(objs)
+	ids := make([]string, len(objs))
+	for i, fi := range objs {
+		ids[i] = strings.TrimSuffix(fi.Name(), objectExt)
+	}
+	return ids
+}
+
+type objectsByAge []os.FileInfo
+
+func (o objectsByAge) Len() int           { return len(o) }
+func (o objectsByAge) Less(i, j int) bool { return o[i].ModTime().Before(o[j].ModTime()) }
+func (o objectsByAge) Swap(i, j int)      { o[i], o[j] = o[j], o[i] }
+
+// Notifies the uploader of a new object file. Never blocks, a signal that's
+// already pending covers the new file too.
+func (o *S3Output) signalUpload() {
+	select {
+	case o.uploadSignal <- struct{}{}:
+	default:
+	}
+}
+
+// Uploads the object files on disk whenever it's signaled, retrying failures
+// w/ a backoff until Heka shuts down or the retries run out. Once stopped it
+// gives each remaining object one more try. Anything not uploaded by then
+// stays on disk and will be picked up on the next start.
+func (o *S3Output) uploadLoop(or OutputRunner) {
+	defer o.uploadWg.Done()
+	retry, _ := NewRunnerRetryHelper(or, RetryOptions{
+		MaxDelay:   "60s",
+		MaxRetries: -1,
+	})
+	for {
+		stopping := false
+		select {
+		case <-o.uploadSignal:
+		case <-o.stopChan:
+			stopping = true
+		}
+		for _, id := range o.pendingObjects() {
+			for {
+				err := o.upload(id)
+				if err == nil {
+					atomic.AddInt64(&o.uploadCount, 1)
+					retry.Reset()
+					break
+				}
+				atomic.AddInt64(&o.uploadFailCount, 1)
+				or.LogError(err)
+				if !stopping {
+					if err = retry.WaitOrStop(o.stopChan); err == nil {
+						continue
+					}
+					// Stopped, or out of retries, which leaves the file
+					// for the next start.
+					stopping = err == ErrRetryStopped
+				}
+				break
+			}
+		}
+		if stopping {
+			return
+		}
+	}
+}
+
+func (o *S3Output) Run(or OutputRunner, h PluginHelper) (err error) {
+	var (
+		ok       = true
+		pack     *PipelinePack
+		outBytes []byte
+		buf      *s3Buffer
+		e        error
+		inChan   = or.InChan()
+		ticker   = time.NewTicker(time.Second)
+	)
+	defer ticker.Stop()
+
+	if or.Encoder() == nil {
+		return errors.New("Encoder required.")
+	}
+
+	o.buffers = make(map[string]*s3Buffer)
+	o.stopChan = make(chan struct{})
+	o.uploadSignal = make(chan struct{}, 1)
+	if pending := o.recover(or); len(pending) > 0 {
+		o.signalUpload()
+	}
+	o.uploadWg.Add(1)
+	go o.uploadLoop(or)
+
+	finalize := func(buf *s3Buffer) {
+		id, e := o.finalize(buf)
+		if e != nil {
+			or.LogError(fmt.Errorf("can't finalize buffer: %s", e))
+			return
+		}
+		if id != "" {
+			o.signalUpload()
+		}
+	}
+
+	for ok {
+		select {
+		case pack, ok = <-inChan:
+			if !ok {
+				break
+			}
+			prefix := o.keyPrefix(pack.Message)
+			outBytes, e = or.Encode(pack)
+			pack.Recycle()
+			if e != nil {
+				or.LogError(e)
+				continue
+			}
+			if outBytes == nil {
+				continue
+			}
+			if buf, e = o.buffer(prefix); e != nil {
+				or.LogError(e)
+				continue
+			}
+			n, e := buf.out.Write(outBytes)
+			buf.size += int64(n)
+			if e != nil {
+				or.LogError(fmt.Errorf("writing to buffer: %s", e))
+			} else {
+				atomic.AddInt64(&o.processMessageCount, 1)
+			}
+			if buf.size >= o.BufferMaxSize {
+				finalize(buf)
+			}
+		case now := <-ticker.C:
+			maxAge := time.Duration(o.BufferMaxAge) * time.Second
+			for _, buf := range o.buffers {
+				if now.Sub(buf.created) >= maxAge {
+					finalize(buf)
+				}
+			}
+		}
+	}
+
+	// Prepare whatever we've got for upload and give the uploader one shot
+	// at sending it before we exit.
+	for _, buf := range o.buffers {
+		finalize(buf)
+	}
+	close(o.stopChan)
+	o.uploadWg.Wait()
+	return
+}
+
+// Satisfies the `pipeline.ReportingPlugin` interface to provide plugin state
+// information to the Heka report and dashboard.
+func (o *S3Output) ReportMsg(msg *message.Message) error {
+	o.reportLock.Lock()
+	defer o.reportLock.Unlock()
+
+	message.NewInt64Field(msg, "ProcessMessageCount",
+		atomic.LoadInt64(&o.processMessageCount), "count")
+	message.NewInt64Field(msg, "UploadCount",
+		atomic.LoadInt64(&o.uploadCount), "count")
+	message.NewInt64Field(msg, "UploadFailCount",
+		atomic.LoadInt64(&o.uploadFailCount), "count")
+	return nil
+}
+
+// S3 backed uploader.
+type s3Uploader struct {
+	bucket   *amzs3.Bucket
+	partSize int64
+	acl      amzs3.ACL
+}
+
+// Uploads the file w/ a single PUT if it's smaller than a part, otherwise
+// uses a multipart upload. Multipart uploads that were interrupted are
+// resumed, skipping any parts that S3 already has.
+func (u *s3Uploader) Upload(key string, file *os.File, size int64,
+	meta map[string][]string) (err error) {
+
+	contType := "application/octet-stream"
+	if strings.HasSuffix(key, ".gz") {
+		contType = "application/x-gzip"
+	}
+	options := amzs3.Options{Meta: meta}
+	if size <= u.partSize {
+		return u.bucket.PutReader(key, file, size, contType, u.acl, options)
+	}
+
+	multi, err := u.bucket.Multi(key, contType, u.acl, options)
+	if err != nil {
+		return
+	}
+	existing := make(map[int]amzs3.Part)
+	if parts, err := multi.ListParts(); err == nil {
+		for _, part := range parts {
+			existing[part.N] = part
+		}
+	}
+	var parts []amzs3.Part
+	for n, offset := 1, int64(0); offset < size; n, offset = n+1, offset+u.partSize {
+		partLen := u.partSize
+		if offset+partLen > size {
+			partLen = size - offset
+		}
+		if part, ok := existing[n]; ok && part.Size == partLen {
+			parts = append(parts, part)
+			continue
+		}
+		part, err := multi.PutPart(n, io.NewSectionReader(file, offset, partLen))
+		if err != nil {
+			return err
+		}
+		parts = append(parts, part)
+	}
+	return multi.Complete(parts)
+}
+
+func init() {
+	RegisterPlugin("S3Output", func() interface{} {
+		return new(S3Output)
+	})
+}
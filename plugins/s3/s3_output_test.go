@@ -0,0 +1,232 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package s3
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	. "github.com/mozilla-services/heka/pipeline"
+	pipeline_ts "github.com/mozilla-services/heka/pipeline/testsupport"
+	"github.com/mozilla-services/heka/plugins/encrypt"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+type fakeUploader struct {
+	objects map[string][]byte
+	meta    map[string]map[string][]string
+	err     error
+}
+
+func (u *fakeUploader) Upload(key string, file *os.File, size int64,
+	meta map[string][]string) error {
+
+	if u.err != nil {
+		return u.err
+	}
+	data, err := ioutil.ReadAll(file)
+	if err != nil {
+		return err
+	}
+	u.objects[key] = data
+	u.meta[key] = meta
+	return nil
+}
+
+func gunzip(data []byte) string {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return ""
+	}
+	out, _ := ioutil.ReadAll(r)
+	return string(out)
+}
+
+func S3OutputSpec(c gs.Context) {
+	tmpDir, tmpErr := ioutil.TempDir("", "s3-tests")
+	defer func() {
+		tmpErr = os.RemoveAll(tmpDir)
+		c.Expect(tmpErr, gs.Equals, nil)
+	}()
+	globals := DefaultGlobals()
+	globals.BaseDir = tmpDir
+	pConfig := NewPipelineConfig(globals)
+
+	msg := pipeline_ts.GetTestMessage()
+
+	c.Specify("An S3Output", func() {
+		up := &fakeUploader{
+			objects: make(map[string][]byte),
+			meta:    make(map[string]map[string][]string),
+		}
+		output := new(S3Output)
+		output.SetName("s3")
+		output.SetPipelineConfig(pConfig)
+		output.uploader = up
+		config := output.ConfigStruct().(*S3OutputConfig)
+		config.Bucket = "heka"
+
+		c.Specify("requires a bucket", func() {
+			config.Bucket = ""
+			err := output.Init(config)
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+
+		c.Specify("rejects a part size below the S3 minimum", func() {
+			config.PartSize = 1024
+			err := output.Init(config)
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+
+		c.Specify("resolves the key prefix from the message", func() {
+			config.KeyPrefix = "%{Type}/%{Hostname}/%Y-%m-%d/%{foo}/"
+			err := output.Init(config)
+			c.Assume(err, gs.IsNil)
+			c.Expect(output.keyPrefix(msg), gs.Equals, "TEST/my.host.name/2006-01-02/bar/")
+		})
+
+		c.Specify("finalizes and uploads a buffer", func() {
+			err := output.Init(config)
+			c.Assume(err, gs.IsNil)
+			output.buffers = make(map[string]*s3Buffer)
+			buf, err := output.buffer("TEST/")
+			c.Assume(err, gs.IsNil)
+			n, _ := buf.file.Write([]byte("some data"))
+			buf.size += int64(n)
+
+			id, err := output.finalize(buf)
+			c.Expect(err, gs.IsNil)
+			c.Expect(len(output.buffers), gs.Equals, 0)
+			bufs, _ := filepath.Glob(filepath.Join(output.bufferDir, "*"+bufferExt))
+			c.Expect(len(bufs), gs.Equals, 0)
+
+			err = output.upload(id)
+			c.Expect(err, gs.IsNil)
+			c.Expect(len(up.objects), gs.Equals, 1)
+			for key, data := range up.objects {
+				c.Expect(strings.HasPrefix(key, "TEST/"), gs.IsTrue)
+				c.Expect(strings.HasSuffix(key, ".gz"), gs.IsTrue)
+				c.Expect(gunzip(data), gs.Equals, "some data")
+			}
+			objs, _ := filepath.Glob(filepath.Join(output.bufferDir, "*"))
+			c.Expect(len(objs), gs.Equals, 0)
+		})
+
+		c.Specify("encrypts the buffer and the object", func() {
+			keyPath := filepath.Join(tmpDir, "key")
+			err := ioutil.WriteFile(keyPath, bytes.Repeat([]byte{1}, 32), 0600)
+			c.Assume(err, gs.IsNil)
+			config.Encryption = &encrypt.Config{KeyFile: keyPath, KeyId: "test-key"}
+			err = output.Init(config)
+			c.Assume(err, gs.IsNil)
+			output.buffers = make(map[string]*s3Buffer)
+			buf, err := output.buffer("TEST/")
+			c.Assume(err, gs.IsNil)
+			n, _ := buf.out.Write([]byte("some data"))
+			buf.size += int64(n)
+			contents, err := ioutil.ReadFile(buf.file.Name())
+			c.Assume(err, gs.IsNil)
+			c.Expect(bytes.Contains(contents, []byte("some data")), gs.IsFalse)
+
+			id, err := output.finalize(buf)
+			c.Assume(err, gs.IsNil)
+			err = output.upload(id)
+			c.Expect(err, gs.IsNil)
+			c.Expect(len(up.objects), gs.Equals, 1)
+			for key, data := range up.objects {
+				c.Expect(strings.HasSuffix(key, ".gz.enc"), gs.IsTrue)
+				c.Expect(up.meta[key][keyIdMeta][0], gs.Equals, "test-key")
+				reader := encrypt.NewReader(bytes.NewReader(data),
+					config.Encryption.Resolver())
+				compressed, err := ioutil.ReadAll(reader)
+				c.Expect(err, gs.IsNil)
+				c.Expect(gunzip(compressed), gs.Equals, "some data")
+			}
+		})
+
+		c.Specify("keeps the object on disk if the upload fails", func() {
+			config.Compression = "none"
+			err := output.Init(config)
+			c.Assume(err, gs.IsNil)
+			output.buffers = make(map[string]*s3Buffer)
+			buf, _ := output.buffer("TEST/")
+			n, _ := buf.file.Write([]byte("some data"))
+			buf.size += int64(n)
+			id, err := output.finalize(buf)
+			c.Assume(err, gs.IsNil)
+
+			up.err = errors.New("boom")
+			err = output.upload(id)
+			c.Expect(err, gs.Not(gs.IsNil))
+			objs, _ := filepath.Glob(filepath.Join(output.bufferDir, "*"+objectExt))
+			c.Expect(len(objs), gs.Equals, 1)
+		})
+
+		c.Specify("queues uploads on disk w/o blocking", func() {
+			config.Compression = "none"
+			err := output.Init(config)
+			c.Assume(err, gs.IsNil)
+			output.buffers = make(map[string]*s3Buffer)
+			output.uploadSignal = make(chan struct{}, 1)
+			output.stopChan = make(chan struct{})
+			for _, prefix := range []string{"A/", "B/", "C/"} {
+				buf, _ := output.buffer(prefix)
+				n, _ := buf.file.Write([]byte("some data"))
+				buf.size += int64(n)
+				_, err = output.finalize(buf)
+				c.Assume(err, gs.IsNil)
+				output.signalUpload()
+			}
+			c.Expect(len(output.pendingObjects()), gs.Equals, 3)
+
+			output.uploadWg.Add(1)
+			go output.uploadLoop(nil)
+			close(output.stopChan)
+			output.uploadWg.Wait()
+			c.Expect(len(up.objects), gs.Equals, 3)
+			c.Expect(len(output.pendingObjects()), gs.Equals, 0)
+		})
+
+		c.Specify("recovers data left behind by a crash", func() {
+			config.Compression = "none"
+			err := output.Init(config)
+			c.Assume(err, gs.IsNil)
+
+			// A buffer that was never finalized, and a half written object.
+			bufPath := filepath.Join(output.bufferDir, "TEST%2F"+bufferExt)
+			err = ioutil.WriteFile(bufPath, []byte("left over"), 0600)
+			c.Assume(err, gs.IsNil)
+			tmpPath := filepath.Join(output.bufferDir, "partial"+objectExt+tmpExt)
+			err = ioutil.WriteFile(tmpPath, []byte("junk"), 0600)
+			c.Assume(err, gs.IsNil)
+
+			ids := output.recover(nil)
+			c.Expect(len(ids), gs.Equals, 1)
+			_, err = os.Stat(tmpPath)
+			c.Expect(os.IsNotExist(err), gs.IsTrue)
+
+			err = output.upload(ids[0])
+			c.Expect(err, gs.IsNil)
+			for key, data := range up.objects {
+				c.Expect(strings.HasPrefix(key, "TEST/"), gs.IsTrue)
+				c.Expect(string(data), gs.Equals, "left over")
+			}
+		})
+	})
+}
@@ -0,0 +1,151 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+// Package sigv4 signs requests to AWS APIs w/ Signature Version 4.
+package sigv4
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// AWS credentials used to sign requests.
+type Credentials struct {
+	AccessKeyId     string
+	SecretAccessKey string
+	SessionToken    string
+}
+
+// Returns the given credentials, or the ones from the standard AWS
+// environment variables if no access key id is given.
+func NewCredentials(accessKeyId, secretAccessKey, sessionToken string) (
+	*Credentials, error) {
+
+	creds := &Credentials{accessKeyId, secretAccessKey, sessionToken}
+	if creds.AccessKeyId == "" {
+		creds.AccessKeyId = os.Getenv("AWS_ACCESS_KEY_ID")
+		creds.SecretAccessKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+		creds.SessionToken = os.Getenv("AWS_SESSION_TOKEN")
+	}
+	if creds.AccessKeyId == "" || creds.SecretAccessKey == "" {
+		return nil, errors.New("no AWS credentials configured")
+	}
+	return creds, nil
+}
+
+func hmacSha256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func sha256Hex(data []byte) string {
+	h := sha256.Sum256(data)
+	return hex.EncodeToString(h[:])
+}
+
+// Escapes a string as required by SigV4, which differs from
+// `url.QueryEscape` in its handling of spaces and tildes.
+func Escape(s string) string {
+	s = url.QueryEscape(s)
+	return strings.NewReplacer("+", "%20", "%7E", "~").Replace(s)
+}
+
+func canonicalQuery(u *url.URL) string {
+	query := u.Query()
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, key := range keys {
+		values := query[key]
+		sort.Strings(values)
+		for _, value := range values {
+			parts = append(parts, Escape(key)+"="+Escape(value))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// Signs the request w/ AWS Signature Version 4, setting the X-Amz-Date,
+// X-Amz-Security-Token, and Authorization headers. All headers already set
+// on the request are signed.
+func Sign(req *http.Request, body []byte, creds *Credentials, region,
+	service string, now time.Time) {
+
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Del("Authorization")
+	req.Header.Set("X-Amz-Date", amzDate)
+	if creds.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.SessionToken)
+	}
+
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	headers := map[string]string{"host": host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonHeaders string
+	for _, name := range names {
+		canonHeaders += name + ":" + headers[name] + "\n"
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	path := strings.SplitN(req.URL.RequestURI(), "?", 2)[0]
+	canonRequest := strings.Join([]string{
+		req.Method,
+		path,
+		canonicalQuery(req.URL),
+		canonHeaders,
+		signedHeaders,
+		sha256Hex(body),
+	}, "\n")
+
+	scope := strings.Join([]string{date, region, service, "aws4_request"}, "/")
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		sha256Hex([]byte(canonRequest)),
+	}, "\n")
+
+	key := hmacSha256([]byte("AWS4"+creds.SecretAccessKey), date)
+	key = hmacSha256(key, region)
+	key = hmacSha256(key, service)
+	key = hmacSha256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSha256(key, stringToSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+
+		creds.AccessKeyId+"/"+scope+", SignedHeaders="+signedHeaders+
+		", Signature="+signature)
+}
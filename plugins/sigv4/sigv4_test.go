@@ -0,0 +1,54 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package sigv4
+
+import (
+	gs "github.com/rafrombrc/gospec/src/gospec"
+	"net/http"
+	"time"
+)
+
+func SigV4Spec(c gs.Context) {
+	c.Specify("SigV4 signing", func() {
+		// Example request from the AWS Signature Version 4 documentation.
+		req, err := http.NewRequest("GET",
+			"https://iam.amazonaws.com/?Action=ListUsers&Version=2010-05-08", nil)
+		c.Assume(err, gs.IsNil)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+		creds := &Credentials{
+			AccessKeyId:     "AKIDEXAMPLE",
+			SecretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY",
+		}
+		now := time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC)
+
+		Sign(req, []byte{}, creds, "us-east-1", "iam", now)
+		c.Expect(req.Header.Get("X-Amz-Date"), gs.Equals, "20150830T123600Z")
+		c.Expect(req.Header.Get("Authorization"), gs.Equals,
+			"AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/iam/aws4_request, "+
+				"SignedHeaders=content-type;host;x-amz-date, "+
+				"Signature=5d672d79c15b13162d9279b0855cfba6789a8edb4c82c400e06b5924a6f2b5d7")
+
+		// Signing again must give the same result.
+		Sign(req, []byte{}, creds, "us-east-1", "iam", now)
+		c.Expect(req.Header.Get("Authorization"), gs.Equals,
+			"AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/iam/aws4_request, "+
+				"SignedHeaders=content-type;host;x-amz-date, "+
+				"Signature=5d672d79c15b13162d9279b0855cfba6789a8edb4c82c400e06b5924a6f2b5d7")
+	})
+
+	c.Specify("SigV4 escaping", func() {
+		c.Expect(Escape("a b~c/d"), gs.Equals, "a%20b~c%2Fd")
+	})
+}
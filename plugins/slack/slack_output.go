@@ -0,0 +1,291 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package slack
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/mozilla-services/heka/message"
+	. "github.com/mozilla-services/heka/pipeline"
+	"github.com/mozilla-services/heka/plugins"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Output plugin that posts messages to a Slack compatible incoming webhook.
+type SlackOutput struct {
+	*SlackOutputConfig
+	client              *http.Client
+	colors              map[int32]string
+	lastSent            map[string]time.Time
+	windowStart         time.Time
+	windowCount         int
+	suppressed          int
+	now                 func() time.Time
+	processMessageCount int64
+	dropMessageCount    int64
+	reportLock          sync.Mutex
+}
+
+// ConfigStruct for SlackOutput plugin.
+type SlackOutputConfig struct {
+	// Incoming webhook URL.
+	WebhookUrl string `toml:"webhook_url"`
+	// Channel to post to, overriding the webhook's default. May contain
+	// `%{<name>}` placeholders.
+	Channel string
+	// User name and icon to post as.
+	Username  string
+	IconEmoji string `toml:"icon_emoji"`
+	IconUrl   string `toml:"icon_url"`
+	// Attachment title and text templates, may contain `%{<name>}`
+	// placeholders.
+	Title string
+	Text  string
+	// Dynamic message fields that will be added to the attachment.
+	Fields []string
+	// Map of severity (as a string) to attachment color, overriding the
+	// defaults.
+	Colors map[string]string
+	// Posts w/ the same title and text as one sent within this many seconds
+	// are suppressed. 0 disables deduplication.
+	DedupWindow uint32 `toml:"dedup_window"`
+	// Maximum number of posts per minute. Messages over the limit are
+	// dropped, and a count of them is included in the next post. 0 means no
+	// limit.
+	MaxPerMinute int `toml:"max_per_minute"`
+	// HTTP request timeout, in milliseconds. 0 means no timeout.
+	HttpTimeout uint32 `toml:"http_timeout"`
+}
+
+// Slack message structures, see https://api.slack.com/incoming-webhooks.
+type slackField struct {
+	Title string `json:"title"`
+	Value string `json:"value"`
+	Short bool   `json:"short"`
+}
+
+type slackAttachment struct {
+	Fallback string       `json:"fallback"`
+	Color    string       `json:"color,omitempty"`
+	Title    string       `json:"title,omitempty"`
+	Text     string       `json:"text"`
+	Fields   []slackField `json:"fields,omitempty"`
+	Ts       int64        `json:"ts"`
+}
+
+type slackMessage struct {
+	Channel     string            `json:"channel,omitempty"`
+	Username    string            `json:"username,omitempty"`
+	IconEmoji   string            `json:"icon_emoji,omitempty"`
+	IconUrl     string            `json:"icon_url,omitempty"`
+	Text        string            `json:"text,omitempty"`
+	Attachments []slackAttachment `json:"attachments"`
+}
+
+// Default attachment colors, keyed by syslog severity.
+var defaultColors = map[int32]string{
+	0: "danger",
+	1: "danger",
+	2: "danger",
+	3: "danger",
+	4: "warning",
+	5: "good",
+	6: "good",
+	7: "#cccccc",
+}
+
+func (o *SlackOutput) ConfigStruct() interface{} {
+	return &SlackOutputConfig{
+		Username:     "heka",
+		Title:        "%{Type} from %{Hostname}",
+		Text:         "%{Payload}",
+		DedupWindow:  300,
+		MaxPerMinute: 10,
+		HttpTimeout:  5000,
+	}
+}
+
+func (o *SlackOutput) Init(config interface{}) (err error) {
+	o.SlackOutputConfig = config.(*SlackOutputConfig)
+
+	if o.WebhookUrl == "" {
+		return errors.New("`webhook_url` setting is required")
+	}
+	u, err := url.Parse(o.WebhookUrl)
+	if err != nil {
+		return fmt.Errorf("can't parse URL '%s': %s", o.WebhookUrl, err.Error())
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return errors.New("`webhook_url` must contain an absolute http or https URL")
+	}
+
+	o.colors = make(map[int32]string)
+	for sev, color := range defaultColors {
+		o.colors[sev] = color
+	}
+	for sevStr, color := range o.Colors {
+		var sev int32
+		if _, err = fmt.Sscanf(sevStr, "%d", &sev); err != nil || sev < 0 || sev > 7 {
+			return fmt.Errorf("invalid severity in `colors`: %s", sevStr)
+		}
+		o.colors[sev] = color
+	}
+
+	o.client = new(http.Client)
+	if o.HttpTimeout > 0 {
+		o.client.Timeout = time.Duration(o.HttpTimeout) * time.Millisecond
+	}
+	o.lastSent = make(map[string]time.Time)
+	if o.now == nil {
+		o.now = time.Now
+	}
+	return
+}
+
+// Builds the webhook payload for a message.
+func (o *SlackOutput) slackMessage(msg *message.Message) *slackMessage {
+	attachment := slackAttachment{
+		Title: plugins.InterpolateMessageString(o.Title, msg),
+		Text:  plugins.InterpolateMessageString(o.Text, msg),
+		Color: o.colors[msg.GetSeverity()],
+		Ts:    msg.GetTimestamp() / int64(time.Second),
+	}
+	attachment.Fallback = attachment.Title
+	if attachment.Fallback == "" {
+		attachment.Fallback = attachment.Text
+	}
+	for _, name := range o.Fields {
+		val, ok := msg.GetFieldValue(name)
+		if !ok {
+			continue
+		}
+		valStr := fmt.Sprint(val)
+		attachment.Fields = append(attachment.Fields, slackField{
+			Title: name,
+			Value: valStr,
+			Short: len(valStr) < 40,
+		})
+	}
+	return &slackMessage{
+		Channel:     plugins.InterpolateMessageString(o.Channel, msg),
+		Username:    o.Username,
+		IconEmoji:   o.IconEmoji,
+		IconUrl:     o.IconUrl,
+		Attachments: []slackAttachment{attachment},
+	}
+}
+
+// Decides whether a message may be posted, applying the dedup window and
+// the rate limit.
+func (o *SlackOutput) allow(sm *slackMessage) bool {
+	now := o.now()
+	if o.DedupWindow > 0 {
+		window := time.Duration(o.DedupWindow) * time.Second
+		for key, sent := range o.lastSent {
+			if now.Sub(sent) >= window {
+				delete(o.lastSent, key)
+			}
+		}
+		attachment := sm.Attachments[0]
+		key := sm.Channel + "\x00" + attachment.Title + "\x00" + attachment.Text
+		if _, ok := o.lastSent[key]; ok {
+			return false
+		}
+		o.lastSent[key] = now
+	}
+	if o.MaxPerMinute > 0 {
+		if now.Sub(o.windowStart) >= time.Minute {
+			o.windowStart = now
+			o.windowCount = 0
+		}
+		if o.windowCount >= o.MaxPerMinute {
+			o.suppressed++
+			return false
+		}
+		o.windowCount++
+	}
+	return true
+}
+
+func (o *SlackOutput) Run(or OutputRunner, h PluginHelper) (err error) {
+	for pack := range or.InChan() {
+		sm := o.slackMessage(pack.Message)
+		pack.Recycle()
+		if !o.allow(sm) {
+			atomic.AddInt64(&o.dropMessageCount, 1)
+			continue
+		}
+		if o.suppressed > 0 {
+			sm.Text = fmt.Sprintf("%d messages were suppressed by the rate limit",
+				o.suppressed)
+			o.suppressed = 0
+		}
+		if e := o.post(sm); e != nil {
+			or.LogError(e)
+			atomic.AddInt64(&o.dropMessageCount, 1)
+			continue
+		}
+		atomic.AddInt64(&o.processMessageCount, 1)
+	}
+	return
+}
+
+// Sends a message to the webhook.
+func (o *SlackOutput) post(sm *slackMessage) (err error) {
+	body, err := json.Marshal(sm)
+	if err != nil {
+		return fmt.Errorf("can't encode Slack message: %s", err.Error())
+	}
+	resp, err := o.client.Post(o.WebhookUrl, "application/json",
+		bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("error making HTTP request: %s", err.Error())
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		respBody, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("Slack webhook post failed: %s - %s", resp.Status,
+			strings.TrimSpace(string(respBody)))
+	}
+	return
+}
+
+// Satisfies the `pipeline.ReportingPlugin` interface to provide plugin state
+// information to the Heka report and dashboard.
+func (o *SlackOutput) ReportMsg(msg *message.Message) error {
+	o.reportLock.Lock()
+	defer o.reportLock.Unlock()
+
+	message.NewInt64Field(msg, "ProcessMessageCount",
+		atomic.LoadInt64(&o.processMessageCount), "count")
+	message.NewInt64Field(msg, "DropMessageCount",
+		atomic.LoadInt64(&o.dropMessageCount), "count")
+	return nil
+}
+
+func init() {
+	RegisterPlugin("SlackOutput", func() interface{} {
+		return new(SlackOutput)
+	})
+}
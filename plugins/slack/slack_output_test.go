@@ -0,0 +1,127 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package slack
+
+import (
+	"encoding/json"
+	"github.com/mozilla-services/heka/message"
+	pipeline_ts "github.com/mozilla-services/heka/pipeline/testsupport"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"time"
+)
+
+func SlackOutputSpec(c gs.Context) {
+	output := new(SlackOutput)
+	config := output.ConfigStruct().(*SlackOutputConfig)
+	config.WebhookUrl = "http://localhost/hook"
+
+	msg := pipeline_ts.GetTestMessage()
+	field, _ := message.NewField("count", int64(12), "")
+	msg.AddField(field)
+
+	now := time.Unix(1136239445, 0)
+	output.now = func() time.Time { return now }
+
+	c.Specify("A SlackOutput", func() {
+		c.Specify("requires a webhook URL", func() {
+			config.WebhookUrl = ""
+			err := output.Init(config)
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+
+		c.Specify("builds an attachment from the message", func() {
+			config.Channel = "#%{Logger}"
+			config.Fields = []string{"foo", "count", "missing"}
+			config.Colors = map[string]string{"6": "#00ff00"}
+			err := output.Init(config)
+			c.Assume(err, gs.IsNil)
+
+			sm := output.slackMessage(msg)
+			c.Expect(sm.Channel, gs.Equals, "#GoSpec")
+			c.Expect(sm.Username, gs.Equals, "heka")
+			c.Expect(len(sm.Attachments), gs.Equals, 1)
+			attachment := sm.Attachments[0]
+			c.Expect(attachment.Title, gs.Equals, "TEST from my.host.name")
+			c.Expect(attachment.Fallback, gs.Equals, "TEST from my.host.name")
+			c.Expect(attachment.Text, gs.Equals, "Test Payload")
+			c.Expect(attachment.Color, gs.Equals, "#00ff00")
+			c.Expect(attachment.Ts, gs.Equals, int64(1136239445))
+			c.Expect(len(attachment.Fields), gs.Equals, 2)
+			c.Expect(attachment.Fields[0].Value, gs.Equals, "bar")
+			c.Expect(attachment.Fields[1].Value, gs.Equals, "12")
+		})
+
+		c.Specify("suppresses duplicates within the dedup window", func() {
+			config.MaxPerMinute = 0
+			err := output.Init(config)
+			c.Assume(err, gs.IsNil)
+			c.Expect(output.allow(output.slackMessage(msg)), gs.IsTrue)
+			c.Expect(output.allow(output.slackMessage(msg)), gs.IsFalse)
+			now = now.Add(301 * time.Second)
+			c.Expect(output.allow(output.slackMessage(msg)), gs.IsTrue)
+		})
+
+		c.Specify("enforces the rate limit", func() {
+			config.DedupWindow = 0
+			config.MaxPerMinute = 2
+			err := output.Init(config)
+			c.Assume(err, gs.IsNil)
+			c.Expect(output.allow(output.slackMessage(msg)), gs.IsTrue)
+			c.Expect(output.allow(output.slackMessage(msg)), gs.IsTrue)
+			c.Expect(output.allow(output.slackMessage(msg)), gs.IsFalse)
+			c.Expect(output.suppressed, gs.Equals, 1)
+			now = now.Add(time.Minute)
+			c.Expect(output.allow(output.slackMessage(msg)), gs.IsTrue)
+		})
+
+		c.Specify("posts JSON to the webhook", func() {
+			var received slackMessage
+			var contentType string
+			server := httptest.NewServer(http.HandlerFunc(
+				func(w http.ResponseWriter, r *http.Request) {
+					contentType = r.Header.Get("Content-Type")
+					body, _ := ioutil.ReadAll(r.Body)
+					json.Unmarshal(body, &received)
+				}))
+			defer server.Close()
+
+			config.WebhookUrl = server.URL
+			err := output.Init(config)
+			c.Assume(err, gs.IsNil)
+			err = output.post(output.slackMessage(msg))
+			c.Expect(err, gs.IsNil)
+			c.Expect(contentType, gs.Equals, "application/json")
+			c.Expect(len(received.Attachments), gs.Equals, 1)
+			c.Expect(received.Attachments[0].Color, gs.Equals, "good")
+		})
+
+		c.Specify("returns an error on a failed post", func() {
+			server := httptest.NewServer(http.HandlerFunc(
+				func(w http.ResponseWriter, r *http.Request) {
+					http.Error(w, "no_text", http.StatusBadRequest)
+				}))
+			defer server.Close()
+
+			config.WebhookUrl = server.URL
+			err := output.Init(config)
+			c.Assume(err, gs.IsNil)
+			err = output.post(output.slackMessage(msg))
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+	})
+}
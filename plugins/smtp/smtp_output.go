@@ -18,10 +18,14 @@
 package smtp
 
 import (
+	"crypto/tls"
 	"encoding/base64"
 	"errors"
 	"fmt"
+	"github.com/mozilla-services/heka/message"
 	. "github.com/mozilla-services/heka/pipeline"
+	"github.com/mozilla-services/heka/plugins"
+	"github.com/mozilla-services/heka/plugins/tcp"
 	"net"
 	"net/smtp"
 	"strings"
@@ -35,10 +39,17 @@ type SmtpOutput struct {
 	conf         *SmtpOutputConfig
 	auth         smtp.Auth
 	sendFunction func(addr string, a smtp.Auth, from string, to []string, msg []byte) error
-	inMessage    chan []byte
+	inMessage    chan *mailContents
 	or           OutputRunner
 	fullMsg      []byte
 	headerLen    int
+	tlsConfig    *tls.Config
+}
+
+// The subject and body generated for a single message.
+type mailContents struct {
+	subject string
+	body    []byte
 }
 
 type SmtpOutputConfig struct {
@@ -46,8 +57,11 @@ type SmtpOutputConfig struct {
 	SendFrom string `toml:"send_from"`
 	// email addresses to send the output to
 	SendTo []string `toml:"send_to"`
-	// User defined email subject line
+	// User defined email subject line, may contain `%{<name>}` placeholders.
 	Subject string
+	// Template for the email body, may contain `%{<name>}` placeholders. If
+	// empty the output's encoder is used to generate the body.
+	BodyTemplate string `toml:"body_template"`
 	// SMTP Host
 	Host string
 	// SMTP Authentication type
@@ -61,6 +75,16 @@ type SmtpOutputConfig struct {
 	// is received in the period, the mail text is concatenated. Default is 0,
 	// meaning no limit.
 	SendInterval uint `toml:"send_interval"`
+	// Maximum number of messages that will be included in a single email
+	// when `send_interval` is in effect. Any further messages received in
+	// the same interval are dropped, and a count of the dropped messages is
+	// appended to the email. Default is 0, meaning no limit.
+	MaxBatchCount uint `toml:"max_batch_count"`
+	// Connect using TLS rather than upgrading a plain connection w/
+	// STARTTLS.
+	UseTls bool `toml:"use_tls"`
+	// TLS settings used for both TLS and STARTTLS connections.
+	Tls tcp.TlsConfig
 }
 
 type smtpHeader struct {
@@ -89,7 +113,14 @@ func (s *SmtpOutput) Init(config interface{}) (err error) {
 		return fmt.Errorf("Host must contain a port specifier")
 	}
 
-	s.sendFunction = smtp.SendMail
+	s.sendFunction = s.deliver
+
+	if s.tlsConfig, err = tcp.CreateGoTlsConfig(&s.conf.Tls); err != nil {
+		return fmt.Errorf("TLS init error: %s", err)
+	}
+	if s.tlsConfig.ServerName == "" {
+		s.tlsConfig.ServerName = host
+	}
 
 	if s.conf.Auth == "Plain" {
 		s.auth = smtp.PlainAuth("", s.conf.User, s.conf.Password, host)
@@ -109,44 +140,56 @@ func (s *SmtpOutput) Run(or OutputRunner, h PluginHelper) (err error) {
 		contents []byte
 	)
 	s.or = or
-	if or.Encoder() == nil {
+	if s.conf.BodyTemplate == "" && or.Encoder() == nil {
 		return errors.New("encoder required")
 	}
 
 	inChan := or.InChan()
-	s.fullMsg = s.getHeader()
-	s.headerLen = len(s.fullMsg)
 
 	if s.conf.SendInterval != 0 {
 		// Start sender. This will receive messages on the s.inMessage channel.
-		s.inMessage = make(chan []byte, 1)
+		s.inMessage = make(chan *mailContents, 1)
 		go s.sendLoop()
 	}
 
 	for pack = range inChan {
-		contents, err = or.Encode(pack)
-		if contents == nil || err != nil {
-			if err != nil {
-				or.LogError(fmt.Errorf("encoding error: %s", err.Error()))
+		if s.conf.BodyTemplate != "" {
+			contents = []byte(plugins.InterpolateMessageString(s.conf.BodyTemplate,
+				pack.Message))
+		} else {
+			contents, err = or.Encode(pack)
+			if contents == nil || err != nil {
+				if err != nil {
+					or.LogError(fmt.Errorf("encoding error: %s", err.Error()))
+				}
+				pack.Recycle()
+				continue
 			}
-			pack.Recycle()
-			continue
 		}
+		subject := s.subject(pack.Message)
 
 		// We run this direct output if no minimum interval has been requested.
 		if s.conf.SendInterval == 0 {
-			err = s.sendMail(contents)
+			err = s.sendMail(subject, contents)
 			if err != nil {
 				or.LogError(fmt.Errorf("sending error: %s", err.Error()))
 			}
 		} else {
-			s.inMessage <- contents
+			s.inMessage <- &mailContents{subject: subject, body: contents}
 		}
 		pack.Recycle()
 	}
 	return nil
 }
 
+// Generates the email subject for a message.
+func (s *SmtpOutput) subject(msg *message.Message) string {
+	if s.conf.Subject == "" {
+		return fmt.Sprintf("Heka [%s]", s.or.Name())
+	}
+	return plugins.InterpolateMessageString(s.conf.Subject, msg)
+}
+
 func (s *SmtpOutput) encodeFullMsg(contents []byte) {
 	// RFC 2045 6.8 Base64 Content-Transfer-Encoding
 	// The encoded output stream must be represented in lines of no more
@@ -185,19 +228,70 @@ func (s *SmtpOutput) encodeFullMsg(contents []byte) {
 	}
 }
 
-func (s SmtpOutput) sendMail(contents []byte) error {
+func (s *SmtpOutput) sendMail(subject string, contents []byte) error {
+	s.fullMsg = append(s.fullMsg[:0], s.getHeader(subject)...)
+	s.headerLen = len(s.fullMsg)
 	s.encodeFullMsg(contents)
 	return s.sendFunction(s.conf.Host, s.auth, s.conf.SendFrom, s.conf.SendTo, s.fullMsg)
 }
 
-// Only called once at startup.
-func (s SmtpOutput) getHeader() []byte {
-	var subject string
-	if s.conf.Subject != "" {
-		subject = s.conf.Subject
+// Delivers a message in the same way as `smtp.SendMail`, but using the
+// configured TLS settings, and w/ support for connecting over TLS.
+func (s *SmtpOutput) deliver(addr string, a smtp.Auth, from string, to []string,
+	msg []byte) (err error) {
+
+	var conn net.Conn
+	if s.conf.UseTls {
+		conn, err = tls.Dial("tcp", addr, s.tlsConfig)
 	} else {
-		subject = fmt.Sprintf("Heka [%s]", s.or.Name())
+		conn, err = net.Dial("tcp", addr)
+	}
+	if err != nil {
+		return
+	}
+	c, err := smtp.NewClient(conn, s.tlsConfig.ServerName)
+	if err != nil {
+		conn.Close()
+		return
 	}
+	defer c.Close()
+
+	if !s.conf.UseTls {
+		if ok, _ := c.Extension("STARTTLS"); ok {
+			if err = c.StartTLS(s.tlsConfig); err != nil {
+				return
+			}
+		}
+	}
+	if a != nil {
+		if ok, _ := c.Extension("AUTH"); ok {
+			if err = c.Auth(a); err != nil {
+				return
+			}
+		}
+	}
+	if err = c.Mail(from); err != nil {
+		return
+	}
+	for _, rcpt := range to {
+		if err = c.Rcpt(rcpt); err != nil {
+			return
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return
+	}
+	if _, err = w.Write(msg); err != nil {
+		return
+	}
+	if err = w.Close(); err != nil {
+		return
+	}
+	return c.Quit()
+}
+
+func (s *SmtpOutput) getHeader(subject string) []byte {
 	headers := make([]string, 5)
 	headers[0] = "From: " + s.conf.SendFrom
 	headers[1] = encodeSubject(subject)
@@ -212,6 +306,11 @@ func (s *SmtpOutput) sendLoop() {
 
 	// Bodies of all currently queued messages that will be sent in the next mail
 	var queue []byte
+	// Subject of the first queued message, used for the next mail
+	var subject string
+	// Number of queued messages, and of messages dropped due to
+	// max_batch_count
+	var queued, dropped uint
 	// Channel to indicate that timeout has been reached
 	timeOut := make(chan bool, 1)
 	// Minimum duration between each email
@@ -225,7 +324,7 @@ func (s *SmtpOutput) sendLoop() {
 			// If none are queued, and we are after the ticker duration, just
 			// send it right away.
 			if len(queue) == 0 && time.Now().After(lastSent.Add(tickerDur)) {
-				err = s.sendMail(msg)
+				err = s.sendMail(msg.subject, msg.body)
 				lastSent = time.Now()
 				if err != nil {
 					s.or.LogError(err)
@@ -242,14 +341,27 @@ func (s *SmtpOutput) sendLoop() {
 					timeOut <- true
 				}()
 			}
-			queue = append(queue, msg...)
+			if s.conf.MaxBatchCount > 0 && queued >= s.conf.MaxBatchCount {
+				dropped++
+				continue
+			}
+			if queued == 0 {
+				subject = msg.subject
+			}
+			queued++
+			queue = append(queue, msg.body...)
 			queue = append(queue, []byte("\r\n\r\n")...)
 		case <-timeOut:
 			// When the timeout has expired, send the messages that are
 			// queued.
+			if dropped > 0 {
+				queue = append(queue, []byte(fmt.Sprintf(
+					"%d additional messages were dropped\r\n\r\n", dropped))...)
+			}
 			contents := queue[:len(queue)-4]
+			err = s.sendMail(subject, contents)
 			queue = queue[:0]
-			err = s.sendMail(contents)
+			queued, dropped = 0, 0
 			lastSent = time.Now()
 			if err != nil {
 				s.or.LogError(err)
@@ -77,10 +77,10 @@ func SmtpOutputSpec(c gs.Context) {
 		inChanCall.Return(inChan)
 		runnerName := oth.MockOutputRunner.EXPECT().Name().AnyTimes()
 		runnerName.Return("SmtpOutput")
-		oth.MockOutputRunner.EXPECT().Encoder().Return(encoder)
-		encCall := oth.MockOutputRunner.EXPECT().Encode(pack)
 
 		c.Specify("send email payload message", func() {
+			oth.MockOutputRunner.EXPECT().Encoder().Return(encoder)
+			encCall := oth.MockOutputRunner.EXPECT().Encode(pack)
 			err := smtpOutput.Init(config)
 			c.Assume(err, gs.IsNil)
 			smtpOutput.sendFunction = testSendMail
@@ -97,6 +97,33 @@ func SmtpOutputSpec(c gs.Context) {
 			close(inChan)
 			wg.Wait()
 		})
+
+		c.Specify("send email w/ templated subject and body", func() {
+			config.Subject = "[%{Severity}] %{Type} on %{Hostname}"
+			config.BodyTemplate = "foo is %{foo}"
+			err := smtpOutput.Init(config)
+			c.Assume(err, gs.IsNil)
+
+			var sent []byte
+			smtpOutput.sendFunction = func(addr string, a smtp.Auth, from string,
+				to []string, msg []byte) error {
+				sent = append([]byte{}, msg...)
+				return nil
+			}
+
+			wg.Add(1)
+			go func() {
+				smtpOutput.Run(oth.MockOutputRunner, oth.MockHelper)
+				wg.Done()
+			}()
+			inChan <- pack
+			close(inChan)
+			wg.Wait()
+			c.Expect(string(sent), gs.Equals, "From: heka@localhost.localdomain\r\n"+
+				"Subject: [6] TEST on my.host.name\r\nMIME-Version: 1.0\r\n"+
+				"Content-Type: text/plain; charset=\"utf-8\"\r\n"+
+				"Content-Transfer-Encoding: base64\r\n\r\nZm9vIGlzIGJhcg==")
+		})
 	})
 
 	c.Specify("SmtpOutput Message Body Encoding", func() {
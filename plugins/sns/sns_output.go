@@ -0,0 +1,369 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package sns
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"github.com/mozilla-services/heka/message"
+	. "github.com/mozilla-services/heka/pipeline"
+	"github.com/mozilla-services/heka/plugins"
+	"github.com/mozilla-services/heka/plugins/sigv4"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	// API limits for a single PublishBatch request.
+	maxEntriesPerRequest = 10
+	maxRequestBytes      = 256 * 1024
+	// Limit on the number of attributes of a single message.
+	maxAttributes = 10
+)
+
+// Output plugin that publishes messages to an AWS SNS topic.
+type SnsOutput struct {
+	*SnsOutputConfig
+	creds               *sigv4.Credentials
+	client              *http.Client
+	now                 func() time.Time
+	processMessageCount int64
+	dropMessageCount    int64
+	reportLock          sync.Mutex
+	batcher             *Batcher
+	or                  OutputRunner
+}
+
+// ConfigStruct for SnsOutput plugin.
+type SnsOutputConfig struct {
+	// AWS region and credentials. If the credentials are empty, the
+	// standard AWS environment variables are used.
+	Region          string
+	AccessKeyId     string `toml:"access_key_id"`
+	SecretAccessKey string `toml:"secret_access_key"`
+	SessionToken    string `toml:"session_token"`
+	// ARN of the topic the messages are published to.
+	TopicArn string `toml:"topic_arn"`
+	// Templates for the message subject and, for FIFO topics, the message
+	// group ID. May contain `%{<name>}` placeholders.
+	Subject        string
+	MessageGroupId string `toml:"message_group_id"`
+	// Dynamic message fields sent as message attributes.
+	AttributeFields []string `toml:"attribute_fields"`
+	// Batching settings, from the `batch` subsection.
+	Batch BatchConfig `toml:"batch"`
+	// HTTP request timeout, in milliseconds. 0 means no timeout.
+	HttpTimeout uint32 `toml:"http_timeout"`
+	// API endpoint override, defaulting to the region's endpoint.
+	Endpoint string
+}
+
+type snsAttribute struct {
+	Name     string `json:"name"`
+	DataType string `json:"type"`
+	Value    string `json:"value"`
+}
+
+// A batched message, holding everything needed for its PublishBatch entry.
+type snsEntry struct {
+	Message    string          `json:"message"`
+	Subject    string          `json:"subject,omitempty"`
+	GroupId    string          `json:"group_id,omitempty"`
+	DedupId    string          `json:"dedup_id,omitempty"`
+	Attributes []*snsAttribute `json:"attributes,omitempty"`
+}
+
+type snsFailure struct {
+	Id          string
+	Code        string
+	Message     string
+	SenderFault bool
+}
+
+type publishBatchResponse struct {
+	Failed []snsFailure `xml:"PublishBatchResult>Failed>member"`
+}
+
+type errorResponse struct {
+	Code    string `xml:"Error>Code"`
+	Message string `xml:"Error>Message"`
+}
+
+func (o *SnsOutput) ConfigStruct() interface{} {
+	batch := DefaultBatchConfig()
+	batch.FlushCount = maxEntriesPerRequest
+	return &SnsOutputConfig{
+		Region:      "us-east-1",
+		HttpTimeout: 10000,
+		Batch:       batch,
+	}
+}
+
+func (o *SnsOutput) Init(config interface{}) (err error) {
+	o.SnsOutputConfig = config.(*SnsOutputConfig)
+
+	if o.TopicArn == "" {
+		return errors.New("`topic_arn` must be set")
+	}
+	if o.Region == "" {
+		return errors.New("`region` must not be empty")
+	}
+	if o.Batch.FlushCount < 1 || o.Batch.FlushCount > maxEntriesPerRequest {
+		return fmt.Errorf("`batch` `flush_count` must be between 1 and %d", maxEntriesPerRequest)
+	}
+	if len(o.AttributeFields) > maxAttributes {
+		return fmt.Errorf("at most %d `attribute_fields` are allowed", maxAttributes)
+	}
+	o.creds, err = sigv4.NewCredentials(o.AccessKeyId, o.SecretAccessKey, o.SessionToken)
+	if err != nil {
+		return
+	}
+	if o.Endpoint == "" {
+		o.Endpoint = fmt.Sprintf("https://sns.%s.amazonaws.com/", o.Region)
+	}
+
+	o.client = new(http.Client)
+	if o.HttpTimeout > 0 {
+		o.client.Timeout = time.Duration(o.HttpTimeout) * time.Millisecond
+	}
+	if o.now == nil {
+		o.now = time.Now
+	}
+	err = o.Batch.Validate()
+	return
+}
+
+// Converts a message field value into an SNS attribute.
+func attribute(name string, value interface{}) *snsAttribute {
+	attr := &snsAttribute{Name: name, DataType: "String"}
+	switch v := value.(type) {
+	case string:
+		attr.Value = v
+	case []byte:
+		attr.DataType = "Binary"
+		attr.Value = base64.StdEncoding.EncodeToString(v)
+	case int64:
+		attr.DataType = "Number"
+		attr.Value = strconv.FormatInt(v, 10)
+	case float64:
+		attr.DataType = "Number"
+		attr.Value = strconv.FormatFloat(v, 'f', -1, 64)
+	default:
+		attr.Value = fmt.Sprintf("%v", v)
+	}
+	return attr
+}
+
+// Generates the batched entry for a message and its encoded contents.
+func (o *SnsOutput) makeEntry(msg *message.Message, contents []byte) (record []byte,
+	err error) {
+
+	if !utf8.Valid(contents) {
+		return nil, errors.New("encoded message isn't valid UTF-8 text")
+	}
+	if len(contents) > maxRequestBytes {
+		return nil, fmt.Errorf("encoded message too large: %d bytes", len(contents))
+	}
+	entry := &snsEntry{Message: string(contents)}
+	if o.Subject != "" {
+		entry.Subject = plugins.InterpolateMessageString(o.Subject, msg)
+	}
+	if o.MessageGroupId != "" {
+		entry.GroupId = plugins.InterpolateMessageString(o.MessageGroupId, msg)
+		entry.DedupId = msg.GetUuidString()
+	}
+	for _, name := range o.AttributeFields {
+		if val, ok := msg.GetFieldValue(name); ok {
+			entry.Attributes = append(entry.Attributes, attribute(name, val))
+		}
+	}
+	return json.Marshal(entry)
+}
+
+// Generates the PublishBatch query parameters for a set of entries.
+func (o *SnsOutput) publishParams(entries []*snsEntry) url.Values {
+	params := url.Values{
+		"Action":   {"PublishBatch"},
+		"Version":  {"2010-03-31"},
+		"TopicArn": {o.TopicArn},
+	}
+	for i, entry := range entries {
+		prefix := fmt.Sprintf("PublishBatchRequestEntries.member.%d.", i+1)
+		params.Set(prefix+"Id", strconv.Itoa(i))
+		params.Set(prefix+"Message", entry.Message)
+		if entry.Subject != "" {
+			params.Set(prefix+"Subject", entry.Subject)
+		}
+		if entry.GroupId != "" {
+			params.Set(prefix+"MessageGroupId", entry.GroupId)
+			params.Set(prefix+"MessageDeduplicationId", entry.DedupId)
+		}
+		for j, attr := range entry.Attributes {
+			attrPrefix := fmt.Sprintf("%sMessageAttributes.entry.%d.", prefix, j+1)
+			params.Set(attrPrefix+"Name", attr.Name)
+			params.Set(attrPrefix+"Value.DataType", attr.DataType)
+			if attr.DataType == "Binary" {
+				params.Set(attrPrefix+"Value.BinaryValue", attr.Value)
+			} else {
+				params.Set(attrPrefix+"Value.StringValue", attr.Value)
+			}
+		}
+	}
+	return params
+}
+
+// Makes a signed PublishBatch request. Throttling and server errors are
+// returned so the batch is retried. Entries SNS rejects are logged and
+// dropped.
+func (o *SnsOutput) publish(entries []*snsEntry) error {
+	body := []byte(o.publishParams(entries).Encode())
+	req, err := http.NewRequest("POST", o.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("can't create HTTP request: %s", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+	sigv4.Sign(req, body, o.creds, o.Region, "sns", o.now())
+
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("error making HTTP request: %s", err)
+	}
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("can't read response: %s", err)
+	}
+
+	if resp.StatusCode >= 300 {
+		awsErr := new(errorResponse)
+		xml.Unmarshal(respBody, awsErr)
+		err = fmt.Errorf("PublishBatch failed: %d - %s: %s", resp.StatusCode,
+			awsErr.Code, awsErr.Message)
+		if resp.StatusCode == 429 || resp.StatusCode >= 500 ||
+			strings.HasPrefix(awsErr.Code, "Throttl") {
+			return err
+		}
+		o.or.LogError(err)
+		atomic.AddInt64(&o.dropMessageCount, int64(len(entries)))
+		return nil
+	}
+
+	result := new(publishBatchResponse)
+	if err = xml.Unmarshal(respBody, result); err != nil {
+		return fmt.Errorf("can't decode response: %s", err)
+	}
+	for _, failure := range result.Failed {
+		o.or.LogError(fmt.Errorf("SNS rejected message %s: %s - %s", failure.Id,
+			failure.Code, failure.Message))
+	}
+	atomic.AddInt64(&o.dropMessageCount, int64(len(result.Failed)))
+	atomic.AddInt64(&o.processMessageCount, int64(len(entries)-len(result.Failed)))
+	return nil
+}
+
+// Satisfies `pipeline.BatchFlushFunc`, publishing the entries in as few
+// requests as the API's limits allow.
+func (o *SnsOutput) flush(records [][]byte) error {
+	var (
+		entries []*snsEntry
+		size    int
+	)
+	for _, record := range records {
+		entry := new(snsEntry)
+		if err := json.Unmarshal(record, entry); err != nil {
+			return err
+		}
+		if len(entries) == maxEntriesPerRequest ||
+			(len(entries) > 0 && size+len(entry.Message) > maxRequestBytes) {
+
+			if err := o.publish(entries); err != nil {
+				return err
+			}
+			entries, size = nil, 0
+		}
+		entries = append(entries, entry)
+		size += len(entry.Message)
+	}
+	if len(entries) > 0 {
+		return o.publish(entries)
+	}
+	return nil
+}
+
+func (o *SnsOutput) Run(or OutputRunner, h PluginHelper) (err error) {
+	if or.Encoder() == nil {
+		return errors.New("Encoder required.")
+	}
+	o.or = or
+	if o.batcher, err = NewOutputBatcher(o.Batch, o.flush, or, h); err != nil {
+		return
+	}
+	o.batcher.Start()
+
+	var (
+		outgoing, record []byte
+		e                error
+	)
+	for pack := range or.InChan() {
+		if outgoing, e = or.Encode(pack); e == nil && outgoing != nil {
+			record, e = o.makeEntry(pack.Message, outgoing)
+		}
+		pack.Recycle()
+		if e != nil {
+			or.LogError(e)
+			atomic.AddInt64(&o.dropMessageCount, 1)
+			continue
+		}
+		if outgoing == nil {
+			continue
+		}
+		o.batcher.Add(record)
+	}
+	o.batcher.Stop()
+	return
+}
+
+// Satisfies the `pipeline.ReportingPlugin` interface to provide plugin state
+// information to the Heka report and dashboard.
+func (o *SnsOutput) ReportMsg(msg *message.Message) error {
+	o.reportLock.Lock()
+	defer o.reportLock.Unlock()
+
+	message.NewInt64Field(msg, "ProcessMessageCount",
+		atomic.LoadInt64(&o.processMessageCount), "count")
+	message.NewInt64Field(msg, "DropMessageCount",
+		atomic.LoadInt64(&o.dropMessageCount), "count")
+	if o.batcher != nil {
+		o.batcher.ReportMsg(msg)
+	}
+	return nil
+}
+
+func init() {
+	RegisterPlugin("SnsOutput", func() interface{} {
+		return new(SnsOutput)
+	})
+}
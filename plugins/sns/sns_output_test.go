@@ -0,0 +1,167 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package sns
+
+import (
+	"encoding/json"
+	"github.com/mozilla-services/heka/message"
+	pipeline_ts "github.com/mozilla-services/heka/pipeline/testsupport"
+	plugins_ts "github.com/mozilla-services/heka/plugins/testsupport"
+	"github.com/rafrombrc/gomock/gomock"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+)
+
+func SnsOutputSpec(c gs.Context) {
+	t := new(pipeline_ts.SimpleT)
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	output := new(SnsOutput)
+	config := output.ConfigStruct().(*SnsOutputConfig)
+	config.AccessKeyId = "AKIDEXAMPLE"
+	config.SecretAccessKey = "secret"
+	config.TopicArn = "arn:aws:sns:us-east-1:123456789012:heka"
+
+	msg := pipeline_ts.GetTestMessage()
+	field, _ := message.NewField("count", int64(3), "")
+	msg.AddField(field)
+
+	c.Specify("An SnsOutput", func() {
+		c.Specify("requires a topic", func() {
+			config.TopicArn = ""
+			err := output.Init(config)
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+
+		c.Specify("limits the batch size", func() {
+			config.Batch.FlushCount = 11
+			err := output.Init(config)
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+
+		c.Specify("generates publish entries", func() {
+			config.Subject = "%{Type} from %{Hostname}"
+			config.MessageGroupId = "%{Logger}"
+			config.AttributeFields = []string{"foo", "count", "missing"}
+			err := output.Init(config)
+			c.Assume(err, gs.IsNil)
+
+			record, err := output.makeEntry(msg, []byte("hello"))
+			c.Assume(err, gs.IsNil)
+			entry := new(snsEntry)
+			json.Unmarshal(record, entry)
+			params := output.publishParams([]*snsEntry{entry})
+
+			prefix := "PublishBatchRequestEntries.member.1."
+			c.Expect(params.Get("Action"), gs.Equals, "PublishBatch")
+			c.Expect(params.Get("TopicArn"), gs.Equals, config.TopicArn)
+			c.Expect(params.Get(prefix+"Message"), gs.Equals, "hello")
+			c.Expect(params.Get(prefix+"Subject"), gs.Equals, "TEST from my.host.name")
+			c.Expect(params.Get(prefix+"MessageGroupId"), gs.Equals, "GoSpec")
+			c.Expect(params.Get(prefix+"MessageDeduplicationId"), gs.Equals,
+				msg.GetUuidString())
+			attrPrefix := prefix + "MessageAttributes.entry."
+			c.Expect(params.Get(attrPrefix+"1.Name"), gs.Equals, "foo")
+			c.Expect(params.Get(attrPrefix+"1.Value.DataType"), gs.Equals, "String")
+			c.Expect(params.Get(attrPrefix+"1.Value.StringValue"), gs.Equals, "bar")
+			c.Expect(params.Get(attrPrefix+"2.Value.DataType"), gs.Equals, "Number")
+			c.Expect(params.Get(attrPrefix+"2.Value.StringValue"), gs.Equals, "3")
+			c.Expect(params.Get(attrPrefix+"3.Name"), gs.Equals, "")
+		})
+
+		c.Specify("rejects binary contents", func() {
+			err := output.Init(config)
+			c.Assume(err, gs.IsNil)
+			_, err = output.makeEntry(msg, []byte{0xff, 0xfe})
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+
+		c.Specify("publishes batches", func() {
+			var (
+				requests []url.Values
+				status   = http.StatusOK
+				respBody = "<PublishBatchResponse><PublishBatchResult>" +
+					"<Successful/><Failed/></PublishBatchResult></PublishBatchResponse>"
+				auth string
+			)
+			server := httptest.NewServer(http.HandlerFunc(
+				func(w http.ResponseWriter, r *http.Request) {
+					auth = r.Header.Get("Authorization")
+					r.ParseForm()
+					requests = append(requests, r.PostForm)
+					w.WriteHeader(status)
+					w.Write([]byte(respBody))
+				}))
+			defer server.Close()
+
+			config.Endpoint = server.URL
+			err := output.Init(config)
+			c.Assume(err, gs.IsNil)
+			oth := plugins_ts.NewOutputTestHelper(ctrl)
+			output.or = oth.MockOutputRunner
+			record, _ := output.makeEntry(msg, []byte("hello"))
+
+			c.Specify("in requests of at most ten messages", func() {
+				records := make([][]byte, 12)
+				for i := range records {
+					records[i] = record
+				}
+				err = output.flush(records)
+				c.Expect(err, gs.IsNil)
+				c.Expect(len(requests), gs.Equals, 2)
+				c.Expect(requests[1].Get("PublishBatchRequestEntries.member.2.Message"),
+					gs.Equals, "hello")
+				c.Expect(requests[1].Get("PublishBatchRequestEntries.member.3.Message"),
+					gs.Equals, "")
+				c.Expect(strings.Contains(auth, "/us-east-1/sns/aws4_request"), gs.IsTrue)
+				c.Expect(output.processMessageCount, gs.Equals, int64(12))
+			})
+
+			c.Specify("and drops the entries SNS rejects", func() {
+				respBody = "<PublishBatchResponse><PublishBatchResult><Successful/>" +
+					"<Failed><member><Id>0</Id><Code>InvalidParameter</Code>" +
+					"<Message>bad</Message><SenderFault>true</SenderFault></member>" +
+					"</Failed></PublishBatchResult></PublishBatchResponse>"
+				oth.MockOutputRunner.EXPECT().LogError(gomock.Any())
+				err = output.flush([][]byte{record, record})
+				c.Expect(err, gs.IsNil)
+				c.Expect(output.processMessageCount, gs.Equals, int64(1))
+				c.Expect(output.dropMessageCount, gs.Equals, int64(1))
+			})
+
+			c.Specify("and asks for a retry when throttled", func() {
+				status = http.StatusBadRequest
+				respBody = "<ErrorResponse><Error><Code>Throttling</Code>" +
+					"<Message>Rate exceeded</Message></Error></ErrorResponse>"
+				err = output.flush([][]byte{record})
+				c.Expect(err, gs.Not(gs.IsNil))
+			})
+
+			c.Specify("and drops batches SNS rejects", func() {
+				status = http.StatusForbidden
+				respBody = "<ErrorResponse><Error><Code>AuthorizationError</Code>" +
+					"<Message>denied</Message></Error></ErrorResponse>"
+				oth.MockOutputRunner.EXPECT().LogError(gomock.Any())
+				err = output.flush([][]byte{record})
+				c.Expect(err, gs.IsNil)
+				c.Expect(output.dropMessageCount, gs.Equals, int64(1))
+			})
+		})
+	})
+}
@@ -0,0 +1,347 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package splunk
+
+import (
+	"bytes"
+	"code.google.com/p/go-uuid/uuid"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/mozilla-services/heka/message"
+	. "github.com/mozilla-services/heka/pipeline"
+	"github.com/mozilla-services/heka/plugins"
+	"github.com/mozilla-services/heka/plugins/tcp"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Output plugin that sends messages to a Splunk HTTP Event Collector.
+type SplunkOutput struct {
+	*SplunkOutputConfig
+	client              *http.Client
+	ackUrl              string
+	processMessageCount int64
+	dropMessageCount    int64
+	ackTimeoutCount     int64
+	reportLock          sync.Mutex
+	batcher             *Batcher
+	or                  OutputRunner
+	useEncoder          bool
+}
+
+// ConfigStruct for SplunkOutput plugin.
+type SplunkOutputConfig struct {
+	// URL of the collector's event endpoint.
+	Url string
+	// HEC token.
+	Token string
+	// Event metadata templates, may contain `%{<name>}` placeholders. Empty
+	// templates leave the choice to the token's defaults.
+	Host       string
+	Source     string
+	Sourcetype string
+	Index      string
+	// Dynamic message fields sent as indexed fields.
+	IndexFields []string `toml:"index_fields"`
+	// Whether to wait for the collector to acknowledge each batch before
+	// it's considered sent.
+	UseAck bool `toml:"use_ack"`
+	// Channel used for acknowledgements, a GUID. One is generated if empty.
+	Channel string
+	// How long to wait for a batch to be acknowledged, in milliseconds.
+	AckTimeout uint32 `toml:"ack_timeout"`
+	// How often the ack endpoint is polled, in milliseconds.
+	AckPollInterval uint32 `toml:"ack_poll_interval"`
+	// Batching settings, from the `batch` subsection.
+	Batch BatchConfig `toml:"batch"`
+	// HTTP request timeout, in milliseconds. 0 means no timeout.
+	HttpTimeout uint32 `toml:"http_timeout"`
+	Tls         tcp.TlsConfig
+}
+
+// A single event in the collector's JSON event format.
+type hecEvent struct {
+	Time       json.Number       `json:"time"`
+	Host       string            `json:"host,omitempty"`
+	Source     string            `json:"source,omitempty"`
+	Sourcetype string            `json:"sourcetype,omitempty"`
+	Index      string            `json:"index,omitempty"`
+	Event      json.RawMessage   `json:"event"`
+	Fields     map[string]string `json:"fields,omitempty"`
+}
+
+type hecResponse struct {
+	Text  string `json:"text"`
+	Code  int    `json:"code"`
+	AckId *int64 `json:"ackId"`
+}
+
+type hecAckRequest struct {
+	Acks []int64 `json:"acks"`
+}
+
+type hecAckResponse struct {
+	Acks map[string]bool `json:"acks"`
+}
+
+func (o *SplunkOutput) ConfigStruct() interface{} {
+	return &SplunkOutputConfig{
+		Url:             "https://localhost:8088/services/collector/event",
+		Host:            "%{Hostname}",
+		Source:          "%{Logger}",
+		Sourcetype:      "%{Type}",
+		AckTimeout:      30000,
+		AckPollInterval: 1000,
+		HttpTimeout:     5000,
+		Batch:           DefaultBatchConfig(),
+	}
+}
+
+func (o *SplunkOutput) Init(config interface{}) (err error) {
+	o.SplunkOutputConfig = config.(*SplunkOutputConfig)
+
+	if o.Token == "" {
+		return errors.New("`token` setting is required")
+	}
+	u, err := url.Parse(o.Url)
+	if err != nil {
+		return fmt.Errorf("can't parse URL '%s': %s", o.Url, err.Error())
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return errors.New("`url` must contain an absolute http or https URL")
+	}
+	if o.UseAck {
+		if o.Channel == "" {
+			o.Channel = uuid.NewRandom().String()
+		} else if uuid.Parse(o.Channel) == nil {
+			return fmt.Errorf("`channel` must be a GUID: %s", o.Channel)
+		}
+		if o.AckPollInterval == 0 {
+			return errors.New("`ack_poll_interval` must be greater than 0")
+		}
+		// The ack endpoint is the event endpoint's sibling.
+		o.ackUrl = u.ResolveReference(&url.URL{Path: "ack"}).String()
+	}
+
+	o.client = new(http.Client)
+	if o.HttpTimeout > 0 {
+		o.client.Timeout = time.Duration(o.HttpTimeout) * time.Millisecond
+	}
+	if u.Scheme == "https" {
+		transport := &http.Transport{}
+		if transport.TLSClientConfig, err = tcp.CreateGoTlsConfig(&o.Tls); err != nil {
+			return fmt.Errorf("TLS init error: %s", err.Error())
+		}
+		o.client.Transport = transport
+	}
+	err = o.Batch.Validate()
+	return
+}
+
+// Generates the JSON encoded event for a message. The event is the output's
+// encoder output if it has an encoder, the message payload otherwise.
+func (o *SplunkOutput) makeEvent(pack *PipelinePack) ([]byte, error) {
+	msg := pack.Message
+	var body []byte
+	if o.useEncoder {
+		encoded, err := o.or.Encode(pack)
+		if err != nil {
+			return nil, err
+		}
+		if encoded == nil {
+			return nil, nil
+		}
+		body = encoded
+	} else {
+		body = []byte(msg.GetPayload())
+	}
+	// Encoded JSON is embedded as is so Splunk extracts its fields, anything
+	// else is sent as a string.
+	var event json.RawMessage
+	if !bytes.HasPrefix(bytes.TrimSpace(body), []byte("{")) ||
+		json.Unmarshal(body, &event) != nil {
+
+		var err error
+		if event, err = json.Marshal(string(body)); err != nil {
+			return nil, err
+		}
+	}
+
+	ts := msg.GetTimestamp()
+	e := &hecEvent{
+		Time: json.Number(fmt.Sprintf("%d.%03d", ts/int64(time.Second),
+			ts%int64(time.Second)/int64(time.Millisecond))),
+		Host:       plugins.InterpolateMessageString(o.Host, msg),
+		Source:     plugins.InterpolateMessageString(o.Source, msg),
+		Sourcetype: plugins.InterpolateMessageString(o.Sourcetype, msg),
+		Index:      plugins.InterpolateMessageString(o.Index, msg),
+		Event:      event,
+	}
+	for _, name := range o.IndexFields {
+		if val, ok := msg.GetFieldValue(name); ok {
+			if e.Fields == nil {
+				e.Fields = make(map[string]string)
+			}
+			e.Fields[name] = fmt.Sprintf("%v", val)
+		}
+	}
+	return json.Marshal(e)
+}
+
+// Makes a request to the collector, returning the response body for
+// successful requests. The returned bool is set if a failed request should
+// be retried.
+func (o *SplunkOutput) request(reqUrl string, body []byte) ([]byte, bool, error) {
+	req, err := http.NewRequest("POST", reqUrl, bytes.NewReader(body))
+	if err != nil {
+		return nil, false, fmt.Errorf("can't create HTTP request: %s", err.Error())
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Splunk "+o.Token)
+	if o.UseAck {
+		req.Header.Set("X-Splunk-Request-Channel", o.Channel)
+	}
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return nil, true, fmt.Errorf("error making HTTP request: %s", err.Error())
+	}
+	defer resp.Body.Close()
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode < 300 {
+		if err != nil {
+			return nil, true, fmt.Errorf("can't read response: %s", err.Error())
+		}
+		return respBody, false, nil
+	}
+	err = fmt.Errorf("Splunk request failed: %s - %s", resp.Status,
+		strings.TrimSpace(string(respBody)))
+	return nil, resp.StatusCode == 429 || resp.StatusCode >= 500, err
+}
+
+// Polls the ack endpoint until the collector acknowledges ackId or the
+// ack timeout passes.
+func (o *SplunkOutput) waitForAck(ackId int64) error {
+	body, err := json.Marshal(&hecAckRequest{Acks: []int64{ackId}})
+	if err != nil {
+		return err
+	}
+	key := strconv.FormatInt(ackId, 10)
+	deadline := time.Now().Add(time.Duration(o.AckTimeout) * time.Millisecond)
+	for {
+		respBody, _, err := o.request(o.ackUrl, body)
+		if err == nil {
+			resp := new(hecAckResponse)
+			if err = json.Unmarshal(respBody, resp); err == nil && resp.Acks[key] {
+				return nil
+			}
+		}
+		if !time.Now().Before(deadline) {
+			atomic.AddInt64(&o.ackTimeoutCount, 1)
+			return fmt.Errorf("batch w/ ack ID %d wasn't acknowledged in time", ackId)
+		}
+		time.Sleep(time.Duration(o.AckPollInterval) * time.Millisecond)
+	}
+}
+
+// Satisfies `pipeline.BatchFlushFunc`, sending a batch of JSON encoded
+// events. When acks are in use a batch is only sent once it's acknowledged,
+// batches that aren't are retried and may be indexed twice.
+func (o *SplunkOutput) flush(records [][]byte) error {
+	body := bytes.Join(records, []byte("\n"))
+	respBody, retry, err := o.request(o.Url, body)
+	if err != nil {
+		if retry {
+			return err
+		}
+		o.or.LogError(err)
+		atomic.AddInt64(&o.dropMessageCount, int64(len(records)))
+		return nil
+	}
+	if o.UseAck {
+		resp := new(hecResponse)
+		if err = json.Unmarshal(respBody, resp); err != nil {
+			return fmt.Errorf("can't parse response: %s", err.Error())
+		}
+		if resp.AckId == nil {
+			return errors.New("response has no ack ID, is indexer " +
+				"acknowledgement enabled for the token?")
+		}
+		if err = o.waitForAck(*resp.AckId); err != nil {
+			return err
+		}
+	}
+	atomic.AddInt64(&o.processMessageCount, int64(len(records)))
+	return nil
+}
+
+func (o *SplunkOutput) Run(or OutputRunner, h PluginHelper) (err error) {
+	o.or = or
+	o.useEncoder = or.Encoder() != nil
+	if o.batcher, err = NewOutputBatcher(o.Batch, o.flush, or, h); err != nil {
+		return
+	}
+	o.batcher.Start()
+
+	var (
+		record []byte
+		e      error
+	)
+	for pack := range or.InChan() {
+		record, e = o.makeEvent(pack)
+		pack.Recycle()
+		if e != nil {
+			or.LogError(e)
+			atomic.AddInt64(&o.dropMessageCount, 1)
+			continue
+		}
+		if record != nil {
+			o.batcher.Add(record)
+		}
+	}
+	o.batcher.Stop()
+	return
+}
+
+// Satisfies the `pipeline.ReportingPlugin` interface to provide plugin state
+// information to the Heka report and dashboard.
+func (o *SplunkOutput) ReportMsg(msg *message.Message) error {
+	o.reportLock.Lock()
+	defer o.reportLock.Unlock()
+
+	message.NewInt64Field(msg, "ProcessMessageCount",
+		atomic.LoadInt64(&o.processMessageCount), "count")
+	message.NewInt64Field(msg, "DropMessageCount",
+		atomic.LoadInt64(&o.dropMessageCount), "count")
+	message.NewInt64Field(msg, "AckTimeoutCount",
+		atomic.LoadInt64(&o.ackTimeoutCount), "count")
+	if o.batcher != nil {
+		o.batcher.ReportMsg(msg)
+	}
+	return nil
+}
+
+func init() {
+	RegisterPlugin("SplunkOutput", func() interface{} {
+		return new(SplunkOutput)
+	})
+}
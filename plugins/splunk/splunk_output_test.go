@@ -0,0 +1,200 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package splunk
+
+import (
+	"encoding/json"
+	"github.com/mozilla-services/heka/message"
+	. "github.com/mozilla-services/heka/pipeline"
+	pipeline_ts "github.com/mozilla-services/heka/pipeline/testsupport"
+	plugins_ts "github.com/mozilla-services/heka/plugins/testsupport"
+	"github.com/rafrombrc/gomock/gomock"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+)
+
+func SplunkOutputSpec(c gs.Context) {
+	t := new(pipeline_ts.SimpleT)
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	output := new(SplunkOutput)
+	config := output.ConfigStruct().(*SplunkOutputConfig)
+	config.Token = "0123-4567"
+
+	msg := pipeline_ts.GetTestMessage()
+	field, _ := message.NewField("status", int64(200), "")
+	msg.AddField(field)
+	pack := NewPipelinePack(nil)
+	pack.Message = msg
+
+	decode := func(record []byte) (e hecEvent) {
+		json.Unmarshal(record, &e)
+		return
+	}
+
+	c.Specify("A SplunkOutput", func() {
+		c.Specify("requires a token", func() {
+			config.Token = ""
+			err := output.Init(config)
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+
+		c.Specify("rejects a channel that isn't a GUID", func() {
+			config.UseAck = true
+			config.Channel = "heka"
+			err := output.Init(config)
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+
+		c.Specify("generates a channel for acks", func() {
+			config.UseAck = true
+			err := output.Init(config)
+			c.Expect(err, gs.IsNil)
+			c.Expect(len(output.Channel), gs.Equals, 36)
+			c.Expect(output.ackUrl, gs.Equals, "https://localhost:8088/services/collector/ack")
+		})
+
+		c.Specify("converts messages to events", func() {
+			config.Index = "web_%{Logger}"
+			config.IndexFields = []string{"status", "missing"}
+			err := output.Init(config)
+			c.Assume(err, gs.IsNil)
+			record, err := output.makeEvent(pack)
+			c.Assume(err, gs.IsNil)
+			e := decode(record)
+			c.Expect(string(e.Time), gs.Equals, "1136239445.000")
+			c.Expect(e.Host, gs.Equals, "my.host.name")
+			c.Expect(e.Source, gs.Equals, "GoSpec")
+			c.Expect(e.Sourcetype, gs.Equals, "TEST")
+			c.Expect(e.Index, gs.Equals, "web_GoSpec")
+			c.Expect(string(e.Event), gs.Equals, `"Test Payload"`)
+			c.Expect(len(e.Fields), gs.Equals, 1)
+			c.Expect(e.Fields["status"], gs.Equals, "200")
+		})
+
+		c.Specify("embeds JSON encoder output", func() {
+			err := output.Init(config)
+			c.Assume(err, gs.IsNil)
+			oth := plugins_ts.NewOutputTestHelper(ctrl)
+			output.or = oth.MockOutputRunner
+			output.useEncoder = true
+
+			oth.MockOutputRunner.EXPECT().Encode(pack).Return([]byte(`{"a": 1}`), nil)
+			record, err := output.makeEvent(pack)
+			c.Assume(err, gs.IsNil)
+			c.Expect(string(decode(record).Event), gs.Equals, `{"a":1}`)
+
+			oth.MockOutputRunner.EXPECT().Encode(pack).Return([]byte("{not json"), nil)
+			record, err = output.makeEvent(pack)
+			c.Assume(err, gs.IsNil)
+			c.Expect(string(decode(record).Event), gs.Equals, `"{not json"`)
+		})
+
+		c.Specify("sends batches", func() {
+			var (
+				events   []string
+				status   = http.StatusOK
+				acked    = true
+				auth     string
+				channel  string
+				ackPolls int
+			)
+			server := httptest.NewServer(http.HandlerFunc(
+				func(w http.ResponseWriter, r *http.Request) {
+					body, _ := ioutil.ReadAll(r.Body)
+					channel = r.Header.Get("X-Splunk-Request-Channel")
+					if strings.HasSuffix(r.URL.Path, "/ack") {
+						ackPolls++
+						if !strings.Contains(string(body), "7") {
+							w.WriteHeader(http.StatusBadRequest)
+							return
+						}
+						resp := &hecAckResponse{Acks: map[string]bool{"7": acked}}
+						json.NewEncoder(w).Encode(resp)
+						return
+					}
+					auth = r.Header.Get("Authorization")
+					events = strings.Split(string(body), "\n")
+					w.WriteHeader(status)
+					if channel != "" {
+						w.Write([]byte(`{"text":"Success","code":0,"ackId":7}`))
+					} else {
+						w.Write([]byte(`{"text":"Success","code":0}`))
+					}
+				}))
+			defer server.Close()
+
+			config.Url = server.URL + "/services/collector/event"
+			config.AckTimeout = 0
+
+			c.Specify("to the collector", func() {
+				err := output.Init(config)
+				c.Assume(err, gs.IsNil)
+				record, _ := output.makeEvent(pack)
+				err = output.flush([][]byte{record, record})
+				c.Expect(err, gs.IsNil)
+				c.Expect(auth, gs.Equals, "Splunk 0123-4567")
+				c.Expect(len(events), gs.Equals, 2)
+				c.Expect(decode([]byte(events[1])).Sourcetype, gs.Equals, "TEST")
+				c.Expect(output.processMessageCount, gs.Equals, int64(2))
+			})
+
+			c.Specify("and waits for acks", func() {
+				config.UseAck = true
+				config.Channel = "9f6c2b8e-3a43-4d55-8d3b-7d7f0b4ad0c1"
+				err := output.Init(config)
+				c.Assume(err, gs.IsNil)
+				record, _ := output.makeEvent(pack)
+				err = output.flush([][]byte{record})
+				c.Expect(err, gs.IsNil)
+				c.Expect(channel, gs.Equals, config.Channel)
+				c.Expect(ackPolls, gs.Equals, 1)
+				c.Expect(output.processMessageCount, gs.Equals, int64(1))
+
+				c.Specify("retrying batches that aren't acknowledged", func() {
+					acked = false
+					err = output.flush([][]byte{record})
+					c.Expect(err, gs.Not(gs.IsNil))
+					c.Expect(output.ackTimeoutCount, gs.Equals, int64(1))
+					c.Expect(output.processMessageCount, gs.Equals, int64(1))
+				})
+			})
+
+			c.Specify("and asks for a retry when the collector is busy", func() {
+				status = http.StatusServiceUnavailable
+				err := output.Init(config)
+				c.Assume(err, gs.IsNil)
+				err = output.flush([][]byte{[]byte("{}")})
+				c.Expect(err, gs.Not(gs.IsNil))
+			})
+
+			c.Specify("and drops batches the collector rejects", func() {
+				status = http.StatusBadRequest
+				err := output.Init(config)
+				c.Assume(err, gs.IsNil)
+				oth := plugins_ts.NewOutputTestHelper(ctrl)
+				oth.MockOutputRunner.EXPECT().LogError(gomock.Any())
+				output.or = oth.MockOutputRunner
+				err = output.flush([][]byte{[]byte("{}")})
+				c.Expect(err, gs.IsNil)
+				c.Expect(output.dropMessageCount, gs.Equals, int64(1))
+			})
+		})
+	})
+}
@@ -0,0 +1,378 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package sql
+
+import (
+	"bytes"
+	proto "code.google.com/p/gogoprotobuf/proto"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/mozilla-services/heka/client"
+	"github.com/mozilla-services/heka/message"
+	. "github.com/mozilla-services/heka/pipeline"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	_ "github.com/go-sql-driver/mysql"
+	_ "github.com/lib/pq"
+)
+
+// Output plugin that inserts message data into a SQL database table.
+type SqlOutput struct {
+	*SqlOutputConfig
+	db                  *sql.DB
+	stmt                *sql.Stmt
+	columns             []string
+	insert              string
+	retryHelper         *RetryHelper
+	deadLetter          *os.File
+	batch               []*sqlRow
+	processMessageCount int64
+	dropMessageCount    int64
+	reportLock          sync.Mutex
+}
+
+// ConfigStruct for SqlOutput plugin.
+type SqlOutputConfig struct {
+	// Database driver name, "postgres" or "mysql".
+	Driver string
+	// Driver specific data source name.
+	Dsn string
+	// Table the rows are inserted into.
+	Table string
+	// Map of column name to the message header or field name its value is
+	// taken from.
+	Columns map[string]string
+	// Number of rows inserted in a single transaction.
+	BatchSize int `toml:"batch_size"`
+	// Interval at which accumulated rows will be inserted, in milliseconds.
+	FlushInterval uint32 `toml:"flush_interval"`
+	// What to do when a batch can't be inserted: "retry", "drop", or
+	// "dead_letter".
+	OnError string `toml:"on_error"`
+	// Maximum number of retries when `on_error` is "retry". -1 means retry
+	// forever.
+	MaxRetries int `toml:"max_retries"`
+	// File that failed messages are written to when `on_error` is
+	// "dead_letter", relative to Heka's base_dir.
+	DeadLetterPath string `toml:"dead_letter_path"`
+}
+
+// Column values for a single message, along w/ the protobuf encoded
+// message if it might need to be dead lettered.
+type sqlRow struct {
+	values   []interface{}
+	msgBytes []byte
+}
+
+func (o *SqlOutput) ConfigStruct() interface{} {
+	return &SqlOutputConfig{
+		BatchSize:     100,
+		FlushInterval: 1000,
+		OnError:       "retry",
+		MaxRetries:    -1,
+	}
+}
+
+// Quotes an identifier in the style of the database driver.
+func quoteIdent(driver, ident string) string {
+	if driver == "mysql" {
+		return "`" + strings.Replace(ident, "`", "``", -1) + "`"
+	}
+	return `"` + strings.Replace(ident, `"`, `""`, -1) + `"`
+}
+
+// Generates the INSERT statement, using the placeholder style of the
+// database driver.
+func insertStatement(driver, table string, columns []string) string {
+	quoted := make([]string, len(columns))
+	placeholders := make([]string, len(columns))
+	for i, column := range columns {
+		quoted[i] = quoteIdent(driver, column)
+		if driver == "postgres" {
+			placeholders[i] = fmt.Sprintf("$%d", i+1)
+		} else {
+			placeholders[i] = "?"
+		}
+	}
+	return fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)", quoteIdent(driver, table),
+		strings.Join(quoted, ", "), strings.Join(placeholders, ", "))
+}
+
+func (o *SqlOutput) Init(config interface{}) (err error) {
+	o.SqlOutputConfig = config.(*SqlOutputConfig)
+
+	if o.Driver == "" || o.Dsn == "" {
+		return errors.New("`driver` and `dsn` settings are required")
+	}
+	if o.Table == "" {
+		return errors.New("`table` setting is required")
+	}
+	if len(o.Columns) == 0 {
+		return errors.New("at least one column must be configured")
+	}
+	if o.BatchSize < 1 {
+		return errors.New("`batch_size` must be at least 1")
+	}
+	switch o.OnError {
+	case "retry", "drop":
+	case "dead_letter":
+		if o.DeadLetterPath == "" {
+			return errors.New("`dead_letter_path` is required w/ on_error = 'dead_letter'")
+		}
+	default:
+		return fmt.Errorf("`on_error` must be 'retry', 'drop', or 'dead_letter', got %s",
+			o.OnError)
+	}
+
+	o.columns = make([]string, 0, len(o.Columns))
+	for column := range o.Columns {
+		o.columns = append(o.columns, column)
+	}
+	sort.Strings(o.columns)
+	o.insert = insertStatement(o.Driver, o.Table, o.columns)
+
+	o.retryHelper, err = NewRetryHelper(o.retryOptions())
+	if err != nil {
+		return fmt.Errorf("can't create retry helper: %s", err.Error())
+	}
+
+	// This doesn't connect, so an unavailable database won't prevent Heka
+	// from starting.
+	if o.db, err = sql.Open(o.Driver, o.Dsn); err != nil {
+		return fmt.Errorf("can't open database: %s", err)
+	}
+	return
+}
+
+// Extracts the value for a column from a message. Message headers are
+// referenced by name, e.g. "Timestamp" or "Hostname", anything else is
+// looked up as a dynamic field. Missing fields result in a NULL.
+func columnValue(msg *message.Message, source string) interface{} {
+	switch source {
+	case "Timestamp":
+		return time.Unix(0, msg.GetTimestamp()).UTC()
+	case "Type":
+		return msg.GetType()
+	case "Logger":
+		return msg.GetLogger()
+	case "Hostname":
+		return msg.GetHostname()
+	case "EnvVersion":
+		return msg.GetEnvVersion()
+	case "Severity":
+		return int64(msg.GetSeverity())
+	case "Pid":
+		return int64(msg.GetPid())
+	case "Uuid":
+		return msg.GetUuidString()
+	case "Payload":
+		return msg.GetPayload()
+	}
+	if val, ok := msg.GetFieldValue(source); ok {
+		return val
+	}
+	return nil
+}
+
+// Generates the row for a message.
+func (o *SqlOutput) row(msg *message.Message) (row *sqlRow, err error) {
+	row = &sqlRow{values: make([]interface{}, len(o.columns))}
+	for i, column := range o.columns {
+		row.values[i] = columnValue(msg, o.Columns[column])
+	}
+	if o.OnError == "dead_letter" {
+		if row.msgBytes, err = proto.Marshal(msg); err != nil {
+			return nil, err
+		}
+	}
+	return
+}
+
+// Inserts the rows in a single transaction.
+func (o *SqlOutput) insertRows(rows []*sqlRow) (err error) {
+	if o.stmt == nil {
+		if o.stmt, err = o.db.Prepare(o.insert); err != nil {
+			o.stmt = nil
+			return fmt.Errorf("can't prepare insert statement: %s", err)
+		}
+	}
+	tx, err := o.db.Begin()
+	if err != nil {
+		return fmt.Errorf("can't start transaction: %s", err)
+	}
+	stmt := tx.Stmt(o.stmt)
+	for _, row := range rows {
+		if _, err = stmt.Exec(row.values...); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("insert failed: %s", err)
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("commit failed: %s", err)
+	}
+	return
+}
+
+// Appends the messages to the dead letter file, using Heka's stream framing
+// so they can be replayed.
+func (o *SqlOutput) writeDeadLetters(rows []*sqlRow) (err error) {
+	var framed []byte
+	buf := new(bytes.Buffer)
+	for _, row := range rows {
+		if err = client.CreateHekaStream(row.msgBytes, &framed, nil); err != nil {
+			return
+		}
+		buf.Write(framed)
+	}
+	_, err = o.deadLetter.Write(buf.Bytes())
+	return
+}
+
+// Inserts the current batch, handling failures according to the `on_error`
+// setting. Returns the error if the batch was dropped.
+func (o *SqlOutput) flush(or OutputRunner) (err error) {
+	if len(o.batch) == 0 {
+		return
+	}
+	defer func() {
+		o.batch = o.batch[:0]
+	}()
+
+	o.retryHelper.Reset()
+	for {
+		if err = o.insertRows(o.batch); err == nil {
+			return
+		}
+		if o.OnError != "retry" || o.retryHelper.Wait() != nil {
+			break
+		}
+		or.LogMessage(fmt.Sprintf("%s; retrying", err.Error()))
+	}
+
+	if o.OnError == "dead_letter" {
+		if e := o.writeDeadLetters(o.batch); e != nil {
+			return fmt.Errorf("%s; can't write dead letters: %s", err, e)
+		}
+		or.LogError(fmt.Errorf("%s; %d messages written to %s", err, len(o.batch),
+			o.deadLetter.Name()))
+		return nil
+	}
+	return
+}
+
+// The output's own retry settings, which a `backoff` section can override.
+func (o *SqlOutput) retryOptions() RetryOptions {
+	return RetryOptions{
+		MaxDelay:   "30s",
+		Delay:      "250ms",
+		MaxRetries: o.MaxRetries,
+	}
+}
+
+func (o *SqlOutput) Run(or OutputRunner, h PluginHelper) (err error) {
+	var (
+		ok     = true
+		pack   *PipelinePack
+		row    *sqlRow
+		e      error
+		inChan = or.InChan()
+		tick   <-chan time.Time
+	)
+	if o.retryHelper, err = NewRunnerRetryHelper(or, o.retryOptions()); err != nil {
+		o.db.Close()
+		return fmt.Errorf("can't create retry helper: %s", err.Error())
+	}
+
+	defer func() {
+		if o.stmt != nil {
+			o.stmt.Close()
+			o.stmt = nil
+		}
+		o.db.Close()
+	}()
+
+	if o.OnError == "dead_letter" {
+		path := h.PipelineConfig().Globals.PrependBaseDir(o.DeadLetterPath)
+		o.deadLetter, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return fmt.Errorf("can't open dead letter file: %s", err)
+		}
+		defer o.deadLetter.Close()
+	}
+
+	if o.FlushInterval > 0 {
+		ticker := time.NewTicker(time.Duration(o.FlushInterval) * time.Millisecond)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	flush := func() {
+		count := int64(len(o.batch))
+		if e := o.flush(or); e != nil {
+			or.LogError(e)
+			atomic.AddInt64(&o.dropMessageCount, count)
+		} else {
+			atomic.AddInt64(&o.processMessageCount, count)
+		}
+	}
+
+	for ok {
+		select {
+		case pack, ok = <-inChan:
+			if !ok {
+				flush()
+				break
+			}
+			row, e = o.row(pack.Message)
+			pack.Recycle()
+			if e != nil {
+				or.LogError(e)
+				atomic.AddInt64(&o.dropMessageCount, 1)
+				continue
+			}
+			if o.batch = append(o.batch, row); len(o.batch) >= o.BatchSize {
+				flush()
+			}
+		case <-tick:
+			flush()
+		}
+	}
+	return
+}
+
+// Satisfies the `pipeline.ReportingPlugin` interface to provide plugin state
+// information to the Heka report and dashboard.
+func (o *SqlOutput) ReportMsg(msg *message.Message) error {
+	o.reportLock.Lock()
+	defer o.reportLock.Unlock()
+
+	message.NewInt64Field(msg, "ProcessMessageCount",
+		atomic.LoadInt64(&o.processMessageCount), "count")
+	message.NewInt64Field(msg, "DropMessageCount",
+		atomic.LoadInt64(&o.dropMessageCount), "count")
+	return nil
+}
+
+func init() {
+	RegisterPlugin("SqlOutput", func() interface{} {
+		return new(SqlOutput)
+	})
+}
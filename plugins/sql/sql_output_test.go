@@ -0,0 +1,197 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package sql
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"github.com/mozilla-services/heka/message"
+	. "github.com/mozilla-services/heka/pipeline"
+	pipeline_ts "github.com/mozilla-services/heka/pipeline/testsupport"
+	plugins_ts "github.com/mozilla-services/heka/plugins/testsupport"
+	"github.com/rafrombrc/gomock/gomock"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+// Fake database driver that records the executed statements.
+type fakeDb struct {
+	query     string
+	execs     [][]driver.Value
+	commits   int
+	rollbacks int
+	failExecs int
+}
+
+var testDb = new(fakeDb)
+
+type fakeDriver struct{}
+
+func (d fakeDriver) Open(name string) (driver.Conn, error) { return fakeConn{}, nil }
+
+type fakeConn struct{}
+
+func (c fakeConn) Prepare(query string) (driver.Stmt, error) {
+	testDb.query = query
+	return fakeStmt{}, nil
+}
+func (c fakeConn) Close() error              { return nil }
+func (c fakeConn) Begin() (driver.Tx, error) { return fakeTx{}, nil }
+
+type fakeStmt struct{}
+
+func (s fakeStmt) Close() error  { return nil }
+func (s fakeStmt) NumInput() int { return -1 }
+func (s fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	if testDb.failExecs > 0 {
+		testDb.failExecs--
+		return nil, errors.New("exec failed")
+	}
+	testDb.execs = append(testDb.execs, args)
+	return driver.RowsAffected(1), nil
+}
+func (s fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return nil, errors.New("not supported")
+}
+
+type fakeTx struct{}
+
+func (t fakeTx) Commit() error   { testDb.commits++; return nil }
+func (t fakeTx) Rollback() error { testDb.rollbacks++; return nil }
+
+func init() {
+	sql.Register("heka_fake", fakeDriver{})
+}
+
+func SqlOutputSpec(c gs.Context) {
+	t := new(pipeline_ts.SimpleT)
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	msg := pipeline_ts.GetTestMessage()
+	field, _ := message.NewField("count", int64(3), "")
+	msg.AddField(field)
+
+	c.Specify("Insert statements", func() {
+		columns := []string{"a", "b"}
+		c.Expect(insertStatement("postgres", "logs", columns), gs.Equals,
+			`INSERT INTO "logs" ("a", "b") VALUES ($1, $2)`)
+		c.Expect(insertStatement("mysql", "logs", columns), gs.Equals,
+			"INSERT INTO `logs` (`a`, `b`) VALUES (?, ?)")
+	})
+
+	c.Specify("A SqlOutput", func() {
+		*testDb = fakeDb{}
+		output := new(SqlOutput)
+		config := output.ConfigStruct().(*SqlOutputConfig)
+		config.Driver = "heka_fake"
+		config.Dsn = "test"
+		config.Table = "logs"
+		config.Columns = map[string]string{
+			"ts":      "Timestamp",
+			"host":    "Hostname",
+			"foo":     "foo",
+			"count":   "count",
+			"missing": "missing",
+		}
+		oth := plugins_ts.NewOutputTestHelper(ctrl)
+
+		c.Specify("requires a table", func() {
+			config.Table = ""
+			err := output.Init(config)
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+
+		c.Specify("inserts a batch in a transaction", func() {
+			err := output.Init(config)
+			c.Assume(err, gs.IsNil)
+			row, err := output.row(msg)
+			c.Assume(err, gs.IsNil)
+			output.batch = append(output.batch, row, row)
+			err = output.flush(oth.MockOutputRunner)
+			c.Expect(err, gs.IsNil)
+
+			c.Expect(testDb.query, gs.Equals, `INSERT INTO "logs" `+
+				`("count", "foo", "host", "missing", "ts") VALUES (?, ?, ?, ?, ?)`)
+			c.Expect(testDb.commits, gs.Equals, 1)
+			c.Expect(len(testDb.execs), gs.Equals, 2)
+			values := testDb.execs[0]
+			c.Expect(values[0], gs.Equals, int64(3))
+			c.Expect(values[1], gs.Equals, "bar")
+			c.Expect(values[2], gs.Equals, "my.host.name")
+			c.Expect(values[3], gs.IsNil)
+			c.Expect(values[4].(time.Time).Unix(), gs.Equals, int64(1136239445))
+			c.Expect(len(output.batch), gs.Equals, 0)
+		})
+
+		c.Specify("retries a failed batch", func() {
+			err := output.Init(config)
+			c.Assume(err, gs.IsNil)
+			output.retryHelper, _ = NewRetryHelper(RetryOptions{
+				Delay:      "1ms",
+				MaxDelay:   "1ms",
+				MaxRetries: 3,
+			})
+			testDb.failExecs = 1
+			row, _ := output.row(msg)
+			output.batch = append(output.batch, row)
+			oth.MockOutputRunner.EXPECT().LogMessage(gomock.Any())
+			err = output.flush(oth.MockOutputRunner)
+			c.Expect(err, gs.IsNil)
+			c.Expect(testDb.rollbacks, gs.Equals, 1)
+			c.Expect(testDb.commits, gs.Equals, 1)
+		})
+
+		c.Specify("drops a failed batch", func() {
+			config.OnError = "drop"
+			err := output.Init(config)
+			c.Assume(err, gs.IsNil)
+			testDb.failExecs = 1
+			row, _ := output.row(msg)
+			output.batch = append(output.batch, row)
+			err = output.flush(oth.MockOutputRunner)
+			c.Expect(err, gs.Not(gs.IsNil))
+			c.Expect(len(output.batch), gs.Equals, 0)
+		})
+
+		c.Specify("writes failed messages to the dead letter file", func() {
+			config.OnError = "dead_letter"
+			config.DeadLetterPath = "dead.log"
+			err := output.Init(config)
+			c.Assume(err, gs.IsNil)
+			output.deadLetter, err = ioutil.TempFile("", "heka-sql-test")
+			c.Assume(err, gs.IsNil)
+			defer func() {
+				output.deadLetter.Close()
+				os.Remove(output.deadLetter.Name())
+			}()
+
+			testDb.failExecs = 1
+			row, _ := output.row(msg)
+			output.batch = append(output.batch, row)
+			oth.MockOutputRunner.EXPECT().LogError(gomock.Any())
+			err = output.flush(oth.MockOutputRunner)
+			c.Expect(err, gs.IsNil)
+
+			data, err := ioutil.ReadFile(output.deadLetter.Name())
+			c.Expect(err, gs.IsNil)
+			c.Expect(data[0], gs.Equals, byte(0x1e))
+			c.Expect(len(data) > len(row.msgBytes), gs.IsTrue)
+		})
+	})
+}
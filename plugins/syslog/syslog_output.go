@@ -0,0 +1,357 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package syslog
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"github.com/mozilla-services/heka/message"
+	. "github.com/mozilla-services/heka/pipeline"
+	"github.com/mozilla-services/heka/plugins"
+	"github.com/mozilla-services/heka/plugins/tcp"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Syslog facility names, as used by RFC 5424.
+var facilities = map[string]int{
+	"kern":     0,
+	"user":     1,
+	"mail":     2,
+	"daemon":   3,
+	"auth":     4,
+	"syslog":   5,
+	"lpr":      6,
+	"news":     7,
+	"uucp":     8,
+	"cron":     9,
+	"authpriv": 10,
+	"ftp":      11,
+	"ntp":      12,
+	"security": 13,
+	"console":  14,
+	"clock":    15,
+	"local0":   16,
+	"local1":   17,
+	"local2":   18,
+	"local3":   19,
+	"local4":   20,
+	"local5":   21,
+	"local6":   22,
+	"local7":   23,
+}
+
+// Output plugin that re-emits messages as RFC 5424 syslog messages over UDP,
+// TCP, or TLS.
+type SyslogOutput struct {
+	*SyslogOutputConfig
+	facility            int
+	tlsConfig           *tls.Config
+	conn                net.Conn
+	fields              map[string]bool
+	processMessageCount int64
+	dropMessageCount    int64
+	reportLock          sync.Mutex
+}
+
+// ConfigStruct for SyslogOutput plugin.
+type SyslogOutputConfig struct {
+	// Transport, one of "udp", "tcp", or "tls".
+	Net string
+	// Address of the syslog server.
+	Address string
+	// Default facility name.
+	Facility string
+	// Message field that can override the facility on a per message basis.
+	FacilityField string `toml:"facility_field"`
+	// Header and message templates, may contain `%{<name>}` placeholders.
+	Hostname string
+	AppName  string `toml:"app_name"`
+	MsgId    string `toml:"msg_id"`
+	Message  string
+	// SD-ID of the structured data element generated from the message
+	// fields. Empty means no structured data is generated.
+	SdId string `toml:"sd_id"`
+	// Dynamic message fields included in the structured data. If empty, all
+	// fields are included.
+	Fields []string
+	// Framing used for stream transports, "octet_counting" or
+	// "non_transparent".
+	Framing string
+	// Maximum size of a UDP message, longer messages are truncated.
+	MaxMessageSize int `toml:"max_message_size"`
+	// Connection timeout, in milliseconds.
+	ConnectTimeout uint32 `toml:"connect_timeout"`
+	Tls            tcp.TlsConfig
+}
+
+func (o *SyslogOutput) ConfigStruct() interface{} {
+	return &SyslogOutputConfig{
+		Net:            "udp",
+		Address:        "localhost:514",
+		Facility:       "user",
+		Hostname:       "%{Hostname}",
+		AppName:        "%{Logger}",
+		MsgId:          "%{Type}",
+		Message:        "%{Payload}",
+		SdId:           "fields@32473",
+		Framing:        "octet_counting",
+		MaxMessageSize: 2048,
+		ConnectTimeout: 5000,
+	}
+}
+
+func (o *SyslogOutput) Init(config interface{}) (err error) {
+	o.SyslogOutputConfig = config.(*SyslogOutputConfig)
+
+	switch o.Net {
+	case "udp", "tcp":
+	case "tls":
+		if o.tlsConfig, err = tcp.CreateGoTlsConfig(&o.Tls); err != nil {
+			return fmt.Errorf("TLS init error: %s", err)
+		}
+	default:
+		return fmt.Errorf("`net` must be 'udp', 'tcp', or 'tls', got %s", o.Net)
+	}
+	switch o.Framing {
+	case "octet_counting", "non_transparent":
+	default:
+		return fmt.Errorf("unknown `framing`: %s", o.Framing)
+	}
+	var ok bool
+	if o.facility, ok = facilities[o.Facility]; !ok {
+		return fmt.Errorf("unknown `facility`: %s", o.Facility)
+	}
+	if o.SdId != "" && !validSdName(o.SdId) {
+		return fmt.Errorf("invalid `sd_id`: %s", o.SdId)
+	}
+	if len(o.Fields) > 0 {
+		o.fields = make(map[string]bool)
+		for _, name := range o.Fields {
+			o.fields[name] = true
+		}
+	}
+	return
+}
+
+// Returns whether a string can be used as an SD-ID or PARAM-NAME.
+func validSdName(name string) bool {
+	if len(name) == 0 || len(name) > 32 {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if c <= ' ' || c > '~' || c == '=' || c == ']' || c == '"' {
+			return false
+		}
+	}
+	return true
+}
+
+// Converts a value to a valid header field, replacing characters that
+// aren't allowed and truncating it to the maximum length. Empty values are
+// replaced w/ the NILVALUE.
+func headerField(value string, maxLen int) string {
+	if value == "" {
+		return "-"
+	}
+	value = strings.Map(func(r rune) rune {
+		if r <= ' ' || r > '~' {
+			return '_'
+		}
+		return r
+	}, value)
+	if len(value) > maxLen {
+		value = value[:maxLen]
+	}
+	return value
+}
+
+// Converts a field name to a valid PARAM-NAME.
+func paramName(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if r <= ' ' || r > '~' || r == '=' || r == ']' || r == '"' {
+			return '_'
+		}
+		return r
+	}, name)
+	if len(name) > 32 {
+		name = name[:32]
+	}
+	return name
+}
+
+var paramEscaper = strings.NewReplacer(`"`, `\"`, `\`, `\\`, `]`, `\]`)
+
+// Returns the PRI value for the message.
+func (o *SyslogOutput) priority(msg *message.Message) int {
+	facility := o.facility
+	if o.FacilityField != "" {
+		if val, ok := msg.GetFieldValue(o.FacilityField); ok {
+			switch v := val.(type) {
+			case string:
+				if f, ok := facilities[v]; ok {
+					facility = f
+				}
+			case int64:
+				if v >= 0 && v <= 23 {
+					facility = int(v)
+				}
+			}
+		}
+	}
+	severity := int(msg.GetSeverity())
+	if severity < 0 || severity > 7 {
+		severity = 7
+	}
+	return facility*8 + severity
+}
+
+// Appends the RFC 5424 representation of the message to the buffer.
+func (o *SyslogOutput) writeMessage(msg *message.Message, buf *bytes.Buffer) {
+	ts := time.Unix(0, msg.GetTimestamp()).UTC()
+	procId := "-"
+	if pid := msg.GetPid(); pid != 0 {
+		procId = strconv.Itoa(int(pid))
+	}
+	fmt.Fprintf(buf, "<%d>1 %s %s %s %s %s ", o.priority(msg),
+		ts.Format("2006-01-02T15:04:05.000000Z07:00"),
+		headerField(plugins.InterpolateMessageString(o.Hostname, msg), 255),
+		headerField(plugins.InterpolateMessageString(o.AppName, msg), 48),
+		procId,
+		headerField(plugins.InterpolateMessageString(o.MsgId, msg), 32))
+
+	params := 0
+	if o.SdId != "" {
+		for _, field := range msg.Fields {
+			if o.fields != nil && !o.fields[field.GetName()] {
+				continue
+			}
+			value := field.GetValue()
+			if value == nil {
+				continue
+			}
+			if params == 0 {
+				buf.WriteByte('[')
+				buf.WriteString(o.SdId)
+			}
+			var valStr string
+			if b, ok := value.([]byte); ok {
+				valStr = string(b)
+			} else {
+				valStr = fmt.Sprint(value)
+			}
+			fmt.Fprintf(buf, ` %s="%s"`, paramName(field.GetName()),
+				paramEscaper.Replace(valStr))
+			params++
+		}
+	}
+	if params > 0 {
+		buf.WriteByte(']')
+	} else {
+		buf.WriteByte('-')
+	}
+
+	if text := plugins.InterpolateMessageString(o.Message, msg); text != "" {
+		buf.WriteByte(' ')
+		buf.WriteString(text)
+	}
+}
+
+// Adds transport framing to a message.
+func (o *SyslogOutput) frame(data []byte) []byte {
+	if o.Net == "udp" {
+		if len(data) > o.MaxMessageSize {
+			data = data[:o.MaxMessageSize]
+		}
+		return data
+	}
+	if o.Framing == "non_transparent" {
+		data = bytes.Replace(data, []byte{'\n'}, []byte{' '}, -1)
+		return append(data, '\n')
+	}
+	return append([]byte(strconv.Itoa(len(data))+" "), data...)
+}
+
+// Writes data to the syslog server, connecting first if necessary.
+func (o *SyslogOutput) send(data []byte) (err error) {
+	if o.conn == nil {
+		timeout := time.Duration(o.ConnectTimeout) * time.Millisecond
+		switch o.Net {
+		case "tls":
+			dialer := &net.Dialer{Timeout: timeout}
+			o.conn, err = tls.DialWithDialer(dialer, "tcp", o.Address, o.tlsConfig)
+		default:
+			o.conn, err = net.DialTimeout(o.Net, o.Address, timeout)
+		}
+		if err != nil {
+			o.conn = nil
+			return fmt.Errorf("can't connect to %s: %s", o.Address, err)
+		}
+	}
+	if _, err = o.conn.Write(data); err != nil {
+		o.conn.Close()
+		o.conn = nil
+		return fmt.Errorf("writing to %s: %s", o.Address, err)
+	}
+	return
+}
+
+func (o *SyslogOutput) Run(or OutputRunner, h PluginHelper) (err error) {
+	defer func() {
+		if o.conn != nil {
+			o.conn.Close()
+			o.conn = nil
+		}
+	}()
+
+	buf := new(bytes.Buffer)
+	for pack := range or.InChan() {
+		buf.Reset()
+		o.writeMessage(pack.Message, buf)
+		pack.Recycle()
+		if e := o.send(o.frame(buf.Bytes())); e != nil {
+			or.LogError(e)
+			atomic.AddInt64(&o.dropMessageCount, 1)
+			continue
+		}
+		atomic.AddInt64(&o.processMessageCount, 1)
+	}
+	return
+}
+
+// Satisfies the `pipeline.ReportingPlugin` interface to provide plugin state
+// information to the Heka report and dashboard.
+func (o *SyslogOutput) ReportMsg(msg *message.Message) error {
+	o.reportLock.Lock()
+	defer o.reportLock.Unlock()
+
+	message.NewInt64Field(msg, "ProcessMessageCount",
+		atomic.LoadInt64(&o.processMessageCount), "count")
+	message.NewInt64Field(msg, "DropMessageCount",
+		atomic.LoadInt64(&o.dropMessageCount), "count")
+	return nil
+}
+
+func init() {
+	RegisterPlugin("SyslogOutput", func() interface{} {
+		return new(SyslogOutput)
+	})
+}
@@ -0,0 +1,107 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package syslog
+
+import (
+	"bytes"
+	"github.com/mozilla-services/heka/message"
+	pipeline_ts "github.com/mozilla-services/heka/pipeline/testsupport"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+	"net"
+	"time"
+)
+
+func SyslogOutputSpec(c gs.Context) {
+	output := new(SyslogOutput)
+	config := output.ConfigStruct().(*SyslogOutputConfig)
+	msg := pipeline_ts.GetTestMessage()
+
+	c.Specify("A SyslogOutput", func() {
+		buf := new(bytes.Buffer)
+
+		c.Specify("generates RFC 5424 messages", func() {
+			err := output.Init(config)
+			c.Assume(err, gs.IsNil)
+			output.writeMessage(msg, buf)
+			c.Expect(buf.String(), gs.Equals, "<14>1 2006-01-02T22:04:05.000000Z "+
+				`my.host.name GoSpec 43 TEST [fields@32473 foo="bar"] Test Payload`)
+		})
+
+		c.Specify("escapes structured data and honors the facility field", func() {
+			config.Facility = "local0"
+			config.FacilityField = "facility"
+			config.Fields = []string{"quote", "facility"}
+			err := output.Init(config)
+			c.Assume(err, gs.IsNil)
+			field, _ := message.NewField("quote", `say "hi"]`, "")
+			msg.AddField(field)
+			field, _ = message.NewField("facility", "daemon", "")
+			msg.AddField(field)
+			msg.SetSeverity(2)
+			msg.SetLogger("my app")
+			output.writeMessage(msg, buf)
+			c.Expect(buf.String(), gs.Equals, "<26>1 2006-01-02T22:04:05.000000Z "+
+				`my.host.name my_app 43 TEST [fields@32473 quote="say \"hi\"\]" `+
+				`facility="daemon"] Test Payload`)
+		})
+
+		c.Specify("omits structured data w/o an SD-ID", func() {
+			config.SdId = ""
+			config.Facility = "local0"
+			err := output.Init(config)
+			c.Assume(err, gs.IsNil)
+			output.writeMessage(msg, buf)
+			c.Expect(buf.String(), gs.Equals, "<134>1 2006-01-02T22:04:05.000000Z "+
+				"my.host.name GoSpec 43 TEST - Test Payload")
+		})
+
+		c.Specify("rejects an unknown facility", func() {
+			config.Facility = "bogus"
+			err := output.Init(config)
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+
+		c.Specify("frames stream messages", func() {
+			config.Net = "tcp"
+			err := output.Init(config)
+			c.Assume(err, gs.IsNil)
+			c.Expect(string(output.frame([]byte("hello"))), gs.Equals, "5 hello")
+			output.Framing = "non_transparent"
+			c.Expect(string(output.frame([]byte("a\nb"))), gs.Equals, "a b\n")
+		})
+
+		c.Specify("sends messages over UDP", func() {
+			addr, err := net.ResolveUDPAddr("udp", "127.0.0.1:0")
+			c.Assume(err, gs.IsNil)
+			conn, err := net.ListenUDP("udp", addr)
+			c.Assume(err, gs.IsNil)
+			defer conn.Close()
+
+			config.Address = conn.LocalAddr().String()
+			config.MaxMessageSize = 10
+			err = output.Init(config)
+			c.Assume(err, gs.IsNil)
+			err = output.send(output.frame([]byte("0123456789abcdef")))
+			c.Expect(err, gs.IsNil)
+
+			received := make([]byte, 100)
+			conn.SetReadDeadline(time.Now().Add(time.Second))
+			n, err := conn.Read(received)
+			c.Expect(err, gs.IsNil)
+			c.Expect(string(received[:n]), gs.Equals, "0123456789")
+			output.conn.Close()
+		})
+	})
+}
@@ -0,0 +1,150 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package tail
+
+import (
+	"errors"
+	"fmt"
+	"github.com/mozilla-services/heka/message"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+)
+
+// Errors returned when a client can't be accepted right now.
+var (
+	errTooManyClients = errors.New("too many clients")
+	errClosed         = errors.New("output is shutting down")
+)
+
+// A connected client, receiving the encoded messages its matcher selects.
+type subscriber struct {
+	spec     *message.MatcherSpecification
+	messages chan []byte
+}
+
+// Tracks the connected clients and hands each of them its messages. Clients
+// that don't keep up miss messages rather than slowing down the output.
+type hub struct {
+	lock             sync.Mutex
+	subscribers      map[*subscriber]bool
+	maxClients       int
+	bufferSize       int
+	closed           bool
+	clientCount      int64
+	dropMessageCount int64
+}
+
+func newHub(maxClients, bufferSize int) *hub {
+	return &hub{
+		subscribers: make(map[*subscriber]bool),
+		maxClients:  maxClients,
+		bufferSize:  bufferSize,
+	}
+}
+
+// Registers a client w/ the given matcher expression.
+func (h *hub) subscribe(matcher string) (*subscriber, error) {
+	spec, err := message.CreateMatcherSpecification(matcher)
+	if err != nil {
+		return nil, fmt.Errorf("invalid matcher: %s", err)
+	}
+	sub := &subscriber{spec: spec, messages: make(chan []byte, h.bufferSize)}
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.closed {
+		return nil, errClosed
+	}
+	if h.maxClients > 0 && len(h.subscribers) >= h.maxClients {
+		return nil, errTooManyClients
+	}
+	h.subscribers[sub] = true
+	atomic.StoreInt64(&h.clientCount, int64(len(h.subscribers)))
+	return sub, nil
+}
+
+// Returns the HTTP status for a subscribe error.
+func subscribeErrorStatus(err error) int {
+	if err == errTooManyClients || err == errClosed {
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusBadRequest
+}
+
+// Returns whether an origin, as sent by browsers, matches one of the
+// allowed origins, which are either full origins or hosts. "*" allows any
+// origin.
+func originAllowed(allowed []string, origin string) bool {
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	for _, a := range allowed {
+		if a == "*" || a == origin || a == u.Host {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *hub) unsubscribe(sub *subscriber) {
+	h.lock.Lock()
+	delete(h.subscribers, sub)
+	atomic.StoreInt64(&h.clientCount, int64(len(h.subscribers)))
+	h.lock.Unlock()
+}
+
+// Disconnects all clients by closing their message channels.
+func (h *hub) close() {
+	h.lock.Lock()
+	h.closed = true
+	for sub := range h.subscribers {
+		close(sub.messages)
+		delete(h.subscribers, sub)
+	}
+	atomic.StoreInt64(&h.clientCount, 0)
+	h.lock.Unlock()
+}
+
+// Sends a message to every client whose matcher it matches. The message is
+// only encoded if there's at least one of them. Returns whether any client
+// received the message.
+func (h *hub) publish(msg *message.Message, encode func() ([]byte, error)) (
+	sent bool, err error) {
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	var contents []byte
+	for sub := range h.subscribers {
+		if !sub.spec.Match(msg) {
+			continue
+		}
+		if contents == nil {
+			if contents, err = encode(); err != nil || contents == nil {
+				return
+			}
+		}
+		select {
+		case sub.messages <- contents:
+			sent = true
+		default:
+			atomic.AddInt64(&h.dropMessageCount, 1)
+		}
+	}
+	return
+}
@@ -0,0 +1,222 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package tail
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/mozilla-services/heka/message"
+	. "github.com/mozilla-services/heka/pipeline"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Output plugin that streams the messages matching each client's matcher
+// as Server-Sent Events, for environments where WebSockets are blocked.
+type SseOutput struct {
+	*SseOutputConfig
+	hub                 *hub
+	listener            net.Listener
+	processMessageCount int64
+	reportLock          sync.Mutex
+}
+
+// ConfigStruct for SseOutput plugin.
+type SseOutputConfig struct {
+	// TCP address the endpoint listens on.
+	Address string
+	// URL path clients connect to.
+	Path string
+	// Matcher used for clients that don't send one.
+	DefaultMatcher string `toml:"default_matcher"`
+	// Maximum number of connected clients. 0 means no limit.
+	MaxClients int `toml:"max_clients"`
+	// Number of messages buffered for each client before messages are
+	// dropped for it.
+	ClientBuffer int `toml:"client_buffer"`
+	// Origins browsers may connect from on other sites, "*" allows any.
+	AllowedOrigins []string `toml:"allowed_origins"`
+	// Event type of the events, the default "message" type if empty.
+	EventType string `toml:"event_type"`
+	// Interval at which heartbeat comments are sent to keep the connection
+	// open, in milliseconds. 0 disables heartbeats.
+	HeartbeatInterval uint32 `toml:"heartbeat_interval"`
+}
+
+func (o *SseOutput) ConfigStruct() interface{} {
+	return &SseOutputConfig{
+		Address:           "127.0.0.1:4354",
+		Path:              "/tail",
+		DefaultMatcher:    "TRUE",
+		MaxClients:        20,
+		ClientBuffer:      1000,
+		HeartbeatInterval: 15000,
+	}
+}
+
+func (o *SseOutput) Init(config interface{}) (err error) {
+	o.SseOutputConfig = config.(*SseOutputConfig)
+
+	if !strings.HasPrefix(o.Path, "/") {
+		return errors.New("`path` must begin with '/'")
+	}
+	if _, err = message.CreateMatcherSpecification(o.DefaultMatcher); err != nil {
+		return fmt.Errorf("invalid `default_matcher`: %s", err)
+	}
+	if o.ClientBuffer < 1 {
+		return errors.New("`client_buffer` must be at least 1")
+	}
+	if strings.ContainsAny(o.EventType, "\r\n") {
+		return errors.New("`event_type` must not contain line breaks")
+	}
+	o.hub = newHub(o.MaxClients, o.ClientBuffer)
+	return
+}
+
+// Formats encoded contents as an event. Each line of the contents becomes a
+// data line, so multi-line contents arrive unchanged.
+func (o *SseOutput) formatEvent(contents []byte) []byte {
+	buf := new(bytes.Buffer)
+	if o.EventType != "" {
+		buf.WriteString("event: " + o.EventType + "\n")
+	}
+	contents = bytes.TrimRight(contents, "\r\n")
+	for _, line := range bytes.Split(contents, []byte("\n")) {
+		buf.WriteString("data: ")
+		buf.Write(bytes.TrimRight(line, "\r"))
+		buf.WriteByte('\n')
+	}
+	buf.WriteByte('\n')
+	return buf.Bytes()
+}
+
+// Streams the matching messages as an event stream. Clients pass their
+// matcher in the `matcher` query parameter.
+func (o *SseOutput) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	if origin := req.Header.Get("Origin"); origin != "" &&
+		originAllowed(o.AllowedOrigins, origin) {
+
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+	}
+	matcher := req.URL.Query().Get("matcher")
+	if matcher == "" {
+		matcher = o.DefaultMatcher
+	}
+	sub, err := o.hub.subscribe(matcher)
+	if err != nil {
+		http.Error(w, err.Error(), subscribeErrorStatus(err))
+		return
+	}
+	defer o.hub.unsubscribe(sub)
+
+	var gone <-chan bool
+	if notifier, ok := w.(http.CloseNotifier); ok {
+		gone = notifier.CloseNotify()
+	}
+	var heartbeats <-chan time.Time
+	if o.HeartbeatInterval > 0 {
+		ticker := time.NewTicker(time.Duration(o.HeartbeatInterval) * time.Millisecond)
+		defer ticker.Stop()
+		heartbeats = ticker.C
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	for {
+		select {
+		case contents, ok := <-sub.messages:
+			if !ok {
+				return
+			}
+			if _, err = w.Write(o.formatEvent(contents)); err != nil {
+				return
+			}
+		case <-heartbeats:
+			if _, err = w.Write([]byte(": heartbeat\n\n")); err != nil {
+				return
+			}
+		case <-gone:
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+func (o *SseOutput) Run(or OutputRunner, h PluginHelper) (err error) {
+	if or.Encoder() == nil {
+		return errors.New("Encoder required.")
+	}
+	if o.listener, err = net.Listen("tcp", o.Address); err != nil {
+		return fmt.Errorf("can't listen on %s: %s", o.Address, err)
+	}
+	defer o.listener.Close()
+	or.LogMessage(fmt.Sprintf("Serving event stream tails on %s%s",
+		o.listener.Addr(), o.Path))
+
+	mux := http.NewServeMux()
+	mux.Handle(o.Path, o)
+	go http.Serve(o.listener, mux)
+
+	var (
+		sent bool
+		e    error
+	)
+	for pack := range or.InChan() {
+		sent, e = o.hub.publish(pack.Message, func() ([]byte, error) {
+			return or.Encode(pack)
+		})
+		pack.Recycle()
+		if e != nil {
+			or.LogError(e)
+		} else if sent {
+			atomic.AddInt64(&o.processMessageCount, 1)
+		}
+	}
+	o.hub.close()
+	return
+}
+
+// Satisfies the `pipeline.ReportingPlugin` interface to provide plugin state
+// information to the Heka report and dashboard.
+func (o *SseOutput) ReportMsg(msg *message.Message) error {
+	o.reportLock.Lock()
+	defer o.reportLock.Unlock()
+
+	message.NewInt64Field(msg, "ProcessMessageCount",
+		atomic.LoadInt64(&o.processMessageCount), "count")
+	message.NewInt64Field(msg, "DropMessageCount",
+		atomic.LoadInt64(&o.hub.dropMessageCount), "count")
+	message.NewInt64Field(msg, "ClientCount",
+		atomic.LoadInt64(&o.hub.clientCount), "count")
+	return nil
+}
+
+func init() {
+	RegisterPlugin("SseOutput", func() interface{} {
+		return new(SseOutput)
+	})
+}
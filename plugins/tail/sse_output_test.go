@@ -0,0 +1,92 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package tail
+
+import (
+	"bufio"
+	pipeline_ts "github.com/mozilla-services/heka/pipeline/testsupport"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+)
+
+func SseOutputSpec(c gs.Context) {
+	output := new(SseOutput)
+	config := output.ConfigStruct().(*SseOutputConfig)
+	msg := pipeline_ts.GetTestMessage()
+
+	c.Specify("An SseOutput", func() {
+		c.Specify("formats multi-line events", func() {
+			config.EventType = "heka"
+			err := output.Init(config)
+			c.Assume(err, gs.IsNil)
+			event := output.formatEvent([]byte("{\"a\":\n1}\n"))
+			c.Expect(string(event), gs.Equals, "event: heka\ndata: {\"a\":\ndata: 1}\n\n")
+		})
+
+		c.Specify("streams matching messages to clients", func() {
+			config.HeartbeatInterval = 10
+			config.AllowedOrigins = []string{"*"}
+			err := output.Init(config)
+			c.Assume(err, gs.IsNil)
+			server := httptest.NewServer(output)
+			defer server.Close()
+
+			req, _ := http.NewRequest("GET", server.URL+"/tail?matcher="+
+				url.QueryEscape("Type == 'TEST'"), nil)
+			req.Header.Set("Origin", "https://dashboard.example.com")
+			resp, err := http.DefaultClient.Do(req)
+			c.Assume(err, gs.IsNil)
+			defer resp.Body.Close()
+			c.Expect(resp.Header.Get("Content-Type"), gs.Equals, "text/event-stream")
+			c.Expect(resp.Header.Get("Access-Control-Allow-Origin"), gs.Equals,
+				"https://dashboard.example.com")
+			reader := bufio.NewReader(resp.Body)
+
+			line, err := reader.ReadString('\n')
+			c.Expect(err, gs.IsNil)
+			c.Expect(line, gs.Equals, ": heartbeat\n")
+			reader.ReadString('\n')
+
+			sent, err := output.hub.publish(msg, func() ([]byte, error) {
+				return []byte(msg.GetPayload()), nil
+			})
+			c.Expect(err, gs.IsNil)
+			c.Expect(sent, gs.IsTrue)
+			for line == ": heartbeat\n" || line == "\n" {
+				line, err = reader.ReadString('\n')
+				c.Assume(err, gs.IsNil)
+			}
+			c.Expect(line, gs.Equals, "data: Test Payload\n")
+
+			output.hub.close()
+			for err == nil {
+				_, err = reader.ReadString('\n')
+			}
+		})
+
+		c.Specify("rejects invalid matchers", func() {
+			err := output.Init(config)
+			c.Assume(err, gs.IsNil)
+			server := httptest.NewServer(output)
+			defer server.Close()
+			resp, err := http.Get(server.URL + "/tail?matcher=" + url.QueryEscape("Type =="))
+			c.Assume(err, gs.IsNil)
+			resp.Body.Close()
+			c.Expect(resp.StatusCode, gs.Equals, http.StatusBadRequest)
+		})
+	})
+}
@@ -0,0 +1,224 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package tail
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"github.com/mozilla-services/heka/message"
+	. "github.com/mozilla-services/heka/pipeline"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Output plugin that serves a WebSocket endpoint, sending each connected
+// client the messages matching the matcher it connected w/.
+type WebSocketOutput struct {
+	*WebSocketOutputConfig
+	hub                 *hub
+	upgrader            *websocket.Upgrader
+	listener            net.Listener
+	processMessageCount int64
+	reportLock          sync.Mutex
+}
+
+// ConfigStruct for WebSocketOutput plugin.
+type WebSocketOutputConfig struct {
+	// TCP address the endpoint listens on.
+	Address string
+	// URL path clients connect to.
+	Path string
+	// Matcher used for clients that don't send one.
+	DefaultMatcher string `toml:"default_matcher"`
+	// Maximum number of connected clients. 0 means no limit.
+	MaxClients int `toml:"max_clients"`
+	// Number of messages buffered for each client before messages are
+	// dropped for it.
+	ClientBuffer int `toml:"client_buffer"`
+	// Origins browsers may connect from, "*" allows any. If empty, only
+	// same origin connections are accepted.
+	AllowedOrigins []string `toml:"allowed_origins"`
+	// Interval at which clients are pinged to keep the connection open, in
+	// milliseconds. 0 disables pings.
+	PingInterval uint32 `toml:"ping_interval"`
+	// Timeout for each write to a client, in milliseconds.
+	WriteTimeout uint32 `toml:"write_timeout"`
+}
+
+func (o *WebSocketOutput) ConfigStruct() interface{} {
+	return &WebSocketOutputConfig{
+		Address:        "127.0.0.1:4353",
+		Path:           "/tail",
+		DefaultMatcher: "TRUE",
+		MaxClients:     20,
+		ClientBuffer:   1000,
+		PingInterval:   30000,
+		WriteTimeout:   10000,
+	}
+}
+
+func (o *WebSocketOutput) Init(config interface{}) (err error) {
+	o.WebSocketOutputConfig = config.(*WebSocketOutputConfig)
+
+	if !strings.HasPrefix(o.Path, "/") {
+		return errors.New("`path` must begin with '/'")
+	}
+	if _, err = message.CreateMatcherSpecification(o.DefaultMatcher); err != nil {
+		return fmt.Errorf("invalid `default_matcher`: %s", err)
+	}
+	if o.ClientBuffer < 1 {
+		return errors.New("`client_buffer` must be at least 1")
+	}
+	o.hub = newHub(o.MaxClients, o.ClientBuffer)
+	o.upgrader = &websocket.Upgrader{}
+	if len(o.AllowedOrigins) > 0 {
+		o.upgrader.CheckOrigin = o.checkOrigin
+	}
+	return
+}
+
+// Checks the request's origin against the allowed origins.
+func (o *WebSocketOutput) checkOrigin(req *http.Request) bool {
+	origin := req.Header.Get("Origin")
+	return origin == "" || originAllowed(o.AllowedOrigins, origin)
+}
+
+// Reads and discards what the client sends, so control frames are handled.
+// The returned channel is closed once the connection is gone.
+func readLoop(conn *websocket.Conn) chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				close(done)
+				return
+			}
+		}
+	}()
+	return done
+}
+
+// Upgrades a request to a WebSocket connection and streams the matching
+// messages to it. Clients pass their matcher in the `matcher` query
+// parameter.
+func (o *WebSocketOutput) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	matcher := req.URL.Query().Get("matcher")
+	if matcher == "" {
+		matcher = o.DefaultMatcher
+	}
+	sub, err := o.hub.subscribe(matcher)
+	if err != nil {
+		http.Error(w, err.Error(), subscribeErrorStatus(err))
+		return
+	}
+	defer o.hub.unsubscribe(sub)
+
+	conn, err := o.upgrader.Upgrade(w, req, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	done := readLoop(conn)
+
+	var pings <-chan time.Time
+	if o.PingInterval > 0 {
+		ticker := time.NewTicker(time.Duration(o.PingInterval) * time.Millisecond)
+		defer ticker.Stop()
+		pings = ticker.C
+	}
+	timeout := time.Duration(o.WriteTimeout) * time.Millisecond
+	for {
+		select {
+		case contents, ok := <-sub.messages:
+			if !ok {
+				conn.WriteControl(websocket.CloseMessage,
+					websocket.FormatCloseMessage(websocket.CloseGoingAway, ""),
+					time.Now().Add(timeout))
+				return
+			}
+			conn.SetWriteDeadline(time.Now().Add(timeout))
+			if err = conn.WriteMessage(websocket.TextMessage, contents); err != nil {
+				return
+			}
+		case <-pings:
+			err = conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(timeout))
+			if err != nil {
+				return
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+func (o *WebSocketOutput) Run(or OutputRunner, h PluginHelper) (err error) {
+	if or.Encoder() == nil {
+		return errors.New("Encoder required.")
+	}
+	if o.listener, err = net.Listen("tcp", o.Address); err != nil {
+		return fmt.Errorf("can't listen on %s: %s", o.Address, err)
+	}
+	defer o.listener.Close()
+	or.LogMessage(fmt.Sprintf("Serving WebSocket tails on %s%s", o.listener.Addr(),
+		o.Path))
+
+	mux := http.NewServeMux()
+	mux.Handle(o.Path, o)
+	go http.Serve(o.listener, mux)
+
+	var (
+		sent bool
+		e    error
+	)
+	for pack := range or.InChan() {
+		sent, e = o.hub.publish(pack.Message, func() ([]byte, error) {
+			return or.Encode(pack)
+		})
+		pack.Recycle()
+		if e != nil {
+			or.LogError(e)
+		} else if sent {
+			atomic.AddInt64(&o.processMessageCount, 1)
+		}
+	}
+	o.hub.close()
+	return
+}
+
+// Satisfies the `pipeline.ReportingPlugin` interface to provide plugin state
+// information to the Heka report and dashboard.
+func (o *WebSocketOutput) ReportMsg(msg *message.Message) error {
+	o.reportLock.Lock()
+	defer o.reportLock.Unlock()
+
+	message.NewInt64Field(msg, "ProcessMessageCount",
+		atomic.LoadInt64(&o.processMessageCount), "count")
+	message.NewInt64Field(msg, "DropMessageCount",
+		atomic.LoadInt64(&o.hub.dropMessageCount), "count")
+	message.NewInt64Field(msg, "ClientCount",
+		atomic.LoadInt64(&o.hub.clientCount), "count")
+	return nil
+}
+
+func init() {
+	RegisterPlugin("WebSocketOutput", func() interface{} {
+		return new(WebSocketOutput)
+	})
+}
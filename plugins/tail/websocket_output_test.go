@@ -0,0 +1,138 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package tail
+
+import (
+	"github.com/gorilla/websocket"
+	pipeline_ts "github.com/mozilla-services/heka/pipeline/testsupport"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+)
+
+func WebSocketOutputSpec(c gs.Context) {
+	output := new(WebSocketOutput)
+	config := output.ConfigStruct().(*WebSocketOutputConfig)
+	msg := pipeline_ts.GetTestMessage()
+	encode := func() ([]byte, error) {
+		return []byte(msg.GetPayload()), nil
+	}
+
+	c.Specify("A WebSocketOutput", func() {
+		c.Specify("rejects an invalid default matcher", func() {
+			config.DefaultMatcher = "Type =="
+			err := output.Init(config)
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+
+		c.Specify("streams matching messages to clients", func() {
+			config.MaxClients = 2
+			err := output.Init(config)
+			c.Assume(err, gs.IsNil)
+			server := httptest.NewServer(output)
+			defer server.Close()
+			wsUrl := "ws" + strings.TrimPrefix(server.URL, "http") + "/tail"
+
+			dial := func(matcher string) (*websocket.Conn, *http.Response, error) {
+				return websocket.DefaultDialer.Dial(
+					wsUrl+"?matcher="+url.QueryEscape(matcher), nil)
+			}
+			matching, _, err := dial("Type == 'TEST'")
+			c.Assume(err, gs.IsNil)
+			defer matching.Close()
+			other, _, err := dial("Type == 'other'")
+			c.Assume(err, gs.IsNil)
+			defer other.Close()
+			c.Expect(output.hub.clientCount, gs.Equals, int64(2))
+
+			sent, err := output.hub.publish(msg, encode)
+			c.Expect(err, gs.IsNil)
+			c.Expect(sent, gs.IsTrue)
+			_, data, err := matching.ReadMessage()
+			c.Expect(err, gs.IsNil)
+			c.Expect(string(data), gs.Equals, "Test Payload")
+
+			c.Specify("and limits the number of clients", func() {
+				_, resp, err := dial("TRUE")
+				c.Expect(err, gs.Not(gs.IsNil))
+				c.Expect(resp.StatusCode, gs.Equals, http.StatusServiceUnavailable)
+			})
+
+			c.Specify("and rejects invalid matchers", func() {
+				_, resp, err := dial("Type ==")
+				c.Expect(err, gs.Not(gs.IsNil))
+				c.Expect(resp.StatusCode, gs.Equals, http.StatusBadRequest)
+			})
+
+			c.Specify("and closes the connections on shutdown", func() {
+				output.hub.close()
+				_, _, err := matching.ReadMessage()
+				c.Expect(websocket.IsCloseError(err, websocket.CloseGoingAway), gs.IsTrue)
+			})
+		})
+
+		c.Specify("checks the origin", func() {
+			config.AllowedOrigins = []string{"dashboard.example.com"}
+			err := output.Init(config)
+			c.Assume(err, gs.IsNil)
+			req, _ := http.NewRequest("GET", "http://localhost:4353/tail", nil)
+			req.Header.Set("Origin", "https://dashboard.example.com")
+			c.Expect(output.checkOrigin(req), gs.IsTrue)
+			req.Header.Set("Origin", "https://evil.example.com")
+			c.Expect(output.checkOrigin(req), gs.IsFalse)
+		})
+	})
+}
+
+func HubSpec(c gs.Context) {
+	h := newHub(0, 1)
+	msg := pipeline_ts.GetTestMessage()
+	encodes := 0
+	encode := func() ([]byte, error) {
+		encodes++
+		return []byte("encoded"), nil
+	}
+
+	c.Specify("A hub", func() {
+		c.Specify("only encodes messages that a client wants", func() {
+			_, err := h.subscribe("Type == 'other'")
+			c.Assume(err, gs.IsNil)
+			sent, err := h.publish(msg, encode)
+			c.Expect(err, gs.IsNil)
+			c.Expect(sent, gs.IsFalse)
+			c.Expect(encodes, gs.Equals, 0)
+		})
+
+		c.Specify("encodes a message once for all clients", func() {
+			first, _ := h.subscribe("TRUE")
+			second, _ := h.subscribe("Logger == 'GoSpec'")
+			sent, _ := h.publish(msg, encode)
+			c.Expect(sent, gs.IsTrue)
+			c.Expect(encodes, gs.Equals, 1)
+			c.Expect(string(<-first.messages), gs.Equals, "encoded")
+			c.Expect(string(<-second.messages), gs.Equals, "encoded")
+		})
+
+		c.Specify("drops messages for slow clients", func() {
+			sub, _ := h.subscribe("TRUE")
+			h.publish(msg, encode)
+			h.publish(msg, encode)
+			c.Expect(len(sub.messages), gs.Equals, 1)
+			c.Expect(h.dropMessageCount, gs.Equals, int64(1))
+		})
+	})
+}
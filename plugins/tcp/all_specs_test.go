@@ -27,6 +27,10 @@ func TestAllSpecs(t *testing.T) {
 	r.AddSpec(TcpOutputSpec)
 	r.AddSpec(TlsSpec)
 	r.AddSpec(TcpInputSpecFailure)
+	r.AddSpec(ProxySpec)
+	r.AddSpec(CachingDialerSpec)
+	r.AddSpec(EndpointPoolSpec)
+	r.AddSpec(HandshakeSpec)
 
 	gospec.MainGoTest(r, t)
 }
@@ -0,0 +1,200 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package tcp
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mozilla-services/heka/message"
+)
+
+// Ways of picking the next endpoint from an EndpointPool.
+const (
+	ENDPOINT_ROUND_ROBIN   = "round_robin"
+	ENDPOINT_LEAST_PENDING = "least_pending"
+)
+
+// Settings for spreading an output's connections or requests across several
+// endpoints.
+type EndpointPoolConfig struct {
+	// Addresses of the endpoints, in the form the output's own address
+	// setting takes.
+	Addresses []string
+	// How the next endpoint is picked, either "round_robin" or
+	// "least_pending". Defaults to "round_robin".
+	Strategy string
+	// Number of consecutive failures after which an endpoint is ejected from
+	// the pool. Defaults to 3.
+	MaxFailures int `toml:"max_failures"`
+	// Number of seconds an ejected endpoint stays out of the pool before it's
+	// tried again. Defaults to 30.
+	EjectDuration uint `toml:"eject_duration"`
+	// Interval, in seconds, at which ejected endpoints are probed, returning
+	// them to the pool as soon as a probe succeeds. 0 disables probing.
+	HealthCheckInterval uint `toml:"health_check_interval"`
+}
+
+// An endpoint of an EndpointPool.
+type Endpoint struct {
+	Address      string
+	pending      int
+	failures     int
+	ejectedUntil time.Time
+}
+
+// Picks endpoints for an output, ejecting the ones that keep failing until
+// they recover.
+type EndpointPool struct {
+	lock          sync.Mutex
+	endpoints     []*Endpoint
+	leastPending  bool
+	maxFailures   int
+	ejectDuration time.Duration
+	checkInterval time.Duration
+	next          int
+	ejectCount    int64
+}
+
+func NewEndpointPool(conf *EndpointPoolConfig) (*EndpointPool, error) {
+	if len(conf.Addresses) == 0 {
+		return nil, errors.New("endpoint pool requires at least one address")
+	}
+	pool := &EndpointPool{
+		maxFailures:   conf.MaxFailures,
+		ejectDuration: time.Duration(conf.EjectDuration) * time.Second,
+		checkInterval: time.Duration(conf.HealthCheckInterval) * time.Second,
+	}
+	switch conf.Strategy {
+	case "", ENDPOINT_ROUND_ROBIN:
+	case ENDPOINT_LEAST_PENDING:
+		pool.leastPending = true
+	default:
+		return nil, fmt.Errorf("endpoint strategy must be '%s' or '%s', got %s",
+			ENDPOINT_ROUND_ROBIN, ENDPOINT_LEAST_PENDING, conf.Strategy)
+	}
+	if pool.maxFailures <= 0 {
+		pool.maxFailures = 3
+	}
+	if pool.ejectDuration == 0 {
+		pool.ejectDuration = 30 * time.Second
+	}
+	for _, address := range conf.Addresses {
+		pool.endpoints = append(pool.endpoints, &Endpoint{Address: address})
+	}
+	return pool, nil
+}
+
+// Returns the endpoint to use next, which must be handed back to Release
+// once it's no longer in use. If every endpoint is ejected the one due to
+// return first is used.
+func (p *EndpointPool) Acquire() *Endpoint {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	now := time.Now()
+	n := len(p.endpoints)
+	best, bestIdx := (*Endpoint)(nil), 0
+	for i := 0; i < n; i++ {
+		idx := (p.next + i) % n
+		e := p.endpoints[idx]
+		if now.Before(e.ejectedUntil) {
+			continue
+		}
+		if best == nil || (p.leastPending && e.pending < best.pending) {
+			best, bestIdx = e, idx
+			if !p.leastPending {
+				break
+			}
+		}
+	}
+	if best == nil {
+		for idx, e := range p.endpoints {
+			if best == nil || e.ejectedUntil.Before(best.ejectedUntil) {
+				best, bestIdx = e, idx
+			}
+		}
+	}
+	p.next = (bestIdx + 1) % n
+	best.pending++
+	return best
+}
+
+// Hands back an endpoint returned by Acquire, along w/ the error, if any,
+// that using it resulted in.
+func (p *EndpointPool) Release(e *Endpoint, err error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	e.pending--
+	if err == nil {
+		e.failures = 0
+		return
+	}
+	if e.failures++; e.failures >= p.maxFailures {
+		e.failures = 0
+		e.ejectedUntil = time.Now().Add(p.ejectDuration)
+		atomic.AddInt64(&p.ejectCount, 1)
+	}
+}
+
+// Probes the ejected endpoints w/ probe every `health_check_interval` until
+// stop is closed, returning those that pass to the pool.
+func (p *EndpointPool) HealthCheck(probe func(address string) error,
+	stop <-chan struct{}) {
+
+	if p.checkInterval == 0 {
+		return
+	}
+	ticker := time.NewTicker(p.checkInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		for _, e := range p.ejected() {
+			if probe(e.Address) == nil {
+				p.lock.Lock()
+				e.ejectedUntil = time.Time{}
+				p.lock.Unlock()
+			}
+		}
+	}
+}
+
+// Returns the endpoints that are currently ejected.
+func (p *EndpointPool) ejected() (ejected []*Endpoint) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	now := time.Now()
+	for _, e := range p.endpoints {
+		if now.Before(e.ejectedUntil) {
+			ejected = append(ejected, e)
+		}
+	}
+	return
+}
+
+// Adds the number of endpoints in the pool, of ejected endpoints, and of
+// ejections so far to a report message.
+func (p *EndpointPool) ReportMsg(msg *message.Message) {
+	message.NewIntField(msg, "EndpointCount", len(p.endpoints), "count")
+	message.NewIntField(msg, "EjectedEndpointCount", len(p.ejected()), "count")
+	message.NewInt64Field(msg, "EndpointEjectCount", atomic.LoadInt64(&p.ejectCount),
+		"count")
+}
@@ -0,0 +1,94 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package tcp
+
+import (
+	"errors"
+	"time"
+
+	gs "github.com/rafrombrc/gospec/src/gospec"
+)
+
+func EndpointPoolSpec(c gs.Context) {
+	c.Specify("An EndpointPool", func() {
+		conf := &EndpointPoolConfig{
+			Addresses:   []string{"a:1", "b:1", "c:1"},
+			MaxFailures: 2,
+		}
+		failure := errors.New("connection refused")
+
+		c.Specify("rotates through the endpoints", func() {
+			pool, err := NewEndpointPool(conf)
+			c.Assume(err, gs.IsNil)
+			for _, expected := range []string{"a:1", "b:1", "c:1", "a:1"} {
+				e := pool.Acquire()
+				c.Expect(e.Address, gs.Equals, expected)
+				pool.Release(e, nil)
+			}
+		})
+
+		c.Specify("picks the endpoint w/ the fewest pending uses", func() {
+			conf.Strategy = ENDPOINT_LEAST_PENDING
+			pool, err := NewEndpointPool(conf)
+			c.Assume(err, gs.IsNil)
+			a, b := pool.Acquire(), pool.Acquire()
+			c.Expect(a.Address, gs.Equals, "a:1")
+			c.Expect(b.Address, gs.Equals, "b:1")
+			pool.Release(a, nil)
+			c.Expect(pool.Acquire().Address, gs.Equals, "c:1")
+			c.Expect(pool.Acquire().Address, gs.Equals, "a:1")
+		})
+
+		c.Specify("ejects endpoints that keep failing", func() {
+			pool, err := NewEndpointPool(conf)
+			c.Assume(err, gs.IsNil)
+			a := pool.endpoints[0]
+			pool.Release(pool.Acquire(), failure)
+			pool.Acquire()
+			pool.Acquire()
+			c.Expect(len(pool.ejected()), gs.Equals, 0)
+			pool.Release(pool.Acquire(), failure)
+			c.Expect(len(pool.ejected()), gs.Equals, 1)
+			for i := 0; i < 4; i++ {
+				c.Expect(pool.Acquire(), gs.Not(gs.Equals), a)
+			}
+
+			c.Specify("and returns them once they pass a health check", func() {
+				pool.checkInterval = 10 * time.Millisecond
+				stop := make(chan struct{})
+				defer close(stop)
+				go pool.HealthCheck(func(address string) error { return nil }, stop)
+				for len(pool.ejected()) > 0 {
+					time.Sleep(time.Millisecond)
+				}
+			})
+		})
+
+		c.Specify("uses an ejected endpoint when all of them are", func() {
+			conf.Addresses = []string{"a:1"}
+			conf.MaxFailures = 1
+			pool, err := NewEndpointPool(conf)
+			c.Assume(err, gs.IsNil)
+			pool.Release(pool.Acquire(), failure)
+			c.Expect(pool.Acquire().Address, gs.Equals, "a:1")
+		})
+
+		c.Specify("rejects unknown strategies", func() {
+			conf.Strategy = "random"
+			_, err := NewEndpointPool(conf)
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+	})
+}
@@ -0,0 +1,99 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package tcp
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"time"
+
+	"github.com/mozilla-services/heka/message"
+)
+
+// Handshake records are only a few bytes, anything longer is a message.
+const maxHandshakeSize = 64
+
+// How long a TcpOutput waits for the answer to its handshake.
+var handshakeTimeout = 10 * time.Second
+
+// Returns the lower of two schema versions, the one both peers understand.
+func negotiatedVersion(local, peer uint32) uint32 {
+	if peer < local {
+		return peer
+	}
+	return local
+}
+
+// Consumes the handshake at the start of r and returns the schema version it
+// announces. If r doesn't start w/ a handshake, ok is false and nothing is
+// consumed.
+func readHandshake(r *bufio.Reader) (version uint32, ok bool, err error) {
+	buf, err := r.Peek(len(message.FRAMING_V2_MAGIC))
+	if err != nil || !message.IsFramingV2(buf) {
+		return
+	}
+	header := new(message.Header)
+	for n := len(buf) + 1; n <= maxHandshakeSize; n++ {
+		if buf, err = r.Peek(n); err != nil {
+			return
+		}
+		messageStart, e := message.DecodeHeaderV2(buf, header)
+		if e != nil {
+			// Leave corrupt records to the splitter.
+			return
+		}
+		if messageStart == 0 {
+			continue
+		}
+		if !message.IsHandshake(header) {
+			return
+		}
+		if _, err = io.ReadFull(r, make([]byte, messageStart)); err != nil {
+			return
+		}
+		return header.GetSchemaVersion(), true, nil
+	}
+	return
+}
+
+// Writes a handshake announcing this Heka's schema version.
+func writeHandshake(w io.Writer) error {
+	record, err := message.AppendHandshake(nil, message.SCHEMA_VERSION)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(record)
+	return err
+}
+
+// Sends a handshake over a new connection and waits for the peer's, returning
+// the schema version both sides understand.
+func negotiateSchema(conn net.Conn) (uint32, error) {
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+	if err := writeHandshake(conn); err != nil {
+		return 0, err
+	}
+	version, ok, err := readHandshake(bufio.NewReaderSize(conn, maxHandshakeSize))
+	if err != nil {
+		return 0, err
+	}
+	if !ok {
+		return 0, errors.New("peer didn't answer the handshake")
+	}
+	return negotiatedVersion(message.SCHEMA_VERSION, version), nil
+}
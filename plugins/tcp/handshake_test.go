@@ -0,0 +1,101 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package tcp
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"net"
+	"time"
+
+	"github.com/mozilla-services/heka/client"
+	"github.com/mozilla-services/heka/message"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+)
+
+func HandshakeSpec(c gs.Context) {
+	encoded := []byte("pretend this is a message")
+	var framed []byte
+	err := client.CreateFramedRecord(encoded, &framed, client.FramingOptions{Version: 2})
+	c.Assume(err, gs.IsNil)
+
+	c.Specify("A handshake", func() {
+		c.Specify("is consumed from the start of a stream", func() {
+			record, err := message.AppendHandshake(nil, 7)
+			c.Assume(err, gs.IsNil)
+			r := bufio.NewReader(bytes.NewReader(append(record, framed...)))
+			version, ok, err := readHandshake(r)
+			c.Expect(err, gs.IsNil)
+			c.Expect(ok, gs.IsTrue)
+			c.Expect(version, gs.Equals, uint32(7))
+			rest, _ := ioutil.ReadAll(r)
+			c.Expect(bytes.Equal(rest, framed), gs.IsTrue)
+		})
+
+		c.Specify("isn't mistaken for a record", func() {
+			for _, data := range [][]byte{framed, []byte("plain data")} {
+				r := bufio.NewReader(bytes.NewReader(data))
+				_, ok, err := readHandshake(r)
+				c.Expect(err, gs.IsNil)
+				c.Expect(ok, gs.IsFalse)
+				rest, _ := ioutil.ReadAll(r)
+				c.Expect(bytes.Equal(rest, data), gs.IsTrue)
+			}
+		})
+
+		c.Specify("settles on the lower schema version", func() {
+			c.Expect(negotiatedVersion(2, 1), gs.Equals, uint32(1))
+			c.Expect(negotiatedVersion(1, 3), gs.Equals, uint32(1))
+		})
+
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		c.Assume(err, gs.IsNil)
+		defer listener.Close()
+		accepted := make(chan net.Conn, 1)
+		go func() {
+			conn, err := listener.Accept()
+			if err == nil {
+				accepted <- conn
+			}
+		}()
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		c.Assume(err, gs.IsNil)
+		defer conn.Close()
+		peer := <-accepted
+		defer peer.Close()
+
+		c.Specify("is answered by the peer", func() {
+			go func() {
+				if _, ok, _ := readHandshake(bufio.NewReader(peer)); ok {
+					writeHandshake(peer)
+				}
+			}()
+			version, err := negotiateSchema(conn)
+			c.Expect(err, gs.IsNil)
+			c.Expect(version, gs.Equals, message.SCHEMA_VERSION)
+		})
+
+		c.Specify("fails if the peer doesn't answer", func() {
+			timeout := handshakeTimeout
+			handshakeTimeout = 50 * time.Millisecond
+			defer func() {
+				handshakeTimeout = timeout
+			}()
+			_, err := negotiateSchema(conn)
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+	})
+}
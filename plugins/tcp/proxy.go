@@ -0,0 +1,246 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package tcp
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Settings for connecting to a destination through a proxy, shared by the
+// network outputs.
+type ProxyConfig struct {
+	// URL of the proxy, either "http://host:port" for an HTTP proxy that
+	// supports the CONNECT method or "socks5://host:port" for a SOCKS5 proxy.
+	Url string `toml:"url"`
+	// Optional credentials for the proxy, sent w/ basic auth to an HTTP proxy
+	// or w/ username / password authentication to a SOCKS5 proxy.
+	Username string
+	Password string
+}
+
+// Returns a function w/ the signature of net.Dial that opens connections to
+// their destination through the proxy, using forward to connect to the
+// proxy itself. Only TCP networks are supported.
+func NewProxyDialer(conf *ProxyConfig, forward *net.Dialer) (
+	dial func(network, address string) (net.Conn, error), err error) {
+
+	proxyUrl, err := url.Parse(conf.Url)
+	if err != nil {
+		return nil, fmt.Errorf("can't parse proxy url '%s': %s", conf.Url, err)
+	}
+	if proxyUrl.Host == "" {
+		return nil, fmt.Errorf("proxy url '%s' has no host", conf.Url)
+	}
+	var handshake func(conn net.Conn, address string) (net.Conn, error)
+	switch proxyUrl.Scheme {
+	case "http":
+		handshake = func(conn net.Conn, address string) (net.Conn, error) {
+			return httpConnect(conn, address, conf.Username, conf.Password)
+		}
+	case "socks5":
+		handshake = func(conn net.Conn, address string) (net.Conn, error) {
+			return conn, socks5Connect(conn, address, conf.Username, conf.Password)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme '%s', must be 'http' or 'socks5'",
+			proxyUrl.Scheme)
+	}
+
+	dial = func(network, address string) (net.Conn, error) {
+		switch network {
+		case "tcp", "tcp4", "tcp6":
+		default:
+			return nil, fmt.Errorf("can't proxy network '%s'", network)
+		}
+		conn, err := forward.Dial(network, proxyUrl.Host)
+		if err != nil {
+			return nil, fmt.Errorf("can't connect to proxy '%s': %s", proxyUrl.Host, err)
+		}
+		if forward.Timeout > 0 {
+			conn.SetDeadline(time.Now().Add(forward.Timeout))
+		}
+		tunnel, err := handshake(conn, address)
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("proxy '%s' can't connect to '%s': %s",
+				proxyUrl.Host, address, err)
+		}
+		conn.SetDeadline(time.Time{})
+		return tunnel, nil
+	}
+	return dial, nil
+}
+
+// A connection whose reads start w/ any data that was buffered while
+// reading the proxy's response.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (b *bufferedConn) Read(p []byte) (int, error) {
+	return b.r.Read(p)
+}
+
+// Asks an HTTP proxy to open a tunnel to address using the CONNECT method.
+func httpConnect(conn net.Conn, address, username, password string) (net.Conn, error) {
+	req := &http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Opaque: address},
+		Host:   address,
+		Header: make(http.Header),
+	}
+	if username != "" || password != "" {
+		auth := base64.StdEncoding.EncodeToString([]byte(username + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+auth)
+	}
+	if err := req.Write(conn); err != nil {
+		return nil, err
+	}
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("CONNECT failed: %s", resp.Status)
+	}
+	if r.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, r: r}, nil
+	}
+	return conn, nil
+}
+
+// SOCKS5 protocol values, from RFC 1928 and RFC 1929.
+const (
+	socks5Version      = 5
+	socks5AuthNone     = 0
+	socks5AuthPassword = 2
+	socks5AuthNoMatch  = 0xff
+	socks5CmdConnect   = 1
+	socks5AddrIPv4     = 1
+	socks5AddrDomain   = 3
+	socks5AddrIPv6     = 4
+)
+
+// Asks a SOCKS5 proxy to connect conn to address.
+func socks5Connect(conn net.Conn, address, username, password string) error {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port < 1 || port > 0xffff {
+		return fmt.Errorf("invalid port: %s", portStr)
+	}
+
+	useAuth := username != "" || password != ""
+	greeting := []byte{socks5Version, 1, socks5AuthNone}
+	if useAuth {
+		greeting = []byte{socks5Version, 2, socks5AuthNone, socks5AuthPassword}
+	}
+	if _, err = conn.Write(greeting); err != nil {
+		return err
+	}
+	reply := make([]byte, 2)
+	if _, err = io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[0] != socks5Version {
+		return fmt.Errorf("unexpected SOCKS version: %d", reply[0])
+	}
+	switch reply[1] {
+	case socks5AuthNone:
+	case socks5AuthPassword:
+		if !useAuth {
+			return errors.New("proxy requires a username and password")
+		}
+		if len(username) > 255 || len(password) > 255 {
+			return errors.New("proxy username and password can't exceed 255 bytes")
+		}
+		auth := []byte{1, byte(len(username))}
+		auth = append(auth, username...)
+		auth = append(auth, byte(len(password)))
+		auth = append(auth, password...)
+		if _, err = conn.Write(auth); err != nil {
+			return err
+		}
+		if _, err = io.ReadFull(conn, reply); err != nil {
+			return err
+		}
+		if reply[1] != 0 {
+			return errors.New("proxy rejected the username and password")
+		}
+	case socks5AuthNoMatch:
+		return errors.New("proxy doesn't accept any of the offered authentication methods")
+	default:
+		return fmt.Errorf("proxy chose an unsupported authentication method: %d", reply[1])
+	}
+
+	req := []byte{socks5Version, socks5CmdConnect, 0}
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return fmt.Errorf("host name too long: %s", host)
+		}
+		req = append(req, socks5AddrDomain, byte(len(host)))
+		req = append(req, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		req = append(req, socks5AddrIPv4)
+		req = append(req, ip4...)
+	} else {
+		req = append(req, socks5AddrIPv6)
+		req = append(req, ip.To16()...)
+	}
+	req = append(req, byte(port>>8), byte(port))
+	if _, err = conn.Write(req); err != nil {
+		return err
+	}
+
+	// The reply holds the version, status, a reserved byte, and the address
+	// the proxy bound, which we read and discard.
+	header := make([]byte, 4)
+	if _, err = io.ReadFull(conn, header); err != nil {
+		return err
+	}
+	if header[1] != 0 {
+		return fmt.Errorf("SOCKS connect failed w/ status %d", header[1])
+	}
+	var addrLen int
+	switch header[3] {
+	case socks5AddrIPv4:
+		addrLen = net.IPv4len
+	case socks5AddrIPv6:
+		addrLen = net.IPv6len
+	case socks5AddrDomain:
+		if _, err = io.ReadFull(conn, header[:1]); err != nil {
+			return err
+		}
+		addrLen = int(header[0])
+	default:
+		return fmt.Errorf("unknown SOCKS address type: %d", header[3])
+	}
+	_, err = io.ReadFull(conn, make([]byte, addrLen+2))
+	return err
+}
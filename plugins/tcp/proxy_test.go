@@ -0,0 +1,141 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package tcp
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+
+	gs "github.com/rafrombrc/gospec/src/gospec"
+)
+
+// Starts a proxy that accepts a single connection, performs handshake on it,
+// and then echoes whatever it receives.
+func startTestProxy(c gs.Context, handshake func(conn net.Conn) bool) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assume(err, gs.IsNil)
+	go func() {
+		defer listener.Close()
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		if handshake(conn) {
+			io.Copy(conn, conn)
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func expectEcho(c gs.Context, conn net.Conn) {
+	_, err := conn.Write([]byte("ping"))
+	c.Expect(err, gs.IsNil)
+	reply := make([]byte, 4)
+	_, err = io.ReadFull(conn, reply)
+	c.Expect(err, gs.IsNil)
+	c.Expect(string(reply), gs.Equals, "ping")
+}
+
+func ProxySpec(c gs.Context) {
+	c.Specify("A proxy dialer", func() {
+		conf := &ProxyConfig{Username: "user", Password: "secret"}
+
+		c.Specify("tunnels through an HTTP proxy", func() {
+			reqs := make(chan *http.Request, 1)
+			addr := startTestProxy(c, func(conn net.Conn) bool {
+				req, err := http.ReadRequest(bufio.NewReader(conn))
+				if err != nil || req.Method != "CONNECT" {
+					return false
+				}
+				reqs <- req
+				conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+				return true
+			})
+			conf.Url = "http://" + addr
+			dial, err := NewProxyDialer(conf, new(net.Dialer))
+			c.Assume(err, gs.IsNil)
+			conn, err := dial("tcp", "example.com:443")
+			c.Assume(err, gs.IsNil)
+			defer conn.Close()
+			expectEcho(c, conn)
+			req := <-reqs
+			c.Expect(req.Host, gs.Equals, "example.com:443")
+			c.Expect(req.Header.Get("Proxy-Authorization"), gs.Equals,
+				"Basic dXNlcjpzZWNyZXQ=")
+		})
+
+		c.Specify("reports a refused HTTP tunnel", func() {
+			addr := startTestProxy(c, func(conn net.Conn) bool {
+				http.ReadRequest(bufio.NewReader(conn))
+				conn.Write([]byte("HTTP/1.1 407 Proxy Authentication Required\r\n" +
+					"Content-Length: 0\r\n\r\n"))
+				return false
+			})
+			conf.Url = "http://" + addr
+			dial, err := NewProxyDialer(conf, new(net.Dialer))
+			c.Assume(err, gs.IsNil)
+			_, err = dial("tcp", "example.com:443")
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+
+		c.Specify("tunnels through a SOCKS5 proxy w/ auth", func() {
+			received := make(chan []byte, 2)
+			addr := startTestProxy(c, func(conn net.Conn) bool {
+				greeting := make([]byte, 4)
+				if _, err := io.ReadFull(conn, greeting); err != nil {
+					return false
+				}
+				conn.Write([]byte{socks5Version, socks5AuthPassword})
+				// Version, length, "user", length, "secret".
+				credentials := make([]byte, 13)
+				if _, err := io.ReadFull(conn, credentials); err != nil {
+					return false
+				}
+				received <- credentials
+				conn.Write([]byte{1, 0})
+				// Header, domain length, "example.com", port.
+				target := make([]byte, 18)
+				if _, err := io.ReadFull(conn, target); err != nil {
+					return false
+				}
+				received <- target
+				conn.Write([]byte{socks5Version, 0, 0, socks5AddrIPv4, 0, 0, 0, 0, 0, 0})
+				return true
+			})
+			conf.Url = "socks5://" + addr
+			dial, err := NewProxyDialer(conf, new(net.Dialer))
+			c.Assume(err, gs.IsNil)
+			conn, err := dial("tcp", "example.com:80")
+			c.Assume(err, gs.IsNil)
+			defer conn.Close()
+			expectEcho(c, conn)
+			credentials, target := <-received, <-received
+			c.Expect(string(credentials[2:6]), gs.Equals, "user")
+			c.Expect(string(credentials[7:]), gs.Equals, "secret")
+			c.Expect(target[3], gs.Equals, byte(socks5AddrDomain))
+			c.Expect(string(target[5:16]), gs.Equals, "example.com")
+			c.Expect(int(target[16])<<8|int(target[17]), gs.Equals, 80)
+		})
+
+		c.Specify("rejects unknown schemes", func() {
+			conf.Url = "ftp://proxy:21"
+			_, err := NewProxyDialer(conf, new(net.Dialer))
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+	})
+}
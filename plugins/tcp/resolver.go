@@ -0,0 +1,134 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package tcp
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// Dials host names for long-lived outputs. The addresses a name resolves to
+// are cached for the TTL, after which the name is re-resolved on the next
+// connect, so outputs follow DNS changes. Each connect tries the addresses in
+// turn, starting w/ the one that last worked, so a name w/ several A or AAAA
+// records fails over to the next address when one is down. When every
+// address fails the cached entry is dropped, forcing a fresh lookup.
+//
+// Go's resolver doesn't expose record TTLs, so the configured TTL is used for
+// every name.
+type CachingDialer struct {
+	Dialer *net.Dialer
+	TTL    time.Duration
+	lock   sync.Mutex
+	cache  map[string]*dnsEntry
+	// Swapped out by the tests.
+	lookupHost func(host string) ([]string, error)
+}
+
+type dnsEntry struct {
+	addrs   []string
+	expires time.Time
+	// Index of the address that last connected.
+	next int
+}
+
+// Creates a CachingDialer that connects w/ dialer and caches lookups for ttl.
+// A ttl of 0 re-resolves names on every connect.
+func NewCachingDialer(dialer *net.Dialer, ttl time.Duration) *CachingDialer {
+	return &CachingDialer{
+		Dialer:     dialer,
+		TTL:        ttl,
+		cache:      make(map[string]*dnsEntry),
+		lookupHost: net.LookupHost,
+	}
+}
+
+// Returns the cached addresses for host, resolving it if they're missing or
+// expired. A stale entry is used if the lookup fails.
+func (d *CachingDialer) resolve(host string) (*dnsEntry, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	entry := d.cache[host]
+	if entry != nil && time.Now().Before(entry.expires) {
+		return entry, nil
+	}
+	addrs, err := d.lookupHost(host)
+	if err != nil {
+		if entry != nil {
+			return entry, nil
+		}
+		return nil, err
+	}
+	if len(addrs) == 0 {
+		return nil, errors.New("no addresses found for " + host)
+	}
+	entry = &dnsEntry{addrs: addrs, expires: time.Now().Add(d.TTL)}
+	d.cache[host] = entry
+	return entry, nil
+}
+
+// Returns whether ip can be used w/ network.
+func familyMatches(network string, ip net.IP) bool {
+	switch network {
+	case "tcp4", "udp4":
+		return ip.To4() != nil
+	case "tcp6", "udp6":
+		return ip.To4() == nil
+	}
+	return true
+}
+
+// Satisfies the signature of net.Dial.
+func (d *CachingDialer) Dial(network, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	if net.ParseIP(host) != nil {
+		return d.Dialer.Dial(network, address)
+	}
+	entry, err := d.resolve(host)
+	if err != nil {
+		return nil, err
+	}
+
+	d.lock.Lock()
+	addrs, start := entry.addrs, entry.next
+	d.lock.Unlock()
+	err = errors.New("no addresses for " + host + " match network " + network)
+	for i := 0; i < len(addrs); i++ {
+		idx := (start + i) % len(addrs)
+		ip := net.ParseIP(addrs[idx])
+		if ip == nil || !familyMatches(network, ip) {
+			continue
+		}
+		var conn net.Conn
+		if conn, err = d.Dialer.Dial(network, net.JoinHostPort(addrs[idx], port)); err == nil {
+			d.lock.Lock()
+			entry.next = idx
+			d.lock.Unlock()
+			return conn, nil
+		}
+	}
+
+	d.lock.Lock()
+	if d.cache[host] == entry {
+		delete(d.cache, host)
+	}
+	d.lock.Unlock()
+	return nil, err
+}
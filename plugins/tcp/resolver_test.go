@@ -0,0 +1,97 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package tcp
+
+import (
+	"errors"
+	"net"
+	"time"
+
+	gs "github.com/rafrombrc/gospec/src/gospec"
+)
+
+func CachingDialerSpec(c gs.Context) {
+	c.Specify("A CachingDialer", func() {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		c.Assume(err, gs.IsNil)
+		defer listener.Close()
+		go func() {
+			for {
+				conn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				conn.Close()
+			}
+		}()
+		_, port, _ := net.SplitHostPort(listener.Addr().String())
+
+		lookups := 0
+		addrs := []string{"127.0.0.1"}
+		var lookupErr error
+		dialer := NewCachingDialer(&net.Dialer{Timeout: time.Second}, time.Minute)
+		dialer.lookupHost = func(host string) ([]string, error) {
+			lookups++
+			return addrs, lookupErr
+		}
+		address := net.JoinHostPort("service.example.com", port)
+
+		dial := func() error {
+			conn, err := dialer.Dial("tcp", address)
+			if err == nil {
+				conn.Close()
+			}
+			return err
+		}
+
+		c.Specify("caches lookups for the TTL", func() {
+			c.Expect(dial(), gs.IsNil)
+			c.Expect(dial(), gs.IsNil)
+			c.Expect(lookups, gs.Equals, 1)
+
+			dialer.cache["service.example.com"].expires = time.Now().Add(-time.Second)
+			c.Expect(dial(), gs.IsNil)
+			c.Expect(lookups, gs.Equals, 2)
+		})
+
+		c.Specify("uses a stale entry if the lookup fails", func() {
+			c.Expect(dial(), gs.IsNil)
+			dialer.cache["service.example.com"].expires = time.Now().Add(-time.Second)
+			lookupErr = errors.New("no DNS")
+			c.Expect(dial(), gs.IsNil)
+			c.Expect(lookups, gs.Equals, 2)
+		})
+
+		c.Specify("fails over to the next address", func() {
+			// Nothing listens on 127.0.0.2 w/ the listener's port.
+			addrs = []string{"127.0.0.2", "127.0.0.1"}
+			c.Expect(dial(), gs.IsNil)
+			c.Expect(dialer.cache["service.example.com"].next, gs.Equals, 1)
+		})
+
+		c.Specify("re-resolves after every address fails", func() {
+			addrs = []string{"127.0.0.2"}
+			c.Expect(dial(), gs.Not(gs.IsNil))
+			_, cached := dialer.cache["service.example.com"]
+			c.Expect(cached, gs.IsFalse)
+		})
+
+		c.Specify("skips addresses of the wrong family", func() {
+			addrs = []string{"::1"}
+			_, err := dialer.Dial("tcp4", address)
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+	})
+}
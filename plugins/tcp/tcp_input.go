@@ -16,21 +16,26 @@
 package tcp
 
 import (
+	"bufio"
 	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"fmt"
+	"io"
 	"net"
+	"strings"
 	"sync"
 	"time"
 
 	. "github.com/mozilla-services/heka/pipeline"
 )
 
-// Input plugin implementation that listens for Heka protocol messages on a
-// specified TCP socket. Creates a separate goroutine for each TCP connection.
+// Input plugin implementation that listens for Heka protocol messages on
+// one or more TCP sockets. Creates a separate goroutine for each listener and
+// each TCP connection.
 type TcpInput struct {
 	keepAliveDuration time.Duration
-	listener          net.Listener
+	listeners         []net.Listener
 	wg                sync.WaitGroup
 	stopChan          chan bool
 	ir                InputRunner
@@ -38,12 +43,16 @@ type TcpInput struct {
 }
 
 type TcpInputConfig struct {
-	// Network type (e.g. "tcp", "tcp4", "tcp6", "unix" or "unixpacket").
-	// Needs to match the input type.
+	// Network type ("tcp", "tcp4", or "tcp6"). Needs to match the input
+	// type.
 	Net string
 	// String representation of the address of the network connection on which
 	// the listener should be listening (e.g. "127.0.0.1:5565").
 	Address string
+	// Additional addresses to listen on, sharing the decoder, splitter, and
+	// reports of the input. Each can start w/ a network type followed by
+	// "://" (e.g. "tcp6://[::1]:5565") to override Net for that address.
+	Addresses []string
 	// Set to true if the TCP connection should be tunneled through TLS.
 	// Requires additional Tls config section.
 	UseTls bool `toml:"use_tls"`
@@ -57,6 +66,11 @@ type TcpInputConfig struct {
 	Decoder string
 	// So we can default to using HekaFramingSplitter.
 	Splitter string
+	// Part of a verified TLS client certificate to use as the signer of
+	// every message received over the connection, either "cn" for the
+	// subject's common name or "san" for the first DNS name (or, failing
+	// that, email address) in the subject alternative names.
+	TlsIdentity string `toml:"tls_identity"`
 }
 
 func (t *TcpInput) ConfigStruct() interface{} {
@@ -69,29 +83,66 @@ func (t *TcpInput) ConfigStruct() interface{} {
 	return config
 }
 
+// A resolved address to listen on, along w/ its network type.
+type listenAddr struct {
+	net  string
+	addr *net.TCPAddr
+}
+
+// Resolves the `address` and `addresses` settings.
+func resolveListenAddrs(conf *TcpInputConfig) ([]listenAddr, error) {
+	specs := conf.Addresses
+	if conf.Address != "" {
+		specs = append([]string{conf.Address}, specs...)
+	}
+	if len(specs) == 0 {
+		return nil, errors.New("no address specified")
+	}
+	addrs := make([]listenAddr, 0, len(specs))
+	for _, spec := range specs {
+		network := conf.Net
+		if i := strings.Index(spec, "://"); i >= 0 {
+			network, spec = spec[:i], spec[i+3:]
+		}
+		addr, err := net.ResolveTCPAddr(network, spec)
+		if err != nil {
+			return nil, err
+		}
+		addrs = append(addrs, listenAddr{net: network, addr: addr})
+	}
+	return addrs, nil
+}
+
 func (t *TcpInput) Init(config interface{}) error {
 	var err error
 	t.config = config.(*TcpInputConfig)
-	address, err := net.ResolveTCPAddr(t.config.Net, t.config.Address)
+	addrs, err := resolveListenAddrs(t.config)
 	if err != nil {
 		return fmt.Errorf("ResolveTCPAddress failed: %s\n", err.Error())
 	}
-	t.listener, err = net.ListenTCP(t.config.Net, address)
-	if err != nil {
-		return fmt.Errorf("ListenTCP failed: %s\n", err.Error())
-	}
-	// We're already listening, make sure we clean up if init fails later on.
+	// Make sure we clean up any listeners if init fails later on.
 	closeIt := true
 	defer func() {
 		if closeIt {
-			t.listener.Close()
+			t.closeListeners()
+			t.listeners = nil
 		}
 	}()
+	for _, la := range addrs {
+		listener, err := net.ListenTCP(la.net, la.addr)
+		if err != nil {
+			return fmt.Errorf("ListenTCP failed: %s\n", err.Error())
+		}
+		t.listeners = append(t.listeners, listener)
+	}
 	if t.config.UseTls {
 		if err = t.setupTls(&t.config.Tls); err != nil {
 			return err
 		}
 	}
+	if err = validateTlsIdentity(t.config); err != nil {
+		return err
+	}
 	if t.config.KeepAlivePeriod != 0 {
 		t.keepAliveDuration = time.Duration(t.config.KeepAlivePeriod) * time.Second
 	}
@@ -100,13 +151,97 @@ func (t *TcpInput) Init(config interface{}) error {
 	return nil
 }
 
+// Satisfies the `pipeline.ValidatesConfig` interface, checking the listen
+// address and TLS settings w/o opening the listener.
+func (t *TcpInput) ValidateConfig(config interface{}) error {
+	conf := config.(*TcpInputConfig)
+	if _, err := resolveListenAddrs(conf); err != nil {
+		return fmt.Errorf("ResolveTCPAddress failed: %s", err.Error())
+	}
+	if conf.UseTls {
+		if conf.Tls.CertFile == "" || conf.Tls.KeyFile == "" {
+			return errors.New("TLS config requires both cert_file and key_file value.")
+		}
+		if _, err := CreateGoTlsConfig(&conf.Tls); err != nil {
+			return err
+		}
+	}
+	return validateTlsIdentity(conf)
+}
+
+// Makes sure that the `tls_identity` setting is a known one and will only
+// ever be applied to certificates that have been verified against the
+// `client_cafile`.
+func validateTlsIdentity(conf *TcpInputConfig) error {
+	switch conf.TlsIdentity {
+	case "":
+		return nil
+	case "cn", "san":
+	default:
+		return fmt.Errorf("invalid tls_identity: %s", conf.TlsIdentity)
+	}
+	if !conf.UseTls {
+		return errors.New("tls_identity requires use_tls")
+	}
+	switch conf.Tls.ClientAuth {
+	case "RequireAndVerifyClientCert", "VerifyClientCertIfGiven":
+	default:
+		return errors.New("tls_identity requires a client_auth setting that " +
+			"verifies client certificates")
+	}
+	return nil
+}
+
+// Extracts the identity specified by source ("cn" or "san") from a client
+// certificate, returning an empty string if the certificate doesn't have one.
+func certIdentity(cert *x509.Certificate, source string) string {
+	if source == "cn" {
+		return cert.Subject.CommonName
+	}
+	if len(cert.DNSNames) > 0 {
+		return cert.DNSNames[0]
+	}
+	if len(cert.EmailAddresses) > 0 {
+		return cert.EmailAddresses[0]
+	}
+	return ""
+}
+
+// Completes the TLS handshake on conn and returns the configured identity of
+// the client's verified certificate, or an empty string if the client didn't
+// present one.
+func (t *TcpInput) verifiedIdentity(conn *tls.Conn) (string, error) {
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	defer conn.SetDeadline(time.Time{})
+	if err := conn.Handshake(); err != nil {
+		return "", err
+	}
+	state := conn.ConnectionState()
+	if len(state.VerifiedChains) == 0 {
+		return "", nil
+	}
+	return certIdentity(state.VerifiedChains[0][0], t.config.TlsIdentity), nil
+}
+
 func (t *TcpInput) setupTls(tomlConf *TlsConfig) (err error) {
 	if tomlConf.CertFile == "" || tomlConf.KeyFile == "" {
 		return errors.New("TLS config requires both cert_file and key_file value.")
 	}
 	var goConf *tls.Config
 	if goConf, err = CreateGoTlsConfig(tomlConf); err == nil {
-		t.listener = tls.NewListener(t.listener, goConf)
+		for i, listener := range t.listeners {
+			t.listeners[i] = tls.NewListener(listener, goConf)
+		}
+	}
+	return
+}
+
+// Closes every listener, returning the first error encountered.
+func (t *TcpInput) closeListeners() (err error) {
+	for _, listener := range t.listeners {
+		if e := listener.Close(); e != nil && err == nil {
+			err = e
+		}
 	}
 	return
 }
@@ -130,13 +265,40 @@ func (t *TcpInput) handleConnection(conn net.Conn) {
 		sr.Done()
 	}()
 
+	var identity string
+	if tlsConn, ok := conn.(*tls.Conn); ok && t.config.TlsIdentity != "" {
+		if identity, err = t.verifiedIdentity(tlsConn); err != nil {
+			t.ir.LogError(fmt.Errorf("TLS handshake with %s failed: %s", raddr, err))
+			return
+		}
+	}
+
 	if !sr.UseMsgBytes() {
 		name := t.ir.Name()
 		packDec := func(pack *PipelinePack) {
 			pack.Message.SetHostname(raddr)
 			pack.Message.SetType(name)
+			if identity != "" {
+				pack.Signer = identity
+			}
 		}
 		sr.SetPackDecorator(packDec)
+	} else if identity != "" {
+		// The verified identity takes precedence over any signer from the
+		// message framing.
+		sr.SetPackDecorator(func(pack *PipelinePack) {
+			pack.Signer = identity
+		})
+	}
+
+	var input io.Reader = conn
+	if sr.UseMsgBytes() {
+		// Heka protocol senders may start w/ a handshake.
+		reader := bufio.NewReader(conn)
+		if !t.answerHandshake(conn, reader) {
+			return
+		}
+		input = reader
 	}
 
 	stopped := false
@@ -146,7 +308,7 @@ func (t *TcpInput) handleConnection(conn net.Conn) {
 		case <-t.stopChan:
 			stopped = true
 		default:
-			err = sr.SplitStream(conn, deliverer)
+			err = sr.SplitStream(input, deliverer)
 			if err != nil {
 				if neterr, ok := err.(net.Error); ok && neterr.Timeout() {
 					// keep the connection open, we are just checking to see if
@@ -159,22 +321,66 @@ func (t *TcpInput) handleConnection(conn net.Conn) {
 	}
 }
 
-func (t *TcpInput) Run(ir InputRunner, h PluginHelper) error {
-	t.ir = ir
+// Answers the handshake the connection's data starts w/, if any, announcing
+// this Heka's schema version. Returns false if the connection should be
+// closed.
+func (t *TcpInput) answerHandshake(conn net.Conn, r *bufio.Reader) bool {
+	for {
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		select {
+		case <-t.stopChan:
+			return false
+		default:
+		}
+		_, ok, err := readHandshake(r)
+		if neterr, isNet := err.(net.Error); isNet && neterr.Timeout() {
+			continue
+		}
+		if err != nil {
+			return false
+		}
+		if ok {
+			if err = writeHandshake(conn); err != nil {
+				t.ir.LogError(fmt.Errorf("answering handshake from %s: %s",
+					conn.RemoteAddr(), err))
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// Accepts connections on listener until it's closed, handing each one to a
+// new handleConnection goroutine.
+func (t *TcpInput) accept(listener net.Listener) (err error) {
 	var conn net.Conn
 	var e error
+	// Back off on temporary errors, e.g. running out of file descriptors.
+	rh, e := NewRunnerRetryHelper(t.ir, RetryOptions{
+		Delay:      "5ms",
+		MaxDelay:   "1s",
+		MaxJitter:  "5ms",
+		MaxRetries: -1,
+	})
+	if e != nil {
+		return e
+	}
 	for {
-		if conn, e = t.listener.Accept(); e != nil {
+		if conn, e = listener.Accept(); e != nil {
 			if netErr, ok := e.(net.Error); ok && netErr.Temporary() {
 				t.ir.LogError(fmt.Errorf("TCP accept failed: %s", e))
+				if err = rh.Wait(); err != nil {
+					return err
+				}
 				continue
-			} else {
-				break
 			}
+			return nil
 		}
+		rh.Reset()
 		if t.config.KeepAlive {
 			tcpConn, ok := conn.(*net.TCPConn)
 			if !ok {
+				conn.Close()
 				return errors.New("KeepAlive only supported for TCP Connections.")
 			}
 			tcpConn.SetKeepAlive(t.config.KeepAlive)
@@ -185,12 +391,32 @@ func (t *TcpInput) Run(ir InputRunner, h PluginHelper) error {
 		t.wg.Add(1)
 		go t.handleConnection(conn)
 	}
+}
+
+func (t *TcpInput) Run(ir InputRunner, h PluginHelper) (err error) {
+	t.ir = ir
+	errs := make(chan error, len(t.listeners))
+	for _, listener := range t.listeners {
+		go func(listener net.Listener) {
+			e := t.accept(listener)
+			if e != nil {
+				// Stop listening everywhere so the input gets restarted.
+				t.closeListeners()
+			}
+			errs <- e
+		}(listener)
+	}
+	for _ = range t.listeners {
+		if e := <-errs; e != nil && err == nil {
+			err = e
+		}
+	}
 	t.wg.Wait()
-	return nil
+	return err
 }
 
 func (t *TcpInput) Stop() {
-	if err := t.listener.Close(); err != nil {
+	if err := t.closeListeners(); err != nil {
 		t.ir.LogError(fmt.Errorf("Error closing listener: %s", err))
 	}
 	close(t.stopChan)
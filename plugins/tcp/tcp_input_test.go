@@ -17,6 +17,8 @@ package tcp
 
 import (
 	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
 	"io"
 	"io/ioutil"
 	"net"
@@ -99,7 +101,8 @@ func TcpInputSpec(c gs.Context) {
 		c.Specify("not using TLS", func() {
 			err := tcpInput.Init(config)
 			c.Assume(err, gs.IsNil)
-			c.Expect(tcpInput.listener.Addr().String(), gs.Equals, ith.ResolvedAddrStr)
+			c.Expect(len(tcpInput.listeners), gs.Equals, 1)
+			c.Expect(tcpInput.listeners[0].Addr().String(), gs.Equals, ith.ResolvedAddrStr)
 
 			c.Specify("accepts connections and passes them to the splitter", func() {
 				go startServer()
@@ -122,6 +125,51 @@ func TcpInputSpec(c gs.Context) {
 			})
 		})
 
+		c.Specify("accepts connections on each of multiple addresses", func() {
+			config.Addresses = []string{"tcp4://localhost:55566"}
+			err := tcpInput.Init(config)
+			c.Assume(err, gs.IsNil)
+			c.Expect(len(tcpInput.listeners), gs.Equals, 2)
+			c.Expect(tcpInput.listeners[1].Addr().String(), gs.Equals, "127.0.0.1:55566")
+
+			go startServer()
+			outConn, err := net.Dial("tcp", "localhost:55566")
+			c.Assume(err, gs.IsNil)
+			_, err = outConn.Write([]byte("SECOND ADDRESS"))
+			c.Expect(err, gs.IsNil)
+			outConn.Close()
+			c.Expect(string(<-bytesChan), gs.Equals, "SECOND ADDRESS")
+
+			tcpInput.Stop()
+			c.Expect(<-errChan, gs.IsNil)
+		})
+
+		if plugins_ts.IPv6Available() {
+			c.Specify("binds the IPv6 wildcard address", func() {
+				config.Net = "tcp6"
+				config.Address = "[::]:55567"
+				err := tcpInput.Init(config)
+				c.Assume(err, gs.IsNil)
+				c.Expect(tcpInput.listeners[0].Addr().String(), gs.Equals, "[::]:55567")
+
+				go startServer()
+				outConn, err := net.Dial("tcp6", "[::1]:55567")
+				c.Assume(err, gs.IsNil)
+				_, err = outConn.Write([]byte("OVER IPV6"))
+				c.Expect(err, gs.IsNil)
+				outConn.Close()
+				c.Expect(string(<-bytesChan), gs.Equals, "OVER IPV6")
+
+				tcpInput.Stop()
+				c.Expect(<-errChan, gs.IsNil)
+			})
+		}
+
+		c.Specify("requires an address", func() {
+			err := tcpInput.Init(&TcpInputConfig{Net: "tcp"})
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+
 		c.Specify("using TLS", func() {
 			config.UseTls = true
 
@@ -138,6 +186,38 @@ func TcpInputSpec(c gs.Context) {
 				KeyFile:  "./testsupport/key.pem",
 			}
 
+			c.Specify("validates the config w/o listening", func() {
+				err := tcpInput.ValidateConfig(config)
+				c.Expect(err, gs.IsNil)
+				c.Expect(len(tcpInput.listeners), gs.Equals, 0)
+				config.Tls.KeyFile = "./testsupport/missing.pem"
+				err = tcpInput.ValidateConfig(config)
+				c.Expect(err, gs.Not(gs.IsNil))
+			})
+
+			c.Specify("only uses identities from verified certificates", func() {
+				config.TlsIdentity = "san"
+				err := tcpInput.ValidateConfig(config)
+				c.Expect(err, gs.Not(gs.IsNil))
+				config.Tls.ClientAuth = "RequireAndVerifyClientCert"
+				err = tcpInput.ValidateConfig(config)
+				c.Expect(err, gs.IsNil)
+				config.TlsIdentity = "serial"
+				err = tcpInput.ValidateConfig(config)
+				c.Expect(err, gs.Not(gs.IsNil))
+			})
+
+			c.Specify("extracts identities from client certificates", func() {
+				certPEM, err := ioutil.ReadFile(config.Tls.CertFile)
+				c.Assume(err, gs.IsNil)
+				block, _ := pem.Decode(certPEM)
+				c.Assume(block, gs.Not(gs.IsNil))
+				cert, err := x509.ParseCertificate(block.Bytes)
+				c.Assume(err, gs.IsNil)
+				c.Expect(certIdentity(cert, "san"), gs.Equals, "example.com")
+				c.Expect(certIdentity(cert, "cn"), gs.Equals, "")
+			})
+
 			c.Specify("accepts connections and passes them to the splitter", func() {
 				err := tcpInput.Init(config)
 				c.Expect(err, gs.IsNil)
@@ -19,6 +19,7 @@ package tcp
 import (
 	"crypto/tls"
 	"fmt"
+	"github.com/mozilla-services/heka/client"
 	"github.com/mozilla-services/heka/message"
 	. "github.com/mozilla-services/heka/pipeline"
 	"net"
@@ -33,6 +34,8 @@ import (
 type TcpOutput struct {
 	processMessageCount int64
 	dropMessageCount    int64
+	relayLoopCount      int64
+	schemaVersion       int64
 	keepAliveDuration   time.Duration
 	conf                *TcpOutputConfig
 	address             string
@@ -44,6 +47,11 @@ type TcpOutput struct {
 	or                  OutputRunner
 	outputBlock         *RetryHelper
 	pConfig             *PipelineConfig
+	signedBytes         []byte
+	relayPack           *PipelinePack
+	dial                func(network, address string) (net.Conn, error)
+	endpoints           *EndpointPool
+	endpoint            *Endpoint
 }
 
 // ConfigStruct for TcpOutput plugin.
@@ -73,15 +81,40 @@ type TcpOutputConfig struct {
 	// Specifies action which should be executed if queue is full. Possible
 	// values are "shutdown", "drop", or "block".
 	QueueFullAction string `toml:"queue_full_action"`
+	// Optional message signing configuration. If provided, each encoded
+	// message will be wrapped in Heka's stream framing, with a header
+	// containing an HMAC signature that the receiving Heka can verify.
+	Signer *message.MessageSigningConfig `toml:"signer"`
+	// Set to true to append this Heka's hostname to the `heka.relay` field of
+	// each message sent, and to drop messages already relayed by this Heka so
+	// misconfigured heka-to-heka topologies can't loop.
+	RelayPath bool `toml:"relay_path"`
+	// Network type, either "tcp" to use whichever of IPv4 or IPv6 the
+	// address resolves to, or "tcp4" or "tcp6" to only use that family.
+	Net string
+	// Optional proxy to connect through.
+	Proxy *ProxyConfig `toml:"proxy"`
+	// Number of seconds the addresses the destination's host name resolves
+	// to are cached for. 0 re-resolves the name on every connect.
+	DnsCacheTtl uint `toml:"dns_cache_ttl"`
+	// Optional pool of destinations to spread connections across, used in
+	// place of Address.
+	Endpoints *EndpointPoolConfig `toml:"endpoints"`
+	// Set to true to exchange schema versions w/ the receiving Heka in a
+	// handshake on every new connection. Connections to receivers that don't
+	// answer the handshake fail.
+	SchemaNegotiation bool `toml:"schema_negotiation"`
 }
 
 func (t *TcpOutput) ConfigStruct() interface{} {
 	return &TcpOutputConfig{
 		Address:            "localhost:9125",
+		Net:                "tcp",
 		TickerInterval:     uint(300),
 		Encoder:            "ProtobufEncoder",
 		QueueMaxBufferSize: 0,
 		QueueFullAction:    "shutdown",
+		DnsCacheTtl:        30,
 	}
 }
 
@@ -90,17 +123,48 @@ func (t *TcpOutput) SetName(name string) {
 	t.name = re.ReplaceAllString(name, "_")
 }
 
+// The output only needs the message's fields to record the relay path, the
+// encoder says whether it needs them.
+func (t *TcpOutput) UsesFields() bool {
+	return t.conf.RelayPath
+}
+
 func (t *TcpOutput) Init(config interface{}) (err error) {
 	t.conf = config.(*TcpOutputConfig)
 	t.address = t.conf.Address
 
+	switch t.conf.Net {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return fmt.Errorf("`net` must be 'tcp', 'tcp4', or 'tcp6', got %s", t.conf.Net)
+	}
+
 	if t.conf.LocalAddress != "" {
 		// Error out if use_tls and local_address options are both set for now.
 		if t.conf.UseTls {
 			return fmt.Errorf("Cannot combine local_address %s and use_tls config options",
-				t.localAddress)
+				t.conf.LocalAddress)
+		}
+		if t.localAddress, err = net.ResolveTCPAddr(t.conf.Net, t.conf.LocalAddress); err != nil {
+			return fmt.Errorf("Error resolving local address '%s': %s",
+				t.conf.LocalAddress, err)
+		}
+	}
+
+	dialer := &net.Dialer{LocalAddr: t.localAddress}
+	if t.conf.Proxy != nil {
+		if t.dial, err = NewProxyDialer(t.conf.Proxy, dialer); err != nil {
+			return err
+		}
+	} else {
+		ttl := time.Duration(t.conf.DnsCacheTtl) * time.Second
+		t.dial = NewCachingDialer(dialer, ttl).Dial
+	}
+
+	if t.conf.Endpoints != nil {
+		if t.endpoints, err = NewEndpointPool(t.conf.Endpoints); err != nil {
+			return err
 		}
-		t.localAddress, err = net.ResolveTCPAddr("tcp", t.conf.LocalAddress)
 	}
 
 	if t.conf.KeepAlivePeriod != 0 {
@@ -113,23 +177,72 @@ func (t *TcpOutput) Init(config interface{}) (err error) {
 		return fmt.Errorf("`queue_full_action` must be 'shutdown', 'drop', or 'block', got %s",
 			t.conf.QueueFullAction)
 	}
+
+	if t.conf.Signer != nil {
+		if t.conf.Signer.Name == "" || t.conf.Signer.Key == "" {
+			return fmt.Errorf("`signer` requires both a `name` and an `hmac_key`")
+		}
+		switch t.conf.Signer.Hash {
+		case "":
+			t.conf.Signer.Hash = "md5"
+		case "md5", "sha1":
+		default:
+			return fmt.Errorf("`signer` `hmac_hash` must be 'md5' or 'sha1', got %s",
+				t.conf.Signer.Hash)
+		}
+	}
 	return
 }
 
-func (t *TcpOutput) connect() (err error) {
-	dialer := &net.Dialer{LocalAddr: t.localAddress}
+// queueRecord encodes the pack and adds it to the output queue. If a signer
+// is configured the message is framed and signed here, rather than by the
+// output runner.
+func (t *TcpOutput) queueRecord(pack *PipelinePack) (err error) {
+	if t.conf.RelayPath {
+		var relayed *message.Message
+		if relayed, err = AddRelayHop(pack.Message, t.pConfig.Hostname()); err != nil {
+			return
+		}
+		if t.relayPack == nil {
+			t.relayPack = NewPipelinePack(nil)
+		}
+		t.relayPack.Message = relayed
+		t.relayPack.TrustMsgBytes = false
+		pack = t.relayPack
+	}
+	if t.conf.Signer == nil {
+		return t.bufferedOut.QueueRecord(pack)
+	}
+	var encoded []byte
+	if encoded, err = t.or.Encoder().Encode(pack); encoded == nil || err != nil {
+		return
+	}
+	framing := t.or.FramingOptions()
+	framing.Signer = t.conf.Signer
+	if err = client.CreateFramedRecord(encoded, &t.signedBytes, framing); err != nil {
+		return
+	}
+	return t.bufferedOut.QueueBytes(t.signedBytes)
+}
 
+func (t *TcpOutput) connect() (err error) {
+	if t.endpoints != nil {
+		t.endpoint = t.endpoints.Acquire()
+		t.address = t.endpoint.Address
+		defer func() {
+			if err != nil {
+				t.releaseEndpoint(err)
+			}
+		}()
+	}
 	if t.conf.UseTls {
 		var goTlsConf *tls.Config
 		if goTlsConf, err = CreateGoTlsConfig(&t.conf.Tls); err != nil {
 			return fmt.Errorf("TLS init error: %s", err)
 		}
-		// We should use DialWithDialer but its not in GOLANG release yet.
-		// https://code.google.com/p/go/source/detail?r=3d37606fb79393f22a69573afe31f0b0cd4866e3&name=default
-		// t.connection, err = tls.DialWithDialer(dialer, "tcp", t.address, goTlsConf)
-		t.connection, err = tls.Dial("tcp", t.address, goTlsConf)
+		t.connection, err = t.dialTls(goTlsConf)
 	} else {
-		t.connection, err = dialer.Dial("tcp", t.address)
+		t.connection, err = t.dial(t.conf.Net, t.address)
 	}
 	if t.connection != nil && t.conf.KeepAlive {
 		tcpConn, ok := t.connection.(*net.TCPConn)
@@ -142,9 +255,56 @@ func (t *TcpOutput) connect() (err error) {
 			}
 		}
 	}
+	if err == nil && t.conf.SchemaNegotiation {
+		var version uint32
+		if version, err = negotiateSchema(t.connection); err != nil {
+			t.connection.Close()
+			t.connection = nil
+			return fmt.Errorf("schema negotiation w/ %s failed: %s", t.address, err)
+		}
+		atomic.StoreInt64(&t.schemaVersion, int64(version))
+	}
 	return
 }
 
+// Connects to the destination, possibly through a proxy, and starts a TLS
+// session over the connection.
+func (t *TcpOutput) dialTls(goTlsConf *tls.Config) (net.Conn, error) {
+	conn, err := t.dial(t.conf.Net, t.address)
+	if err != nil {
+		return nil, err
+	}
+	if goTlsConf.ServerName == "" {
+		if goTlsConf.ServerName, _, err = net.SplitHostPort(t.address); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	tlsConn := tls.Client(conn, goTlsConf)
+	if err = tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// Hands the endpoint of the current connection, if any, back to the pool.
+func (t *TcpOutput) releaseEndpoint(err error) {
+	if t.endpoint != nil {
+		t.endpoints.Release(t.endpoint, err)
+		t.endpoint = nil
+	}
+}
+
+// Probes an endpoint by opening and closing a connection to it.
+func (t *TcpOutput) probe(address string) error {
+	conn, err := t.dial(t.conf.Net, address)
+	if err == nil {
+		conn.Close()
+	}
+	return err
+}
+
 func (t *TcpOutput) SendRecord(record []byte) (err error) {
 	var n int
 
@@ -157,19 +317,20 @@ func (t *TcpOutput) SendRecord(record []byte) (err error) {
 		}
 	}
 
-	cleanupConn := func() {
+	cleanupConn := func(err error) {
 		if t.connection != nil {
 			t.connection.Close()
 			t.connection = nil
 		}
+		t.releaseEndpoint(err)
 	}
 
 	if n, err = t.connection.Write(record); err != nil {
-		cleanupConn()
+		cleanupConn(err)
 		err = fmt.Errorf("writing to %s: %s", t.address, err)
 	} else if n != len(record) {
-		cleanupConn()
 		err = fmt.Errorf("truncated output to: %s", t.address)
+		cleanupConn(err)
 	}
 
 	return
@@ -196,7 +357,11 @@ func (t *TcpOutput) Run(or OutputRunner, h PluginHelper) (err error) {
 
 	t.pConfig = h.PipelineConfig()
 
-	if t.conf.UseFraming == nil {
+	if t.conf.Signer != nil {
+		// Signing requires framing, which queueRecord applies along w/ the
+		// signature. The runner's flag tells the queue it's already there.
+		or.SetUseFraming(true)
+	} else if t.conf.UseFraming == nil {
 		// Nothing was specified, we'll default to framing IFF ProtobufEncoder
 		// is being used.
 		if _, ok := or.Encoder().(*ProtobufEncoder); ok {
@@ -210,8 +375,15 @@ func (t *TcpOutput) Run(or OutputRunner, h PluginHelper) (err error) {
 			t.connection.Close()
 			t.connection = nil
 		}
+		t.releaseEndpoint(nil)
 	}()
 
+	if t.endpoints != nil {
+		stopChecks := make(chan struct{})
+		defer close(stopChecks)
+		go t.endpoints.HealthCheck(t.probe, stopChecks)
+	}
+
 	t.bufferedOut, err = NewBufferedOutput("output_queue", t.name, or, h,
 		t.conf.QueueMaxBufferSize)
 	if err != nil {
@@ -236,13 +408,17 @@ func (t *TcpOutput) Run(or OutputRunner, h PluginHelper) (err error) {
 
 				break
 			}
-			if err := t.bufferedOut.QueueRecord(pack); err != nil {
-				if err == QueueIsFull {
+			queued := false
+			if err := t.queueRecord(pack); err != nil {
+				if err == ErrRelayLoop {
+					atomic.AddInt64(&t.relayLoopCount, 1)
+					atomic.AddInt64(&t.dropMessageCount, 1)
+				} else if err == QueueIsFull {
 					if !dupFullMsg {
 						or.LogError(err)
 						dupFullMsg = true
 					}
-					ok = t.queueFull(pack)
+					ok, queued = t.queueFull(pack)
 				} else {
 					or.LogError(err)
 					dupFullMsg = false
@@ -250,6 +426,13 @@ func (t *TcpOutput) Run(or OutputRunner, h PluginHelper) (err error) {
 			} else {
 				atomic.AddInt64(&t.processMessageCount, 1)
 				dupFullMsg = false
+				queued = true
+			}
+			// The message is delivered once it's in the disk buffer.
+			if queued {
+				pack.Tracker.Done()
+			} else {
+				pack.Tracker.Fail()
 			}
 			pack.Recycle()
 
@@ -269,17 +452,18 @@ func (t *TcpOutput) Run(or OutputRunner, h PluginHelper) (err error) {
 // This function will be called if the queue is full and another item is sent
 // to the queue. The result depends on the configured queue full action.
 // The returned bool indicates if the queue can continue to accept items.
-func (t *TcpOutput) queueFull(pack *PipelinePack) bool {
+func (t *TcpOutput) queueFull(pack *PipelinePack) (ok, queued bool) {
 	switch t.conf.QueueFullAction {
 	// Tries to queue message until its possible to send it to output.
 	case "block":
 		for t.outputBlock.Wait() == nil {
 			if t.pConfig.Globals.IsShuttingDown() {
-				return false
+				return false, false
 			}
-			blockErr := t.bufferedOut.QueueRecord(pack)
+			blockErr := t.queueRecord(pack)
 			if blockErr == nil {
 				atomic.AddInt64(&t.processMessageCount, 1)
+				queued = true
 				break
 			}
 			runtime.Gosched()
@@ -287,12 +471,18 @@ func (t *TcpOutput) queueFull(pack *PipelinePack) bool {
 	// Terminate Heka activity.
 	case "shutdown":
 		t.pConfig.Globals.ShutDown()
-		return false
+		return false, false
 
 	// Drop packets
 	case "drop":
 		atomic.AddInt64(&t.dropMessageCount, 1)
 	}
+	return true, queued
+}
+
+// Tracked messages are acknowledged once they've been written to the disk
+// buffer.
+func (t *TcpOutput) AcksDelivery() bool {
 	return true
 }
 
@@ -312,7 +502,16 @@ func (t *TcpOutput) ReportMsg(msg *message.Message) error {
 		atomic.LoadInt64(&t.processMessageCount), "count")
 	message.NewInt64Field(msg, "DropMessageCount",
 		atomic.LoadInt64(&t.dropMessageCount), "count")
+	message.NewInt64Field(msg, "RelayLoopCount",
+		atomic.LoadInt64(&t.relayLoopCount), "count")
+	if t.conf.SchemaNegotiation {
+		message.NewInt64Field(msg, "SchemaVersion",
+			atomic.LoadInt64(&t.schemaVersion), "")
+	}
 
 	t.bufferedOut.ReportMsg(msg)
+	if t.endpoints != nil {
+		t.endpoints.ReportMsg(msg)
+	}
 	return nil
 }
@@ -17,6 +17,8 @@ package tcp
 
 import (
 	"code.google.com/p/gogoprotobuf/proto"
+	"github.com/mozilla-services/heka/client"
+	"github.com/mozilla-services/heka/message"
 	. "github.com/mozilla-services/heka/pipeline"
 	pipeline_ts "github.com/mozilla-services/heka/pipeline/testsupport"
 	"github.com/mozilla-services/heka/plugins"
@@ -88,6 +90,12 @@ func TcpOutputSpec(c gs.Context) {
 			}()
 		}
 
+		c.Specify("rejects an unknown network", func() {
+			config.Net = "udp"
+			err := tcpOutput.Init(config)
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+
 		c.Specify("doesn't use framing w/o ProtobufEncoder", func() {
 			encoder := new(plugins.PayloadEncoder)
 			oth.MockOutputRunner.EXPECT().Encoder().Return(encoder)
@@ -163,6 +171,122 @@ func TcpOutputSpec(c gs.Context) {
 			c.Expect(err, gs.IsNil)
 		})
 
+		c.Specify("signs messages when a signer is configured", func() {
+			config.Signer = &message.MessageSigningConfig{
+				Name:    "test",
+				Key:     "testkey",
+				Version: 1,
+			}
+			err := tcpOutput.Init(config)
+			c.Assume(err, gs.IsNil)
+			c.Expect(config.Signer.Hash, gs.Equals, "md5")
+
+			ln, err := net.Listen("tcp", "localhost:9125")
+			c.Assume(err, gs.IsNil)
+			defer ln.Close()
+			ch := make(chan []byte, 1)
+			go func() {
+				conn, err := ln.Accept()
+				if err != nil {
+					ch <- nil
+					return
+				}
+				b := make([]byte, 1000)
+				n, _ := conn.Read(b)
+				ch <- b[:n]
+				conn.Close()
+			}()
+
+			oth.MockOutputRunner.EXPECT().SetUseFraming(true)
+			oth.MockOutputRunner.EXPECT().Encoder().Return(encoder).AnyTimes()
+			oth.MockOutputRunner.EXPECT().UsesFraming().Return(true).AnyTimes()
+			oth.MockOutputRunner.EXPECT().FramingOptions().Return(client.FramingOptions{}).AnyTimes()
+
+			startOutput()
+			inChan <- pack
+			result := <-ch
+
+			c.Assume(len(result) > message.HEADER_FRAMING_SIZE, gs.IsTrue)
+			headerEnd := int(result[1]) + message.HEADER_FRAMING_SIZE
+			header := new(message.Header)
+			ok, err := message.DecodeHeader(result[message.HEADER_DELIMITER_SIZE:headerEnd],
+				header)
+			c.Expect(ok, gs.IsTrue)
+			c.Expect(err, gs.IsNil)
+			c.Expect(header.GetHmacSigner(), gs.Equals, "test")
+			c.Expect(header.GetHmacKeyVersion(), gs.Equals, uint32(1))
+			c.Expect(len(header.GetHmac()), gs.Equals, 16)
+			c.Expect(string(result[headerEnd:]), gs.Equals, string(matchBytes))
+
+			close(inChan)
+			err = <-errChan
+			c.Expect(err, gs.IsNil)
+		})
+
+		c.Specify("appends its hostname to the relay path", func() {
+			config.RelayPath = true
+			config.Signer = &message.MessageSigningConfig{
+				Name: "test",
+				Key:  "testkey",
+			}
+			err := tcpOutput.Init(config)
+			c.Assume(err, gs.IsNil)
+
+			ln, err := net.Listen("tcp", "localhost:9125")
+			c.Assume(err, gs.IsNil)
+			defer ln.Close()
+			ch := make(chan []byte, 1)
+			go func() {
+				conn, err := ln.Accept()
+				if err != nil {
+					ch <- nil
+					return
+				}
+				b := make([]byte, 1000)
+				n, _ := conn.Read(b)
+				ch <- b[:n]
+				conn.Close()
+			}()
+
+			oth.MockOutputRunner.EXPECT().SetUseFraming(true)
+			oth.MockOutputRunner.EXPECT().Encoder().Return(encoder).AnyTimes()
+			oth.MockOutputRunner.EXPECT().UsesFraming().Return(true).AnyTimes()
+			oth.MockOutputRunner.EXPECT().FramingOptions().Return(client.FramingOptions{}).AnyTimes()
+
+			startOutput()
+			inChan <- pack
+			result := <-ch
+
+			c.Assume(len(result) > message.HEADER_FRAMING_SIZE, gs.IsTrue)
+			headerEnd := int(result[1]) + message.HEADER_FRAMING_SIZE
+			relayed := new(message.Message)
+			err = proto.Unmarshal(result[headerEnd:], relayed)
+			c.Expect(err, gs.IsNil)
+			c.Expect(RelayedThrough(relayed, pConfig.Hostname()), gs.IsTrue)
+			// The original message is left alone.
+			c.Expect(pack.Message.FindFirstField(RELAY_FIELD), gs.IsNil)
+
+			// A message that has already been relayed by this node is dropped.
+			looped := NewPipelinePack(pConfig.InputRecycleChan())
+			looped.Message = relayed
+			inChan <- looped
+			close(inChan)
+			err = <-errChan
+			c.Expect(err, gs.IsNil)
+			c.Expect(atomic.LoadInt64(&tcpOutput.relayLoopCount), gs.Equals, int64(1))
+			c.Expect(atomic.LoadInt64(&tcpOutput.dropMessageCount), gs.Equals, int64(1))
+		})
+
+		c.Specify("rejects an invalid signer hash", func() {
+			config.Signer = &message.MessageSigningConfig{
+				Name: "test",
+				Key:  "testkey",
+				Hash: "sha256",
+			}
+			err := tcpOutput.Init(config)
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+
 		c.Specify("far end not initially listening", func() {
 			oth.MockOutputRunner.EXPECT().LogError(gomock.Any()).AnyTimes()
 
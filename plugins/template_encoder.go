@@ -0,0 +1,151 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package plugins
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/cactus/gostrftime"
+	"github.com/mozilla-services/heka/pipeline"
+	"io/ioutil"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Syslog severity names, indexed by severity.
+var severityNames = []string{"emerg", "alert", "crit", "err", "warning",
+	"notice", "info", "debug"}
+
+// Functions available to TemplateEncoder templates.
+var templateFuncs = template.FuncMap{
+	"strftime": func(format string, t time.Time) string {
+		return gostrftime.Strftime(format, t)
+	},
+	"upper": strings.ToUpper,
+	"lower": strings.ToLower,
+}
+
+// TemplateEncoder renders messages using a Go `text/template`, allowing
+// arbitrary line formats.
+type TemplateEncoder struct {
+	*TemplateEncoderConfig
+	tmpl     *template.Template
+	shareDir func(string) string
+}
+
+// ConfigStruct for TemplateEncoder plugin.
+type TemplateEncoderConfig struct {
+	// Template text.
+	Template string
+	// Path to a file containing the template text, used if `template` is
+	// empty. Relative paths are evaluated relative to the Heka share dir.
+	TemplateFile string `toml:"template_file"`
+	// Whether a newline is appended to each rendered message.
+	AppendNewlines bool `toml:"append_newlines"`
+}
+
+// Data made available to the template for each message.
+type templateData struct {
+	Uuid         string
+	Timestamp    time.Time
+	Type         string
+	Logger       string
+	Severity     int32
+	SeverityName string
+	Payload      string
+	EnvVersion   string
+	Pid          int32
+	Hostname     string
+	// Dynamic fields, w/ the first value of each field keyed by name.
+	Fields map[string]interface{}
+}
+
+func (te *TemplateEncoder) ConfigStruct() interface{} {
+	return &TemplateEncoderConfig{
+		AppendNewlines: true,
+	}
+}
+
+// Heka will call this before calling any other methods to give us access to
+// the pipeline configuration.
+func (te *TemplateEncoder) SetPipelineConfig(pConfig *pipeline.PipelineConfig) {
+	te.shareDir = pConfig.Globals.PrependShareDir
+}
+
+func (te *TemplateEncoder) Init(config interface{}) (err error) {
+	te.TemplateEncoderConfig = config.(*TemplateEncoderConfig)
+
+	text := te.Template
+	if text == "" {
+		if te.TemplateFile == "" {
+			return errors.New("one of `template` or `template_file` is required")
+		}
+		path := te.TemplateFile
+		if te.shareDir != nil {
+			path = te.shareDir(path)
+		}
+		var contents []byte
+		if contents, err = ioutil.ReadFile(path); err != nil {
+			return fmt.Errorf("can't read template file: %s", err)
+		}
+		text = string(contents)
+	}
+	if te.tmpl, err = template.New("").Funcs(templateFuncs).Parse(text); err != nil {
+		return fmt.Errorf("can't parse template: %s", err)
+	}
+	return
+}
+
+func (te *TemplateEncoder) Encode(pack *pipeline.PipelinePack) (output []byte, err error) {
+	msg := pack.Message
+	data := &templateData{
+		Uuid:       msg.GetUuidString(),
+		Timestamp:  time.Unix(0, msg.GetTimestamp()).UTC(),
+		Type:       msg.GetType(),
+		Logger:     msg.GetLogger(),
+		Severity:   msg.GetSeverity(),
+		Payload:    msg.GetPayload(),
+		EnvVersion: msg.GetEnvVersion(),
+		Pid:        msg.GetPid(),
+		Hostname:   msg.GetHostname(),
+		Fields:     make(map[string]interface{}, len(msg.Fields)),
+	}
+	if data.Severity >= 0 && int(data.Severity) < len(severityNames) {
+		data.SeverityName = severityNames[data.Severity]
+	}
+	for _, field := range msg.Fields {
+		name := field.GetName()
+		if _, ok := data.Fields[name]; !ok {
+			data.Fields[name] = field.GetValue()
+		}
+	}
+
+	buf := new(bytes.Buffer)
+	if err = te.tmpl.Execute(buf, data); err != nil {
+		return nil, fmt.Errorf("error rendering template: %s", err)
+	}
+	if te.AppendNewlines {
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes(), nil
+}
+
+func init() {
+	pipeline.RegisterPlugin("TemplateEncoder", func() interface{} {
+		return new(TemplateEncoder)
+	})
+}
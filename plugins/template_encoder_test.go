@@ -0,0 +1,78 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package plugins
+
+import (
+	"github.com/mozilla-services/heka/message"
+	"github.com/mozilla-services/heka/pipeline"
+	pipeline_ts "github.com/mozilla-services/heka/pipeline/testsupport"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+	"os"
+)
+
+func TemplateEncoderSpec(c gs.Context) {
+	c.Specify("A TemplateEncoder", func() {
+		encoder := new(TemplateEncoder)
+		config := encoder.ConfigStruct().(*TemplateEncoderConfig)
+		pack := pipeline.NewPipelinePack(make(chan *pipeline.PipelinePack, 1))
+		pack.Message = pipeline_ts.GetTestMessage()
+		field, _ := message.NewField("status", int64(200), "")
+		pack.Message.AddField(field)
+
+		c.Specify("renders headers and fields", func() {
+			config.Template = `{{strftime "%Y-%m-%d %H:%M:%S" .Timestamp}} ` +
+				`{{.SeverityName | upper}} {{.Hostname}} {{.Fields.foo}} ` +
+				`{{index .Fields "status"}}: {{.Payload}}`
+			err := encoder.Init(config)
+			c.Assume(err, gs.IsNil)
+			output, err := encoder.Encode(pack)
+			c.Expect(err, gs.IsNil)
+			c.Expect(string(output), gs.Equals,
+				"2006-01-02 22:04:05 INFO my.host.name bar 200: Test Payload\n")
+		})
+
+		c.Specify("supports conditionals and go time formats", func() {
+			config.Template = `{{.Timestamp.Format "15:04"}}` +
+				`{{if le .Severity 3}} ALERT{{end}}`
+			config.AppendNewlines = false
+			err := encoder.Init(config)
+			c.Assume(err, gs.IsNil)
+			output, err := encoder.Encode(pack)
+			c.Expect(err, gs.IsNil)
+			c.Expect(string(output), gs.Equals, "22:04")
+			pack.Message.SetSeverity(2)
+			output, err = encoder.Encode(pack)
+			c.Expect(err, gs.IsNil)
+			c.Expect(string(output), gs.Equals, "22:04 ALERT")
+		})
+
+		c.Specify("loads the template from a file", func() {
+			path := pipeline_ts.WriteStringToTmpFile("{{.Type}}")
+			defer os.Remove(path)
+			config.TemplateFile = path
+			err := encoder.Init(config)
+			c.Assume(err, gs.IsNil)
+			output, err := encoder.Encode(pack)
+			c.Expect(err, gs.IsNil)
+			c.Expect(string(output), gs.Equals, "TEST\n")
+		})
+
+		c.Specify("rejects invalid templates", func() {
+			c.Expect(encoder.Init(config), gs.Not(gs.IsNil))
+			config.Template = "{{.Type"
+			c.Expect(encoder.Init(config), gs.Not(gs.IsNil))
+		})
+	})
+}
@@ -16,6 +16,7 @@ package testsupport
 
 import (
 	"github.com/rafrombrc/gospec/src/gospec"
+	"net"
 	"strings"
 )
 
@@ -28,3 +29,14 @@ func StringContains(actual interface{}, criteria interface{}) (match bool,
 	neg = gospec.Messagef(toTest, "does not contain "+critTest)
 	return
 }
+
+// Returns whether the host can listen on the IPv6 loopback address, so specs
+// that need IPv6 can be skipped where it isn't available.
+func IPv6Available() bool {
+	listener, err := net.Listen("tcp6", "[::1]:0")
+	if err != nil {
+		return false
+	}
+	listener.Close()
+	return true
+}
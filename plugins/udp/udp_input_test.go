@@ -111,6 +111,29 @@ func UdpInputSpec(c gs.Context) {
 			})
 		})
 
+		if plugins_ts.IPv6Available() {
+			c.Specify("using the IPv6 wildcard address", func() {
+				config.Net = "udp6"
+				config.Address = "[::]:55568"
+
+				err := udpInput.Init(config)
+				c.Assume(err, gs.IsNil)
+				realListener := (udpInput.listener).(*net.UDPConn)
+				c.Expect(realListener.LocalAddr().String(), gs.Equals, "[::]:55568")
+
+				go udpInput.Run(ith.MockInputRunner, ith.MockHelper)
+				conn, err := net.Dial("udp6", "[::1]:55568")
+				c.Assume(err, gs.IsNil)
+				_, err = conn.Write(buf)
+				c.Assume(err, gs.IsNil)
+				conn.Close()
+
+				recd := <-bytesChan
+				c.Expect(string(recd), gs.Equals, string(buf))
+				udpInput.Stop()
+			})
+		}
+
 		if runtime.GOOS != "windows" {
 			c.Specify("using a unix datagram socket", func() {
 				tmpDir, err := ioutil.TempDir("", "heka-socket")
@@ -20,6 +20,7 @@ import (
 	"github.com/mozilla-services/heka/pipeline"
 	"net"
 	"runtime"
+	"time"
 )
 
 // This is our plugin struct.
@@ -41,6 +42,14 @@ type UdpOutputConfig struct {
 
 	// Maximum size of message, plugin drops the data if it exceeds this limit.
 	MaxMessageSize int `toml:"max_message_size"`
+	// If true, messages exceeding the maximum size are truncated instead of
+	// being dropped.
+	TruncateOversize bool `toml:"truncate_oversize"`
+	// Interval in milliseconds at which buffered messages are sent. If 0,
+	// each message is sent in its own datagram as soon as it's encoded.
+	FlushInterval uint32 `toml:"flush_interval"`
+	// Separator written between messages that share a datagram.
+	Delimiter string
 }
 
 // Provides pipeline.HasConfigStruct interface.
@@ -50,6 +59,7 @@ func (o *UdpOutput) ConfigStruct() interface{} {
 
 		// Defines maximum size of udp data for IPv4
 		MaxMessageSize: 65507,
+		Delimiter:      "\n",
 	}
 }
 
@@ -92,7 +102,7 @@ func (o *UdpOutput) Init(config interface{}) (err error) {
 			lAddr, err = net.ResolveUDPAddr(o.Net, o.LocalAddress)
 			if err != nil {
 				return fmt.Errorf("Error resolving local UDP address '%s': %s",
-					o.Address, err.Error())
+					o.LocalAddress, err.Error())
 			}
 		}
 		if o.conn, err = net.DialUDP(o.Net, lAddr, udpAddr); err != nil {
@@ -110,26 +120,77 @@ func (o *UdpOutput) Run(or pipeline.OutputRunner, h pipeline.PluginHelper) (err
 	}
 
 	var (
+		ok       = true
+		pack     *pipeline.PipelinePack
 		outBytes []byte
 		e        error
+		inChan   = or.InChan()
+		tick     <-chan time.Time
+		// Holds the messages waiting to be sent in the next datagram.
+		buf = make([]byte, 0, o.MaxMessageSize)
 	)
 
-	for pack := range or.InChan() {
-		if outBytes, e = or.Encode(pack); e != nil {
-			or.LogError(fmt.Errorf("Error encoding message: %s", e.Error()))
-		} else if outBytes != nil {
-			msgSize := len(outBytes)
-			if msgSize > o.UdpOutputConfig.MaxMessageSize {
-				or.LogError(fmt.Errorf("Message has exceeded allowed UDP data size: %d > %d", msgSize, o.UdpOutputConfig.MaxMessageSize))
-			} else {
-				o.conn.Write(outBytes)
+	if o.FlushInterval > 0 {
+		ticker := time.NewTicker(time.Duration(o.FlushInterval) * time.Millisecond)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	flush := func() {
+		if len(buf) > 0 {
+			o.write(or, buf)
+			buf = buf[:0]
+		}
+	}
+
+	for ok {
+		select {
+		case pack, ok = <-inChan:
+			if !ok {
+				flush()
+				break
+			}
+			if outBytes, e = or.Encode(pack); e != nil {
+				or.LogError(fmt.Errorf("Error encoding message: %s", e.Error()))
+			} else if outBytes != nil {
+				msgSize := len(outBytes)
+				if msgSize > o.MaxMessageSize {
+					if !o.TruncateOversize {
+						or.LogError(fmt.Errorf("Message has exceeded allowed UDP data size: %d > %d", msgSize, o.MaxMessageSize))
+						pack.Recycle()
+						continue
+					}
+					outBytes = outBytes[:o.MaxMessageSize]
+				}
+				if o.FlushInterval == 0 {
+					o.write(or, outBytes)
+				} else {
+					// Send what we have if this message won't fit in the
+					// same datagram.
+					if len(buf) > 0 && len(buf)+len(o.Delimiter)+len(outBytes) > o.MaxMessageSize {
+						flush()
+					}
+					if len(buf) > 0 {
+						buf = append(buf, o.Delimiter...)
+					}
+					buf = append(buf, outBytes...)
+				}
 			}
+			pack.Recycle()
+		case <-tick:
+			flush()
 		}
-		pack.Recycle()
 	}
 	return
 }
 
+// Sends a single datagram.
+func (o *UdpOutput) write(or pipeline.OutputRunner, data []byte) {
+	if _, err := o.conn.Write(data); err != nil {
+		or.LogError(fmt.Errorf("Error writing to '%s': %s", o.Address, err.Error()))
+	}
+}
+
 func init() {
 	pipeline.RegisterPlugin("UdpOutput", func() interface{} {
 		return new(UdpOutput)
@@ -121,6 +121,31 @@ func UdpOutputSpec(c gs.Context) {
 				close(inChan)
 				wg.Wait()
 			})
+
+			c.Specify("buffers messages into a single datagram", func() {
+				config.FlushInterval = 60000
+				err := udpOutput.Init(config)
+				c.Assume(err, gs.IsNil)
+				oth.MockOutputRunner.EXPECT().Encode(pack).Return(encoder.Encode(pack))
+
+				wg.Add(1)
+				go func() {
+					err = udpOutput.Run(oth.MockOutputRunner, oth.MockHelper)
+					c.Expect(err, gs.IsNil)
+					wg.Done()
+				}()
+
+				inChan <- pack
+				<-rChan
+				inChan <- pack
+				<-rChan
+				// Nothing is sent until the buffer is flushed on shutdown.
+				close(inChan)
+				result = <-ch
+
+				c.Expect(result, gs.Equals, payload+"\n"+payload)
+				wg.Wait()
+			})
 		})
 
 		c.Specify("using Unix datagrams", func() {
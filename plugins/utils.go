@@ -17,6 +17,7 @@ package plugins
 
 import (
 	"fmt"
+	"github.com/mozilla-services/heka/message"
 	"io/ioutil"
 	"os"
 	"strings"
@@ -42,3 +43,58 @@ func CheckWritePermission(fp string) (err error) {
 	}
 	return
 }
+
+// Replaces any `%{<name>}` placeholders in the template with the value of the
+// named message header (Type, Logger, Hostname, EnvVersion, Severity, Pid,
+// Uuid, or Payload) or the first value of the named dynamic field.
+// Placeholders that don't match anything in the message are replaced with an
+// empty string, unterminated placeholders are left as is.
+func InterpolateMessageString(template string, msg *message.Message) string {
+	return InterpolateMessageStringEscaped(template, msg, nil)
+}
+
+// Works like InterpolateMessageString, but passes each interpolated value through
+// the provided escape function (if not nil) before it's inserted.
+func InterpolateMessageStringEscaped(template string, msg *message.Message,
+	escape func(string) string) string {
+
+	if !strings.Contains(template, "%{") {
+		return template
+	}
+	parts := strings.Split(template, "%{")
+	for i, part := range parts[1:] {
+		end := strings.Index(part, "}")
+		if end == -1 {
+			parts[i+1] = "%{" + part
+			continue
+		}
+		var val string
+		switch name := part[:end]; name {
+		case "Type":
+			val = msg.GetType()
+		case "Logger":
+			val = msg.GetLogger()
+		case "Hostname":
+			val = msg.GetHostname()
+		case "EnvVersion":
+			val = msg.GetEnvVersion()
+		case "Severity":
+			val = fmt.Sprint(msg.GetSeverity())
+		case "Pid":
+			val = fmt.Sprint(msg.GetPid())
+		case "Uuid":
+			val = msg.GetUuidString()
+		case "Payload":
+			val = msg.GetPayload()
+		default:
+			if fieldVal, ok := msg.GetFieldValue(name); ok {
+				val = fmt.Sprint(fieldVal)
+			}
+		}
+		if escape != nil {
+			val = escape(val)
+		}
+		parts[i+1] = val + part[end+1:]
+	}
+	return strings.Join(parts, "")
+}
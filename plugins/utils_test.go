@@ -0,0 +1,52 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package plugins
+
+import (
+	pipeline_ts "github.com/mozilla-services/heka/pipeline/testsupport"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+	"strings"
+)
+
+func InterpolateMessageStringSpec(c gs.Context) {
+	msg := pipeline_ts.GetTestMessage()
+
+	c.Specify("String interpolation", func() {
+		c.Specify("replaces headers and fields", func() {
+			s := InterpolateMessageString("%{Type}.%{Hostname}.%{foo}", msg)
+			c.Expect(s, gs.Equals, "TEST.my.host.name.bar")
+		})
+
+		c.Specify("replaces missing fields w/ an empty string", func() {
+			s := InterpolateMessageString("%{Logger}.%{missing}", msg)
+			c.Expect(s, gs.Equals, "GoSpec.")
+		})
+
+		c.Specify("leaves unterminated placeholders alone", func() {
+			s := InterpolateMessageString("logs.%{Severity}.%{foo", msg)
+			c.Expect(s, gs.Equals, "logs.6.%{foo")
+		})
+
+		c.Specify("escapes interpolated values", func() {
+			s := InterpolateMessageStringEscaped("[%{Type}]", msg, strings.ToLower)
+			c.Expect(s, gs.Equals, "[test]")
+		})
+
+		c.Specify("returns templates w/o placeholders unchanged", func() {
+			s := InterpolateMessageString("plain", msg)
+			c.Expect(s, gs.Equals, "plain")
+		})
+	})
+}
@@ -0,0 +1,330 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package xmpp
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"github.com/mattn/go-xmpp"
+	"github.com/mozilla-services/heka/message"
+	. "github.com/mozilla-services/heka/pipeline"
+	"github.com/mozilla-services/heka/plugins"
+	"github.com/mozilla-services/heka/plugins/tcp"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Connection to an XMPP server, an interface so the tests can fake it.
+type xmppClient interface {
+	// Sends a message of the given type, "chat" or "groupchat".
+	Send(to, typ, text string) error
+	// Joins a multi-user chat room.
+	Join(room, nick string) error
+	// Reads the next stanza, which the output discards.
+	Recv() error
+	Close() error
+}
+
+// Output plugin that sends messages to XMPP users and multi-user chat rooms.
+type XmppOutput struct {
+	*XmppOutputConfig
+	options             xmpp.Options
+	connect             func() (xmppClient, error)
+	client              xmppClient
+	recvErr             chan error
+	retryHelper         *RetryHelper
+	or                  OutputRunner
+	processMessageCount int64
+	dropMessageCount    int64
+	reconnectCount      int64
+	reportLock          sync.Mutex
+}
+
+// ConfigStruct for XmppOutput plugin.
+type XmppOutputConfig struct {
+	// JID the output logs in as, e.g. "heka@example.com".
+	Jid      string
+	Password string
+	// Resource part of the full JID.
+	Resource string
+	// Server address. Defaults to the JID's domain on port 5222.
+	Server string
+	// JIDs that are sent each message in a one to one chat.
+	Recipients []string
+	// Multi-user chat rooms that are joined and sent each message.
+	Rooms []string
+	// Nick used in the rooms.
+	Nick string
+	// One of "starttls", "direct", or "none".
+	TlsMode string `toml:"tls_mode"`
+	Tls     tcp.TlsConfig
+	// Template used to generate the message text, may contain `%{<name>}`
+	// placeholders. If set, no encoder is required.
+	Template string
+	// Maximum number of reconnect attempts for a message before it's
+	// dropped. -1 means retry forever.
+	MaxRetries int `toml:"max_retries"`
+}
+
+func (o *XmppOutput) ConfigStruct() interface{} {
+	return &XmppOutputConfig{
+		Resource:   "heka",
+		Nick:       "heka",
+		TlsMode:    "starttls",
+		MaxRetries: -1,
+	}
+}
+
+func (o *XmppOutput) Init(config interface{}) (err error) {
+	o.XmppOutputConfig = config.(*XmppOutputConfig)
+
+	parts := strings.SplitN(o.Jid, "@", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return fmt.Errorf("`jid` must be a bare JID like user@example.com, got '%s'", o.Jid)
+	}
+	if len(o.Recipients) == 0 && len(o.Rooms) == 0 {
+		return errors.New("at least one recipient or room must be configured")
+	}
+	server := o.Server
+	if server == "" {
+		server = net.JoinHostPort(parts[1], "5222")
+	}
+	host, _, err := net.SplitHostPort(server)
+	if err != nil {
+		return fmt.Errorf("invalid server address '%s': %s", server, err)
+	}
+
+	o.options = xmpp.Options{
+		Host:     server,
+		User:     o.Jid,
+		Password: o.Password,
+		Resource: o.Resource,
+		Session:  true,
+	}
+	var tlsConfig *tls.Config
+	if o.TlsMode != "none" {
+		if tlsConfig, err = tcp.CreateGoTlsConfig(&o.Tls); err != nil {
+			return fmt.Errorf("TLS init error: %s", err)
+		}
+		if tlsConfig.ServerName == "" {
+			tlsConfig.ServerName = host
+		}
+		o.options.TLSConfig = tlsConfig
+	}
+	switch o.TlsMode {
+	case "starttls":
+		o.options.NoTLS = true
+		o.options.StartTLS = true
+	case "direct":
+	case "none":
+		o.options.NoTLS = true
+		o.options.InsecureAllowUnencryptedAuth = true
+	default:
+		return fmt.Errorf("`tls_mode` must be 'starttls', 'direct', or 'none', got %s",
+			o.TlsMode)
+	}
+
+	o.connect = o.dial
+	o.retryHelper, err = NewRetryHelper(o.retryOptions())
+	if err != nil {
+		return fmt.Errorf("can't create retry helper: %s", err.Error())
+	}
+	return
+}
+
+// The output's own retry settings, which a `backoff` section can override.
+func (o *XmppOutput) retryOptions() RetryOptions {
+	return RetryOptions{
+		MaxDelay:   "30s",
+		Delay:      "1s",
+		MaxRetries: o.MaxRetries,
+	}
+}
+
+type goXmppClient struct {
+	*xmpp.Client
+}
+
+func (c goXmppClient) Send(to, typ, text string) error {
+	_, err := c.Client.Send(xmpp.Chat{Remote: to, Type: typ, Text: text})
+	return err
+}
+
+// Joins a room w/o asking for its history, so the output doesn't have to
+// read through it.
+func (c goXmppClient) Join(room, nick string) error {
+	var to bytes.Buffer
+	xml.EscapeText(&to, []byte(room+"/"+nick))
+	_, err := c.SendOrg(fmt.Sprintf("<presence to='%s'>"+
+		"<x xmlns='http://jabber.org/protocol/muc'><history maxstanzas='0'/></x>"+
+		"</presence>", to.String()))
+	return err
+}
+
+func (c goXmppClient) Recv() error {
+	_, err := c.Client.Recv()
+	return err
+}
+
+func (o *XmppOutput) dial() (xmppClient, error) {
+	client, err := o.options.NewClient()
+	if err != nil {
+		return nil, err
+	}
+	return goXmppClient{client}, nil
+}
+
+// Connects and joins the rooms if there's no connection yet. Incoming
+// stanzas are read and discarded, so the server doesn't stall the stream.
+func (o *XmppOutput) ensureConnected() (err error) {
+	if o.client != nil {
+		select {
+		case err = <-o.recvErr:
+			o.disconnect()
+			o.or.LogError(fmt.Errorf("connection lost: %s", err))
+		default:
+			return nil
+		}
+	}
+	client, err := o.connect()
+	if err != nil {
+		return fmt.Errorf("can't connect to %s: %s", o.options.Host, err)
+	}
+	for _, room := range o.Rooms {
+		if err = client.Join(room, o.Nick); err != nil {
+			client.Close()
+			return fmt.Errorf("can't join room %s: %s", room, err)
+		}
+	}
+	recvErr := make(chan error, 1)
+	go func() {
+		for {
+			if err := client.Recv(); err != nil {
+				recvErr <- err
+				return
+			}
+		}
+	}()
+	o.client, o.recvErr = client, recvErr
+	return nil
+}
+
+func (o *XmppOutput) disconnect() {
+	if o.client != nil {
+		o.client.Close()
+		o.client = nil
+	}
+}
+
+// Sends the text to every recipient and room.
+func (o *XmppOutput) sendAll(text string) error {
+	for _, to := range o.Recipients {
+		if err := o.client.Send(to, "chat", text); err != nil {
+			return err
+		}
+	}
+	for _, room := range o.Rooms {
+		if err := o.client.Send(room, "groupchat", text); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Delivers the text, reconnecting w/ an increasing delay until it's sent or
+// the retries are used up. A message that failed part way through is resent
+// to all recipients.
+func (o *XmppOutput) deliver(text string) (err error) {
+	o.retryHelper.Reset()
+	for {
+		if err = o.ensureConnected(); err == nil {
+			if err = o.sendAll(text); err == nil {
+				return
+			}
+			o.disconnect()
+		}
+		if o.retryHelper.Wait() != nil {
+			return
+		}
+		atomic.AddInt64(&o.reconnectCount, 1)
+		o.or.LogMessage(fmt.Sprintf("%s; reconnecting", err.Error()))
+	}
+}
+
+func (o *XmppOutput) Run(or OutputRunner, h PluginHelper) (err error) {
+	if or.Encoder() == nil && o.Template == "" {
+		return errors.New("Encoder required.")
+	}
+	o.or = or
+	if o.retryHelper, err = NewRunnerRetryHelper(or, o.retryOptions()); err != nil {
+		return fmt.Errorf("can't create retry helper: %s", err.Error())
+	}
+	defer o.disconnect()
+
+	var (
+		outgoing []byte
+		e        error
+	)
+	for pack := range or.InChan() {
+		e = nil
+		if o.Template != "" {
+			outgoing = []byte(plugins.InterpolateMessageString(o.Template, pack.Message))
+		} else {
+			outgoing, e = or.Encode(pack)
+		}
+		pack.Recycle()
+		if e != nil {
+			or.LogError(e)
+			atomic.AddInt64(&o.dropMessageCount, 1)
+			continue
+		}
+		if outgoing == nil {
+			continue
+		}
+		if e = o.deliver(string(outgoing)); e != nil {
+			or.LogError(fmt.Errorf("dropping message: %s", e))
+			atomic.AddInt64(&o.dropMessageCount, 1)
+			continue
+		}
+		atomic.AddInt64(&o.processMessageCount, 1)
+	}
+	return
+}
+
+// Satisfies the `pipeline.ReportingPlugin` interface to provide plugin state
+// information to the Heka report and dashboard.
+func (o *XmppOutput) ReportMsg(msg *message.Message) error {
+	o.reportLock.Lock()
+	defer o.reportLock.Unlock()
+
+	message.NewInt64Field(msg, "ProcessMessageCount",
+		atomic.LoadInt64(&o.processMessageCount), "count")
+	message.NewInt64Field(msg, "DropMessageCount",
+		atomic.LoadInt64(&o.dropMessageCount), "count")
+	message.NewInt64Field(msg, "ReconnectCount",
+		atomic.LoadInt64(&o.reconnectCount), "count")
+	return nil
+}
+
+func init() {
+	RegisterPlugin("XmppOutput", func() interface{} {
+		return new(XmppOutput)
+	})
+}
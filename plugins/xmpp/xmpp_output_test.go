@@ -0,0 +1,153 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package xmpp
+
+import (
+	"errors"
+	pipeline_ts "github.com/mozilla-services/heka/pipeline/testsupport"
+	plugins_ts "github.com/mozilla-services/heka/plugins/testsupport"
+	"github.com/rafrombrc/gomock/gomock"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+)
+
+type sentChat struct {
+	to, typ, text string
+}
+
+// Fake client recording what it's asked to do.
+type fakeClient struct {
+	sent     []sentChat
+	joined   []string
+	failSend int
+	closed   chan struct{}
+}
+
+func (c *fakeClient) Send(to, typ, text string) error {
+	if c.failSend > 0 {
+		c.failSend--
+		return errors.New("broken pipe")
+	}
+	c.sent = append(c.sent, sentChat{to, typ, text})
+	return nil
+}
+
+func (c *fakeClient) Join(room, nick string) error {
+	c.joined = append(c.joined, room+"/"+nick)
+	return nil
+}
+
+func (c *fakeClient) Recv() error {
+	<-c.closed
+	return errors.New("closed")
+}
+
+func (c *fakeClient) Close() error {
+	close(c.closed)
+	return nil
+}
+
+func XmppOutputSpec(c gs.Context) {
+	t := new(pipeline_ts.SimpleT)
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	output := new(XmppOutput)
+	config := output.ConfigStruct().(*XmppOutputConfig)
+	config.Jid = "heka@example.com"
+	config.Recipients = []string{"ops@example.com"}
+	config.Rooms = []string{"alerts@conference.example.com"}
+
+	c.Specify("An XmppOutput", func() {
+		c.Specify("requires a bare JID", func() {
+			config.Jid = "heka"
+			err := output.Init(config)
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+
+		c.Specify("requires somebody to send to", func() {
+			config.Recipients = nil
+			config.Rooms = nil
+			err := output.Init(config)
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+
+		c.Specify("defaults to the JID's domain w/ STARTTLS", func() {
+			err := output.Init(config)
+			c.Assume(err, gs.IsNil)
+			c.Expect(output.options.Host, gs.Equals, "example.com:5222")
+			c.Expect(output.options.StartTLS, gs.IsTrue)
+			c.Expect(output.options.TLSConfig.ServerName, gs.Equals, "example.com")
+		})
+
+		c.Specify("delivers messages", func() {
+			config.MaxRetries = 1
+			err := output.Init(config)
+			c.Assume(err, gs.IsNil)
+			oth := plugins_ts.NewOutputTestHelper(ctrl)
+			output.or = oth.MockOutputRunner
+
+			var clients []*fakeClient
+			output.connect = func() (xmppClient, error) {
+				client := &fakeClient{closed: make(chan struct{})}
+				clients = append(clients, client)
+				return client, nil
+			}
+			defer output.disconnect()
+
+			c.Specify("to recipients and rooms", func() {
+				err = output.deliver("disk full")
+				c.Expect(err, gs.IsNil)
+				c.Expect(len(clients), gs.Equals, 1)
+				client := clients[0]
+				c.Expect(len(client.joined), gs.Equals, 1)
+				c.Expect(client.joined[0], gs.Equals, "alerts@conference.example.com/heka")
+				c.Expect(len(client.sent), gs.Equals, 2)
+				c.Expect(client.sent[0], gs.Equals, sentChat{"ops@example.com", "chat", "disk full"})
+				c.Expect(client.sent[1].typ, gs.Equals, "groupchat")
+
+				err = output.deliver("disk ok")
+				c.Expect(err, gs.IsNil)
+				c.Expect(len(clients), gs.Equals, 1)
+				c.Expect(len(client.sent), gs.Equals, 4)
+			})
+
+			c.Specify("reconnecting when a send fails", func() {
+				output.connect = func() (xmppClient, error) {
+					client := &fakeClient{closed: make(chan struct{})}
+					if len(clients) == 0 {
+						client.failSend = 1
+					}
+					clients = append(clients, client)
+					return client, nil
+				}
+				oth.MockOutputRunner.EXPECT().LogMessage(gomock.Any())
+				err = output.deliver("disk full")
+				c.Expect(err, gs.IsNil)
+				c.Expect(len(clients), gs.Equals, 2)
+				c.Expect(len(clients[1].sent), gs.Equals, 2)
+				c.Expect(output.reconnectCount, gs.Equals, int64(1))
+			})
+
+			c.Specify("giving up once the retries are used up", func() {
+				output.connect = func() (xmppClient, error) {
+					return nil, errors.New("connection refused")
+				}
+				oth.MockOutputRunner.EXPECT().LogMessage(gomock.Any())
+				err = output.deliver("disk full")
+				c.Expect(err, gs.Not(gs.IsNil))
+			})
+		})
+	})
+}
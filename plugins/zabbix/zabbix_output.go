@@ -0,0 +1,293 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package zabbix
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/mozilla-services/heka/message"
+	. "github.com/mozilla-services/heka/pipeline"
+	"github.com/mozilla-services/heka/plugins"
+	"io"
+	"net"
+	"regexp"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Header that starts every Zabbix protocol packet, followed by the little
+// endian uint64 length of the JSON body.
+var zabbixHeader = []byte("ZBXD\x01")
+
+// Parses the summary the server returns in the `info` response field.
+var infoRegex = regexp.MustCompile(`processed:? (\d+); failed:? (\d+)`)
+
+// Output plugin that sends numeric or text message data to a Zabbix server
+// or proxy using the zabbix_sender protocol.
+type ZabbixOutput struct {
+	*ZabbixOutputConfig
+	processMessageCount int64
+	dropMessageCount    int64
+	failedItemCount     int64
+	reportLock          sync.Mutex
+	batcher             *Batcher
+	or                  OutputRunner
+}
+
+// ConfigStruct for ZabbixOutput plugin.
+type ZabbixOutputConfig struct {
+	// TCP address of the Zabbix server or proxy trapper port.
+	Address string
+	// Name of the monitored host in Zabbix, may contain `%{<name>}`
+	// placeholders.
+	Host string
+	// Item key, may contain `%{<name>}` placeholders.
+	Key string
+	// Name of the message field containing the item value.
+	ValueField string `toml:"value_field"`
+	// Batching settings, from the `batch` subsection.
+	Batch BatchConfig `toml:"batch"`
+	// Connection and response timeout, in milliseconds.
+	Timeout uint32
+}
+
+// A single item value in a sender data request.
+type zabbixItem struct {
+	Host  string `json:"host"`
+	Key   string `json:"key"`
+	Value string `json:"value"`
+	Clock int64  `json:"clock"`
+	Ns    int64  `json:"ns"`
+}
+
+type senderRequest struct {
+	Request string            `json:"request"`
+	Data    []json.RawMessage `json:"data"`
+	Clock   int64             `json:"clock"`
+}
+
+type senderResponse struct {
+	Response string `json:"response"`
+	Info     string `json:"info"`
+}
+
+func (o *ZabbixOutput) ConfigStruct() interface{} {
+	return &ZabbixOutputConfig{
+		Address:    "localhost:10051",
+		Host:       "%{Hostname}",
+		Key:        "%{Type}",
+		ValueField: "value",
+		Timeout:    5000,
+		Batch:      DefaultBatchConfig(),
+	}
+}
+
+func (o *ZabbixOutput) Init(config interface{}) (err error) {
+	o.ZabbixOutputConfig = config.(*ZabbixOutputConfig)
+
+	if o.Address == "" {
+		return errors.New("`address` must not be empty")
+	}
+	if o.Host == "" {
+		return errors.New("`host` must not be empty")
+	}
+	if o.Key == "" {
+		return errors.New("`key` must not be empty")
+	}
+	if o.ValueField == "" {
+		return errors.New("`value_field` must not be empty")
+	}
+	err = o.Batch.Validate()
+	return
+}
+
+// Generates the Zabbix item for a message.
+func (o *ZabbixOutput) makeItem(msg *message.Message) (*zabbixItem, error) {
+	val, ok := msg.GetFieldValue(o.ValueField)
+	if !ok {
+		return nil, fmt.Errorf("message has no '%s' field", o.ValueField)
+	}
+	var valStr string
+	switch v := val.(type) {
+	case int64:
+		valStr = strconv.FormatInt(v, 10)
+	case float64:
+		valStr = strconv.FormatFloat(v, 'f', -1, 64)
+	case bool:
+		valStr = strconv.FormatBool(v)
+	case string:
+		valStr = v
+	default:
+		return nil, fmt.Errorf("field '%s' has an unsupported type", o.ValueField)
+	}
+
+	item := &zabbixItem{
+		Host:  plugins.InterpolateMessageString(o.Host, msg),
+		Key:   plugins.InterpolateMessageString(o.Key, msg),
+		Value: valStr,
+		Clock: msg.GetTimestamp() / int64(time.Second),
+		Ns:    msg.GetTimestamp() % int64(time.Second),
+	}
+	if item.Host == "" || item.Key == "" {
+		return nil, errors.New("empty host or key generated for message")
+	}
+	return item, nil
+}
+
+// Encodes a Zabbix protocol packet.
+func encodePacket(body []byte) []byte {
+	packet := make([]byte, len(zabbixHeader)+8+len(body))
+	copy(packet, zabbixHeader)
+	binary.LittleEndian.PutUint64(packet[len(zabbixHeader):], uint64(len(body)))
+	copy(packet[len(zabbixHeader)+8:], body)
+	return packet
+}
+
+// Reads a Zabbix protocol packet, returning the body.
+func readPacket(r io.Reader) (body []byte, err error) {
+	header := make([]byte, len(zabbixHeader)+8)
+	if _, err = io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(header[:len(zabbixHeader)], zabbixHeader) {
+		return nil, errors.New("invalid response header")
+	}
+	size := binary.LittleEndian.Uint64(header[len(zabbixHeader):])
+	if size > uint64(message.MAX_MESSAGE_SIZE) {
+		return nil, fmt.Errorf("response too large: %d bytes", size)
+	}
+	body = make([]byte, size)
+	_, err = io.ReadFull(r, body)
+	return
+}
+
+// Sends a batch of JSON encoded items to the server, returning the number of
+// items the server reported as failed.
+func (o *ZabbixOutput) send(records [][]byte) (failed int, err error) {
+	req := &senderRequest{
+		Request: "sender data",
+		Data:    make([]json.RawMessage, len(records)),
+		Clock:   time.Now().Unix(),
+	}
+	for i, record := range records {
+		req.Data[i] = json.RawMessage(record)
+	}
+	body, err := json.Marshal(req)
+	if err != nil {
+		return 0, err
+	}
+
+	timeout := time.Duration(o.Timeout) * time.Millisecond
+	conn, err := net.DialTimeout("tcp", o.Address, timeout)
+	if err != nil {
+		return 0, fmt.Errorf("can't connect to %s: %s", o.Address, err)
+	}
+	defer conn.Close()
+	if timeout > 0 {
+		conn.SetDeadline(time.Now().Add(timeout))
+	}
+
+	if _, err = conn.Write(encodePacket(body)); err != nil {
+		return 0, fmt.Errorf("writing to %s: %s", o.Address, err)
+	}
+	if body, err = readPacket(conn); err != nil {
+		return 0, fmt.Errorf("reading response from %s: %s", o.Address, err)
+	}
+	resp := new(senderResponse)
+	if err = json.Unmarshal(body, resp); err != nil {
+		return 0, fmt.Errorf("can't parse response: %s", err)
+	}
+	if resp.Response != "success" {
+		return 0, fmt.Errorf("server returned '%s': %s", resp.Response, resp.Info)
+	}
+	if match := infoRegex.FindStringSubmatch(resp.Info); match != nil {
+		failed, _ = strconv.Atoi(match[2])
+	}
+	return
+}
+
+// Satisfies `pipeline.BatchFlushFunc`, sending a batch of items. Items the
+// server rejects are logged, but not retried.
+func (o *ZabbixOutput) flush(records [][]byte) error {
+	failed, err := o.send(records)
+	if err != nil {
+		return err
+	}
+	if failed > 0 {
+		o.or.LogError(fmt.Errorf("Zabbix rejected %d of %d items", failed,
+			len(records)))
+		atomic.AddInt64(&o.failedItemCount, int64(failed))
+	}
+	atomic.AddInt64(&o.processMessageCount, int64(len(records)))
+	return nil
+}
+
+func (o *ZabbixOutput) Run(or OutputRunner, h PluginHelper) (err error) {
+	o.or = or
+	if o.batcher, err = NewOutputBatcher(o.Batch, o.flush, or, h); err != nil {
+		return
+	}
+	o.batcher.Start()
+
+	var (
+		item   *zabbixItem
+		record []byte
+		e      error
+	)
+	for pack := range or.InChan() {
+		item, e = o.makeItem(pack.Message)
+		pack.Recycle()
+		if e == nil {
+			record, e = json.Marshal(item)
+		}
+		if e != nil {
+			or.LogError(e)
+			atomic.AddInt64(&o.dropMessageCount, 1)
+			continue
+		}
+		o.batcher.Add(record)
+	}
+	o.batcher.Stop()
+	return
+}
+
+// Satisfies the `pipeline.ReportingPlugin` interface to provide plugin state
+// information to the Heka report and dashboard.
+func (o *ZabbixOutput) ReportMsg(msg *message.Message) error {
+	o.reportLock.Lock()
+	defer o.reportLock.Unlock()
+
+	message.NewInt64Field(msg, "ProcessMessageCount",
+		atomic.LoadInt64(&o.processMessageCount), "count")
+	message.NewInt64Field(msg, "DropMessageCount",
+		atomic.LoadInt64(&o.dropMessageCount), "count")
+	message.NewInt64Field(msg, "FailedItemCount",
+		atomic.LoadInt64(&o.failedItemCount), "count")
+	if o.batcher != nil {
+		o.batcher.ReportMsg(msg)
+	}
+	return nil
+}
+
+func init() {
+	RegisterPlugin("ZabbixOutput", func() interface{} {
+		return new(ZabbixOutput)
+	})
+}
@@ -0,0 +1,114 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package zabbix
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/mozilla-services/heka/message"
+	pipeline_ts "github.com/mozilla-services/heka/pipeline/testsupport"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+	"net"
+)
+
+func ZabbixOutputSpec(c gs.Context) {
+	output := new(ZabbixOutput)
+	config := output.ConfigStruct().(*ZabbixOutputConfig)
+
+	msg := pipeline_ts.GetTestMessage()
+	field, _ := message.NewField("value", 2.5, "")
+	msg.AddField(field)
+
+	c.Specify("A ZabbixOutput", func() {
+		c.Specify("generates items from templates", func() {
+			config.Key = "heka.%{Logger}[%{foo}]"
+			err := output.Init(config)
+			c.Assume(err, gs.IsNil)
+			item, err := output.makeItem(msg)
+			c.Expect(err, gs.IsNil)
+			c.Expect(item.Host, gs.Equals, "my.host.name")
+			c.Expect(item.Key, gs.Equals, "heka.GoSpec[bar]")
+			c.Expect(item.Value, gs.Equals, "2.5")
+			c.Expect(item.Clock, gs.Equals, int64(1136239445))
+			c.Expect(item.Ns, gs.Equals, int64(0))
+		})
+
+		c.Specify("rejects messages w/o a value", func() {
+			config.ValueField = "missing"
+			err := output.Init(config)
+			c.Assume(err, gs.IsNil)
+			_, err = output.makeItem(msg)
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+
+		c.Specify("encodes and decodes packets", func() {
+			packet := encodePacket([]byte("{}"))
+			c.Expect(string(packet), gs.Equals, "ZBXD\x01\x02\x00\x00\x00\x00\x00\x00\x00{}")
+			body, err := readPacket(bytes.NewReader(packet))
+			c.Expect(err, gs.IsNil)
+			c.Expect(string(body), gs.Equals, "{}")
+			_, err = readPacket(bytes.NewReader([]byte("HTTP/1.1 400 Bad")))
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+
+		c.Specify("sends items to the server", func() {
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			c.Assume(err, gs.IsNil)
+			defer listener.Close()
+			config.Address = listener.Addr().String()
+			err = output.Init(config)
+			c.Assume(err, gs.IsNil)
+
+			reqChan := make(chan *senderRequest, 1)
+			go func() {
+				conn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+				body, err := readPacket(conn)
+				if err != nil {
+					return
+				}
+				req := new(senderRequest)
+				json.Unmarshal(body, req)
+				reqChan <- req
+				conn.Write(encodePacket([]byte(`{"response":"success",` +
+					`"info":"processed: 1; failed: 1; total: 2; seconds spent: 0.0001"}`)))
+			}()
+
+			item, _ := output.makeItem(msg)
+			record, _ := json.Marshal(item)
+			failed, err := output.send([][]byte{record, record})
+			c.Expect(err, gs.IsNil)
+			c.Expect(failed, gs.Equals, 1)
+
+			req := <-reqChan
+			c.Expect(req.Request, gs.Equals, "sender data")
+			c.Expect(len(req.Data), gs.Equals, 2)
+			sent := new(zabbixItem)
+			err = json.Unmarshal(req.Data[0], sent)
+			c.Expect(err, gs.IsNil)
+			c.Expect(sent.Key, gs.Equals, "TEST")
+			c.Expect(sent.Value, gs.Equals, "2.5")
+		})
+
+		c.Specify("rejects an invalid failure action", func() {
+			config.Batch.FailureAction = "panic"
+			err := output.Init(config)
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+	})
+}
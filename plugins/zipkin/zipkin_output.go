@@ -0,0 +1,412 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package zipkin
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/mozilla-services/heka/message"
+	. "github.com/mozilla-services/heka/pipeline"
+	"github.com/mozilla-services/heka/plugins"
+	"hash/fnv"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Output plugin that turns groups of correlated messages, i.e. the messages
+// sharing a request ID, into trace spans and sends them to Zipkin, or to
+// any collector that accepts the Zipkin v2 API, such as Jaeger's.
+type ZipkinOutput struct {
+	*ZipkinOutputConfig
+	client              *http.Client
+	spanTimeout         time.Duration
+	tagFields           map[string]bool
+	groups              map[string]*spanGroup
+	emitSpan            func(span []byte)
+	processMessageCount int64
+	dropMessageCount    int64
+	spanCount           int64
+	reportLock          sync.Mutex
+	batcher             *Batcher
+}
+
+// ConfigStruct for ZipkinOutput plugin.
+type ZipkinOutputConfig struct {
+	// URL of the Zipkin v2 spans endpoint.
+	Url string
+	// Message field holding the ID shared by all of a request's messages.
+	RequestIdField string `toml:"request_id_field"`
+	// Message fields holding the hex encoded trace, span, and parent span
+	// IDs. IDs are derived from the request ID if the fields are missing.
+	TraceIdField  string `toml:"trace_id_field"`
+	SpanIdField   string `toml:"span_id_field"`
+	ParentIdField string `toml:"parent_id_field"`
+	// Templates for the span and service names. May contain `%{<name>}`
+	// placeholders.
+	Name        string
+	ServiceName string `toml:"service_name"`
+	// Span kind, one of "CLIENT", "SERVER", "PRODUCER", or "CONSUMER".
+	// Empty leaves the kind unset.
+	Kind string
+	// Dynamic message fields written as span tags. If empty, all dynamic
+	// fields other than the ID fields are written.
+	TagFields []string `toml:"tag_fields"`
+	// Time in milliseconds w/o a new message after which a request's span is
+	// considered complete.
+	SpanTimeout uint32 `toml:"span_timeout"`
+	// Maximum number of spans that can be open at once. When it's reached
+	// the span idle the longest is completed early.
+	MaxOpenSpans int `toml:"max_open_spans"`
+	// Batching settings, from the `batch` subsection.
+	Batch BatchConfig `toml:"batch"`
+	// HTTP request timeout, in milliseconds. 0 means no timeout.
+	HttpTimeout uint32 `toml:"http_timeout"`
+}
+
+// Zipkin v2 span structures.
+type zipkinEndpoint struct {
+	ServiceName string `json:"serviceName,omitempty"`
+}
+
+type zipkinAnnotation struct {
+	Timestamp int64  `json:"timestamp"`
+	Value     string `json:"value"`
+}
+
+type zipkinSpan struct {
+	TraceId       string              `json:"traceId"`
+	Id            string              `json:"id"`
+	ParentId      string              `json:"parentId,omitempty"`
+	Name          string              `json:"name,omitempty"`
+	Kind          string              `json:"kind,omitempty"`
+	Timestamp     int64               `json:"timestamp"`
+	Duration      int64               `json:"duration"`
+	LocalEndpoint *zipkinEndpoint     `json:"localEndpoint,omitempty"`
+	Annotations   []*zipkinAnnotation `json:"annotations,omitempty"`
+	Tags          map[string]string   `json:"tags,omitempty"`
+}
+
+// The messages of a single request seen so far.
+type spanGroup struct {
+	span     *zipkinSpan
+	start    int64
+	end      int64
+	lastSeen time.Time
+}
+
+func (o *ZipkinOutput) ConfigStruct() interface{} {
+	return &ZipkinOutputConfig{
+		Url:            "http://localhost:9411/api/v2/spans",
+		RequestIdField: "request_id",
+		TraceIdField:   "trace_id",
+		SpanIdField:    "span_id",
+		ParentIdField:  "parent_id",
+		Name:           "%{Type}",
+		ServiceName:    "%{Logger}",
+		SpanTimeout:    5000,
+		MaxOpenSpans:   10000,
+		HttpTimeout:    5000,
+		Batch:          DefaultBatchConfig(),
+	}
+}
+
+func (o *ZipkinOutput) Init(config interface{}) (err error) {
+	o.ZipkinOutputConfig = config.(*ZipkinOutputConfig)
+
+	u, err := url.Parse(o.Url)
+	if err != nil {
+		return fmt.Errorf("can't parse URL '%s': %s", o.Url, err.Error())
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return errors.New("`url` must contain an absolute http or https URL")
+	}
+	if o.RequestIdField == "" {
+		return errors.New("`request_id_field` must not be empty")
+	}
+	switch o.Kind {
+	case "", "CLIENT", "SERVER", "PRODUCER", "CONSUMER":
+	default:
+		return fmt.Errorf("unsupported span `kind`: %s", o.Kind)
+	}
+	if o.SpanTimeout == 0 {
+		return errors.New("`span_timeout` must be greater than 0")
+	}
+	if o.MaxOpenSpans < 1 {
+		return errors.New("`max_open_spans` must be at least 1")
+	}
+	o.spanTimeout = time.Duration(o.SpanTimeout) * time.Millisecond
+
+	o.client = new(http.Client)
+	if o.HttpTimeout > 0 {
+		o.client.Timeout = time.Duration(o.HttpTimeout) * time.Millisecond
+	}
+	o.tagFields = make(map[string]bool)
+	for _, name := range o.TagFields {
+		o.tagFields[name] = true
+	}
+	o.groups = make(map[string]*spanGroup)
+	err = o.Batch.Validate()
+	return
+}
+
+// Returns the hex encoded ID from a message field, or "" if the field is
+// missing or doesn't hold an ID of one of the given lengths in bytes.
+func fieldId(msg *message.Message, name string, sizes ...int) string {
+	if name == "" {
+		return ""
+	}
+	val, ok := msg.GetFieldValue(name)
+	if !ok {
+		return ""
+	}
+	id, ok := val.(string)
+	if !ok {
+		return ""
+	}
+	id = strings.ToLower(strings.Replace(id, "-", "", -1))
+	b, err := hex.DecodeString(id)
+	if err != nil {
+		return ""
+	}
+	for _, size := range sizes {
+		if len(b) == size {
+			return id
+		}
+	}
+	return ""
+}
+
+// Derives a trace or span ID from a request ID, so every message of the
+// request ends up in the same span.
+func derivedTraceId(requestId string) string {
+	sum := md5.Sum([]byte(requestId))
+	return hex.EncodeToString(sum[:])
+}
+
+func derivedSpanId(requestId string) string {
+	h := fnv.New64a()
+	h.Write([]byte(requestId))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Adds a message to its request's span, starting the span if it's the
+// request's first message.
+func (o *ZipkinOutput) add(msg *message.Message, now time.Time) error {
+	val, ok := msg.GetFieldValue(o.RequestIdField)
+	if !ok {
+		return fmt.Errorf("message has no '%s' field", o.RequestIdField)
+	}
+	requestId := fmt.Sprint(val)
+	if requestId == "" {
+		return fmt.Errorf("message has an empty '%s' field", o.RequestIdField)
+	}
+
+	ts := msg.GetTimestamp()
+	group, ok := o.groups[requestId]
+	if !ok {
+		if len(o.groups) >= o.MaxOpenSpans {
+			o.emitOldest()
+		}
+		span := &zipkinSpan{
+			TraceId:  fieldId(msg, o.TraceIdField, 8, 16),
+			Id:       fieldId(msg, o.SpanIdField, 8),
+			ParentId: fieldId(msg, o.ParentIdField, 8),
+			Name:     plugins.InterpolateMessageString(o.Name, msg),
+			Kind:     o.Kind,
+		}
+		if span.TraceId == "" {
+			span.TraceId = derivedTraceId(requestId)
+		}
+		if span.Id == "" {
+			span.Id = derivedSpanId(requestId)
+		}
+		if service := plugins.InterpolateMessageString(o.ServiceName, msg); service != "" {
+			span.LocalEndpoint = &zipkinEndpoint{ServiceName: service}
+		}
+		group = &spanGroup{span: span, start: ts, end: ts}
+		o.groups[requestId] = group
+	}
+	group.lastSeen = now
+	if ts < group.start {
+		group.start = ts
+	}
+	if ts > group.end {
+		group.end = ts
+	}
+
+	span := group.span
+	if payload := msg.GetPayload(); payload != "" {
+		span.Annotations = append(span.Annotations,
+			&zipkinAnnotation{Timestamp: ts / 1000, Value: payload})
+	}
+	for _, field := range msg.Fields {
+		name := field.GetName()
+		switch name {
+		case o.RequestIdField, o.TraceIdField, o.SpanIdField, o.ParentIdField:
+			continue
+		}
+		if len(o.tagFields) > 0 && !o.tagFields[name] {
+			continue
+		}
+		value := field.GetValue()
+		if value == nil {
+			continue
+		}
+		if span.Tags == nil {
+			span.Tags = make(map[string]string)
+		}
+		if b, ok := value.([]byte); ok {
+			value = string(b)
+		}
+		span.Tags[name] = fmt.Sprint(value)
+	}
+	return nil
+}
+
+// Completes the span of a request, handing it to emitSpan.
+func (o *ZipkinOutput) emit(requestId string, group *spanGroup) {
+	delete(o.groups, requestId)
+	span := group.span
+	span.Timestamp = group.start / 1000
+	// Zipkin requires a duration of at least one microsecond.
+	if span.Duration = (group.end - group.start) / 1000; span.Duration < 1 {
+		span.Duration = 1
+	}
+	data, err := json.Marshal(span)
+	if err != nil {
+		atomic.AddInt64(&o.dropMessageCount, 1)
+		return
+	}
+	atomic.AddInt64(&o.spanCount, 1)
+	o.emitSpan(data)
+}
+
+// Completes the span that's been idle the longest.
+func (o *ZipkinOutput) emitOldest() {
+	var (
+		oldestId string
+		oldest   *spanGroup
+	)
+	for requestId, group := range o.groups {
+		if oldest == nil || group.lastSeen.Before(oldest.lastSeen) {
+			oldestId, oldest = requestId, group
+		}
+	}
+	if oldest != nil {
+		o.emit(oldestId, oldest)
+	}
+}
+
+// Completes the spans that haven't seen a message within the span timeout,
+// or all of them if all is true.
+func (o *ZipkinOutput) expire(now time.Time, all bool) {
+	for requestId, group := range o.groups {
+		if all || now.Sub(group.lastSeen) >= o.spanTimeout {
+			o.emit(requestId, group)
+		}
+	}
+}
+
+// Satisfies `pipeline.BatchFlushFunc`, sending a batch of JSON encoded spans.
+func (o *ZipkinOutput) flush(records [][]byte) error {
+	body := new(bytes.Buffer)
+	body.WriteByte('[')
+	body.Write(bytes.Join(records, []byte{','}))
+	body.WriteByte(']')
+
+	resp, err := o.client.Post(o.Url, "application/json", body)
+	if err != nil {
+		return fmt.Errorf("error making HTTP request: %s", err.Error())
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		respBody, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("Zipkin request failed: %s - %s", resp.Status,
+			strings.TrimSpace(string(respBody)))
+	}
+	return nil
+}
+
+func (o *ZipkinOutput) Run(or OutputRunner, h PluginHelper) (err error) {
+	if o.batcher, err = NewOutputBatcher(o.Batch, o.flush, or, h); err != nil {
+		return
+	}
+	o.emitSpan = o.batcher.Add
+	o.batcher.Start()
+
+	// Check for completed spans a few times per timeout.
+	ticker := time.NewTicker(o.spanTimeout / 4)
+	defer ticker.Stop()
+
+	var (
+		ok     = true
+		pack   *PipelinePack
+		inChan = or.InChan()
+		e      error
+	)
+	for ok {
+		select {
+		case pack, ok = <-inChan:
+			if !ok {
+				break
+			}
+			e = o.add(pack.Message, time.Now())
+			pack.Recycle()
+			if e != nil {
+				or.LogError(e)
+				atomic.AddInt64(&o.dropMessageCount, 1)
+				continue
+			}
+			atomic.AddInt64(&o.processMessageCount, 1)
+		case now := <-ticker.C:
+			o.expire(now, false)
+		}
+	}
+	o.expire(time.Now(), true)
+	o.batcher.Stop()
+	return
+}
+
+// Satisfies the `pipeline.ReportingPlugin` interface to provide plugin state
+// information to the Heka report and dashboard.
+func (o *ZipkinOutput) ReportMsg(msg *message.Message) error {
+	o.reportLock.Lock()
+	defer o.reportLock.Unlock()
+
+	message.NewInt64Field(msg, "ProcessMessageCount",
+		atomic.LoadInt64(&o.processMessageCount), "count")
+	message.NewInt64Field(msg, "DropMessageCount",
+		atomic.LoadInt64(&o.dropMessageCount), "count")
+	message.NewInt64Field(msg, "SpanCount", atomic.LoadInt64(&o.spanCount), "count")
+	if o.batcher != nil {
+		o.batcher.ReportMsg(msg)
+	}
+	return nil
+}
+
+func init() {
+	RegisterPlugin("ZipkinOutput", func() interface{} {
+		return new(ZipkinOutput)
+	})
+}
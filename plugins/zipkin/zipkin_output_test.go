@@ -0,0 +1,145 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package zipkin
+
+import (
+	"encoding/json"
+	"github.com/mozilla-services/heka/message"
+	pipeline_ts "github.com/mozilla-services/heka/pipeline/testsupport"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"time"
+)
+
+func ZipkinOutputSpec(c gs.Context) {
+	output := new(ZipkinOutput)
+	config := output.ConfigStruct().(*ZipkinOutputConfig)
+
+	var spans []*zipkinSpan
+	capture := func(data []byte) {
+		span := new(zipkinSpan)
+		json.Unmarshal(data, span)
+		spans = append(spans, span)
+	}
+
+	newMsg := func(requestId string, offset time.Duration, payload string) *message.Message {
+		msg := pipeline_ts.GetTestMessage()
+		msg.SetTimestamp(msg.GetTimestamp() + int64(offset))
+		msg.SetPayload(payload)
+		field, _ := message.NewField("request_id", requestId, "")
+		msg.AddField(field)
+		return msg
+	}
+	now := time.Now()
+
+	c.Specify("A ZipkinOutput", func() {
+		c.Specify("rejects an unknown span kind", func() {
+			config.Kind = "SIDEWAYS"
+			err := output.Init(config)
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+
+		c.Specify("turns a request's messages into a span", func() {
+			config.Kind = "SERVER"
+			err := output.Init(config)
+			c.Assume(err, gs.IsNil)
+			output.emitSpan = capture
+
+			err = output.add(newMsg("req-1", 0, "received"), now)
+			c.Expect(err, gs.IsNil)
+			err = output.add(newMsg("req-1", 250*time.Millisecond, "responded"), now)
+			c.Expect(err, gs.IsNil)
+			output.expire(now, false)
+			c.Expect(len(spans), gs.Equals, 0)
+
+			output.expire(now.Add(output.spanTimeout), false)
+			c.Assume(len(spans), gs.Equals, 1)
+			span := spans[0]
+			c.Expect(span.TraceId, gs.Equals, derivedTraceId("req-1"))
+			c.Expect(span.Id, gs.Equals, derivedSpanId("req-1"))
+			c.Expect(len(span.TraceId), gs.Equals, 32)
+			c.Expect(len(span.Id), gs.Equals, 16)
+			c.Expect(span.Name, gs.Equals, "TEST")
+			c.Expect(span.Kind, gs.Equals, "SERVER")
+			c.Expect(span.LocalEndpoint.ServiceName, gs.Equals, "GoSpec")
+			c.Expect(span.Timestamp, gs.Equals, int64(1136239445000000))
+			c.Expect(span.Duration, gs.Equals, int64(250000))
+			c.Expect(len(span.Annotations), gs.Equals, 2)
+			c.Expect(span.Annotations[1].Value, gs.Equals, "responded")
+			c.Expect(span.Tags["foo"], gs.Equals, "bar")
+			_, ok := span.Tags["request_id"]
+			c.Expect(ok, gs.IsFalse)
+			c.Expect(len(output.groups), gs.Equals, 0)
+		})
+
+		c.Specify("uses the messages' trace IDs", func() {
+			err := output.Init(config)
+			c.Assume(err, gs.IsNil)
+			output.emitSpan = capture
+			msg := newMsg("req-2", 0, "")
+			field, _ := message.NewField("trace_id", "4BF92F35-77B3-4DA6-A3CE-929D0E0E4736", "")
+			msg.AddField(field)
+			field, _ = message.NewField("parent_id", "00f067aa0ba902b7", "")
+			msg.AddField(field)
+			err = output.add(msg, now)
+			c.Assume(err, gs.IsNil)
+			output.expire(now, true)
+			c.Assume(len(spans), gs.Equals, 1)
+			c.Expect(spans[0].TraceId, gs.Equals, "4bf92f3577b34da6a3ce929d0e0e4736")
+			c.Expect(spans[0].ParentId, gs.Equals, "00f067aa0ba902b7")
+			c.Expect(spans[0].Duration, gs.Equals, int64(1))
+		})
+
+		c.Specify("completes the oldest span when too many are open", func() {
+			config.MaxOpenSpans = 1
+			err := output.Init(config)
+			c.Assume(err, gs.IsNil)
+			output.emitSpan = capture
+			output.add(newMsg("req-1", 0, ""), now)
+			output.add(newMsg("req-2", 0, ""), now)
+			c.Assume(len(spans), gs.Equals, 1)
+			c.Expect(spans[0].Id, gs.Equals, derivedSpanId("req-1"))
+			c.Expect(len(output.groups), gs.Equals, 1)
+		})
+
+		c.Specify("rejects messages w/o a request ID", func() {
+			err := output.Init(config)
+			c.Assume(err, gs.IsNil)
+			err = output.add(pipeline_ts.GetTestMessage(), now)
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+
+		c.Specify("sends batches of spans", func() {
+			var received []*zipkinSpan
+			server := httptest.NewServer(http.HandlerFunc(
+				func(w http.ResponseWriter, r *http.Request) {
+					body, _ := ioutil.ReadAll(r.Body)
+					json.Unmarshal(body, &received)
+					w.WriteHeader(http.StatusAccepted)
+				}))
+			defer server.Close()
+
+			config.Url = server.URL
+			err := output.Init(config)
+			c.Assume(err, gs.IsNil)
+			err = output.flush([][]byte{[]byte(`{"id":"1"}`), []byte(`{"id":"2"}`)})
+			c.Expect(err, gs.IsNil)
+			c.Assume(len(received), gs.Equals, 2)
+			c.Expect(received[1].Id, gs.Equals, "2")
+		})
+	})
+}
@@ -0,0 +1,142 @@
+-- This Source Code Form is subject to the terms of the Mozilla Public
+-- License, v. 2.0. If a copy of the MPL was not distributed with this
+-- file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+--[[
+Fleet-wide Heka node health monitoring, using the heka.node-report messages
+that each hekad sends when its `node_report_interval` is set.
+
+Generates a JSON structure with a row per node which includes the node's
+last_report, version, full_plugins, last_alert and status. The status is
+"ok", "unhealthy" when the node reports a stalled pool or plugins w/ full
+input channels, or "missing" when no report has arrived within the
+missing_timeout.
+
+This plugin also sends an alert when a node goes missing or is unhealthy,
+and supports alert throttling to reduce noise.
+
+Config:
+
+- missing_timeout (uint, optional, default 180)
+    Sets the maximum duration (in seconds) between reports before a node is
+    considered missing. This should be a few times the nodes'
+    `node_report_interval`.
+
+- alert_throttle (uint, optional, default 300)
+    Sets the minimum duration (in seconds) between alerts for each node.
+
+*Example Heka Configuration*
+
+Each node emits its reports and sends them, signed, to the aggregator:
+
+.. code-block:: ini
+
+    [hekad]
+    node_report_interval = 60
+
+    [aggregator-output]
+    type = "TcpOutput"
+    address = "aggregator.example.com:5565"
+    message_matcher = "Type == 'heka.node-report'"
+
+      [aggregator-output.signer]
+      name = "fleet"
+      hmac_key = "4865ey9urgkidls xtb0[7lf9rzcivthkm"
+      version = 0
+
+The aggregator only accepts reports w/ a valid signature:
+
+.. code-block:: ini
+
+    [fleet-splitter]
+    type = "HekaFramingSplitter"
+
+      [fleet-splitter.signer.fleet_0]
+      hmac_key = "4865ey9urgkidls xtb0[7lf9rzcivthkm"
+
+    [node-reports]
+    type = "TcpInput"
+    address = ":5565"
+    splitter = "fleet-splitter"
+
+    [node-health]
+    type = "SandboxFilter"
+    filename = "lua_filters/heka_node_health.lua"
+    ticker_interval = 60
+    preserve_data = true
+    message_matcher = "Type == 'heka.node-report'"
+    message_signer = "fleet"
+
+      [node-health.config]
+      missing_timeout = 180
+      alert_throttle = 300
+
+*Example Output*
+
+.. code-block:: json
+
+  {"web-1":{"last_report":1415311858257,"version":"0.10.0","full_plugins":"","status":"ok","last_alert":0},"web-2":{"last_report":1415311856214,"version":"0.10.0","full_plugins":"ElasticSearchOutput","status":"unhealthy","last_alert":1415311856300}}
+
+:Timestamp: 2014-11-06T22:10:58Z
+:Hostname: aggregator
+:Plugin: node-health
+:Alert: Unhealthy Node - web-2 (full plugins: ElasticSearchOutput)
+
+--]]
+
+require "cjson"
+require "math"
+require "string"
+
+local alert = require "alert"
+alert.set_throttle(0) -- disable alert module's built-in throttling
+
+local missing_timeout = read_config("missing_timeout") or 180
+local alert_throttle = read_config("alert_throttle") or 300
+
+nodes = {}
+local floor = math.floor
+
+function process_message()
+    local timestamp = floor(read_message("Timestamp") / 1e6) -- in ms
+    local hostname = read_message("Hostname")
+    if not hostname then return -1 end
+
+    local node = nodes[hostname]
+    if not node then
+        node = {last_alert = 0}
+        nodes[hostname] = node
+    end
+    node.last_report = timestamp
+    node.version = read_message("Fields[Version]") or ""
+    node.full_plugins = read_message("Fields[FullPlugins]") or ""
+    node.reported_status = read_message("Fields[Status]") or "ok"
+    return 0
+end
+
+function timer_event(ns)
+    local current_time = floor(ns / 1e6) -- in ms
+    local out = {}
+    for hostname, node in pairs(nodes) do
+        local msg
+        if current_time - node.last_report > missing_timeout * 1000 then
+            node.status = "missing"
+            msg = string.format("Missing Node - %s\n", hostname)
+        elseif node.reported_status ~= "ok" then
+            node.status = "unhealthy"
+            msg = string.format("Unhealthy Node - %s (full plugins: %s)\n",
+                                hostname, node.full_plugins)
+        else
+            node.status = "ok"
+        end
+        if msg and current_time - node.last_alert > alert_throttle * 1000 then
+            alert.queue(ns, msg)
+            node.last_alert = current_time
+        end
+        out[hostname] = {last_report = node.last_report, version = node.version,
+                         full_plugins = node.full_plugins, status = node.status,
+                         last_alert = node.last_alert}
+    end
+    alert.send_queue(ns)
+    inject_payload("json", "node_health", cjson.encode(out))
+end
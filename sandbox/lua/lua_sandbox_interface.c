@@ -368,6 +368,9 @@ static inline void inject_error(lua_State* lua, const char* fn, int result)
     case 4:
         luaL_error(lua, "%s creates a circular reference (matches this plugin's message_matcher)", fn);
         break;
+    case 5:
+        luaL_error(lua, "%s no message pack available", fn);
+        break;
     default:
         luaL_error(lua, "%s unknown error", fn);
         break;
@@ -267,6 +267,50 @@ func FilterSpec(c gs.Context) {
 			ok := pConfig.RemoveFilterRunner(fullSbxName)
 			c.Expect(ok, gs.IsTrue)
 		})
+
+		c.Specify("Creates and removes a SandboxDecoder", func() {
+			sbxName := "SandboxDecoder"
+			sbxMgrName := "SandboxManagerFilter"
+			code := `
+			function process_message()
+			    return 0
+			end
+			`
+			cfg := fmt.Sprintf("[%s]\ntype = \"SandboxDecoder\"\n", sbxName)
+			msg.SetPayload(code)
+			f, err := message.NewField("config", cfg, "toml")
+			c.Assume(err, gs.IsNil)
+			msg.AddField(f)
+
+			fullSbxName := fmt.Sprintf("%s-%s", sbxMgrName, sbxName)
+			fth.MockFilterRunner.EXPECT().Name().Return(sbxMgrName).AnyTimes()
+			fth.MockHelper.EXPECT().Filter(fullSbxName).Return(nil, false)
+
+			c.Specify("only when decoders are allowed", func() {
+				sbmFilter.Init(config)
+				err = sbmFilter.loadSandbox(fth.MockFilterRunner, fth.MockHelper, sbxMgrsDir, msg)
+				c.Expect(err.Error(), gs.Equals,
+					"SandboxManagerFilter attempted to load more than 0 decoders")
+			})
+
+			c.Specify("when decoders are allowed", func() {
+				config.MaxDecoders = 1
+				sbmFilter.Init(config)
+				fth.MockFilterRunner.EXPECT().LogMessage(fmt.Sprintf("Loading: %s", fullSbxName))
+				err = sbmFilter.loadSandbox(fth.MockFilterRunner, fth.MockHelper, sbxMgrsDir, msg)
+				c.Expect(err, gs.IsNil)
+				_, ok := pConfig.DecoderMakers[fullSbxName]
+				c.Expect(ok, gs.IsTrue)
+				c.Expect(sbmFilter.currentDecoders, gs.Equals, int32(1))
+
+				sbmFilter.unloadSandbox(fullSbxName)
+				_, ok = pConfig.DecoderMakers[fullSbxName]
+				c.Expect(ok, gs.IsFalse)
+				c.Expect(sbmFilter.currentDecoders, gs.Equals, int32(0))
+				_, err = os.Stat(filepath.Join(sbxMgrsDir, fullSbxName+".toml"))
+				c.Expect(os.IsNotExist(err), gs.IsTrue)
+			})
+		})
 	})
 
 	c.Specify("A Load Average Stats filter", func() {
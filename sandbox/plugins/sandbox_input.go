@@ -102,7 +102,11 @@ func (s *SandboxInput) Init(config interface{}) (err error) {
 
 func (s *SandboxInput) Run(ir pipeline.InputRunner, h pipeline.PluginHelper) (err error) {
 	s.sb.InjectMessage(func(payload, payload_type, payload_name string) int {
-		pack := <-ir.InChan()
+		pack := ir.NewPack()
+		if pack == nil {
+			// The pool rejected the message.
+			return 5
+		}
 		if err := proto.Unmarshal([]byte(payload), pack.Message); err != nil {
 			pack.Recycle()
 			return 1
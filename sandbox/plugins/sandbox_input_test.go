@@ -50,7 +50,6 @@ func InputSpec(c gs.Context) {
 		ith.MockInputRunner = pipelinemock.NewMockInputRunner(ctrl)
 		ith.PackSupply = make(chan *PipelinePack, 1)
 		ith.Pack = NewPipelinePack(ith.PackSupply)
-		ith.PackSupply <- ith.Pack
 
 		startInput := func() {
 			wg.Add(1)
@@ -63,7 +62,7 @@ func InputSpec(c gs.Context) {
 		c.Specify("test a polling input", func() {
 			tickChan := time.Tick(10 * time.Millisecond)
 			ith.MockInputRunner.EXPECT().Ticker().Return(tickChan)
-			ith.MockInputRunner.EXPECT().InChan().Return(ith.PackSupply).Times(2)
+			ith.MockInputRunner.EXPECT().NewPack().Return(ith.Pack).Times(2)
 			ith.MockInputRunner.EXPECT().LogError(fmt.Errorf("failure message"))
 
 			var cnt int
@@ -77,7 +76,6 @@ func InputSpec(c gs.Context) {
 						input.Stop()
 					}
 					cnt++
-					ith.PackSupply <- pack
 				}).Times(2)
 
 			config := input.ConfigStruct().(*sandbox.SandboxConfig)
@@ -98,12 +96,11 @@ func InputSpec(c gs.Context) {
 		c.Specify("run once input", func() {
 			var tickChan <-chan time.Time
 			ith.MockInputRunner.EXPECT().Ticker().Return(tickChan)
-			ith.MockInputRunner.EXPECT().InChan().Return(ith.PackSupply).Times(1)
+			ith.MockInputRunner.EXPECT().NewPack().Return(ith.Pack).Times(1)
 			ith.MockInputRunner.EXPECT().LogMessage("single run completed")
 			ith.MockInputRunner.EXPECT().Inject(gomock.Any()).Do(
 				func(pack *PipelinePack) {
 					c.Expect(pack.Message.GetPayload(), gs.Equals, "line 1")
-					ith.PackSupply <- pack
 				}).Times(1)
 
 			config := input.ConfigStruct().(*sandbox.SandboxConfig)
@@ -33,18 +33,22 @@ import (
 )
 
 // Heka Filter plugin that listens for (signed) control messages and
-// dynamically creates, manages, and destroys sandboxed filter scripts as
-// instructed.
+// dynamically creates, manages, and destroys sandboxed filter and decoder
+// scripts as instructed.
 type SandboxManagerFilter struct {
 	processMessageCount int64
 	currentFilters      int32
+	currentDecoders     int32
 	maxFilters          int
-	workingDirectory    string
-	moduleDirectory     string
-	memoryLimit         uint
-	instructionLimit    uint
-	outputLimit         uint
-	pConfig             *pipeline.PipelineConfig
+	maxDecoders         int
+	// Names of the running decoders created by this manager.
+	decoders         map[string]bool
+	workingDirectory string
+	moduleDirectory  string
+	memoryLimit      uint
+	instructionLimit uint
+	outputLimit      uint
+	pConfig          *pipeline.PipelineConfig
 }
 
 // Config struct for `SandboxManagerFilter`.
@@ -52,6 +56,9 @@ type SandboxManagerFilterConfig struct {
 	// Maximum number of sandboxed filters this instance will be allowed to
 	// manage.
 	MaxFilters int `toml:"max_filters"`
+	// Maximum number of sandboxed decoders this instance will be allowed to
+	// manage.
+	MaxDecoders int `toml:"max_decoders"`
 	// Path to file system directory the sandbox manager can use for storing
 	// dynamic filter scripts and data. Relative paths will be relative to the
 	// Heka base_dir. Defaults to a directory in ${BASE_DIR}/sbxmgrs that is
@@ -99,6 +106,8 @@ func (this *SandboxManagerFilter) Init(config interface{}) (err error) {
 	conf := config.(*SandboxManagerFilterConfig)
 	globals := this.pConfig.Globals
 	this.maxFilters = conf.MaxFilters
+	this.maxDecoders = conf.MaxDecoders
+	this.decoders = make(map[string]bool)
 	this.workingDirectory = globals.PrependBaseDir(conf.WorkingDirectory)
 	this.moduleDirectory = globals.PrependShareDir(conf.ModuleDirectory)
 	this.memoryLimit = conf.MemoryLimit
@@ -108,25 +117,34 @@ func (this *SandboxManagerFilter) Init(config interface{}) (err error) {
 	return
 }
 
-// Adds running filters count to the report output.
+// Adds running filters and decoders counts to the report output.
 func (this *SandboxManagerFilter) ReportMsg(msg *message.Message) error {
 	message.NewIntField(msg, "RunningFilters", int(atomic.LoadInt32(&this.currentFilters)),
 		"count")
+	message.NewIntField(msg, "RunningDecoders", int(atomic.LoadInt32(&this.currentDecoders)),
+		"count")
 	message.NewInt64Field(msg, "ProcessMessageCount",
 		atomic.LoadInt64(&this.processMessageCount), "count")
 	return nil
 }
 
-// Creates a FilterRunner for the specified sandbox name and configuration.
-func (this *SandboxManagerFilter) createRunner(dir, name string, configSection toml.Primitive) (
-	pipeline.FilterRunner, error) {
+// Creates a plugin maker for the specified sandbox name and configuration,
+// which must be for a SandboxFilter or a SandboxDecoder.
+func (this *SandboxManagerFilter) createMaker(dir, name string, configSection toml.Primitive) (
+	pipeline.MutableMaker, error) {
 
 	maker, err := pipeline.NewPluginMaker(name, this.pConfig, configSection)
 	if err != nil {
 		return nil, err
 	}
-	if maker.Type() != "SandboxFilter" {
-		return nil, fmt.Errorf("Plugin must be a SandboxFilter, received %s",
+	var pluginType string
+	switch maker.Type() {
+	case "SandboxFilter":
+		pluginType = "filter"
+	case "SandboxDecoder":
+		pluginType = "decoder"
+	default:
+		return nil, fmt.Errorf("Plugin must be a SandboxFilter or SandboxDecoder, received %s",
 			maker.Type())
 	}
 
@@ -144,14 +162,20 @@ func (this *SandboxManagerFilter) createRunner(dir, name string, configSection t
 		conf.MemoryLimit = this.memoryLimit
 		conf.InstructionLimit = this.instructionLimit
 		conf.OutputLimit = this.outputLimit
-		conf.PluginType = "filter"
+		conf.PluginType = pluginType
 		return conf, nil
 	}
 	mutMaker.SetPrepConfig(prepConfig)
+	return mutMaker, nil
+}
+
+// Creates a FilterRunner for the specified sandbox name from its maker.
+func (this *SandboxManagerFilter) createRunner(name string, maker pipeline.PluginMaker) (
+	pipeline.FilterRunner, error) {
 
 	// Finally call MakeRunner() to initialize the plugin and create the
 	// runner.
-	runner, err := mutMaker.MakeRunner(name)
+	runner, err := maker.MakeRunner(name)
 	if err != nil {
 		return nil, err
 	}
@@ -160,6 +184,41 @@ func (this *SandboxManagerFilter) createRunner(dir, name string, configSection t
 	return runner.(pipeline.FilterRunner), nil
 }
 
+// Starts the specified sandbox, either as a filter or, for a SandboxDecoder,
+// by making it available to inputs that create decoders from then on. The
+// sandbox's files are removed if it can't be created.
+func (this *SandboxManagerFilter) startSandbox(dir, name string, configSection toml.Primitive) (
+	err error) {
+
+	maker, err := this.createMaker(dir, name, configSection)
+	if err == nil {
+		if maker.Type() == "SandboxFilter" {
+			var runner pipeline.FilterRunner
+			if runner, err = this.createRunner(name, maker); err == nil {
+				// The files are kept if the filter fails to start, so it will
+				// be retried when Heka restarts.
+				if err = this.pConfig.AddFilterRunner(runner); err == nil {
+					atomic.AddInt32(&this.currentFilters, 1)
+				}
+				return
+			}
+		} else {
+			// Make sure the decoder can be created before any input tries to
+			// use it.
+			if _, _, err = maker.Make(); err == nil {
+				err = this.pConfig.AddDecoderMaker(maker)
+			}
+			if err == nil {
+				this.decoders[name] = true
+				atomic.AddInt32(&this.currentDecoders, 1)
+				return
+			}
+		}
+	}
+	removeAll(dir, fmt.Sprintf("%s.*", name))
+	return
+}
+
 // Replaces all non word characters with an underscore and returns the
 // normalized string
 func getNormalizedName(name string) (normalized string) {
@@ -187,7 +246,7 @@ func removeAll(dir, glob string) {
 }
 
 // Parses a Heka message and extracts the information necessary to start a new
-// SandboxFilter
+// SandboxFilter or SandboxDecoder.
 func (this *SandboxManagerFilter) loadSandbox(fr pipeline.FilterRunner,
 	h pipeline.PluginHelper, dir string, msg *message.Message) (err error) {
 
@@ -200,45 +259,62 @@ func (this *SandboxManagerFilter) loadSandbox(fr pipeline.FilterRunner,
 
 		for name, conf := range configFile {
 			name = getSandboxName(fr.Name(), name)
-			if _, ok := h.Filter(name); ok {
+			if _, ok := h.Filter(name); ok || this.decoders[name] {
 				// todo support reload
 				return fmt.Errorf("loadSandbox failed: %s is already running", name)
 			}
-			fr.LogMessage(fmt.Sprintf("Loading: %s", name))
-			confFile := filepath.Join(dir, fmt.Sprintf("%s.toml", name))
-			err = ioutil.WriteFile(confFile, []byte(config), 0600)
-			if err != nil {
-				return
+			var sbc struct {
+				Type       string
+				ScriptType string `toml:"script_type"`
 			}
-			var sbc SandboxConfig
 			// Default, will get overwritten if necessary
 			sbc.ScriptType = "lua"
 			if err = toml.PrimitiveDecode(conf, &sbc); err != nil {
 				return fmt.Errorf("loadSandbox failed: %s\n", err)
 			}
-			scriptFile := filepath.Join(dir, fmt.Sprintf("%s.%s", name, sbc.ScriptType))
-			err = ioutil.WriteFile(scriptFile, []byte(msg.GetPayload()), 0600)
+			if sbc.Type == "SandboxDecoder" {
+				if int(atomic.LoadInt32(&this.currentDecoders)) >= this.maxDecoders {
+					return fmt.Errorf("%s attempted to load more than %d decoders",
+						fr.Name(), this.maxDecoders)
+				}
+			} else if int(atomic.LoadInt32(&this.currentFilters)) >= this.maxFilters {
+				return fmt.Errorf("%s attempted to load more than %d filters",
+					fr.Name(), this.maxFilters)
+			}
+			fr.LogMessage(fmt.Sprintf("Loading: %s", name))
+			confFile := filepath.Join(dir, fmt.Sprintf("%s.toml", name))
+			err = ioutil.WriteFile(confFile, []byte(config), 0600)
 			if err != nil {
-				removeAll(dir, fmt.Sprintf("%s.*", name))
 				return
 			}
-			var runner pipeline.FilterRunner
-			runner, err = this.createRunner(dir, name, conf)
+			scriptFile := filepath.Join(dir, fmt.Sprintf("%s.%s", name, sbc.ScriptType))
+			err = ioutil.WriteFile(scriptFile, []byte(msg.GetPayload()), 0600)
 			if err != nil {
 				removeAll(dir, fmt.Sprintf("%s.*", name))
 				return
 			}
-			err = this.pConfig.AddFilterRunner(runner)
-			if err == nil {
-				atomic.AddInt32(&this.currentFilters, 1)
-			}
+			err = this.startSandbox(dir, name, conf)
 			break // only interested in the first item
 		}
 	}
 	return
 }
 
-// On Heka restarts this function reloads all previously running SandboxFilters
+// Stops the named sandbox and removes its files. Running instances of a
+// decoder aren't stopped, but no new ones will be created.
+func (this *SandboxManagerFilter) unloadSandbox(name string) {
+	if this.pConfig.RemoveFilterRunner(name) {
+		removeAll(this.workingDirectory, fmt.Sprintf("%s.*", name))
+		return
+	}
+	if this.decoders[name] && this.pConfig.RemoveDecoderMaker(name) {
+		delete(this.decoders, name)
+		atomic.AddInt32(&this.currentDecoders, -1)
+		removeAll(this.workingDirectory, fmt.Sprintf("%s.*", name))
+	}
+}
+
+// On Heka restarts this function reloads all previously running sandboxes
 // using the script, configuration, and preservation files in the working
 // directory.
 func (this *SandboxManagerFilter) restoreSandboxes(fr pipeline.FilterRunner,
@@ -253,20 +329,10 @@ func (this *SandboxManagerFilter) restoreSandboxes(fr pipeline.FilterRunner,
 				continue
 			}
 			for _, conf := range configFile {
-				var runner pipeline.FilterRunner
 				name := path.Base(fn[:len(fn)-5])
 				fr.LogMessage(fmt.Sprintf("Loading: %s", name))
-				runner, err = this.createRunner(dir, name, conf)
-				if err != nil {
-					fr.LogError(fmt.Errorf("createRunner failed: %s\n", err.Error()))
-					removeAll(dir, fmt.Sprintf("%s.*", name))
-					break
-				}
-				err = this.pConfig.AddFilterRunner(runner)
-				if err != nil {
-					fr.LogError(err)
-				} else {
-					atomic.AddInt32(&this.currentFilters, 1)
+				if err = this.startSandbox(dir, name, conf); err != nil {
+					fr.LogError(fmt.Errorf("restoreSandboxes failed: %s\n", err.Error()))
 				}
 				break // only interested in the first item
 			}
@@ -301,29 +367,20 @@ func (this *SandboxManagerFilter) Run(fr pipeline.FilterRunner,
 			action, _ := pack.Message.GetFieldValue("action")
 			switch action {
 			case "load":
-				current := int(atomic.LoadInt32(&this.currentFilters))
-				if current < this.maxFilters {
-					err := this.loadSandbox(fr, h, this.workingDirectory, pack.Message)
-					if err != nil {
-						p := h.PipelinePack(0)
-						p.Message.SetType("heka.sandbox-terminated")
-						p.Message.SetLogger(pipeline.HEKA_DAEMON)
-						message.NewStringField(p.Message, "plugin", fr.Name())
-						p.Message.SetPayload(err.Error())
-						fr.Inject(p)
-						fr.LogError(err)
-					}
-				} else {
-					fr.LogError(fmt.Errorf("%s attempted to load more than %d filters",
-						fr.Name(), this.maxFilters))
+				err := this.loadSandbox(fr, h, this.workingDirectory, pack.Message)
+				if err != nil {
+					p := h.PipelinePack(0)
+					p.Message.SetType("heka.sandbox-terminated")
+					p.Message.SetLogger(pipeline.HEKA_DAEMON)
+					message.NewStringField(p.Message, "plugin", fr.Name())
+					p.Message.SetPayload(err.Error())
+					fr.Inject(p)
+					fr.LogError(err)
 				}
 			case "unload":
 				fv, _ := pack.Message.GetFieldValue("name")
 				if name, ok := fv.(string); ok {
-					name = getSandboxName(fr.Name(), name)
-					if this.pConfig.RemoveFilterRunner(name) {
-						removeAll(this.workingDirectory, fmt.Sprintf("%s.*", name))
-					}
+					this.unloadSandbox(getSandboxName(fr.Name(), name))
 				}
 			}
 			pack.Recycle()